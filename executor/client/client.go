@@ -0,0 +1,685 @@
+// client/client.go
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed to write a message to the server
+const writeWait = 10 * time.Second
+
+var (
+	// ErrClosed is returned once the underlying connection has gone away
+	ErrClosed = errors.New("connection closed")
+	// ErrReconnecting is returned for writes attempted while reconnecting
+	ErrReconnecting = errors.New("connection lost, reconnecting")
+	// ErrUnauthorized is returned once the server has closed the connection
+	// because its access token was missing, invalid or expired
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrIdleTimeout is returned once the server has closed the connection
+	// for sitting idle; it is not reconnected, so dial again when needed
+	ErrIdleTimeout = errors.New("closed for idling")
+)
+
+// A connection silent for this many heartbeat intervals is taken to be
+// half-open and dropped
+const heartbeatsMissed = 3
+
+// Client is a Go SDK for the executor WebSocket protocol. It multiplexes any
+// number of streams over a single connection and routes server messages to
+// the stream they belong to.
+type Client struct {
+	url       string
+	header    http.Header
+	dialer    *websocket.Dialer
+	reconnect *ReconnectPolicy
+	encoding  string
+	compress  bool
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	conn         *websocket.Conn
+	codec        protocol.Codec
+	compressed   bool
+	token        string
+	reconnecting bool
+	closed       bool
+	streams      map[string]*Stream
+	groups       map[string]*Group
+	unrouted     chan protocol.WSMessage
+	err          error
+	// hello is the server's latest hello message
+	hello map[string]interface{}
+	// heartbeat is the server's latest heartbeat message, received at
+	// heartbeatAt
+	heartbeat   map[string]interface{}
+	heartbeatAt time.Time
+	// session is the token from the latest hello that resumes the
+	// connection's session on a reconnect
+	session string
+
+	// silence is how long the connection may go without a message, once
+	// the server sends heartbeats; only the reading goroutine uses it
+	silence time.Duration
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Options configures a client connection
+type Options struct {
+	// Dialer defaults to websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	Header http.Header
+
+	// Reconnect enables automatic reconnection when the connection drops.
+	// Without it the client shuts down on the first connection error.
+	Reconnect *ReconnectPolicy
+
+	// Encoding requests a message encoding: protocol.EncodingJSON (the
+	// default), protocol.EncodingMsgpack or protocol.EncodingCBOR. Servers
+	// that do not support it fall back to JSON.
+	Encoding string
+
+	// Compression offers permessage-deflate; it is used only if the server
+	// has compression enabled
+	Compression bool
+
+	// Token is an access token or API key sent as a bearer token with
+	// every handshake, including reconnects; SetToken replaces it before
+	// it expires
+	Token string
+
+	// Values asks for times and arbitrary-precision numbers in rows to be
+	// sent in a format other than the server's default, for the fields it
+	// sets
+	Values protocol.ValueFormat
+}
+
+// Dial connects to the executor WebSocket endpoint
+func Dial(ctx context.Context, url string, header http.Header) (*Client, error) {
+	return DialOptions(ctx, url, Options{Header: header})
+}
+
+// DialWithDialer connects to the executor WebSocket endpoint using a custom dialer
+func DialWithDialer(ctx context.Context, dialer *websocket.Dialer, url string, header http.Header) (*Client, error) {
+	return DialOptions(ctx, url, Options{Dialer: dialer, Header: header})
+}
+
+// DialOptions connects to the executor WebSocket endpoint
+func DialOptions(ctx context.Context, url string, opts Options) (*Client, error) {
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	if _, err := protocol.CodecFor(opts.Encoding); err != nil {
+		return nil, err
+	}
+	url, err := withValueFormat(url, opts.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		url:       url,
+		header:    opts.Header,
+		dialer:    opts.Dialer,
+		reconnect: opts.Reconnect.withDefaults(),
+		encoding:  opts.Encoding,
+		compress:  opts.Compression,
+		token:     opts.Token,
+		streams:   make(map[string]*Stream),
+		groups:    make(map[string]*Group),
+		unrouted:  make(chan protocol.WSMessage, 64),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	conn, compressed, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.codec = protocol.CodecForSubprotocol(conn.Subprotocol())
+	c.compressed = compressed
+
+	go c.run(conn)
+	return c, nil
+}
+
+// withValueFormat adds the query parameters negotiating a value format to
+// the endpoint URL
+func withValueFormat(rawURL string, f protocol.ValueFormat) (string, error) {
+	if f == (protocol.ValueFormat{}) {
+		return rawURL, nil
+	}
+	if err := f.Validate(); err != nil {
+		return "", err
+	}
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parse %s: %w", rawURL, err)
+	}
+	query := u.Query()
+	if f.Times != "" {
+		query.Set(protocol.ValueTimesParam, f.Times)
+	}
+	if f.Numerics != "" {
+		query.Set(protocol.ValueNumericsParam, f.Numerics)
+	}
+	if f.Precision != 0 {
+		query.Set(protocol.ValuePrecisionParam, strconv.Itoa(f.Precision))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// dial connects, reporting whether permessage-deflate was negotiated
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, bool, error) {
+	dialer := *c.dialer
+	if c.encoding != "" && c.encoding != protocol.EncodingJSON {
+		dialer.Subprotocols = []string{protocol.Subprotocol(c.encoding)}
+	}
+	if c.compress {
+		dialer.EnableCompression = true
+	}
+
+	header := c.header
+	c.mu.Lock()
+	token, session := c.token, c.session
+	c.mu.Unlock()
+	if token != "" || session != "" {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	// A reconnect asks to resume the session of the connection it replaces
+	if session != "" {
+		header.Set(protocol.SessionHeader, session)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, c.url, header)
+	if err != nil {
+		return nil, false, fmt.Errorf("dial %s: %w", c.url, err)
+	}
+	compressed := c.compress && strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	return conn, compressed, nil
+}
+
+// Execute submits a query request and returns the stream its results arrive on.
+// A stream ID is generated when the request does not carry one.
+func (c *Client) Execute(req protocol.QueryRequest, opts ...StreamOption) (*Stream, error) {
+	return c.submit(protocol.MessageTypeQuery, req, opts)
+}
+
+func (c *Client) submit(typ protocol.MessageType, req protocol.QueryRequest, opts []StreamOption) (*Stream, error) {
+	if req.StreamID == "" {
+		req.StreamID = uuid.NewString()
+	}
+
+	stream := newStream(c, typ, req)
+	for _, opt := range opts {
+		opt(stream)
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	// A stream ID still in use carries this request after the current one,
+	// as the request's duplicate policy decides
+	stream.prev = c.streams[req.StreamID]
+	c.streams[req.StreamID] = stream
+	c.mu.Unlock()
+
+	if err := c.Send(stream.message()); err != nil {
+		c.unregister(stream)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Attach resumes streaming an async execution, typically one submitted on a
+// previous connection. The request must carry the query and execution IDs.
+// Reading results has no side effects, so attached streams are always
+// resubmitted after a reconnect.
+func (c *Client) Attach(req protocol.QueryRequest, opts ...StreamOption) (*Stream, error) {
+	return c.submit(protocol.MessageTypeAttach, req, append([]StreamOption{Idempotent()}, opts...))
+}
+
+// History lists up to limit recent executions of a query, newest first; a
+// limit of 0 uses the server's default. Any of them can be re-run with
+// Execute by passing its ExecutionID as the request's Replay.
+func (c *Client) History(ctx context.Context, queryID string, limit int64) ([]protocol.ExecutionRecord, error) {
+	stream, err := c.submit(protocol.MessageTypeHistory, protocol.QueryRequest{QueryID: queryID, Limit: limit}, []StreamOption{Idempotent()})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case protocol.MessageTypeError:
+			reason, _ := msg.Payload["error"].(string)
+			return nil, fmt.Errorf("history of %s: %s", queryID, reason)
+		case protocol.MessageTypeHistory:
+			// The payload arrives as generic values in any encoding, so it
+			// is converted through JSON
+			data, err := json.Marshal(msg.Payload["executions"])
+			if err != nil {
+				return nil, fmt.Errorf("history of %s: %w", queryID, err)
+			}
+			var records []protocol.ExecutionRecord
+			if err := json.Unmarshal(data, &records); err != nil {
+				return nil, fmt.Errorf("history of %s: %w", queryID, err)
+			}
+			return records, nil
+		}
+	}
+}
+
+// TestConnection asks the server to check a connector can be reached. A
+// connector that cannot be is reported by the result's Status and Error;
+// the error return is for a test that could not run.
+func (c *Client) TestConnection(ctx context.Context, connectorID string) (*protocol.ConnectionTest, error) {
+	stream, err := c.submit(protocol.MessageTypeTestConnection, protocol.QueryRequest{ConnectorID: connectorID}, []StreamOption{Idempotent()})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case protocol.MessageTypeError:
+			reason, _ := msg.Payload["error"].(string)
+			return nil, fmt.Errorf("test connection %s: %s", connectorID, reason)
+		case protocol.MessageTypeTestConnection:
+			data, err := json.Marshal(msg.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("test connection %s: %w", connectorID, err)
+			}
+			var result protocol.ConnectionTest
+			if err := json.Unmarshal(data, &result); err != nil {
+				return nil, fmt.Errorf("test connection %s: %w", connectorID, err)
+			}
+			return &result, nil
+		}
+	}
+}
+
+// Cancel asks the server to cancel a queued or running stream
+func (c *Client) Cancel(streamID string) error {
+	return c.Send(protocol.ClientMessage{
+		Type:         protocol.MessageTypeCancel,
+		QueryRequest: protocol.QueryRequest{StreamID: streamID},
+	})
+}
+
+// SetToken sends a fresh access token for the connection's user to the
+// server, which must arrive before the current one expires. It is also
+// used when reconnecting.
+func (c *Client) SetToken(token string) error {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+	return c.Send(protocol.ClientMessage{Type: protocol.MessageTypeAuth, Token: token})
+}
+
+// Send writes an arbitrary message to the server in the connection's encoding
+func (c *Client) Send(v interface{}) error {
+	c.mu.Lock()
+	conn, codec, reconnecting := c.conn, c.codec, c.reconnecting
+	c.mu.Unlock()
+	if reconnecting {
+		return ErrReconnecting
+	}
+
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+	frameType := websocket.TextMessage
+	if codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+	return c.write(conn, frameType, data)
+}
+
+// SendRaw writes a raw text frame to the server without validating it
+func (c *Client) SendRaw(data []byte) error {
+	c.mu.Lock()
+	conn, reconnecting := c.conn, c.reconnecting
+	c.mu.Unlock()
+	if reconnecting {
+		return ErrReconnecting
+	}
+	return c.write(conn, websocket.TextMessage, data)
+}
+
+// Compressed reports whether permessage-deflate was negotiated with the server
+func (c *Client) Compressed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compressed
+}
+
+// Encoding returns the message encoding negotiated with the server
+func (c *Client) Encoding() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.codec.Name()
+}
+
+// Values returns the value format the server sends rows in, as announced
+// in its latest hello
+func (c *Client) Values() protocol.ValueFormat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var f protocol.ValueFormat
+	values, _ := c.hello["values"].(map[string]interface{})
+	f.Times, _ = values["times"].(string)
+	f.Numerics, _ = values["numerics"].(string)
+	if precision, ok := payloadInt(values["precision"]); ok {
+		f.Precision = int(precision)
+	}
+	return f
+}
+
+func (c *Client) write(conn *websocket.Conn, frameType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	return nil
+}
+
+// Unrouted delivers server messages that do not belong to a known stream,
+// such as errors for malformed requests
+func (c *Client) Unrouted() <-chan protocol.WSMessage {
+	return c.unrouted
+}
+
+// InstanceID names the server replica of the current connection once it
+// has said hello; it changes when a reconnect lands on another replica
+func (c *Client) InstanceID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, _ := c.hello["instanceId"].(string)
+	return id
+}
+
+// Heartbeat returns the server's latest heartbeat, with "serverTime" and
+// "activeStreams", and when it arrived; nil before the first one or when
+// the server sends none
+func (c *Client) Heartbeat() (map[string]interface{}, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heartbeat, c.heartbeatAt
+}
+
+// Done is closed when the connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that terminated the connection, if any
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close performs a clean close handshake and releases the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		<-c.done
+		return nil
+	}
+	c.closed = true
+	close(c.closing)
+	conn := c.conn
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(writeWait))
+	c.writeMu.Unlock()
+
+	err := conn.Close()
+	<-c.done
+	return err
+}
+
+// run reads from the connection, reconnecting when allowed, until the
+// client is closed or gives up
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+
+	for {
+		err := c.readLoop(conn)
+
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		// A rejected token would be rejected again
+		if websocket.IsCloseError(err, protocol.CloseUnauthorized) {
+			c.shutdown(fmt.Errorf("%w: %v", ErrUnauthorized, err))
+			return
+		}
+		if websocket.IsCloseError(err, protocol.CloseIdleTimeout) {
+			c.shutdown(fmt.Errorf("%w: %v", ErrIdleTimeout, err))
+			return
+		}
+		if c.reconnect == nil || closed {
+			c.shutdown(err)
+			return
+		}
+
+		if conn, err = c.recover(err); err != nil {
+			c.shutdown(err)
+			return
+		}
+	}
+}
+
+func (c *Client) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = fmt.Errorf("%w: %w", ErrClosed, err)
+}
+
+// readLoop routes every incoming message to its stream until the connection
+// ends. Once the server says it sends heartbeats, a connection that falls
+// silent for several of them is dropped as half-open.
+func (c *Client) readLoop(conn *websocket.Conn) error {
+	for {
+		msg, err := c.readMessage(conn)
+		if err != nil {
+			return err
+		}
+		c.handle(conn, msg)
+	}
+}
+
+// readMessage reads and decodes the connection's next message
+func (c *Client) readMessage(conn *websocket.Conn) (protocol.WSMessage, error) {
+	var msg protocol.WSMessage
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	if c.silence > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.silence))
+	}
+
+	if frameType == websocket.BinaryMessage {
+		c.mu.Lock()
+		codec := c.codec
+		c.mu.Unlock()
+		err = codec.Unmarshal(data, &msg)
+	} else {
+		err = json.Unmarshal(data, &msg)
+	}
+	if err != nil {
+		return msg, fmt.Errorf("decode message: %w", err)
+	}
+	return msg, nil
+}
+
+// handle routes a message read from the connection
+func (c *Client) handle(conn *websocket.Conn, msg protocol.WSMessage) {
+	// Each connection, including reconnects, opens with a hello
+	if msg.Type == protocol.MessageTypeHello {
+		c.mu.Lock()
+		c.hello = msg.Payload
+		c.session, _ = msg.Payload["sessionToken"].(string)
+		c.mu.Unlock()
+		c.silence = 0
+		if ms, ok := payloadInt(msg.Payload["heartbeatIntervalMs"]); ok && ms > 0 {
+			c.silence = heartbeatsMissed * time.Duration(ms) * time.Millisecond
+			conn.SetReadDeadline(time.Now().Add(c.silence))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		return
+	}
+	if msg.Type == protocol.MessageTypeHeartbeat {
+		c.mu.Lock()
+		c.heartbeat = msg.Payload
+		c.heartbeatAt = time.Now()
+		c.mu.Unlock()
+		return
+	}
+
+	if msg.Type == protocol.MessageTypeGroup {
+		c.routeGroup(msg)
+		return
+	}
+
+	stream, ok := c.route(msg)
+	if ok {
+		if stream.observe(msg) {
+			stream.push(msg)
+		}
+		return
+	}
+
+	// Messages for streams we no longer track are dropped; anything
+	// without a stream is surfaced to the caller
+	if msg.StreamID == "" {
+		select {
+		case c.unrouted <- msg:
+		default:
+		}
+	}
+}
+
+// route picks the stream a message belongs to. Requests submitted on a
+// stream ID in use wait behind the one holding it, so a stream ID carries
+// several streams in turn: the server's reply to a request goes to the
+// oldest stream awaiting one, and anything else to the oldest whose
+// execution has not ended.
+func (c *Client) route(msg protocol.WSMessage) (*Stream, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	newest, ok := c.streams[msg.StreamID]
+	if !ok {
+		return nil, false
+	}
+
+	var chain []*Stream
+	for s := newest; s != nil; s = s.prev {
+		chain = append(chain, s)
+	}
+	reply := isReply(msg)
+	pruning := true
+	for i := len(chain) - 1; i >= 0; i-- {
+		answered, ended := chain[i].state()
+		if ended {
+			// Nothing more arrives for the oldest streams once they end
+			if pruning && i > 0 {
+				chain[i-1].prev = nil
+			}
+			continue
+		}
+		pruning = false
+		if !reply || !answered {
+			return chain[i], true
+		}
+	}
+	return newest, true
+}
+
+// routeGroup hands a group message to its group, forgetting the group once
+// it has ended
+func (c *Client) routeGroup(msg protocol.WSMessage) {
+	id, _ := msg.Payload["groupId"].(string)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if g, ok := c.groups[id]; ok && g.observe(msg) {
+		delete(c.groups, id)
+	}
+}
+
+// isReply reports whether a message answers a request rather than belonging
+// to an execution: a waiting status or a rejection
+func isReply(msg protocol.WSMessage) bool {
+	switch msg.Type {
+	case protocol.MessageTypeStatus:
+		return msg.Payload["status"] == protocol.StatusWaiting
+	case protocol.MessageTypeError:
+		rejected, _ := msg.Payload["rejected"].(bool)
+		return rejected
+	}
+	return false
+}
+
+// unregister stops routing messages to stream, handing its stream ID back to
+// the stream it followed until that one ends
+func (c *Client) unregister(stream *Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streams[stream.ID] != stream {
+		return
+	}
+	if prev := stream.prev; prev != nil {
+		if _, ended := prev.state(); !ended {
+			c.streams[stream.ID] = prev
+			return
+		}
+	}
+	delete(c.streams, stream.ID)
+}
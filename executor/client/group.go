@@ -0,0 +1,173 @@
+// client/group.go
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/google/uuid"
+)
+
+// ErrGroupInterrupted ends a group whose connection was lost before its
+// last stream ended. Its streams are resubmitted on their own, if they can
+// be, but the new connection does not report on them as a group.
+var ErrGroupInterrupted = errors.New("connection lost before the group ended")
+
+// Group is a batch of streams submitted together, which the server reports
+// on as a whole each time one of them ends
+type Group struct {
+	ID      string
+	Streams []*Stream
+
+	client *Client
+	mu     sync.Mutex
+	status GroupStatus
+	done   chan struct{}
+	err    error
+}
+
+// GroupStatus is a group's progress, or its outcome once Status is no
+// longer running
+type GroupStatus struct {
+	Status    string
+	Total     int
+	Completed int
+	Failed    int
+	Cancelled int
+	Pending   int
+	Elapsed   time.Duration
+	// Error is set when the server rejected the batch
+	Error string
+}
+
+// Batch submits requests as a group, returning the group with a stream for
+// each request in order. A group ID and stream IDs are generated when not
+// set; a group ID cannot be reused until its group has ended.
+func (c *Client) Batch(groupID string, reqs []protocol.QueryRequest, opts ...StreamOption) (*Group, error) {
+	if groupID == "" {
+		groupID = uuid.NewString()
+	}
+	g := &Group{
+		ID:     groupID,
+		client: c,
+		status: GroupStatus{Status: protocol.StatusRunning, Total: len(reqs), Pending: len(reqs)},
+		done:   make(chan struct{}),
+	}
+	msg := protocol.ClientMessage{Type: protocol.MessageTypeBatch, QueryRequest: protocol.QueryRequest{GroupID: groupID}}
+	for _, req := range reqs {
+		if req.StreamID == "" {
+			req.StreamID = uuid.NewString()
+		}
+		req.GroupID = groupID
+		stream := newStream(c, protocol.MessageTypeQuery, req)
+		for _, opt := range opts {
+			opt(stream)
+		}
+		g.Streams = append(g.Streams, stream)
+		msg.Queries = append(msg.Queries, stream.message().QueryRequest)
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if _, exists := c.groups[groupID]; exists {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("group %s has not ended", groupID)
+	}
+	for _, stream := range g.Streams {
+		stream.prev = c.streams[stream.ID]
+		c.streams[stream.ID] = stream
+	}
+	c.groups[groupID] = g
+	c.mu.Unlock()
+
+	if err := c.Send(msg); err != nil {
+		for _, stream := range g.Streams {
+			c.unregister(stream)
+		}
+		c.mu.Lock()
+		delete(c.groups, groupID)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return g, nil
+}
+
+// observe records a group message, ending the group once it reports its
+// outcome
+func (g *Group) observe(msg protocol.WSMessage) (ended bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status, _ := msg.Payload["status"].(string)
+	g.status.Status = status
+	g.status.Error, _ = msg.Payload["error"].(string)
+	for field, count := range map[string]*int{
+		"total":     &g.status.Total,
+		"completed": &g.status.Completed,
+		"failed":    &g.status.Failed,
+		"cancelled": &g.status.Cancelled,
+		"pending":   &g.status.Pending,
+	} {
+		if n, ok := payloadInt(msg.Payload[field]); ok {
+			*count = int(n)
+		}
+	}
+	if ms, ok := payloadInt(msg.Payload["elapsedMs"]); ok {
+		g.status.Elapsed = time.Duration(ms) * time.Millisecond
+	}
+	if status == protocol.StatusRunning {
+		return false
+	}
+	close(g.done)
+	return true
+}
+
+// fail ends the group locally with err
+func (g *Group) fail(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.err = err
+	close(g.done)
+}
+
+// Progress returns the group's latest reported progress
+func (g *Group) Progress() GroupStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status
+}
+
+// Wait blocks until every stream of the group has ended and returns the
+// group's outcome. Each stream's results are read from the stream itself.
+func (g *Group) Wait(ctx context.Context) (GroupStatus, error) {
+	select {
+	case <-g.done:
+	case <-ctx.Done():
+		return g.Progress(), ctx.Err()
+	case <-g.client.done:
+		select {
+		case <-g.done:
+		default:
+			return g.Progress(), g.client.Err()
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.status, g.err
+}
+
+// Cancel asks the server to cancel every stream of the group
+func (g *Group) Cancel() error {
+	return g.client.Send(protocol.ClientMessage{
+		Type:         protocol.MessageTypeCancel,
+		QueryRequest: protocol.QueryRequest{GroupID: g.ID},
+	})
+}
@@ -0,0 +1,241 @@
+// client/reconnect.go
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrMustReexecute fails streams that cannot be resumed after a reconnect
+// because the server had already started executing them. The caller has
+// to decide whether running the query again is safe.
+var ErrMustReexecute = errors.New("stream interrupted by connection loss and cannot be resumed; re-execute the query")
+
+// Time allowed for a new connection to say hello
+const helloTimeout = 10 * time.Second
+
+// ReconnectPolicy controls automatic reconnection with exponential backoff
+type ReconnectPolicy struct {
+	// MaxAttempts bounds consecutive failed dials; zero retries forever
+	MaxAttempts int
+	// InitialBackoff is the delay before the first attempt (default 250ms)
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts (default 30s)
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after each failed attempt (default 2)
+	Multiplier float64
+}
+
+func (p *ReconnectPolicy) withDefaults() *ReconnectPolicy {
+	if p == nil {
+		return nil
+	}
+
+	policy := *p
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 250 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 30 * time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	return &policy
+}
+
+// backoff returns the jittered delay before the given attempt (1-based)
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt && delay < float64(p.MaxBackoff); i++ {
+		delay *= p.Multiplier
+	}
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	// Spread reconnecting clients out so they do not arrive in lockstep
+	return time.Duration(delay/2 + rand.Float64()*delay/2)
+}
+
+// recover re-establishes the connection after it was lost with cause. The
+// new connection resumes the old one's session where the server allows it,
+// in which case streams it kept queued carry on as they were. Other streams
+// that can be resumed are resubmitted on the new connection; the rest fail
+// with ErrMustReexecute.
+func (c *Client) recover(cause error) (*websocket.Conn, error) {
+	c.mu.Lock()
+	c.reconnecting = true
+	for id, g := range c.groups {
+		delete(c.groups, id)
+		g.fail(ErrGroupInterrupted)
+	}
+	for id, stream := range c.streams {
+		// Streams a later request on the stream ID followed are not
+		// resubmitted; it would replace them or wait for them again
+		for prev := stream.prev; prev != nil; prev = prev.prev {
+			if _, ended := prev.state(); !ended {
+				prev.fail(fmt.Errorf("%w (followed by another request on the stream)", ErrMustReexecute))
+			}
+		}
+		stream.prev = nil
+		// Whether a stream that had not started can carry on is known once
+		// the new connection says what its session kept
+		if stream.pending() {
+			continue
+		}
+		if err := stream.resumable(); err != nil {
+			delete(c.streams, id)
+			stream.fail(err)
+		}
+	}
+	waiting := len(c.streams)
+	c.mu.Unlock()
+
+	log.Printf("Connection lost (%v), reconnecting with %d streams waiting", cause, waiting)
+
+	for attempt := 1; c.reconnect.MaxAttempts == 0 || attempt <= c.reconnect.MaxAttempts; attempt++ {
+		select {
+		case <-c.closing:
+			return nil, cause
+		case <-time.After(c.reconnect.backoff(attempt)):
+		}
+
+		conn, compressed, err := c.dial(context.Background())
+		if err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+			continue
+		}
+		c.mu.Lock()
+		c.codec = protocol.CodecForSubprotocol(conn.Subprotocol())
+		c.mu.Unlock()
+		hello, err := c.awaitHello(conn)
+		if err != nil {
+			log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+			conn.Close()
+			continue
+		}
+		kept := make(map[string]bool)
+		if ids, ok := hello["resumedStreams"].([]interface{}); ok {
+			for _, id := range ids {
+				if id, ok := id.(string); ok {
+					kept[id] = true
+				}
+			}
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return nil, cause
+		}
+		var resubmit []*Stream
+		for id, stream := range c.streams {
+			if kept[id] {
+				delete(kept, id)
+				stream.resumed()
+				continue
+			}
+			if err := stream.resumable(); err != nil {
+				delete(c.streams, id)
+				stream.fail(err)
+				continue
+			}
+			resubmit = append(resubmit, stream)
+		}
+		c.conn = conn
+		c.compressed = compressed
+		c.reconnecting = false
+		c.mu.Unlock()
+
+		// Streams the session kept that the client no longer waits for
+		for id := range kept {
+			c.Send(protocol.ClientMessage{Type: protocol.MessageTypeCancel, QueryRequest: protocol.QueryRequest{StreamID: id}})
+		}
+		for _, stream := range resubmit {
+			if err := c.Send(stream.message()); err != nil {
+				// The new connection is already gone; the next recovery
+				// round will pick the stream up again
+				break
+			}
+		}
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("reconnect failed after %d attempts: %w", c.reconnect.MaxAttempts, cause)
+}
+
+// awaitHello reads a new connection's messages up to its hello, which says
+// what the server kept of the session
+func (c *Client) awaitHello(conn *websocket.Conn) (map[string]interface{}, error) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	for {
+		msg, err := c.readMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("await hello: %w", err)
+		}
+		c.handle(conn, msg)
+		if msg.Type == protocol.MessageTypeHello {
+			return msg.Payload, nil
+		}
+	}
+}
+
+// pending reports whether the server had yet to start the stream, so a
+// resumed session may have kept it queued
+func (s *Stream) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.started && s.rowsReceived == 0 && s.executionID == ""
+}
+
+// resumed carries on a stream the server kept queued across a reconnect,
+// which numbers its messages afresh on the new connection
+func (s *Stream) resumed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq = 0
+}
+
+// resumable reports whether the stream can be resubmitted after a reconnect,
+// switching async streams to attach by execution ID. Streams that allow it
+// resume after the rows already received.
+func (s *Stream) resumable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resuming := s.rowsReceived > 0 && s.resumeRows && (s.idempotent || s.executionID != "")
+	if s.rowsReceived > 0 && !resuming {
+		return fmt.Errorf("%w (%d rows already received)", ErrMustReexecute, s.rowsReceived)
+	}
+	if resuming {
+		s.req.ResumeAfterRows = s.rowsReceived
+		s.req.ResumeChecksum = s.checksum.Sum()
+	}
+
+	// A resubmitted stream is numbered afresh by the server
+	s.lastSeq = 0
+	s.answered = false
+
+	// A submitted async execution keeps running on the engine and can be
+	// re-attached without running the query again
+	if s.executionID != "" {
+		s.msgType = protocol.MessageTypeAttach
+		s.req.ExecutionID = s.executionID
+		s.started = false
+		return nil
+	}
+
+	if (s.started && !resuming) || !s.idempotent {
+		return ErrMustReexecute
+	}
+	return nil
+}
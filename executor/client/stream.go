@@ -0,0 +1,499 @@
+// client/stream.go
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"supalytics-executor/protocol"
+)
+
+// Stream receives the messages the server sends for a single streamId.
+// Messages are buffered without bound so a slow consumer of one stream
+// never blocks delivery to the others.
+type Stream struct {
+	ID string
+
+	client *Client
+	mu     sync.Mutex
+	queue  []protocol.WSMessage
+	notify chan struct{}
+	err    error
+
+	// Submission details used to decide whether the stream can be
+	// resubmitted after a reconnect
+	msgType      protocol.MessageType
+	req          protocol.QueryRequest
+	idempotent   bool
+	started      bool
+	rowsReceived int64
+	executionID  string
+
+	// lastSeq is the sequence number of the last message delivered; a
+	// message that skips ahead records where the gap ended in gapAt
+	lastSeq int64
+	gapAt   int64
+	gapErr  error
+
+	// autoCredit grants credit for rows as the caller consumes them
+	autoCredit bool
+
+	// checksum follows the rows received so the server's checksums in row
+	// batches and the complete message can be verified; checksumAt is the
+	// sequence number of the batch that first failed verification
+	checksum    *protocol.RowChecksum
+	checksumErr error
+	checksumAt  int64
+
+	// resumeRows lets the stream carry on after a reconnect even once rows
+	// were received
+	resumeRows bool
+
+	// prev is the stream submitted before this one on the same stream ID,
+	// whose messages come first; it is guarded by the client's lock.
+	// answered is set once the server has accepted or rejected the request,
+	// ended once its execution has ended.
+	prev     *Stream
+	answered bool
+	ended    bool
+}
+
+// ErrSequenceGap reports messages the server numbered but the client never
+// received. Next returns it along with the first message after the gap.
+var ErrSequenceGap = errors.New("stream sequence gap")
+
+// ErrIntegrity reports rows lost or reordered between the server and the
+// client, detected by a checksum mismatch at the end of the stream
+var ErrIntegrity = errors.New("stream integrity check failed")
+
+// StreamOption configures how a stream is submitted
+type StreamOption func(*Stream)
+
+// Idempotent marks a query as safe to run more than once, allowing the
+// client to resubmit it automatically if the connection drops before the
+// server starts executing it.
+func Idempotent() StreamOption {
+	return func(s *Stream) {
+		s.idempotent = true
+	}
+}
+
+// FlowControl limits the server to window rows ahead of the caller. Credit
+// is granted back as Next hands rows over, so a consumer that falls behind
+// pauses the query instead of buffering its results without bound.
+func FlowControl(window int64) StreamOption {
+	return func(s *Stream) {
+		s.req.Credits = window
+		s.autoCredit = true
+	}
+}
+
+// BatchChecksums asks the server for the checksum of the rows so far with
+// every row batch, so Next reports rows lost or corrupted in transit with
+// the batch they affect instead of only at the end of the stream.
+func BatchChecksums() StreamOption {
+	return func(s *Stream) {
+		s.req.BatchChecksums = true
+	}
+}
+
+// ResumeRows lets an idempotent or async stream that already received rows
+// carry on after a reconnect. The query runs again and the server skips the
+// rows received, sending only the rest; if the rows it skipped are not the
+// ones received, the stream fails with protocol.ErrorCodeIntegrity.
+func ResumeRows() StreamOption {
+	return func(s *Stream) {
+		s.resumeRows = true
+	}
+}
+
+// Result is the collected outcome of a stream
+type Result struct {
+	Columns []string
+	// Nullable says whether the engine allows each column to hold nulls,
+	// nil for columns it does not declare; nil when it declares none
+	Nullable []*bool
+	// Scales gives the decimal places of each fixed-point numeric column,
+	// nil for other columns; nil when there are none
+	Scales    []*int
+	Rows      [][]interface{}
+	TotalRows int64
+	// Truncated is set when the result continued past the requested page
+	Truncated bool
+	// FromCache is set when the server replayed a cached result
+	FromCache bool
+	// Sample describes the sample the rows were reduced to, when the
+	// request asked for one
+	Sample *protocol.SampleInfo
+	// LimitExceeded is set when the server stopped the stream at one of
+	// its row or byte caps; Rows holds what was sent before it
+	LimitExceeded *protocol.LimitExceeded
+	// QueryVersion is the version of the query that ran, for versioned
+	// queries
+	QueryVersion int
+	// SnapshotURL downloads the result from object storage when the query
+	// asked for a snapshot
+	SnapshotURL string
+
+	Status    string
+	Error     string
+	ErrorCode string
+	// Engine is what the engine reported about an error it raised
+	Engine *protocol.EngineError
+	// SQL is the rendered SQL of a failed debug request
+	SQL      string
+	Messages []protocol.WSMessage
+}
+
+func newStream(c *Client, typ protocol.MessageType, req protocol.QueryRequest) *Stream {
+	return &Stream{
+		ID:       req.StreamID,
+		client:   c,
+		checksum: protocol.NewRowChecksumCodec(c.codec),
+		notify:   make(chan struct{}, 1),
+		msgType:  typ,
+		req:      req,
+	}
+}
+
+// message builds the request that (re)submits the stream
+func (s *Stream) message() protocol.ClientMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return protocol.ClientMessage{Type: s.msgType, QueryRequest: s.req}
+}
+
+// observe tracks how far the server got with the stream, reporting whether
+// the message should be delivered. Duplicates of messages already delivered
+// are discarded.
+func (s *Stream) observe(msg protocol.WSMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Servers that predate sequence numbers send none
+	if msg.Seq != 0 {
+		if msg.Seq <= s.lastSeq {
+			return false
+		}
+		if msg.Seq > s.lastSeq+1 && s.gapErr == nil {
+			s.gapAt = msg.Seq
+			s.gapErr = fmt.Errorf("%w: messages %d to %d were not received", ErrSequenceGap, s.lastSeq+1, msg.Seq-1)
+		}
+		s.lastSeq = msg.Seq
+	}
+
+	s.answered = true
+	switch msg.Type {
+	case protocol.MessageTypeMetadata:
+		s.started = true
+	case protocol.MessageTypeRow:
+		rows, _ := msg.Payload["data"].([]interface{})
+		s.rowsReceived += int64(len(rows))
+		for _, r := range rows {
+			row, _ := r.([]interface{})
+			s.checksum.Add(row)
+		}
+		if want, ok := msg.Payload["checksum"].(string); ok && want != s.checksum.Sum() && s.checksumErr == nil {
+			s.checksumAt = msg.Seq
+			s.checksumErr = fmt.Errorf("%w: received %d rows with checksum %s, server sent checksum %s",
+				ErrIntegrity, s.rowsReceived, s.checksum.Sum(), want)
+		}
+	case protocol.MessageTypeComplete:
+		// Servers that predate checksums send none
+		if want, ok := msg.Payload["checksum"].(string); ok && want != s.checksum.Sum() && s.checksumErr == nil {
+			s.checksumErr = fmt.Errorf("%w: received %d rows with checksum %s, server sent checksum %s",
+				ErrIntegrity, s.rowsReceived, s.checksum.Sum(), want)
+		}
+	case protocol.MessageTypeError:
+		// A rejected request never runs
+		if rejected, _ := msg.Payload["rejected"].(bool); rejected {
+			s.ended = true
+		}
+	case protocol.MessageTypeStatus:
+		status, _ := msg.Payload["status"].(string)
+		if protocol.IsTerminalStatus(status) {
+			s.ended = true
+		}
+		switch status {
+		case protocol.StatusRunning:
+			s.started = true
+		case protocol.StatusSubmitted:
+			s.executionID, _ = msg.Payload["executionId"].(string)
+		}
+	}
+	return true
+}
+
+// state reports whether the server has answered the stream's request and
+// whether its execution has ended
+func (s *Stream) state() (answered, ended bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.answered, s.ended
+}
+
+// fail ends the stream locally with err once queued messages are consumed
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) push(msg protocol.WSMessage) {
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until the next message for this stream arrives
+func (s *Stream) Next(ctx context.Context) (protocol.WSMessage, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			msg := s.queue[0]
+			s.queue = s.queue[1:]
+			var checksumErr error
+			if msg.Type == protocol.MessageTypeComplete || (msg.Seq != 0 && msg.Seq == s.checksumAt) {
+				checksumErr = s.checksumErr
+			}
+			autoCredit := s.autoCredit
+			var gapErr error
+			if msg.Seq != 0 && msg.Seq == s.gapAt {
+				gapErr = s.gapErr
+			}
+			s.mu.Unlock()
+			if autoCredit && msg.Type == protocol.MessageTypeRow {
+				if rows, _ := msg.Payload["data"].([]interface{}); len(rows) > 0 {
+					// A failed grant means the connection is gone, which
+					// the stream reports on its own
+					s.Grant(int64(len(rows)))
+				}
+			}
+			if gapErr != nil {
+				return msg, gapErr
+			}
+			if checksumErr != nil {
+				return msg, checksumErr
+			}
+			return msg, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return protocol.WSMessage{}, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return protocol.WSMessage{}, ctx.Err()
+		case <-s.notify:
+		case <-s.client.done:
+			// Drain anything delivered before the connection ended
+			s.mu.Lock()
+			pending := len(s.queue)
+			s.mu.Unlock()
+			if pending == 0 {
+				return protocol.WSMessage{}, s.client.Err()
+			}
+		}
+	}
+}
+
+// Grant allows a flow-controlled stream to send n more rows
+func (s *Stream) Grant(n int64) error {
+	return s.client.Send(protocol.ClientMessage{
+		Type:         protocol.MessageTypeCredit,
+		QueryRequest: protocol.QueryRequest{StreamID: s.ID, Credits: n},
+	})
+}
+
+// Cancel asks the server to cancel this stream
+func (s *Stream) Cancel() error {
+	return s.client.Cancel(s.ID)
+}
+
+// Close stops routing messages to this stream
+func (s *Stream) Close() {
+	s.client.unregister(s)
+}
+
+// Collect reads the stream until it reaches a terminal status or an error
+// and returns everything that was received. The stream is closed afterwards.
+func (s *Stream) Collect(ctx context.Context) (*Result, error) {
+	defer s.Close()
+
+	result := &Result{}
+	for {
+		msg, err := s.Next(ctx)
+		if err != nil {
+			return result, err
+		}
+		result.Messages = append(result.Messages, msg)
+
+		switch msg.Type {
+		case protocol.MessageTypeMetadata:
+			result.Columns = metadataColumns(msg.Payload)
+			result.Nullable = metadataNullable(msg.Payload)
+			result.Scales = metadataScales(msg.Payload)
+			if version, ok := payloadInt(msg.Payload["queryVersion"]); ok {
+				result.QueryVersion = int(version)
+			}
+
+		case protocol.MessageTypeRow:
+			rows, ok := msg.Payload["data"].([]interface{})
+			if !ok {
+				return result, errors.New("row message without data")
+			}
+			for _, r := range rows {
+				row, ok := r.([]interface{})
+				if !ok {
+					return result, fmt.Errorf("unexpected row type %T", r)
+				}
+				result.Rows = append(result.Rows, row)
+			}
+
+		case protocol.MessageTypeComplete:
+			if total, ok := payloadInt(msg.Payload["totalRows"]); ok {
+				result.TotalRows = total
+			}
+			result.Truncated, _ = msg.Payload["truncated"].(bool)
+			result.FromCache, _ = msg.Payload["fromCache"].(bool)
+			if limit, ok := msg.Payload["limitExceeded"].(map[string]interface{}); ok {
+				result.LimitExceeded = &protocol.LimitExceeded{}
+				result.LimitExceeded.Limit, _ = limit["limit"].(string)
+				result.LimitExceeded.Max, _ = payloadInt(limit["max"])
+			}
+			if sample, ok := msg.Payload["sample"].(map[string]interface{}); ok {
+				result.Sample = &protocol.SampleInfo{}
+				result.Sample.Method, _ = sample["method"].(string)
+				result.Sample.RowsSeen, _ = payloadInt(sample["rowsSeen"])
+				result.Sample.RowsSampled, _ = payloadInt(sample["rowsSampled"])
+			}
+			if snapshot, ok := msg.Payload["snapshot"].(map[string]interface{}); ok {
+				result.SnapshotURL, _ = snapshot["url"].(string)
+			}
+
+		case protocol.MessageTypeError:
+			result.Error, _ = msg.Payload["error"].(string)
+			result.ErrorCode, _ = msg.Payload["code"].(string)
+			result.SQL, _ = msg.Payload["sql"].(string)
+			if engine, ok := msg.Payload["engine"].(map[string]interface{}); ok {
+				result.Engine = engineError(engine)
+			}
+			result.Status = protocol.StatusFailed
+			return result, nil
+
+		case protocol.MessageTypeStatus:
+			status, _ := msg.Payload["status"].(string)
+			if status == protocol.StatusTimeout {
+				result.Error, _ = msg.Payload["reason"].(string)
+				result.ErrorCode, _ = msg.Payload["code"].(string)
+			}
+			if protocol.IsTerminalStatus(status) {
+				result.Status = status
+				return result, nil
+			}
+		}
+	}
+}
+
+func metadataColumns(payload map[string]interface{}) []string {
+	metadata, ok := payload["metadata"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	raw, ok := metadata["columns"].([]interface{})
+	if !ok {
+		return nil
+	}
+	columns := make([]string, 0, len(raw))
+	for _, c := range raw {
+		if name, ok := c.(string); ok {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+func metadataNullable(payload map[string]interface{}) []*bool {
+	metadata, _ := payload["metadata"].(map[string]interface{})
+	raw, ok := metadata["nullable"].([]interface{})
+	if !ok {
+		return nil
+	}
+	nullable := make([]*bool, len(raw))
+	for i, v := range raw {
+		if b, ok := v.(bool); ok {
+			nullable[i] = &b
+		}
+	}
+	return nullable
+}
+
+func metadataScales(payload map[string]interface{}) []*int {
+	metadata, _ := payload["metadata"].(map[string]interface{})
+	raw, ok := metadata["scales"].([]interface{})
+	if !ok {
+		return nil
+	}
+	scales := make([]*int, len(raw))
+	for i, v := range raw {
+		if n, ok := payloadInt(v); ok {
+			scale := int(n)
+			scales[i] = &scale
+		}
+	}
+	return scales
+}
+
+// engineError reads the engine detail of an error payload
+func engineError(engine map[string]interface{}) *protocol.EngineError {
+	e := &protocol.EngineError{}
+	e.Code, _ = engine["code"].(string)
+	e.SQLState, _ = engine["sqlState"].(string)
+	e.Detail, _ = engine["detail"].(string)
+	e.Hint, _ = engine["hint"].(string)
+	position, _ := payloadInt(engine["position"])
+	line, _ := payloadInt(engine["line"])
+	column, _ := payloadInt(engine["column"])
+	e.Position, e.Line, e.Column = int(position), int(line), int(column)
+	return e
+}
+
+// payloadInt reads an integer payload field, which JSON decodes as a float
+// and binary encodings as a sized integer
+func payloadInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,174 @@
+// client/subscription.go
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"supalytics-executor/protocol"
+)
+
+// ErrSubscriptionEnded is returned by Subscription.Next once the server has
+// ended the subscription: it was cancelled, its first run failed or the
+// server rejected it
+var ErrSubscriptionEnded = errors.New("subscription ended")
+
+// Subscription is the stream of a live query, holding its latest result as
+// updates arrive
+type Subscription struct {
+	*Stream
+	keyColumns []string
+
+	// Revision, Columns and Rows are the latest result, once Next has
+	// returned an update
+	Revision int64
+	Columns  []string
+	Rows     [][]interface{}
+}
+
+// Subscribe starts a live query the server runs every
+// req.RefreshIntervalMS, and on each notification on req.NotifyChannel,
+// sending the result again, or what changed in it, whenever it changes. Re-running a query has no side effects, so
+// subscriptions are resubmitted after a reconnect and start again from a
+// whole result.
+func (c *Client) Subscribe(req protocol.QueryRequest, opts ...StreamOption) (*Subscription, error) {
+	stream, err := c.submit(protocol.MessageTypeSubscribe, req, append([]StreamOption{Idempotent()}, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{Stream: stream, keyColumns: req.KeyColumns}, nil
+}
+
+// Next blocks until the result changes, applies the update to Rows and
+// returns it. Warnings about failed refreshes are skipped; the previous
+// result stands until a refresh succeeds.
+func (s *Subscription) Next(ctx context.Context) (protocol.WSMessage, error) {
+	var failure string
+	for {
+		msg, err := s.Stream.Next(ctx)
+		if err != nil {
+			return msg, err
+		}
+		switch msg.Type {
+		case protocol.MessageTypeUpdate:
+			s.apply(msg.Payload)
+			return msg, nil
+		case protocol.MessageTypeError:
+			failure, _ = msg.Payload["error"].(string)
+			if rejected, _ := msg.Payload["rejected"].(bool); rejected {
+				s.Close()
+				return msg, fmt.Errorf("%w: %s", ErrSubscriptionEnded, failure)
+			}
+		case protocol.MessageTypeStatus:
+			status, _ := msg.Payload["status"].(string)
+			if !protocol.IsTerminalStatus(status) {
+				continue
+			}
+			s.Close()
+			if failure != "" {
+				return msg, fmt.Errorf("%w: %s: %s", ErrSubscriptionEnded, status, failure)
+			}
+			return msg, fmt.Errorf("%w: %s", ErrSubscriptionEnded, status)
+		}
+	}
+}
+
+// apply brings the result up to date with an update: a whole result
+// replaces it, a keyed update replaces, removes and appends rows by key,
+// otherwise the removed rows are taken out and the added ones appended
+func (s *Subscription) apply(payload map[string]interface{}) {
+	if revision, ok := payloadInt(payload["revision"]); ok {
+		s.Revision = revision
+	}
+	if rows, ok := payload["rows"].([]interface{}); ok {
+		columns, _ := payload["columns"].([]interface{})
+		s.Columns = make([]string, 0, len(columns))
+		for _, c := range columns {
+			name, _ := c.(string)
+			s.Columns = append(s.Columns, name)
+		}
+		s.Rows = payloadRows(rows)
+		return
+	}
+	if _, keyed := payload["inserted"]; keyed {
+		s.applyKeyed(payload)
+		return
+	}
+
+	removed, _ := payload["removed"].([]interface{})
+	for _, row := range payloadRows(removed) {
+		key := rowKey(row)
+		for i, have := range s.Rows {
+			if rowKey(have) == key {
+				s.Rows = append(s.Rows[:i], s.Rows[i+1:]...)
+				break
+			}
+		}
+	}
+	added, _ := payload["added"].([]interface{})
+	s.Rows = append(s.Rows, payloadRows(added)...)
+}
+
+// applyKeyed applies a keyed update, keeping the order of the rows left in
+// place
+func (s *Subscription) applyKeyed(payload map[string]interface{}) {
+	positions := make([]int, len(s.keyColumns))
+	for i, name := range s.keyColumns {
+		positions[i] = slices.Index(s.Columns, name)
+	}
+	key := func(row []interface{}) string {
+		values := make([]interface{}, len(positions))
+		for i, pos := range positions {
+			if pos >= 0 && pos < len(row) {
+				values[i] = row[pos]
+			}
+		}
+		return rowKey(values)
+	}
+
+	deleted, _ := payload["deleted"].([]interface{})
+	gone := make(map[string]bool, len(deleted))
+	for _, values := range payloadRows(deleted) {
+		gone[rowKey(values)] = true
+	}
+	changed, _ := payload["updated"].([]interface{})
+	updated := make(map[string][]interface{}, len(changed))
+	for _, row := range payloadRows(changed) {
+		updated[key(row)] = row
+	}
+
+	rows := make([][]interface{}, 0, len(s.Rows))
+	for _, row := range s.Rows {
+		k := key(row)
+		if gone[k] {
+			continue
+		}
+		if u, ok := updated[k]; ok {
+			row = u
+		}
+		rows = append(rows, row)
+	}
+	inserted, _ := payload["inserted"].([]interface{})
+	s.Rows = append(rows, payloadRows(inserted)...)
+}
+
+func payloadRows(rows []interface{}) [][]interface{} {
+	out := make([][]interface{}, 0, len(rows))
+	for _, r := range rows {
+		row, _ := r.([]interface{})
+		out = append(out, row)
+	}
+	return out
+}
+
+// rowKey encodes a row so rows can be compared by value
+func rowKey(row []interface{}) string {
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Sprint(row)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,59 @@
+// Command apikey generates an API key for a machine client. It prints the
+// key, which is shown only once, to stderr and the api_keys row to insert,
+// which holds just the key's hash, to stdout.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"supalytics-executor/runner"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	orgID := flag.String("org", "", "ID of the organization the key belongs to")
+	name := flag.String("name", "", "name describing the key's client, e.g. nightly-ci")
+	queries := flag.String("queries", "", "comma-separated query IDs the key is limited to; empty allows all")
+	expires := flag.Duration("expires", 0, "lifetime of the key, e.g. 2160h; zero never expires")
+	flag.Parse()
+
+	if *orgID == "" {
+		log.Fatal("-org is required: keys are scoped to an organization")
+	}
+
+	key, hash, err := runner.NewAPIKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	row := runner.APIKey{
+		ID:             uuid.NewString(),
+		OrganizationID: *orgID,
+		Name:           *name,
+		KeyHash:        hash,
+		CreatedAt:      time.Now().UTC(),
+	}
+	for _, id := range strings.Split(*queries, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			row.QueryIDs = append(row.QueryIDs, id)
+		}
+	}
+	if *expires > 0 {
+		at := row.CreatedAt.Add(*expires)
+		row.ExpiresAt = &at
+	}
+
+	out, err := json.MarshalIndent(row, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "API key (store it now, it cannot be recovered): %s\n", key)
+	fmt.Println(string(out))
+}
@@ -1,137 +1,459 @@
+// Command client runs a saved query on an executor and writes its rows to
+// stdout as a table, CSV or JSON lines, with status and errors on stderr:
+//
+//	client --query <id> --set region=eu --output csv > result.csv
+//
+// Ctrl-C cancels the query on the server and waits for it to stop; a
+// second Ctrl-C quits at once. The exit code reflects how the query ended.
 package main
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+
+	"supalytics-executor/client"
+	"supalytics-executor/export"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
 )
 
-// MessageType represents different types of messages received from the server
-type MessageType string
+// Exit codes
+const (
+	exitCompleted   = 0
+	exitFailed      = 1 // the query failed or ran past its execution deadline
+	exitUsage       = 2 // invalid flags
+	exitCancelled   = 3 // cancelled, by Ctrl-C, -timeout or the server
+	exitUnreachable = 4 // the executor could not be reached or the connection was lost
+	exitInterrupted = 130
+)
 
+// Output formats
 const (
-	MessageTypeMetadata MessageType = "metadata"
-	MessageTypeColumns  MessageType = "columns"
-	MessageTypeRow      MessageType = "row"
-	MessageTypeError    MessageType = "error"
-	MessageTypeComplete MessageType = "complete"
-	MessageTypeStatus   MessageType = "status"
+	outputTable = "table"
+	outputCSV   = "csv"
+	outputJSONL = "jsonl"
 )
 
-// WSMessage represents the standardized message format
-type WSMessage struct {
-	Type     MessageType            `json:"type"`
-	StreamID string                 `json:"streamId"`
-	Payload  map[string]interface{} `json:"payload,omitempty"`
+// cancelGrace is how long a cancelled query has to report its end before
+// the client gives up on it
+const cancelGrace = 10 * time.Second
+
+// exitError ends the command with an exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func exitf(code int, format string, args ...interface{}) error {
+	return &exitError{code: code, err: fmt.Errorf(format, args...)}
 }
 
-// QueryRequest represents the JSON structure sent to the server
-type QueryRequest struct {
-	QueryID      string                 `json:"queryId"`
-	StreamID     string                 `json:"streamId"`
-	TemplateData map[string]interface{} `json:"templateData"`
+// flags holds the command line
+type flags struct {
+	url      string
+	token    string
+	queryID  string
+	data     string
+	set      []string
+	output   string
+	timezone string
+	cache    string
+	timeout  time.Duration
+	verbose  bool
 }
 
-func executeQuery(conn *websocket.Conn, queryID string, streamID string, templateData map[string]interface{}) {
-	// Prepare the query request
-	req := QueryRequest{
-		QueryID:      queryID,
-		StreamID:     streamID,
-		TemplateData: templateData,
+func main() {
+	f := &flags{}
+	cmd := &cobra.Command{
+		Use:   "client --query <id> [flags]",
+		Short: "Run a saved query on a Supalytics executor",
+		Long: `Run a saved query on a Supalytics executor and write its rows to stdout.
+
+Exit codes: 0 completed, 1 failed, 2 invalid flags, 3 cancelled,
+4 executor unreachable or connection lost, 130 interrupted.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(f)
+		},
 	}
+	cmd.Flags().StringVar(&f.url, "url", envOr("SUPALYTICS_URL", "ws://localhost:8080/ws"), "executor WebSocket endpoint ($SUPALYTICS_URL)")
+	cmd.Flags().StringVar(&f.token, "token", os.Getenv("SUPALYTICS_TOKEN"), "access token or API key ($SUPALYTICS_TOKEN)")
+	cmd.Flags().StringVarP(&f.queryID, "query", "q", "", "ID of the query to run")
+	cmd.Flags().StringVarP(&f.data, "data", "d", "", "template data as a JSON object")
+	cmd.Flags().StringArrayVarP(&f.set, "set", "s", nil, "template value as key=value, repeatable; applied over --data")
+	cmd.Flags().StringVarP(&f.output, "output", "o", outputTable, "output format: table, csv or jsonl")
+	cmd.Flags().StringVar(&f.timezone, "timezone", "", "IANA time zone to render timestamps in")
+	cmd.Flags().StringVar(&f.cache, "cache", runner.CacheUse, "result cache use: use, bypass or refresh")
+	cmd.Flags().DurationVar(&f.timeout, "timeout", 0, "cancel the query after this long; 0 waits indefinitely")
+	cmd.Flags().BoolVarP(&f.verbose, "verbose", "v", false, "print status updates to stderr")
+	cmd.MarkFlagRequired("query")
 
-	// Send the query request
-	if err := conn.WriteJSON(req); err != nil {
-		log.Printf("Error sending query request for stream %s: %v", streamID, err)
-		return
+	if err := cmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
+		// Errors cobra returns itself are about the command line
+		os.Exit(exitUsage)
 	}
-	log.Printf("Sent query request for stream %s: %+v", streamID, req)
 }
 
-func main() {
-	url := "ws://localhost:8080/ws"
-	log.Printf("Connecting to %s", url)
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// templateData merges --data and --set; --set values are strings
+func (f *flags) templateData() (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	if f.data != "" {
+		if err := json.Unmarshal([]byte(f.data), &data); err != nil {
+			return nil, fmt.Errorf("--data must be a JSON object: %w", err)
+		}
+	}
+	for _, kv := range f.set {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("--set %q must be key=value", kv)
+		}
+		data[key] = value
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+func run(f *flags) error {
+	data, err := f.templateData()
+	if err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+	switch f.cache {
+	case runner.CacheUse, runner.CacheBypass, runner.CacheRefresh:
+	default:
+		return exitf(exitUsage, "--cache must be use, bypass or refresh")
+	}
+	out, err := newRowWriter(f.output, os.Stdout)
 	if err != nil {
-		log.Fatalf("Dial error: %v", err)
+		return &exitError{code: exitUsage, err: err}
 	}
-	defer conn.Close()
 
-	// Template data for our queries
-	templateData1 := map[string]interface{}{
-		"Con": "connectors",
+	// ctx ends only on a second Ctrl-C or when a cancelled query does not
+	// stop in time; the first Ctrl-C cancels the query on the server
+	ctx, quit := context.WithCancel(context.Background())
+	defer quit()
+
+	c, err := client.DialOptions(ctx, f.url, client.Options{Token: f.token})
+	if err != nil {
+		return exitf(exitUnreachable, "connect to %s: %w", f.url, err)
 	}
-	// Template data for our queries
-	templateData2 := map[string]interface{}{}
-	// Execute first query
-	executeQuery(conn, "aec65753-66e0-473a-aabb-edcfc7a16421", "stream1", templateData1)
+	defer c.Close()
 
-	// Execute second query after a short delay
-	// time.Sleep(2 * time.Second)
-	executeQuery(conn, "df279904-9271-4e7c-87f5-76ff5ee23bb9", "stream2", templateData2)
+	stream, err := c.Execute(protocol.QueryRequest{
+		QueryID:      f.queryID,
+		TemplateData: data,
+		Timezone:     f.timezone,
+		CacheControl: f.cache,
+	})
+	if err != nil {
+		return exitf(exitUnreachable, "send query: %w", err)
+	}
+	defer stream.Close()
 
-	// Track completion of both streams
-	completedStreams := make(map[string]bool)
-	var totalRows int64
+	interrupted := make(chan os.Signal, 2)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+	var timeout <-chan time.Time
+	if f.timeout > 0 {
+		timer := time.NewTimer(f.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	done := make(chan struct{})
+	defer close(done)
+	var forced atomic.Bool
+	go func() {
+		select {
+		case <-interrupted:
+			fmt.Fprintln(os.Stderr, "Cancelling query; press Ctrl-C again to quit")
+		case <-timeout:
+			fmt.Fprintf(os.Stderr, "Cancelling query after %s\n", f.timeout)
+		case <-done:
+			return
+		}
+		stream.Cancel()
+		select {
+		case <-interrupted:
+			forced.Store(true)
+		case <-time.After(cancelGrace):
+		case <-done:
+			return
+		}
+		quit()
+	}()
 
-	// Set read deadline
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	err = readStream(ctx, stream, out, f.verbose)
+	if ctx.Err() != nil {
+		if forced.Load() {
+			return exitf(exitInterrupted, "interrupted")
+		}
+		return exitf(exitCancelled, "query did not stop within %s of being cancelled", cancelGrace)
+	}
+	return err
+}
 
-	// Read and process messages
+// readStream writes the stream's rows as they arrive and returns an
+// exitError unless the query completed
+func readStream(ctx context.Context, stream *client.Stream, out rowWriter, verbose bool) error {
+	var rows int64
+	wroteHeader := false
 	for {
-		var msg WSMessage
-		err := conn.ReadJSON(&msg)
+		msg, err := stream.Next(ctx)
 		if err != nil {
-			log.Printf("Read error: %v", err)
-			break
-		}
-
-		// Log the stream ID with each message
-		streamLog := func(format string, args ...interface{}) {
-			newArgs := make([]interface{}, len(args)+1)
-			newArgs[0] = msg.StreamID
-			copy(newArgs[1:], args)
-			log.Printf("[Stream %s] "+format, newArgs...)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return exitf(exitUnreachable, "connection lost: %w", err)
 		}
 
 		switch msg.Type {
-		case MessageTypeMetadata:
-			streamLog("Received metadata: %v", msg.Payload)
-
-		case MessageTypeRow:
-			if data, ok := msg.Payload["data"].([]interface{}); ok {
-				streamLog("Received row: %v", data)
+		case protocol.MessageTypeMetadata:
+			if wroteHeader {
+				continue
 			}
+			if err := out.WriteHeader(metadataColumns(msg.Payload)); err != nil {
+				return exitf(exitFailed, "write output: %w", err)
+			}
+			wroteHeader = true
 
-		case MessageTypeError:
-			if errMsg, ok := msg.Payload["error"].(string); ok {
-				streamLog("Error received: %s", errMsg)
+		case protocol.MessageTypeRow:
+			data, _ := msg.Payload["data"].([]interface{})
+			for _, r := range data {
+				row, _ := r.([]interface{})
+				if err := out.WriteRow(row); err != nil {
+					return exitf(exitFailed, "write output: %w", err)
+				}
+				rows++
+			}
+			if err := out.Flush(); err != nil {
+				return exitf(exitFailed, "write output: %w", err)
 			}
-			completedStreams[msg.StreamID] = true
 
-		case MessageTypeComplete:
-			if total, ok := msg.Payload["totalRows"].(float64); ok {
-				rows := int64(total)
-				totalRows += rows
-				streamLog("Query complete. Stream rows: %d", rows)
+		case protocol.MessageTypeError:
+			out.Close()
+			errMsg, _ := msg.Payload["error"].(string)
+			if code, _ := msg.Payload["code"].(string); code != "" {
+				errMsg += " (" + code + ")"
 			}
-			completedStreams[msg.StreamID] = true
+			return exitf(exitFailed, "query failed: %s", errMsg)
 
-		case MessageTypeStatus:
-			if status, ok := msg.Payload["status"].(string); ok {
-				streamLog("Status update: %s", status)
+		case protocol.MessageTypeStatus:
+			status, _ := msg.Payload["status"].(string)
+			if warning, _ := msg.Payload["warning"].(string); warning != "" {
+				fmt.Fprintln(os.Stderr, "Warning:", warning)
+			} else if verbose {
+				fmt.Fprintln(os.Stderr, "Status:", status)
+			}
+			if !protocol.IsTerminalStatus(status) {
+				continue
 			}
+			if err := out.Close(); err != nil {
+				return exitf(exitFailed, "write output: %w", err)
+			}
+			switch status {
+			case protocol.StatusCompleted:
+				if verbose {
+					fmt.Fprintf(os.Stderr, "%d rows\n", rows)
+				}
+				return nil
+			case protocol.StatusCancelled:
+				return exitf(exitCancelled, "query cancelled")
+			case protocol.StatusTimeout:
+				reason, _ := msg.Payload["reason"].(string)
+				return exitf(exitFailed, "query timed out: %s", reason)
+			default:
+				errMsg, _ := msg.Payload["error"].(string)
+				if errMsg == "" {
+					errMsg = status
+				}
+				return exitf(exitFailed, "query failed: %s", errMsg)
+			}
+		}
+	}
+}
 
-		default:
-			streamLog("Unknown message type: %s", msg.Type)
+func metadataColumns(payload map[string]interface{}) []string {
+	metadata, _ := payload["metadata"].(map[string]interface{})
+	raw, _ := metadata["columns"].([]interface{})
+	columns := make([]string, 0, len(raw))
+	for _, c := range raw {
+		name, _ := c.(string)
+		columns = append(columns, name)
+	}
+	return columns
+}
+
+// rowWriter writes rows in an output format. Flush sends what has been
+// written so far on to stdout; Close finishes the output.
+type rowWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(row []interface{}) error
+	Flush() error
+	Close() error
+}
+
+func newRowWriter(format string, w io.Writer) (rowWriter, error) {
+	buf := bufio.NewWriter(w)
+	switch format {
+	case outputTable:
+		// A table is aligned once every row is known, so it is written at
+		// the end
+		return &tableWriter{tw: tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0), buf: buf}, nil
+	case outputCSV:
+		csv, err := export.NewWriter(export.FormatCSV, buf)
+		if err != nil {
+			return nil, err
 		}
+		return &csvWriter{csv: csv, buf: buf}, nil
+	case outputJSONL:
+		return &jsonLinesWriter{buf: buf}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q: use table, csv or jsonl", format)
+	}
+}
 
-		// Check if both streams are complete
-		if len(completedStreams) == 2 {
-			log.Printf("All streams complete. Total rows across streams: %d", totalRows)
-			return
+// formatValue renders a value as text. Numbers arrive as floats, which are
+// written without an exponent so integers stay integers.
+func formatValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return export.FormatValue(v)
+}
+
+type tableWriter struct {
+	tw  *tabwriter.Writer
+	buf *bufio.Writer
+}
+
+func (t *tableWriter) WriteHeader(columns []string) error {
+	_, err := fmt.Fprintln(t.tw, strings.Join(columns, "\t"))
+	return err
+}
+
+func (t *tableWriter) WriteRow(row []interface{}) error {
+	cells := make([]string, len(row))
+	for i, v := range row {
+		if v == nil {
+			cells[i] = "NULL"
+			continue
 		}
+		// Tabs and newlines would break the alignment
+		cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(formatValue(v))
+	}
+	_, err := fmt.Fprintln(t.tw, strings.Join(cells, "\t"))
+	return err
+}
+
+func (t *tableWriter) Flush() error { return nil }
+
+func (t *tableWriter) Close() error {
+	if err := t.tw.Flush(); err != nil {
+		return err
 	}
+	return t.buf.Flush()
+}
+
+type csvWriter struct {
+	csv export.Writer
+	buf *bufio.Writer
 }
+
+func (c *csvWriter) WriteHeader(columns []string) error { return c.csv.WriteHeader(columns) }
+
+func (c *csvWriter) WriteRow(row []interface{}) error {
+	record := make([]interface{}, len(row))
+	for i, v := range row {
+		if f, ok := v.(float64); ok {
+			record[i] = formatValue(f)
+			continue
+		}
+		record[i] = v
+	}
+	return c.csv.WriteRow(record)
+}
+
+func (c *csvWriter) Flush() error {
+	if err := c.csv.Close(); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+func (c *csvWriter) Close() error { return c.Flush() }
+
+// jsonLinesWriter writes one JSON object per row, keyed by column in
+// column order
+type jsonLinesWriter struct {
+	buf  *bufio.Writer
+	keys [][]byte
+}
+
+func (j *jsonLinesWriter) WriteHeader(columns []string) error {
+	j.keys = make([][]byte, len(columns))
+	for i, col := range columns {
+		key, err := json.Marshal(col)
+		if err != nil {
+			return err
+		}
+		j.keys[i] = key
+	}
+	return nil
+}
+
+func (j *jsonLinesWriter) WriteRow(row []interface{}) error {
+	j.buf.WriteByte('{')
+	for i, v := range row {
+		if i > 0 {
+			j.buf.WriteByte(',')
+		}
+		if i < len(j.keys) {
+			j.buf.Write(j.keys[i])
+		} else {
+			fmt.Fprintf(j.buf, `"%d"`, i)
+		}
+		j.buf.WriteByte(':')
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		j.buf.Write(value)
+	}
+	_, err := j.buf.WriteString("}\n")
+	return err
+}
+
+func (j *jsonLinesWriter) Flush() error { return j.buf.Flush() }
+
+func (j *jsonLinesWriter) Close() error { return j.buf.Flush() }
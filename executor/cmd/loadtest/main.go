@@ -0,0 +1,295 @@
+// Command loadtest puts an executor under load: it opens -connections
+// WebSocket connections, runs -streams concurrent streams of the query on
+// each, one after another until -duration has passed, and reports stream
+// latency percentiles, rows per second and dropped connections. Point it
+// at a query of a mock connector with a generator to measure the executor
+// alone, or at one of a real connector to include the engine.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// stats collects the outcome of every stream
+type stats struct {
+	mu           sync.Mutex
+	firstRow     []time.Duration // from sending the request to its first row
+	total        []time.Duration // from sending the request to its end
+	failures     map[string]int  // by error, or by status for cancellations
+	rows         atomic.Int64
+	messages     atomic.Int64
+	dropped      atomic.Int64 // connections lost mid-run
+	dialFailures atomic.Int64
+}
+
+func (s *stats) record(firstRow, total time.Duration, failure string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failure != "" {
+		s.failures[failure]++
+		return
+	}
+	if firstRow > 0 {
+		s.firstRow = append(s.firstRow, firstRow)
+	}
+	s.total = append(s.total, total)
+}
+
+// report is the summary printed at the end, as text or with -json
+type report struct {
+	Elapsed         string         `json:"elapsed"`
+	Streams         int            `json:"streams"`
+	Failed          int            `json:"failed"`
+	Failures        map[string]int `json:"failures,omitempty"`
+	Rows            int64          `json:"rows"`
+	RowsPerSecond   float64        `json:"rowsPerSecond"`
+	Messages        int64          `json:"messages"`
+	RowsPerMessage  float64        `json:"rowsPerMessage"`
+	DroppedConns    int64          `json:"droppedConnections"`
+	DialFailures    int64          `json:"dialFailures"`
+	FirstRowLatency latencySummary `json:"firstRowLatency"`
+	StreamLatency   latencySummary `json:"streamLatency"`
+}
+
+// latencySummary holds percentiles in milliseconds
+type latencySummary struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func summarize(durations []time.Duration) latencySummary {
+	if len(durations) == 0 {
+		return latencySummary{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return float64(sorted[max(i, 0)]) / float64(time.Millisecond)
+	}
+	return latencySummary{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: at(1)}
+}
+
+func (s *stats) report(elapsed time.Duration) report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := 0
+	for _, n := range s.failures {
+		failed += n
+	}
+	r := report{
+		Elapsed:         elapsed.Round(time.Millisecond).String(),
+		Streams:         len(s.total) + failed,
+		Failed:          failed,
+		Failures:        s.failures,
+		Rows:            s.rows.Load(),
+		Messages:        s.messages.Load(),
+		DroppedConns:    s.dropped.Load(),
+		DialFailures:    s.dialFailures.Load(),
+		FirstRowLatency: summarize(s.firstRow),
+		StreamLatency:   summarize(s.total),
+	}
+	r.RowsPerSecond = float64(r.Rows) / elapsed.Seconds()
+	if r.Messages > 0 {
+		r.RowsPerMessage = float64(r.Rows) / float64(r.Messages)
+	}
+	return r
+}
+
+func (r report) print() {
+	fmt.Printf("elapsed:              %s\n", r.Elapsed)
+	fmt.Printf("streams:              %d (%d failed)\n", r.Streams, r.Failed)
+	for failure, n := range r.Failures {
+		fmt.Printf("  %6d × %s\n", n, failure)
+	}
+	fmt.Printf("rows:                 %d (%.0f/s, %.1f per message)\n", r.Rows, r.RowsPerSecond, r.RowsPerMessage)
+	fmt.Printf("dropped connections:  %d (%d failed to dial)\n", r.DroppedConns, r.DialFailures)
+	for _, l := range []struct {
+		name string
+		s    latencySummary
+	}{{"first row latency", r.FirstRowLatency}, {"stream latency", r.StreamLatency}} {
+		fmt.Printf("%-21s p50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms\n", l.name+":", l.s.P50, l.s.P90, l.s.P99, l.s.Max)
+	}
+}
+
+// runStream executes one stream and records its outcome, reading rows as
+// they arrive rather than buffering them
+func runStream(ctx context.Context, c *client.Client, req protocol.QueryRequest, st *stats) error {
+	start := time.Now()
+	stream, err := c.Execute(req)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	var firstRow time.Duration
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				st.record(0, 0, err.Error())
+			}
+			return err
+		}
+		switch msg.Type {
+		case protocol.MessageTypeRow:
+			if firstRow == 0 {
+				firstRow = time.Since(start)
+			}
+			rows, _ := msg.Payload["data"].([]interface{})
+			st.rows.Add(int64(len(rows)))
+			st.messages.Add(1)
+		case protocol.MessageTypeError:
+			errMsg, _ := msg.Payload["error"].(string)
+			st.record(0, 0, errMsg)
+			return nil
+		case protocol.MessageTypeStatus:
+			status, _ := msg.Payload["status"].(string)
+			if !protocol.IsTerminalStatus(status) {
+				continue
+			}
+			failure := ""
+			if status != protocol.StatusCompleted {
+				failure = "status " + status
+			}
+			st.record(firstRow, time.Since(start), failure)
+			return nil
+		}
+	}
+}
+
+// runConnection keeps a connection's streams busy until ctx ends, dialing
+// again when the connection drops
+func runConnection(ctx context.Context, url string, opts client.Options, streams int, req protocol.QueryRequest, st *stats) {
+	for ctx.Err() == nil {
+		c, err := client.DialOptions(ctx, url, opts)
+		if err != nil {
+			if ctx.Err() == nil {
+				st.dialFailures.Add(1)
+				log.Printf("Dial failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < streams; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					if err := runStream(ctx, c, req, st); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-c.Done():
+			if ctx.Err() == nil {
+				st.dropped.Add(1)
+				log.Printf("Connection dropped: %v", c.Err())
+			}
+		default:
+		}
+		c.Close()
+	}
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8080/ws", "executor WebSocket endpoint")
+	token := flag.String("token", os.Getenv("SUPALYTICS_TOKEN"), "access token or API key")
+	queryID := flag.String("query", "", "ID of the query every stream runs")
+	templateData := flag.String("template-data", "", "template data of the query, as a JSON object")
+	connections := flag.Int("connections", 10, "WebSocket connections to open")
+	streams := flag.Int("streams", 5, "concurrent streams per connection")
+	duration := flag.Duration("duration", 30*time.Second, "how long to keep streams running")
+	encoding := flag.String("encoding", protocol.EncodingJSON, "message encoding: json, msgpack or cbor")
+	compression := flag.Bool("compression", false, "offer permessage-deflate")
+	cacheBypass := flag.Bool("cache-bypass", true, "bypass the result cache, so every stream runs the query")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	if *queryID == "" {
+		log.Fatal("-query is required")
+	}
+	if *connections < 1 || *streams < 1 {
+		log.Fatal("-connections and -streams must be at least 1")
+	}
+
+	req := protocol.QueryRequest{QueryID: *queryID}
+	if *templateData != "" {
+		if err := json.Unmarshal([]byte(*templateData), &req.TemplateData); err != nil {
+			log.Fatalf("-template-data must be a JSON object: %v", err)
+		}
+	}
+	if *cacheBypass {
+		req.CacheControl = runner.CacheBypass
+	}
+	opts := client.Options{Encoding: *encoding, Compression: *compression, Token: *token}
+
+	st := &stats{failures: make(map[string]int)}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	log.Printf("Running %d streams on each of %d connections to %s for %s", *streams, *connections, *url, *duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runConnection(ctx, *url, opts, *streams, req, st)
+		}()
+	}
+
+	// Progress every few seconds, for runs long enough to watch
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("%d rows, %d dropped connections", st.rows.Load(), st.dropped.Load())
+			}
+		}
+	}()
+	wg.Wait()
+
+	r := st.report(time.Since(start))
+	if *asJSON {
+		out, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		r.print()
+	}
+	if r.Streams == 0 {
+		log.Fatal("No stream finished")
+	}
+	if r.Failed > 0 || r.DroppedConns > 0 {
+		os.Exit(1)
+	}
+}
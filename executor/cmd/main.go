@@ -2,30 +2,28 @@ package main
 
 import (
 	"log"
+	"os"
 
+	"supalytics-executor/redact"
 	"supalytics-executor/websocket"
-
-	"github.com/BurntSushi/toml"
 )
 
+const configFile = "config.toml"
+
 func main() {
-	var cfg websocket.Config
-	if _, err := toml.DecodeFile("config.toml", &cfg); err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
+	// Driver errors quote DSNs and keys, so no log line carries them
+	log.SetOutput(redact.NewWriter(os.Stderr))
 
-	// Set defaults if not configured
-	if cfg.MaxWorkers == 0 {
-		cfg.MaxWorkers = 3
-	}
-	if cfg.QueueCapacity == 0 {
-		cfg.QueueCapacity = 100
+	cfg, err := websocket.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
 	server, err := websocket.NewServer(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
+	server.SetConfigFile(configFile)
 
 	if err := server.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
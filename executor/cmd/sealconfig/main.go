@@ -0,0 +1,58 @@
+// Command sealconfig encrypts a connector config for storage. It reads the
+// plaintext config JSON from stdin and prints the encryption envelope to
+// store in the connector's config column, using the [encryption] keys from
+// config.toml.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	"github.com/BurntSushi/toml"
+)
+
+func main() {
+	configPath := flag.String("config", "config.toml", "executor config file")
+	connectorID := flag.String("connector", "", "ID of the connector the config belongs to")
+	flag.Parse()
+
+	if *connectorID == "" {
+		log.Fatal("-connector is required: envelopes are bound to their connector")
+	}
+
+	var cfg websocket.Config
+	if _, err := toml.DecodeFile(*configPath, &cfg); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx := context.Background()
+	keyring, err := runner.NewKeyring(ctx, cfg.Encryption)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	if keyring == nil {
+		log.Fatal("No encryption keys configured in [encryption]")
+	}
+
+	plaintext, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+	if !json.Valid(plaintext) {
+		log.Fatal("Connector config on stdin is not valid JSON")
+	}
+
+	sealed, err := keyring.Encrypt(ctx, *connectorID, plaintext)
+	if err != nil {
+		log.Fatalf("Failed to encrypt config: %v", err)
+	}
+	fmt.Println(string(sealed))
+}
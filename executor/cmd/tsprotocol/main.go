@@ -0,0 +1,486 @@
+// Command tsprotocol writes the WebSocket protocol's types and constants as
+// TypeScript, so the frontend is built against the same messages the
+// executor sends. It reads the protocol package's source and is run by go
+// generate there:
+//
+//	go generate ./protocol
+//
+// Exported structs become interfaces keyed by their JSON names, with
+// omitempty fields optional. Each group of constants becomes an object
+// named by the prefix its names share, e.g. Status.Completed, along with a
+// union type of its values; a group of a named type, such as MessageType,
+// takes the type's name. -check fails instead of writing when the file is
+// out of date, for CI.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const header = `// Code generated by executor/cmd/tsprotocol from executor/protocol; DO NOT EDIT.
+// Run "go generate ./protocol" in executor after changing the protocol.
+
+`
+
+// jsonTypes gives the TypeScript of types that marshal themselves, which
+// their fields do not describe. Every exported type with a MarshalJSON
+// method must be listed.
+var jsonTypes = map[string]string{
+	"Decimal": "string",
+}
+
+// generator collects the package's declarations and writes them out
+type generator struct {
+	out       bytes.Buffer
+	types     map[string]*ast.TypeSpec // exported type declarations by name
+	marshaled map[string]bool          // types with a MarshalJSON method
+	enums     map[string]bool          // named types given a union of constants
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the protocol package")
+	out := flag.String("out", "", "TypeScript file to write")
+	check := flag.Bool("check", false, "fail if the file is out of date instead of writing it")
+	flag.Parse()
+	if *out == "" {
+		log.Fatal("-out is required")
+	}
+
+	files, err := parseDir(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g := &generator{
+		types:     make(map[string]*ast.TypeSpec),
+		marshaled: make(map[string]bool),
+		enums:     make(map[string]bool),
+	}
+	source, err := g.generate(files)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *check {
+		current, err := os.ReadFile(*out)
+		if err != nil || !bytes.Equal(current, source) {
+			log.Fatalf("%s is out of date: run go generate ./protocol", *out)
+		}
+		return
+	}
+	if err := os.WriteFile(*out, source, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseDir parses the package's non-test files in name order
+func parseDir(dir string) ([]*ast.File, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no Go files in %s", dir)
+	}
+	return files, nil
+}
+
+func (g *generator) generate(files []*ast.File) ([]byte, error) {
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				if d.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range d.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if ts.Doc == nil && len(d.Specs) == 1 {
+						ts.Doc = d.Doc
+					}
+					if ts.Name.IsExported() {
+						g.types[ts.Name.Name] = ts
+					}
+				}
+			case *ast.FuncDecl:
+				if d.Recv != nil && d.Name.Name == "MarshalJSON" {
+					g.marshaled[receiverType(d.Recv.List[0].Type)] = true
+				}
+			}
+		}
+	}
+	for name := range g.marshaled {
+		if _, ok := g.jsonType(name); !ok && ast.IsExported(name) {
+			return nil, fmt.Errorf("%s has a MarshalJSON method: add its TypeScript to jsonTypes", name)
+		}
+	}
+
+	g.out.WriteString(header)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.CONST {
+				if err := g.constants(d); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			d, ok := decl.(*ast.GenDecl)
+			if !ok || d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				if err := g.typeDecl(spec.(*ast.TypeSpec)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return append(bytes.TrimRight(g.out.Bytes(), "\n"), '\n'), nil
+}
+
+func receiverType(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+func (g *generator) jsonType(name string) (string, bool) {
+	ts, ok := jsonTypes[name]
+	return ts, ok
+}
+
+// constant is an exported constant with a literal value
+type constant struct {
+	name  string
+	value string // as TypeScript
+	doc   *ast.CommentGroup
+	typ   string // the named type it is declared with, if any
+}
+
+// constants writes a const declaration: a group sharing a prefix as an
+// object and a union type, anything else as separate constants
+func (g *generator) constants(d *ast.GenDecl) error {
+	var consts []constant
+	for _, spec := range d.Specs {
+		vs := spec.(*ast.ValueSpec)
+		for i, name := range vs.Names {
+			if !name.IsExported() {
+				continue
+			}
+			if i >= len(vs.Values) {
+				return fmt.Errorf("constant %s has no value of its own", name.Name)
+			}
+			lit, ok := vs.Values[i].(*ast.BasicLit)
+			if !ok || (lit.Kind != token.STRING && lit.Kind != token.INT && lit.Kind != token.FLOAT) {
+				return fmt.Errorf("constant %s is not a string or number literal", name.Name)
+			}
+			value := lit.Value
+			if lit.Kind == token.STRING {
+				s, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					return err
+				}
+				value = strconv.Quote(s)
+			}
+			c := constant{name: name.Name, value: value, doc: vs.Doc}
+			if c.doc == nil && d.Lparen == token.NoPos {
+				c.doc = d.Doc
+			}
+			if c.doc == nil {
+				c.doc = vs.Comment
+			}
+			if ident, ok := vs.Type.(*ast.Ident); ok {
+				c.typ = ident.Name
+			}
+			consts = append(consts, c)
+		}
+	}
+	if len(consts) == 0 {
+		return nil
+	}
+
+	prefix := consts[0].typ
+	if prefix == "" || !ast.IsExported(prefix) {
+		prefix = commonPrefix(consts)
+	}
+	keys := make([]string, len(consts))
+	for i, c := range consts {
+		keys[i] = strings.TrimPrefix(c.name, prefix)
+		if prefix == "" || keys[i] == "" || !strings.HasPrefix(c.name, prefix) || len(consts) == 1 {
+			prefix = ""
+			break
+		}
+	}
+	if prefix == "" {
+		for _, c := range consts {
+			g.comment(c.doc, "")
+			fmt.Fprintf(&g.out, "export const %s = %s;\n", c.name, c.value)
+		}
+		g.out.WriteString("\n")
+		return nil
+	}
+	if ts, ok := g.types[prefix]; ok && consts[0].typ != prefix {
+		return fmt.Errorf("constants %s... would be named like type %s", consts[0].name, ts.Name.Name)
+	}
+
+	g.enums[prefix] = true
+	g.comment(d.Doc, "")
+	fmt.Fprintf(&g.out, "export const %s = {\n", prefix)
+	for i, c := range consts {
+		g.comment(c.doc, "  ")
+		fmt.Fprintf(&g.out, "  %s: %s,\n", keys[i], c.value)
+	}
+	fmt.Fprintf(&g.out, "} as const;\n")
+	fmt.Fprintf(&g.out, "export type %s = (typeof %s)[keyof typeof %s];\n\n", prefix, prefix, prefix)
+	return nil
+}
+
+// commonPrefix returns the leading words, split at capitals, every
+// constant's name shares
+func commonPrefix(consts []constant) string {
+	words := camelWords(consts[0].name)
+	n := len(words)
+	for _, c := range consts[1:] {
+		other := camelWords(c.name)
+		i := 0
+		for i < n && i < len(other) && words[i] == other[i] {
+			i++
+		}
+		n = i
+	}
+	return strings.Join(words[:n], "")
+}
+
+// camelWords splits a name before each capital that starts a word, keeping
+// acronyms and numbers with the word before them
+func camelWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// typeDecl writes an exported struct as an interface. Other named types
+// are written only as the union of their constants, and types without
+// exported fields, such as RowChecksum, not at all.
+func (g *generator) typeDecl(ts *ast.TypeSpec) error {
+	if !ts.Name.IsExported() || g.enums[ts.Name.Name] {
+		return nil
+	}
+	name := ts.Name.Name
+	if json, ok := g.jsonType(name); ok {
+		g.comment(ts.Doc, "")
+		fmt.Fprintf(&g.out, "export type %s = %s;\n\n", name, json)
+		return nil
+	}
+	st, ok := ts.Type.(*ast.StructType)
+	if !ok {
+		return nil
+	}
+
+	var extends []string
+	var body bytes.Buffer
+	for _, field := range st.Fields.List {
+		tag := ""
+		if field.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(field.Tag.Value, "`")).Get("json")
+		}
+		jsonName, opts, _ := strings.Cut(tag, ",")
+		if jsonName == "-" && opts == "" {
+			continue
+		}
+		if len(field.Names) == 0 {
+			if tag == "" {
+				embedded, err := g.tsType(field.Type)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				extends = append(extends, embedded)
+				continue
+			}
+			field.Names = []*ast.Ident{ast.NewIdent(receiverType(field.Type))}
+		}
+		omitempty := strings.Contains(","+opts+",", ",omitempty,")
+		for _, ident := range field.Names {
+			if !ident.IsExported() {
+				continue
+			}
+			typ, err := g.tsType(field.Type)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", name, ident.Name, err)
+			}
+			if !omitempty && nullable(field.Type) {
+				typ += " | null"
+			}
+			key := jsonName
+			if key == "" {
+				key = ident.Name
+			}
+			doc := field.Doc
+			if doc == nil {
+				doc = field.Comment
+			}
+			g.commentTo(&body, doc, "  ")
+			optional := ""
+			if omitempty {
+				optional = "?"
+			}
+			fmt.Fprintf(&body, "  %s%s: %s;\n", key, optional, typ)
+		}
+	}
+	if body.Len() == 0 && len(extends) == 0 {
+		return nil
+	}
+
+	g.comment(ts.Doc, "")
+	fmt.Fprintf(&g.out, "export interface %s ", name)
+	if len(extends) > 0 {
+		fmt.Fprintf(&g.out, "extends %s ", strings.Join(extends, ", "))
+	}
+	fmt.Fprintf(&g.out, "{\n%s}\n\n", body.String())
+	return nil
+}
+
+// nullable reports whether a field's zero value marshals as null
+func nullable(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.ArrayType:
+		return t.Len == nil
+	case *ast.MapType:
+		return true
+	}
+	return false
+}
+
+// tsType returns the TypeScript of a field's type as it marshals to JSON
+func (g *generator) tsType(expr ast.Expr) (string, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return "string", nil
+		case "bool":
+			return "boolean", nil
+		case "int", "int8", "int16", "int32", "int64",
+			"uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+			return "number", nil
+		case "any":
+			return "unknown", nil
+		}
+		ts, ok := g.types[t.Name]
+		if !ok {
+			return "", fmt.Errorf("unsupported type %s", t.Name)
+		}
+		if _, isStruct := ts.Type.(*ast.StructType); isStruct || g.enums[t.Name] {
+			return t.Name, nil
+		}
+		if _, ok := g.jsonType(t.Name); ok {
+			return t.Name, nil
+		}
+		// Other named types are written as what they are defined as
+		return g.tsType(ts.Type)
+	case *ast.SelectorExpr:
+		switch pkg := t.X.(*ast.Ident).Name + "." + t.Sel.Name; pkg {
+		case "time.Time":
+			return "string", nil // RFC 3339
+		case "time.Duration":
+			return "number", nil // nanoseconds
+		case "json.RawMessage":
+			return "unknown", nil
+		default:
+			return "", fmt.Errorf("unsupported type %s", pkg)
+		}
+	case *ast.StarExpr:
+		inner, err := g.tsType(t.X)
+		if err != nil {
+			return "", err
+		}
+		return inner + " | null", nil
+	case *ast.ArrayType:
+		if ident, ok := t.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			return "string", nil // base64
+		}
+		elem, err := g.tsType(t.Elt)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(elem, " | ") {
+			elem = "(" + elem + ")"
+		}
+		return elem + "[]", nil
+	case *ast.MapType:
+		key, err := g.tsType(t.Key)
+		if err != nil {
+			return "", err
+		}
+		value, err := g.tsType(t.Value)
+		if err != nil {
+			return "", err
+		}
+		return "Record<" + key + ", " + value + ">", nil
+	case *ast.InterfaceType:
+		return "unknown", nil
+	}
+	return "", fmt.Errorf("unsupported type %T", expr)
+}
+
+func (g *generator) comment(doc *ast.CommentGroup, indent string) {
+	g.commentTo(&g.out, doc, indent)
+}
+
+// commentTo writes a Go doc comment as a JSDoc comment
+func (g *generator) commentTo(out *bytes.Buffer, doc *ast.CommentGroup, indent string) {
+	text := strings.TrimSpace(doc.Text())
+	if text == "" {
+		return
+	}
+	text = strings.ReplaceAll(text, "*/", "*\\/")
+	lines := strings.Split(text, "\n")
+	if len(lines) == 1 {
+		fmt.Fprintf(out, "%s/** %s */\n", indent, lines[0])
+		return
+	}
+	fmt.Fprintf(out, "%s/**\n", indent)
+	for _, line := range lines {
+		fmt.Fprintf(out, "%s *%s\n", indent, strings.TrimRight(" "+line, " "))
+	}
+	fmt.Fprintf(out, "%s */\n", indent)
+}
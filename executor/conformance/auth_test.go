@@ -0,0 +1,865 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	"github.com/golang-jwt/jwt/v5"
+	gorilla "github.com/gorilla/websocket"
+)
+
+func jwtAuth(cfg *websocket.Config) {
+	cfg.Auth = websocket.AuthConfig{JWTSecret: authSecret, Timeout: 200 * time.Millisecond, APIKeys: true}
+}
+
+func allowedOrigins(cfg *websocket.Config) {
+	cfg.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org"}
+}
+
+// authSecret signs the access tokens of the Auth scenario
+const authSecret = "conformance-jwt-secret"
+
+// signToken issues a Supabase-style access token for user, a member of org
+// "org-<user>"; user "nobody" belongs to no organization
+func signToken(secret, user string, ttl time.Duration) string {
+	org := "org-" + user
+	if user == "nobody" {
+		org = ""
+	}
+	return signMemberToken(secret, user, org, ttl)
+}
+
+// signMemberToken issues an access token for user as a member of org, or of
+// no organization when org is empty
+func signMemberToken(secret, user, org string, ttl time.Duration) string {
+	claims := jwt.MapClaims{
+		"sub":  user,
+		"aud":  "authenticated",
+		"role": "authenticated",
+		"exp":  time.Now().Add(ttl).Unix(),
+	}
+	if org != "" {
+		claims["app_metadata"] = map[string]interface{}{"organization_id": org}
+	}
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	return token
+}
+
+func testAuth(ctx context.Context, h *harness) error {
+	valid := signToken(authSecret, "alice", time.Hour)
+
+	// Connections without a valid token are closed with 4401
+	expectRejected := func(name, rawQuery string, first interface{}) error {
+		conn, _, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL+rawQuery, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		defer conn.Close()
+		if first != nil {
+			conn.WriteJSON(first)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		if !gorilla.IsCloseError(err, protocol.CloseUnauthorized) {
+			return fmt.Errorf("%s: read error %v, want close %d", name, err, protocol.CloseUnauthorized)
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		name, rawQuery string
+		first          interface{}
+	}{
+		{"no token", "", nil},
+		{"query before auth", "", protocol.ClientMessage{Type: protocol.MessageTypeQuery, QueryRequest: protocol.QueryRequest{QueryID: queryFast}}},
+		{"wrong secret", "?access_token=" + signToken("other-secret", "alice", time.Hour), nil},
+		{"expired", "?access_token=" + signToken(authSecret, "alice", -time.Hour), nil},
+		{"bad auth message", "", protocol.ClientMessage{Type: protocol.MessageTypeAuth, Token: "not-a-jwt"}},
+	} {
+		if err := expectRejected(tc.name, tc.rawQuery, tc.first); err != nil {
+			return err
+		}
+	}
+
+	// A token in the query string, as browsers send it
+	conn, _, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL+"?access_token="+valid, nil)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	// A token in the first message is acknowledged with the caller's claims
+	conn, _, err = gorilla.DefaultDialer.DialContext(ctx, h.wsURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.WriteJSON(protocol.ClientMessage{Type: protocol.MessageTypeAuth, Token: valid})
+	var ack protocol.WSMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&ack); err != nil {
+		return fmt.Errorf("auth message: %w", err)
+	}
+	if ack.Type != protocol.MessageTypeAuth || ack.Payload["userId"] != "alice" || ack.Payload["organizationId"] != "org-alice" {
+		return fmt.Errorf("auth ack %+v, want alice of org-alice", ack)
+	}
+
+	// A bearer token authenticates the SDK, which can refresh it in place
+	c, err := h.dialOptions(ctx, client.Options{Token: signToken(authSecret, "alice", time.Second)})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SetToken(valid); err != nil {
+		return err
+	}
+	if msg, err := nextUnrouted(ctx, c); err != nil || msg.Type != protocol.MessageTypeAuth {
+		return fmt.Errorf("refresh: got %+v (%v), want an auth ack", msg, err)
+	}
+	if err := expectCompleted(ctx, c, queryAlice); err != nil {
+		return err
+	}
+
+	// Without a refresh the connection ends when the token expires, and
+	// the SDK does not reconnect with a token the server rejected
+	expiring, err := h.dialOptions(ctx, client.Options{
+		Token:     signToken(authSecret, "bob", time.Second),
+		Reconnect: &client.ReconnectPolicy{InitialBackoff: 10 * time.Millisecond},
+	})
+	if err != nil {
+		return err
+	}
+	defer expiring.Close()
+	select {
+	case <-expiring.Done():
+	case <-ctx.Done():
+		return errors.New("connection outlived its token")
+	}
+	if !errors.Is(expiring.Err(), client.ErrUnauthorized) {
+		return fmt.Errorf("expired client error %v, want ErrUnauthorized", expiring.Err())
+	}
+
+	// The refreshed connection outlived its first token
+	select {
+	case <-c.Done():
+		return fmt.Errorf("refreshed connection closed: %v", c.Err())
+	default:
+	}
+
+	// A token for another user cannot take over the connection
+	if err := c.SetToken(signToken(authSecret, "mallory", time.Hour)); err != nil {
+		return err
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		return errors.New("connection accepted another user's token")
+	}
+
+	// HTTP endpoints take the token as a bearer token or query parameter
+	export := h.server.URL + "/export?queryId=" + queryAlice
+	for _, tc := range []struct {
+		name   string
+		url    string
+		bearer string
+		want   int
+	}{
+		{"export without token", export, "", http.StatusUnauthorized},
+		{"export with invalid token", export, "invalid", http.StatusUnauthorized},
+		{"export with bearer", export, valid, http.StatusOK},
+		{"export with query token", export + "&access_token=" + valid, "", http.StatusOK},
+		{"execution without token", h.server.URL + "/api/v1/executions/unknown", "", http.StatusUnauthorized},
+		{"execution with bearer", h.server.URL + "/api/v1/executions/unknown", valid, http.StatusNotFound},
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tc.url, nil)
+		if err != nil {
+			return err
+		}
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			return fmt.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+	return nil
+}
+
+func testOrganizationAccess(ctx context.Context, h *harness) error {
+	dial := func(user string) (*client.Client, error) {
+		return h.dialOptions(ctx, client.Options{Token: signToken(authSecret, user, time.Hour)})
+	}
+	alice, err := dial("alice")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+	nobody, err := dial("nobody")
+	if err != nil {
+		return err
+	}
+	defer nobody.Close()
+
+	// Queries and connectors of other organizations look like missing ones
+	for _, tc := range []struct {
+		name    string
+		c       *client.Client
+		queryID string
+		want    string
+	}{
+		{"own query", alice, queryAlice, ""},
+		{"other organization's query", alice, queryBob, "query not found"},
+		{"other organization's connector", alice, queryForeignConnector, "connector not found"},
+		{"query without organization", alice, queryFast, "query not found"},
+		{"caller without organization", nobody, queryAlice, "query not found"},
+	} {
+		stream, err := tc.c.Execute(protocol.QueryRequest{QueryID: tc.queryID})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", tc.name, err)
+		}
+		if tc.want == "" {
+			if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+				return fmt.Errorf("%s: status %q (error %q) with %d rows, want 3 rows", tc.name, result.Status, result.Error, len(result.Rows))
+			}
+			continue
+		}
+		if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, tc.want) {
+			return fmt.Errorf("%s: status %q (error %q), want failure %q", tc.name, result.Status, result.Error, tc.want)
+		}
+	}
+
+	// Only the user that started an async execution can attach to it
+	stream, err := alice.Execute(protocol.QueryRequest{QueryID: queryAlice, Async: true})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	var executionID string
+	for _, msg := range result.Messages {
+		if status, _ := msg.Payload["status"].(string); status == protocol.StatusSubmitted {
+			executionID, _ = msg.Payload["executionId"].(string)
+		}
+	}
+	if result.Status != protocol.StatusCompleted || executionID == "" {
+		return fmt.Errorf("async run: status %q (error %q) with execution %q", result.Status, result.Error, executionID)
+	}
+	carol, err := h.dialOptions(ctx, client.Options{Token: signMemberToken(authSecret, "carol", "org-alice", time.Hour)})
+	if err != nil {
+		return err
+	}
+	defer carol.Close()
+	for _, tc := range []struct {
+		name    string
+		c       *client.Client
+		queryID string
+		want    string
+	}{
+		{"teammate attaching", carol, queryAlice, "execution not found"},
+		{"attaching through another query", alice, queryForeignConnector, "execution not found"},
+		{"attaching to an own execution", alice, queryAlice, ""},
+	} {
+		attached, err := tc.c.Attach(protocol.QueryRequest{QueryID: tc.queryID, ExecutionID: executionID})
+		if err != nil {
+			return err
+		}
+		result, err := attached.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", tc.name, err)
+		}
+		if tc.want == "" {
+			if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+				return fmt.Errorf("%s: status %q (error %q) with %d rows, want 3 rows", tc.name, result.Status, result.Error, len(result.Rows))
+			}
+			continue
+		}
+		if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, tc.want) {
+			return fmt.Errorf("%s: status %q (error %q), want failure %q", tc.name, result.Status, result.Error, tc.want)
+		}
+	}
+
+	call := func(method, path, user, body string, into interface{}) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, method, h.server.URL+path, strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+signToken(authSecret, user, time.Hour))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if into != nil {
+			json.NewDecoder(resp.Body).Decode(into)
+		}
+		return resp.StatusCode, nil
+	}
+
+	if status, err := call(http.MethodPost, "/api/v1/queries/"+queryBob+"/execute", "alice", `{}`, nil); err != nil || status != http.StatusNotFound {
+		return fmt.Errorf("REST on another organization's query: status %d (%v), want 404", status, err)
+	}
+	if status, err := call(http.MethodGet, "/export?queryId="+queryBob, "alice", "", nil); err != nil || status != http.StatusNotFound {
+		return fmt.Errorf("export of another organization's query: status %d (%v), want 404", status, err)
+	}
+
+	// Async executions are only visible to their own organization
+	var started struct {
+		ExecutionID string `json:"executionId"`
+	}
+	if status, err := call(http.MethodPost, "/api/v1/queries/"+queryAlice+"/execute", "alice", `{"async":true}`, &started); err != nil || status != http.StatusAccepted {
+		return fmt.Errorf("async REST: status %d (%v), want 202", status, err)
+	}
+	execution := "/api/v1/executions/" + started.ExecutionID
+	if status, err := call(http.MethodGet, execution, "bob", "", nil); err != nil || status != http.StatusNotFound {
+		return fmt.Errorf("execution polled by another organization: status %d (%v), want 404", status, err)
+	}
+	if status, err := call(http.MethodDelete, execution, "bob", "", nil); err != nil || status != http.StatusNotFound {
+		return fmt.Errorf("execution cancelled by another organization: status %d (%v), want 404", status, err)
+	}
+	if status, err := call(http.MethodGet, execution, "alice", "", nil); err != nil || status != http.StatusOK {
+		return fmt.Errorf("execution polled by its organization: status %d (%v), want 200", status, err)
+	}
+	return nil
+}
+
+func testAPIKeys(ctx context.Context, h *harness) error {
+	newKey := func(id string, configure func(*runner.APIKey)) string {
+		key, hash, err := runner.NewAPIKey()
+		if err != nil {
+			panic(err)
+		}
+		k := runner.APIKey{ID: id, OrganizationID: "org-alice", KeyHash: hash}
+		if configure != nil {
+			configure(&k)
+		}
+		h.store.PutAPIKey(k)
+		return key
+	}
+	past := time.Now().Add(-time.Minute)
+	full := newKey("key-full", nil)
+	scoped := newKey("key-scoped", func(k *runner.APIKey) { k.QueryIDs = []string{queryForeignConnector} })
+	revoked := newKey("key-revoked", func(k *runner.APIKey) { k.RevokedAt = &past })
+	expired := newKey("key-expired", func(k *runner.APIKey) { k.ExpiresAt = &past })
+
+	for name, key := range map[string]string{
+		"revoked": revoked,
+		"expired": expired,
+		"unknown": runner.APIKeyPrefix + "unknown",
+	} {
+		conn, _, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL+"?api_key="+key, nil)
+		if err != nil {
+			return fmt.Errorf("%s key: %w", name, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		conn.Close()
+		if !gorilla.IsCloseError(err, protocol.CloseUnauthorized) {
+			return fmt.Errorf("%s key: read error %v, want close %d", name, err, protocol.CloseUnauthorized)
+		}
+	}
+
+	run := func(opts client.Options, queryID string) (*client.Result, error) {
+		c, err := h.dialOptions(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID})
+		if err != nil {
+			return nil, err
+		}
+		return stream.Collect(ctx)
+	}
+
+	// Keys are accepted as a bearer token and in the X-API-Key header
+	for name, opts := range map[string]client.Options{
+		"bearer": {Token: full},
+		"header": {Header: http.Header{"X-API-Key": {full}}},
+	} {
+		result, err := run(opts, queryAlice)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+			return fmt.Errorf("%s: status %q (error %q), want 3 rows", name, result.Status, result.Error)
+		}
+	}
+
+	// A scoped key runs only its queries
+	result, err := run(client.Options{Token: scoped}, queryAlice)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, "query not found") {
+		return fmt.Errorf("scoped key outside its scope: status %q (error %q), want query not found", result.Status, result.Error)
+	}
+	result, err = run(client.Options{Token: scoped}, queryForeignConnector)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(result.Error, "connector not found") {
+		return fmt.Errorf("scoped key within its scope: error %q, want the query to resolve", result.Error)
+	}
+
+	// And the REST API takes them the same way
+	for _, tc := range []struct {
+		name, key string
+		want      int
+	}{
+		{"full key", full, http.StatusOK},
+		{"scoped key", scoped, http.StatusNotFound},
+		{"revoked key", revoked, http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.server.URL+"/api/v1/queries/"+queryAlice+"/execute", strings.NewReader(`{}`))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-API-Key", tc.key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			return fmt.Errorf("REST with %s: status %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+	return nil
+}
+
+func testAllowedOrigins(ctx context.Context, h *harness) error {
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true}, // non-browser clients send no origin
+		{"https://app.example.com", true},
+		{"https://eu.app.example.org", true},
+		{"https://example.org", false},
+		{"http://app.example.com", false},
+		{"https://evil.com", false},
+	} {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		conn, resp, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if tc.want && err != nil {
+			return fmt.Errorf("origin %q: %v, want the upgrade to succeed", tc.origin, err)
+		}
+		if !tc.want && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			return fmt.Errorf("origin %q: upgrade allowed, want 403", tc.origin)
+		}
+	}
+
+	request := func(method, path, origin string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, h.server.URL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	// Preflights are answered for allowed origins
+	resp, err := request(http.MethodOptions, "/api/v1/queries/"+queryFast+"/execute", "https://app.example.com", http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"authorization, content-type"},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "POST") {
+		return fmt.Errorf("preflight: status %d with headers %v", resp.StatusCode, resp.Header)
+	}
+
+	// Responses name the allowed origin and refuse others
+	resp, err = request(http.MethodGet, "/export?queryId="+queryFast, "https://eu.app.example.org", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://eu.app.example.org" {
+		return fmt.Errorf("export: status %d, allowed origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	resp, err = request(http.MethodPost, "/api/v1/queries/"+queryFast+"/execute", "https://evil.com", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		return fmt.Errorf("other origin: status %d, want 403 without CORS headers", resp.StatusCode)
+	}
+	return nil
+}
+
+func testQuotas(ctx context.Context, h *harness) error {
+	slow := mockConnector("connector-alice-slow", 3, 100)
+	slow.OrganizationID = "org-alice"
+	h.store.PutConnector(slow)
+	h.store.PutQuery(runner.Query{ID: "query-alice-slow", OrganizationID: "org-alice", ConnectorID: slow.ID, Content: "select * from slow"})
+	h.store.PutQuota(runner.Quota{OrganizationID: "org-alice", MaxConcurrentQueries: 1, MaxRowsPerQuery: 2})
+	h.store.PutQuota(runner.Quota{OrganizationID: "org-bob", MaxQueriesPerMinute: 2})
+
+	dial := func(user string) (*client.Client, error) {
+		return h.dialOptions(ctx, client.Options{Token: signToken(authSecret, user, time.Hour)})
+	}
+	alice, err := dial("alice")
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+
+	// Results are cut at the organization's row limit
+	stream, err := alice.Execute(protocol.QueryRequest{QueryID: queryAlice})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 2 || !result.Truncated {
+		return fmt.Errorf("row limit: status %q with %d rows (truncated %v), want 2 truncated rows", result.Status, len(result.Rows), result.Truncated)
+	}
+
+	// A second query is refused while the first is running
+	running, err := alice.Execute(protocol.QueryRequest{QueryID: "query-alice-slow"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, running, protocol.StatusRunning); err != nil {
+		return err
+	}
+	stream, err = alice.Execute(protocol.QueryRequest{QueryID: queryAlice})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.ErrorCode != protocol.ErrorCodeRateLimited || !strings.Contains(result.Error, "concurrent") {
+		return fmt.Errorf("concurrency limit: error %q code %q, want %s", result.Error, result.ErrorCode, protocol.ErrorCodeRateLimited)
+	}
+	if result, err = running.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("running query: %+v (%v)", result, err)
+	}
+	if err := expectCompleted(ctx, alice, queryAlice); err != nil {
+		return fmt.Errorf("after the running query finished: %w", err)
+	}
+
+	// Queries per minute are counted across connections and the REST API
+	bob, err := dial("bob")
+	if err != nil {
+		return err
+	}
+	defer bob.Close()
+	if err := expectCompleted(ctx, bob, queryBob); err != nil {
+		return err
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.server.URL+"/api/v1/queries/"+queryBob+"/execute", strings.NewReader(`{}`))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+signToken(authSecret, "bob", time.Hour))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			return fmt.Errorf("REST query %d: status %d, want %d", i+2, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			return errors.New("rate limited REST response without Retry-After")
+		}
+	}
+	stream, err = bob.Execute(protocol.QueryRequest{QueryID: queryBob})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	retryAfter, _ := result.Messages[len(result.Messages)-1].Payload["retryAfterMs"].(float64)
+	if result.ErrorCode != protocol.ErrorCodeRateLimited || retryAfter <= 0 {
+		return fmt.Errorf("per-minute limit: error %q code %q retryAfterMs %v", result.Error, result.ErrorCode, retryAfter)
+	}
+	return nil
+}
+
+func testScanBudget(ctx context.Context, h *harness) error {
+	scanning := mockConnector("connector-alice-scan", 2, 0)
+	scanning.OrganizationID = "org-alice"
+	var config map[string]interface{}
+	if err := json.Unmarshal(scanning.Config, &config); err != nil {
+		return err
+	}
+	config["bytes_scanned"] = 1000
+	scanning.Config, _ = json.Marshal(config)
+	h.store.PutConnector(scanning)
+	h.store.PutQuery(runner.Query{ID: "query-alice-scan", OrganizationID: "org-alice", ConnectorID: scanning.ID, Content: "select * from events"})
+	h.store.PutQuota(runner.Quota{OrganizationID: "org-alice", MaxBytesScannedPerMonth: 1500})
+
+	alice, err := h.dialOptions(ctx, client.Options{Token: signToken(authSecret, "alice", time.Hour)})
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+
+	// The first query fits the budget and reports what it scanned
+	stream, err := alice.Execute(protocol.QueryRequest{QueryID: "query-alice-scan", StreamID: "scan-1"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("first query: %v (%+v)", err, result)
+	}
+	scanned, _ := result.Messages[len(result.Messages)-2].Payload["bytesScanned"].(float64)
+	if scanned != 1000 {
+		return fmt.Errorf("completed payload reports %v bytes scanned, want 1000", scanned)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "scan-1"); err != nil {
+		return err
+	}
+	for _, e := range h.store.AuditEntries() {
+		if e.StreamID == "scan-1" && e.BytesScanned != 1000 {
+			return fmt.Errorf("audit entry records %d bytes scanned, want 1000", e.BytesScanned)
+		}
+	}
+
+	// The second starts under budget and takes usage past it
+	if err := expectCompleted(ctx, alice, "query-alice-scan"); err != nil {
+		return fmt.Errorf("second query: %w", err)
+	}
+
+	// Further queries are refused until the month is out
+	stream, err = alice.Execute(protocol.QueryRequest{QueryID: "query-alice-scan"})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	retryAfter, _ := result.Messages[len(result.Messages)-1].Payload["retryAfterMs"].(float64)
+	if result.ErrorCode != protocol.ErrorCodeScanBudgetExceeded || retryAfter <= 0 {
+		return fmt.Errorf("over budget: error %q code %q retryAfterMs %v", result.Error, result.ErrorCode, retryAfter)
+	}
+	return nil
+}
+
+func testRowLevelSecurity(ctx context.Context, h *harness) error {
+	h.store.PutQuery(runner.Query{
+		ID:             "query-alice-rls",
+		OrganizationID: "org-alice",
+		ConnectorID:    "connector-org-alice",
+		Content:        "select * from events where org_id = '{{.User.OrgID}}' and user_id = '{{.User.ID}}' and role = '{{.User.Claims.role}}'",
+	})
+
+	alice, err := h.dialOptions(ctx, client.Options{Token: signToken(authSecret, "alice", time.Hour)})
+	if err != nil {
+		return err
+	}
+	defer alice.Close()
+
+	// A User variable in the request is replaced by the token's identity
+	spoof := map[string]interface{}{"User": map[string]interface{}{"ID": "bob", "OrgID": "org-bob"}}
+	stream, err := alice.Execute(protocol.QueryRequest{QueryID: "query-alice-rls", StreamID: "rls-alice", TemplateData: spoof})
+	if err != nil {
+		return err
+	}
+	if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("query: %v (%+v)", err, result)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "rls-alice"); err != nil {
+		return err
+	}
+	want := "select * from events where org_id = 'org-alice' and user_id = 'alice' and role = 'authenticated'"
+	var executionID string
+	for _, e := range h.store.AuditEntries() {
+		if e.StreamID != "rls-alice" {
+			continue
+		}
+		if e.RenderedSQL != want {
+			return fmt.Errorf("rendered %q, want %q", e.RenderedSQL, want)
+		}
+		executionID = e.ExecutionID
+	}
+
+	// A teammate cannot replay alice's SQL to read the rows it filtered to
+	carol, err := h.dialOptions(ctx, client.Options{Token: signMemberToken(authSecret, "carol", "org-alice", time.Hour)})
+	if err != nil {
+		return err
+	}
+	defer carol.Close()
+	stolen, err := carol.Execute(protocol.QueryRequest{QueryID: "query-alice-rls", Replay: executionID})
+	if err != nil {
+		return err
+	}
+	if err := waitForError(ctx, stolen, "execution not found"); err != nil {
+		return fmt.Errorf("teammate replay: %w", err)
+	}
+
+	// Nor read it, or alice's identity, from the history
+	recorded := func(c *client.Client) (*protocol.ExecutionRecord, error) {
+		records, err := c.History(ctx, "query-alice-rls", 10)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.ExecutionID == executionID {
+				return &r, nil
+			}
+		}
+		return nil, fmt.Errorf("history %+v lacks execution %s", records, executionID)
+	}
+	record, err := recorded(carol)
+	if err != nil {
+		return err
+	}
+	if record.RenderedSQL != "" || record.TemplateData != nil {
+		return fmt.Errorf("teammate history %+v, want alice's execution without its SQL and template data", record)
+	}
+	record, err = recorded(alice)
+	if err != nil {
+		return err
+	}
+	if record.RenderedSQL != want {
+		return fmt.Errorf("own history %+v, want the execution with its SQL", record)
+	}
+	if data, _ := record.TemplateData.(map[string]interface{}); data["User"] != nil {
+		return fmt.Errorf("history template data %v records the caller", data)
+	}
+
+	replay, err := alice.Execute(protocol.QueryRequest{QueryID: "query-alice-rls", Replay: executionID})
+	if err != nil {
+		return err
+	}
+	if result, err := replay.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("own replay: %v (%+v)", err, result)
+	}
+	return nil
+}
+
+func connectionLimits(cfg *websocket.Config) {
+	jwtAuth(cfg)
+	cfg.ConnectionLimits = websocket.ConnectionLimits{MaxConnections: 4, PerIP: 3, PerOrganization: 2}
+}
+
+func testConnectionLimits(ctx context.Context, h *harness) error {
+	var open []*gorilla.Conn
+	defer func() {
+		for _, conn := range open {
+			conn.Close()
+		}
+	}()
+	// connect opens a connection as user and waits for its hello, or
+	// returns the upgrade status or close code it was refused with
+	connect := func(user string) (int, error) {
+		conn, resp, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL+"?access_token="+signToken(authSecret, user, time.Hour), nil)
+		if err != nil {
+			if resp != nil {
+				return resp.StatusCode, nil
+			}
+			return 0, err
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var hello protocol.WSMessage
+		if err := conn.ReadJSON(&hello); err != nil {
+			conn.Close()
+			var closeErr *gorilla.CloseError
+			if errors.As(err, &closeErr) {
+				return closeErr.Code, nil
+			}
+			return 0, err
+		}
+		open = append(open, conn)
+		return http.StatusSwitchingProtocols, nil
+	}
+	expect := func(user string, want int) error {
+		got, err := connect(user)
+		if err != nil {
+			return fmt.Errorf("%s: %w", user, err)
+		}
+		if got != want {
+			return fmt.Errorf("%s: connection got %d, want %d", user, got, want)
+		}
+		return nil
+	}
+
+	// An organization's connections beyond its limit are closed once they
+	// authenticate
+	for _, step := range []struct {
+		user string
+		want int
+	}{
+		{"alice", http.StatusSwitchingProtocols},
+		{"alice", http.StatusSwitchingProtocols},
+		{"alice", protocol.CloseTooManyConnections},
+		{"bob", http.StatusSwitchingProtocols},
+		// A client address beyond its limit is refused at upgrade
+		{"bob", http.StatusTooManyRequests},
+	} {
+		if err := expect(step.user, step.want); err != nil {
+			return err
+		}
+	}
+
+	// Closing a connection frees its place
+	open[0].Close()
+	open = open[1:]
+	time.Sleep(50 * time.Millisecond)
+	if err := expect("alice", http.StatusSwitchingProtocols); err != nil {
+		return err
+	}
+
+	// Limits reload; the server-wide limit refuses upgrades with 503
+	h.executor.Reload(websocket.Config{MaxWorkers: 3, QueueCapacity: 100,
+		ConnectionLimits: websocket.ConnectionLimits{MaxConnections: 4, PerOrganization: 2}})
+	if err := expect("bob", http.StatusSwitchingProtocols); err != nil {
+		return err
+	}
+	if err := expect("carol", http.StatusServiceUnavailable); err != nil {
+		return err
+	}
+
+	if got := h.executor.Snapshot().RejectedConnections; got != (websocket.ConnectionRejections{Server: 1, IP: 1, Organization: 1}) {
+		return fmt.Errorf("rejected connections %+v, want one per limit", got)
+	}
+	return nil
+}
@@ -0,0 +1,624 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// warmPool refills quickly, so a connector pinned after startup is warmed
+// within the scenario
+func warmPool(cfg *websocket.Config) {
+	cfg.WarmPool = runner.WarmPoolConfig{Size: 1, Interval: 50 * time.Millisecond}
+}
+
+// prewarm reads the declared queries often, so one declared after startup
+// is picked up within the scenario
+func prewarm(cfg *websocket.Config) {
+	resultCache(cfg)
+	cfg.Prewarm = websocket.PrewarmConfig{Interval: 50 * time.Millisecond}
+}
+
+// prewarmQuotas lets each organization declare two pre-warmed queries
+func prewarmQuotas(cfg *websocket.Config) {
+	prewarm(cfg)
+	jwtAuth(cfg)
+	cfg.Prewarm.MaxPerOrganization = 2
+}
+
+func resultCache(cfg *websocket.Config) {
+	cfg.ResultCache = runner.ResultCacheConfig{Enabled: true, TTL: time.Minute}
+}
+
+func dedupeInFlight(cfg *websocket.Config) {
+	cfg.DedupeInFlight = true
+}
+
+func testResultCache(ctx context.Context, h *harness) error {
+	h.store.PutQuery(runner.Query{ID: "query-uncached", ConnectorID: "connector-fast", Content: "select * from uncached", ResultCacheTTL: -1})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	run := func(queryID string, table string, control string) (*client.Result, error) {
+		stream, err := c.Execute(protocol.QueryRequest{
+			QueryID:      queryID,
+			TemplateData: map[string]interface{}{"Table": table},
+			CacheControl: control,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return nil, fmt.Errorf("%s: status %q (error %q)", queryID, result.Status, result.Error)
+		}
+		if len(result.Rows) != fastRows {
+			return nil, fmt.Errorf("%s: got %d rows, want %d", queryID, len(result.Rows), fastRows)
+		}
+		return result, nil
+	}
+
+	steps := []struct {
+		queryID, table, control string
+		fromCache               bool
+	}{
+		{queryFast, "cached", "", false},
+		{queryFast, "cached", "", true},
+		{queryFast, "other", "", false}, // different template data
+		{queryFast, "cached", runner.CacheBypass, false},
+		{queryFast, "cached", runner.CacheRefresh, false},
+		{queryFast, "cached", runner.CacheUse, true},
+		{"query-uncached", "", "", false},
+		{"query-uncached", "", "", false},
+	}
+	for i, step := range steps {
+		result, err := run(step.queryID, step.table, step.control)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if result.FromCache != step.fromCache {
+			return fmt.Errorf("step %d (%s %q %q): fromCache = %v, want %v",
+				i+1, step.queryID, step.table, step.control, result.FromCache, step.fromCache)
+		}
+		if step.fromCache {
+			for _, msg := range result.Messages {
+				if msg.Type == protocol.MessageTypeRow && msg.Payload["fromCache"] != true {
+					return fmt.Errorf("step %d: replayed row batch not marked fromCache", i+1)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func testSharedResultCache(ctx context.Context, h *harness) error {
+	redis, err := miniredis.Run()
+	if err != nil {
+		return err
+	}
+	defer redis.Close()
+
+	shared := func(cfg *websocket.Config) {
+		cfg.ResultCache = runner.ResultCacheConfig{Enabled: true, RedisURL: "redis://" + redis.Addr()}
+	}
+	replicas := []string{h.replica(shared), h.replica(shared)}
+
+	clients := make([]*client.Client, len(replicas))
+	for i, url := range replicas {
+		c, err := client.Dial(ctx, url, nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	run := func(c *client.Client, queryID string, rows int) (*client.Result, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID, TemplateData: map[string]interface{}{"Table": "shared"}})
+		if err != nil {
+			return nil, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != rows {
+			return nil, fmt.Errorf("%s: status %q (error %q) with %d rows, want %d", queryID, result.Status, result.Error, len(result.Rows), rows)
+		}
+		return result, nil
+	}
+
+	// A result cached by one replica is replayed by the other
+	first, err := run(clients[0], queryFast, fastRows)
+	if err != nil {
+		return err
+	}
+	second, err := run(clients[1], queryFast, fastRows)
+	if err != nil {
+		return err
+	}
+	if first.FromCache || !second.FromCache {
+		return fmt.Errorf("fromCache = %v then %v, want false then true", first.FromCache, second.FromCache)
+	}
+
+	// Concurrent identical requests on both replicas execute once
+	results := make([]*client.Result, len(clients))
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			results[i], errs[i] = run(c, queryPaced, pacedRows)
+		}(i, c)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if results[0].FromCache == results[1].FromCache {
+		return fmt.Errorf("concurrent requests: fromCache = %v and %v, want exactly one replayed", results[0].FromCache, results[1].FromCache)
+	}
+	return nil
+}
+
+func testInFlightDedup(ctx context.Context, h *harness) error {
+	// The engine takes a while to plan, so every request below arrives
+	// before the first one's rows
+	config, err := json.Marshal(map[string]interface{}{
+		"columns":        []string{"id"},
+		"rows":           [][]interface{}{{1}, {2}, {3}},
+		"query_delay_ms": 300,
+	})
+	if err != nil {
+		return err
+	}
+	h.store.PutConnector(runner.Connector{ID: "connector-planned", Type: string(driver.MockType), Config: config})
+	h.store.PutQuery(runner.Query{ID: "query-planned", ConnectorID: "connector-planned", Content: "select * from planned"})
+
+	clients := make([]*client.Client, 2)
+	for i := range clients {
+		c, err := h.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+
+	requests := []struct {
+		c     *client.Client
+		table string
+	}{
+		{clients[0], "shared"},
+		{clients[1], "shared"},
+		{clients[1], "shared"}, // a second stream on the same connection
+		{clients[0], "other"},  // different template data runs on its own
+	}
+	streams := make([]*client.Stream, len(requests))
+	for i, r := range requests {
+		stream, err := r.c.Execute(protocol.QueryRequest{
+			QueryID:      "query-planned",
+			TemplateData: map[string]interface{}{"Table": r.table},
+			Verbose:      true,
+		})
+		if err != nil {
+			return err
+		}
+		streams[i] = stream
+	}
+
+	joined := make([]bool, len(streams))
+	for i, stream := range streams {
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("stream %d: %w", i, err)
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+			return fmt.Errorf("stream %d: status %q (error %q) with %d rows, want 3", i, result.Status, result.Error, len(result.Rows))
+		}
+		for _, msg := range result.Messages {
+			if msg.Type == protocol.MessageTypeStatus && msg.Payload["event"] == "joined_execution" {
+				joined[i] = true
+			}
+		}
+	}
+	// Whichever shared request reached a worker first runs the query
+	var members int
+	for _, j := range joined[:3] {
+		if j {
+			members++
+		}
+	}
+	if members != 2 || joined[3] {
+		return fmt.Errorf("joined shared execution = %v, want two of the first three", joined)
+	}
+	return nil
+}
+
+func metadataCache(cfg *websocket.Config) {
+	cfg.MetadataCache = runner.MetadataCacheConfig{TTL: 300 * time.Millisecond}
+}
+
+func testMetadataCache(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	run := func(streamID string, cacheBust bool) (int64, error) {
+		before := h.outage.fetches.Load()
+		stream, err := c.Execute(protocol.QueryRequest{
+			QueryID:      queryFast,
+			StreamID:     streamID,
+			TemplateData: map[string]interface{}{"Table": "events"},
+			CacheBust:    cacheBust,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+			return 0, fmt.Errorf("%s: %v (%+v)", streamID, err, result)
+		}
+		return h.outage.fetches.Load() - before, nil
+	}
+
+	// The first run fetches the query and connector; the next reuses them
+	if fetched, err := run("first", false); err != nil || fetched != 2 {
+		return fmt.Errorf("first run fetched %d rows (%v), want the query and connector", fetched, err)
+	}
+	if fetched, err := run("cached", false); err != nil || fetched != 0 {
+		return fmt.Errorf("cached run fetched %d rows (%v), want none", fetched, err)
+	}
+
+	// cacheBust fetches both again and refreshes the cache
+	if fetched, err := run("busted", true); err != nil || fetched != 2 {
+		return fmt.Errorf("cacheBust run fetched %d rows (%v), want the query and connector", fetched, err)
+	}
+	if fetched, err := run("after-bust", false); err != nil || fetched != 0 {
+		return fmt.Errorf("run after cacheBust fetched %d rows (%v), want none", fetched, err)
+	}
+
+	// Entries expire after the TTL
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(400 * time.Millisecond):
+	}
+	if fetched, err := run("expired", false); err != nil || fetched != 2 {
+		return fmt.Errorf("run after the TTL fetched %d rows (%v), want the query and connector", fetched, err)
+	}
+	return nil
+}
+
+func testWarmPool(ctx context.Context, h *harness) error {
+	// Connecting takes a second, as to an engine with a slow handshake
+	connector := mockConnector("connector-pinned", 3, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns":          []string{"id"},
+		"rows":             [][]interface{}{{1}, {2}, {3}},
+		"connect_delay_ms": 1000,
+	})
+	connector.Pinned = true
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-pinned", ConnectorID: connector.ID, Content: "select 1"})
+
+	warmed := func(want int) error {
+		for {
+			got := h.executor.Snapshot().WarmDrivers[connector.ID]
+			if got == want {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%d warm drivers, want %d: %w", got, want, ctx.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	if err := warmed(1); err != nil {
+		return err
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Each query takes a warm driver, which the pool replaces
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if err := expectCompleted(ctx, c, "query-pinned"); err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			return fmt.Errorf("query %d on a pinned connector took %s, want it to skip connecting", i+1, elapsed)
+		}
+		if err := warmed(1); err != nil {
+			return fmt.Errorf("after query %d: %w", i+1, err)
+		}
+	}
+
+	// Unpinning the connector closes its drivers
+	connector.Pinned = false
+	h.store.PutConnector(connector)
+	return warmed(0)
+}
+
+func testPrewarm(ctx context.Context, h *harness) error {
+	call := func(base, method, path string, body string, into interface{}) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, method, base+path, strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if into != nil && resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+				return resp.StatusCode, err
+			}
+		}
+		return resp.StatusCode, nil
+	}
+	// warmed waits for a pre-warmed query's run on an executor
+	warmed := func(base, id string) error {
+		for {
+			var list struct {
+				Prewarms []protocol.PrewarmedQuery `json:"prewarms"`
+			}
+			if _, err := call(base, http.MethodGet, "/api/v1/prewarms", "", &list); err != nil {
+				return err
+			}
+			for _, p := range list.Prewarms {
+				if p.ID != id || p.LastRunAt == nil {
+					continue
+				}
+				if p.LastError != "" || p.LastRows != fastRows {
+					return fmt.Errorf("pre-warm %s: %d rows (error %q), want %d", id, p.LastRows, p.LastError, fastRows)
+				}
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("pre-warm %s did not run: %w", id, ctx.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	fromCache := func(c *client.Client, table string) (bool, error) {
+		stream, err := c.Execute(protocol.QueryRequest{
+			QueryID:      queryFast,
+			TemplateData: map[string]interface{}{"Table": table},
+		})
+		if err != nil {
+			return false, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return false, err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return false, fmt.Errorf("%s: status %q (error %q)", table, result.Status, result.Error)
+		}
+		return result.FromCache, nil
+	}
+
+	// Declarations are checked before they are saved
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"queryId":"` + queryFast + `","intervalSeconds":5}`, http.StatusBadRequest},
+		{`{"queryId":"` + queryFast + `","timezone":"Mars/Olympus"}`, http.StatusBadRequest},
+		{`{"queryId":"query-missing"}`, http.StatusNotFound},
+	} {
+		status, err := call(h.server.URL, http.MethodPost, "/api/v1/prewarms", tc.body, nil)
+		if err != nil {
+			return err
+		}
+		if status != tc.want {
+			return fmt.Errorf("declare %s: got %d, want %d", tc.body, status, tc.want)
+		}
+	}
+
+	// A declared query is executed right away, so the dashboard's first
+	// execution is served from the cache
+	var declared protocol.PrewarmedQuery
+	status, err := call(h.server.URL, http.MethodPost, "/api/v1/prewarms",
+		`{"queryId":"`+queryFast+`","templateData":{"Table":"warm"}}`, &declared)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusCreated || declared.ID == "" {
+		return fmt.Errorf("declare: got %d with ID %q, want %d", status, declared.ID, http.StatusCreated)
+	}
+	if err := warmed(h.server.URL, declared.ID); err != nil {
+		return err
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for _, step := range []struct {
+		table string
+		want  bool
+	}{{"warm", true}, {"cold", false}} {
+		cached, err := fromCache(c, step.table)
+		if err != nil {
+			return err
+		}
+		if cached != step.want {
+			return fmt.Errorf("table %s: fromCache = %v, want %v", step.table, cached, step.want)
+		}
+	}
+
+	// An executor starting up warms the queries marked on_startup, but not
+	// those declared to run only once
+	if err := h.store.SavePrewarm(ctx, runner.Prewarm{
+		ID:           "prewarm-startup",
+		QueryID:      queryFast,
+		TemplateData: map[string]interface{}{"Table": "startup"},
+		OnStartup:    true,
+		CreatedAt:    time.Now(),
+	}); err != nil {
+		return err
+	}
+	replica := h.replica(prewarm)
+	replicaURL := "http" + strings.TrimSuffix(strings.TrimPrefix(replica, "ws"), "/ws")
+	if err := warmed(replicaURL, "prewarm-startup"); err != nil {
+		return err
+	}
+	rc, err := client.Dial(ctx, replica, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	for _, step := range []struct {
+		table string
+		want  bool
+	}{{"startup", true}, {"warm", false}} {
+		cached, err := fromCache(rc, step.table)
+		if err != nil {
+			return err
+		}
+		if cached != step.want {
+			return fmt.Errorf("replica, table %s: fromCache = %v, want %v", step.table, cached, step.want)
+		}
+	}
+
+	// Deleting a declaration stops its pre-warming
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		status, err := call(h.server.URL, http.MethodDelete, "/api/v1/prewarms/"+declared.ID, "", nil)
+		if err != nil {
+			return err
+		}
+		if status != want {
+			return fmt.Errorf("delete: got %d, want %d", status, want)
+		}
+	}
+	remaining, err := h.store.ListPrewarms(ctx)
+	if err != nil {
+		return err
+	}
+	if len(remaining) != 1 || remaining[0].ID != "prewarm-startup" {
+		return fmt.Errorf("after delete, %d pre-warmed queries remain, want only prewarm-startup", len(remaining))
+	}
+	return nil
+}
+
+func testPrewarmQuotas(ctx context.Context, h *harness) error {
+	h.store.PutQuota(runner.Quota{OrganizationID: "org-alice", MaxQueriesPerMinute: 1})
+
+	declare := func(table string) (int, *protocol.PrewarmedQuery, error) {
+		body := `{"queryId":"` + queryAlice + `","templateData":{"Table":"` + table + `"}}`
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.server.URL+"/api/v1/prewarms", strings.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+signToken(authSecret, "alice", time.Hour))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		var declared protocol.PrewarmedQuery
+		if resp.StatusCode == http.StatusCreated {
+			if err := json.NewDecoder(resp.Body).Decode(&declared); err != nil {
+				return resp.StatusCode, nil, err
+			}
+		}
+		return resp.StatusCode, &declared, nil
+	}
+	// lastRun waits for a pre-warmed query's run and returns its record
+	lastRun := func(id string) (*protocol.PrewarmedQuery, error) {
+		for {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.server.URL+"/api/v1/prewarms", nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+signToken(authSecret, "alice", time.Hour))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			var list struct {
+				Prewarms []protocol.PrewarmedQuery `json:"prewarms"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&list)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range list.Prewarms {
+				if p.ID == id && p.LastRunAt != nil {
+					return &p, nil
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("pre-warm %s did not run: %w", id, ctx.Err())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	// The first run takes the organization's only query of the minute, so
+	// the second is skipped
+	for i, want := range []string{"", "rate limited"} {
+		status, declared, err := declare(fmt.Sprintf("t%d", i))
+		if err != nil {
+			return err
+		}
+		if status != http.StatusCreated {
+			return fmt.Errorf("declare %d: got %d, want %d", i+1, status, http.StatusCreated)
+		}
+		run, err := lastRun(declared.ID)
+		if err != nil {
+			return err
+		}
+		if want == "" && (run.LastError != "" || run.LastRows != 3) {
+			return fmt.Errorf("run %d: %d rows (error %q), want 3 rows", i+1, run.LastRows, run.LastError)
+		}
+		if want != "" && !strings.Contains(run.LastError, want) {
+			return fmt.Errorf("run %d: error %q, want %q", i+1, run.LastError, want)
+		}
+	}
+
+	// The organization has declared as many as it may
+	status, _, err := declare("t2")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusConflict {
+		return fmt.Errorf("declaring over the limit: got %d, want %d", status, http.StatusConflict)
+	}
+	return nil
+}
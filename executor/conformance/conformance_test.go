@@ -0,0 +1,197 @@
+// Package conformance holds the protocol conformance suite: every scenario
+// spins up an in-process executor backed by the mock driver and drives it
+// through the client SDK, so the server and client cannot drift apart
+// without go test failing. Scenarios taking seconds are skipped with -short.
+//
+// TestEngines runs the executor against real engines or their emulators,
+// given with CONFORMANCE_POSTGRES, CONFORMANCE_BIGQUERY and
+// CONFORMANCE_ATHENA or started in Docker with CONFORMANCE_DOCKER=1, and is
+// skipped without them.
+package conformance
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// errSkipped is returned by scenarios that cannot run in this environment,
+// such as those needing a database server that was not given
+var errSkipped = errors.New("skipped")
+
+// scenario is a single conformance check
+type scenario struct {
+	name string
+	cfg  func(*websocket.Config)
+	run  func(ctx context.Context, h *harness) error
+	// long scenarios take seconds and are skipped with -short
+	long bool
+}
+
+// harness is an in-process executor plus helpers to talk to it
+type harness struct {
+	server   *httptest.Server
+	executor *websocket.Server
+	store    *runner.MemoryStore
+	outage   *outageStore
+	cache    *runner.CachingStore
+	wsURL    string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	replicas []*httptest.Server
+	// executors behind replicas, drained on close to stop their workers
+	executors []*websocket.Server
+}
+
+func newHarness(configure func(*websocket.Config)) *harness {
+	cfg := websocket.Config{
+		MaxWorkers:    3,
+		QueueCapacity: 100,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	store := runner.NewMemoryStore()
+	seedFixtures(store)
+
+	// Wire the store the way production does: a metadata cache in front of
+	// a backend that scenarios can take down
+	outage := &outageStore{MemoryStore: store}
+	cache := runner.NewCachingStore(outage)
+	executor := websocket.NewServerWithStore(cfg, cache)
+	srv := httptest.NewServer(executor.Handler())
+	return &harness{
+		server:   srv,
+		executor: executor,
+		store:    store,
+		outage:   outage,
+		cache:    cache,
+		wsURL:    "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+	}
+}
+
+func (h *harness) dial(ctx context.Context) (*client.Client, error) {
+	return h.dialOptions(ctx, client.Options{})
+}
+
+// dialOptions connects with opts, recording every underlying connection
+// (including reconnects) so dropConnections can sever them
+func (h *harness) dialOptions(ctx context.Context, opts client.Options) (*client.Client, error) {
+	opts.Dialer = &gorilla.Dialer{
+		HandshakeTimeout: 5 * time.Second,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				h.mu.Lock()
+				h.conns = append(h.conns, conn)
+				h.mu.Unlock()
+			}
+			return conn, err
+		},
+	}
+	return client.DialOptions(ctx, h.wsURL, opts)
+}
+
+// dropConnections severs every client connection at the TCP level,
+// simulating a network failure without a close handshake
+func (h *harness) dropConnections() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conn := range h.conns {
+		conn.Close()
+	}
+	h.conns = nil
+}
+
+// replica starts another executor on the harness's store, as a second
+// instance behind a load balancer would be, and returns its WebSocket URL
+func (h *harness) replica(configure func(*websocket.Config)) string {
+	cfg := websocket.Config{
+		MaxWorkers:    3,
+		QueueCapacity: 100,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	executor := websocket.NewServerWithStore(cfg, runner.NewCachingStore(h.outage))
+	srv := httptest.NewServer(executor.Handler())
+	h.mu.Lock()
+	h.replicas = append(h.replicas, srv)
+	h.executors = append(h.executors, executor)
+	h.mu.Unlock()
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func (h *harness) close() {
+	h.dropConnections()
+	h.server.Close()
+	for _, srv := range h.replicas {
+		srv.Close()
+	}
+	// Nothing is left to wait for once the servers have closed
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, executor := range h.executors {
+		executor.Drain(ctx)
+	}
+}
+
+// scenarioTimeout bounds each scenario
+const scenarioTimeout = 30 * time.Second
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestConformance(t *testing.T) {
+	runScenarios(t, scenarios)
+}
+
+// runScenarios runs each scenario as a subtest
+func runScenarios(t *testing.T, scenarios []scenario) {
+	for _, sc := range scenarios {
+		t.Run(sc.name, func(t *testing.T) {
+			if sc.long && testing.Short() {
+				t.Skip("long scenario in short mode")
+			}
+			err := runScenario(sc, scenarioTimeout)
+			if errors.Is(err, errSkipped) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func runScenario(sc scenario, timeout time.Duration) error {
+	h := newHarness(sc.cfg)
+	defer h.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return sc.run(ctx, h)
+}
@@ -0,0 +1,365 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jackc/pgx/v5"
+
+	"supalytics-executor/client"
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// engineScenarios run against real engines, the suite of TestEngines
+var engineScenarios = []scenario{
+	{name: "PostgresTypes", run: testPostgresTypes},
+	{name: "PostgresStreaming", run: testPostgresStreaming},
+	{name: "PostgresReadOnly", run: testPostgresReadOnly},
+	{name: "BigQueryEmulator", run: testBigQueryEmulator},
+	{name: "AthenaLocalStack", run: testAthenaLocalStack},
+}
+
+// TestEngines runs the engine scenarios against the engines given in
+// CONFORMANCE_* variables, starting those not given in Docker with
+// CONFORMANCE_DOCKER=1. Scenarios for engines that are not available skip.
+func TestEngines(t *testing.T) {
+	postgresDSN = os.Getenv("CONFORMANCE_POSTGRES")
+	bigqueryEndpoint = os.Getenv("CONFORMANCE_BIGQUERY")
+	athenaEndpoint = os.Getenv("CONFORMANCE_ATHENA")
+	useDocker := os.Getenv("CONFORMANCE_DOCKER") != ""
+	if postgresDSN == "" && bigqueryEndpoint == "" && athenaEndpoint == "" && !useDocker {
+		t.Skip("set CONFORMANCE_POSTGRES, CONFORMANCE_BIGQUERY, CONFORMANCE_ATHENA or CONFORMANCE_DOCKER=1 to run the engine scenarios")
+	}
+	if useDocker {
+		stop, err := startContainers(context.Background())
+		if err != nil {
+			t.Fatalf("starting engines: %v", err)
+		}
+		t.Cleanup(stop)
+	}
+	runScenarios(t, engineScenarios)
+}
+
+// Endpoints of the BigQuery emulator and LocalStack the engine scenarios
+// run against, set with CONFORMANCE_BIGQUERY and CONFORMANCE_ATHENA
+var (
+	bigqueryEndpoint string
+	athenaEndpoint   string
+)
+
+// engineContainer is an engine CONFORMANCE_DOCKER starts when its
+// variable is not set
+type engineContainer struct {
+	name  string
+	image string
+	port  string // the port the engine listens on inside the container
+	env   []string
+	args  []string
+	// target is the endpoint variable set, built from the address the port
+	// is published on
+	target   *string
+	endpoint func(addr string) string
+	// ready reports whether the engine accepts requests at the endpoint
+	ready func(ctx context.Context, endpoint string) error
+}
+
+// engineContainers lists the engines CONFORMANCE_DOCKER starts. LocalStack
+// serves Athena only in its Pro image, so it is started when a
+// LOCALSTACK_AUTH_TOKEN is set.
+func engineContainers() []engineContainer {
+	containers := []engineContainer{
+		{
+			name:   "postgres",
+			image:  "postgres:16-alpine",
+			port:   "5432/tcp",
+			env:    []string{"POSTGRES_PASSWORD=conformance"},
+			target: &postgresDSN,
+			endpoint: func(addr string) string {
+				return "postgres://postgres:conformance@" + addr + "/postgres?sslmode=disable"
+			},
+			ready: func(ctx context.Context, dsn string) error {
+				conn, err := pgx.Connect(ctx, dsn)
+				if err != nil {
+					return err
+				}
+				defer conn.Close(context.Background())
+				return conn.Ping(ctx)
+			},
+		},
+		{
+			name:     "bigquery",
+			image:    "ghcr.io/goccy/bigquery-emulator:latest",
+			port:     "9050/tcp",
+			args:     []string{"--project=conformance", "--dataset=conformance"},
+			target:   &bigqueryEndpoint,
+			endpoint: func(addr string) string { return "http://" + addr },
+			ready: func(ctx context.Context, endpoint string) error {
+				return httpReady(ctx, endpoint+"/bigquery/v2/projects/conformance/datasets")
+			},
+		},
+	}
+	if token := os.Getenv("LOCALSTACK_AUTH_TOKEN"); token != "" {
+		containers = append(containers, engineContainer{
+			name:     "athena",
+			image:    "localstack/localstack-pro:latest",
+			port:     "4566/tcp",
+			env:      []string{"LOCALSTACK_AUTH_TOKEN=" + token, "SERVICES=athena,s3"},
+			target:   &athenaEndpoint,
+			endpoint: func(addr string) string { return "http://" + addr },
+			ready: func(ctx context.Context, endpoint string) error {
+				return httpReady(ctx, endpoint+"/_localstack/health")
+			},
+		})
+	}
+	return containers
+}
+
+// startContainers starts the engines whose variable is not set in Docker,
+// waiting until they accept requests, and returns a function removing them
+func startContainers(ctx context.Context) (func(), error) {
+	var ids []string
+	stop := func() {
+		if len(ids) > 0 {
+			exec.Command("docker", append([]string{"rm", "-f"}, ids...)...).Run()
+		}
+	}
+	for _, c := range engineContainers() {
+		if *c.target != "" {
+			continue
+		}
+		args := []string{"run", "--detach", "--rm", "--publish", "127.0.0.1::" + strings.TrimSuffix(c.port, "/tcp")}
+		for _, env := range c.env {
+			args = append(args, "--env", env)
+		}
+		args = append(append(args, c.image), c.args...)
+		id, err := docker(ctx, args...)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("start %s: %w", c.name, err)
+		}
+		ids = append(ids, id)
+
+		addr, err := docker(ctx, "port", id, c.port)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("find %s's port: %w", c.name, err)
+		}
+		// One line per published address
+		endpoint := c.endpoint(strings.Fields(addr)[0])
+		if err := waitReady(ctx, endpoint, c.ready); err != nil {
+			stop()
+			return nil, fmt.Errorf("%s did not start: %w", c.name, err)
+		}
+		*c.target = endpoint
+	}
+	return stop, nil
+}
+
+// docker runs a docker command and returns its trimmed output
+func docker(ctx context.Context, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, msg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// waitReady polls ready until it succeeds, for at most two minutes as
+// images are pulled on first use
+func waitReady(ctx context.Context, endpoint string, ready func(context.Context, string) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	for {
+		attempt, cancelAttempt := context.WithTimeout(ctx, 5*time.Second)
+		err := ready(attempt, endpoint)
+		cancelAttempt()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// httpReady succeeds once a GET of the URL returns 200
+func httpReady(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// engineQuery runs SQL saved as a query on the connector and collects the
+// result
+func engineQuery(ctx context.Context, c *client.Client, h *harness, connectorID, id, sql string) (*client.Result, error) {
+	h.store.PutQuery(runner.Query{ID: id, ConnectorID: connectorID, Content: sql})
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: id, CacheControl: runner.CacheBypass})
+	if err != nil {
+		return nil, err
+	}
+	return stream.Collect(ctx)
+}
+
+// checkEngineResult checks a completed result's rows and that its
+// messages arrived in the order the UI relies on
+func checkEngineResult(result *client.Result, wantRows string) error {
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("status %q (error %q), want completed", result.Status, result.Error)
+	}
+	if got := fmt.Sprint(result.Rows); got != wantRows {
+		return fmt.Errorf("rows %s, want %s", got, wantRows)
+	}
+	want := []string{"status:queued", "status:running", "metadata", "row", "complete", "status:completed"}
+	if got := messageSequence(result.Messages); !isSubsequence(want, got) {
+		return fmt.Errorf("message sequence %v does not follow %v", got, want)
+	}
+	return nil
+}
+
+// checkEngineError checks a query the engine rejects fails the stream
+// with the engine's error
+func checkEngineError(ctx context.Context, c *client.Client, h *harness, connectorID, sql, want string) error {
+	result, err := engineQuery(ctx, c, h, connectorID, "query-engine-error", sql)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, want) {
+		return fmt.Errorf("%s: status %q (error %q), want failed with %q", sql, result.Status, result.Error, want)
+	}
+	return nil
+}
+
+func testBigQueryEmulator(ctx context.Context, h *harness) error {
+	if bigqueryEndpoint == "" {
+		return fmt.Errorf("%w: no CONFORMANCE_BIGQUERY emulator", errSkipped)
+	}
+	config, _ := json.Marshal(map[string]string{
+		"project_id": "conformance",
+		"dataset":    "conformance",
+		"endpoint":   bigqueryEndpoint,
+	})
+	h.store.PutConnector(runner.Connector{ID: "connector-bigquery", Name: "bigquery", Type: string(driver.BigQueryType), Config: config})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	result, err := engineQuery(ctx, c, h, "connector-bigquery", "query-bigquery",
+		"SELECT n, CONCAT('row-', CAST(n AS STRING)) AS name FROM UNNEST(GENERATE_ARRAY(1, 3)) AS n ORDER BY n")
+	if err != nil {
+		return err
+	}
+	if err := checkEngineResult(result, "[[1 row-1] [2 row-2] [3 row-3]]"); err != nil {
+		return err
+	}
+	return checkEngineError(ctx, c, h, "connector-bigquery", "SELECT * FROM conformance.missing_table", "missing_table")
+}
+
+func testAthenaLocalStack(ctx context.Context, h *harness) error {
+	if athenaEndpoint == "" {
+		return fmt.Errorf("%w: no CONFORMANCE_ATHENA endpoint (LocalStack's Athena needs LOCALSTACK_AUTH_TOKEN)", errSkipped)
+	}
+
+	// Athena writes results to a bucket, which must exist
+	s3Client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(athenaEndpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+		UsePathStyle: true,
+	})
+	_, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("conformance-results")})
+	var owned interface{ ErrorCode() string }
+	if err != nil && !(errors.As(err, &owned) && owned.ErrorCode() == "BucketAlreadyOwnedByYou") {
+		return fmt.Errorf("create results bucket: %w", err)
+	}
+
+	config, _ := json.Marshal(map[string]string{
+		"region":            "us-east-1",
+		"database":          "default",
+		"output_location":   "s3://conformance-results/",
+		"access_key_id":     "test",
+		"secret_access_key": "test",
+		"endpoint":          athenaEndpoint,
+	})
+	h.store.PutConnector(runner.Connector{ID: "connector-athena", Name: "athena", Type: string(driver.AthenaType), Config: config})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	result, err := engineQuery(ctx, c, h, "connector-athena", "query-athena",
+		"SELECT n, concat('row-', CAST(n AS varchar)) AS name FROM UNNEST(sequence(1, 3)) AS t(n) ORDER BY n")
+	if err != nil {
+		return err
+	}
+	if err := checkEngineResult(result, "[[1 row-1] [2 row-2] [3 row-3]]"); err != nil {
+		return err
+	}
+	if err := checkEngineError(ctx, c, h, "connector-athena", "SELECT * FROM missing_table", "missing_table"); err != nil {
+		return err
+	}
+
+	// Unloaded Parquet files are deleted once they have been streamed
+	config, _ = json.Marshal(map[string]string{
+		"region":            "us-east-1",
+		"database":          "default",
+		"output_location":   "s3://conformance-results/",
+		"result_mode":       "unload",
+		"access_key_id":     "test",
+		"secret_access_key": "test",
+		"endpoint":          athenaEndpoint,
+	})
+	h.store.PutConnector(runner.Connector{ID: "connector-athena-unload", Name: "athena-unload", Type: string(driver.AthenaType), Config: config})
+	result, err = engineQuery(ctx, c, h, "connector-athena-unload", "query-athena-unload",
+		"SELECT n FROM UNNEST(sequence(1, 3)) AS t(n)")
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+		return fmt.Errorf("unload: status %q (error %q) with %d rows, want 3 rows", result.Status, result.Error, len(result.Rows))
+	}
+	left, err := s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("conformance-results"), Prefix: aws.String("unload/")})
+	if err != nil {
+		return fmt.Errorf("list unloaded files: %w", err)
+	}
+	if len(left.Contents) != 0 {
+		return fmt.Errorf("%d unloaded files left behind, want none", len(left.Contents))
+	}
+	return nil
+}
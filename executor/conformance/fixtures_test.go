@@ -0,0 +1,129 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/runner"
+)
+
+// Fixture IDs shared by the scenarios
+const (
+	queryFast             = "query-fast"
+	querySlow             = "query-slow"
+	queryMissingConnector = "query-missing-connector"
+	queryMultiStatement   = "query-multi-statement"
+	queryPaced            = "query-paced"
+
+	// Queries owned by organizations, for authenticated callers
+	queryAlice            = "query-org-alice"
+	queryBob              = "query-org-bob"
+	queryForeignConnector = "query-foreign-connector" // alice's query on bob's connector
+
+	fastRows  = 600 // spans several row batches
+	slowRows  = 200
+	pacedRows = 600 // sends its first batch well before it finishes
+)
+
+func seedFixtures(store *runner.MemoryStore) {
+	store.PutConnector(mockConnector("connector-fast", fastRows, 0))
+	store.PutConnector(mockConnector("connector-slow", slowRows, 50))
+	store.PutConnector(mockConnector("connector-paced", pacedRows, 2))
+
+	store.PutQuery(runner.Query{ID: queryFast, ConnectorID: "connector-fast", Content: "select * from {{.Table}}"})
+	store.PutQuery(runner.Query{ID: querySlow, ConnectorID: "connector-slow", Content: "select * from slow"})
+	store.PutQuery(runner.Query{ID: queryPaced, ConnectorID: "connector-paced", Content: "select * from paced"})
+	store.PutParameterSet(runner.ParameterSet{QueryID: queryFast, Name: "fixtures", Values: map[string]interface{}{"Table": "fixtures"}})
+	store.PutParameterSet(runner.ParameterSet{QueryID: queryFast, Name: "incomplete", Values: map[string]interface{}{}})
+	store.PutQuery(runner.Query{ID: queryMissingConnector, ConnectorID: "connector-missing", Content: "select 1"})
+
+	alice := mockConnector("connector-org-alice", 3, 0)
+	alice.OrganizationID = "org-alice"
+	bob := mockConnector("connector-org-bob", 3, 0)
+	bob.OrganizationID = "org-bob"
+	store.PutConnector(alice)
+	store.PutConnector(bob)
+	store.PutQuery(runner.Query{ID: queryAlice, OrganizationID: "org-alice", ConnectorID: alice.ID, Content: "select * from alice"})
+	store.PutQuery(runner.Query{ID: queryBob, OrganizationID: "org-bob", ConnectorID: bob.ID, Content: "select * from bob"})
+	store.PutQuery(runner.Query{ID: queryForeignConnector, OrganizationID: "org-alice", ConnectorID: bob.ID, Content: "select * from bob"})
+
+	store.PutQuery(runner.Query{
+		ID:          queryMultiStatement,
+		ConnectorID: "connector-fast",
+		Content:     "create temp table t as select ';' as x;\n-- setup done;\ninsert into t values ('a');\nselect * from t;",
+	})
+}
+
+func mockConnector(id string, rows int, delayMS int) runner.Connector {
+	data := make([][]interface{}, rows)
+	for i := range data {
+		data[i] = []interface{}{i, fmt.Sprintf("row-%d", i)}
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"columns":      []string{"id", "name"},
+		"rows":         data,
+		"row_delay_ms": delayMS,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return runner.Connector{
+		ID:     id,
+		Name:   id,
+		Type:   string(driver.MockType),
+		Config: config,
+	}
+}
+
+var errStoreUnavailable = errors.New("metadata store unavailable")
+
+// outageStore simulates a metadata backend that can go down
+type outageStore struct {
+	*runner.MemoryStore
+	down atomic.Bool
+	// fetches counts the queries and connectors read from the store
+	fetches atomic.Int64
+}
+
+func (s *outageStore) FetchQuery(ctx context.Context, queryID string) (*runner.Query, error) {
+	s.fetches.Add(1)
+	if s.down.Load() {
+		return nil, errStoreUnavailable
+	}
+	return s.MemoryStore.FetchQuery(ctx, queryID)
+}
+
+func (s *outageStore) FetchConnector(ctx context.Context, connectorID string) (*runner.Connector, error) {
+	s.fetches.Add(1)
+	if s.down.Load() {
+		return nil, errStoreUnavailable
+	}
+	return s.MemoryStore.FetchConnector(ctx, connectorID)
+}
+
+func (s *outageStore) FetchParameterSet(ctx context.Context, queryID string, name string) (*runner.ParameterSet, error) {
+	if s.down.Load() {
+		return nil, errStoreUnavailable
+	}
+	return s.MemoryStore.FetchParameterSet(ctx, queryID, name)
+}
+
+func (s *outageStore) Ping(ctx context.Context) error {
+	if s.down.Load() {
+		return errStoreUnavailable
+	}
+	return nil
+}
+
+func (s *outageStore) RecordExecution(ctx context.Context, entry runner.AuditEntry) error {
+	if s.down.Load() {
+		return errStoreUnavailable
+	}
+	return s.MemoryStore.RecordExecution(ctx, entry)
+}
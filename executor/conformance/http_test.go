@@ -0,0 +1,378 @@
+package conformance
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	"github.com/apache/arrow/go/v15/parquet/file"
+)
+
+func restMaxRows(cfg *websocket.Config) {
+	cfg.RESTMaxRows = 100
+}
+
+// objectStore is a minimal S3-compatible store: objects are PUT and read
+// back by path, and signatures are not checked
+type objectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (o *objectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o.objects[r.URL.Path] = data
+	case http.MethodGet:
+		data, ok := o.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func testSnapshots(ctx context.Context, h *harness) error {
+	store := httptest.NewServer(&objectStore{objects: make(map[string][]byte)})
+	defer store.Close()
+
+	replica := h.replica(func(cfg *websocket.Config) {
+		cfg.Snapshots = runner.SnapshotConfig{
+			Provider:        "s3",
+			Bucket:          "exports",
+			Region:          "us-east-1",
+			Endpoint:        store.URL,
+			PathStyle:       true,
+			AccessKeyID:     "conformance",
+			SecretAccessKey: "conformance",
+		}
+	})
+	h.store.PutQuery(runner.Query{ID: "query-snapshot", ConnectorID: "connector-fast", Content: "select * from exports", SnapshotFormat: runner.SnapshotCSV})
+
+	c, err := client.Dial(ctx, replica, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	run := func(req protocol.QueryRequest, rows int) (*client.Result, []byte, error) {
+		stream, err := c.Execute(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return nil, nil, fmt.Errorf("status %q (error %q)", result.Status, result.Error)
+		}
+		if len(result.Rows) != rows || result.TotalRows != fastRows {
+			return nil, nil, fmt.Errorf("got %d rows streamed of %d, want %d of %d", len(result.Rows), result.TotalRows, rows, fastRows)
+		}
+		if result.SnapshotURL == "" {
+			return nil, nil, errors.New("complete message carries no snapshot URL")
+		}
+		resp, err := http.Get(result.SnapshotURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("download snapshot: %s", resp.Status)
+		}
+		data, err := io.ReadAll(resp.Body)
+		return result, data, err
+	}
+
+	// CSV alongside the streamed rows
+	_, data, err := run(protocol.QueryRequest{QueryID: queryFast, TemplateData: map[string]interface{}{"Table": "t"}, Snapshot: runner.SnapshotCSV}, fastRows)
+	if err != nil {
+		return fmt.Errorf("csv: %w", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return fmt.Errorf("csv: %w", err)
+	}
+	if len(records) != fastRows+1 || strings.Join(records[0], ",") != "id,name" || strings.Join(records[1], ",") != "0,row-0" {
+		return fmt.Errorf("csv: got %d records starting %v, want a header and %d rows", len(records), records[:min(len(records), 2)], fastRows)
+	}
+
+	// Parquet instead of the streamed rows
+	_, data, err = run(protocol.QueryRequest{QueryID: queryFast, TemplateData: map[string]interface{}{"Table": "t"}, Snapshot: runner.SnapshotParquet, SnapshotOnly: true}, 0)
+	if err != nil {
+		return fmt.Errorf("parquet: %w", err)
+	}
+	reader, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("parquet: %w", err)
+	}
+	defer reader.Close()
+	if reader.NumRows() != fastRows || reader.MetaData().Schema.NumColumns() != 2 {
+		return fmt.Errorf("parquet: got %d rows in %d columns, want %d in 2", reader.NumRows(), reader.MetaData().Schema.NumColumns(), fastRows)
+	}
+
+	// A query can ask for a snapshot of every result
+	if _, _, err := run(protocol.QueryRequest{QueryID: "query-snapshot"}, fastRows); err != nil {
+		return fmt.Errorf("query snapshot_format: %w", err)
+	}
+
+	// Servers without object storage reject snapshot requests
+	plain, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	for _, req := range []protocol.QueryRequest{
+		{QueryID: queryFast, TemplateData: map[string]interface{}{"Table": "t"}, Snapshot: "xlsx"},
+		{QueryID: queryFast, TemplateData: map[string]interface{}{"Table": "t"}, SnapshotOnly: true},
+		{QueryID: queryFast, TemplateData: map[string]interface{}{"Table": "t"}, Snapshot: runner.SnapshotCSV},
+	} {
+		stream, err := plain.Execute(req)
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusFailed {
+			return fmt.Errorf("snapshot %q (only %v): status %q, want failed", req.Snapshot, req.SnapshotOnly, result.Status)
+		}
+	}
+	return nil
+}
+
+func testExport(ctx context.Context, h *harness) error {
+	download := func(params string) (*http.Response, []byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.server.URL+"/export?"+params, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, data, err
+	}
+	query := "queryId=" + queryFast + "&templateData=" + url.QueryEscape(`{"Table":"export"}`)
+
+	resp, data, err := download(query)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") ||
+		!strings.Contains(resp.Header.Get("Content-Disposition"), "attachment") {
+		return fmt.Errorf("csv: %s with content type %q and disposition %q", resp.Status, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"))
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return fmt.Errorf("csv: %w", err)
+	}
+	if len(records) != fastRows+1 || strings.Join(records[1], ",") != "0,row-0" {
+		return fmt.Errorf("csv: got %d records, want a header and %d rows", len(records), fastRows)
+	}
+
+	_, data, err = download(query + "&format=json&limit=10")
+	if err != nil {
+		return err
+	}
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return fmt.Errorf("json: %w", err)
+	}
+	if len(objects) != 10 || objects[0]["name"] != "row-0" {
+		return fmt.Errorf("json: got %d objects starting %v, want 10 starting with row-0", len(objects), objects[:min(len(objects), 1)])
+	}
+
+	_, data, err = download(query + "&format=xlsx")
+	if err != nil {
+		return err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("xlsx: %w", err)
+	}
+	sheet, err := archive.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return fmt.Errorf("xlsx: %w", err)
+	}
+	defer sheet.Close()
+	xmlData, err := io.ReadAll(sheet)
+	if err != nil {
+		return err
+	}
+	if rows := strings.Count(string(xmlData), "<row "); rows != fastRows+1 {
+		return fmt.Errorf("xlsx: sheet has %d rows, want %d", rows, fastRows+1)
+	}
+
+	for params, want := range map[string]int{
+		"queryId=missing":           http.StatusNotFound,
+		query + "&format=pdf":       http.StatusBadRequest,
+		query + "&limit=-1":         http.StatusBadRequest,
+		"format=csv":                http.StatusBadRequest,
+		"queryId=x&templateData=[}": http.StatusBadRequest,
+	} {
+		resp, _, err := download(params)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != want {
+			return fmt.Errorf("%s: got %s, want %d", params, resp.Status, want)
+		}
+	}
+	return nil
+}
+
+func testREST(ctx context.Context, h *harness) error {
+	call := func(method, path string, body string, into interface{}) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, method, h.server.URL+path, strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if into != nil && resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+				return resp.StatusCode, err
+			}
+		}
+		return resp.StatusCode, nil
+	}
+	type result struct {
+		Columns   []string        `json:"columns"`
+		Rows      [][]interface{} `json:"rows"`
+		RowCount  int             `json:"rowCount"`
+		Truncated bool            `json:"truncated"`
+	}
+	type execution struct {
+		ExecutionID string  `json:"executionId"`
+		Status      string  `json:"status"`
+		Error       string  `json:"error"`
+		Result      *result `json:"result"`
+	}
+	poll := func(id string, want string) (*execution, error) {
+		for {
+			var exec execution
+			if _, err := call(http.MethodGet, "/api/v1/executions/"+id, "", &exec); err != nil {
+				return nil, err
+			}
+			if exec.Status != "running" {
+				if exec.Status != want {
+					return nil, fmt.Errorf("execution %s: status %q (error %q), want %q", id, exec.Status, exec.Error, want)
+				}
+				return &exec, nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+	execute := "/api/v1/queries/" + queryFast + "/execute"
+
+	// Synchronous results are capped at rest_max_rows
+	var res result
+	status, err := call(http.MethodPost, execute, `{"templateData":{"Table":"rest"}}`, &res)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK || res.RowCount != 100 || len(res.Rows) != 100 || !res.Truncated || len(res.Columns) != 2 {
+		return fmt.Errorf("sync: status %d with %d rows (truncated %v), want 100 truncated rows", status, res.RowCount, res.Truncated)
+	}
+	res = result{}
+	if _, err := call(http.MethodPost, execute, `{"templateData":{"Table":"rest"},"limit":5,"offset":10}`, &res); err != nil {
+		return err
+	}
+	if res.RowCount != 5 || res.Rows[0][1] != "row-10" || !res.Truncated {
+		return fmt.Errorf("sync page: got %d rows starting %v, want 5 from row-10", res.RowCount, res.Rows)
+	}
+
+	// Async executions are polled for their result
+	var started execution
+	status, err = call(http.MethodPost, "/api/v1/queries/"+queryPaced+"/execute", `{"async":true}`, &started)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusAccepted || started.ExecutionID == "" {
+		return fmt.Errorf("async: status %d with execution %q, want 202 and an ID", status, started.ExecutionID)
+	}
+	done, err := poll(started.ExecutionID, "completed")
+	if err != nil {
+		return err
+	}
+	if done.Result == nil || done.Result.RowCount != 100 {
+		return fmt.Errorf("async: result %+v, want 100 rows", done.Result)
+	}
+
+	// And can be cancelled
+	started = execution{}
+	if _, err := call(http.MethodPost, "/api/v1/queries/"+querySlow+"/execute", `{"async":true}`, &started); err != nil {
+		return err
+	}
+	if status, err := call(http.MethodDelete, "/api/v1/executions/"+started.ExecutionID, "", nil); err != nil || status != http.StatusNoContent {
+		return fmt.Errorf("cancel: status %d (%v), want 204", status, err)
+	}
+	if _, err := poll(started.ExecutionID, "cancelled"); err != nil {
+		return err
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/api/v1/queries/missing/execute", `{}`, http.StatusNotFound},
+		{http.MethodPost, execute, `{"limit":-1}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"resultReuseMinutes":20000}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"resultReuseMinutes":-9223372036854775807}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"jobPriority":"urgent"}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"jobLabels":{"Dashboard":"sales"}}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"jobLabels":{"supalytics_org":"other"}}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"maxBytesBilled":-1}`, http.StatusBadRequest},
+		{http.MethodPost, execute, `{"jobLabels":{"dashboard":"sales"},"jobPriority":"batch","maxBytesBilled":1000000}`, http.StatusOK},
+		{http.MethodPost, execute, `not json`, http.StatusBadRequest},
+		{http.MethodGet, execute, "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/v1/executions/unknown", "", http.StatusNotFound},
+	} {
+		status, err := call(tc.method, tc.path, tc.body, nil)
+		if err != nil {
+			return err
+		}
+		if status != tc.want {
+			return fmt.Errorf("%s %s %s: status %d, want %d", tc.method, tc.path, tc.body, status, tc.want)
+		}
+	}
+	return nil
+}
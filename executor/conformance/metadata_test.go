@@ -0,0 +1,363 @@
+package conformance
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// expectTimeout runs the slow query and expects it to fail with code
+// conformanceKey is the local master key used by encryption scenarios
+var conformanceKey = base64.StdEncoding.EncodeToString([]byte("conformance-local-key-0123456789"))
+
+func localEncryption(cfg *websocket.Config) {
+	cfg.Encryption = runner.EncryptionConfig{LocalKey: conformanceKey}
+}
+
+func testMetadataOutage(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Warm the metadata cache
+	if err := expectCompleted(ctx, c, queryFast); err != nil {
+		return err
+	}
+
+	h.outage.down.Store(true)
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "during-outage"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("cached query: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+	if got := messageSequence(result.Messages); !isSubsequence([]string{"status:warning", "row"}, got) {
+		return fmt.Errorf("cached query: no stale metadata warning in %v", got)
+	}
+
+	// Queries that were never cached still fail
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: querySlow, StreamID: "uncached"}, "unavailable"); err != nil {
+		return err
+	}
+
+	var ready struct {
+		Status        string             `json:"status"`
+		MetadataStore runner.StoreHealth `json:"metadataStore"`
+	}
+	if err := getJSON(ctx, h.server.URL+"/readyz", &ready); err != nil {
+		return err
+	}
+	if ready.Status != "degraded" || !ready.MetadataStore.Degraded {
+		return fmt.Errorf("readyz during outage = %+v, want degraded", ready)
+	}
+
+	// Audit writes made during the outage are delivered once it ends
+	h.outage.down.Store(false)
+	if err := expectCompleted(ctx, c, queryFast); err != nil {
+		return err
+	}
+	for !hasAuditEntry(h.store, "during-outage") {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("audit entry written during outage was never flushed: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if err := getJSON(ctx, h.server.URL+"/readyz", &ready); err != nil {
+		return err
+	}
+	if ready.Status != "ready" {
+		return fmt.Errorf("readyz after outage = %+v, want ready", ready)
+	}
+	return nil
+}
+
+// realtimeServer speaks enough of the Supabase Realtime protocol to accept a
+// postgres_changes subscription and push changes to it
+type realtimeServer struct {
+	joined  chan []string // tables of each subscription
+	changes chan [2]string
+	drop    chan struct{}
+}
+
+func (rs *realtimeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/realtime/v1/websocket" || r.URL.Query().Get("apikey") == "" {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := (&gorilla.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var join struct {
+		Topic   string `json:"topic"`
+		Event   string `json:"event"`
+		Ref     string `json:"ref"`
+		Payload struct {
+			Config struct {
+				Changes []struct {
+					Table string `json:"table"`
+				} `json:"postgres_changes"`
+			} `json:"config"`
+		} `json:"payload"`
+	}
+	if err := conn.ReadJSON(&join); err != nil || join.Event != "phx_join" {
+		return
+	}
+	var tables []string
+	for _, c := range join.Payload.Config.Changes {
+		tables = append(tables, c.Table)
+	}
+	conn.WriteJSON(map[string]interface{}{
+		"topic": join.Topic, "event": "phx_reply", "ref": join.Ref,
+		"payload": map[string]interface{}{"status": "ok", "response": map[string]interface{}{}},
+	})
+	rs.joined <- tables
+
+	for {
+		select {
+		case change := <-rs.changes:
+			conn.WriteJSON(map[string]interface{}{
+				"topic": join.Topic, "event": "postgres_changes", "ref": nil,
+				"payload": map[string]interface{}{"data": map[string]interface{}{
+					"schema": "public", "table": change[0], "type": "UPDATE",
+					"record": map[string]interface{}{"id": change[1]},
+				}},
+			})
+		case <-rs.drop:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func testRealtimeMetadata(ctx context.Context, h *harness) error {
+	rs := &realtimeServer{joined: make(chan []string, 4), changes: make(chan [2]string), drop: make(chan struct{})}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	feed, err := runner.NewSupabaseRealtime(srv.URL, "anon-key")
+	if err != nil {
+		return err
+	}
+	followCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	h.cache.Follow(followCtx, feed)
+
+	subscribed := func() error {
+		select {
+		case tables := <-rs.joined:
+			if strings.Join(tables, ",") != "queries,connectors" {
+				return fmt.Errorf("subscribed to %v, want queries and connectors", tables)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the realtime subscription: %w", ctx.Err())
+		}
+		for !h.cache.Health().Realtime {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("waiting for the cache to follow changes: %w", ctx.Err())
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+		return nil
+	}
+	if err := subscribed(); err != nil {
+		return err
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// The first run fetches the query and connector; later runs reuse them
+	run := func(streamID string) (*runner.AuditEntry, int64, error) {
+		before := h.outage.fetches.Load()
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: streamID, TemplateData: map[string]interface{}{"Table": "events"}})
+		if err != nil {
+			return nil, 0, err
+		}
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+			return nil, 0, fmt.Errorf("%s: %v (%+v)", streamID, err, result)
+		}
+		if err := waitForAuditEntry(ctx, h.store, streamID); err != nil {
+			return nil, 0, err
+		}
+		for _, e := range h.store.AuditEntries() {
+			if e.StreamID == streamID {
+				return &e, h.outage.fetches.Load() - before, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("%s: no audit entry", streamID)
+	}
+	if _, fetched, err := run("first"); err != nil || fetched != 2 {
+		return fmt.Errorf("first run fetched %d rows (%v), want the query and connector", fetched, err)
+	}
+	if _, fetched, err := run("second"); err != nil || fetched != 0 {
+		return fmt.Errorf("second run fetched %d rows (%v), want none", fetched, err)
+	}
+
+	// A change to the query is picked up by the next run
+	query, err := h.store.FetchQuery(ctx, queryFast)
+	if err != nil {
+		return err
+	}
+	query.Content = "select * from {{.Table}} where true"
+	h.store.PutQuery(*query)
+	rs.changes <- [2]string{"queries", queryFast}
+	for i := 0; ; i++ {
+		entry, _, err := run(fmt.Sprintf("changed-%d", i))
+		if err != nil {
+			return err
+		}
+		if entry.RenderedSQL == "select * from events where true" {
+			break
+		}
+	}
+
+	// Rows may have changed while the feed was down, so everything is
+	// fetched again once it resubscribes
+	rs.drop <- struct{}{}
+	if err := subscribed(); err != nil {
+		return err
+	}
+	if _, fetched, err := run("resubscribed"); err != nil || fetched != 2 {
+		return fmt.Errorf("run after resubscribing fetched %d rows (%v), want the query and connector", fetched, err)
+	}
+	return nil
+}
+
+func testEncryptedConnector(ctx context.Context, h *harness) error {
+	keyring, err := runner.NewKeyring(ctx, runner.EncryptionConfig{LocalKey: conformanceKey})
+	if err != nil {
+		return err
+	}
+
+	// Seal a copy of the fast connector under a new ID
+	connector := mockConnector("connector-sealed", fastRows, 0)
+	if connector.Config, err = keyring.Encrypt(ctx, connector.ID, connector.Config); err != nil {
+		return err
+	}
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-sealed", ConnectorID: connector.ID, Content: "select * from sealed"})
+
+	// An envelope copied to another connector does not decrypt
+	copied := connector
+	copied.ID = "connector-copied"
+	h.store.PutConnector(copied)
+	h.store.PutQuery(runner.Query{ID: "query-copied", ConnectorID: copied.ID, Content: "select * from copied"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := expectCompleted(ctx, c, "query-sealed"); err != nil {
+		return err
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-copied", StreamID: "copied"}, "decrypt connector config")
+}
+
+func testVaultSecrets(ctx context.Context, h *harness) error {
+	var reads atomic.Int32
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/auth/approle/login":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": "conformance-token", "lease_duration": 3600, "renewable": true},
+			})
+		case r.Header.Get("X-Vault-Token") != "conformance-token":
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		case r.URL.Path == "/v1/secret/data/mock":
+			reads.Add(1)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"column": "secret_name"},
+					"metadata": map[string]interface{}{"version": 1},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+
+	resolver, err := runner.NewVaultResolver(runner.VaultConfig{Address: vault.URL, RoleID: "role", SecretID: "secret"})
+	if err != nil {
+		return err
+	}
+	h.executor.SetSecretResolver(resolver)
+
+	for _, ref := range []struct{ id, column string }{
+		{"vault", "vault:secret/data/mock#column"},
+		{"vault-bad-key", "vault:secret/data/mock#missing"},
+	} {
+		connector := mockConnector("connector-"+ref.id, fastRows, 0)
+		var fields map[string]interface{}
+		if err := json.Unmarshal(connector.Config, &fields); err != nil {
+			return err
+		}
+		fields["columns"] = []string{"id", ref.column}
+		if connector.Config, err = json.Marshal(fields); err != nil {
+			return err
+		}
+		h.store.PutConnector(connector)
+		h.store.PutQuery(runner.Query{ID: "query-" + ref.id, ConnectorID: connector.ID, Content: "select 1"})
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-vault"})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("status %q (error %q)", result.Status, result.Error)
+		}
+		if len(result.Columns) != 2 || result.Columns[1] != "secret_name" {
+			return fmt.Errorf("columns = %v, want the Vault reference resolved to secret_name", result.Columns)
+		}
+	}
+	if n := reads.Load(); n != 1 {
+		return fmt.Errorf("vault secret read %d times, want 1 (cached)", n)
+	}
+
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-vault-bad-key", StreamID: "bad-key"}, "has no key")
+}
@@ -0,0 +1,219 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"supalytics-executor/client"
+	"supalytics-executor/driver"
+	"supalytics-executor/drivers/postgres"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// postgresDSN is the PostgreSQL server the engine scenarios run against,
+// set with CONFORMANCE_POSTGRES; they are skipped without one
+var postgresDSN string
+
+// postgresSetup creates the user-defined types the type matrix uses. The
+// connector registers them when it connects, so they exist beforehand.
+var postgresSetup = []string{
+	`DROP SCHEMA IF EXISTS conformance_types CASCADE`,
+	`CREATE SCHEMA conformance_types`,
+	`CREATE TYPE conformance_types.mood AS ENUM ('sad', 'happy')`,
+	`CREATE TYPE conformance_types.price AS (amount numeric, currency text)`,
+}
+
+// postgresTypes is the type matrix PostgresTypes checks: an expression of
+// each type and the JSON a client receives for it
+var postgresTypes = []struct{ name, expr, want string }{
+	{"int_array", `ARRAY[1, 2, NULL]::int[]`, `[1,2,null]`},
+	{"text_array", `ARRAY['a', 'b c']`, `["a","b c"]`},
+	{"matrix", `ARRAY[[1, 2], [3, 4]]`, `[[1,2],[3,4]]`},
+	{"numeric_array", `ARRAY[1.50, 2]::numeric[]`, `["1.5","2"]`},
+	{"empty_array", `'{}'::text[]`, `[]`},
+	{"jsonb", `'{"b": [1, "x"], "a": null}'::jsonb`, `{"a":null,"b":[1,"x"]}`},
+	{"json", `'{"n": 1.50}'::json`, `{"n":1.5}`},
+	{"interval", `INTERVAL '1 year 2 months 3 days 04:05:06.5'`, `"P1Y2M3DT4H5M6.5S"`},
+	{"negative_interval", `INTERVAL '-1 day -00:00:00.25'`, `"P-1DT-0.25S"`},
+	{"int_range", `int4range(1, 5)`, `{"lower":1,"lowerInclusive":true,"upper":5,"upperInclusive":false}`},
+	{"open_range", `tsrange('2024-01-01', NULL)`, `{"lower":"2024-01-01T00:00:00Z","lowerInclusive":true,"upper":null,"upperInclusive":false}`},
+	{"empty_range", `'empty'::int4range`, `{"empty":true}`},
+	{"enum", `'happy'::conformance_types.mood`, `"happy"`},
+	{"enum_array", `ARRAY['sad', 'happy']::conformance_types.mood[]`, `["sad","happy"]`},
+	{"composite", `ROW(1.50, 'EUR')::conformance_types.price`, `{"amount":"1.5","currency":"EUR"}`},
+	{"time", `TIME '13:00:00.0015'`, `"13:00:00.001500000"`},
+	{"uuid", `'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11'::uuid`, `"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"`},
+}
+
+// putPostgresConnector adds connector-postgres for the CONFORMANCE_POSTGRES
+// server
+func putPostgresConnector(h *harness) error {
+	return putPostgresConnectorWith(h, func(*runner.Connector) {})
+}
+
+// putPostgresConnectorWith adds connector-postgres for the
+// CONFORMANCE_POSTGRES server, changed by configure
+func putPostgresConnectorWith(h *harness, configure func(*runner.Connector)) error {
+	if postgresDSN == "" {
+		return fmt.Errorf("%w: no CONFORMANCE_POSTGRES server", errSkipped)
+	}
+	cfg, err := postgres.ParseDSN(postgresDSN)
+	if err != nil {
+		return err
+	}
+	config, err := cfg.ToJSON()
+	if err != nil {
+		return err
+	}
+	connector := runner.Connector{ID: "connector-postgres", Name: "postgres", Type: string(driver.PostgresType), Config: config}
+	configure(&connector)
+	h.store.PutConnector(connector)
+	return nil
+}
+
+func testPostgresTypes(ctx context.Context, h *harness) error {
+	if err := putPostgresConnector(h); err != nil {
+		return err
+	}
+
+	setup, err := pgx.Connect(ctx, postgresDSN)
+	if err != nil {
+		return err
+	}
+	defer setup.Close(context.Background())
+	for _, stmt := range postgresSetup {
+		if _, err := setup.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("setup %q: %w", stmt, err)
+		}
+	}
+
+	exprs := make([]string, len(postgresTypes))
+	for i, typ := range postgresTypes {
+		exprs[i] = typ.expr + " AS " + typ.name
+	}
+	h.store.PutQuery(runner.Query{ID: "query-types", ConnectorID: "connector-postgres", Content: "SELECT " + strings.Join(exprs, ", ")})
+
+	// Binary encodings decode to the same values as JSON
+	for _, encoding := range []string{protocol.EncodingJSON, protocol.EncodingMsgpack, protocol.EncodingCBOR} {
+		c, err := h.dialOptions(ctx, client.Options{
+			Encoding: encoding,
+			Values:   protocol.ValueFormat{Times: protocol.TimesISO8601},
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-types"})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != 1 {
+			return fmt.Errorf("%s: status %q with %d rows (error %q)", encoding, result.Status, len(result.Rows), result.Error)
+		}
+		for i, typ := range postgresTypes {
+			got, err := json.Marshal(result.Rows[0][i])
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", encoding, typ.name, err)
+			}
+			if string(got) != typ.want {
+				return fmt.Errorf("%s %s (%s) = %s, want %s", encoding, typ.name, typ.expr, got, typ.want)
+			}
+		}
+	}
+	return nil
+}
+
+func testPostgresStreaming(ctx context.Context, h *harness) error {
+	if err := putPostgresConnector(h); err != nil {
+		return err
+	}
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Rows arrive complete and in the engine's order
+	result, err := engineQuery(ctx, c, h, "connector-postgres", "query-series",
+		"SELECT n, 'row-' || n AS name FROM generate_series(1, 5000) AS n ORDER BY n")
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 5000 || result.TotalRows != 5000 {
+		return fmt.Errorf("status %q with %d rows, totalRows %d (error %q)", result.Status, len(result.Rows), result.TotalRows, result.Error)
+	}
+	for i, row := range result.Rows {
+		if n, _ := row[0].(float64); int(n) != i+1 || row[1] != fmt.Sprintf("row-%d", i+1) {
+			return fmt.Errorf("row %d out of order: %v", i, row)
+		}
+	}
+	if err := checkEngineResult(result, fmt.Sprint(result.Rows)); err != nil {
+		return err
+	}
+
+	if err := checkEngineError(ctx, c, h, "connector-postgres", "SELECT * FROM conformance_missing_table", "does not exist"); err != nil {
+		return err
+	}
+
+	// Cancelling stops the query on the server instead of waiting it out
+	h.store.PutQuery(runner.Query{ID: "query-sleep", ConnectorID: "connector-postgres", Content: "SELECT pg_sleep(600)"})
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-sleep"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+	if err := stream.Cancel(); err != nil {
+		return err
+	}
+	cancelled, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if cancelled.Status != protocol.StatusCancelled {
+		return fmt.Errorf("cancelled query: status %q (error %q)", cancelled.Status, cancelled.Error)
+	}
+	return nil
+}
+
+// testPostgresReadOnly checks a read-only connector's session refuses
+// writes the lexical check cannot see, such as those made by functions
+func testPostgresReadOnly(ctx context.Context, h *harness) error {
+	if err := putPostgresConnectorWith(h, func(c *runner.Connector) { c.ReadOnly = true }); err != nil {
+		return err
+	}
+	setup, err := pgx.Connect(ctx, postgresDSN)
+	if err != nil {
+		return err
+	}
+	defer setup.Close(context.Background())
+	if _, err := setup.Exec(ctx, `CREATE SEQUENCE IF NOT EXISTS conformance_read_only`); err != nil {
+		return err
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	result, err := engineQuery(ctx, c, h, "connector-postgres", "query-read-only", "SHOW default_transaction_read_only")
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 1 || result.Rows[0][0] != "on" {
+		return fmt.Errorf("default_transaction_read_only: status %q with rows %v (error %q), want on", result.Status, result.Rows, result.Error)
+	}
+	return checkEngineError(ctx, c, h, "connector-postgres",
+		"SELECT nextval('conformance_read_only')", "read-only transaction")
+}
@@ -0,0 +1,726 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+func testHappyPath(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{
+		QueryID:      queryFast,
+		StreamID:     "happy",
+		TemplateData: map[string]interface{}{"Table": "fixtures"},
+	})
+	if err != nil {
+		return err
+	}
+
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("status = %q (error %q), want %q", result.Status, result.Error, protocol.StatusCompleted)
+	}
+	if strings.Join(result.Columns, ",") != "id,name" {
+		return fmt.Errorf("columns = %v, want [id name]", result.Columns)
+	}
+	if len(result.Rows) != fastRows || result.TotalRows != fastRows {
+		return fmt.Errorf("got %d rows (totalRows %d), want %d", len(result.Rows), result.TotalRows, fastRows)
+	}
+	for i, row := range result.Rows {
+		if id, _ := row[0].(float64); int(id) != i {
+			return fmt.Errorf("row %d out of order: %v", i, row)
+		}
+	}
+
+	// The envelope sequence is part of the contract the UI relies on
+	want := []string{"status:queued", "status:running", "metadata", "row", "complete", "status:completed"}
+	if got := messageSequence(result.Messages); !isSubsequence(want, got) {
+		return fmt.Errorf("message sequence %v does not follow %v", got, want)
+	}
+	return nil
+}
+
+func testConcurrentStreams(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	streams := make([]*client.Stream, 5)
+	for i := range streams {
+		if streams[i], err = c.Execute(protocol.QueryRequest{QueryID: queryFast}); err != nil {
+			return err
+		}
+	}
+
+	for _, stream := range streams {
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("stream %s: %w", stream.ID, err)
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+			return fmt.Errorf("stream %s: status %q with %d rows", stream.ID, result.Status, len(result.Rows))
+		}
+	}
+	return nil
+}
+
+func testMultiStatement(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryMultiStatement})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("status = %q (error %q), want %q", result.Status, result.Error, protocol.StatusCompleted)
+	}
+
+	// Only the final statement's result set is streamed
+	if len(result.Rows) != fastRows {
+		return fmt.Errorf("got %d rows, want %d", len(result.Rows), fastRows)
+	}
+
+	var events []string
+	for _, msg := range result.Messages {
+		if status, _ := msg.Payload["status"].(string); status == protocol.StatusStatement {
+			stmt, _ := msg.Payload["statement"].(map[string]interface{})
+			events = append(events, fmt.Sprintf("%v/%v:%v", stmt["index"], stmt["total"], stmt["state"]))
+		}
+	}
+	want := "1/3:running,1/3:completed,2/3:running,2/3:completed,3/3:running"
+	if got := strings.Join(events, ","); got != want {
+		return fmt.Errorf("statement events = %s, want %s", got, want)
+	}
+	return nil
+}
+
+func testParameterSets(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "preset", ParameterSet: "fixtures"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("preset: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// A preset that does not supply every template key is rejected
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: queryFast, StreamID: "incomplete", ParameterSet: "incomplete"}, "render template"); err != nil {
+		return err
+	}
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: queryFast, StreamID: "unknown", ParameterSet: "no-such-preset"}, "parameter set not found"); err != nil {
+		return err
+	}
+
+	// The audit log records which preset each execution used
+	for {
+		for _, entry := range h.store.AuditEntries() {
+			if entry.StreamID == "preset" {
+				if entry.ParameterSet != "fixtures" || entry.Status != protocol.StatusCompleted {
+					return fmt.Errorf("audit entry = %+v, want parameter set %q and status %q", entry, "fixtures", protocol.StatusCompleted)
+				}
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no audit entry for stream preset: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func testCountOnly(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, queryID := range []string{queryFast, queryMultiStatement} {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID, TemplateData: map[string]interface{}{"Table": "fixtures"}, CountOnly: true})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("%s: status = %q (error %q), want %q", queryID, result.Status, result.Error, protocol.StatusCompleted)
+		}
+		if len(result.Columns) != 1 || result.Columns[0] != runner.CountColumn {
+			return fmt.Errorf("%s: columns = %v, want [%s]", queryID, result.Columns, runner.CountColumn)
+		}
+		if len(result.Rows) != 1 || len(result.Rows[0]) != 1 || result.Rows[0][0] != float64(fastRows) {
+			return fmt.Errorf("%s: rows = %v, want [[%d]]", queryID, result.Rows, fastRows)
+		}
+	}
+	return nil
+}
+
+func testPagination(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	pages := []struct {
+		limit, offset int64
+		first, rows   int
+		truncated     bool
+	}{
+		{limit: 250, offset: 100, first: 100, rows: 250, truncated: true},
+		{limit: 100, offset: 550, first: 550, rows: 50},
+		{limit: 600, first: 0, rows: 600},
+		{offset: 590, first: 590, rows: 10},
+	}
+	for _, page := range pages {
+		stream, err := c.Execute(protocol.QueryRequest{
+			QueryID:      queryFast,
+			TemplateData: map[string]interface{}{"Table": "fixtures"},
+			Limit:        page.limit,
+			Offset:       page.offset,
+		})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("limit %d offset %d: status %q (error %q)", page.limit, page.offset, result.Status, result.Error)
+		}
+		if len(result.Rows) != page.rows || result.TotalRows != int64(page.rows) {
+			return fmt.Errorf("limit %d offset %d: got %d rows (totalRows %d), want %d",
+				page.limit, page.offset, len(result.Rows), result.TotalRows, page.rows)
+		}
+		if id := result.Rows[0][0]; id != float64(page.first) {
+			return fmt.Errorf("limit %d offset %d: first row id %v, want %d", page.limit, page.offset, id, page.first)
+		}
+		if result.Truncated != page.truncated {
+			return fmt.Errorf("limit %d offset %d: truncated = %v, want %v", page.limit, page.offset, result.Truncated, page.truncated)
+		}
+	}
+	return nil
+}
+
+func testPreview(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	previews := []struct {
+		rows      int64
+		want      int
+		truncated bool
+	}{
+		{rows: 0, want: 100, truncated: true}, // the server's default
+		{rows: 10, want: 10, truncated: true},
+		{rows: fastRows, want: fastRows},
+	}
+	for _, p := range previews {
+		stream, err := c.Execute(protocol.QueryRequest{
+			QueryID:      queryFast,
+			TemplateData: map[string]interface{}{"Table": "fixtures"},
+			Preview:      true,
+			PreviewRows:  p.rows,
+		})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("previewRows %d: status %q (error %q)", p.rows, result.Status, result.Error)
+		}
+		if len(result.Rows) != p.want || result.Truncated != p.truncated {
+			return fmt.Errorf("previewRows %d: got %d rows (truncated %v), want %d (truncated %v)",
+				p.rows, len(result.Rows), result.Truncated, p.want, p.truncated)
+		}
+	}
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, Preview: true, Limit: 5})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed {
+		return fmt.Errorf("preview with a limit: status %q, want %q", result.Status, protocol.StatusFailed)
+	}
+	return nil
+}
+
+func testHistory(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	first, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "yesterday", TemplateData: map[string]interface{}{"Table": "yesterday"}})
+	if err != nil {
+		return err
+	}
+	if result, err := first.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("first run: %v (%+v)", err, result)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "yesterday"); err != nil {
+		return err
+	}
+
+	records, err := c.History(ctx, queryFast, 10)
+	if err != nil {
+		return err
+	}
+	if len(records) != 1 {
+		return fmt.Errorf("history: got %d executions, want 1", len(records))
+	}
+	past := records[0]
+	data, _ := past.TemplateData.(map[string]interface{})
+	if past.StreamID != "yesterday" || past.RenderedSQL != "select * from yesterday" || data["Table"] != "yesterday" || past.Status != protocol.StatusCompleted {
+		return fmt.Errorf("history record %+v, want the first run with its SQL and template data", past)
+	}
+
+	// The replay runs the recorded SQL whatever template data it is sent
+	replay, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "today", Replay: past.ExecutionID, TemplateData: map[string]interface{}{"Table": "today"}})
+	if err != nil {
+		return err
+	}
+	if result, err := replay.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("replay: %v (%+v)", err, result)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "today"); err != nil {
+		return err
+	}
+
+	// The REST API lists the replay first
+	resp, err := http.Get(h.server.URL + "/api/v1/queries/" + queryFast + "/history?limit=1")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Executions []protocol.ExecutionRecord `json:"executions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if len(body.Executions) != 1 || body.Executions[0].ReplayOf != past.ExecutionID || body.Executions[0].RenderedSQL != past.RenderedSQL {
+		return fmt.Errorf("REST history %+v, want the replay of %s with the same SQL", body.Executions, past.ExecutionID)
+	}
+
+	unknown, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, Replay: "no-such-execution"})
+	if err != nil {
+		return err
+	}
+	return waitForError(ctx, unknown, "execution not found")
+}
+
+func testQueryVersions(ctx context.Context, h *harness) error {
+	h.store.PutQueryVersion(runner.QueryVersion{ID: "fast-v1", QueryID: queryFast, Version: 1, Content: "select * from {{.Table}} where version = 1"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	run := func(streamID string, version int) (*client.Result, *runner.AuditEntry, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: streamID, QueryVersion: version, TemplateData: map[string]interface{}{"Table": "events"}})
+		if err != nil {
+			return nil, nil, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil || result.Status != protocol.StatusCompleted {
+			return nil, nil, fmt.Errorf("%s: %v (%+v)", streamID, err, result)
+		}
+		if err := waitForAuditEntry(ctx, h.store, streamID); err != nil {
+			return nil, nil, err
+		}
+		for _, e := range h.store.AuditEntries() {
+			if e.StreamID == streamID {
+				return result, &e, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("%s: no audit entry", streamID)
+	}
+
+	// A pinned run renders the saved version and reports it
+	result, entry, err := run("pinned", 1)
+	if err != nil {
+		return err
+	}
+	if result.QueryVersion != 1 || entry.RenderedSQL != "select * from events where version = 1" || entry.QueryVersion != 1 {
+		return fmt.Errorf("pinned run reported version %d and recorded %q (version %d), want version 1", result.QueryVersion, entry.RenderedSQL, entry.QueryVersion)
+	}
+
+	// Without a version the current template runs
+	result, entry, err = run("current", 0)
+	if err != nil {
+		return err
+	}
+	if result.QueryVersion != 0 || entry.RenderedSQL != "select * from events" {
+		return fmt.Errorf("current run reported version %d and recorded %q, want the current template", result.QueryVersion, entry.RenderedSQL)
+	}
+
+	unknown, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, QueryVersion: 9})
+	if err != nil {
+		return err
+	}
+	return waitForError(ctx, unknown, "query version not found")
+}
+
+func testQueryNotFound(ctx context.Context, h *harness) error {
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "does-not-exist", StreamID: "s"}, "query not found")
+}
+
+func testConnectorNotFound(ctx context.Context, h *harness) error {
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: queryMissingConnector, StreamID: "s"}, "connector not found")
+}
+
+func testMissingFields(ctx context.Context, h *harness) error {
+	return expectStreamError(ctx, h, protocol.QueryRequest{StreamID: "no-query"}, "streamId and queryId are required")
+}
+
+func testDuplicateStreamID(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	first, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "dup"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, first, protocol.StatusRunning); err != nil {
+		return err
+	}
+
+	// Resubmitting the same stream ID must not disturb the running stream
+	if err := c.Send(protocol.ClientMessage{
+		Type:         protocol.MessageTypeQuery,
+		QueryRequest: protocol.QueryRequest{QueryID: queryFast, StreamID: "dup"},
+	}); err != nil {
+		return err
+	}
+	if err := waitForError(ctx, first, "already exists"); err != nil {
+		return err
+	}
+	return first.Cancel()
+}
+
+func testMalformedMessage(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.SendRaw([]byte(`{"type": "query", "queryId": `)); err != nil {
+		return err
+	}
+	msg, err := nextUnrouted(ctx, c)
+	if err != nil {
+		return err
+	}
+	if errText, _ := msg.Payload["error"].(string); msg.Type != protocol.MessageTypeError || !strings.Contains(errText, "malformed message") {
+		return fmt.Errorf("unexpected response to malformed message: %+v", msg)
+	}
+
+	// The connection must survive garbage input
+	return expectCompleted(ctx, c, queryFast)
+}
+
+func testUnknownMessageType(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Send(map[string]string{"type": "bogus"}); err != nil {
+		return err
+	}
+	msg, err := nextUnrouted(ctx, c)
+	if err != nil {
+		return err
+	}
+	if errText, _ := msg.Payload["error"].(string); !strings.Contains(errText, "unknown message type") {
+		return fmt.Errorf("unexpected response to unknown type: %+v", msg)
+	}
+	return expectCompleted(ctx, c, queryFast)
+}
+
+// testDuplicateStreams reuses the stream ID of a running query under each
+// duplicate policy: reject leaves the running query alone, replace cancels
+// it and runs the new one, and queue runs the new one once it completes
+func testDuplicateStreams(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Rejected by default
+	first, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "filter"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, first, protocol.StatusRunning); err != nil {
+		return err
+	}
+	rejected, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "filter", ParameterSet: "fixtures"})
+	if err != nil {
+		return err
+	}
+	result, err := rejected.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.ErrorCode != protocol.ErrorCodeDuplicateStream || !strings.Contains(result.Error, "already exists") {
+		return fmt.Errorf("duplicate under reject: %q (%s), want a duplicate_stream rejection", result.Error, result.ErrorCode)
+	}
+
+	// Replaced: the running query is cancelled first, then the new one runs
+	replacement, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "filter", ParameterSet: "fixtures", OnDuplicate: protocol.DuplicateReplace})
+	if err != nil {
+		return err
+	}
+	result, err = first.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCancelled {
+		return fmt.Errorf("replaced query: status %q, want cancelled", result.Status)
+	}
+	if last := result.Messages[len(result.Messages)-1]; last.Payload["reason"] != "replaced" {
+		return fmt.Errorf("replaced query: cancelled with %v, want reason replaced", last.Payload)
+	}
+	result, err = replacement.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("replacement: status %q with %d rows, want completed with %d", result.Status, len(result.Rows), fastRows)
+	}
+	if status := result.Messages[0].Payload["status"]; status != protocol.StatusWaiting {
+		return fmt.Errorf("replacement: first status %v, want waiting", status)
+	}
+
+	// Queued: the new query waits for the running one to complete
+	chart, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced, StreamID: "chart"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, chart, protocol.StatusRunning); err != nil {
+		return err
+	}
+	behind, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "chart", ParameterSet: "fixtures", OnDuplicate: protocol.DuplicateQueue})
+	if err != nil {
+		return err
+	}
+	result, err = chart.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != pacedRows {
+		return fmt.Errorf("query ahead: status %q with %d rows, want completed with %d", result.Status, len(result.Rows), pacedRows)
+	}
+	result, err = behind.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("queued behind: status %q with %d rows, want completed with %d", result.Status, len(result.Rows), fastRows)
+	}
+	waited := false
+	for _, msg := range result.Messages {
+		if msg.Payload["status"] == protocol.StatusQueued {
+			_, waited = msg.Payload["waitedMs"]
+			break
+		}
+	}
+	if !waited {
+		return errors.New("queued behind: queued status without waitedMs")
+	}
+
+	// Cancelling the stream cancels the request waiting behind it too
+	table, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "table"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, table, protocol.StatusRunning); err != nil {
+		return err
+	}
+	waiting, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "table", ParameterSet: "fixtures", OnDuplicate: protocol.DuplicateQueue})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, waiting, protocol.StatusWaiting); err != nil {
+		return err
+	}
+	if err := table.Cancel(); err != nil {
+		return err
+	}
+	for _, stream := range []*client.Stream{table, waiting} {
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCancelled {
+			return fmt.Errorf("%s after cancel: %+v (%v), want cancelled", stream.ID, result, err)
+		}
+	}
+
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: queryFast, StreamID: "invalid", OnDuplicate: "merge"}, "invalid onDuplicate")
+}
+
+// testQueryGroups submits dashboards' worth of queries as batches: the group
+// reports each stream ending and completes once the last one has, and a
+// group cancel reaches every stream
+func testQueryGroups(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	collect := func(g *client.Group) ([]*client.Result, error) {
+		results := make([]*client.Result, len(g.Streams))
+		for i, stream := range g.Streams {
+			result, err := stream.Collect(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", stream.ID, err)
+			}
+			results[i] = result
+		}
+		return results, nil
+	}
+
+	// One failing widget fails the group once the others complete
+	reqs := []protocol.QueryRequest{{QueryID: queryMissingConnector}}
+	for i := 0; i < 4; i++ {
+		reqs = append(reqs, protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures"})
+	}
+	dashboard, err := c.Batch("dashboard", reqs)
+	if err != nil {
+		return err
+	}
+	results, err := collect(dashboard)
+	if err != nil {
+		return err
+	}
+	for i, result := range results[1:] {
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+			return fmt.Errorf("widget %d: status %q with %d rows, want completed with %d", i+1, result.Status, len(result.Rows), fastRows)
+		}
+	}
+	status, err := dashboard.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Status != protocol.StatusFailed || status.Total != 5 || status.Completed != 4 || status.Failed != 1 || status.Pending != 0 {
+		return fmt.Errorf("dashboard group: %+v, want failed with 4 completed and 1 failed", status)
+	}
+
+	// Group IDs are free again once the group has ended
+	healthy, err := c.Batch("dashboard", reqs[1:])
+	if err != nil {
+		return err
+	}
+	if status, err := healthy.Wait(ctx); err != nil || status.Status != protocol.StatusCompleted || status.Completed != 4 {
+		return fmt.Errorf("healthy group: %+v (%v), want completed with 4 completed", status, err)
+	}
+
+	// A group cancel reaches running and queued streams alike
+	slow := make([]protocol.QueryRequest, 6)
+	for i := range slow {
+		slow[i] = protocol.QueryRequest{QueryID: querySlow}
+	}
+	export, err := c.Batch("export", slow)
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, export.Streams[0], protocol.StatusRunning); err != nil {
+		return err
+	}
+	if _, err := c.Batch("export", slow[:1]); err == nil {
+		return errors.New("reused the ID of a running group")
+	}
+	if err := export.Cancel(); err != nil {
+		return err
+	}
+	results, err = collect(export)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Status != protocol.StatusCancelled {
+			return fmt.Errorf("cancelled group: stream %s, want cancelled", result.Status)
+		}
+	}
+	status, err = export.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Status != protocol.StatusCancelled || status.Cancelled != len(slow) {
+		return fmt.Errorf("cancelled group: %+v, want cancelled with %d cancelled", status, len(slow))
+	}
+
+	// Batches the server cannot take are rejected as a whole
+	empty, err := c.Batch("empty", nil)
+	if err != nil {
+		return err
+	}
+	status, err = empty.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Status != protocol.StatusFailed || !strings.Contains(status.Error, "no queries") {
+		return fmt.Errorf("empty batch: %+v, want rejected", status)
+	}
+	return nil
+}
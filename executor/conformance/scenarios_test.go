@@ -0,0 +1,303 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+var scenarios = []scenario{
+	{name: "HappyPath", run: testHappyPath},
+	{name: "ConcurrentStreams", run: testConcurrentStreams},
+	{name: "MultiStatement", run: testMultiStatement},
+	{name: "ParameterSets", run: testParameterSets},
+	{name: "CountOnly", run: testCountOnly},
+	{name: "Pagination", run: testPagination},
+	{name: "Preview", run: testPreview},
+	{name: "ResultCache", cfg: resultCache, run: testResultCache},
+	{name: "SharedResultCache", run: testSharedResultCache},
+	{name: "InFlightDedup", cfg: dedupeInFlight, run: testInFlightDedup},
+	{name: "Snapshots", run: testSnapshots},
+	{name: "Export", run: testExport},
+	{name: "REST", cfg: restMaxRows, run: testREST},
+	{name: "History", run: testHistory},
+	{name: "QueryVersions", run: testQueryVersions},
+	{name: "Auth", cfg: jwtAuth, run: testAuth},
+	{name: "OrganizationAccess", cfg: jwtAuth, run: testOrganizationAccess},
+	{name: "APIKeys", cfg: jwtAuth, run: testAPIKeys},
+	{name: "AllowedOrigins", cfg: allowedOrigins, run: testAllowedOrigins},
+	{name: "Quotas", cfg: jwtAuth, run: testQuotas},
+	{name: "ScanBudget", cfg: jwtAuth, run: testScanBudget},
+	{name: "RowLevelSecurity", cfg: jwtAuth, run: testRowLevelSecurity},
+	{name: "TemplateDefaults", cfg: templateConstants, run: testTemplateDefaults},
+	{name: "VerboseTrace", run: testVerboseTrace},
+	{name: "StreamChecksum", run: testStreamChecksum},
+	{name: "SequenceNumbers", run: testSequenceNumbers},
+	{name: "DateRange", run: testDateRange},
+	{name: "TemplateFunctions", run: testTemplateFunctions},
+	{name: "SQLTemplateMode", run: testSQLTemplateMode},
+	{name: "ParameterSchema", run: testParameterSchema},
+	{name: "JinjaTemplates", run: testJinjaTemplates},
+	{name: "SQLValidation", cfg: validateSQL, run: testSQLValidation},
+	{name: "Transforms", run: testTransforms},
+	{name: "CompositeQuery", run: testCompositeQuery},
+	{name: "Aggregates", run: testAggregates},
+	{name: "Sampling", run: testSampling},
+	{name: "StreamLimits", cfg: streamLimits, run: testStreamLimits},
+	{name: "MemoryBudget", cfg: memoryBudget, run: testMemoryBudget},
+	{name: "GracefulShutdown", run: testGracefulShutdown},
+	{name: "JobQueue", run: testJobQueue},
+	{name: "StreamRouting", run: testStreamRouting},
+	{name: "ConfigReload", run: testConfigReload},
+	{name: "ConnectionLimits", cfg: connectionLimits, run: testConnectionLimits},
+	{name: "Readiness", cfg: readiness, run: testReadiness},
+	{name: "Diagnostics", cfg: diagnostics, run: testDiagnostics},
+	{name: "TaskLifecycle", cfg: taskLifecycle, run: testTaskLifecycle},
+	{name: "DuplicateStreams", run: testDuplicateStreams},
+	{name: "QueryGroups", run: testQueryGroups},
+	{name: "Keepalive", cfg: keepalive, run: testKeepalive},
+	{name: "SessionResumption", cfg: sessionResumption, run: testSessionResumption},
+	{name: "Subscriptions", cfg: subscriptions, run: testSubscriptions},
+	{name: "NotifySubscriptions", cfg: subscriptions, run: testNotifySubscriptions},
+	{name: "KeyedSubscriptions", cfg: subscriptions, run: testKeyedSubscriptions},
+	{name: "BinaryEncoding", run: testBinaryEncoding},
+	{name: "FlowControl", run: testFlowControl},
+	{name: "Progress", cfg: frequentProgress, run: testProgress},
+	{name: "Compression", cfg: compression, run: testCompression},
+	{name: "ValueFormats", cfg: isoTimes, run: testValueFormats},
+	{name: "Nullability", run: testNullability},
+	{name: "DecimalNumerics", run: testDecimalNumerics},
+	{name: "Timezone", run: testTimezone},
+	{name: "MockFixtures", run: testMockFixtures},
+	{name: "ErrorCodes", run: testErrorCodes},
+	{name: "Redaction", cfg: redaction, run: testRedaction},
+	{name: "PanicIsolation", run: testPanicIsolation},
+	{name: "ExecutionTimeout", cfg: executionTimeout, run: testExecutionTimeout},
+	{name: "WarmPool", cfg: warmPool, run: testWarmPool, long: true},
+	{name: "Prewarm", cfg: prewarm, run: testPrewarm},
+	{name: "PrewarmQuotas", cfg: prewarmQuotas, run: testPrewarmQuotas},
+	{name: "MetadataOutage", run: testMetadataOutage},
+	{name: "Webhooks", run: testWebhooks},
+	{name: "SlowQueries", cfg: slowQueries, run: testSlowQueries},
+	{name: "ConnectorHealthChecks", cfg: healthChecks, run: testConnectorHealthChecks},
+	{name: "RealtimeMetadata", run: testRealtimeMetadata},
+	{name: "MetadataCache", cfg: metadataCache, run: testMetadataCache},
+	{name: "EncryptedConnector", cfg: localEncryption, run: testEncryptedConnector},
+	{name: "VaultSecrets", run: testVaultSecrets},
+	{name: "QueryNotFound", run: testQueryNotFound},
+	{name: "ConnectorNotFound", run: testConnectorNotFound},
+	{name: "MissingFields", run: testMissingFields},
+	{name: "DuplicateStreamID", run: testDuplicateStreamID},
+	{name: "Cancellation", run: testCancellation},
+	{name: "CancelUnknownStream", run: testCancelUnknownStream},
+	{name: "CancelDeadline", cfg: cancelDeadline, run: testCancelDeadline},
+	{name: "QueueFull", cfg: singleWorker, run: testQueueFull},
+	{name: "Priority", cfg: serialWorker, run: testPriority, long: true},
+	{name: "QueueFeedback", cfg: queueTimeout, run: testQueueFeedback},
+	{name: "AdminAPI", cfg: adminAPI, run: testAdminAPI},
+	{name: "StatusPage", cfg: statusPage, run: testStatusPage},
+	{name: "SlowClient", cfg: slowClient, run: testSlowClient},
+	{name: "Reconnection", run: testReconnection},
+	{name: "AsyncAttach", run: testAsyncAttach, long: true},
+	{name: "ClientResubmission", cfg: serialWorker, run: testClientResubmission},
+	{name: "ResumedStreams", run: testResumedStreams, long: true},
+	{name: "FirstRowTimeout", cfg: timeouts(runner.Timeouts{FirstRow: 10 * time.Millisecond}), run: expectTimeout(protocol.ErrorCodeFirstRowTimeout)},
+	{name: "IdleTimeout", cfg: timeouts(runner.Timeouts{Idle: 20 * time.Millisecond}), run: expectTimeout(protocol.ErrorCodeIdleTimeout)},
+	{name: "StreamTimeout", cfg: timeouts(runner.Timeouts{Stream: 300 * time.Millisecond}), run: expectTimeout(protocol.ErrorCodeStreamTimeout)},
+	{name: "MalformedMessage", run: testMalformedMessage},
+	{name: "UnknownMessageType", run: testUnknownMessageType},
+}
+
+// waitForAuditEntry waits for a stream's audit entry, which is written in
+// the background
+func waitForAuditEntry(ctx context.Context, store *runner.MemoryStore, streamID string) error {
+	for !hasAuditEntry(store, streamID) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no audit entry for stream %s: %w", streamID, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func hasAuditEntry(store *runner.MemoryStore, streamID string) bool {
+	for _, entry := range store.AuditEntries() {
+		if entry.StreamID == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// traceEvents extracts the event names of trace status messages
+func traceEvents(msgs []protocol.WSMessage) []string {
+	var events []string
+	for _, msg := range msgs {
+		if status, _ := msg.Payload["status"].(string); msg.Type == protocol.MessageTypeStatus && status == protocol.StatusTrace {
+			event, _ := msg.Payload["event"].(string)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// expectStreamError runs req on a fresh connection and expects it to fail with want
+func expectStreamError(ctx context.Context, h *harness, req protocol.QueryRequest, want string) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(req)
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, want) {
+		return fmt.Errorf("status %q error %q, want failure containing %q", result.Status, result.Error, want)
+	}
+	return nil
+}
+
+// expectCompleted runs queryID to completion on c
+func expectCompleted(ctx context.Context, c *client.Client, queryID string) error {
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("follow-up query: status %q (error %q)", result.Status, result.Error)
+	}
+	return nil
+}
+
+// waitForStatus consumes stream messages until the given status is reported
+func waitForStatus(ctx context.Context, stream *client.Stream, want string) error {
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for %q on %s: %w", want, stream.ID, err)
+		}
+		if msg.Type == protocol.MessageTypeError {
+			return fmt.Errorf("waiting for %q on %s: got error %v", want, stream.ID, msg.Payload["error"])
+		}
+		if msg.Type != protocol.MessageTypeStatus {
+			continue
+		}
+		status, _ := msg.Payload["status"].(string)
+		if status == want {
+			return nil
+		}
+		if protocol.IsTerminalStatus(status) {
+			return fmt.Errorf("waiting for %q on %s: stream ended with %q", want, stream.ID, status)
+		}
+	}
+}
+
+// waitForError consumes stream messages until an error containing want arrives
+func waitForError(ctx context.Context, stream *client.Stream, want string) error {
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for error %q on %s: %w", want, stream.ID, err)
+		}
+		if msg.Type != protocol.MessageTypeError {
+			continue
+		}
+		if errText, _ := msg.Payload["error"].(string); strings.Contains(errText, want) {
+			return nil
+		}
+		return fmt.Errorf("waiting for error %q on %s: got %v", want, stream.ID, msg.Payload["error"])
+	}
+}
+
+func nextUnrouted(ctx context.Context, c *client.Client) (protocol.WSMessage, error) {
+	select {
+	case msg := <-c.Unrouted():
+		return msg, nil
+	case <-c.Done():
+		return protocol.WSMessage{}, c.Err()
+	case <-ctx.Done():
+		return protocol.WSMessage{}, fmt.Errorf("waiting for unrouted message: %w", ctx.Err())
+	case <-time.After(5 * time.Second):
+		return protocol.WSMessage{}, fmt.Errorf("no unrouted message received")
+	}
+}
+
+// messageSequence flattens messages into "type" or "status:<status>" tokens,
+// collapsing consecutive duplicates
+func messageSequence(msgs []protocol.WSMessage) []string {
+	var seq []string
+	for _, msg := range msgs {
+		token := string(msg.Type)
+		if msg.Type == protocol.MessageTypeStatus {
+			status, _ := msg.Payload["status"].(string)
+			token += ":" + status
+		}
+		if len(seq) > 0 && seq[len(seq)-1] == token {
+			continue
+		}
+		seq = append(seq, token)
+	}
+	return seq
+}
+
+// isSubsequence reports whether want appears in order within got
+func isSubsequence(want, got []string) bool {
+	i := 0
+	for _, token := range got {
+		if i < len(want) && token == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
+
+// expectRejected submits req and checks the server rejects it with code
+func expectRejected(ctx context.Context, c *client.Client, req protocol.QueryRequest, code string) error {
+	stream, err := c.Execute(req)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	msg, err := stream.Next(ctx)
+	if err != nil {
+		return err
+	}
+	if rejected, _ := msg.Payload["rejected"].(bool); !rejected || msg.Payload["code"] != code {
+		return fmt.Errorf("%s: %+v, want rejected with %s", req.StreamID, msg, code)
+	}
+	return nil
+}
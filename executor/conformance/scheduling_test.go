@@ -0,0 +1,744 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+)
+
+func singleWorker(cfg *websocket.Config) {
+	cfg.MaxWorkers = 1
+	cfg.QueueCapacity = 1
+}
+
+func serialWorker(cfg *websocket.Config) {
+	cfg.MaxWorkers = 1
+}
+
+// queueTimeout reports queue positions often and gives up on queued
+// queries after a second
+func queueTimeout(cfg *websocket.Config) {
+	cfg.MaxWorkers = 1
+	cfg.ProgressInterval = 50 * time.Millisecond
+	cfg.QueueTimeout = time.Second
+}
+
+// executionTimeout gives executions a short deadline, and a cancel timeout
+// long enough that only cancelling on the engine stops a hung one in time
+func executionTimeout(cfg *websocket.Config) {
+	cfg.ExecutionTimeout = 300 * time.Millisecond
+	cfg.MaxExecutionTimeout = 2 * time.Second
+	cfg.CancelTimeout = 30 * time.Second
+}
+
+// cancelDeadline runs a single worker so a hung execution that is not
+// forcibly closed would block every later query
+func cancelDeadline(cfg *websocket.Config) {
+	cfg.MaxWorkers = 1
+	cfg.CancelTimeout = 100 * time.Millisecond
+}
+
+func timeouts(t runner.Timeouts) func(*websocket.Config) {
+	return func(cfg *websocket.Config) {
+		cfg.Timeouts = t
+	}
+}
+
+func expectTimeout(code string) func(ctx context.Context, h *harness) error {
+	return func(ctx context.Context, h *harness) error {
+		c, err := h.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: querySlow})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusFailed || result.ErrorCode != code {
+			return fmt.Errorf("status %q code %q (error %q), want failure with code %q", result.Status, result.ErrorCode, result.Error, code)
+		}
+
+		// The timeout only affects its own stream
+		return expectCompleted(ctx, c, queryFast)
+	}
+}
+
+func testPriority(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Hold the only worker so the rest queue up; each query takes long
+	// enough that they finish in the order they ran
+	blocker, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, blocker, protocol.StatusRunning); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for _, name := range []string{"background-1", "export", "background-2", "interactive", ""} {
+		priority, _, _ := strings.Cut(name, "-")
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced, StreamID: "priority-" + name, Priority: priority})
+		if err != nil {
+			return err
+		}
+		if err := waitForStatus(ctx, stream, protocol.StatusQueued); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			result, err := stream.Collect(ctx)
+			if err == nil && result.Status != protocol.StatusCompleted {
+				err = fmt.Errorf("stream %s: status %q (error %q)", stream.ID, result.Status, result.Error)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}(name)
+	}
+	if _, err := blocker.Collect(ctx); err != nil {
+		return err
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	// Interactive first (the default too, in arrival order), then exports,
+	// then background work
+	want := "interactive,,export,background-1,background-2"
+	if got := strings.Join(order, ","); got != want {
+		return fmt.Errorf("ran in order %s, want %s", got, want)
+	}
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, Priority: "urgent"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(result.Error, "invalid priority") {
+		return fmt.Errorf("unknown priority: error %q, want invalid priority", result.Error)
+	}
+	return nil
+}
+
+func testQueueFeedback(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// A finished run gives the server a run time to estimate waits from
+	first, err := c.Execute(protocol.QueryRequest{QueryID: queryFast})
+	if err != nil {
+		return err
+	}
+	if _, err := first.Collect(ctx); err != nil {
+		return err
+	}
+
+	blocker, err := c.Execute(protocol.QueryRequest{QueryID: querySlow})
+	if err != nil {
+		return err
+	}
+	defer blocker.Cancel()
+	if err := waitForStatus(ctx, blocker, protocol.StatusRunning); err != nil {
+		return err
+	}
+
+	var queued []*client.Stream
+	for i := 1; i <= 2; i++ {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast})
+		if err != nil {
+			return err
+		}
+		queued = append(queued, stream)
+	}
+	for i, stream := range queued {
+		update, err := nextQueuePosition(ctx, stream)
+		if err != nil {
+			return err
+		}
+		if position, _ := update["position"].(float64); int(position) != i+1 {
+			return fmt.Errorf("stream %d reported position %v, want %d", i+1, update["position"], i+1)
+		}
+		if _, ok := update["estimatedWaitMs"]; !ok {
+			return fmt.Errorf("stream %d: queued status without estimatedWaitMs: %v", i+1, update)
+		}
+	}
+
+	for i, stream := range queued {
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.ErrorCode != protocol.ErrorCodeQueueTimeout || result.Status != protocol.StatusFailed {
+			return fmt.Errorf("stream %d: status %q code %q, want failed with %s", i+1, result.Status, result.ErrorCode, protocol.ErrorCodeQueueTimeout)
+		}
+	}
+	return nil
+}
+
+// nextQueuePosition waits for a queued status carrying the stream's
+// position
+func nextQueuePosition(ctx context.Context, stream *client.Stream) (map[string]interface{}, error) {
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type != protocol.MessageTypeStatus {
+			return nil, fmt.Errorf("stream %s: unexpected %s message while queued", stream.ID, msg.Type)
+		}
+		if status, _ := msg.Payload["status"].(string); status != protocol.StatusQueued {
+			return nil, fmt.Errorf("stream %s: status %q while waiting for its position", stream.ID, status)
+		}
+		if _, ok := msg.Payload["position"]; ok {
+			return msg.Payload, nil
+		}
+	}
+}
+
+func testCancellation(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "cancel-me"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+	if err := stream.Cancel(); err != nil {
+		return err
+	}
+
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCancelled {
+		return fmt.Errorf("status = %q (error %q), want %q", result.Status, result.Error, protocol.StatusCancelled)
+	}
+
+	// The connection must remain usable after a cancellation
+	return expectCompleted(ctx, c, queryFast)
+}
+
+func testCancelDeadline(ctx context.Context, h *harness) error {
+	connector := mockConnector("connector-hung", 10, 0)
+	connector.Config = withHang(connector.Config, 60000)
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-hung", ConnectorID: connector.ID, Content: "select * from hung"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-hung", StreamID: "hung"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+	if err := stream.Cancel(); err != nil {
+		return err
+	}
+
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCancelled {
+		return fmt.Errorf("status = %q (error %q), want %q", result.Status, result.Error, protocol.StatusCancelled)
+	}
+	last := result.Messages[len(result.Messages)-1]
+	if code, _ := last.Payload["code"].(string); code != protocol.ErrorCodeCancelTimeout {
+		return fmt.Errorf("cancelled status code = %q, want %q", code, protocol.ErrorCodeCancelTimeout)
+	}
+
+	// The only worker must be free again
+	return expectCompleted(ctx, c, queryFast)
+}
+
+// withHang adds a hang to a mock connector config
+func withHang(config json.RawMessage, hangMS int) json.RawMessage {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(config, &fields); err != nil {
+		panic(err)
+	}
+	fields["hang_ms"] = hangMS
+	config, err := json.Marshal(fields)
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+func testCancelUnknownStream(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Cancel(""); err != nil {
+		return err
+	}
+	msg, err := nextUnrouted(ctx, c)
+	if err != nil {
+		return err
+	}
+	if errText, _ := msg.Payload["error"].(string); !strings.Contains(errText, "streamId is required") {
+		return fmt.Errorf("unexpected cancel error %q", errText)
+	}
+	return nil
+}
+
+func testQueueFull(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	running, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "running"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, running, protocol.StatusRunning); err != nil {
+		return err
+	}
+
+	queued, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "queued"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, queued, protocol.StatusQueued); err != nil {
+		return err
+	}
+
+	rejected, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "rejected"})
+	if err != nil {
+		return err
+	}
+	result, err := rejected.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(result.Error, "queue is full") {
+		return fmt.Errorf("error = %q, want queue full rejection", result.Error)
+	}
+
+	if err := running.Cancel(); err != nil {
+		return err
+	}
+	return queued.Cancel()
+}
+
+func testGracefulShutdown(ctx context.Context, h *harness) error {
+	h.store.PutConnector(mockConnector("connector-finishing", 10, 30))
+	h.store.PutConnector(mockConnector("connector-endless", 1000, 50))
+	h.store.PutQuery(runner.Query{ID: "query-finishing", ConnectorID: "connector-finishing", Content: "select * from finishing"})
+	h.store.PutQuery(runner.Query{ID: "query-endless", ConnectorID: "connector-endless", Content: "select * from endless"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	finishing, err := c.Execute(protocol.QueryRequest{QueryID: "query-finishing"})
+	if err != nil {
+		return err
+	}
+	endless, err := c.Execute(protocol.QueryRequest{QueryID: "query-endless"})
+	if err != nil {
+		return err
+	}
+	type collected struct {
+		result *client.Result
+		err    error
+	}
+	results := make(chan collected, 2)
+	for _, stream := range []*client.Stream{finishing, endless} {
+		go func(stream *client.Stream) {
+			result, err := stream.Collect(ctx)
+			results <- collected{result, err}
+		}(stream)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	drainCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- h.executor.Drain(drainCtx) }()
+
+	// Clients hear of the shutdown before anything is cut short
+	select {
+	case msg := <-c.Unrouted():
+		if status, _ := msg.Payload["status"].(string); status != protocol.StatusServerShutdown {
+			return fmt.Errorf("expected a server_shutdown status, got %+v", msg)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// New queries, connections and readiness checks are turned away
+	if late, err := h.dial(ctx); err == nil {
+		late.Close()
+		return errors.New("connected to a draining server")
+	}
+	rejected, err := c.Execute(protocol.QueryRequest{QueryID: "query-finishing"})
+	if err != nil {
+		return err
+	}
+	result, err := rejected.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeServerShutdown {
+		return fmt.Errorf("query while draining: status %q code %q", result.Status, result.ErrorCode)
+	}
+	resp, err := http.Get(h.server.URL + "/readyz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("readyz while draining: %d", resp.StatusCode)
+	}
+
+	// The query that finishes within the drain timeout completes; the other
+	// is cancelled once it runs out
+	outcomes := map[string]*client.Result{}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			return r.err
+		}
+		outcomes[r.result.Status] = r.result
+	}
+	if done := outcomes[protocol.StatusCompleted]; done == nil || len(done.Rows) != 10 {
+		return fmt.Errorf("draining did not let the short query finish: %+v", outcomes)
+	}
+	cancelled := outcomes[protocol.StatusCancelled]
+	if cancelled == nil {
+		return fmt.Errorf("draining did not cancel the endless query: %+v", outcomes)
+	}
+	last := cancelled.Messages[len(cancelled.Messages)-1]
+	if reason, _ := last.Payload["reason"].(string); reason != "server shutting down" {
+		return fmt.Errorf("cancelled without the shutdown reason: %+v", last)
+	}
+	if err := <-drained; !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("drain returned %v, want its deadline", err)
+	}
+
+	// The connection is closed as going away once drained
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		return errors.New("connection left open after draining")
+	}
+	return nil
+}
+
+func taskLifecycle(cfg *websocket.Config) {
+	jwtAuth(cfg)
+	cfg.MaxWorkers = 1
+}
+
+// testTaskLifecycle races cancellations, disconnects and closing queues
+// against the workers running the tasks: every stream must end exactly
+// once, and every task must release its stream ID and quota
+func testTaskLifecycle(ctx context.Context, h *harness) error {
+	slow := mockConnector("connector-lifecycle-slow", 3, 100)
+	slow.OrganizationID = "org-alice"
+	h.store.PutConnector(slow)
+	h.store.PutQuery(runner.Query{ID: "query-lifecycle-slow", OrganizationID: "org-alice", ConnectorID: slow.ID, Content: "select * from slow"})
+	h.store.PutQuota(runner.Quota{OrganizationID: "org-alice", MaxConcurrentQueries: 3})
+	dial := func() (*client.Client, error) {
+		return h.dialOptions(ctx, client.Options{Token: signToken(authSecret, "alice", time.Hour)})
+	}
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Cancelling as the worker claims the task: one ending, and nothing
+	// for the stream after it
+	for i := 0; i < 50; i++ {
+		streamID := fmt.Sprintf("race-%d", i)
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryAlice, StreamID: streamID})
+		if err != nil {
+			return err
+		}
+		if err := c.Cancel(streamID); err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted && result.Status != protocol.StatusCancelled {
+			return fmt.Errorf("%s: status %q (error %q), want completed or cancelled", streamID, result.Status, result.Error)
+		}
+	}
+
+	// Cancelling a running task frees its stream ID as soon as the client
+	// hears it was cancelled
+	running, err := c.Execute(protocol.QueryRequest{QueryID: "query-lifecycle-slow", StreamID: "reused"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, running, protocol.StatusRunning); err != nil {
+		return err
+	}
+	if err := c.Cancel("reused"); err != nil {
+		return err
+	}
+	if result, err := running.Collect(ctx); err != nil || result.Status != protocol.StatusCancelled {
+		return fmt.Errorf("cancel during run: %+v (%v), want cancelled", result, err)
+	}
+	again, err := c.Execute(protocol.QueryRequest{QueryID: queryAlice, StreamID: "reused"})
+	if err != nil {
+		return err
+	}
+	if result, err := again.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("stream ID reused after its cancellation: %+v (%v), want completed", result, err)
+	}
+
+	// Disconnecting with a task running and others queued ends them all
+	orphaned, err := dial()
+	if err != nil {
+		return err
+	}
+	stream, err := orphaned.Execute(protocol.QueryRequest{QueryID: "query-lifecycle-slow", StreamID: "orphan-running"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+	for _, streamID := range []string{"orphan-queued-1", "orphan-queued-2"} {
+		stream, err := orphaned.Execute(protocol.QueryRequest{QueryID: "query-lifecycle-slow", StreamID: streamID})
+		if err != nil {
+			return err
+		}
+		if err := waitForStatus(ctx, stream, protocol.StatusQueued); err != nil {
+			return err
+		}
+	}
+	orphaned.Close()
+
+	// Closing connections while their queues fill
+	for i := 0; i < 20; i++ {
+		closing, err := dial()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < 3; j++ {
+			closing.Execute(protocol.QueryRequest{QueryID: queryAlice, StreamID: fmt.Sprintf("closing-%d-%d", i, j)})
+		}
+		closing.Close()
+	}
+
+	// The running task was cancelled and audited once its driver stopped
+	for !hasAuditEntry(h.store, "orphan-running") {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("task running at disconnect was never audited: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for _, entry := range h.store.AuditEntries() {
+		if entry.StreamID == "orphan-running" && entry.Status != "cancelled" {
+			return fmt.Errorf("task running at disconnect audited %q, want cancelled", entry.Status)
+		}
+	}
+
+	// Every closed connection released its tasks' quota: the organization
+	// can run as many at once as ever
+	var streams []*client.Stream
+	for i := 0; i < 3; i++ {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryAlice, StreamID: fmt.Sprintf("after-%d", i)})
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+	}
+	for _, stream := range streams {
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("%s after disconnects: %+v (%v), want completed", stream.ID, result, err)
+		}
+	}
+	return nil
+}
+
+func testPanicIsolation(ctx context.Context, h *harness) error {
+	connector := mockConnector("connector-panics", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns":      []string{"id"},
+		"rows":         [][]interface{}{{1}, {2}, {3}},
+		"row_delay_ms": 20,
+		"fail":         map[string]interface{}{"stream": "index out of range", "after_rows": 2, "panic": true},
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-panics", ConnectorID: connector.ID, Content: "select 1"})
+	h.store.PutConnector(mockConnector("connector-beside", 10, 20))
+	h.store.PutQuery(runner.Query{ID: "query-beside", ConnectorID: "connector-beside", Content: "select 1"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// A stream running beside the one that panics is not disturbed
+	panics, err := c.Execute(protocol.QueryRequest{QueryID: "query-panics", CacheControl: runner.CacheBypass})
+	if err != nil {
+		return err
+	}
+	beside, err := c.Execute(protocol.QueryRequest{QueryID: "query-beside", CacheControl: runner.CacheBypass})
+	if err != nil {
+		return err
+	}
+	result, err := panics.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeInternal || len(result.Rows) > 2 {
+		return fmt.Errorf("panicking stream: status %q code %q with %d rows (error %q)", result.Status, result.ErrorCode, len(result.Rows), result.Error)
+	}
+	if result, err = beside.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("concurrent stream: status %q (error %q)", result.Status, result.Error)
+	}
+
+	// The connection's worker survives to run the next query
+	if err := expectCompleted(ctx, c, queryFast); err != nil {
+		return fmt.Errorf("after the panic: %w", err)
+	}
+
+	// So does the server, for executions outside a stream
+	resp, err := http.Post(h.server.URL+"/api/v1/queries/query-panics/execute", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var failure struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusInternalServerError || failure.Code != protocol.ErrorCodeInternal {
+		return fmt.Errorf("REST: status %d code %q, want %d %s", resp.StatusCode, failure.Code, http.StatusInternalServerError, protocol.ErrorCodeInternal)
+	}
+	return nil
+}
+
+func testExecutionTimeout(ctx context.Context, h *harness) error {
+	connector := mockConnector("connector-hangs", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"id"},
+		"rows":    [][]interface{}{{1}},
+		"hang_ms": 20000,
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-hangs", ConnectorID: connector.ID, Content: "select 1"})
+	// Ten rows at 50ms each outlast the default deadline
+	h.store.PutConnector(mockConnector("connector-half-second", 10, 50))
+	h.store.PutQuery(runner.Query{ID: "query-half-second", ConnectorID: "connector-half-second", Content: "select 1"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// A query ignoring its context is stopped on the engine at its
+	// deadline, well before the cancel timeout
+	start := time.Now()
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-hangs"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusTimeout || result.ErrorCode != protocol.ErrorCodeExecutionTimeout {
+		return fmt.Errorf("hung query: status %q code %q (error %q), want %s", result.Status, result.ErrorCode, result.Error, protocol.StatusTimeout)
+	}
+	last := result.Messages[len(result.Messages)-1]
+	if limit, _ := last.Payload["limitMs"].(float64); limit != 300 {
+		return fmt.Errorf("hung query: limitMs %v, want 300", last.Payload["limitMs"])
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		return fmt.Errorf("hung query: timed out after %s, want it cancelled on the engine", elapsed)
+	}
+
+	// Requests may ask for longer, up to the maximum
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-half-second", TimeoutMS: 1500, CacheControl: runner.CacheBypass})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 10 {
+		return fmt.Errorf("longer deadline: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+	if err := expectRejected(ctx, c, protocol.QueryRequest{QueryID: queryFast, StreamID: "too-long", TimeoutMS: 5000}, protocol.ErrorCodeInvalidRequest); err != nil {
+		return fmt.Errorf("over the maximum: %w", err)
+	}
+
+	// The worker is free again
+	return expectCompleted(ctx, c, queryFast)
+}
@@ -0,0 +1,691 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	"github.com/alicebob/miniredis/v2"
+	gorilla "github.com/gorilla/websocket"
+)
+
+func testReconnection(ctx context.Context, h *harness) error {
+	first, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	stream, err := first.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "abandoned"})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+
+	// Drop the connection mid-stream, then reconnect and reuse the stream ID
+	h.dropConnections()
+	<-first.Done()
+
+	second, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+
+	reused, err := second.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "abandoned"})
+	if err != nil {
+		return err
+	}
+	result, err := reused.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("after reconnect: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+	return nil
+}
+
+func testAsyncAttach(ctx context.Context, h *harness) error {
+	first, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	stream, err := first.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "async", Async: true})
+	if err != nil {
+		return err
+	}
+
+	var executionID string
+	for executionID == "" {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for %q: %w", protocol.StatusSubmitted, err)
+		}
+		if msg.Type == protocol.MessageTypeError {
+			return fmt.Errorf("waiting for %q: got error %v", protocol.StatusSubmitted, msg.Payload["error"])
+		}
+		if status, _ := msg.Payload["status"].(string); status == protocol.StatusSubmitted {
+			executionID, _ = msg.Payload["executionId"].(string)
+			if executionID == "" {
+				return fmt.Errorf("submitted status without executionId: %+v", msg)
+			}
+		}
+	}
+
+	// Lose the connection before any results arrive, then resume elsewhere
+	h.dropConnections()
+	<-first.Done()
+
+	second, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+
+	attached, err := second.Attach(protocol.QueryRequest{QueryID: querySlow, ExecutionID: executionID})
+	if err != nil {
+		return err
+	}
+	result, err := attached.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != slowRows {
+		return fmt.Errorf("after attach: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// Attaching to an unknown execution fails on the stream
+	unknown, err := second.Attach(protocol.QueryRequest{QueryID: querySlow, ExecutionID: "no-such-execution"})
+	if err != nil {
+		return err
+	}
+	return waitForError(ctx, unknown, "not found")
+}
+
+func testClientResubmission(ctx context.Context, h *harness) error {
+	c, err := h.dialOptions(ctx, client.Options{
+		Reconnect: &client.ReconnectPolicy{MaxAttempts: 5, InitialBackoff: 20 * time.Millisecond},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// One worker: the paced query runs while the other two wait in the queue
+	streaming, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced, StreamID: "streaming"}, client.Idempotent())
+	if err != nil {
+		return err
+	}
+	idempotent, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "idempotent"}, client.Idempotent())
+	if err != nil {
+		return err
+	}
+	unsafe, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "unsafe"})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := streaming.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for first rows: %w", err)
+		}
+		if msg.Type == protocol.MessageTypeRow {
+			break
+		}
+	}
+	h.dropConnections()
+
+	// Rows were already delivered, so the stream cannot be resumed
+	if _, err := streaming.Collect(ctx); !errors.Is(err, client.ErrMustReexecute) {
+		return fmt.Errorf("streaming: err = %v, want ErrMustReexecute", err)
+	}
+	// Queued but not idempotent: the client must not run it again on its own
+	if _, err := unsafe.Collect(ctx); !errors.Is(err, client.ErrMustReexecute) {
+		return fmt.Errorf("unsafe: err = %v, want ErrMustReexecute", err)
+	}
+
+	result, err := idempotent.Collect(ctx)
+	if err != nil {
+		return fmt.Errorf("idempotent: %w", err)
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("idempotent: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// The reconnected client keeps serving new streams
+	return expectCompleted(ctx, c, queryFast)
+}
+
+func testResumedStreams(ctx context.Context, h *harness) error {
+	c, err := h.dialOptions(ctx, client.Options{
+		Reconnect: &client.ReconnectPolicy{MaxAttempts: 5, InitialBackoff: 20 * time.Millisecond},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced, StreamID: "resumed"}, client.Idempotent(), client.ResumeRows())
+	if err != nil {
+		return err
+	}
+	var rows []interface{}
+	for len(rows) == 0 {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for first rows: %w", err)
+		}
+		rows, _ = msg.Payload["data"].([]interface{})
+	}
+	h.dropConnections()
+
+	// The stream carries on with the rows it had not received, verified
+	// against those it had
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return fmt.Errorf("resumed: %w", err)
+	}
+	for _, row := range result.Rows {
+		rows = append(rows, row)
+	}
+	if result.Status != protocol.StatusCompleted || result.TotalRows != pacedRows || len(rows) != pacedRows {
+		return fmt.Errorf("resumed: status %q, totalRows %d, %d rows received, want %d", result.Status, result.TotalRows, len(rows), pacedRows)
+	}
+	for i, r := range rows {
+		if row, _ := r.([]interface{}); len(row) == 0 || row[0] != float64(i) {
+			return fmt.Errorf("resumed: row %d is %v", i, r)
+		}
+	}
+
+	// Skipped rows that are not the ones received fail the stream
+	received := protocol.NewRowChecksum()
+	received.Add([]interface{}{0, "row-0"})
+	for _, tc := range []struct {
+		name      string
+		after     int64
+		checksum  string
+		wantError string
+	}{
+		{"changed", 1, "0000000000000000", "checksum"},
+		{"shorter", fastRows + 1, received.Sum(), fmt.Sprintf("the result has %d rows", fastRows)},
+	} {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ResumeAfterRows: tc.after, ResumeChecksum: tc.checksum})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeIntegrity || !strings.Contains(result.Error, tc.wantError) {
+			return fmt.Errorf("%s: status %q, error %q (%s), want %s", tc.name, result.Status, result.Error, result.ErrorCode, protocol.ErrorCodeIntegrity)
+		}
+	}
+
+	// The right checksum resumes after the first row. The SDK never saw
+	// that row to verify the final checksum, so the stream is read raw.
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: queryFast})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	whole := result.Messages[len(result.Messages)-2].Payload["checksum"]
+
+	conn, _, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(protocol.ClientMessage{
+		Type:         protocol.MessageTypeQuery,
+		QueryRequest: protocol.QueryRequest{QueryID: queryFast, StreamID: "after-one", ResumeAfterRows: 1, ResumeChecksum: received.Sum()},
+	}); err != nil {
+		return err
+	}
+	var sent int
+	for {
+		var msg protocol.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case protocol.MessageTypeRow:
+			data, _ := msg.Payload["data"].([]interface{})
+			sent += len(data)
+		case protocol.MessageTypeError:
+			return fmt.Errorf("resumed after one row: %v", msg.Payload["error"])
+		case protocol.MessageTypeComplete:
+			if total, _ := msg.Payload["totalRows"].(float64); sent != fastRows-1 || total != fastRows || msg.Payload["checksum"] != whole {
+				return fmt.Errorf("resumed after one row: %d rows sent of %v, checksum %v, want %v", sent, total, msg.Payload["checksum"], whole)
+			}
+			return nil
+		}
+	}
+}
+
+func testJobQueue(ctx context.Context, h *harness) error {
+	redis, err := miniredis.Run()
+	if err != nil {
+		return err
+	}
+	defer redis.Close()
+
+	h.store.PutConnector(mockConnector("connector-queued", 250, 0))
+	h.store.PutQuery(runner.Query{ID: "query-queued", ConnectorID: "connector-queued", Content: "select * from queued"})
+
+	queue := websocket.JobQueueConfig{RedisURL: "redis://" + redis.Addr(), ClaimTimeout: 500 * time.Millisecond}
+	// The front replica only publishes; the worker replica runs its
+	// queries with a memory budget of its own
+	front := h.replica(func(cfg *websocket.Config) {
+		cfg.JobQueue = queue
+		cfg.JobQueue.Publish = true
+	})
+	h.replica(func(cfg *websocket.Config) {
+		cfg.JobQueue = queue
+		cfg.JobQueue.Workers = 2
+		cfg.Memory = runner.MemoryConfig{Budget: 4 << 10}
+	})
+	// Nobody claims the queries of a replica publishing under another prefix
+	unclaimed := h.replica(func(cfg *websocket.Config) {
+		cfg.JobQueue = queue
+		cfg.JobQueue.KeyPrefix = "unclaimed:"
+		cfg.JobQueue.Publish = true
+	})
+
+	c, err := client.Dial(ctx, front, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Rows run on the worker reach the client of the front replica
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-queued"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 250 {
+		return fmt.Errorf("queued query: status %q (error %q) with %d rows", result.Status, result.Error, len(result.Rows))
+	}
+	if got := fmt.Sprint(result.Columns, result.Rows[249]); got != "[id name] [249 row-249]" {
+		return fmt.Errorf("queued query: got %s", got)
+	}
+
+	// Stream limits still apply on the front replica
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-queued", Limit: 10})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 10 {
+		return fmt.Errorf("limited queued query: status %q with %d rows", result.Status, len(result.Rows))
+	}
+
+	// A failure on the worker reaches the client with its code
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-queued", Transforms: []protocol.Transform{
+		{Op: runner.TransformTop, N: 200, By: "id"},
+	}})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeMemoryBudgetExceeded {
+		return fmt.Errorf("failed queued query: status %q code %q error %q", result.Status, result.ErrorCode, result.Error)
+	}
+
+	// A query no worker claims fails once the claim timeout passes
+	other, err := client.Dial(ctx, unclaimed, nil)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	stream, err = other.Execute(protocol.QueryRequest{QueryID: "query-queued"})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || !strings.Contains(result.Error, "claimed") {
+		return fmt.Errorf("unclaimed query: status %q error %q", result.Status, result.Error)
+	}
+	return nil
+}
+
+func testStreamRouting(ctx context.Context, h *harness) error {
+	redis, err := miniredis.Run()
+	if err != nil {
+		return err
+	}
+	defer redis.Close()
+
+	routed := func(id string) func(*websocket.Config) {
+		return func(cfg *websocket.Config) {
+			cfg.Routing = websocket.RoutingConfig{
+				InstanceID: id,
+				URL:        "wss://" + id + ".executor.internal/ws",
+				RedisURL:   "redis://" + redis.Addr(),
+			}
+		}
+	}
+	replicas := []string{h.replica(routed("replica-a")), h.replica(routed("replica-b"))}
+	httpURL := func(wsURL string) string {
+		return "http" + strings.TrimSuffix(strings.TrimPrefix(wsURL, "ws"), "/ws")
+	}
+
+	// Each connection opens with a hello naming the replica
+	c, err := client.Dial(ctx, replicas[0], nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.InstanceID() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if id := c.InstanceID(); id != "replica-a" {
+		return fmt.Errorf("hello named instance %q, want replica-a", id)
+	}
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: querySlow, StreamID: "routed", Async: true})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusSubmitted); err != nil {
+		return err
+	}
+
+	// Either replica finds the owner of the stream, with its execution
+	var owner websocket.StreamOwner
+	for {
+		err = getJSON(ctx, httpURL(replicas[1])+"/api/v1/streams/routed/owner", &owner)
+		if err == nil && owner.ExecutionID != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("owner lookup on replica-b: %v (%+v)", err, owner)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if owner.InstanceID != "replica-a" || owner.URL != "wss://replica-a.executor.internal/ws" {
+		return fmt.Errorf("owner %+v, want replica-a", owner)
+	}
+
+	// The owner is still known once the stream has ended
+	if err := c.Cancel("routed"); err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusCancelled); err != nil {
+		return err
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		err = getJSON(ctx, httpURL(replicas[1])+"/api/v1/streams/routed/owner", &owner)
+		if err == nil && owner.Status == protocol.StatusCancelled {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("owner after completion: %v (%+v)", err, owner)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Without Redis a replica only knows its own streams
+	if err := getJSON(ctx, h.server.URL+"/api/v1/streams/routed/owner", &owner); err == nil || !strings.Contains(err.Error(), "404") {
+		return fmt.Errorf("lookup of another replica's stream without redis: %v", err)
+	}
+	return nil
+}
+
+func keepalive(cfg *websocket.Config) {
+	cfg.Keepalive = websocket.KeepaliveConfig{
+		PingPeriod:        100 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		IdleTimeout:       400 * time.Millisecond,
+	}
+}
+
+// testKeepalive checks heartbeats arrive and that a connection is closed for
+// idling only once it has no streams left
+func testKeepalive(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// A query outlasting the idle timeout keeps the connection open
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced})
+	if err != nil {
+		return err
+	}
+	if err := waitForStatus(ctx, stream, protocol.StatusRunning); err != nil {
+		return err
+	}
+	heartbeat, _ := c.Heartbeat()
+	for heartbeat == nil {
+		select {
+		case <-ctx.Done():
+			return errors.New("no heartbeat received")
+		case <-time.After(10 * time.Millisecond):
+		}
+		heartbeat, _ = c.Heartbeat()
+	}
+	if active, _ := heartbeat["activeStreams"].(float64); active != 1 {
+		return fmt.Errorf("heartbeat: %v, want 1 active stream", heartbeat)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(heartbeat["serverTime"])); err != nil {
+		return fmt.Errorf("heartbeat server time: %w", err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("query outlasting the idle timeout: %+v (%v), want completed", result, err)
+	}
+
+	// Then the idle connection is closed
+	idleSince := time.Now()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		return errors.New("idle connection was not closed")
+	}
+	if !errors.Is(c.Err(), client.ErrIdleTimeout) {
+		return fmt.Errorf("idle connection closed with %v, want ErrIdleTimeout", c.Err())
+	}
+	if idle := time.Since(idleSince); idle < 300*time.Millisecond {
+		return fmt.Errorf("connection closed %s after its last stream, want the idle timeout", idle)
+	}
+	return nil
+}
+
+func sessionResumption(cfg *websocket.Config) {
+	cfg.MaxWorkers = 1
+	cfg.Sessions.ResumeWindow = 500 * time.Millisecond
+}
+
+// testSessionResumption checks a reconnecting client gets back the streams
+// that were still queued, without submitting them again, and that sessions
+// are only resumed with a valid token inside the resume window
+func testSessionResumption(ctx context.Context, h *harness) error {
+	c, err := h.dialOptions(ctx, client.Options{
+		Reconnect: &client.ReconnectPolicy{MaxAttempts: 5, InitialBackoff: 20 * time.Millisecond},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// One worker: the paced query runs while the other waits in the queue
+	streaming, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced, StreamID: "streaming"}, client.Idempotent())
+	if err != nil {
+		return err
+	}
+	unsafe, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "unsafe"})
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := streaming.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for first rows: %w", err)
+		}
+		if msg.Type == protocol.MessageTypeRow {
+			break
+		}
+	}
+	h.dropConnections()
+
+	if _, err := streaming.Collect(ctx); !errors.Is(err, client.ErrMustReexecute) {
+		return fmt.Errorf("streaming: err = %v, want ErrMustReexecute", err)
+	}
+	// Never started, so the resumed session runs it even though the
+	// client could not have resubmitted it safely
+	result, err := unsafe.Collect(ctx)
+	if err != nil {
+		return fmt.Errorf("unsafe: %w", err)
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("unsafe: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// A client presenting the token of a connection that is still open
+	// takes the session over
+	first, hello, err := dialSession(ctx, h, "")
+	if err != nil {
+		return err
+	}
+	defer first.Close()
+	token, _ := hello["sessionToken"].(string)
+	if token == "" {
+		return fmt.Errorf("hello without a session token: %v", hello)
+	}
+	if err := queueBehindSlow(first, "held"); err != nil {
+		return err
+	}
+	second, hello, err := dialSession(ctx, h, token)
+	if err != nil {
+		return err
+	}
+	defer second.Close()
+	if hello["resumed"] != true || fmt.Sprint(hello["resumedStreams"]) != "[held]" {
+		return fmt.Errorf("takeover hello: %v, want the held stream resumed", hello)
+	}
+	for {
+		var msg protocol.WSMessage
+		if err := second.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("resumed stream: %w", err)
+		}
+		if msg.StreamID == "held" && msg.Type == protocol.MessageTypeStatus && protocol.IsTerminalStatus(fmt.Sprint(msg.Payload["status"])) {
+			if msg.Payload["status"] != protocol.StatusCompleted {
+				return fmt.Errorf("resumed stream ended %v, want completed", msg.Payload)
+			}
+			break
+		}
+	}
+	// The connection taken over was closed
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg protocol.WSMessage
+		if err := first.ReadJSON(&msg); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errors.New("the connection taken over stayed open")
+			}
+			break
+		}
+	}
+
+	// Nothing is kept once the resume window has passed
+	third, hello, err := dialSession(ctx, h, "")
+	if err != nil {
+		return err
+	}
+	token, _ = hello["sessionToken"].(string)
+	if err := queueBehindSlow(third, "expired"); err != nil {
+		third.Close()
+		return err
+	}
+	third.UnderlyingConn().Close()
+	time.Sleep(800 * time.Millisecond)
+	late, hello, err := dialSession(ctx, h, token)
+	if err != nil {
+		return err
+	}
+	late.Close()
+	if hello["resumed"] != true || fmt.Sprint(hello["resumedStreams"]) != "[]" {
+		return fmt.Errorf("late hello: %v, want a resumed session with no streams", hello)
+	}
+
+	// A forged token starts a new session
+	forged, hello, err := dialSession(ctx, h, "session.forged")
+	if err != nil {
+		return err
+	}
+	forged.Close()
+	if _, resumed := hello["resumed"]; resumed || hello["sessionToken"] == "" {
+		return fmt.Errorf("forged token hello: %v, want a new session", hello)
+	}
+	return nil
+}
+
+// dialSession opens a raw connection, resuming the session of token when
+// set, and returns its hello
+func dialSession(ctx context.Context, h *harness, token string) (*gorilla.Conn, map[string]interface{}, error) {
+	header := http.Header{}
+	if token != "" {
+		header.Set(protocol.SessionHeader, token)
+	}
+	conn, _, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	var hello protocol.WSMessage
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != protocol.MessageTypeHello {
+		conn.Close()
+		return nil, nil, fmt.Errorf("hello: %+v (%v)", hello, err)
+	}
+	return conn, hello.Payload, nil
+}
+
+// queueBehindSlow runs a slow query on a raw connection with one worker
+// and queues a fast one behind it on streamID
+func queueBehindSlow(conn *gorilla.Conn, streamID string) error {
+	for _, req := range []protocol.QueryRequest{
+		{QueryID: querySlow, StreamID: streamID + "-slow"},
+		{QueryID: queryFast, StreamID: streamID},
+	} {
+		if err := conn.WriteJSON(protocol.ClientMessage{Type: protocol.MessageTypeQuery, QueryRequest: req}); err != nil {
+			return err
+		}
+	}
+	for {
+		var msg protocol.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.StreamID == streamID && msg.Payload["status"] == protocol.StatusQueued {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,1054 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+
+	gorilla "github.com/gorilla/websocket"
+)
+
+// slowClient leaves almost no room for frames a client is not reading
+func slowClient(cfg *websocket.Config) {
+	cfg.SendQueueSize = 1
+	cfg.SlowClientTimeout = 100 * time.Millisecond
+}
+
+func compression(cfg *websocket.Config) {
+	cfg.Compression = true
+	cfg.CompressionLevel = 9
+}
+
+// isoTimes sends times as text by default, even in binary encodings
+func isoTimes(cfg *websocket.Config) {
+	cfg.Values = protocol.ValueFormat{Times: protocol.TimesISO8601}
+}
+
+func frequentProgress(cfg *websocket.Config) {
+	cfg.ProgressInterval = 50 * time.Millisecond
+}
+
+func testStreamChecksum(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Every stream ends with a checksum the SDK verifies
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	last := result.Messages[len(result.Messages)-2]
+	if _, ok := last.Payload["checksum"].(string); last.Type != protocol.MessageTypeComplete || !ok {
+		return fmt.Errorf("complete message %+v carries no checksum", last)
+	}
+
+	// Batch checksums run up to each batch, the last matching the final one
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: queryFast}, client.BatchChecksums())
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	var batches int
+	var running string
+	for _, msg := range result.Messages {
+		switch msg.Type {
+		case protocol.MessageTypeRow:
+			batches++
+			running, _ = msg.Payload["checksum"].(string)
+			if running == "" {
+				return fmt.Errorf("row batch %d carries no checksum", batches)
+			}
+		case protocol.MessageTypeComplete:
+			if msg.Payload["checksum"] != running {
+				return fmt.Errorf("complete checksum %v, last batch had %s", msg.Payload["checksum"], running)
+			}
+		}
+	}
+	if batches < 2 {
+		return fmt.Errorf("%d row batches, want several", batches)
+	}
+
+	// A server whose rows went missing in transit is caught by the SDK
+	upgrader := gorilla.Upgrader{}
+	lossy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		sent := protocol.NewRowChecksum()
+		sent.Add([]interface{}{1, "dropped"})
+		sent.Add([]interface{}{2, "delivered"})
+		for {
+			var msg protocol.ClientMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			batch := map[string]interface{}{"data": [][]interface{}{{2, "delivered"}}}
+			if msg.BatchChecksums {
+				batch["checksum"] = sent.Sum()
+			}
+			for _, out := range []protocol.WSMessage{
+				{Type: protocol.MessageTypeRow, StreamID: msg.StreamID, Seq: 1, Payload: batch},
+				{Type: protocol.MessageTypeComplete, StreamID: msg.StreamID, Seq: 2, Payload: map[string]interface{}{"totalRows": 2, "checksum": sent.Sum()}},
+			} {
+				conn.WriteJSON(out)
+			}
+		}
+	}))
+	defer lossy.Close()
+
+	lc, err := client.Dial(ctx, "ws"+strings.TrimPrefix(lossy.URL, "http"), nil)
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+
+	stream, err = lc.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "lossy"})
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Collect(ctx); !errors.Is(err, client.ErrIntegrity) {
+		return fmt.Errorf("collect error = %v, want %v", err, client.ErrIntegrity)
+	}
+
+	// With batch checksums the loss is caught at the batch it affects
+	stream, err = lc.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "lossy-batches"}, client.BatchChecksums())
+	if err != nil {
+		return err
+	}
+	msg, err := stream.Next(ctx)
+	if !errors.Is(err, client.ErrIntegrity) || msg.Type != protocol.MessageTypeRow {
+		return fmt.Errorf("first batch: %s message with error %v, want %v", msg.Type, err, client.ErrIntegrity)
+	}
+	return nil
+}
+
+func testSequenceNumbers(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Every message of a stream is numbered from 1 without gaps
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures", Verbose: true})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	for i, msg := range result.Messages {
+		if msg.Seq != int64(i+1) {
+			return fmt.Errorf("message %d (%s) has seq %d", i+1, msg.Type, msg.Seq)
+		}
+	}
+
+	// A server that skips and repeats numbers is caught by the SDK
+	upgrader := gorilla.Upgrader{}
+	faulty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var msg protocol.ClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		for _, seq := range []int64{1, 1, 3} {
+			conn.WriteJSON(protocol.WSMessage{Type: protocol.MessageTypeStatus, StreamID: msg.StreamID, Seq: seq, Payload: map[string]interface{}{"status": protocol.StatusRunning}})
+		}
+		conn.ReadMessage()
+	}))
+	defer faulty.Close()
+
+	fc, err := client.Dial(ctx, "ws"+strings.TrimPrefix(faulty.URL, "http"), nil)
+	if err != nil {
+		return err
+	}
+	defer fc.Close()
+
+	stream, err = fc.Execute(protocol.QueryRequest{QueryID: queryFast, StreamID: "faulty"})
+	if err != nil {
+		return err
+	}
+	if msg, err := stream.Next(ctx); err != nil || msg.Seq != 1 {
+		return fmt.Errorf("first message: seq %d (%v)", msg.Seq, err)
+	}
+	// The duplicate of 1 is discarded and 3 arrives flagged with the gap
+	if msg, err := stream.Next(ctx); !errors.Is(err, client.ErrSequenceGap) || msg.Seq != 3 {
+		return fmt.Errorf("after gap: seq %d, error %v, want seq 3 with %v", msg.Seq, err, client.ErrSequenceGap)
+	}
+	return nil
+}
+
+func testBinaryEncoding(ctx context.Context, h *harness) error {
+	for _, encoding := range []string{protocol.EncodingMsgpack, protocol.EncodingCBOR} {
+		c, err := h.dialOptions(ctx, client.Options{Encoding: encoding})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if got := c.Encoding(); got != encoding {
+			return fmt.Errorf("negotiated %q, want %q", got, encoding)
+		}
+
+		// Rows are verified against the checksum in the binary encoding too
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures"})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", encoding, err)
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows || result.TotalRows != fastRows {
+			return fmt.Errorf("%s: status %q with %d rows, totalRows %d (error %q)", encoding, result.Status, len(result.Rows), result.TotalRows, result.Error)
+		}
+		if strings.Join(result.Columns, ",") != "id,name" {
+			return fmt.Errorf("%s: columns = %v, want [id name]", encoding, result.Columns)
+		}
+
+		// Hand-written JSON text frames are still accepted
+		if err := c.SendRaw([]byte(`{"type":"cancel"}`)); err != nil {
+			return err
+		}
+		select {
+		case msg := <-c.Unrouted():
+			if errText, _ := msg.Payload["error"].(string); !strings.Contains(errText, "streamId is required") {
+				return fmt.Errorf("%s: text frame answered with %+v", encoding, msg)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func testCompression(ctx context.Context, h *harness) error {
+	for _, offer := range []bool{true, false} {
+		c, err := h.dialOptions(ctx, client.Options{Compression: offer})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		// Compression is used only when the client offers it
+		if c.Compressed() != offer {
+			return fmt.Errorf("offered compression %v, negotiated %v", offer, c.Compressed())
+		}
+		if err := expectCompleted(ctx, c, queryFast); err != nil {
+			return fmt.Errorf("compression %v: %w", offer, err)
+		}
+	}
+	return nil
+}
+
+func testValueFormats(ctx context.Context, h *harness) error {
+	// Typed columns, as a real engine returns them
+	connector := mockConnector("connector-typed", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"at", "day", "amount", "ratio"},
+		"types":   []string{"timestamp", "date", "numeric", "float"},
+		"rows": [][]interface{}{
+			{"2024-03-01T12:30:45.123Z", "2024-03-01", "12345678901234567890.123456789", "NaN"},
+			{"2024-03-02T00:00:00Z", "2024-03-02", "1.005", "0.123456"},
+		},
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-typed", ConnectorID: connector.ID, Content: "select * from typed"})
+
+	collect := func(opts client.Options) ([][]interface{}, protocol.ValueFormat, error) {
+		c, err := h.dialOptions(ctx, opts)
+		if err != nil {
+			return nil, protocol.ValueFormat{}, err
+		}
+		defer c.Close()
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-typed"})
+		if err != nil {
+			return nil, protocol.ValueFormat{}, err
+		}
+		// Rows are verified against the stream checksum as they arrive
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return nil, protocol.ValueFormat{}, err
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != 2 {
+			return nil, protocol.ValueFormat{}, fmt.Errorf("status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+		}
+		return result.Rows, c.Values(), nil
+	}
+
+	// The server's default: times and dates as ISO 8601 text, decimals as
+	// their exact text and floats JSON cannot carry spelled out
+	rows, values, err := collect(client.Options{})
+	if err != nil {
+		return err
+	}
+	if values.Times != protocol.TimesISO8601 {
+		return fmt.Errorf("hello announced %+v, want iso8601 times", values)
+	}
+	if got := fmt.Sprint(rows[0]); got != "[2024-03-01T12:30:45.123Z 2024-03-01 12345678901234567890.123456789 NaN]" {
+		return fmt.Errorf("default row %s", got)
+	}
+	if got := fmt.Sprint(rows[1]); got != "[2024-03-02T00:00:00Z 2024-03-02 1.005 0.123456]" {
+		return fmt.Errorf("default row %s", got)
+	}
+
+	// Binary encodings follow the same format
+	rows, _, err = collect(client.Options{Encoding: protocol.EncodingMsgpack})
+	if err != nil {
+		return err
+	}
+	if at, _ := rows[0][0].(string); at != "2024-03-01T12:30:45.123Z" || rows[0][2] != "12345678901234567890.123456789" || rows[0][3] != "NaN" {
+		return fmt.Errorf("msgpack row %#v", rows[0])
+	}
+
+	// A connection negotiates its own
+	rows, values, err = collect(client.Options{Values: protocol.ValueFormat{
+		Times:     protocol.TimesUnixMillis,
+		Numerics:  protocol.NumericsNumber,
+		Precision: 2,
+	}})
+	if err != nil {
+		return err
+	}
+	if values != (protocol.ValueFormat{Times: protocol.TimesUnixMillis, Numerics: protocol.NumericsNumber, Precision: 2}) {
+		return fmt.Errorf("hello announced %+v", values)
+	}
+	want := []interface{}{float64(1709296245123), float64(1709251200000), 12345678901234567890.12, "NaN"}
+	if fmt.Sprint(rows[0]) != fmt.Sprint(want) {
+		return fmt.Errorf("negotiated row %v, want %v", rows[0], want)
+	}
+	want = []interface{}{float64(1709337600000), float64(1709337600000), 1.01, 0.12}
+	if fmt.Sprint(rows[1]) != fmt.Sprint(want) {
+		return fmt.Errorf("negotiated row %v, want %v", rows[1], want)
+	}
+
+	// An unknown format is refused at the handshake
+	_, resp, err := gorilla.DefaultDialer.DialContext(ctx, h.wsURL+"?times=epoch", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("unknown times format: %v, want a 400", err)
+	}
+
+	// REST results use the server's default
+	resp, err = http.Post(h.server.URL+"/api/v1/queries/query-typed/execute", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Rows [][]interface{} `json:"rows"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if len(body.Rows) != 2 || fmt.Sprint(body.Rows[0]) != "[2024-03-01T12:30:45.123Z 2024-03-01 12345678901234567890.123456789 NaN]" {
+		return fmt.Errorf("REST rows %v", body.Rows)
+	}
+	return nil
+}
+
+func testNullability(ctx context.Context, h *harness) error {
+	// The engine declares id NOT NULL and note nullable, but not score
+	connector := mockConnector("connector-nullable", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns":  []string{"id", "note", "score"},
+		"nullable": map[string]bool{"id": false, "note": true},
+		"rows": [][]interface{}{
+			{1, nil, 0},
+			{2, "", nil},
+			{3, "ok", 7},
+		},
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-nullable", ConnectorID: connector.ID, Content: "select * from nullable"})
+
+	describe := func(nullable []*bool) string {
+		parts := make([]string, len(nullable))
+		for i, n := range nullable {
+			parts[i] = "?"
+			if n != nil {
+				parts[i] = fmt.Sprint(*n)
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-nullable"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+		return fmt.Errorf("status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+	if got := describe(result.Nullable); got != "false,true,?" {
+		return fmt.Errorf("metadata nullable %s, want false,true,?", got)
+	}
+	// Nulls arrive as nulls, apart from empty strings and zeros
+	if result.Rows[0][1] != nil || result.Rows[1][1] != "" || result.Rows[0][2] != float64(0) || result.Rows[1][2] != nil {
+		return fmt.Errorf("rows %v", result.Rows)
+	}
+
+	// Columns the engine never saw are undeclared
+	stream, err = c.Execute(protocol.QueryRequest{
+		QueryID:    "query-nullable",
+		Transforms: []protocol.Transform{{Op: "rename", Names: map[string]string{"note": "comment"}}},
+	})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if got := describe(result.Nullable); got != "false,?,?" {
+		return fmt.Errorf("renamed nullable %s, want false,?,?", got)
+	}
+
+	// REST results declare it too
+	resp, err := http.Post(h.server.URL+"/api/v1/queries/query-nullable/execute", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Nullable []*bool `json:"nullable"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if got := describe(body.Nullable); got != "false,true,?" {
+		return fmt.Errorf("REST nullable %s, want false,true,?", got)
+	}
+
+	// A connector declaring nothing sends no nullability
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: queryFast})
+	if err != nil {
+		return err
+	}
+	if result, err = stream.Collect(ctx); err != nil {
+		return err
+	}
+	if result.Nullable != nil {
+		return fmt.Errorf("undeclared nullable %s, want none", describe(result.Nullable))
+	}
+	return nil
+}
+
+func testDecimalNumerics(ctx context.Context, h *harness) error {
+	// A NUMERIC(20,2) price, and a ratio of unconstrained numerics
+	connector := mockConnector("connector-decimal", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"price", "ratio"},
+		"types":   []string{"numeric", "numeric"},
+		"scales":  map[string]int{"price": 2},
+		"rows": [][]interface{}{
+			{"19.9", "0.1"},
+			{"1234567890123456789.05", "1/3"},
+			{nil, "2.5"},
+		},
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-decimal", ConnectorID: connector.ID, Content: "select * from decimal"})
+
+	collect := func(opts client.Options) (*client.Result, error) {
+		c, err := h.dialOptions(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-decimal"})
+		if err != nil {
+			return nil, err
+		}
+		// Rows are verified against the stream checksum as they arrive
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result.Status != protocol.StatusCompleted || len(result.Rows) != 3 {
+			return nil, fmt.Errorf("status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+		}
+		return result, nil
+	}
+
+	// Decimals are exact text, at the declared scale where there is one
+	result, err := collect(client.Options{})
+	if err != nil {
+		return err
+	}
+	if len(result.Scales) != 2 || result.Scales[0] == nil || *result.Scales[0] != 2 || result.Scales[1] != nil {
+		return fmt.Errorf("metadata scales %v, want [2 <nil>]", result.Scales)
+	}
+	want := "[[19.90 0.1] [1234567890123456789.05 0.33333333333333333333333333333333333333] [<nil> 2.5]]"
+	if got := fmt.Sprint(result.Rows); got != want {
+		return fmt.Errorf("rows %s, want %s", got, want)
+	}
+
+	// In decimal mode binary encodings carry a decimal type, and JSON the
+	// same exact text
+	for _, encoding := range []string{protocol.EncodingMsgpack, protocol.EncodingCBOR, protocol.EncodingJSON} {
+		result, err := collect(client.Options{Encoding: encoding, Values: protocol.ValueFormat{Numerics: protocol.NumericsDecimal}})
+		if err != nil {
+			return fmt.Errorf("%s: %w", encoding, err)
+		}
+		if got := fmt.Sprint(result.Rows); got != want {
+			return fmt.Errorf("%s decimal rows %s, want %s", encoding, got, want)
+		}
+		price, isDecimal := result.Rows[1][0].(protocol.Decimal)
+		if binary := encoding != protocol.EncodingJSON; binary != isDecimal {
+			return fmt.Errorf("%s price decoded as %T", encoding, result.Rows[1][0])
+		}
+		if isDecimal && (price.Scale() != 2 || price.Mantissa.String() != "123456789012345678905") {
+			return fmt.Errorf("%s price %v with scale %d", encoding, price, price.Scale())
+		}
+	}
+
+	// REST results declare scales too
+	resp, err := http.Post(h.server.URL+"/api/v1/queries/query-decimal/execute", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Scales []*int          `json:"scales"`
+		Rows   [][]interface{} `json:"rows"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if len(body.Scales) != 2 || body.Scales[0] == nil || *body.Scales[0] != 2 || fmt.Sprint(body.Rows) != want {
+		return fmt.Errorf("REST scales %v rows %v", body.Scales, body.Rows)
+	}
+	return nil
+}
+
+func testSlowClient(ctx context.Context, h *harness) error {
+	// Far more data than socket buffers hold, so a client that stops
+	// reading stalls the writer
+	connector := mockConnector("connector-large", 0, 0)
+	rows := make([][]interface{}, 8000)
+	for i := range rows {
+		rows[i] = []interface{}{i, strings.Repeat("x", 2048)}
+	}
+	connector.Config, _ = json.Marshal(map[string]interface{}{"columns": []string{"id", "payload"}, "rows": rows})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-large", ConnectorID: connector.ID, Content: "select * from large"})
+
+	// A small receive buffer keeps the kernel from absorbing the stream
+	dialer := &gorilla.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetReadBuffer(16 << 10)
+			}
+			return conn, err
+		},
+	}
+	deadline, _ := ctx.Deadline()
+
+	for _, policy := range []string{protocol.SlowClientDrop, protocol.SlowClientClose} {
+		conn, _, err := dialer.DialContext(ctx, h.wsURL, nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(deadline)
+
+		if err := conn.WriteJSON(protocol.ClientMessage{
+			Type:         protocol.MessageTypeQuery,
+			QueryRequest: protocol.QueryRequest{QueryID: "query-large", StreamID: policy, SlowClientPolicy: policy},
+		}); err != nil {
+			return err
+		}
+
+		// Once rows are on their way, stop reading long enough for the
+		// policy to apply
+		for {
+			var msg protocol.WSMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return fmt.Errorf("%s: %w", policy, err)
+			}
+			if msg.Type == protocol.MessageTypeRow {
+				break
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+
+		var code string
+		var readErr error
+		completed := false
+		for code == "" && readErr == nil && !completed {
+			var msg protocol.WSMessage
+			if readErr = conn.ReadJSON(&msg); readErr == nil && msg.Type == protocol.MessageTypeError {
+				code, _ = msg.Payload["code"].(string)
+			}
+			completed = msg.Type == protocol.MessageTypeComplete ||
+				msg.Type == protocol.MessageTypeStatus && msg.Payload["status"] == protocol.StatusCompleted
+		}
+		if completed {
+			return fmt.Errorf("%s: stream completed, want the policy applied", policy)
+		}
+
+		switch policy {
+		case protocol.SlowClientDrop:
+			if code != protocol.ErrorCodeSlowClient {
+				return fmt.Errorf("drop: stream ended with code %q (read error %v), want %q", code, readErr, protocol.ErrorCodeSlowClient)
+			}
+		case protocol.SlowClientClose:
+			if readErr == nil {
+				return fmt.Errorf("close: connection stayed open, stream ended with code %q", code)
+			}
+		}
+	}
+
+	// Other clients are unaffected
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return expectCompleted(ctx, c, queryFast)
+}
+
+func testFlowControl(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Without further credit the server stops after the initial window
+	const window = 100
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures", Credits: window})
+	if err != nil {
+		return err
+	}
+	received := 0
+	for received < window {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if msg.Type == protocol.MessageTypeRow {
+			rows, _ := msg.Payload["data"].([]interface{})
+			received += len(rows)
+		}
+	}
+	if received != window {
+		return fmt.Errorf("received %d rows on a window of %d", received, window)
+	}
+
+	idle, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	msg, err := stream.Next(idle)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("server kept sending without credit: %+v (%v)", msg, err)
+	}
+
+	if err := stream.Grant(fastRows - window); err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || received+len(result.Rows) != fastRows {
+		return fmt.Errorf("after grant: status %q with %d more rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// The SDK grants credit back as rows are consumed
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures"}, client.FlowControl(50))
+	if err != nil {
+		return err
+	}
+	result, err = stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("auto credit: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	// Credit for a stream without flow control is refused
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: querySlow})
+	if err != nil {
+		return err
+	}
+	defer stream.Cancel()
+	if err := stream.Grant(10); err != nil {
+		return err
+	}
+	for {
+		msg, err := stream.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if errText, _ := msg.Payload["error"].(string); msg.Type == protocol.MessageTypeError {
+			if !strings.Contains(errText, "not started with flow control") {
+				return fmt.Errorf("credit without flow control answered with %q", errText)
+			}
+			return nil
+		}
+	}
+}
+
+func testProgress(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryPaced})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("status %q (error %q)", result.Status, result.Error)
+	}
+
+	var reports int
+	var lastRows float64
+	completed := false
+	for _, msg := range result.Messages {
+		switch msg.Type {
+		case protocol.MessageTypeComplete:
+			completed = true
+		case protocol.MessageTypeProgress:
+			if completed {
+				return errors.New("progress reported after the complete message")
+			}
+			rows, _ := msg.Payload["rowsStreamed"].(float64)
+			if rows < lastRows {
+				return fmt.Errorf("rowsStreamed went back from %v to %v", lastRows, rows)
+			}
+			lastRows = rows
+			// The mock driver estimates completion from the rows it served
+			if _, ok := msg.Payload["estimatedRemainingMs"]; rows > 0 && !ok {
+				return fmt.Errorf("progress without an estimate: %v", msg.Payload)
+			}
+			reports++
+		}
+	}
+	if reports < 2 {
+		return fmt.Errorf("got %d progress messages, want several", reports)
+	}
+	return nil
+}
+
+func testVerboseTrace(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures", Verbose: true})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("status %q (error %q)", result.Status, result.Error)
+	}
+
+	want := []string{"received", "validated", "queued", "dequeued", "resolved", "driver_connected", "executing", "first_row"}
+	if got := traceEvents(result.Messages); !isSubsequence(want, got) {
+		return fmt.Errorf("trace events %v do not follow %v", got, want)
+	}
+
+	// Streams that did not opt in see no trace messages
+	quiet, err := c.Execute(protocol.QueryRequest{QueryID: queryFast, ParameterSet: "fixtures"})
+	if err != nil {
+		return err
+	}
+	result, err = quiet.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if events := traceEvents(result.Messages); len(events) > 0 {
+		return fmt.Errorf("non-verbose stream received trace events %v", events)
+	}
+	return nil
+}
+
+func streamLimits(cfg *websocket.Config) {
+	cfg.MaxStreamRows = 50
+}
+
+func testStreamLimits(ctx context.Context, h *harness) error {
+	h.store.PutConnector(mockConnector("connector-limited", 100, 0))
+	h.store.PutConnector(mockConnector("connector-small", 50, 0))
+	h.store.PutQuery(runner.Query{ID: "query-limited", ConnectorID: "connector-limited", Content: "select * from limited"})
+	h.store.PutQuery(runner.Query{ID: "query-small", ConnectorID: "connector-small", Content: "select * from small"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	cases := []struct {
+		name  string
+		req   protocol.QueryRequest
+		rows  int
+		limit *protocol.LimitExceeded
+	}{
+		// Requests cannot raise the server's cap, only lower it
+		{"server cap", protocol.QueryRequest{QueryID: "query-limited", MaxRows: 500}, 50, &protocol.LimitExceeded{Limit: protocol.LimitRows, Max: 50}},
+		{"request cap", protocol.QueryRequest{QueryID: "query-limited", MaxRows: 10}, 10, &protocol.LimitExceeded{Limit: protocol.LimitRows, Max: 10}},
+		// Rows are sent until they reach the byte cap
+		{"byte cap", protocol.QueryRequest{QueryID: "query-limited", MaxBytes: 100}, 10, &protocol.LimitExceeded{Limit: protocol.LimitBytes, Max: 100}},
+		// A result that fits exactly is not cut short
+		{"within cap", protocol.QueryRequest{QueryID: "query-small"}, 50, nil},
+	}
+	for _, tc := range cases {
+		stream, err := c.Execute(tc.req)
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil || result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("%s: %v (%+v)", tc.name, err, result)
+		}
+		if len(result.Rows) != tc.rows || result.TotalRows != int64(tc.rows) {
+			return fmt.Errorf("%s: got %d rows (totalRows %d), want %d", tc.name, len(result.Rows), result.TotalRows, tc.rows)
+		}
+		if fmt.Sprint(result.LimitExceeded) != fmt.Sprint(tc.limit) {
+			return fmt.Errorf("%s: got limitExceeded %+v, want %+v", tc.name, result.LimitExceeded, tc.limit)
+		}
+	}
+	return nil
+}
+
+func memoryBudget(cfg *websocket.Config) {
+	cfg.Memory = runner.MemoryConfig{Budget: 16 << 10, Spill: true}
+}
+
+func testMemoryBudget(ctx context.Context, h *harness) error {
+	h.store.PutConnector(mockConnector("connector-large", 1000, 0))
+	h.store.PutQuery(runner.Query{ID: "query-large", ConnectorID: "connector-large", Content: "select * from large"})
+	h.store.PutQuery(runner.Query{
+		ID:      "query-large-count",
+		Type:    runner.QueryTypeComposite,
+		Sources: []runner.CompositeSource{{Name: "large", QueryID: "query-large"}},
+		Content: "select count(*) as n, max(name) as last from large",
+	})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Streamed rows are not buffered, so the budget does not limit them
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-large"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil || result.Status != protocol.StatusCompleted || len(result.Rows) != 1000 {
+		return fmt.Errorf("streamed rows: %v (%s, %d rows)", err, result.Status, len(result.Rows))
+	}
+
+	// A composite source over budget spills to disk and loads in full
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-large-count"})
+	if err != nil {
+		return err
+	}
+	result, err = stream.Collect(ctx)
+	if err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("spilled source: %v (%+v)", err, result)
+	}
+	if rows := fmt.Sprint(result.Rows); rows != "[[1000 row-999]]" {
+		return fmt.Errorf("spilled source: got rows %s", rows)
+	}
+
+	// Rows held back by a transform cannot spill, so the execution fails
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-large", Transforms: []protocol.Transform{
+		{Op: runner.TransformTop, N: 900, By: "id", Descending: true},
+	}})
+	if err != nil {
+		return err
+	}
+	result, err = stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeMemoryBudgetExceeded {
+		return fmt.Errorf("top over budget: status %q code %q error %q", result.Status, result.ErrorCode, result.Error)
+	}
+	return nil
+}
+
+func testTimezone(ctx context.Context, h *harness) error {
+	// A timestamp half an hour before Paris moves its clocks forward, and
+	// a date, which has no zone to convert
+	connector := mockConnector("connector-timezone", 0, 0)
+	connector.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"created_at", "day"},
+		"types":   []string{"timestamp", "date"},
+		"rows":    [][]interface{}{{"2024-03-31T00:30:00Z", "2024-03-31"}},
+	})
+	h.store.PutConnector(connector)
+	h.store.PutQuery(runner.Query{ID: "query-timezone", ConnectorID: connector.ID, Content: "select * from events", Timezone: "Europe/Paris"})
+
+	c, err := h.dialOptions(ctx, client.Options{Values: protocol.ValueFormat{Times: protocol.TimesISO8601}})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	collect := func(timezone string) (*client.Result, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-timezone", Timezone: timezone})
+		if err != nil {
+			return nil, err
+		}
+		return stream.Collect(ctx)
+	}
+
+	// The query's default applies unless the request names a zone
+	for _, tc := range []struct{ timezone, want string }{
+		{"", "[[2024-03-31T01:30:00+01:00 2024-03-31]]"},
+		{"Asia/Kolkata", "[[2024-03-31T06:00:00+05:30 2024-03-31]]"},
+		{"UTC", "[[2024-03-31T00:30:00Z 2024-03-31]]"},
+	} {
+		result, err := collect(tc.timezone)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("timezone %q: status %q (error %q)", tc.timezone, result.Status, result.Error)
+		}
+		if got := fmt.Sprint(result.Rows); got != tc.want {
+			return fmt.Errorf("timezone %q: rows %s, want %s", tc.timezone, got, tc.want)
+		}
+	}
+
+	result, err := collect("Mars/Olympus_Mons")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(result.Error, "invalid timezone") {
+		return fmt.Errorf("unknown timezone: error %q, want invalid timezone", result.Error)
+	}
+	return nil
+}
+
+func testMockFixtures(ctx context.Context, h *harness) error {
+	put := func(id string, config map[string]interface{}) {
+		connector := mockConnector("connector-"+id, 0, 0)
+		connector.Config, _ = json.Marshal(config)
+		h.store.PutConnector(connector)
+		h.store.PutQuery(runner.Query{ID: "query-" + id, ConnectorID: connector.ID, Content: "select * from fixture"})
+	}
+	generate := map[string]interface{}{
+		"count":    1000,
+		"patterns": []string{"seq", "cycle:eu,us", "int:1,6", "time:2024-01-01T00:00:00Z,1h"},
+		"seed":     7,
+	}
+	columns := []string{"id", "region", "dice", "at"}
+	put("generated", map[string]interface{}{"columns": columns, "generate": generate})
+	put("broken", map[string]interface{}{"columns": columns, "generate": generate, "fail": map[string]interface{}{"stream": "disk full", "after_rows": 10}})
+	put("refused", map[string]interface{}{"columns": columns, "generate": generate, "fail": map[string]interface{}{"query": "relation does not exist"}})
+	put("down", map[string]interface{}{"columns": columns, "generate": generate, "fail": map[string]interface{}{"connect": "connection refused"}})
+
+	c, err := h.dialOptions(ctx, client.Options{Values: protocol.ValueFormat{Times: protocol.TimesISO8601}})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	collect := func(queryID string) (*client.Result, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID, CacheControl: runner.CacheBypass})
+		if err != nil {
+			return nil, err
+		}
+		return stream.Collect(ctx)
+	}
+
+	// Generated rows follow their patterns, the same on every run
+	first, err := collect("query-generated")
+	if err != nil {
+		return err
+	}
+	if first.Status != protocol.StatusCompleted || len(first.Rows) != 1000 {
+		return fmt.Errorf("generated: status %q with %d rows (error %q)", first.Status, len(first.Rows), first.Error)
+	}
+	row := first.Rows[999]
+	if fmt.Sprintf("%v %v %v", row[0], row[1], row[3]) != "1000 us 2024-02-11T15:00:00Z" {
+		return fmt.Errorf("generated row 1000 is %v", row)
+	}
+	for _, row := range first.Rows {
+		if dice, _ := row[2].(float64); dice < 1 || dice > 6 || dice != float64(int(dice)) {
+			return fmt.Errorf("dice %v outside 1 to 6", row[2])
+		}
+	}
+	second, err := collect("query-generated")
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(first.Rows) != fmt.Sprint(second.Rows) {
+		return errors.New("generated rows differ between runs with the same seed")
+	}
+
+	// Injected failures surface where they happen
+	broken, err := collect("query-broken")
+	if err != nil {
+		return err
+	}
+	if broken.Status != protocol.StatusFailed || len(broken.Rows) != 10 || !strings.Contains(broken.Error, "disk full") {
+		return fmt.Errorf("stream failure: status %q with %d rows (error %q)", broken.Status, len(broken.Rows), broken.Error)
+	}
+	for queryID, want := range map[string]string{"query-refused": "relation does not exist", "query-down": "connection refused"} {
+		result, err := collect(queryID)
+		if err != nil {
+			return err
+		}
+		if result.Status != protocol.StatusFailed || len(result.Rows) != 0 || !strings.Contains(result.Error, want) {
+			return fmt.Errorf("%s: status %q with %d rows (error %q), want %q", queryID, result.Status, len(result.Rows), result.Error, want)
+		}
+	}
+	return nil
+}
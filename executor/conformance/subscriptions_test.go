@@ -0,0 +1,283 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"supalytics-executor/client"
+	"supalytics-executor/drivers/mock"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+)
+
+func subscriptions(cfg *websocket.Config) {
+	cfg.Subscriptions.MinInterval = 20 * time.Millisecond
+}
+
+// testSubscriptions checks a live query sends its result again, or what
+// changed in it, only when the result changes, and ends when cancelled
+func testSubscriptions(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	h.store.PutConnector(mockConnector("connector-live", 2, 0))
+	h.store.PutQuery(runner.Query{ID: "query-live", ConnectorID: "connector-live", Content: "select * from live"})
+	// Each refresh rereads the connector, whose rows the scenario changes
+	live := func(streamID, mode string) protocol.QueryRequest {
+		return protocol.QueryRequest{QueryID: "query-live", StreamID: streamID, CacheBust: true, RefreshIntervalMS: 30, RefreshMode: mode}
+	}
+
+	full, err := c.Subscribe(live("full", protocol.RefreshFull))
+	if err != nil {
+		return err
+	}
+	diff, err := c.Subscribe(live("diff", protocol.RefreshDiff))
+	if err != nil {
+		return err
+	}
+	for _, sub := range []*client.Subscription{full, diff} {
+		if _, err := sub.Next(ctx); err != nil {
+			return fmt.Errorf("%s: first result: %w", sub.ID, err)
+		}
+		if sub.Revision != 1 || len(sub.Rows) != 2 || strings.Join(sub.Columns, ",") != "id,name" {
+			return fmt.Errorf("%s: first result: revision %d, columns %v, %d rows", sub.ID, sub.Revision, sub.Columns, len(sub.Rows))
+		}
+	}
+
+	// Refreshes with the same result send nothing
+	quiet, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	msg, err := full.Next(quiet)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("unchanged result: got %+v (%v), want no update", msg, err)
+	}
+
+	h.store.PutConnector(mockConnector("connector-live", 3, 0))
+	msg, err = full.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("full: %w", err)
+	}
+	if full.Revision != 2 || len(full.Rows) != 3 || msg.Payload["rows"] == nil {
+		return fmt.Errorf("full: revision %d with %d rows (%v), want the whole result of 3 rows", full.Revision, len(full.Rows), msg.Payload)
+	}
+	msg, err = diff.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	if _, whole := msg.Payload["rows"]; whole || fmt.Sprint(msg.Payload["added"]) != "[[2 row-2]]" || fmt.Sprint(msg.Payload["removed"]) != "[]" {
+		return fmt.Errorf("diff: update %v, want row 2 added", msg.Payload)
+	}
+
+	h.store.PutConnector(mockConnector("connector-live", 1, 0))
+	msg, err = diff.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	if fmt.Sprint(msg.Payload["removed"]) != "[[1 row-1] [2 row-2]]" || fmt.Sprint(diff.Rows) != "[[0 row-0]]" {
+		return fmt.Errorf("diff: update %v leaves %v, want rows 1 and 2 removed", msg.Payload, diff.Rows)
+	}
+
+	// A subscription holds its stream ID until it is cancelled
+	if err := expectRejected(ctx, c, protocol.QueryRequest{QueryID: queryFast, StreamID: "full"}, protocol.ErrorCodeDuplicateStream); err != nil {
+		return err
+	}
+	if err := full.Cancel(); err != nil {
+		return err
+	}
+	for {
+		msg, err = full.Next(ctx)
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, client.ErrSubscriptionEnded) || msg.Payload["status"] != protocol.StatusCancelled {
+		return fmt.Errorf("cancelled subscription: %+v (%v)", msg, err)
+	}
+	diff.Cancel()
+
+	// Too frequent refreshes are rejected, and a first run that fails ends
+	// the subscription
+	tooFast, err := c.Subscribe(protocol.QueryRequest{QueryID: queryFast, RefreshIntervalMS: 5})
+	if err != nil {
+		return err
+	}
+	if _, err := tooFast.Next(ctx); !errors.Is(err, client.ErrSubscriptionEnded) || !strings.Contains(err.Error(), "at least 20") {
+		return fmt.Errorf("refreshing every 5ms: %v, want rejected", err)
+	}
+	missing, err := c.Subscribe(protocol.QueryRequest{QueryID: queryMissingConnector, RefreshIntervalMS: 50})
+	if err != nil {
+		return err
+	}
+	if _, err := missing.Next(ctx); !errors.Is(err, client.ErrSubscriptionEnded) || !strings.Contains(err.Error(), "failed: fetch connector: connector not found") {
+		return fmt.Errorf("missing connector: %v, want the subscription failed", err)
+	}
+	return nil
+}
+
+func testNotifySubscriptions(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	h.store.PutConnector(mockConnector("connector-notify", 2, 0))
+	h.store.PutQuery(runner.Query{ID: "query-notify", ConnectorID: "connector-notify", Content: "select * from orders"})
+
+	// Without an interval the query only runs again when notified
+	sub, err := c.Subscribe(protocol.QueryRequest{QueryID: "query-notify", CacheBust: true, NotifyChannel: "orders_changed"})
+	if err != nil {
+		return err
+	}
+	defer sub.Cancel()
+	if _, err := sub.Next(ctx); err != nil {
+		return fmt.Errorf("first result: %w", err)
+	}
+	if len(sub.Rows) != 2 {
+		return fmt.Errorf("first result: %d rows, want 2", len(sub.Rows))
+	}
+	// Let the listener start before the data changes
+	time.Sleep(100 * time.Millisecond)
+
+	h.store.PutConnector(mockConnector("connector-notify", 3, 0))
+	quiet, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	msg, err := sub.Next(quiet)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("before any notification: got %+v (%v), want no update", msg, err)
+	}
+
+	// A burst of notifications refreshes the result once
+	for i := 0; i < 5; i++ {
+		mock.Notify("orders_changed", fmt.Sprint(i))
+	}
+	if _, err := sub.Next(ctx); err != nil {
+		return fmt.Errorf("after notification: %w", err)
+	}
+	if sub.Revision != 2 || len(sub.Rows) != 3 {
+		return fmt.Errorf("after notification: revision %d with %d rows, want revision 2 with 3 rows", sub.Revision, len(sub.Rows))
+	}
+	mock.Notify("other_channel", "")
+	quiet, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	msg, err = sub.Next(quiet)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("unchanged result: got %+v (%v), want no update", msg, err)
+	}
+
+	// Composite queries run on an engine without notifications
+	h.store.PutQuery(runner.Query{
+		ID:      "query-notify-composite",
+		Type:    runner.QueryTypeComposite,
+		Sources: []runner.CompositeSource{{Name: "orders", QueryID: "query-notify"}},
+		Content: "select * from orders",
+	})
+	composite, err := c.Subscribe(protocol.QueryRequest{QueryID: "query-notify-composite", NotifyChannel: "orders_changed"})
+	if err != nil {
+		return err
+	}
+	for err == nil {
+		_, err = composite.Next(ctx)
+	}
+	if !errors.Is(err, client.ErrSubscriptionEnded) || !strings.Contains(err.Error(), runner.ErrNotifyUnsupported.Error()) {
+		return fmt.Errorf("composite query: %v, want the subscription failed", err)
+	}
+
+	// Channel names are bounded like Postgres identifiers
+	long, err := c.Subscribe(protocol.QueryRequest{QueryID: "query-notify", NotifyChannel: strings.Repeat("c", 64)})
+	if err != nil {
+		return err
+	}
+	if _, err := long.Next(ctx); !errors.Is(err, client.ErrSubscriptionEnded) || !strings.Contains(err.Error(), "at most 63 bytes") {
+		return fmt.Errorf("64 byte channel: %v, want rejected", err)
+	}
+	return nil
+}
+
+func testKeyedSubscriptions(ctx context.Context, h *harness) error {
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	orders := func(rows ...[]interface{}) {
+		connector := mockConnector("connector-orders", 0, 0)
+		connector.Config, _ = json.Marshal(map[string]interface{}{"columns": []string{"id", "customer", "status"}, "rows": rows})
+		h.store.PutConnector(connector)
+	}
+	orders([]interface{}{1, "ada", "open"}, []interface{}{2, "bob", "open"}, []interface{}{3, "cy", "open"})
+	h.store.PutQuery(runner.Query{ID: "query-orders", ConnectorID: "connector-orders", Content: "select * from orders"})
+	keyed := func(keys ...string) protocol.QueryRequest {
+		return protocol.QueryRequest{QueryID: "query-orders", CacheBust: true, RefreshIntervalMS: 30, RefreshMode: protocol.RefreshKeyed, KeyColumns: keys}
+	}
+
+	sub, err := c.Subscribe(keyed("id"))
+	if err != nil {
+		return err
+	}
+	defer sub.Cancel()
+	if _, err := sub.Next(ctx); err != nil {
+		return fmt.Errorf("first result: %w", err)
+	}
+	if len(sub.Rows) != 3 {
+		return fmt.Errorf("first result: %d rows, want 3", len(sub.Rows))
+	}
+
+	// Only the changed rows are sent, and deleted rows by key
+	orders([]interface{}{3, "cy", "open"}, []interface{}{1, "ada", "closed"}, []interface{}{4, "dee", "open"})
+	msg, err := sub.Next(ctx)
+	if err != nil {
+		return fmt.Errorf("keyed update: %w", err)
+	}
+	if _, whole := msg.Payload["rows"]; whole ||
+		fmt.Sprint(msg.Payload["inserted"]) != "[[4 dee open]]" ||
+		fmt.Sprint(msg.Payload["updated"]) != "[[1 ada closed]]" ||
+		fmt.Sprint(msg.Payload["deleted"]) != "[[2]]" {
+		return fmt.Errorf("keyed update %v, want order 4 inserted, 1 updated and 2 deleted", msg.Payload)
+	}
+	if fmt.Sprint(sub.Rows) != "[[1 ada closed] [3 cy open] [4 dee open]]" {
+		return fmt.Errorf("after keyed update: rows %v", sub.Rows)
+	}
+
+	// Reordering rows changes nothing
+	orders([]interface{}{4, "dee", "open"}, []interface{}{1, "ada", "closed"}, []interface{}{3, "cy", "open"})
+	quiet, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	msg, err = sub.Next(quiet)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("reordered result: got %+v (%v), want no update", msg, err)
+	}
+	sub.Cancel()
+
+	// Keys must be declared, be columns of the result and be unique
+	for _, tc := range []struct {
+		req  protocol.QueryRequest
+		want string
+	}{
+		{keyed(), "keyed refreshes need keyColumns"},
+		{protocol.QueryRequest{QueryID: "query-orders", RefreshIntervalMS: 30, KeyColumns: []string{"id"}}, "keyColumns apply to keyed refreshes only"},
+		{keyed("order_id"), "key column order_id is not in the result"},
+		{keyed("status"), `key ["open"] is not unique`},
+	} {
+		bad, err := c.Subscribe(tc.req)
+		if err != nil {
+			return err
+		}
+		for err == nil {
+			_, err = bad.Next(ctx)
+		}
+		if !errors.Is(err, client.ErrSubscriptionEnded) || !strings.Contains(err.Error(), tc.want) {
+			return fmt.Errorf("keys %v: %v, want %q", tc.req.KeyColumns, err, tc.want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,635 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"supalytics-executor/client"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+	"supalytics-executor/websocket"
+)
+
+func templateConstants(cfg *websocket.Config) {
+	cfg.TemplateConstants = map[string]interface{}{"Env": "conformance"}
+}
+
+func testTemplateDefaults(ctx context.Context, h *harness) error {
+	h.store.PutOrganization(runner.Organization{ID: "org-defaults", TemplateDefaults: map[string]interface{}{"Schema": "analytics"}})
+
+	connector := mockConnector("connector-defaults", fastRows, 0)
+	connector.OrganizationID = "org-defaults"
+	connector.TemplateDefaults = map[string]interface{}{"Table": "events"}
+	h.store.PutConnector(connector)
+
+	// The empty preset makes rendering strict, so every key must come from
+	// the organization, the connector or the server's constants
+	content := "select * from {{.Schema}}.{{.Table}} where env = '{{.Env}}'"
+	for _, q := range []runner.Query{
+		{ID: "query-defaults", OrganizationID: "org-defaults", ConnectorID: connector.ID, Content: content},
+		{ID: "query-no-defaults", ConnectorID: "connector-fast", Content: content},
+	} {
+		h.store.PutQuery(q)
+		h.store.PutParameterSet(runner.ParameterSet{QueryID: q.ID, Name: "empty", Values: map[string]interface{}{}})
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-defaults", ParameterSet: "empty"})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusCompleted || len(result.Rows) != fastRows {
+		return fmt.Errorf("defaults: status %q with %d rows (error %q)", result.Status, len(result.Rows), result.Error)
+	}
+
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-no-defaults", StreamID: "no-defaults", ParameterSet: "empty"}, "render template")
+}
+
+func testDateRange(ctx context.Context, h *harness) error {
+	for id, content := range map[string]string{
+		"query-date-range":   `select * from events where {{dateRange "created_at" "last_7_days" "tz=America/New_York" "partition=dt"}}`,
+		"query-custom-range": `select * from events where {{dateRange "day" "custom" "type=date" "start=2024-01-01" "end=2024-01-31"}}`,
+		"query-bad-range":    `select * from events where {{dateRange "created_at" "last_fortnight"}}`,
+	} {
+		h.store.PutQuery(runner.Query{ID: id, ConnectorID: "connector-fast", Content: content})
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, queryID := range []string{"query-date-range", "query-custom-range"} {
+		if err := expectCompleted(ctx, c, queryID); err != nil {
+			return err
+		}
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-bad-range", StreamID: "bad-range"}, `unknown range "last_fortnight"`)
+}
+
+func testTemplateFunctions(ctx context.Context, h *harness) error {
+	h.store.PutQuery(runner.Query{ID: "query-template-funcs", ConnectorID: "connector-fast", Content: `select {{quoteIdent .Column}} from {{quoteIdent "analytics.events"}}` +
+		` where id in {{inList .IDs}} and name in {{inList .Names}} and tag in {{inList .Tags}}` +
+		` and ts >= {{now | inTimezone "Asia/Tokyo" | truncToDay | dateAdd "day" -1 | sqlTimestamp}} limit {{.Limit | default 100}}`})
+	h.store.PutQuery(runner.Query{ID: "query-bad-unit", ConnectorID: "connector-fast", Content: `select {{now | dateAdd "fortnight" 1 | sqlDate}}`})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-template-funcs", StreamID: "template-funcs", TemplateData: map[string]interface{}{
+		"Column": `we"ird`,
+		"IDs":    []interface{}{1, 2},
+		"Names":  []interface{}{"o'brien"},
+		"Tags":   []interface{}{},
+	}})
+	if err != nil {
+		return err
+	}
+	if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("template functions: %v (%+v)", err, result)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "template-funcs"); err != nil {
+		return err
+	}
+	var rendered string
+	for _, e := range h.store.AuditEntries() {
+		if e.StreamID == "template-funcs" {
+			rendered = e.RenderedSQL
+		}
+	}
+	// Midnight in Tokyo is 15:00 UTC the day before
+	want := regexp.MustCompile(`^select "we""ird" from "analytics"\."events" where id in \(1, 2\) and name in \('o''brien'\) and tag in \(NULL\)` +
+		` and ts >= TIMESTAMP '\d{4}-\d{2}-\d{2} 15:00:00' limit 100$`)
+	if !want.MatchString(rendered) {
+		return fmt.Errorf("rendered %q", rendered)
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-bad-unit", StreamID: "bad-unit"}, `dateAdd: unknown unit "fortnight"`)
+}
+
+func testSQLTemplateMode(ctx context.Context, h *harness) error {
+	content := `select * from {{quoteIdent .Table}} where name = {{.Name}} and score > {{.Score}}` +
+		`{{range .Extra}} and {{raw .}}{{end}}{{with $n := .Limit}} limit {{$n}}{{end}}`
+	h.store.PutQuery(runner.Query{ID: "query-sql-mode", ConnectorID: "connector-fast", TemplateMode: runner.TemplateModeSQL, Content: content})
+	h.store.PutQuery(runner.Query{ID: "query-sql-strict", ConnectorID: "connector-fast", TemplateMode: runner.TemplateModeSQLStrict, Content: content})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	run := func(queryID, streamID string, data map[string]interface{}) (string, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: queryID, StreamID: streamID, TemplateData: data})
+		if err != nil {
+			return "", err
+		}
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+			return "", fmt.Errorf("%s: %v (%+v)", streamID, err, result)
+		}
+		if err := waitForAuditEntry(ctx, h.store, streamID); err != nil {
+			return "", err
+		}
+		for _, e := range h.store.AuditEntries() {
+			if e.StreamID == streamID {
+				return e.RenderedSQL, nil
+			}
+		}
+		return "", fmt.Errorf("%s: no audit entry", streamID)
+	}
+
+	// Values become quoted literals, so an injection attempt stays a string
+	rendered, err := run("query-sql-mode", "sql-mode", map[string]interface{}{
+		"Table": "events", "Name": "x' or '1'='1", "Score": 2.5, "Extra": []interface{}{"deleted_at is null"}, "Limit": 10,
+	})
+	if err != nil {
+		return err
+	}
+	if want := `select * from "events" where name = 'x'' or ''1''=''1' and score > 2.5 and deleted_at is null limit 10`; rendered != want {
+		return fmt.Errorf("sql mode rendered %q, want %q", rendered, want)
+	}
+
+	// Strict templates render the same without raw, and reject it
+	rendered, err = run("query-sql-strict", "sql-strict", map[string]interface{}{"Table": "events", "Name": "x", "Score": 1})
+	if err != nil {
+		return err
+	}
+	if want := `select * from "events" where name = 'x' and score > 1`; rendered != want {
+		return fmt.Errorf("sql_strict mode rendered %q, want %q", rendered, want)
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-sql-strict", StreamID: "sql-strict-raw", TemplateData: map[string]interface{}{
+		"Table": "events", "Name": "x", "Score": 1, "Extra": []interface{}{"1=1"},
+	}}, runner.ErrRawInterpolation.Error())
+}
+
+func testParameterSchema(ctx context.Context, h *harness) error {
+	h.store.PutQuery(runner.Query{
+		ID:          "query-schema",
+		ConnectorID: "connector-fast",
+		Content:     `select * from events where region = '{{.Region}}' and day >= '{{.Since}}' limit {{.Limit}}`,
+		Parameters: []runner.ParameterSpec{
+			{Name: "Region", Type: runner.ParamString, Required: true, AllowedValues: []interface{}{"eu", "us"}},
+			{Name: "Since", Type: runner.ParamDate, Required: true},
+			{Name: "Limit", Type: runner.ParamInteger, Default: 100},
+		},
+	})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Defaults fill in missing parameters
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-schema", StreamID: "schema-valid", TemplateData: map[string]interface{}{"Region": "eu", "Since": "2024-01-01"}})
+	if err != nil {
+		return err
+	}
+	if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("valid parameters: %v (%+v)", err, result)
+	}
+	if err := waitForAuditEntry(ctx, h.store, "schema-valid"); err != nil {
+		return err
+	}
+	for _, e := range h.store.AuditEntries() {
+		if e.StreamID == "schema-valid" && e.RenderedSQL != "select * from events where region = 'eu' and day >= '2024-01-01' limit 100" {
+			return fmt.Errorf("valid parameters rendered %q, want the default limit", e.RenderedSQL)
+		}
+	}
+
+	// Every offending parameter is reported
+	stream, err = c.Execute(protocol.QueryRequest{QueryID: "query-schema", StreamID: "schema-invalid", TemplateData: map[string]interface{}{"Region": "apac", "Limit": 2.5}})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeInvalidParameters {
+		return fmt.Errorf("invalid parameters: status %q code %q (error %q), want %s", result.Status, result.ErrorCode, result.Error, protocol.ErrorCodeInvalidParameters)
+	}
+	var got []string
+	for _, msg := range result.Messages {
+		if msg.Type != protocol.MessageTypeError {
+			continue
+		}
+		problems, _ := msg.Payload["parameterErrors"].([]interface{})
+		for _, p := range problems {
+			problem, _ := p.(map[string]interface{})
+			got = append(got, fmt.Sprintf("%v:%v", problem["parameter"], problem["code"]))
+		}
+	}
+	if want := "Region:allowed,Since:required,Limit:type"; strings.Join(got, ",") != want {
+		return fmt.Errorf("parameter errors %v, want %s", got, want)
+	}
+
+	// The REST API rejects them as a bad request
+	resp, err := http.Post(h.server.URL+"/api/v1/queries/query-schema/execute", "application/json", strings.NewReader(`{"templateData":{"Region":"eu"}}`))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Code            string                  `json:"code"`
+		ParameterErrors []runner.ParameterError `json:"parameterErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusBadRequest || body.Code != protocol.ErrorCodeInvalidParameters || len(body.ParameterErrors) != 1 || body.ParameterErrors[0].Parameter != "Since" {
+		return fmt.Errorf("REST: status %d with %+v, want 400 listing Since", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func testJinjaTemplates(ctx context.Context, h *harness) error {
+	h.store.PutQuery(runner.Query{
+		ID:             "query-jinja",
+		ConnectorID:    "connector-fast",
+		TemplateEngine: runner.TemplateEngineJinja,
+		Content:        `select * from {{ quoteIdent(table) }}{% if region %} where region = '{{ region | upper }}'{% endif %} limit {{ limit | default(10) }}`,
+	})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for streamID, data := range map[string]map[string]interface{}{
+		"jinja-region": {"table": "events", "region": "eu"},
+		"jinja-all":    {"table": "events", "limit": 5},
+	} {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-jinja", StreamID: streamID, TemplateData: data})
+		if err != nil {
+			return err
+		}
+		if result, err := stream.Collect(ctx); err != nil || result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("%s: %v (%+v)", streamID, err, result)
+		}
+		if err := waitForAuditEntry(ctx, h.store, streamID); err != nil {
+			return err
+		}
+	}
+	want := map[string]string{
+		"jinja-region": `select * from "events" where region = 'EU' limit 10`,
+		"jinja-all":    `select * from "events" limit 5`,
+	}
+	for _, e := range h.store.AuditEntries() {
+		if sql, ok := want[e.StreamID]; ok && e.RenderedSQL != sql {
+			return fmt.Errorf("%s rendered %q, want %q", e.StreamID, e.RenderedSQL, sql)
+		}
+	}
+	return nil
+}
+
+func validateSQL(cfg *websocket.Config) {
+	cfg.ValidateSQL = true
+}
+
+func testSQLValidation(ctx context.Context, h *harness) error {
+	connector := mockConnector("connector-read-only", fastRows, 0)
+	connector.ReadOnly = true
+	h.store.PutConnector(connector)
+
+	queries := map[string]struct {
+		connectorID string
+		content     string
+		want        string // code:statement:line:column, or empty to run
+	}{
+		"query-unterminated": {"connector-fast", "select * from events where name = 'abc", "syntax:1:1:35"},
+		"query-unclosed":     {"connector-fast", "select 1;\nselect count(*) from (select a from t", "syntax:2:2:22"},
+		"query-typo":         {"connector-fast", "selec * from events", "syntax:1:1:1"},
+		"query-delete":       {"connector-read-only", "delete from events", "disallowed:1:1:1"},
+		"query-cte-delete":   {"connector-read-only", "with d as (delete from events returning *) select * from d", "disallowed:1:1:12"},
+		"query-select-into":  {"connector-read-only", "select * into backup from events", "disallowed:1:1:10"},
+		"query-read-write":   {"connector-read-only", "set default_transaction_read_only = off", "disallowed:1:1:5"},
+		"query-read":         {"connector-read-only", "select replace(name, ';', '') from events -- no writes (here)", ""},
+	}
+	for id, q := range queries {
+		h.store.PutQuery(runner.Query{ID: id, ConnectorID: q.connectorID, Content: q.content})
+	}
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for id, q := range queries {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: id})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		if q.want == "" {
+			if result.Status != protocol.StatusCompleted {
+				return fmt.Errorf("%s: status %q (error %q), want completed", id, result.Status, result.Error)
+			}
+			continue
+		}
+		if result.Status != protocol.StatusFailed || result.ErrorCode != protocol.ErrorCodeValidation {
+			return fmt.Errorf("%s: status %q code %q (error %q), want %s", id, result.Status, result.ErrorCode, result.Error, protocol.ErrorCodeValidation)
+		}
+		var got string
+		for _, msg := range result.Messages {
+			if problems, ok := msg.Payload["validationErrors"].([]interface{}); ok && len(problems) > 0 {
+				p, _ := problems[0].(map[string]interface{})
+				got = fmt.Sprintf("%v:%v:%v:%v", p["code"], p["statement"], p["line"], p["column"])
+			}
+		}
+		if got != q.want {
+			return fmt.Errorf("%s: first problem %s (error %q), want %s", id, got, result.Error, q.want)
+		}
+	}
+	return nil
+}
+
+func testTransforms(ctx context.Context, h *harness) error {
+	sales := mockConnector("connector-sales", 0, 0)
+	sales.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"region", "month", "revenue", "cost"},
+		"rows": [][]interface{}{
+			{"eu", "jan", "100", 60}, {"eu", "feb", "150", 70},
+			{"us", "jan", "200", 120}, {"us", "feb", "90", 100},
+		},
+	})
+	h.store.PutConnector(sales)
+	// The engine returns revenue as text, which the query's own transform
+	// turns into numbers before any the request adds
+	h.store.PutQuery(runner.Query{
+		ID:          "query-sales",
+		ConnectorID: sales.ID,
+		Content:     "select * from sales",
+		Transforms:  []runner.Transform{{Op: runner.TransformCast, Types: map[string]string{"revenue": runner.ParamNumber}}},
+	})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	cases := []struct {
+		name       string
+		transforms []protocol.Transform
+		columns    string
+		rows       string
+	}{
+		{
+			name: "top margins",
+			transforms: []protocol.Transform{
+				{Op: runner.TransformCompute, Name: "margin", Expr: "revenue - cost"},
+				{Op: runner.TransformRename, Names: map[string]string{"region": "Region"}},
+				{Op: runner.TransformTop, N: 2, By: "margin", Descending: true},
+			},
+			columns: "[Region month revenue cost margin]",
+			rows:    "[[eu feb 150 70 80] [us jan 200 120 80]]",
+		},
+		{
+			name:       "pivot",
+			transforms: []protocol.Transform{{Op: runner.TransformPivot, Index: []string{"region"}, Column: "month", Value: "revenue"}},
+			columns:    "[region jan feb]",
+			rows:       "[[eu 100 150] [us 200 90]]",
+		},
+		{
+			name: "unpivot",
+			transforms: []protocol.Transform{
+				{Op: runner.TransformTop, N: 1},
+				{Op: runner.TransformUnpivot, Columns: []string{"revenue", "cost"}, Name: "measure"},
+			},
+			columns: "[region month measure value]",
+			rows:    "[[eu jan revenue 100] [eu jan cost 60]]",
+		},
+	}
+	for _, tc := range cases {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-sales", Transforms: tc.transforms})
+		if err != nil {
+			return err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil || result.Status != protocol.StatusCompleted {
+			return fmt.Errorf("%s: %v (%+v)", tc.name, err, result)
+		}
+		if columns, rows := fmt.Sprint(result.Columns), fmt.Sprint(result.Rows); columns != tc.columns || rows != tc.rows {
+			return fmt.Errorf("%s: got columns %s rows %s, want %s and %s", tc.name, columns, rows, tc.columns, tc.rows)
+		}
+	}
+
+	// Transforms that cannot apply fail the request before it runs, and
+	// unknown columns once the result's header arrives
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-sales", Transforms: []protocol.Transform{{Op: "explode"}}}, `unknown operation "explode"`); err != nil {
+		return err
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-sales", Transforms: []protocol.Transform{
+		{Op: runner.TransformCompute, Name: "ratio", Expr: "revenue / visits"},
+	}}, `unknown column "visits"`)
+}
+
+func testCompositeQuery(ctx context.Context, h *harness) error {
+	accounts := mockConnector("connector-accounts", 0, 0)
+	accounts.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"account_id", "plan"},
+		"rows":    [][]interface{}{{1, "pro"}, {2, "free"}, {3, "pro"}},
+	})
+	events := mockConnector("connector-events", 0, 0)
+	events.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"account_id", "clicks"},
+		"rows":    [][]interface{}{{1, 10}, {1, 5}, {2, 7}, {3, nil}, {3, 1}},
+	})
+	h.store.PutConnector(accounts)
+	h.store.PutConnector(events)
+	h.store.PutQuery(runner.Query{ID: "query-accounts", ConnectorID: accounts.ID, Content: "select * from accounts"})
+	h.store.PutQuery(runner.Query{ID: "query-events", ConnectorID: events.ID, Content: "select * from events"})
+	h.store.PutQuery(runner.Query{
+		ID:   "query-blended",
+		Type: runner.QueryTypeComposite,
+		Sources: []runner.CompositeSource{
+			{Name: "accounts", QueryID: "query-accounts"},
+			{Name: "events", QueryID: "query-events"},
+		},
+		Content: `select a.plan, cast(sum(e.clicks) as bigint) as clicks
+			from accounts a join events e using (account_id)
+			where a.plan <> '{{.exclude}}'
+			group by a.plan order by a.plan`,
+	})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-blended", TemplateData: map[string]interface{}{"exclude": "none"}})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("composite query: %v (%+v)", err, result)
+	}
+	if columns, rows := fmt.Sprint(result.Columns), fmt.Sprint(result.Rows); columns != "[plan clicks]" || rows != "[[free 7] [pro 16]]" {
+		return fmt.Errorf("composite query: got columns %s rows %s", columns, rows)
+	}
+
+	// A failing source fails the composite, naming the source
+	h.store.PutQuery(runner.Query{
+		ID:      "query-broken",
+		Type:    runner.QueryTypeComposite,
+		Sources: []runner.CompositeSource{{Name: "accounts", QueryID: "query-accounts"}, {Name: "missing", QueryID: "query-missing"}},
+		Content: "select * from accounts",
+	})
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-broken"}, `composite source "missing"`); err != nil {
+		return err
+	}
+
+	// Composite queries cannot read other composite queries
+	h.store.PutQuery(runner.Query{
+		ID:      "query-nested",
+		Type:    runner.QueryTypeComposite,
+		Sources: []runner.CompositeSource{{Name: "blended", QueryID: "query-blended"}},
+		Content: "select * from blended",
+	})
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-nested"}, "cannot be the source of another")
+}
+
+func testAggregates(ctx context.Context, h *harness) error {
+	orders := mockConnector("connector-orders", 0, 0)
+	orders.Config, _ = json.Marshal(map[string]interface{}{
+		"columns": []string{"region", "amount", "placed"},
+		"rows": [][]interface{}{
+			{"eu", 120, "2024-03-01"}, {"us", 80, "2024-01-15"},
+			{"eu", nil, "2024-02-10"}, {"apac", 40, "2024-04-20"},
+		},
+	})
+	h.store.PutConnector(orders)
+	h.store.PutQuery(runner.Query{ID: "query-orders", ConnectorID: orders.ID, Content: "select * from orders"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Aggregates see the rows after the transforms, and skip nulls
+	stream, err := c.Execute(protocol.QueryRequest{
+		QueryID:    "query-orders",
+		Transforms: []protocol.Transform{{Op: runner.TransformCompute, Name: "taxed", Expr: "amount * 2"}},
+		Aggregates: []protocol.Aggregate{
+			{Fn: runner.AggregateCount},
+			{Fn: runner.AggregateCount, Column: "amount"},
+			{Fn: runner.AggregateSum, Column: "taxed", As: "total"},
+			{Fn: runner.AggregateAvg, Column: "amount"},
+			{Fn: runner.AggregateMin, Column: "placed"},
+			{Fn: runner.AggregateMax, Column: "region"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	result, err := stream.Collect(ctx)
+	if err != nil || result.Status != protocol.StatusCompleted {
+		return fmt.Errorf("aggregates: %v (%+v)", err, result)
+	}
+	want := "[count count_amount total avg_amount min_placed max_region] [[4 3 480 80 2024-01-15 us]]"
+	if got := fmt.Sprint(result.Columns, " ", result.Rows); got != want {
+		return fmt.Errorf("aggregates: got %s, want %s", got, want)
+	}
+
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-orders", Limit: 10,
+		Aggregates: []protocol.Aggregate{{Fn: runner.AggregateCount}}}, "aggregates cannot be combined"); err != nil {
+		return err
+	}
+	if err := expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-orders",
+		Aggregates: []protocol.Aggregate{{Fn: "median", Column: "amount"}}}, `unknown function "median"`); err != nil {
+		return err
+	}
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-orders",
+		Aggregates: []protocol.Aggregate{{Fn: runner.AggregateSum, Column: "region"}}}, "is not a number")
+}
+
+func testSampling(ctx context.Context, h *harness) error {
+	points := mockConnector("connector-points", 100, 0)
+	h.store.PutConnector(points)
+	h.store.PutQuery(runner.Query{ID: "query-points", ConnectorID: points.ID, Content: "select * from points"})
+
+	c, err := h.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	collect := func(sample protocol.Sample) (*client.Result, error) {
+		stream, err := c.Execute(protocol.QueryRequest{QueryID: "query-points", Sample: &sample})
+		if err != nil {
+			return nil, err
+		}
+		result, err := stream.Collect(ctx)
+		if err != nil || result.Status != protocol.StatusCompleted {
+			return nil, fmt.Errorf("sample %+v: %v (%+v)", sample, err, result)
+		}
+		return result, nil
+	}
+
+	result, err := collect(protocol.Sample{Every: 25})
+	if err != nil {
+		return err
+	}
+	var ids []interface{}
+	for _, row := range result.Rows {
+		ids = append(ids, row[0])
+	}
+	if got := fmt.Sprint(ids); got != "[0 25 50 75]" {
+		return fmt.Errorf("every 25th row: got ids %s", got)
+	}
+	if s := result.Sample; s == nil || *s != (protocol.SampleInfo{Method: runner.SampleEvery, RowsSeen: 100, RowsSampled: 4}) {
+		return fmt.Errorf("every 25th row: got sample %+v", s)
+	}
+
+	// A seeded reservoir sample is repeatable and keeps streamed order
+	first, err := collect(protocol.Sample{Size: 10, Seed: 7})
+	if err != nil {
+		return err
+	}
+	second, err := collect(protocol.Sample{Size: 10, Seed: 7})
+	if err != nil {
+		return err
+	}
+	if len(first.Rows) != 10 || fmt.Sprint(first.Rows) != fmt.Sprint(second.Rows) {
+		return fmt.Errorf("reservoir sample: got %v then %v", first.Rows, second.Rows)
+	}
+	last := -1.0
+	for _, row := range first.Rows {
+		id, _ := strconv.ParseFloat(fmt.Sprint(row[0]), 64)
+		if id <= last {
+			return fmt.Errorf("reservoir sample out of order: %v", first.Rows)
+		}
+		last = id
+	}
+	if s := first.Sample; s == nil || s.Method != runner.SampleReservoir || s.RowsSeen != 100 || s.RowsSampled != 10 {
+		return fmt.Errorf("reservoir sample: got sample %+v", s)
+	}
+
+	return expectStreamError(ctx, h, protocol.QueryRequest{QueryID: "query-points", Sample: &protocol.Sample{Every: 2, Size: 5}}, "exactly one of every or size")
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -22,6 +23,8 @@ const (
 	BigQueryType  DriverType = "bigquery"
 	AthenaType    DriverType = "athena"
 	ODBCType      DriverType = "odbc"
+	MockType      DriverType = "mock"
+	DuckDBType    DriverType = "duckdb"
 )
 
 // RowStream is a function type that yields rows one at a time.
@@ -34,6 +37,24 @@ type QueryResult struct {
 	Error   string    `json:"error,omitempty"`
 }
 
+// readOnlyKey marks a context whose statement only reads data
+type readOnlyKey struct{}
+
+// WithReadOnlyStatement returns a context telling the driver that the
+// statement it runs only reads data, as classified by the runner's SQL
+// lint. Drivers with read replicas may route such statements there.
+func WithReadOnlyStatement(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+// IsReadOnlyStatement reports whether ctx carries a statement classified
+// as read-only. Statements without the mark may write and run where writes
+// are possible.
+func IsReadOnlyStatement(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
+
 // Driver defines methods all drivers must implement.
 type Driver interface {
 	Connect(ctx context.Context) error
@@ -41,6 +62,207 @@ type Driver interface {
 	Close() error
 }
 
+// ScriptRunner is implemented by drivers whose engine executes a
+// multi-statement script as a single request and returns the result set of
+// the final statement, so the runner does not need to split it.
+type ScriptRunner interface {
+	RunsScripts() bool
+}
+
+// StatementExecutor is implemented by drivers that can run a statement
+// without materializing a result set.
+type StatementExecutor interface {
+	Execute(ctx context.Context, query string, args ...interface{}) error
+}
+
+// AsyncQuerier is implemented by drivers whose executions run server-side
+// independently of the submitting client. The returned execution ID can be
+// used to resume streaming after the original caller has gone away.
+type AsyncQuerier interface {
+	// StartQuery submits the query and returns its execution ID without waiting
+	StartQuery(ctx context.Context, query string) (string, error)
+	// AttachQuery waits for an execution to finish and streams its results
+	AttachQuery(ctx context.Context, executionID string) (*QueryResult, error)
+}
+
+// Canceller is implemented by drivers whose engine goes on running a query
+// after its context ends, such as warehouses that execute server-side.
+// Cancel asks the engine to stop the query the driver is waiting on, if
+// any; it may be called from another goroutine than the query's.
+type Canceller interface {
+	Cancel(ctx context.Context) error
+}
+
+// TableLoader is implemented by drivers that can load rows fetched
+// elsewhere into a table of their own, so queries can join results from
+// several connectors. Column types are inferred from the values.
+type TableLoader interface {
+	LoadTable(ctx context.Context, name string, columns []string, rows RowSource) error
+}
+
+// RowSource calls fn for each of a set of buffered rows, in order, until fn
+// fails. It can be called more than once, so rows too large to hold in
+// memory can be read back from disk for each pass.
+type RowSource func(fn func(row []interface{}) error) error
+
+// Pinger is implemented by drivers with a cheaper liveness check than
+// running a query. Health checks run SELECT 1 on drivers without one.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Notifier is implemented by drivers whose engine can push notifications
+// to a session, such as Postgres LISTEN/NOTIFY. A driver listening for
+// notifications should not be used for queries.
+type Notifier interface {
+	// Listen subscribes the session to the channel's notifications
+	Listen(ctx context.Context, channel string) error
+	// WaitForNotification blocks until a notification arrives on a channel
+	// the session listens to and returns its payload
+	WaitForNotification(ctx context.Context) (string, error)
+}
+
+// SessionTimezoner is implemented by drivers whose engine evaluates a
+// session's queries in a time zone, which decides how timestamps with a
+// zone are cast to dates and truncated. Drivers without one still have
+// their timestamps converted as they stream.
+type SessionTimezoner interface {
+	// SetTimezone sets the session's IANA time zone, e.g. "Europe/Paris"
+	SetTimezone(ctx context.Context, name string) error
+}
+
+// ReadOnlySession is implemented by drivers whose engine can refuse writes
+// for a whole session, such as Postgres's default_transaction_read_only.
+// Read-only connectors use it on top of the runner's lexical check.
+type ReadOnlySession interface {
+	// SetReadOnly makes the session's transactions read-only, and those of
+	// any session the driver opens for it later
+	SetReadOnly(ctx context.Context) error
+}
+
+// ResultReuser is implemented by drivers whose engine can answer a query
+// with the stored result of an identical one it ran recently, such as
+// Athena's query result reuse, without scanning the data again.
+type ResultReuser interface {
+	// ReuseResults lets the session's queries reuse results up to maxAge
+	// old in place of the connector's setting; a negative maxAge turns
+	// reuse off
+	ReuseResults(maxAge time.Duration)
+}
+
+// Job priorities of engines that schedule queries as jobs
+const (
+	// JobPriorityInteractive runs the query as soon as possible
+	JobPriorityInteractive = "interactive"
+	// JobPriorityBatch queues the query until the engine has idle capacity,
+	// which does not count against concurrent query limits
+	JobPriorityBatch = "batch"
+)
+
+// JobOptions set up the jobs an engine runs a session's queries as
+type JobOptions struct {
+	// Labels tag the jobs, e.g. with the organization and query they ran
+	// for, so the warehouse's billing can be broken down by them. They are
+	// added to the connector's labels.
+	Labels map[string]string
+	// Priority is JobPriorityInteractive or JobPriorityBatch; empty keeps
+	// the connector's
+	Priority string
+	// MaxBytesBilled fails a query that would bill more bytes; it can
+	// lower the connector's limit but not raise it. Zero keeps the
+	// connector's limit.
+	MaxBytesBilled int64
+}
+
+// JobConfigurer is implemented by drivers whose engine runs queries as
+// jobs it bills, schedules and labels, such as BigQuery.
+type JobConfigurer interface {
+	ConfigureJobs(opts JobOptions) error
+}
+
+// Progress is an engine's report on a running query
+type Progress struct {
+	// BytesScanned is the data the engine has read so far
+	BytesScanned int64
+	// BytesBilled is the data the engine charges for, for engines that
+	// bill differently from what they read (BigQuery rounds up and bills a
+	// minimum per table); zero when billing follows BytesScanned
+	BytesBilled int64
+	// Fraction estimates how much of the query is done, from 0 to 1; zero
+	// when the engine gives no estimate
+	Fraction float64
+}
+
+// ProgressReporter is implemented by drivers that expose the progress of
+// their current query.
+type ProgressReporter interface {
+	Progress() Progress
+}
+
+// ProgressTracker records a query's progress; drivers embed it to implement
+// ProgressReporter.
+type ProgressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+}
+
+// SetProgress records the latest progress
+func (t *ProgressTracker) SetProgress(p Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = p
+}
+
+// Progress returns the latest progress
+func (t *ProgressTracker) Progress() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress
+}
+
+// ColumnInfo is what an engine declares about a result column besides its
+// name
+type ColumnInfo struct {
+	// Nullable says whether the column allows nulls, so clients can tell
+	// missing values from zeros and empty strings; nil when the engine does
+	// not say
+	Nullable *bool `json:"nullable,omitempty" msgpack:"nullable,omitempty"`
+	// Scale is the number of decimal places of a fixed-point numeric
+	// column, so its values can be written exactly; nil for other columns
+	// and when the engine does not say
+	Scale *int `json:"scale,omitempty" msgpack:"scale,omitempty"`
+}
+
+// ColumnReporter is implemented by drivers whose engine describes the
+// columns of a result.
+type ColumnReporter interface {
+	// ColumnInfo describes the current query's columns by name, leaving out
+	// those the engine says nothing about. It is known once the result has
+	// yielded its columns.
+	ColumnInfo() map[string]ColumnInfo
+}
+
+// ColumnTracker records what the engine declared about a query's columns;
+// drivers get it through BaseDriver to implement ColumnReporter.
+type ColumnTracker struct {
+	columnMu sync.Mutex
+	columns  map[string]ColumnInfo
+}
+
+// SetColumnInfo records the current result's column descriptions
+func (t *ColumnTracker) SetColumnInfo(columns map[string]ColumnInfo) {
+	t.columnMu.Lock()
+	defer t.columnMu.Unlock()
+	t.columns = columns
+}
+
+// ColumnInfo returns the column descriptions last recorded
+func (t *ColumnTracker) ColumnInfo() map[string]ColumnInfo {
+	t.columnMu.Lock()
+	defer t.columnMu.Unlock()
+	return t.columns
+}
+
 type Result interface {
 	// Stream iterates over the result set.
 	// The provided callback function is invoked with the column names (if available)
@@ -70,6 +292,7 @@ func New(typ DriverType, config json.RawMessage) (Driver, error) {
 
 // BaseDriver implements common functionality for all drivers.
 type BaseDriver struct {
+	ColumnTracker
 	DB *sql.DB
 }
 
@@ -86,6 +309,7 @@ func (b *BaseDriver) ExecuteQuery(ctx context.Context, query string, args ...int
 		rows.Close()
 		return &QueryResult{Error: fmt.Sprintf("failed to get columns: %v", err)}, err
 	}
+	b.SetColumnInfo(describeColumns(rows))
 
 	return &QueryResult{
 		Columns: columns,
@@ -137,13 +361,39 @@ func (b *BaseDriver) Close() error {
 	return nil
 }
 
-// convertValue converts values to appropriate Go types.
+// describeColumns returns what the database/sql driver reports about the
+// columns
+func describeColumns(rows *sql.Rows) map[string]ColumnInfo {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+	columns := make(map[string]ColumnInfo, len(types))
+	for _, ct := range types {
+		var info ColumnInfo
+		if nullable, ok := ct.Nullable(); ok {
+			info.Nullable = &nullable
+		}
+		if _, scale, ok := ct.DecimalSize(); ok {
+			s := int(scale)
+			info.Scale = &s
+		}
+		if info != (ColumnInfo{}) {
+			columns[ct.Name()] = info
+		}
+	}
+	return columns
+}
+
+// convertValue converts values to appropriate Go types. A NULL scanned as
+// a nil byte slice stays nil rather than becoming an empty string.
 func convertValue(v interface{}) interface{} {
 	switch v := v.(type) {
 	case []byte:
+		if v == nil {
+			return nil
+		}
 		return string(v)
-	case time.Time:
-		return v.Format(time.RFC3339)
 	case nil:
 		return nil
 	default:
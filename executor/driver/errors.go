@@ -0,0 +1,49 @@
+// driver/errors.go
+package driver
+
+import (
+	"regexp"
+	"strconv"
+
+	"supalytics-executor/protocol"
+)
+
+// Error is an error the engine raised, with the protocol error code it
+// falls under and what the engine reported about it
+type Error struct {
+	// Code is one of the protocol.ErrorCode constants
+	Code   string
+	Engine protocol.EngineError
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClassifier is implemented by drivers that recognize their engine's
+// errors. ClassifyError returns an *Error describing err, or nil for an
+// error it does not recognize.
+type ErrorClassifier interface {
+	ClassifyError(err error) *Error
+}
+
+// linePosition matches the "line 1:8" of Trino and Athena messages and the
+// "[1:8]" of BigQuery ones
+var linePosition = regexp.MustCompile(`(?:line |\[)(\d+):(\d+)`)
+
+// LineColumn finds the line and column an engine's message points at,
+// zero when it names none
+func LineColumn(message string) (line, column int) {
+	m := linePosition.FindStringSubmatch(message)
+	if m == nil {
+		return 0, 0
+	}
+	line, _ = strconv.Atoi(m[1])
+	column, _ = strconv.Atoi(m[2])
+	return line, column
+}
@@ -0,0 +1,57 @@
+// driver/labels.go
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLabelLength is the longest key or value of a job label
+const maxLabelLength = 63
+
+// ValidateLabel checks a job label follows the rules Google Cloud labels
+// share: the key starts with a lowercase letter, and the key and value
+// hold at most 63 lowercase letters, digits, underscores and dashes
+func ValidateLabel(key, value string) error {
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		return fmt.Errorf("invalid label key %q: must start with a lowercase letter", key)
+	}
+	if len(key) > maxLabelLength || !labelChars(key) {
+		return fmt.Errorf("invalid label key %q: at most %d lowercase letters, digits, _ and -", key, maxLabelLength)
+	}
+	if len(value) > maxLabelLength || !labelChars(value) {
+		return fmt.Errorf("invalid value of label %q: at most %d lowercase letters, digits, _ and -", key, maxLabelLength)
+	}
+	return nil
+}
+
+func labelChars(s string) bool {
+	for _, c := range s {
+		if !isLabelChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLabelChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+// LabelValue makes an identifier a valid label value, lowercasing it,
+// replacing other characters with underscores and cutting it to length
+func LabelValue(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c >= 'A' && c <= 'Z' {
+			return c + 'a' - 'A'
+		}
+		if isLabelChar(c) {
+			return c
+		}
+		return '_'
+	}, s)
+	if len(s) > maxLabelLength {
+		s = s[:maxLabelLength]
+	}
+	return s
+}
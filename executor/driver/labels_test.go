@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLabel(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"valid", "team", "analytics-eu_1", false},
+		{"empty value", "team", "", false},
+		{"longest key and value", "k" + strings.Repeat("a", 62), strings.Repeat("v", 63), false},
+		{"empty key", "", "x", true},
+		{"key starting with a digit", "1team", "x", true},
+		{"uppercase key", "Team", "x", true},
+		{"key too long", "k" + strings.Repeat("a", 63), "x", true},
+		{"key with a dot", "team.name", "x", true},
+		{"uppercase value", "team", "Analytics", true},
+		{"value with a space", "team", "data eng", true},
+		{"value too long", "team", strings.Repeat("v", 64), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLabel(tt.key, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLabel(%q, %q) = %v, want error %v", tt.key, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"org-123", "org-123"},
+		{"Org_ABC", "org_abc"},
+		{"a.b c/d", "a_b_c_d"},
+		{"café", "caf_"},
+		{strings.Repeat("x", 70), strings.Repeat("x", 63)},
+	}
+	for _, tt := range tests {
+		got := LabelValue(tt.in)
+		if got != tt.want {
+			t.Errorf("LabelValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if err := ValidateLabel("key", got); err != nil {
+			t.Errorf("LabelValue(%q) = %q, which is invalid: %v", tt.in, got, err)
+		}
+	}
+}
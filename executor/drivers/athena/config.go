@@ -4,8 +4,26 @@ package athena
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+
+	driver "supalytics-executor/driver"
+)
+
+// Result modes control how rows are read back once a query succeeds
+const (
+	// ResultModeAPI pages through GetQueryResults (1000 rows per call)
+	ResultModeAPI = "api"
+	// ResultModeS3 reads the CSV result object straight from OutputLocation
+	ResultModeS3 = "s3"
+	// ResultModeUnload wraps SELECT queries in UNLOAD ... WITH (format = 'PARQUET')
+	// and streams the Parquet files written under OutputLocation, deleting
+	// them afterwards, which needs s3:DeleteObject on the location
+	ResultModeUnload = "unload"
 )
 
+// MaxResultReuseMinutes is the oldest result Athena reuses, a week
+const MaxResultReuseMinutes = 7 * 24 * 60
+
 // Config holds Athena-specific configuration
 type Config struct {
 	Region          string `json:"region"`
@@ -15,7 +33,27 @@ type Config struct {
 	SecretAccessKey string `json:"secret_access_key,omitempty"`
 	SessionToken    string `json:"session_token,omitempty"`
 	WorkGroup       string `json:"workgroup,omitempty"`
-	Catalog         string `json:"catalog,omitempty"` // Default: AwsDataCatalog
+	Catalog         string `json:"catalog,omitempty"`     // Default: AwsDataCatalog
+	ResultMode      string `json:"result_mode,omitempty"` // api (default), s3 or unload
+
+	// ResultReuseMinutes lets Athena answer a query with the stored result
+	// of an identical one run at most this many minutes ago, up to a week,
+	// instead of scanning the data again; zero runs every query. Reuse
+	// needs a workgroup on engine version 3 and does not apply to unload.
+	ResultReuseMinutes int `json:"result_reuse_minutes,omitempty"`
+
+	// Proxy routes AWS API traffic through a SOCKS5 or HTTP proxy
+	Proxy *driver.ProxyConfig `json:"proxy,omitempty"`
+
+	// Endpoint replaces the AWS endpoints of Athena and S3, e.g. with
+	// LocalStack's; buckets are then addressed by path
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// AssumeRoleARN is a role assumed with the static keys or, when they are
+	// omitted, the ambient credentials (instance profile, EKS IRSA, ...)
+	AssumeRoleARN   string `json:"assume_role_arn,omitempty"`
+	ExternalID      string `json:"external_id,omitempty"`
+	RoleSessionName string `json:"role_session_name,omitempty"` // Default: supalytics-executor
 }
 
 // FromJSON creates a Config from JSON data
@@ -35,6 +73,16 @@ func FromJSON(data json.RawMessage) (*Config, error) {
 	if config.OutputLocation == "" {
 		return nil, fmt.Errorf("output_location is required")
 	}
+	if !strings.HasPrefix(config.OutputLocation, "s3://") {
+		return nil, fmt.Errorf("output_location must be an s3:// URI")
+	}
+	// Without static keys the ambient credential chain is used
+	if (config.AccessKeyID == "") != (config.SecretAccessKey == "") {
+		return nil, fmt.Errorf("access_key_id and secret_access_key must be set together")
+	}
+	if config.AssumeRoleARN == "" && config.ExternalID != "" {
+		return nil, fmt.Errorf("external_id requires assume_role_arn")
+	}
 
 	// Set defaults
 	if config.Catalog == "" {
@@ -43,6 +91,26 @@ func FromJSON(data json.RawMessage) (*Config, error) {
 	if config.WorkGroup == "" {
 		config.WorkGroup = "primary"
 	}
+	if config.ResultMode == "" {
+		config.ResultMode = ResultModeAPI
+	}
+	if config.AssumeRoleARN != "" && config.RoleSessionName == "" {
+		config.RoleSessionName = "supalytics-executor"
+	}
+
+	if config.ResultReuseMinutes < 0 || config.ResultReuseMinutes > MaxResultReuseMinutes {
+		return nil, fmt.Errorf("result_reuse_minutes must be between 0 and %d", MaxResultReuseMinutes)
+	}
+
+	switch config.ResultMode {
+	case ResultModeAPI, ResultModeS3, ResultModeUnload:
+	default:
+		return nil, fmt.Errorf("invalid result_mode: %s", config.ResultMode)
+	}
+
+	if err := config.Proxy.Validate(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
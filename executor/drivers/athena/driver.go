@@ -6,20 +6,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
+	"net/http"
+	"strconv"
 	"supalytics-executor/driver"
+	"sync"
 
 	"time"
 
+	"cloud.google.com/go/civil"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 type Driver struct {
 	driver.BaseDriver
-	client *athena.Client
-	config *Config
+	driver.ProgressTracker
+	client   *athena.Client
+	s3Client *s3.Client
+	config   *Config
+
+	// reuse is the age of the results queries may reuse, zero for none
+	reuse time.Duration
+
+	mu      sync.Mutex
+	waiting *string // the execution waitForQuery polls, for Cancel
 }
 
 func init() {
@@ -31,7 +49,7 @@ func New(config json.RawMessage) (driver.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Driver{config: cfg}, nil
+	return &Driver{config: cfg, reuse: time.Duration(cfg.ResultReuseMinutes) * time.Minute}, nil
 }
 
 func (d *Driver) Connect(ctx context.Context) error {
@@ -42,6 +60,17 @@ func (d *Driver) Connect(ctx context.Context) error {
 
 	cfg.Region = d.config.Region
 
+	if d.config.Proxy != nil {
+		transport, err := d.config.Proxy.HTTPTransport()
+		if err != nil {
+			return err
+		}
+		cfg.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.Proxy = transport.Proxy
+			tr.DialContext = transport.DialContext
+		})
+	}
+
 	if d.config.AccessKeyID != "" && d.config.SecretAccessKey != "" {
 		cfg.Credentials = credentials.NewStaticCredentialsProvider(
 			d.config.AccessKeyID,
@@ -50,12 +79,107 @@ func (d *Driver) Connect(ctx context.Context) error {
 		)
 	}
 
+	if d.config.AssumeRoleARN != "" {
+		// The role is assumed with whichever credentials were resolved above
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), d.config.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = d.config.RoleSessionName
+			if d.config.ExternalID != "" {
+				o.ExternalID = aws.String(d.config.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	if d.config.Endpoint != "" {
+		cfg.BaseEndpoint = aws.String(d.config.Endpoint)
+	}
+
 	d.client = athena.NewFromConfig(cfg)
+	if d.config.ResultMode != ResultModeAPI {
+		d.s3Client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.UsePathStyle = d.config.Endpoint != ""
+		})
+	}
 	return nil
 }
 
 func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
-	// Start query execution
+	query = d.prepareQuery(query)
+
+	execution, err := d.runQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return d.resultFor(ctx, execution), nil
+}
+
+// StartQuery submits the query and returns its QueryExecutionId without
+// waiting for it to finish. The execution keeps running inside Athena even if
+// the caller goes away, so it can later be resumed with AttachQuery.
+func (d *Driver) StartQuery(ctx context.Context, query string) (string, error) {
+	queryID, err := d.startQuery(ctx, d.prepareQuery(query))
+	if err != nil {
+		return "", err
+	}
+	return *queryID, nil
+}
+
+// AttachQuery waits for a previously started execution and streams its results
+func (d *Driver) AttachQuery(ctx context.Context, executionID string) (*driver.QueryResult, error) {
+	execution, err := d.waitForQuery(ctx, aws.String(executionID))
+	if err != nil {
+		return nil, err
+	}
+	return d.resultFor(ctx, execution), nil
+}
+
+// Execute runs a statement whose results are not needed, such as the setup
+// statements of a multi-statement query
+func (d *Driver) Execute(ctx context.Context, query string, args ...interface{}) error {
+	_, err := d.runQuery(ctx, query)
+	return err
+}
+
+// prepareQuery applies the result mode's rewrite, wrapping SELECTs in an
+// UNLOAD when Parquet unloading is enabled
+func (d *Driver) prepareQuery(query string) string {
+	if d.config.ResultMode == ResultModeUnload && isSelect(query) {
+		return wrapUnload(query, d.newUnloadPrefix())
+	}
+	return query
+}
+
+// resultFor picks how the rows of a finished execution are read back
+func (d *Driver) resultFor(ctx context.Context, execution *types.QueryExecution) *driver.QueryResult {
+	queryID := execution.QueryExecutionId
+
+	if prefix := unloadPrefixOf(aws.ToString(execution.Query)); prefix != "" && d.config.ResultMode == ResultModeUnload {
+		return &driver.QueryResult{
+			Stream: d.streamUnload(ctx, prefix),
+		}
+	}
+
+	if d.config.ResultMode == ResultModeS3 && hasCSVResult(execution) {
+		return &driver.QueryResult{
+			Stream: d.streamCSV(ctx, queryID, *execution.ResultConfiguration.OutputLocation),
+		}
+	}
+
+	return &driver.QueryResult{
+		Stream: d.streamResults(ctx, queryID),
+	}
+}
+
+// runQuery starts a query execution and waits for it to finish
+func (d *Driver) runQuery(ctx context.Context, query string) (*types.QueryExecution, error) {
+	queryID, err := d.startQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return d.waitForQuery(ctx, queryID)
+}
+
+func (d *Driver) startQuery(ctx context.Context, query string) (*string, error) {
 	startInput := &athena.StartQueryExecutionInput{
 		QueryString: &query,
 		QueryExecutionContext: &types.QueryExecutionContext{
@@ -65,17 +189,52 @@ func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (
 		ResultConfiguration: &types.ResultConfiguration{
 			OutputLocation: &d.config.OutputLocation,
 		},
-		WorkGroup: &d.config.WorkGroup,
+		WorkGroup:                &d.config.WorkGroup,
+		ResultReuseConfiguration: d.resultReuse(query),
 	}
 
 	startOutput, err := d.client.StartQueryExecution(ctx, startInput)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start query: %w", err)
 	}
+	return startOutput.QueryExecutionId, nil
+}
 
-	queryID := startOutput.QueryExecutionId
+// ReuseResults sets the age of the results the driver's queries may reuse
+// in place of the connector's result_reuse_minutes, capped at a week; a
+// negative age turns reuse off
+func (d *Driver) ReuseResults(maxAge time.Duration) {
+	d.reuse = min(maxAge, MaxResultReuseMinutes*time.Minute)
+}
+
+// resultReuse returns the reuse configuration of a query, or nil when it
+// runs without reuse. Only SELECTs are reused; Athena has no result to
+// reuse for other statements, and an UNLOAD writes a new location each
+// time.
+func (d *Driver) resultReuse(query string) *types.ResultReuseConfiguration {
+	minutes := int32(d.reuse / time.Minute)
+	if minutes <= 0 || !isSelect(query) {
+		return nil
+	}
+	return &types.ResultReuseConfiguration{
+		ResultReuseByAgeConfiguration: &types.ResultReuseByAgeConfiguration{
+			Enabled:         true,
+			MaxAgeInMinutes: aws.Int32(minutes),
+		},
+	}
+}
+
+// waitForQuery polls an execution until it reaches a final state
+func (d *Driver) waitForQuery(ctx context.Context, queryID *string) (*types.QueryExecution, error) {
+	d.mu.Lock()
+	d.waiting = queryID
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.waiting = nil
+		d.mu.Unlock()
+	}()
 
-	// Wait for query completion
 	for {
 		statusOutput, err := d.client.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
 			QueryExecutionId: queryID,
@@ -84,22 +243,52 @@ func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (
 			return nil, fmt.Errorf("failed to get query status: %w", err)
 		}
 
+		// Athena reports data scanned while the query runs but gives no
+		// estimate of how much is left
+		if stats := statusOutput.QueryExecution.Statistics; stats != nil && stats.DataScannedInBytes != nil {
+			d.SetProgress(driver.Progress{BytesScanned: *stats.DataScannedInBytes})
+		}
+
 		state := statusOutput.QueryExecution.Status.State
 		if state == types.QueryExecutionStateFailed ||
 			state == types.QueryExecutionStateCancelled {
-			return nil, fmt.Errorf("query failed: %s", *statusOutput.QueryExecution.Status.StateChangeReason)
+			// A failed UNLOAD may have written some files already
+			if prefix := unloadPrefixOf(aws.ToString(statusOutput.QueryExecution.Query)); prefix != "" {
+				d.deleteUnloaded(prefix)
+			}
+			return nil, &executionError{
+				state:  state,
+				reason: aws.ToString(statusOutput.QueryExecution.Status.StateChangeReason),
+			}
 		}
 
 		if state == types.QueryExecutionStateSucceeded {
-			break
+			return statusOutput.QueryExecution, nil
 		}
 
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
+}
 
-	return &driver.QueryResult{
-		Stream: d.streamResults(ctx, queryID),
-	}, nil
+// Cancel stops the execution the driver is waiting for. Athena runs an
+// execution to the end once it has started, scanning and billing as it
+// goes, whether or not anyone polls it.
+func (d *Driver) Cancel(ctx context.Context) error {
+	d.mu.Lock()
+	queryID := d.waiting
+	d.mu.Unlock()
+	if queryID == nil {
+		return nil
+	}
+	_, err := d.client.StopQueryExecution(ctx, &athena.StopQueryExecutionInput{QueryExecutionId: queryID})
+	if err != nil {
+		return fmt.Errorf("failed to stop query: %w", err)
+	}
+	return nil
 }
 
 func (d *Driver) streamResults(ctx context.Context, queryID *string) driver.RowStream {
@@ -126,10 +315,17 @@ func (d *Driver) streamResults(ctx context.Context, queryID *string) driver.RowS
 				for i, col := range columnInfo {
 					columns[i] = *col.Name
 				}
+				d.SetColumnInfo(describeColumns(columnInfo))
 				firstPage = false
 
+				if err := yield(columns, nil); err != nil {
+					return err
+				}
+
 				// Skip header row in first page
-				output.ResultSet.Rows = output.ResultSet.Rows[1:]
+				if len(output.ResultSet.Rows) > 0 {
+					output.ResultSet.Rows = output.ResultSet.Rows[1:]
+				}
 			}
 
 			// Stream rows
@@ -157,31 +353,94 @@ func (d *Driver) streamResults(ctx context.Context, queryID *string) driver.RowS
 	}
 }
 
+// Ping checks the credentials can read the configured workgroup
+func (d *Driver) Ping(ctx context.Context) error {
+	_, err := d.client.GetWorkGroup(ctx, &athena.GetWorkGroupInput{WorkGroup: &d.config.WorkGroup})
+	if err != nil {
+		return fmt.Errorf("failed to get workgroup %s: %w", d.config.WorkGroup, err)
+	}
+	return nil
+}
+
 func (d *Driver) Close() error {
 	// No connection to close for Athena
 	return nil
 }
 
+// describeColumns returns the nullability Athena declares for the columns,
+// and the scale of decimals
+func describeColumns(columnInfo []types.ColumnInfo) map[string]driver.ColumnInfo {
+	columns := make(map[string]driver.ColumnInfo, len(columnInfo))
+	for _, col := range columnInfo {
+		var info driver.ColumnInfo
+		switch col.Nullable {
+		case types.ColumnNullableNotNull:
+			info.Nullable = new(bool)
+		case types.ColumnNullableNullable:
+			nullable := true
+			info.Nullable = &nullable
+		}
+		if aws.ToString(col.Type) == "decimal" {
+			scale := int(col.Scale)
+			info.Scale = &scale
+		}
+		if info != (driver.ColumnInfo{}) {
+			columns[*col.Name] = info
+		}
+	}
+	return columns
+}
+
+// athenaTimestampLayout is how Athena results render timestamps
+const athenaTimestampLayout = "2006-01-02 15:04:05.999999999"
+
 // convertAthenaValue converts Athena string values to appropriate Go types
 func convertAthenaValue(value *string, dataType *string) interface{} {
 	if value == nil || dataType == nil {
 		return nil
 	}
 
+	// Only strings can be empty. An empty value of another type holds no
+	// value to parse, so it is a NULL rather than a zero.
+	switch *dataType {
+	case "varchar", "char", "string":
+		return *value
+	}
+	if *value == "" {
+		return nil
+	}
+
 	switch *dataType {
-	case "bigint", "integer":
-		var num int64
-		fmt.Sscanf(*value, "%d", &num)
-		return num
-	case "double", "float":
-		var num float64
-		fmt.Sscanf(*value, "%f", &num)
-		return num
+	case "bigint", "integer", "smallint", "tinyint":
+		if num, err := strconv.ParseInt(*value, 10, 64); err == nil {
+			return num
+		}
+		return *value
+	case "double", "float", "real":
+		if num, err := strconv.ParseFloat(*value, 64); err == nil {
+			return num
+		}
+		return *value
 	case "boolean":
 		return *value == "true"
 	case "timestamp":
-		t, _ := time.Parse(time.RFC3339Nano, *value)
-		return t
+		for _, layout := range []string{athenaTimestampLayout, time.RFC3339Nano} {
+			if t, err := time.Parse(layout, *value); err == nil {
+				return t
+			}
+		}
+		return *value
+	case "date":
+		if d, err := civil.ParseDate(*value); err == nil {
+			return d
+		}
+		return *value
+	case "decimal":
+		// Kept exact; the connection's value format decides how it is sent
+		if r, ok := new(big.Rat).SetString(*value); ok {
+			return r
+		}
+		return *value
 	default:
 		return *value
 	}
@@ -0,0 +1,85 @@
+// athena/errors.go
+package athena
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/aws/smithy-go"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// executionError is a query execution that failed or was cancelled, with
+// the reason Athena gave, e.g. "SYNTAX_ERROR: line 1:8: ..."
+type executionError struct {
+	state  types.QueryExecutionState
+	reason string
+}
+
+func (e *executionError) Error() string {
+	return "query failed: " + e.reason
+}
+
+// errorName returns the error type a reason starts with, such as
+// TABLE_NOT_FOUND, or "" when it starts with none
+func (e *executionError) errorName() string {
+	name, _, ok := strings.Cut(e.reason, ":")
+	if !ok || name == "" || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") != "" {
+		return ""
+	}
+	return name
+}
+
+// ClassifyError describes failed executions by the error type their reason
+// names, with the line and column it points at, and API errors by their
+// code
+func (d *Driver) ClassifyError(err error) *driver.Error {
+	var execErr *executionError
+	if errors.As(err, &execErr) {
+		name := execErr.errorName()
+		line, column := driver.LineColumn(execErr.reason)
+		return &driver.Error{
+			Code:   execErr.code(name),
+			Engine: protocol.EngineError{Code: name, Line: line, Column: column},
+			Err:    err,
+		}
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := protocol.ErrorCodeEngine
+		switch apiErr.ErrorCode() {
+		case "AccessDeniedException", "AccessDenied", "UnrecognizedClientException", "InvalidSignatureException":
+			code = protocol.ErrorCodePermissionDenied
+		case "TooManyRequestsException", "ThrottlingException":
+			code = protocol.ErrorCodeRateLimited
+		case "ResourceNotFoundException", "NoSuchBucket", "NoSuchKey":
+			code = protocol.ErrorCodeObjectNotFound
+		}
+		return &driver.Error{Code: code, Engine: protocol.EngineError{Code: apiErr.ErrorCode()}, Err: err}
+	}
+	return nil
+}
+
+// code returns the protocol error code of an execution that ended with the
+// named error type, https://docs.aws.amazon.com/athena/latest/ug/error-reference.html
+func (e *executionError) code(name string) string {
+	if e.state == types.QueryExecutionStateCancelled {
+		return protocol.ErrorCodeCancelled
+	}
+	switch {
+	case name == "SYNTAX_ERROR" && strings.Contains(e.reason, "does not exist"),
+		strings.HasSuffix(name, "_NOT_FOUND"):
+		return protocol.ErrorCodeObjectNotFound
+	case name == "SYNTAX_ERROR":
+		return protocol.ErrorCodeSyntax
+	case name == "PERMISSION_DENIED", name == "ACCESS_DENIED",
+		strings.Contains(e.reason, "Access Denied"), strings.Contains(e.reason, "AccessDenied"):
+		return protocol.ErrorCodePermissionDenied
+	case name == "EXCEEDED_TIME_LIMIT":
+		return protocol.ErrorCodeTimeout
+	}
+	return protocol.ErrorCodeEngine
+}
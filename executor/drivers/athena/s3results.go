@@ -0,0 +1,462 @@
+// athena/s3results.go
+package athena
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"supalytics-executor/driver"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// parquetBatchSize is the number of rows decoded per Arrow record batch
+const parquetBatchSize = 4096
+
+// Time allowed to delete the files of an unloaded result
+const unloadCleanupTimeout = time.Minute
+
+// hasCSVResult reports whether the execution wrote a CSV result object.
+// Only DML statements (SELECT and friends) produce one.
+func hasCSVResult(execution *types.QueryExecution) bool {
+	return execution.StatementType == types.StatementTypeDml &&
+		execution.ResultConfiguration != nil &&
+		execution.ResultConfiguration.OutputLocation != nil &&
+		strings.HasSuffix(*execution.ResultConfiguration.OutputLocation, ".csv")
+}
+
+// streamCSV streams the CSV result object Athena wrote to S3. The column
+// types are read from the result set metadata, which costs a single
+// GetQueryResults call regardless of the result size.
+func (d *Driver) streamCSV(ctx context.Context, queryID *string, location string) driver.RowStream {
+	return func(yield func(columns []string, row []interface{}) error) error {
+		meta, err := d.client.GetQueryResults(ctx, &athena.GetQueryResultsInput{
+			QueryExecutionId: queryID,
+			MaxResults:       aws.Int32(1),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get result metadata: %w", err)
+		}
+		columnInfo := meta.ResultSet.ResultSetMetadata.ColumnInfo
+
+		columns := make([]string, len(columnInfo))
+		for i, col := range columnInfo {
+			columns[i] = *col.Name
+		}
+		d.SetColumnInfo(describeColumns(columnInfo))
+		if err := yield(columns, nil); err != nil {
+			return err
+		}
+
+		bucket, key, err := parseS3URI(location)
+		if err != nil {
+			return err
+		}
+
+		obj, err := d.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read result object: %w", err)
+		}
+		defer obj.Body.Close()
+
+		reader := newCSVReader(obj.Body)
+
+		// Skip header record
+		if _, err := reader.Read(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read result header: %w", err)
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read result row: %w", err)
+			}
+			if len(record) != len(columnInfo) {
+				return fmt.Errorf("result row has %d fields, expected %d", len(record), len(columnInfo))
+			}
+
+			rowData := make([]interface{}, len(record))
+			for i, value := range record {
+				rowData[i] = convertAthenaValue(value, columnInfo[i].Type)
+			}
+
+			if err := yield(nil, rowData); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+// isSelect reports whether the statement returns rows and can be unloaded
+func isSelect(query string) bool {
+	q := strings.ToLower(strings.TrimLeft(query, " \t\r\n("))
+	return strings.HasPrefix(q, "select") || strings.HasPrefix(q, "with") ||
+		strings.HasPrefix(q, "values") || strings.HasPrefix(q, "table")
+}
+
+// newUnloadPrefix returns a fresh, empty S3 prefix under the output location,
+// as UNLOAD refuses to write into a prefix that already holds objects
+func (d *Driver) newUnloadPrefix() string {
+	return strings.TrimSuffix(d.config.OutputLocation, "/") + "/unload/" + uuid.NewString() + "/"
+}
+
+// wrapUnload rewrites a SELECT into an UNLOAD to Parquet
+func wrapUnload(query, prefix string) string {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	return fmt.Sprintf("UNLOAD (%s) TO '%s' WITH (format = 'PARQUET')", query, prefix)
+}
+
+// unloadPrefixPattern extracts the target prefix from a query built by wrapUnload
+var unloadPrefixPattern = regexp.MustCompile(`(?s)^UNLOAD \(.*\) TO '(s3://[^']+)' WITH \(format = 'PARQUET'\)$`)
+
+// unloadPrefixOf returns the S3 prefix an UNLOAD query writes to, or "" when
+// the query was not rewritten by wrapUnload
+func unloadPrefixOf(query string) string {
+	if m := unloadPrefixPattern.FindStringSubmatch(query); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// streamUnload streams every Parquet file UNLOAD wrote under prefix. Athena
+// writes the files in parallel, so row order across files is not preserved.
+// The files are deleted once the stream ends, whether or not it succeeded.
+func (d *Driver) streamUnload(ctx context.Context, prefix string) driver.RowStream {
+	return func(yield func(columns []string, row []interface{}) error) error {
+		bucket, keyPrefix, err := parseS3URI(prefix)
+		if err != nil {
+			return err
+		}
+		defer d.deleteUnloaded(prefix)
+
+		var keys []string
+		paginator := s3.NewListObjectsV2Paginator(d.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(keyPrefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list unloaded files: %w", err)
+			}
+			for _, obj := range page.Contents {
+				keys = append(keys, *obj.Key)
+			}
+		}
+
+		headerSent := false
+		for _, key := range keys {
+			err := d.streamParquetObject(ctx, bucket, key, func(columns []string, row []interface{}) error {
+				if columns != nil {
+					if headerSent {
+						return nil
+					}
+					headerSent = true
+				}
+				return yield(columns, row)
+			})
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// deleteUnloaded removes the files UNLOAD wrote under prefix. Each
+// execution unloads to a prefix of its own that is never read again, so
+// they would otherwise pile up in the output location. Failures are only
+// logged, as the rows have already been streamed or the execution failed.
+func (d *Driver) deleteUnloaded(prefix string) {
+	bucket, keyPrefix, err := parseS3URI(prefix)
+	if err != nil || d.s3Client == nil {
+		return
+	}
+	// The execution's context may be done by now
+	ctx, cancel := context.WithTimeout(context.Background(), unloadCleanupTimeout)
+	defer cancel()
+
+	paginator := s3.NewListObjectsV2Paginator(d.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Failed to list unloaded files under %s: %v", prefix, err)
+			return
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		// A page holds at most 1000 keys, as many as one request deletes
+		objects := make([]s3types.ObjectIdentifier, len(page.Contents))
+		for i, obj := range page.Contents {
+			objects[i] = s3types.ObjectIdentifier{Key: obj.Key}
+		}
+		out, err := d.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err == nil && len(out.Errors) > 0 {
+			err = errors.New(aws.ToString(out.Errors[0].Message))
+		}
+		if err != nil {
+			log.Printf("Failed to delete unloaded files under %s: %v", prefix, err)
+			return
+		}
+	}
+}
+
+// streamParquetObject downloads a Parquet object to a temporary file, which
+// the reader needs for random access, and yields its header and rows
+func (d *Driver) streamParquetObject(ctx context.Context, bucket, key string, yield func(columns []string, row []interface{}) error) error {
+	tmp, err := os.CreateTemp("", "athena-unload-*.parquet")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	obj, err := d.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read unloaded file %s: %w", key, err)
+	}
+	_, err = io.Copy(tmp, obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to download unloaded file %s: %w", key, err)
+	}
+
+	pqReader, err := file.NewParquetReader(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file %s: %w", key, err)
+	}
+	defer pqReader.Close()
+
+	fileReader, err := pqarrow.NewFileReader(pqReader, pqarrow.ArrowReadProperties{BatchSize: parquetBatchSize}, memory.DefaultAllocator)
+	if err != nil {
+		return fmt.Errorf("failed to read parquet file %s: %w", key, err)
+	}
+
+	recordReader, err := fileReader.GetRecordReader(ctx, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read parquet records %s: %w", key, err)
+	}
+	defer recordReader.Release()
+
+	fields := recordReader.Schema().Fields()
+	columns := make([]string, len(fields))
+	described := make(map[string]driver.ColumnInfo, len(fields))
+	for i, f := range fields {
+		columns[i] = f.Name
+		info := driver.ColumnInfo{Nullable: &f.Nullable}
+		if dec, ok := f.Type.(arrow.DecimalType); ok {
+			scale := int(dec.GetScale())
+			info.Scale = &scale
+		}
+		described[f.Name] = info
+	}
+	d.SetColumnInfo(described)
+	if err := yield(columns, nil); err != nil {
+		return err
+	}
+
+	for recordReader.Next() {
+		rec := recordReader.Record()
+		for r := 0; r < int(rec.NumRows()); r++ {
+			row := make([]interface{}, rec.NumCols())
+			for c := range row {
+				col := rec.Column(c)
+				if col.IsNull(r) {
+					continue
+				}
+				row[c] = parquetValue(col, r)
+			}
+			if err := yield(nil, row); err != nil {
+				return err
+			}
+		}
+	}
+	if err := recordReader.Err(); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode parquet file %s: %w", key, err)
+	}
+	return nil
+}
+
+// parquetValue returns the value at row r of a column, keeping decimals
+// exact
+func parquetValue(col arrow.Array, r int) interface{} {
+	switch col := col.(type) {
+	case *array.Decimal128:
+		scale := col.DataType().(*arrow.Decimal128Type).Scale
+		return decimalRat(col.Value(r).BigInt(), scale)
+	case *array.Decimal256:
+		scale := col.DataType().(*arrow.Decimal256Type).Scale
+		return decimalRat(col.Value(r).BigInt(), scale)
+	}
+	return col.GetOneForMarshal(r)
+}
+
+// decimalRat returns unscaled × 10^-scale
+func decimalRat(unscaled *big.Int, scale int32) *big.Rat {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	return new(big.Rat).SetFrac(unscaled, pow)
+}
+
+// parseS3URI splits s3://bucket/key into its bucket and key
+func parseS3URI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid s3 uri: %s", uri)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid s3 uri: %s", uri)
+	}
+	return bucket, key, nil
+}
+
+// csvReader reads the CSV dialect Athena writes: every value is enclosed in
+// double quotes and NULL is written as an empty unquoted field. Unlike
+// encoding/csv it keeps that distinction by returning nil for NULL fields.
+type csvReader struct {
+	r *bufio.Reader
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	return &csvReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Read returns the next record, or io.EOF when the input is exhausted
+func (c *csvReader) Read() ([]*string, error) {
+	var record []*string
+	for {
+		value, end, err := c.readField()
+		if err != nil {
+			if err == io.EOF && (record != nil || value != nil) {
+				return append(record, value), nil
+			}
+			return nil, err
+		}
+		record = append(record, value)
+		if end {
+			return record, nil
+		}
+	}
+}
+
+// readField reads one field and reports whether it ended the record
+func (c *csvReader) readField() (*string, bool, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if b != '"' {
+		// Unquoted field: NULL when empty, otherwise taken verbatim
+		var sb strings.Builder
+		for {
+			switch b {
+			case ',':
+				return unquoted(sb.String()), false, nil
+			case '\n':
+				return unquoted(strings.TrimSuffix(sb.String(), "\r")), true, nil
+			}
+			sb.WriteByte(b)
+			if b, err = c.r.ReadByte(); err != nil {
+				if err == io.EOF {
+					return unquoted(sb.String()), true, nil
+				}
+				return nil, false, err
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil, false, errors.New("unterminated quoted field")
+			}
+			return nil, false, err
+		}
+		if b != '"' {
+			sb.WriteByte(b)
+			continue
+		}
+
+		next, err := c.r.ReadByte()
+		if err == io.EOF {
+			value := sb.String()
+			return &value, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch next {
+		case '"':
+			sb.WriteByte('"')
+		case ',':
+			value := sb.String()
+			return &value, false, nil
+		case '\r':
+			if after, _ := c.r.ReadByte(); after != '\n' {
+				c.r.UnreadByte()
+			}
+			value := sb.String()
+			return &value, true, nil
+		case '\n':
+			value := sb.String()
+			return &value, true, nil
+		default:
+			return nil, false, fmt.Errorf("unexpected character %q after quoted field", next)
+		}
+	}
+}
+
+func unquoted(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
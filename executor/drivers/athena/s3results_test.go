@@ -0,0 +1,80 @@
+package athena
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// str returns a pointer to s, for the non-NULL fields of a record
+func str(s string) *string {
+	return &s
+}
+
+func TestCSVReader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want [][]*string
+	}{
+		{"quoted values", "\"a\",\"b\"\n\"1\",\"2\"\n", [][]*string{{str("a"), str("b")}, {str("1"), str("2")}}},
+		{"null is an empty unquoted field", "\"1\",,\"3\"\n", [][]*string{{str("1"), nil, str("3")}}},
+		{"empty string is quoted", "\"\",\"x\"\n", [][]*string{{str(""), str("x")}}},
+		{"trailing null", "\"1\",\n", [][]*string{{str("1"), nil}}},
+		{"leading null", ",\"2\"\n", [][]*string{{nil, str("2")}}},
+		{"escaped quote", "\"say \"\"hi\"\"\"\n", [][]*string{{str(`say "hi"`)}}},
+		{"comma and newline in a value", "\"a,b\",\"c\nd\"\n", [][]*string{{str("a,b"), str("c\nd")}}},
+		{"crlf line endings", "\"1\",\"2\"\r\n\"3\",\r\n", [][]*string{{str("1"), str("2")}, {str("3"), nil}}},
+		{"no final newline", "\"1\",\"2\"", [][]*string{{str("1"), str("2")}}},
+		{"unquoted value", "1,2\n", [][]*string{{str("1"), str("2")}}},
+		{"empty input", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCSVReader(strings.NewReader(tt.in))
+			var got [][]*string
+			for {
+				record, err := r.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Read: %v", err)
+				}
+				got = append(got, record)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read %s, want %s", format(got), format(tt.want))
+			}
+		})
+	}
+}
+
+func TestCSVReaderErrors(t *testing.T) {
+	for _, in := range []string{"\"abc", "\"a\"b\n"} {
+		if _, err := newCSVReader(strings.NewReader(in)).Read(); err == nil || err == io.EOF {
+			t.Errorf("Read(%q) = %v, want a parse error", in, err)
+		}
+	}
+}
+
+// format renders records with NULL fields spelled out
+func format(records [][]*string) string {
+	var sb strings.Builder
+	for _, record := range records {
+		sb.WriteString("[")
+		for i, v := range record {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			if v == nil {
+				sb.WriteString("NULL")
+			} else {
+				sb.WriteString("\"" + *v + "\"")
+			}
+		}
+		sb.WriteString("]")
+	}
+	return sb.String()
+}
@@ -4,6 +4,19 @@ package bigquery
 import (
 	"encoding/json"
 	"fmt"
+
+	driver "supalytics-executor/driver"
+)
+
+// Script result selection modes
+const (
+	// ScriptResultFinal streams the script's own result, which BigQuery
+	// defines as the result of its last statement
+	ScriptResultFinal = "final"
+	// ScriptResultLastSelect streams the last SELECT statement of the script
+	ScriptResultLastSelect = "last_select"
+	// ScriptResultFirstSelect streams the first SELECT statement of the script
+	ScriptResultFirstSelect = "first_select"
 )
 
 // Config holds BigQuery-specific configuration
@@ -14,6 +27,31 @@ type Config struct {
 	KeyFile        string `json:"key_file,omitempty"`    // Path to credentials file
 	Location       string `json:"location,omitempty"`    // e.g., "US", "EU"
 	MaxBillingTier int    `json:"max_billing_tier,omitempty"`
+	ScriptResult   string `json:"script_result,omitempty"` // final (default), last_select or first_select
+	NestedFields   string `json:"nested_fields,omitempty"` // json (default), flatten or explode; see NestedJSON
+
+	// Labels tag every job the connector runs, alongside the organization
+	// and query labels the executor adds
+	Labels map[string]string `json:"labels,omitempty"`
+	// Priority runs the connector's jobs as interactive (default) or batch
+	// queries; requests may override it
+	Priority string `json:"priority,omitempty"`
+	// MaximumBytesBilled fails queries that would bill more bytes, so a
+	// runaway query costs nothing; requests may lower it
+	MaximumBytesBilled int64 `json:"maximum_bytes_billed,omitempty"`
+
+	// Proxy routes Google API traffic through a SOCKS5 or HTTP proxy
+	Proxy *driver.ProxyConfig `json:"proxy,omitempty"`
+
+	// Endpoint replaces the BigQuery API endpoint, e.g. with an emulator's.
+	// Without credentials or key_file requests to it are unauthenticated.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// ImpersonateServiceAccount is a service account email whose short-lived
+	// tokens are minted with the configured or, when credentials and
+	// key_file are omitted, the ambient credentials (GKE workload identity,
+	// the metadata server, ...)
+	ImpersonateServiceAccount string `json:"impersonate_service_account,omitempty"`
 }
 
 // FromJSON creates a Config from JSON data
@@ -30,8 +68,48 @@ func FromJSON(data json.RawMessage) (*Config, error) {
 	if config.Dataset == "" {
 		return nil, fmt.Errorf("dataset is required")
 	}
-	if config.Credentials == "" && config.KeyFile == "" {
-		return nil, fmt.Errorf("either credentials or key_file must be provided")
+	// Without credentials or key_file, Application Default Credentials are used
+	if config.Credentials != "" && config.KeyFile != "" {
+		return nil, fmt.Errorf("only one of credentials or key_file may be provided")
+	}
+
+	if config.ScriptResult == "" {
+		config.ScriptResult = ScriptResultFinal
+	}
+	switch config.ScriptResult {
+	case ScriptResultFinal, ScriptResultLastSelect, ScriptResultFirstSelect:
+	default:
+		return nil, fmt.Errorf("invalid script_result: %s", config.ScriptResult)
+	}
+
+	if config.NestedFields == "" {
+		config.NestedFields = NestedJSON
+	}
+	switch config.NestedFields {
+	case NestedJSON, NestedFlatten, NestedExplode:
+	default:
+		return nil, fmt.Errorf("invalid nested_fields: %s", config.NestedFields)
+	}
+
+	if config.Priority == "" {
+		config.Priority = driver.JobPriorityInteractive
+	}
+	switch config.Priority {
+	case driver.JobPriorityInteractive, driver.JobPriorityBatch:
+	default:
+		return nil, fmt.Errorf("invalid priority: %s", config.Priority)
+	}
+	if config.MaximumBytesBilled < 0 {
+		return nil, fmt.Errorf("maximum_bytes_billed must not be negative")
+	}
+	for key, value := range config.Labels {
+		if err := driver.ValidateLabel(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Proxy.Validate(); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
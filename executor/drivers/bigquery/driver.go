@@ -3,10 +3,13 @@ package bigquery
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
+	"sync"
 
 	driver "supalytics-executor/driver"
 
@@ -14,15 +17,27 @@ import (
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
+	"google.golang.org/api/impersonate"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 type Driver struct {
 	driver.BaseDriver
+	driver.ProgressTracker
 	client  *bigquery.Client
 	config  *Config
 	dataset *bigquery.Dataset
+
+	timezone string // default time zone of the queries' time functions
+
+	// jobs sets up the query jobs: the connector's labels, priority and
+	// maximum bytes billed, as ConfigureJobs changed them
+	jobs driver.JobOptions
+
+	mu      sync.Mutex
+	waiting *bigquery.Job // the job wait polls, for Cancel
 }
 
 func init() {
@@ -34,7 +49,15 @@ func New(config json.RawMessage) (driver.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Driver{config: cfg}, nil
+	labels := make(map[string]string, len(cfg.Labels))
+	for key, value := range cfg.Labels {
+		labels[key] = value
+	}
+	return &Driver{config: cfg, jobs: driver.JobOptions{
+		Labels:         labels,
+		Priority:       cfg.Priority,
+		MaxBytesBilled: cfg.MaximumBytesBilled,
+	}}, nil
 }
 
 func (d *Driver) Connect(ctx context.Context) error {
@@ -46,10 +69,40 @@ func (d *Driver) Connect(ctx context.Context) error {
 		opts = append(opts, option.WithCredentialsFile(d.config.KeyFile))
 	}
 
-	if d.config.Location != "" {
+	if d.config.ImpersonateServiceAccount != "" {
+		// The credentials above only mint tokens for the impersonated account
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: d.config.ImpersonateServiceAccount,
+			Scopes:          []string{bigquery.Scope},
+		}, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to impersonate %s: %w", d.config.ImpersonateServiceAccount, err)
+		}
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+
+	if d.config.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(d.config.Endpoint))
+		if d.config.Credentials == "" && d.config.KeyFile == "" && d.config.ImpersonateServiceAccount == "" {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	} else if d.config.Location != "" {
 		opts = append(opts, option.WithEndpoint(fmt.Sprintf("https://bigquery.%s.googleapis.com", strings.ToLower(d.config.Location))))
 	}
 
+	if d.config.Proxy != nil {
+		base, err := d.config.Proxy.HTTPTransport()
+		if err != nil {
+			return err
+		}
+		// Wrap the proxied transport with the credentials configured above
+		transport, err := htransport.NewTransport(ctx, base, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create bigquery transport: %w", err)
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+
 	client, err := bigquery.NewClient(ctx, d.config.ProjectID, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create bigquery client: %w", err)
@@ -60,13 +113,55 @@ func (d *Driver) Connect(ctx context.Context) error {
 	return nil
 }
 
+// Query runs the query with args bound as query parameters. Plain values
+// bind positionally to ? placeholders; sql.NamedArg values bind to @name.
 func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
-	query = replaceQueryPlaceholders(query, args...)
+	job, err := d.run(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err = d.resultJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driver.QueryResult{
+		Stream: d.streamResults(ctx, job),
+	}, nil
+}
+
+// Execute runs a statement to completion, discarding any result
+func (d *Driver) Execute(ctx context.Context, query string, args ...interface{}) error {
+	_, err := d.run(ctx, query, args...)
+	return err
+}
+
+// RunsScripts reports that BigQuery executes multi-statement scripts natively
+func (d *Driver) RunsScripts() bool {
+	return true
+}
+
+// run submits the query job and waits for it to finish
+func (d *Driver) run(ctx context.Context, query string, args ...interface{}) (*bigquery.Job, error) {
+	params, err := queryParameters(args)
+	if err != nil {
+		return nil, err
+	}
 
 	q := d.client.Query(query)
+	q.Parameters = params
 	if d.config.MaxBillingTier > 0 {
 		q.MaxBillingTier = d.config.MaxBillingTier
 	}
+	q.Labels = d.jobs.Labels
+	q.MaxBytesBilled = d.jobs.MaxBytesBilled
+	if d.jobs.Priority == driver.JobPriorityBatch {
+		q.Priority = bigquery.BatchPriority
+	}
+	if d.timezone != "" {
+		q.ConnectionProperties = []*bigquery.ConnectionProperty{{Key: "time_zone", Value: d.timezone}}
+	}
 
 	// Run the query
 	job, err := q.Run(ctx)
@@ -74,7 +169,7 @@ func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (
 		return nil, fmt.Errorf("failed to run query: %w", err)
 	}
 
-	status, err := job.Wait(ctx)
+	status, err := d.wait(ctx, job)
 	if err != nil {
 		return nil, fmt.Errorf("failed to wait for job: %w", err)
 	}
@@ -82,10 +177,150 @@ func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (
 	if err := status.Err(); err != nil {
 		return nil, fmt.Errorf("query failed: %w", err)
 	}
+	return job, nil
+}
 
-	return &driver.QueryResult{
-		Stream: d.streamResults(ctx, job),
-	}, nil
+// wait polls the job until it is done, recording its progress
+func (d *Driver) wait(ctx context.Context, job *bigquery.Job) (*bigquery.JobStatus, error) {
+	d.mu.Lock()
+	d.waiting = job
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.waiting = nil
+		d.mu.Unlock()
+	}()
+
+	for {
+		status, err := job.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if status.Statistics != nil {
+			d.SetProgress(jobProgress(status.Statistics))
+		}
+		if status.Done() {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Cancel requests the cancellation of the job the driver is waiting for,
+// which BigQuery otherwise runs to completion however long it takes
+func (d *Driver) Cancel(ctx context.Context) error {
+	d.mu.Lock()
+	job := d.waiting
+	d.mu.Unlock()
+	if job == nil {
+		return nil
+	}
+	if err := job.Cancel(ctx); err != nil {
+		return fmt.Errorf("failed to cancel job: %w", err)
+	}
+	return nil
+}
+
+// jobProgress estimates progress from the latest timeline sample, which
+// counts the parallel units of work completed and still to do
+func jobProgress(stats *bigquery.JobStatistics) driver.Progress {
+	progress := driver.Progress{BytesScanned: stats.TotalBytesProcessed}
+	query, ok := stats.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return progress
+	}
+	if query.TotalBytesProcessed > progress.BytesScanned {
+		progress.BytesScanned = query.TotalBytesProcessed
+	}
+	progress.BytesBilled = query.TotalBytesBilled
+	if len(query.Timeline) == 0 {
+		return progress
+	}
+
+	sample := query.Timeline[len(query.Timeline)-1]
+	if total := sample.CompletedUnits + sample.ActiveUnits + sample.PendingUnits; total > 0 {
+		progress.Fraction = float64(sample.CompletedUnits) / float64(total)
+	}
+	return progress
+}
+
+// resultJob picks the job whose results are streamed. For scripts this may
+// be one of the child jobs, depending on the script_result setting.
+func (d *Driver) resultJob(ctx context.Context, job *bigquery.Job) (*bigquery.Job, error) {
+	if d.config.ScriptResult == ScriptResultFinal {
+		return job, nil
+	}
+	if status := job.LastStatus(); status == nil || status.Statistics == nil || status.Statistics.NumChildJobs == 0 {
+		return job, nil
+	}
+
+	// Child jobs are listed newest first
+	var selected *bigquery.Job
+	it := job.Children(ctx)
+	for {
+		child, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list script jobs: %w", err)
+		}
+		if !isSelect(child) {
+			continue
+		}
+		selected = child
+		if d.config.ScriptResult == ScriptResultLastSelect {
+			break
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("script has no SELECT statement to return results from")
+	}
+	return selected, nil
+}
+
+func isSelect(job *bigquery.Job) bool {
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return false
+	}
+	stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	return ok && stats.StatementType == "SELECT"
+}
+
+// queryParameters converts driver arguments to BigQuery query parameters.
+// Positional and named parameters cannot be mixed in one query.
+func queryParameters(args []interface{}) ([]bigquery.QueryParameter, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	params := make([]bigquery.QueryParameter, len(args))
+	named := 0
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case bigquery.QueryParameter:
+			params[i] = v
+		case sql.NamedArg:
+			params[i] = bigquery.QueryParameter{Name: v.Name, Value: v.Value}
+		default:
+			params[i] = bigquery.QueryParameter{Value: v}
+		}
+		if params[i].Name != "" {
+			named++
+		}
+	}
+
+	if named != 0 && named != len(params) {
+		return nil, fmt.Errorf("cannot mix named and positional query parameters")
+	}
+	return params, nil
 }
 
 func (d *Driver) streamResults(ctx context.Context, job *bigquery.Job) driver.RowStream {
@@ -95,39 +330,82 @@ func (d *Driver) streamResults(ctx context.Context, job *bigquery.Job) driver.Ro
 			return fmt.Errorf("failed to read results: %w", err)
 		}
 
-		// Get and yield schema first
-		schema := it.Schema
-		columns := make([]string, len(schema))
-		for i, field := range schema {
-			columns[i] = field.Name
+		// Fetch the first page so the schema is populated, then yield it
+		var values []bigquery.Value
+		err = it.Next(&values)
+		if err != nil && err != iterator.Done {
+			return fmt.Errorf("failed to read row: %w", err)
+		}
+
+		resultColumns := d.resultColumns(it.Schema)
+		columns := make([]string, len(resultColumns))
+		for i, c := range resultColumns {
+			columns[i] = c.name
+		}
+		d.SetColumnInfo(describeColumns(resultColumns))
+		if err := yield(columns, nil); err != nil {
+			return err
 		}
 
 		// Stream rows
-		for {
-			var values []bigquery.Value
-			err := it.Next(&values)
-			if err == iterator.Done {
-				break
+		for err != iterator.Done {
+			for _, row := range d.resultRows(it.Schema, values) {
+				if err := yield(nil, row); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
 			}
-			if err != nil {
+
+			values = nil
+			err = it.Next(&values)
+			if err != nil && err != iterator.Done {
 				return fmt.Errorf("failed to read row: %w", err)
 			}
+		}
 
-			row := make([]interface{}, len(values))
-			for i, v := range values {
-				row[i] = convertBigQueryValue(v)
-			}
+		return nil
+	}
+}
 
-			if err := yield(columns, row); err != nil {
-				if err == io.EOF {
-					return nil
-				}
-				return err
-			}
+// SetTimezone makes the time zone the default of the time functions of the
+// queries run after it, as the session's @@time_zone does
+func (d *Driver) SetTimezone(ctx context.Context, name string) error {
+	d.timezone = name
+	return nil
+}
+
+// ConfigureJobs adds labels to the jobs of the queries run after it, and
+// sets their priority or lowers their maximum bytes billed
+func (d *Driver) ConfigureJobs(opts driver.JobOptions) error {
+	switch opts.Priority {
+	case "":
+	case driver.JobPriorityInteractive, driver.JobPriorityBatch:
+		d.jobs.Priority = opts.Priority
+	default:
+		return fmt.Errorf("invalid job priority: %s", opts.Priority)
+	}
+	for key, value := range opts.Labels {
+		if err := driver.ValidateLabel(key, value); err != nil {
+			return err
 		}
+	}
+	for key, value := range opts.Labels {
+		d.jobs.Labels[key] = value
+	}
+	if opts.MaxBytesBilled > 0 && (d.jobs.MaxBytesBilled == 0 || opts.MaxBytesBilled < d.jobs.MaxBytesBilled) {
+		d.jobs.MaxBytesBilled = opts.MaxBytesBilled
+	}
+	return nil
+}
 
-		return nil
+// Ping checks the credentials can read the configured dataset
+func (d *Driver) Ping(ctx context.Context) error {
+	if _, err := d.dataset.Metadata(ctx); err != nil {
+		return fmt.Errorf("failed to read dataset %s: %w", d.config.Dataset, err)
 	}
+	return nil
 }
 
 func (d *Driver) Close() error {
@@ -137,20 +415,6 @@ func (d *Driver) Close() error {
 	return nil
 }
 
-// replaceQueryPlaceholders replaces ? with actual values
-func replaceQueryPlaceholders(query string, args ...interface{}) string {
-	for _, arg := range args {
-		switch v := arg.(type) {
-		case string:
-			query = strings.Replace(query, "?", fmt.Sprintf("'%s'", v), 1)
-		default:
-			query = strings.Replace(query, "?", fmt.Sprint(v), 1)
-		}
-	}
-	return query
-}
-
-// convertBigQueryValue converts BigQuery values to standard Go types
 // convertBigQueryValue converts BigQuery values to standard Go types
 func convertBigQueryValue(v bigquery.Value) interface{} {
 	switch v := v.(type) {
@@ -166,3 +430,22 @@ func convertBigQueryValue(v bigquery.Value) interface{} {
 		return v
 	}
 }
+
+// numericScale returns the scale of a NUMERIC or BIGNUMERIC field: the one
+// it was declared with, or the type's default of 9 or 38 places
+func numericScale(field *bigquery.FieldSchema) *int {
+	var scale int
+	switch {
+	case field.Repeated:
+		return nil
+	case field.Scale > 0:
+		scale = int(field.Scale)
+	case field.Type == bigquery.NumericFieldType:
+		scale = 9
+	case field.Type == bigquery.BigNumericFieldType:
+		scale = 38
+	default:
+		return nil
+	}
+	return &scale
+}
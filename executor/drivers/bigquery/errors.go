@@ -0,0 +1,81 @@
+// bigquery/errors.go
+package bigquery
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+
+	driver "supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// ClassifyError describes failed jobs and API errors by their reason, with
+// the line and column a failed query's message points at
+func (d *Driver) ClassifyError(err error) *driver.Error {
+	var jobErr *bigquery.Error
+	if errors.As(err, &jobErr) {
+		line, column := driver.LineColumn(jobErr.Message)
+		return &driver.Error{
+			Code:   reasonCode(jobErr.Reason, jobErr.Message, 0),
+			Engine: protocol.EngineError{Code: jobErr.Reason, Line: line, Column: column},
+			Err:    err,
+		}
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		reason, message := "", apiErr.Message
+		if len(apiErr.Errors) > 0 {
+			reason, message = apiErr.Errors[0].Reason, apiErr.Errors[0].Message
+		}
+		line, column := driver.LineColumn(message)
+		return &driver.Error{
+			Code:   reasonCode(reason, message, apiErr.Code),
+			Engine: protocol.EngineError{Code: reason, Line: line, Column: column},
+			Err:    err,
+		}
+	}
+	return nil
+}
+
+// reasonCode returns the protocol error code of a BigQuery error reason,
+// https://cloud.google.com/bigquery/docs/error-messages, falling back on
+// the HTTP status of API errors without one
+func reasonCode(reason, message string, status int) string {
+	switch reason {
+	case "invalidQuery":
+		switch {
+		case strings.HasPrefix(message, "Syntax error"):
+			return protocol.ErrorCodeSyntax
+		case strings.HasPrefix(message, "Unrecognized name"),
+			strings.HasPrefix(message, "Function not found"),
+			strings.Contains(message, "was not found"):
+			return protocol.ErrorCodeObjectNotFound
+		}
+		return protocol.ErrorCodeEngine
+	case "notFound":
+		return protocol.ErrorCodeObjectNotFound
+	case "accessDenied":
+		return protocol.ErrorCodePermissionDenied
+	case "rateLimitExceeded", "quotaExceeded":
+		return protocol.ErrorCodeRateLimited
+	case "bytesBilledLimitExceeded", "billingTierLimitExceeded":
+		return protocol.ErrorCodeBillingLimitExceeded
+	case "stopped":
+		return protocol.ErrorCodeCancelled
+	case "timeout":
+		return protocol.ErrorCodeTimeout
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return protocol.ErrorCodePermissionDenied
+	case http.StatusNotFound:
+		return protocol.ErrorCodeObjectNotFound
+	case http.StatusTooManyRequests:
+		return protocol.ErrorCodeRateLimited
+	}
+	return protocol.ErrorCodeEngine
+}
@@ -0,0 +1,157 @@
+// bigquery/nested.go
+package bigquery
+
+import (
+	"cloud.google.com/go/bigquery"
+
+	driver "supalytics-executor/driver"
+)
+
+// How RECORD and REPEATED columns are streamed, for Config.NestedFields
+const (
+	// NestedJSON streams each top-level field as one column, records as
+	// objects keyed by field name and repeated fields as arrays
+	NestedJSON = "json"
+	// NestedFlatten streams each field of a record as its own column named
+	// by its dotted path, e.g. "address.city". Repeated fields stay arrays.
+	NestedFlatten = "flatten"
+	// NestedExplode flattens records and streams a row per element of each
+	// repeated field, as a LEFT JOIN UNNEST would: a row with several
+	// repeated fields becomes the cross product of their elements, and one
+	// with an empty array keeps a single row with nulls in its place.
+	NestedExplode = "explode"
+)
+
+// column is a streamed column and the field its values come from
+type column struct {
+	name     string
+	field    *bigquery.FieldSchema
+	nullable bool
+}
+
+// resultColumns lists the columns a result with the schema is streamed as
+func (d *Driver) resultColumns(schema bigquery.Schema) []column {
+	return schemaColumns(schema, "", false, d.config.NestedFields)
+}
+
+func schemaColumns(schema bigquery.Schema, prefix string, nullable bool, mode string) []column {
+	var columns []column
+	for _, field := range schema {
+		name, inherited := prefix+field.Name, nullable
+		if mode == NestedExplode && field.Repeated {
+			// An element of an exploded field stands in for the field, and
+			// an empty array leaves it null
+			element := *field
+			element.Repeated = false
+			field, inherited = &element, true
+		}
+		// Repeated fields hold an empty array rather than a null
+		fieldNullable := inherited || (!field.Required && !field.Repeated)
+		if mode != NestedJSON && field.Type == bigquery.RecordFieldType && !field.Repeated {
+			columns = append(columns, schemaColumns(field.Schema, name+".", fieldNullable, mode)...)
+			continue
+		}
+		columns = append(columns, column{name: name, field: field, nullable: fieldNullable})
+	}
+	return columns
+}
+
+// describeColumns returns what the schema declares about the columns
+func describeColumns(columns []column) map[string]driver.ColumnInfo {
+	described := make(map[string]driver.ColumnInfo, len(columns))
+	for _, c := range columns {
+		nullable := c.nullable
+		described[c.name] = driver.ColumnInfo{Nullable: &nullable, Scale: numericScale(c.field)}
+	}
+	return described
+}
+
+// resultRows converts a row of the schema to the rows streamed for it: one,
+// or one per combination of repeated elements when they are exploded
+func (d *Driver) resultRows(schema bigquery.Schema, values []bigquery.Value) [][]interface{} {
+	return recordRows(schema, values, d.config.NestedFields)
+}
+
+func recordRows(schema bigquery.Schema, values []bigquery.Value, mode string) [][]interface{} {
+	rows := [][]interface{}{{}}
+	for i, field := range schema {
+		var v bigquery.Value
+		if i < len(values) {
+			v = values[i]
+		}
+		parts := fieldRows(field, v, mode)
+		joined := make([][]interface{}, 0, len(rows)*len(parts))
+		for _, row := range rows {
+			for _, part := range parts {
+				joined = append(joined, append(row[:len(row):len(row)], part...))
+			}
+		}
+		rows = joined
+	}
+	return rows
+}
+
+// fieldRows returns the partial rows a field's value contributes, each as
+// wide as the columns the field is streamed as
+func fieldRows(field *bigquery.FieldSchema, v bigquery.Value, mode string) [][]interface{} {
+	switch {
+	case mode == NestedExplode && field.Repeated:
+		element := *field
+		element.Repeated = false
+		items, _ := v.([]bigquery.Value)
+		if len(items) == 0 {
+			return [][]interface{}{nulls(&element, mode)}
+		}
+		var rows [][]interface{}
+		for _, item := range items {
+			rows = append(rows, fieldRows(&element, item, mode)...)
+		}
+		return rows
+	case mode != NestedJSON && field.Type == bigquery.RecordFieldType && !field.Repeated:
+		values, ok := v.([]bigquery.Value)
+		if !ok {
+			return [][]interface{}{nulls(field, mode)}
+		}
+		return recordRows(field.Schema, values, mode)
+	}
+	return [][]interface{}{{nestedValue(field, v)}}
+}
+
+// nulls returns a partial row of nulls for a field
+func nulls(field *bigquery.FieldSchema, mode string) []interface{} {
+	return make([]interface{}, len(schemaColumns(bigquery.Schema{field}, "", true, mode)))
+}
+
+// nestedValue converts a value to nested JSON: records to objects keyed by
+// field name and repeated fields to arrays
+func nestedValue(field *bigquery.FieldSchema, v bigquery.Value) interface{} {
+	if v == nil {
+		return nil
+	}
+	if field.Repeated {
+		element := *field
+		element.Repeated = false
+		items, _ := v.([]bigquery.Value)
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			out[i] = nestedValue(&element, item)
+		}
+		return out
+	}
+	if field.Type == bigquery.RecordFieldType {
+		values, ok := v.([]bigquery.Value)
+		if !ok {
+			return convertBigQueryValue(v)
+		}
+		out := make(map[string]interface{}, len(field.Schema))
+		for i, sub := range field.Schema {
+			var item bigquery.Value
+			if i < len(values) {
+				item = values[i]
+			}
+			out[sub.Name] = nestedValue(sub, item)
+		}
+		return out
+	}
+	return convertBigQueryValue(v)
+}
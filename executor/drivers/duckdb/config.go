@@ -0,0 +1,63 @@
+// duckdb/config.go
+package duckdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Config holds the settings of an embedded DuckDB database
+type Config struct {
+	// Path is the database file to open; empty opens a private in-memory
+	// database that is discarded when the driver closes
+	Path string `json:"path,omitempty"`
+	// Threads bounds the threads a query uses; zero uses every core
+	Threads int `json:"threads,omitempty"`
+	// MemoryLimit bounds the memory the engine uses, e.g. "1GB"; empty
+	// uses DuckDB's default of 80% of the system's memory
+	MemoryLimit string `json:"memory_limit,omitempty"`
+}
+
+// FromJSON creates a Config from JSON data. An empty config opens an
+// in-memory database.
+func FromJSON(data json.RawMessage) (*Config, error) {
+	var config Config
+	if len(data) == 0 {
+		return &config, nil
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse duckdb config: %w", err)
+	}
+
+	if config.Threads < 0 {
+		return nil, fmt.Errorf("threads must be >= 0")
+	}
+
+	return &config, nil
+}
+
+// ToJSON converts Config to JSON
+func (c *Config) ToJSON() (json.RawMessage, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal duckdb config: %w", err)
+	}
+	return data, nil
+}
+
+// BuildDSN builds the DSN go-duckdb opens the database with
+func (c *Config) BuildDSN() string {
+	params := url.Values{}
+	if c.Threads > 0 {
+		params.Set("threads", strconv.Itoa(c.Threads))
+	}
+	if c.MemoryLimit != "" {
+		params.Set("memory_limit", c.MemoryLimit)
+	}
+	if len(params) == 0 {
+		return c.Path
+	}
+	return c.Path + "?" + params.Encode()
+}
@@ -0,0 +1,322 @@
+// duckdb/driver.go
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+
+	driver "supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// Driver runs queries on an embedded DuckDB database. In memory it serves
+// as the engine composite queries join the results of other connectors in.
+type Driver struct {
+	driver.BaseDriver
+	config *Config
+	conn   *sql.Conn
+}
+
+func init() {
+	driver.Register(driver.DuckDBType, New)
+}
+
+func New(config json.RawMessage) (driver.Driver, error) {
+	cfg, err := FromJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Driver{config: cfg}, nil
+}
+
+// Connect opens the database and the session every statement runs on, so
+// tables loaded by LoadTable are visible to the queries that follow
+func (d *Driver) Connect(ctx context.Context) error {
+	connector, err := duckdb.NewConnector(d.config.BuildDSN(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to open duckdb: %w", err)
+	}
+	d.DB = sql.OpenDB(connector)
+
+	conn, err := d.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to duckdb: %w", err)
+	}
+	d.conn = conn
+	return nil
+}
+
+func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
+	rows, err := d.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+	d.SetColumnInfo(describeColumns(rows))
+
+	return &driver.QueryResult{
+		Columns: columns,
+		Stream: func(yield func(columns []string, row []interface{}) error) error {
+			defer rows.Close()
+			if err := yield(columns, nil); err != nil {
+				return err
+			}
+
+			values := make([]interface{}, len(columns))
+			scanArgs := make([]interface{}, len(columns))
+			for i := range values {
+				scanArgs[i] = &values[i]
+			}
+			for rows.Next() {
+				if err := rows.Scan(scanArgs...); err != nil {
+					return fmt.Errorf("failed to scan row: %w", err)
+				}
+				row := make([]interface{}, len(columns))
+				for i, v := range values {
+					row[i] = convertValue(v)
+				}
+				if err := yield(nil, row); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+			}
+			return rows.Err()
+		},
+	}, nil
+}
+
+// Execute runs a statement without reading a result set
+func (d *Driver) Execute(ctx context.Context, query string, args ...interface{}) error {
+	_, err := d.conn.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Ping checks the database is open
+func (d *Driver) Ping(ctx context.Context) error {
+	return d.conn.PingContext(ctx)
+}
+
+// LoadTable creates the table name and appends rows to it. Each column
+// takes the narrowest type holding all of its values: BOOLEAN, BIGINT,
+// DOUBLE, TIMESTAMP or VARCHAR, with nested values stored as JSON text.
+func (d *Driver) LoadTable(ctx context.Context, name string, columns []string, rows driver.RowSource) error {
+	types, err := columnTypes(rows, len(columns))
+	if err != nil {
+		return fmt.Errorf("load %s: %w", name, err)
+	}
+	defs := make([]string, len(columns))
+	for i, column := range columns {
+		defs[i] = quoteIdent(column) + " " + types[i]
+	}
+	create := fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(name), strings.Join(defs, ", "))
+	if _, err := d.conn.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("create table %s: %w", name, err)
+	}
+
+	return d.conn.Raw(func(raw interface{}) error {
+		appender, err := duckdb.NewAppenderFromConn(raw.(sqldriver.Conn), "", name)
+		if err != nil {
+			return fmt.Errorf("append to %s: %w", name, err)
+		}
+		values := make([]sqldriver.Value, len(columns))
+		err = rows(func(row []interface{}) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for i, v := range row {
+				values[i] = appendValue(v, types[i])
+			}
+			if err := appender.AppendRow(values...); err != nil {
+				return fmt.Errorf("append to %s: %w", name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			appender.Close()
+			return err
+		}
+		if err := appender.Close(); err != nil {
+			return fmt.Errorf("append to %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+func (d *Driver) Close() error {
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	return d.BaseDriver.Close()
+}
+
+// quoteIdent quotes a table or column name
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// columnTypes picks the type of each loaded column from its non-null values
+func columnTypes(rows driver.RowSource, columns int) ([]string, error) {
+	types := make([]string, columns)
+	err := rows(func(row []interface{}) error {
+		for i, v := range row {
+			if v == nil {
+				continue
+			}
+			typ, next := types[i], valueType(v)
+			switch {
+			case typ == "" || typ == next:
+				types[i] = next
+			case (typ == "BIGINT" && next == "DOUBLE") || (typ == "DOUBLE" && next == "BIGINT"):
+				types[i] = "DOUBLE"
+			default:
+				types[i] = "VARCHAR"
+			}
+		}
+		return nil
+	})
+	for i, typ := range types {
+		if typ == "" {
+			types[i] = "VARCHAR"
+		}
+	}
+	return types, err
+}
+
+// valueType is the type a single value would be loaded as
+func valueType(v interface{}) string {
+	switch v.(type) {
+	case bool:
+		return "BOOLEAN"
+	case time.Time:
+		return "TIMESTAMP"
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "BIGINT"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return "DOUBLE"
+		}
+		return "BIGINT"
+	case reflect.Float32, reflect.Float64:
+		return "DOUBLE"
+	}
+	return "VARCHAR"
+}
+
+// appendValue converts a value to the Go type the appender expects for a
+// column type
+func appendValue(v interface{}, typ string) sqldriver.Value {
+	if v == nil {
+		return nil
+	}
+	switch typ {
+	case "BOOLEAN":
+		return v.(bool)
+	case "TIMESTAMP":
+		return v.(time.Time).UTC()
+	case "BIGINT", "DOUBLE":
+		rv := reflect.ValueOf(v)
+		var f float64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if typ == "BIGINT" {
+				return rv.Int()
+			}
+			f = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if typ == "BIGINT" {
+				return int64(rv.Uint())
+			}
+			f = float64(rv.Uint())
+		default:
+			f = rv.Float()
+		}
+		return f
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case *big.Rat:
+		return protocol.FormatDecimal(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	}
+	if encoded, err := json.Marshal(v); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(v)
+}
+
+// describeColumns returns the scale of the result's DECIMAL columns, which
+// DuckDB only reports in their type names
+func describeColumns(rows *sql.Rows) map[string]driver.ColumnInfo {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil
+	}
+	columns := make(map[string]driver.ColumnInfo)
+	for _, ct := range types {
+		var width, scale int
+		if _, err := fmt.Sscanf(ct.DatabaseTypeName(), "DECIMAL(%d,%d)", &width, &scale); err == nil {
+			columns[ct.Name()] = driver.ColumnInfo{Scale: &scale}
+		}
+	}
+	return columns
+}
+
+// convertValue converts DuckDB values to types that encode cleanly
+func convertValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if v == nil {
+			return nil
+		}
+		return string(v)
+	case duckdb.Decimal:
+		if v.Value == nil {
+			return nil
+		}
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(v.Scale)), nil)
+		return new(big.Rat).SetFrac(v.Value, scale)
+	case *big.Int:
+		if v.IsInt64() {
+			return v.Int64()
+		}
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f
+	case duckdb.Map:
+		// JSON objects need string keys
+		out := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			out[fmt.Sprint(key)] = convertValue(value)
+		}
+		return out
+	case duckdb.Interval:
+		return fmt.Sprintf("%d months %d days %d microseconds", v.Months, v.Days, v.Micros)
+	}
+	return v
+}
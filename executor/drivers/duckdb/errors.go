@@ -0,0 +1,45 @@
+// duckdb/errors.go
+package duckdb
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/marcboeker/go-duckdb"
+
+	driver "supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// ClassifyError describes errors DuckDB raised by their type, with the
+// "Catalog Error" style prefix of their message as the engine's code
+func (d *Driver) ClassifyError(err error) *driver.Error {
+	var duckErr *duckdb.Error
+	if !errors.As(err, &duckErr) {
+		return nil
+	}
+	name, _, _ := strings.Cut(duckErr.Msg, ": ")
+	line, column := driver.LineColumn(duckErr.Msg)
+	return &driver.Error{
+		Code:   errorTypeCode(duckErr),
+		Engine: protocol.EngineError{Code: name, Line: line, Column: column},
+		Err:    err,
+	}
+}
+
+// errorTypeCode returns the protocol error code of a DuckDB error type
+func errorTypeCode(duckErr *duckdb.Error) string {
+	switch duckErr.Type {
+	case duckdb.ErrorTypeParser, duckdb.ErrorTypeSyntax:
+		return protocol.ErrorCodeSyntax
+	case duckdb.ErrorTypeCatalog, duckdb.ErrorTypeBinder:
+		if strings.Contains(duckErr.Msg, "does not exist") || strings.Contains(duckErr.Msg, "not found") {
+			return protocol.ErrorCodeObjectNotFound
+		}
+	case duckdb.ErrorTypePermission:
+		return protocol.ErrorCodePermissionDenied
+	case duckdb.ErrorTypeInterrupt:
+		return protocol.ErrorCodeCancelled
+	}
+	return protocol.ErrorCodeEngine
+}
@@ -0,0 +1,205 @@
+// mock/config.go
+package mock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	driver "supalytics-executor/driver"
+)
+
+// Config holds the fixture a mock connector serves for every query: the
+// rows listed, or those a generator produces
+type Config struct {
+	Columns    []string        `json:"columns"`
+	Rows       [][]interface{} `json:"rows,omitempty"`
+	Generate   *Generator      `json:"generate,omitempty"`
+	RowDelayMS int             `json:"row_delay_ms,omitempty"` // Delay before each row is yielded
+	// HangMS holds back the first row while ignoring cancellation, like an
+	// unresponsive engine; cancelling or closing the driver releases it
+	HangMS int `json:"hang_ms,omitempty"`
+	// ConnectDelayMS holds back connecting, like an engine with a slow
+	// handshake
+	ConnectDelayMS int `json:"connect_delay_ms,omitempty"`
+	// QueryDelayMS holds back the result, like an engine planning the query
+	QueryDelayMS int `json:"query_delay_ms,omitempty"`
+	// BytesScanned is reported as the data every query scans, like the
+	// statistics of a warehouse engine
+	BytesScanned int64 `json:"bytes_scanned,omitempty"`
+	// PingError fails health checks with this message, like an engine that
+	// cannot be reached
+	PingError string `json:"ping_error,omitempty"`
+	// Types gives columns the driver types of a real engine, one per
+	// column: "timestamp" (RFC 3339 text), "date", "numeric" (decimal text)
+	// or "float" (including "NaN" and "Infinity"). Columns without one
+	// yield their values as decoded from JSON.
+	Types []string `json:"types,omitempty"`
+	// Nullable declares whether columns allow nulls, as an engine's result
+	// metadata does; columns left out are undeclared
+	Nullable map[string]bool `json:"nullable,omitempty"`
+	// Scales declares the decimal places of numeric columns, as an
+	// engine's result metadata does for fixed-point types
+	Scales map[string]int `json:"scales,omitempty"`
+	// Fail injects failures, like an engine that is down or a query that
+	// breaks partway through its result
+	Fail *Failure `json:"fail,omitempty"`
+}
+
+// Failure is where a mock connector fails and with what error message.
+// Each failure that is set happens every time, or with Probability.
+type Failure struct {
+	// Connect fails connecting
+	Connect string `json:"connect,omitempty"`
+	// Query fails the query before it returns a result
+	Query string `json:"query,omitempty"`
+	// Stream fails the result after AfterRows rows have streamed
+	Stream    string `json:"stream,omitempty"`
+	AfterRows int64  `json:"after_rows,omitempty"`
+	// Panic panics with the Stream message instead of returning it, like
+	// a driver bug
+	Panic bool `json:"panic,omitempty"`
+	// Probability is the chance, from 0 to 1, each failure happens; 0
+	// means always, so flaky engines can be simulated under load
+	Probability float64 `json:"probability,omitempty"`
+}
+
+// happen returns one of the failure's messages as an error when it
+// happens this time
+func (f *Failure) happen(message string) error {
+	if message == "" {
+		return nil
+	}
+	if f.Probability > 0 && rand.Float64() >= f.Probability {
+		return nil
+	}
+	return errors.New(message)
+}
+
+// raise returns a stream failure, or panics with it for a failure that
+// simulates a driver bug
+func (f *Failure) raise(err error) error {
+	if err != nil && f.Panic {
+		panic(err.Error())
+	}
+	return err
+}
+
+// FromJSON creates a Config from JSON data
+func FromJSON(data json.RawMessage) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse mock config: %w", err)
+	}
+
+	// Validate required fields
+	if len(config.Columns) == 0 {
+		return nil, fmt.Errorf("columns are required")
+	}
+	if config.Generate != nil {
+		if len(config.Rows) > 0 {
+			return nil, fmt.Errorf("only one of rows or generate may be provided")
+		}
+		if len(config.Types) > 0 {
+			return nil, fmt.Errorf("types do not apply to generated rows")
+		}
+		if err := config.Generate.compile(len(config.Columns)); err != nil {
+			return nil, err
+		}
+	}
+	if f := config.Fail; f != nil {
+		if f.AfterRows < 0 {
+			return nil, fmt.Errorf("fail after_rows must be >= 0")
+		}
+		if f.Probability < 0 || f.Probability > 1 {
+			return nil, fmt.Errorf("fail probability must be between 0 and 1")
+		}
+	}
+	for i, row := range config.Rows {
+		if len(row) != len(config.Columns) {
+			return nil, fmt.Errorf("row %d has %d values, expected %d", i, len(row), len(config.Columns))
+		}
+	}
+	if len(config.Types) > len(config.Columns) {
+		return nil, fmt.Errorf("types has %d entries for %d columns", len(config.Types), len(config.Columns))
+	}
+	for i, row := range config.Rows {
+		for j, typ := range config.Types {
+			if _, err := typedValue(typ, row[j]); err != nil {
+				return nil, fmt.Errorf("row %d column %s: %w", i, config.Columns[j], err)
+			}
+		}
+	}
+	for name, scale := range config.Scales {
+		if scale < 0 {
+			return nil, fmt.Errorf("scale of %s must be >= 0", name)
+		}
+	}
+	if config.RowDelayMS < 0 {
+		return nil, fmt.Errorf("row_delay_ms must be >= 0")
+	}
+	if config.HangMS < 0 {
+		return nil, fmt.Errorf("hang_ms must be >= 0")
+	}
+	if config.QueryDelayMS < 0 {
+		return nil, fmt.Errorf("query_delay_ms must be >= 0")
+	}
+	if config.BytesScanned < 0 {
+		return nil, fmt.Errorf("bytes_scanned must be >= 0")
+	}
+
+	return &config, nil
+}
+
+// columnInfo describes the columns the config declares nullability or a
+// scale for
+func (c *Config) columnInfo() map[string]driver.ColumnInfo {
+	if len(c.Nullable) == 0 && len(c.Scales) == 0 {
+		return nil
+	}
+	columns := make(map[string]driver.ColumnInfo, len(c.Nullable))
+	for name, nullable := range c.Nullable {
+		columns[name] = driver.ColumnInfo{Nullable: &nullable}
+	}
+	for name, scale := range c.Scales {
+		info := columns[name]
+		info.Scale = &scale
+		columns[name] = info
+	}
+	return columns
+}
+
+// rowCount is the number of rows the result has
+func (c *Config) rowCount() int64 {
+	if c.Generate != nil {
+		return c.Generate.Count
+	}
+	return int64(len(c.Rows))
+}
+
+// rows returns a function producing the result's rows in order
+func (c *Config) rows() func(index int64) []interface{} {
+	if c.Generate != nil {
+		return c.Generate.rows()
+	}
+	return func(index int64) []interface{} {
+		row := c.Rows[index]
+		out := make([]interface{}, len(row))
+		copy(out, row)
+		for j, typ := range c.Types {
+			// Values were checked when the config was parsed
+			out[j], _ = typedValue(typ, row[j])
+		}
+		return out
+	}
+}
+
+// ToJSON converts Config to JSON
+func (c *Config) ToJSON() (json.RawMessage, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mock config: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,208 @@
+// mock/driver.go
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	driver "supalytics-executor/driver"
+)
+
+// Driver serves rows from its configuration instead of a real database.
+// It ignores the query text, which makes it useful for exercising the
+// WebSocket pipeline without any external dependencies.
+type Driver struct {
+	driver.BaseDriver
+	driver.ProgressTracker
+	config *Config
+	closed chan struct{}
+	once   sync.Once
+
+	cancelled  chan struct{} // closed by Cancel
+	cancelOnce sync.Once
+
+	notifications chan string // set once the driver listens, see Listen
+}
+
+// executions holds async submissions so they can be attached from any
+// driver instance, mirroring an engine that keeps results server side
+var executions sync.Map // execution ID -> *Config
+
+func init() {
+	driver.Register(driver.MockType, New)
+}
+
+func New(config json.RawMessage) (driver.Driver, error) {
+	cfg, err := FromJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Driver{config: cfg, closed: make(chan struct{}), cancelled: make(chan struct{})}, nil
+}
+
+func (d *Driver) Connect(ctx context.Context) error {
+	if d.config.ConnectDelayMS > 0 {
+		timer := time.NewTimer(time.Duration(d.config.ConnectDelayMS) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if f := d.config.Fail; f != nil {
+		if err := f.happen(f.Connect); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.config.QueryDelayMS > 0 {
+		timer := time.NewTimer(time.Duration(d.config.QueryDelayMS) * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if f := d.config.Fail; f != nil {
+		if err := f.happen(f.Query); err != nil {
+			return nil, err
+		}
+	}
+
+	d.SetColumnInfo(d.config.columnInfo())
+	return &driver.QueryResult{
+		Columns: d.config.Columns,
+		Stream:  d.streamResults(ctx),
+	}, nil
+}
+
+// StartQuery records an execution and returns its ID without streaming
+func (d *Driver) StartQuery(ctx context.Context, query string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	id := uuid.NewString()
+	executions.Store(id, d.config)
+	return id, nil
+}
+
+// AttachQuery streams the results of an execution started by StartQuery
+func (d *Driver) AttachQuery(ctx context.Context, executionID string) (*driver.QueryResult, error) {
+	v, ok := executions.Load(executionID)
+	if !ok {
+		return nil, fmt.Errorf("execution %s not found", executionID)
+	}
+	cfg := v.(*Config)
+	d.SetColumnInfo(cfg.columnInfo())
+
+	return &driver.QueryResult{
+		Columns: cfg.Columns,
+		Stream:  streamResults(ctx, cfg, d.closed, d.cancelled, &d.ProgressTracker),
+	}, nil
+}
+
+func (d *Driver) streamResults(ctx context.Context) driver.RowStream {
+	return streamResults(ctx, d.config, d.closed, d.cancelled, &d.ProgressTracker)
+}
+
+// streamResults yields the configured or generated rows, reporting the
+// share yielded so far as progress
+func streamResults(ctx context.Context, cfg *Config, closed, cancelled <-chan struct{}, progress *driver.ProgressTracker) driver.RowStream {
+	return func(yield func(columns []string, row []interface{}) error) error {
+		if err := yield(cfg.Columns, nil); err != nil {
+			return err
+		}
+		// The whole scan is reported up front, as by an engine that
+		// finished the query before returning rows
+		progress.SetProgress(driver.Progress{BytesScanned: cfg.BytesScanned})
+
+		if cfg.HangMS > 0 {
+			timer := time.NewTimer(time.Duration(cfg.HangMS) * time.Millisecond)
+			select {
+			case <-closed:
+				timer.Stop()
+				return errors.New("driver closed")
+			case <-cancelled:
+				timer.Stop()
+				return errors.New("query cancelled")
+			case <-timer.C:
+			}
+		}
+
+		// A stream failure is decided up front, as the query would either
+		// break or not
+		var failure error
+		if f := cfg.Fail; f != nil {
+			failure = f.happen(f.Stream)
+		}
+
+		delay := time.Duration(cfg.RowDelayMS) * time.Millisecond
+		count, rows := cfg.rowCount(), cfg.rows()
+		for i := int64(0); i < count; i++ {
+			if failure != nil && i == cfg.Fail.AfterRows {
+				return cfg.Fail.raise(failure)
+			}
+			progress.SetProgress(driver.Progress{BytesScanned: cfg.BytesScanned, Fraction: float64(i) / float64(count)})
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			} else if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := yield(nil, rows(i)); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+
+		return cfg.Fail.raise(failure)
+	}
+}
+
+// Cancel releases a hanging query, as an engine acting on a cancellation
+// request would
+func (d *Driver) Cancel(ctx context.Context) error {
+	d.cancelOnce.Do(func() { close(d.cancelled) })
+	return nil
+}
+
+// Ping fails with the configured ping error, if any
+func (d *Driver) Ping(ctx context.Context) error {
+	if d.config.PingError != "" {
+		return errors.New(d.config.PingError)
+	}
+	return ctx.Err()
+}
+
+func (d *Driver) Close() error {
+	d.once.Do(func() {
+		close(d.closed)
+		d.unlisten()
+	})
+	return nil
+}
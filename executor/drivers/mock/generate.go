@@ -0,0 +1,174 @@
+// mock/generate.go
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Generator produces rows on the fly instead of listing them, for results
+// too large to write out such as those of load tests. Rows are the same
+// on every run for the same seed.
+type Generator struct {
+	// Count is the number of rows
+	Count int64 `json:"count"`
+	// Patterns gives each column's values, one per column:
+	//
+	//	seq[:start,step]        1, 2, 3, ... or from start by step
+	//	const:<json>            the same value in every row, e.g. const:"eu"
+	//	cycle:<a>,<b>,...       the values in turn, as text
+	//	text[:prefix]           prefix followed by the row number
+	//	int:<min>,<max>         random integers from min to max
+	//	float:<min>,<max>       random floats from min up to max
+	//	bool                    random booleans
+	//	uuid                    random UUIDs
+	//	time:<start>[,<step>]   timestamps from an RFC 3339 start by a
+	//	                        duration step, one second by default
+	//	null                    nulls
+	Patterns []string `json:"patterns"`
+	// NullRate is the share of values, from 0 to 1, replaced by nulls
+	NullRate float64 `json:"null_rate,omitempty"`
+	// Seed seeds the random values
+	Seed int64 `json:"seed,omitempty"`
+
+	values []valueFunc
+}
+
+// valueFunc returns a column's value in the row with the 0-based index
+type valueFunc func(index int64, rng *rand.Rand) interface{}
+
+// compile parses the patterns
+func (g *Generator) compile(columns int) error {
+	if g.Count < 0 {
+		return fmt.Errorf("generate count must be >= 0")
+	}
+	if len(g.Patterns) != columns {
+		return fmt.Errorf("generate has %d patterns for %d columns", len(g.Patterns), columns)
+	}
+	if g.NullRate < 0 || g.NullRate > 1 {
+		return fmt.Errorf("generate null_rate must be between 0 and 1")
+	}
+	g.values = make([]valueFunc, len(g.Patterns))
+	for i, pattern := range g.Patterns {
+		fn, err := parsePattern(pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		g.values[i] = fn
+	}
+	return nil
+}
+
+// rows returns a function producing the rows in order
+func (g *Generator) rows() func(index int64) []interface{} {
+	rng := rand.New(rand.NewSource(g.Seed))
+	return func(index int64) []interface{} {
+		row := make([]interface{}, len(g.values))
+		for i, fn := range g.values {
+			if g.NullRate > 0 && rng.Float64() < g.NullRate {
+				continue
+			}
+			row[i] = fn(index, rng)
+		}
+		return row
+	}
+}
+
+func parsePattern(pattern string) (valueFunc, error) {
+	kind, arg, _ := strings.Cut(pattern, ":")
+	var args []string
+	if arg != "" {
+		args = strings.Split(arg, ",")
+	}
+	switch kind {
+	case "seq":
+		start, step := int64(1), int64(1)
+		if len(args) > 0 {
+			n, err := parseInts(args, 2)
+			if err != nil {
+				return nil, err
+			}
+			start = n[0]
+			if len(n) > 1 {
+				step = n[1]
+			}
+		}
+		return func(i int64, _ *rand.Rand) interface{} { return start + i*step }, nil
+	case "const":
+		var v interface{}
+		if err := json.Unmarshal([]byte(arg), &v); err != nil {
+			return nil, fmt.Errorf("const needs a JSON value: %w", err)
+		}
+		return func(int64, *rand.Rand) interface{} { return v }, nil
+	case "cycle":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("cycle needs values")
+		}
+		return func(i int64, _ *rand.Rand) interface{} { return args[i%int64(len(args))] }, nil
+	case "text":
+		return func(i int64, _ *rand.Rand) interface{} { return arg + strconv.FormatInt(i+1, 10) }, nil
+	case "int":
+		n, err := parseInts(args, 2)
+		if err != nil || len(n) != 2 || n[0] > n[1] {
+			return nil, fmt.Errorf("int needs min,max")
+		}
+		return func(_ int64, rng *rand.Rand) interface{} { return n[0] + rng.Int63n(n[1]-n[0]+1) }, nil
+	case "float":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("float needs min,max")
+		}
+		lo, err1 := strconv.ParseFloat(args[0], 64)
+		hi, err2 := strconv.ParseFloat(args[1], 64)
+		if err1 != nil || err2 != nil || lo > hi {
+			return nil, fmt.Errorf("float needs min,max")
+		}
+		return func(_ int64, rng *rand.Rand) interface{} { return lo + rng.Float64()*(hi-lo) }, nil
+	case "bool":
+		return func(_ int64, rng *rand.Rand) interface{} { return rng.Intn(2) == 1 }, nil
+	case "uuid":
+		return func(_ int64, rng *rand.Rand) interface{} {
+			id, _ := uuid.NewRandomFromReader(rng)
+			return id
+		}, nil
+	case "time":
+		if len(args) == 0 || len(args) > 2 {
+			return nil, fmt.Errorf("time needs start[,step]")
+		}
+		start, err := time.Parse(time.RFC3339Nano, args[0])
+		if err != nil {
+			return nil, err
+		}
+		step := time.Second
+		if len(args) == 2 {
+			if step, err = time.ParseDuration(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return func(i int64, _ *rand.Rand) interface{} { return start.Add(time.Duration(i) * step) }, nil
+	case "null":
+		return func(int64, *rand.Rand) interface{} { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown pattern %q", kind)
+	}
+}
+
+func parseInts(args []string, limit int) ([]int64, error) {
+	if len(args) > limit {
+		return nil, fmt.Errorf("too many arguments")
+	}
+	out := make([]int64, len(args))
+	for i, arg := range args {
+		n, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = n
+	}
+	return out, nil
+}
@@ -0,0 +1,82 @@
+// mock/notify.go
+package mock
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Notifications a listening driver holds before further ones are dropped
+const notificationBuffer = 16
+
+// listeners holds the drivers listening on each channel, so Notify reaches
+// every driver instance like a database server would
+var listeners = struct {
+	sync.Mutex
+	channels map[string]map[*Driver]struct{}
+}{
+	channels: make(map[string]map[*Driver]struct{}),
+}
+
+// Notify sends a notification to every driver listening on the channel.
+// A listener whose buffer is full misses it.
+func Notify(channel, payload string) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	for d := range listeners.channels[channel] {
+		select {
+		case d.notifications <- payload:
+		default:
+		}
+	}
+}
+
+// Listen subscribes the driver to the channel's notifications
+func (d *Driver) Listen(ctx context.Context, channel string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	listeners.Lock()
+	defer listeners.Unlock()
+	if d.notifications == nil {
+		d.notifications = make(chan string, notificationBuffer)
+	}
+	if listeners.channels[channel] == nil {
+		listeners.channels[channel] = make(map[*Driver]struct{})
+	}
+	listeners.channels[channel][d] = struct{}{}
+	return nil
+}
+
+// WaitForNotification returns the payload of the next notification sent
+// with Notify on a channel the driver listens to
+func (d *Driver) WaitForNotification(ctx context.Context) (string, error) {
+	listeners.Lock()
+	notifications := d.notifications
+	listeners.Unlock()
+	if notifications == nil {
+		return "", errors.New("not listening")
+	}
+
+	select {
+	case payload := <-notifications:
+		return payload, nil
+	case <-d.closed:
+		return "", errors.New("driver closed")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// unlisten stops the driver's notifications
+func (d *Driver) unlisten() {
+	listeners.Lock()
+	defer listeners.Unlock()
+	for channel, drivers := range listeners.channels {
+		delete(drivers, d)
+		if len(drivers) == 0 {
+			delete(listeners.channels, channel)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// mock/types.go
+package mock
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/civil"
+)
+
+// typedValue converts a configured value to the driver type a real engine
+// returns for the column type. Nulls stay nil.
+func typedValue(typ string, v interface{}) (interface{}, error) {
+	if v == nil || typ == "" {
+		return v, nil
+	}
+	text := fmt.Sprint(v)
+	switch typ {
+	case "timestamp":
+		return time.Parse(time.RFC3339Nano, text)
+	case "date":
+		return civil.ParseDate(text)
+	case "numeric":
+		r, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid numeric %q", text)
+		}
+		return r, nil
+	case "float":
+		return strconv.ParseFloat(text, 64)
+	default:
+		return nil, fmt.Errorf("unsupported type %q", typ)
+	}
+}
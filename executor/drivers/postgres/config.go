@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	driver "supalytics-executor/driver"
 )
 
 // Config holds PostgreSQL-specific configuration
@@ -26,6 +28,26 @@ type Config struct {
 	MaxOpenConns    int           `json:"max_open_conns,omitempty"`
 	MaxIdleConns    int           `json:"max_idle_conns,omitempty"`
 	ConnMaxLifetime time.Duration `json:"conn_max_lifetime,omitempty"`
+
+	// CursorFetchSize streams SELECT results through a server-side cursor,
+	// fetching this many rows at a time. Zero reads the result directly.
+	CursorFetchSize int `json:"cursor_fetch_size,omitempty"`
+
+	// Replicas lists read replicas as "host" or "host:port". Statements the
+	// runner classifies as read-only are spread across them round-robin,
+	// falling back to the primary when none is reachable or healthy.
+	Replicas []string `json:"replicas,omitempty"`
+
+	// Proxy tunnels connections through a SOCKS5 or HTTP CONNECT proxy
+	Proxy *driver.ProxyConfig `json:"proxy,omitempty"`
+
+	// AuthMethod is "password" (default) or "iam", which signs in with an
+	// RDS IAM auth token generated at connect time instead of Password
+	AuthMethod         string `json:"auth_method,omitempty"`
+	AWSRegion          string `json:"aws_region,omitempty"`
+	AWSAccessKeyID     string `json:"aws_access_key_id,omitempty"` // default credential chain when empty
+	AWSSecretAccessKey string `json:"aws_secret_access_key,omitempty"`
+	AWSSessionToken    string `json:"aws_session_token,omitempty"`
 }
 
 // Validate checks if the configuration is valid
@@ -42,6 +64,21 @@ func (c *Config) Validate() error {
 	if c.Username == "" {
 		return fmt.Errorf("username is required")
 	}
+	switch c.AuthMethod {
+	case "", AuthMethodPassword:
+	case AuthMethodIAM:
+		if c.AWSRegion == "" {
+			return fmt.Errorf("aws_region is required for iam auth")
+		}
+		if c.SSLMode == "" {
+			c.SSLMode = "require" // RDS only accepts IAM tokens over TLS
+		}
+		if c.SSLMode == "disable" {
+			return fmt.Errorf("iam auth requires ssl")
+		}
+	default:
+		return fmt.Errorf("invalid auth_method: %s", c.AuthMethod)
+	}
 	if c.SSLMode == "" {
 		c.SSLMode = "disable" // Default SSL mode
 	}
@@ -67,6 +104,20 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("max_idle_conns cannot be greater than max_open_conns")
 	}
 
+	if c.CursorFetchSize < 0 {
+		return fmt.Errorf("cursor_fetch_size must be >= 0")
+	}
+
+	if err := c.Proxy.Validate(); err != nil {
+		return err
+	}
+
+	for _, replica := range c.Replicas {
+		if _, _, err := splitReplica(replica, c.Port); err != nil {
+			return fmt.Errorf("invalid replica %q: %w", replica, err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,122 @@
+// postgres/cursor.go
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	driver "supalytics-executor/driver"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Name of the server-side cursor used for streaming results
+const cursorName = "supalytics_stream"
+
+// isCursorable reports whether a cursor can be declared for the query
+func isCursorable(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(strings.TrimLeft(fields[0], "(")) {
+	case "SELECT", "WITH", "VALUES", "TABLE":
+		return true
+	}
+	return false
+}
+
+// queryCursor declares a cursor for the query inside a transaction. Rows are
+// fetched in batches as the consumer reads them, so slow consumers throttle
+// the server instead of buffering the whole result.
+func (d *Driver) queryCursor(ctx context.Context, conn *pgx.Conn, query string, args ...interface{}) (*driver.QueryResult, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin cursor transaction: %w", err)
+	}
+
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	declare := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", cursorName, query)
+	if _, err := tx.Exec(ctx, declare, args...); err != nil {
+		tx.Rollback(context.Background())
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	return &driver.QueryResult{
+		Stream: d.streamCursor(ctx, conn, tx),
+	}, nil
+}
+
+func (d *Driver) streamCursor(ctx context.Context, conn *pgx.Conn, tx pgx.Tx) driver.RowStream {
+	tm := conn.TypeMap()
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM %s", d.config.CursorFetchSize, cursorName)
+
+	return func(yield func(columns []string, row []interface{}) error) (err error) {
+		defer func() {
+			if err != nil {
+				tx.Rollback(context.Background())
+				return
+			}
+			if _, closeErr := tx.Exec(ctx, "CLOSE "+cursorName); closeErr != nil {
+				tx.Rollback(context.Background())
+				err = fmt.Errorf("failed to close cursor: %w", closeErr)
+				return
+			}
+			if commitErr := tx.Commit(ctx); commitErr != nil {
+				err = fmt.Errorf("failed to commit cursor transaction: %w", commitErr)
+			}
+		}()
+
+		headerSent := false
+		for {
+			rows, err := tx.Query(ctx, fetch)
+			if err != nil {
+				return fmt.Errorf("failed to fetch rows: %w", err)
+			}
+
+			fields := rows.FieldDescriptions()
+			if !headerSent {
+				header := make([]string, len(fields))
+				for i, fd := range fields {
+					header[i] = string(fd.Name)
+				}
+				d.SetColumnInfo(describeColumns(fields))
+				if err := yield(header, nil); err != nil {
+					rows.Close()
+					return err
+				}
+				headerSent = true
+			}
+
+			fetched := 0
+			for rows.Next() {
+				fetched++
+				values, err := rows.Values()
+				if err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to read row: %w", err)
+				}
+
+				converted, err := ConvertRowValues(fields, values, rows.RawValues(), tm)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+
+				if err := yield(nil, converted); err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			rows.Close()
+
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("error reading rows: %w", err)
+			}
+			if fetched < d.config.CursorFetchSize {
+				return nil
+			}
+		}
+	}
+}
@@ -11,14 +11,25 @@ import (
 
 	driver "supalytics-executor/driver"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type Driver struct {
 	driver.BaseDriver
-	config *Config
-	conn   *pgx.Conn
+	config  *Config
+	conn    *pgx.Conn
+	replica *pgx.Conn
+	used    bool // a statement has run on the primary session
+
+	replicaAddr      string    // address the replica session is connected to
+	replicaCheckedAt time.Time // when the replica session was last known healthy
+
+	timezone string // session time zone, also set on replicas dialed later
+	readOnly bool   // refuse writes, also on replicas dialed later
+
+	awsCreds aws.CredentialsProvider // cached for IAM auth
 }
 
 func init() {
@@ -45,6 +56,14 @@ func (d *Driver) buildConfig() (*pgx.ConnConfig, error) {
 	// Set reasonable timeout values
 	config.ConnectTimeout = 10 * time.Second
 
+	if d.config.Proxy != nil {
+		dial, err := d.config.Proxy.Dialer()
+		if err != nil {
+			return nil, err
+		}
+		config.DialFunc = pgconn.DialFunc(dial)
+	}
+
 	// ->  ERROR: prepared statement "..." already exists (SQLSTATE 42P05)
 	// https://github.com/jackc/pgx/issues/1847#issuecomment-2211786103
 	config.DefaultQueryExecMode = pgx.QueryExecModeCacheDescribe
@@ -54,6 +73,13 @@ func (d *Driver) buildConfig() (*pgx.ConnConfig, error) {
 		config.RuntimeParams = make(map[string]string)
 	}
 
+	if d.timezone != "" {
+		config.RuntimeParams["timezone"] = d.timezone
+	}
+	if d.readOnly {
+		config.RuntimeParams["default_transaction_read_only"] = "on"
+	}
+
 	// Set timeouts
 	config.RuntimeParams["statement_timeout"] = "30000"
 	config.RuntimeParams["lock_timeout"] = "10000"
@@ -100,6 +126,9 @@ func (d *Driver) Connect(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to build config: %w", err)
 	}
+	if err := d.authenticate(ctx, config); err != nil {
+		return err
+	}
 
 	// Create single connection with timeout context
 	conn, err := pgx.ConnectConfig(ctx, config)
@@ -112,14 +141,21 @@ func (d *Driver) Connect(ctx context.Context) error {
 		conn.Close(ctx)
 		return fmt.Errorf("failed to ping postgres: %w", err)
 	}
+	registerTypes(ctx, conn)
 
 	d.conn = conn
 	return nil
 }
 
 func (d *Driver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
+	conn := d.sessionFor(ctx)
+
+	if d.config.CursorFetchSize > 0 && isCursorable(query) {
+		return d.queryCursor(ctx, conn, query, args...)
+	}
+
 	// Execute query
-	rows, err := d.conn.Query(ctx, query, args...)
+	rows, err := conn.Query(ctx, query, args...)
 	if err != nil {
 		// Instead of returning a QueryResult with an error message and nil Stream,
 		// return a proper error.
@@ -150,6 +186,7 @@ func (d *Driver) streamResults(ctx context.Context, rows pgx.Rows) driver.RowStr
 		for i, fd := range fields {
 			header[i] = string(fd.Name)
 		}
+		d.SetColumnInfo(describeColumns(fields))
 
 		// Yield header.
 		if err := yield(header, nil); err != nil {
@@ -164,7 +201,7 @@ func (d *Driver) streamResults(ctx context.Context, rows pgx.Rows) driver.RowStr
 			}
 
 			// Convert row values using our helper.
-			converted, err := ConvertRowValues(fields, values, tm)
+			converted, err := ConvertRowValues(fields, values, rows.RawValues(), tm)
 			if err != nil {
 				return err
 			}
@@ -184,6 +221,9 @@ func (d *Driver) streamResults(ctx context.Context, rows pgx.Rows) driver.RowStr
 }
 
 func (d *Driver) Close() error {
+	if d.replica != nil {
+		d.replica.Close(context.Background())
+	}
 	if d.conn != nil {
 		return d.conn.Close(context.Background())
 	}
@@ -208,13 +248,44 @@ func isRetryableError(err error) bool {
 }
 
 func (d *Driver) Execute(ctx context.Context, query string, args ...interface{}) error {
-	_, err := d.conn.Exec(ctx, query, args...)
+	_, err := d.sessionFor(ctx).Exec(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("failed to execute query: %w", err)
 	}
 	return nil
 }
 
+// SetReadOnly makes the transactions of the session and of any replica
+// session opened for it read-only, so Postgres refuses writes a lexical
+// check misses
+func (d *Driver) SetReadOnly(ctx context.Context) error {
+	d.readOnly = true
+	for _, conn := range []*pgx.Conn{d.conn, d.replica} {
+		if conn == nil {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "SET default_transaction_read_only = on"); err != nil {
+			return fmt.Errorf("failed to make the session read-only: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetTimezone sets the TimeZone setting of the session and of any replica
+// session opened for it
+func (d *Driver) SetTimezone(ctx context.Context, name string) error {
+	d.timezone = name
+	for _, conn := range []*pgx.Conn{d.conn, d.replica} {
+		if conn == nil {
+			continue
+		}
+		if _, err := conn.Exec(ctx, "SELECT set_config('TimeZone', $1, false)", name); err != nil {
+			return fmt.Errorf("failed to set time zone: %w", err)
+		}
+	}
+	return nil
+}
+
 func (d *Driver) Ping(ctx context.Context) error {
 	return d.conn.Ping(ctx)
 }
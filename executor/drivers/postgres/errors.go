@@ -0,0 +1,69 @@
+// postgres/errors.go
+package postgres
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	driver "supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// ClassifyError describes errors the server raised by their SQLSTATE, with
+// the position in the statement they point at, and failed connections
+func (d *Driver) ClassifyError(err error) *driver.Error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return &driver.Error{
+			Code: sqlStateCode(pgErr),
+			Engine: protocol.EngineError{
+				Code:     pgErr.Code,
+				SQLState: pgErr.Code,
+				Position: int(pgErr.Position),
+				Detail:   pgErr.Detail,
+				Hint:     pgErr.Hint,
+			},
+			Err: err,
+		}
+	}
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return &driver.Error{Code: protocol.ErrorCodeConnectorUnreachable, Err: err}
+	}
+	return nil
+}
+
+// sqlStateCode returns the protocol error code of a SQLSTATE
+func sqlStateCode(pgErr *pgconn.PgError) string {
+	switch pgErr.Code {
+	case "42601": // syntax_error
+		return protocol.ErrorCodeSyntax
+	case "42P01", // undefined_table
+		"42703", // undefined_column
+		"42883", // undefined_function
+		"42704", // undefined_object
+		"3F000", // invalid_schema_name
+		"3D000": // invalid_catalog_name
+		return protocol.ErrorCodeObjectNotFound
+	case "42501": // insufficient_privilege
+		return protocol.ErrorCodePermissionDenied
+	case "57014": // query_canceled, by statement_timeout or pg_cancel_backend
+		if strings.Contains(pgErr.Message, "timeout") {
+			return protocol.ErrorCodeTimeout
+		}
+		return protocol.ErrorCodeCancelled
+	case "57P01", // admin_shutdown
+		"57P02", // crash_shutdown
+		"57P03": // cannot_connect_now
+		return protocol.ErrorCodeConnectorUnreachable
+	}
+	switch {
+	case strings.HasPrefix(pgErr.Code, "28"): // invalid_authorization_specification
+		return protocol.ErrorCodePermissionDenied
+	case strings.HasPrefix(pgErr.Code, "08"): // connection_exception
+		return protocol.ErrorCodeConnectorUnreachable
+	}
+	return protocol.ErrorCodeEngine
+}
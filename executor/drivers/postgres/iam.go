@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/jackc/pgx/v5"
+)
+
+// Authentication methods for the auth_method option
+const (
+	AuthMethodPassword = "password"
+	AuthMethodIAM      = "iam"
+)
+
+// authenticate sets the password for the host config will connect to. With
+// IAM auth a fresh RDS auth token is generated for every connection, so
+// reconnects never reuse an expired token.
+func (d *Driver) authenticate(ctx context.Context, cfg *pgx.ConnConfig) error {
+	if d.config.AuthMethod != AuthMethodIAM {
+		return nil
+	}
+
+	creds, err := d.awsCredentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	token, err := auth.BuildAuthToken(ctx, endpoint, d.config.AWSRegion, d.config.Username, creds)
+	if err != nil {
+		return fmt.Errorf("failed to build RDS IAM auth token: %w", err)
+	}
+	cfg.Password = token
+
+	// RDS only accepts IAM tokens over TLS
+	if cfg.TLSConfig == nil {
+		cfg.TLSConfig = &tls.Config{
+			ServerName:         cfg.Host,
+			InsecureSkipVerify: d.config.SSLMode == "require",
+			MinVersion:         tls.VersionTLS12,
+		}
+		delete(cfg.RuntimeParams, "sslmode")
+	}
+	return nil
+}
+
+// awsCredentials returns the static credentials from the config, or the
+// default credential chain (environment, shared config, instance role)
+func (d *Driver) awsCredentials(ctx context.Context) (aws.CredentialsProvider, error) {
+	if d.config.AWSAccessKeyID != "" && d.config.AWSSecretAccessKey != "" {
+		return credentials.NewStaticCredentialsProvider(
+			d.config.AWSAccessKeyID,
+			d.config.AWSSecretAccessKey,
+			d.config.AWSSessionToken,
+		), nil
+	}
+
+	if d.awsCreds == nil {
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(d.config.AWSRegion))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		d.awsCreds = cfg.Credentials
+	}
+	return d.awsCreds, nil
+}
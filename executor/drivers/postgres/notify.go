@@ -0,0 +1,29 @@
+// postgres/notify.go
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Listen subscribes the primary session to a NOTIFY channel. Replicas are
+// never used, as notifications are not replicated.
+func (d *Driver) Listen(ctx context.Context, channel string) error {
+	d.used = true
+	if _, err := d.conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	return nil
+}
+
+// WaitForNotification returns the payload of the next notification on a
+// channel the session listens to
+func (d *Driver) WaitForNotification(ctx context.Context) (string, error) {
+	n, err := d.conn.WaitForNotification(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to wait for notification: %w", err)
+	}
+	return n.Payload, nil
+}
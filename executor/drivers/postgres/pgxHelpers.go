@@ -3,6 +3,7 @@ package postgres
 
 import (
 	"fmt"
+	"math"
 	"math/big"
 	"strconv"
 	"time"
@@ -11,6 +12,8 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/jackc/pgx/v5/pgtype"
+
+	"supalytics-executor/driver"
 )
 
 // ConvertValue converts a single column value based on its PostgreSQL OID.
@@ -34,9 +37,8 @@ func ConvertValue(oid uint32, val interface{}, typeMap *pgtype.Map) (interface{}
 				return convertTimestamp(val)
 			case "numeric":
 				return convertNumeric(val)
-			// Add more named type cases as needed.
 			default:
-				return val, nil
+				return convertDecoded(val), nil
 			}
 		}
 	}
@@ -50,23 +52,35 @@ func ConvertValue(oid uint32, val interface{}, typeMap *pgtype.Map) (interface{}
 	case 1114, 1184:
 		return convertTimestamp(val)
 	// Numeric – PostgreSQL numeric OID is typically 1700.
-	case 1700:
+	case numericOID:
 		return convertNumeric(val)
 	default:
-		return val, nil
+		return convertDecoded(val), nil
 	}
 }
 
 // ConvertRowValues converts an entire slice of row values using their corresponding
 // field descriptions (from rows.FieldDescriptions()) and the connection’s type map.
+// raw holds the values as received (rows.RawValues()), which JSON columns are
+// passed through from; it may be nil.
 // It returns a new slice with the converted values.
-func ConvertRowValues(fields []pgconn.FieldDescription, values []interface{}, typeMap *pgtype.Map) ([]interface{}, error) {
+func ConvertRowValues(fields []pgconn.FieldDescription, values []interface{}, raw [][]byte, typeMap *pgtype.Map) ([]interface{}, error) {
 	if len(fields) != len(values) {
 		return nil, fmt.Errorf("mismatch between fields count (%d) and values count (%d)", len(fields), len(values))
 	}
 
 	converted := make([]interface{}, len(values))
 	for i, val := range values {
+		if i < len(raw) {
+			if doc, ok := rawJSON(fields[i].DataTypeOID, fields[i].Format, raw[i]); ok {
+				converted[i] = doc
+				continue
+			}
+			if nested, ok := nestedArray(fields[i], raw[i], typeMap); ok {
+				converted[i] = nested
+				continue
+			}
+		}
 		cv, err := ConvertValue(fields[i].DataTypeOID, val, typeMap)
 		if err != nil {
 			return nil, fmt.Errorf("failed to convert value for column %q: %w", string(fields[i].Name), err)
@@ -137,11 +151,18 @@ func parseTime(timeStr string) (interface{}, error) {
 	return timeStr, nil
 }
 
-// convertNumeric converts a numeric value to a *big.Float.
-// PostgreSQL numeric types are often returned as string or []byte.
+// convertNumeric converts a numeric value to an exact *big.Rat, so no
+// digits are lost on the way to the client. NaN and infinities, which have
+// no exact form, become floats.
+// PostgreSQL numeric types are decoded by pgx as pgtype.Numeric, and are
+// otherwise often returned as string or []byte.
 func convertNumeric(val interface{}) (interface{}, error) {
 	var numStr string
 	switch v := val.(type) {
+	case pgtype.Numeric:
+		return numericValue(v), nil
+	case *pgtype.Numeric:
+		return numericValue(*v), nil
 	case []byte:
 		numStr = string(v)
 	case string:
@@ -152,12 +173,58 @@ func convertNumeric(val interface{}) (interface{}, error) {
 	default:
 		numStr = fmt.Sprintf("%v", v)
 	}
-	f, _, err := big.ParseFloat(numStr, 10, 256, big.ToNearestEven)
-	if err != nil {
+	r, ok := new(big.Rat).SetString(numStr)
+	if !ok {
 		// If parsing fails, return the original value.
 		return val, nil
 	}
-	return f, nil
+	return r, nil
+}
+
+// numericValue converts a decoded numeric, Int × 10^Exp, to a *big.Rat
+func numericValue(n pgtype.Numeric) interface{} {
+	switch {
+	case !n.Valid:
+		return nil
+	case n.NaN:
+		return math.NaN()
+	case n.InfinityModifier == pgtype.Infinity:
+		return math.Inf(1)
+	case n.InfinityModifier == pgtype.NegativeInfinity:
+		return math.Inf(-1)
+	case n.Int == nil:
+		return new(big.Rat)
+	}
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(n.Exp))), nil)
+	if n.Exp >= 0 {
+		return new(big.Rat).SetInt(new(big.Int).Mul(n.Int, pow))
+	}
+	return new(big.Rat).SetFrac(n.Int, pow)
+}
+
+func abs(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// numericOID is the type OID of PostgreSQL's numeric
+const numericOID = 1700
+
+// describeColumns returns the scale of the result's numeric columns, which
+// the type modifier carries as (precision << 16 | scale) + 4. Unconstrained
+// numerics have no modifier and no fixed scale.
+func describeColumns(fields []pgconn.FieldDescription) map[string]driver.ColumnInfo {
+	columns := make(map[string]driver.ColumnInfo)
+	for _, fd := range fields {
+		if fd.DataTypeOID != numericOID || fd.TypeModifier < 4 {
+			continue
+		}
+		scale := int((fd.TypeModifier - 4) & 0xffff)
+		columns[string(fd.Name)] = driver.ColumnInfo{Scale: &scale}
+	}
+	return columns
 }
 
 // convertToFloat64 converts a numeric value (int64, int32, float64, or float32) to float64.
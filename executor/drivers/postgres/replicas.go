@@ -0,0 +1,170 @@
+// postgres/replicas.go
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"supalytics-executor/driver"
+)
+
+const (
+	// How long a replica that failed to connect or a health check is skipped
+	replicaRetryAfter = 30 * time.Second
+	// How long a replica session goes without a health check, and how long
+	// the check may take
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+)
+
+// replicaState tracks replica health and the round-robin position across
+// driver instances, keyed by replica address
+var replicaState = struct {
+	sync.Mutex
+	downUntil map[string]time.Time
+	next      map[string]int // keyed by the primary host
+}{
+	downUntil: make(map[string]time.Time),
+	next:      make(map[string]int),
+}
+
+// sessionFor picks the connection a statement runs on. Statements the
+// runner classified as read-only go to a healthy replica until anything has
+// run on the primary; from then on every statement stays on the primary so
+// it sees the session's state (temporary tables, settings). Statements
+// without the classification, or with no replica available, run on the
+// primary.
+func (d *Driver) sessionFor(ctx context.Context) *pgx.Conn {
+	if d.used || len(d.config.Replicas) == 0 || !driver.IsReadOnlyStatement(ctx) {
+		d.used = true
+		return d.conn
+	}
+
+	if d.replica != nil && !d.replicaHealthy(ctx) {
+		d.replica.Close(context.Background())
+		d.replica = nil
+	}
+	if d.replica == nil {
+		d.replica = d.connectReplica(ctx)
+	}
+	if d.replica != nil {
+		return d.replica
+	}
+	d.used = true
+	return d.conn
+}
+
+// replicaHealthy pings the replica session before it takes a statement,
+// unless it was checked within replicaCheckInterval. A replica that fails
+// the check is skipped for replicaRetryAfter like one that fails to
+// connect.
+func (d *Driver) replicaHealthy(ctx context.Context) bool {
+	if time.Since(d.replicaCheckedAt) < replicaCheckInterval {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+	if err := d.replica.Ping(ctx); err != nil {
+		log.Printf("Postgres replica %s failed its health check, skipping for %s: %v", d.replicaAddr, replicaRetryAfter, err)
+		markReplicaDown(d.replicaAddr)
+		return false
+	}
+	d.replicaCheckedAt = time.Now()
+	return true
+}
+
+// markReplicaDown skips a replica for replicaRetryAfter
+func markReplicaDown(addr string) {
+	replicaState.Lock()
+	replicaState.downUntil[addr] = time.Now().Add(replicaRetryAfter)
+	replicaState.Unlock()
+}
+
+// connectReplica connects to the next healthy replica, or returns nil
+func (d *Driver) connectReplica(ctx context.Context) *pgx.Conn {
+	replicas := d.config.Replicas
+
+	replicaState.Lock()
+	start := replicaState.next[d.config.Host]
+	replicaState.next[d.config.Host] = start + 1
+	replicaState.Unlock()
+
+	for i := range replicas {
+		addr := replicas[(start+i)%len(replicas)]
+
+		replicaState.Lock()
+		downUntil := replicaState.downUntil[addr]
+		replicaState.Unlock()
+		if time.Now().Before(downUntil) {
+			continue
+		}
+
+		conn, err := d.dialReplica(ctx, addr)
+		if err != nil {
+			log.Printf("Postgres replica %s unavailable, skipping for %s: %v", addr, replicaRetryAfter, err)
+			markReplicaDown(addr)
+			continue
+		}
+		d.replicaAddr, d.replicaCheckedAt = addr, time.Now()
+		return conn
+	}
+	return nil
+}
+
+func (d *Driver) dialReplica(ctx context.Context, addr string) (*pgx.Conn, error) {
+	config, err := d.buildConfig()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := splitReplica(addr, d.config.Port)
+	if err != nil {
+		return nil, err
+	}
+	config.Host = host
+	config.Port = port
+	config.Fallbacks = nil
+	if err := d.authenticate(ctx, config); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.ConnectTimeout)
+	defer cancel()
+
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Ping(ctx); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	registerTypes(ctx, conn)
+	return conn, nil
+}
+
+// splitReplica parses "host" or "host:port", defaulting to the primary's port
+func splitReplica(addr string, defaultPort int) (string, uint16, error) {
+	if addr == "" {
+		return "", 0, errors.New("empty replica address")
+	}
+	if defaultPort == 0 {
+		defaultPort = 5432
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port given
+		return addr, uint16(defaultPort), nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
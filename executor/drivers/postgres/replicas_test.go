@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"supalytics-executor/driver"
+)
+
+// routedDriver has a primary and a replica session that is known healthy.
+// The sessions are never used, only compared.
+func routedDriver() *Driver {
+	return &Driver{
+		config:           &Config{Host: "primary", Replicas: []string{"replica"}},
+		conn:             new(pgx.Conn),
+		replica:          new(pgx.Conn),
+		replicaAddr:      "replica",
+		replicaCheckedAt: time.Now(),
+	}
+}
+
+func TestSessionForRoutesReadsToTheReplica(t *testing.T) {
+	d := routedDriver()
+	read := driver.WithReadOnlyStatement(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if d.sessionFor(read) != d.replica {
+			t.Fatalf("read %d ran on the primary, want the replica", i+1)
+		}
+	}
+	if d.used {
+		t.Fatal("reads on the replica marked the primary used")
+	}
+}
+
+func TestSessionForKeepsWritesOnThePrimary(t *testing.T) {
+	d := routedDriver()
+	read := driver.WithReadOnlyStatement(context.Background())
+
+	if d.sessionFor(read) != d.replica {
+		t.Fatal("read ran on the primary, want the replica")
+	}
+	// Statements the runner did not classify may write
+	if d.sessionFor(context.Background()) != d.conn {
+		t.Fatal("unclassified statement ran on the replica, want the primary")
+	}
+	// Later reads see the primary session's state
+	if d.sessionFor(read) != d.conn {
+		t.Fatal("read after a write ran on the replica, want the primary")
+	}
+}
+
+func TestSessionForFallsBackToThePrimary(t *testing.T) {
+	// Nothing listens on port 1, so the replica cannot be dialed
+	d := &Driver{
+		config: &Config{Host: "fallback-primary", Port: 5432, Username: "u", Database: "db", Replicas: []string{"127.0.0.1:1"}},
+		conn:   new(pgx.Conn),
+	}
+	defer func() {
+		replicaState.Lock()
+		delete(replicaState.downUntil, "127.0.0.1:1")
+		replicaState.Unlock()
+	}()
+
+	if d.sessionFor(driver.WithReadOnlyStatement(context.Background())) != d.conn {
+		t.Fatal("read ran without a session, want the primary")
+	}
+	replicaState.Lock()
+	downUntil := replicaState.downUntil["127.0.0.1:1"]
+	replicaState.Unlock()
+	if !downUntil.After(time.Now()) {
+		t.Fatal("unreachable replica not skipped")
+	}
+}
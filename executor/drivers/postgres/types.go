@@ -0,0 +1,258 @@
+// postgres/types.go
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/civil"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Type OIDs of PostgreSQL's JSON types, whose values are passed through as
+// the JSON the server sent rather than decoded
+const (
+	jsonOID  = 114
+	jsonbOID = 3802
+)
+
+// userTypesSQL lists the enums, domains, ranges, multiranges and composite
+// types defined outside the system schemas, each with its array type.
+// Tables' row types are left out, as every table has one.
+const userTypesSQL = `
+SELECT n.nspname || '.' || t.typname, COALESCE(n.nspname || '.' || a.typname, '')
+FROM pg_catalog.pg_type t
+JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+LEFT JOIN pg_catalog.pg_class c ON c.oid = t.typrelid
+LEFT JOIN pg_catalog.pg_type a ON a.oid = t.typarray
+WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg\_%'
+  AND (t.typtype IN ('e', 'd', 'r', 'm') OR (t.typtype = 'c' AND c.relkind = 'c'))`
+
+// registerTypes teaches the connection the database's own types, so their
+// values decode to structured values instead of text: enums to strings,
+// composites to objects and ranges to their bounds. A type that cannot be
+// registered, such as a composite with a field of an extension's type,
+// is left to decode as text.
+func registerTypes(ctx context.Context, conn *pgx.Conn) {
+	rows, err := conn.Query(ctx, userTypesSQL)
+	if err != nil {
+		log.Printf("Postgres: failed to list user-defined types: %v", err)
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name, array string
+		if err := rows.Scan(&name, &array); err != nil {
+			rows.Close()
+			log.Printf("Postgres: failed to list user-defined types: %v", err)
+			return
+		}
+		names = append(names, name)
+		if array != "" {
+			names = append(names, array)
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil || len(names) == 0 {
+		return
+	}
+
+	// Types are loaded in one round trip, and one at a time when one of
+	// them spoils the batch
+	if _, err := conn.LoadTypes(ctx, names); err == nil {
+		return
+	}
+	for _, name := range names {
+		if _, err := conn.LoadTypes(ctx, []string{name}); err != nil {
+			log.Printf("Postgres: type %s decodes as text: %v", name, err)
+		}
+	}
+}
+
+// rawJSON returns a json or jsonb column's value as the JSON text the
+// server sent, which keeps its numbers exact and its keys in order
+func rawJSON(oid uint32, format int16, raw []byte) (json.RawMessage, bool) {
+	if raw == nil || (oid != jsonOID && oid != jsonbOID) {
+		return nil, false
+	}
+	// Binary jsonb is the text behind a version byte
+	if oid == jsonbOID && format == pgx.BinaryFormatCode {
+		if len(raw) == 0 || raw[0] != 1 {
+			return nil, false
+		}
+		raw = raw[1:]
+	}
+	return append(json.RawMessage(nil), raw...), true
+}
+
+// nestedArray decodes a multidimensional array column to nested arrays,
+// which pgx otherwise flattens to one dimension
+func nestedArray(fd pgconn.FieldDescription, raw []byte, typeMap *pgtype.Map) ([]interface{}, bool) {
+	if raw == nil || typeMap == nil {
+		return nil, false
+	}
+	typ, ok := typeMap.TypeForOID(fd.DataTypeOID)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := typ.Codec.(*pgtype.ArrayCodec); !ok {
+		return nil, false
+	}
+	var array pgtype.Array[interface{}]
+	if err := typeMap.Scan(fd.DataTypeOID, fd.Format, raw, &array); err != nil || len(array.Dims) < 2 {
+		return nil, false
+	}
+	return nest(array.Elements, array.Dims), true
+}
+
+// nest arranges an array's elements, listed in row-major order, in the
+// dimensions given
+func nest(elements []interface{}, dims []pgtype.ArrayDimension) []interface{} {
+	out := make([]interface{}, dims[0].Length)
+	if len(dims) == 1 {
+		for i := range out {
+			out[i] = convertDecoded(elements[i])
+		}
+		return out
+	}
+	if len(out) == 0 {
+		return out
+	}
+	size := len(elements) / len(out)
+	for i := range out {
+		out[i] = nest(elements[i*size:(i+1)*size], dims[1:])
+	}
+	return out
+}
+
+// convertDecoded converts what pgx decodes structured types to into values
+// that encode cleanly: arrays and their elements, composites as objects,
+// ranges as their bounds and intervals as ISO 8601 durations
+func convertDecoded(val interface{}) interface{} {
+	switch v := val.(type) {
+	case []interface{}:
+		// Arrays, and records of anonymous row types
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = convertDecoded(item)
+		}
+		return out
+	case map[string]interface{}:
+		// Composites, and JSON objects inside arrays
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = convertDecoded(item)
+		}
+		return out
+	case pgtype.Numeric:
+		return numericValue(v)
+	case [16]byte:
+		return uuid.UUID(v)
+	case pgtype.Interval:
+		if !v.Valid {
+			return nil
+		}
+		return intervalText(v)
+	case pgtype.Time:
+		if !v.Valid {
+			return nil
+		}
+		us := v.Microseconds
+		return civil.Time{
+			Hour:       int(us / 3600e6),
+			Minute:     int(us / 60e6 % 60),
+			Second:     int(us / 1e6 % 60),
+			Nanosecond: int(us%1e6) * 1000,
+		}
+	case pgtype.Range[interface{}]:
+		return rangeValue(v)
+	case pgtype.Multirange[pgtype.Range[interface{}]]:
+		out := make([]interface{}, len(v))
+		for i, r := range v {
+			out[i] = rangeValue(r)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+// rangeValue converts a range to an object of its bounds, each null when
+// unbounded, and whether they are inclusive; an empty range is
+// {"empty": true}
+func rangeValue(r pgtype.Range[interface{}]) interface{} {
+	if !r.Valid {
+		return nil
+	}
+	if r.LowerType == pgtype.Empty {
+		return map[string]interface{}{"empty": true}
+	}
+	out := map[string]interface{}{
+		"lower":          nil,
+		"upper":          nil,
+		"lowerInclusive": r.LowerType == pgtype.Inclusive,
+		"upperInclusive": r.UpperType == pgtype.Inclusive,
+	}
+	if r.LowerType != pgtype.Unbounded {
+		out["lower"] = convertDecoded(r.Lower)
+	}
+	if r.UpperType != pgtype.Unbounded {
+		out["upper"] = convertDecoded(r.Upper)
+	}
+	return out
+}
+
+// intervalText writes an interval as an ISO 8601 duration the way
+// PostgreSQL's iso_8601 IntervalStyle does, e.g. "P1Y2M3DT4H5M6.5S", with
+// each part carrying its own sign
+func intervalText(iv pgtype.Interval) string {
+	var b strings.Builder
+	b.WriteByte('P')
+	if years := iv.Months / 12; years != 0 {
+		fmt.Fprintf(&b, "%dY", years)
+	}
+	if months := iv.Months % 12; months != 0 {
+		fmt.Fprintf(&b, "%dM", months)
+	}
+	if iv.Days != 0 {
+		fmt.Fprintf(&b, "%dD", iv.Days)
+	}
+	if us := iv.Microseconds; us != 0 {
+		b.WriteByte('T')
+		if hours := us / 3600e6; hours != 0 {
+			fmt.Fprintf(&b, "%dH", hours)
+		}
+		if minutes := us / 60e6 % 60; minutes != 0 {
+			fmt.Fprintf(&b, "%dM", minutes)
+		}
+		if us %= 60e6; us != 0 {
+			b.WriteString(secondsText(us))
+			b.WriteByte('S')
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
+
+// secondsText writes microseconds as seconds without trailing zeros
+func secondsText(us int64) string {
+	sign := ""
+	if us < 0 {
+		sign, us = "-", -us
+	}
+	text := strconv.FormatInt(us/1e6, 10)
+	if frac := us % 1e6; frac != 0 {
+		text += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+	}
+	return sign + text
+}
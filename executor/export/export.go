@@ -0,0 +1,180 @@
+// Package export writes result sets as downloadable files: CSV, JSON or
+// XLSX. Rows are written as they stream, so exports of any size run in
+// constant memory.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"supalytics-executor/protocol"
+)
+
+// Export formats
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+	FormatXLSX = "xlsx"
+)
+
+// Writer writes a result set in one format
+type Writer interface {
+	// WriteHeader writes the column names; it is called once, first
+	WriteHeader(columns []string) error
+	WriteRow(row []interface{}) error
+	// Close finishes the file. It does not close the underlying writer.
+	Close() error
+}
+
+// NewWriter returns a writer for format that writes to w
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case FormatJSON:
+		return &jsonWriter{w: w}, nil
+	case FormatXLSX:
+		return newXLSXWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// ContentType returns the MIME type of format
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatJSON:
+		return "application/json"
+	case FormatXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// FormatValue renders a value as text: times as RFC 3339, bytes as-is and
+// structured values as JSON
+func FormatValue(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return n
+	case []byte:
+		return string(n)
+	case json.RawMessage:
+		return string(n)
+	case time.Time:
+		return n.Format(time.RFC3339Nano)
+	case *big.Rat:
+		return protocol.FormatDecimal(n)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(n)
+	case fmt.Stringer:
+		return n.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// csvWriter writes RFC 4180 CSV with a header record
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) WriteHeader(columns []string) error {
+	return c.w.Write(columns)
+}
+
+func (c *csvWriter) WriteRow(row []interface{}) error {
+	record := make([]string, len(row))
+	for i, v := range row {
+		record[i] = FormatValue(v)
+	}
+	return c.w.Write(record)
+}
+
+// Flush sends buffered records to the underlying writer
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
+
+// jsonWriter writes a JSON array with one object per row, keyed by column
+// in column order
+type jsonWriter struct {
+	w     io.Writer
+	keys  [][]byte
+	first bool // no row written yet
+}
+
+func (j *jsonWriter) WriteHeader(columns []string) error {
+	j.keys = make([][]byte, len(columns))
+	for i, col := range columns {
+		key, err := json.Marshal(col)
+		if err != nil {
+			return err
+		}
+		j.keys[i] = key
+	}
+	_, err := io.WriteString(j.w, "[")
+	j.first = true
+	return err
+}
+
+func (j *jsonWriter) WriteRow(row []interface{}) error {
+	var b strings.Builder
+	if j.first {
+		j.first = false
+		b.WriteString("\n{")
+	} else {
+		b.WriteString(",\n{")
+	}
+	for i, v := range row {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if i < len(j.keys) {
+			b.Write(j.keys[i])
+		} else {
+			fmt.Fprintf(&b, `"%d"`, i)
+		}
+		b.WriteByte(':')
+		if r, ok := v.(*big.Rat); ok {
+			// Exact decimal text rather than the fraction a Rat marshals as
+			v = protocol.FormatDecimal(r)
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	_, err := io.WriteString(j.w, b.String())
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	if j.keys == nil {
+		// No header means no result set; still produce a valid document
+		_, err := io.WriteString(j.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
@@ -0,0 +1,158 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Excel cannot hold more rows than this in one sheet
+const xlsxMaxRows = 1048576
+
+// The fixed parts of a single-sheet workbook
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Results" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxWriter streams an Office Open XML workbook with a single sheet.
+// Strings are written inline so no shared string table has to be held in
+// memory; times are written as ISO 8601 text.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+	err   error
+}
+
+func newXLSXWriter(w io.Writer) *xlsxWriter {
+	x := &xlsxWriter{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := x.zip.Create(part.name)
+		if err != nil {
+			x.err = err
+			return x
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			x.err = err
+			return x
+		}
+	}
+	sheet, err := x.zip.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		x.err = err
+		return x
+	}
+	x.sheet = bufio.NewWriter(sheet)
+	x.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x
+}
+
+func (x *xlsxWriter) WriteHeader(columns []string) error {
+	row := make([]interface{}, len(columns))
+	for i, col := range columns {
+		row[i] = col
+	}
+	return x.WriteRow(row)
+}
+
+func (x *xlsxWriter) WriteRow(row []interface{}) error {
+	if x.err != nil {
+		return x.err
+	}
+	if x.rows == xlsxMaxRows {
+		return errXLSXTooLarge
+	}
+	x.rows++
+
+	var b strings.Builder
+	b.WriteString(`<row r="`)
+	b.WriteString(strconv.Itoa(x.rows))
+	b.WriteString(`">`)
+	for _, v := range row {
+		writeXLSXCell(&b, v)
+	}
+	b.WriteString(`</row>`)
+	_, x.err = x.sheet.WriteString(b.String())
+	return x.err
+}
+
+func (x *xlsxWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+var errXLSXTooLarge = errors.New("result has more rows than an XLSX sheet holds")
+
+func writeXLSXCell(b *strings.Builder, v interface{}) {
+	switch n := v.(type) {
+	case nil:
+		b.WriteString(`<c/>`)
+	case bool:
+		b.WriteString(`<c t="b"><v>`)
+		if n {
+			b.WriteString("1")
+		} else {
+			b.WriteString("0")
+		}
+		b.WriteString(`</v></c>`)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		b.WriteString(`<c><v>`)
+		b.WriteString(FormatValue(n))
+		b.WriteString(`</v></c>`)
+	case float32, float64:
+		f, _ := strconv.ParseFloat(FormatValue(n), 64)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			writeXLSXString(b, FormatValue(n))
+			return
+		}
+		b.WriteString(`<c><v>`)
+		b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		b.WriteString(`</v></c>`)
+	case time.Time:
+		writeXLSXString(b, n.Format(time.RFC3339Nano))
+	default:
+		writeXLSXString(b, FormatValue(v))
+	}
+}
+
+func writeXLSXString(b *strings.Builder, s string) {
+	b.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+	xml.EscapeText(b, []byte(stripInvalidXML(s)))
+	b.WriteString(`</t></is></c>`)
+}
+
+// stripInvalidXML drops control characters XML 1.0 cannot represent
+func stripInvalidXML(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || r >= 0x20 && r != 0xFFFE && r != 0xFFFF {
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,152 @@
+// Package hooks notifies external systems about execution lifecycle events.
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EventType names a point in an execution's lifecycle
+type EventType string
+
+const (
+	EventQueued    EventType = "queued"
+	EventStarted   EventType = "started"
+	EventCompleted EventType = "completed"
+	EventFailed    EventType = "failed"
+	EventCancelled EventType = "cancelled"
+	// EventSlow follows the terminal event of an execution that ran past
+	// its connector's slow-query threshold
+	EventSlow EventType = "slow"
+	// EventConnectorStatus reports a connector whose health check result
+	// changed; it belongs to no execution
+	EventConnectorStatus EventType = "connector_status"
+)
+
+// Event describes a lifecycle transition of a single execution
+type Event struct {
+	Type         EventType `json:"type"`
+	Time         time.Time `json:"time"`
+	StreamID     string    `json:"streamId"`
+	QueryID      string    `json:"queryId"`
+	ConnectorID  string    `json:"connectorId,omitempty"`
+	ConnectionID string    `json:"connectionId"`
+	ParameterSet string    `json:"parameterSet,omitempty"`
+	RowsSent     int64     `json:"rowsSent"`
+	QueuedAt     time.Time `json:"queuedAt"`
+	StartedAt    time.Time `json:"startedAt,omitempty"`
+	DurationMS   int64     `json:"durationMs,omitempty"` // set on terminal events
+	Error        string    `json:"error,omitempty"`
+	// ThresholdMS is the slow-query threshold a slow event's execution
+	// exceeded; its DurationMS is the time it ran, excluding the queue
+	ThresholdMS int64 `json:"thresholdMs,omitempty"`
+	// Status and PreviousStatus are a connector's new and former health
+	// check status on connector status events
+	Status         string `json:"status,omitempty"`
+	PreviousStatus string `json:"previousStatus,omitempty"`
+}
+
+// Summary describes the event in a line of text for chat notifications
+func (e Event) Summary() string {
+	connector := ""
+	if e.ConnectorID != "" {
+		connector = " on connector " + e.ConnectorID
+	}
+	switch e.Type {
+	case EventConnectorStatus:
+		summary := fmt.Sprintf("Connector %s is now %s", e.ConnectorID, e.Status)
+		if e.PreviousStatus != "" {
+			summary += fmt.Sprintf(" (was %s)", e.PreviousStatus)
+		}
+		if e.Error != "" {
+			summary += ": " + e.Error
+		}
+		return summary
+	case EventSlow:
+		return fmt.Sprintf(":warning: Slow query %s%s: ran %s, over its %s threshold (stream %s, %d rows)",
+			e.QueryID, connector, time.Duration(e.DurationMS)*time.Millisecond, time.Duration(e.ThresholdMS)*time.Millisecond, e.StreamID, e.RowsSent)
+	case EventFailed:
+		return fmt.Sprintf("Query %s%s failed after %s: %s", e.QueryID, connector, time.Duration(e.DurationMS)*time.Millisecond, e.Error)
+	case EventCompleted, EventCancelled:
+		return fmt.Sprintf("Query %s%s %s in %s", e.QueryID, connector, e.Type, time.Duration(e.DurationMS)*time.Millisecond)
+	default:
+		return fmt.Sprintf("Query %s%s %s", e.QueryID, connector, e.Type)
+	}
+}
+
+// Hook receives lifecycle events. Implementations should return promptly;
+// events are delivered from a background goroutine, one at a time per hook.
+type Hook interface {
+	Fire(ctx context.Context, event Event) error
+}
+
+// HookFunc adapts a function to the Hook interface
+type HookFunc func(ctx context.Context, event Event) error
+
+func (f HookFunc) Fire(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// Number of events buffered per hook before new events are dropped
+const queueSize = 1024
+
+// Time allowed for a single delivery
+const deliveryTimeout = 30 * time.Second
+
+// Dispatcher fans events out to registered hooks without blocking the
+// caller. A hook that falls behind drops events instead of slowing down
+// query execution.
+type Dispatcher struct {
+	mu    sync.RWMutex
+	sinks []*sink
+}
+
+type sink struct {
+	hook   Hook
+	events chan Event
+}
+
+// NewDispatcher creates a dispatcher with no hooks
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// Add registers a hook and starts delivering events to it
+func (d *Dispatcher) Add(h Hook) {
+	s := &sink{hook: h, events: make(chan Event, queueSize)}
+	go s.run()
+
+	d.mu.Lock()
+	d.sinks = append(d.sinks, s)
+	d.mu.Unlock()
+}
+
+// Fire queues an event for every registered hook
+func (d *Dispatcher) Fire(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, s := range d.sinks {
+		select {
+		case s.events <- event:
+		default:
+			log.Printf("Hook queue full, dropping %s event for stream %s", event.Type, event.StreamID)
+		}
+	}
+}
+
+func (s *sink) run() {
+	for event := range s.events {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+		if err := s.hook.Fire(ctx, event); err != nil {
+			log.Printf("Hook failed for %s event on stream %s: %v", event.Type, event.StreamID, err)
+		}
+		cancel()
+	}
+}
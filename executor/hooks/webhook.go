@@ -0,0 +1,133 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Header carrying the hex HMAC-SHA256 of the request body when a secret is set
+const SignatureHeader = "X-Supalytics-Signature"
+
+// Webhook payload formats
+const (
+	// FormatJSON posts the event itself (the default)
+	FormatJSON = "json"
+	// FormatSlack posts {"text": ...} with the event's summary, as Slack
+	// incoming webhooks and compatible chat tools accept
+	FormatSlack = "slack"
+)
+
+// WebhookConfig configures an HTTP webhook
+type WebhookConfig struct {
+	URL string `toml:"url"`
+	// Secret signs each payload so receivers can verify its origin
+	Secret string `toml:"secret"`
+	// Events limits delivery to these event types; empty means all
+	Events []string `toml:"events"`
+	// Format is json (default) or slack
+	Format string `toml:"format"`
+	// Attempts bounds delivery retries (default 3)
+	Attempts int `toml:"attempts"`
+	// Timeout bounds a single request (default 10s)
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// Webhook POSTs events as JSON to a URL, retrying failed deliveries with
+// exponential backoff
+type Webhook struct {
+	config WebhookConfig
+	events map[EventType]bool
+	client *http.Client
+}
+
+// NewWebhook creates a webhook hook
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook url is required")
+	}
+	switch cfg.Format {
+	case "", FormatJSON, FormatSlack:
+	default:
+		return nil, fmt.Errorf("invalid webhook format %q: want json or slack", cfg.Format)
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 3
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	w := &Webhook{
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	if len(cfg.Events) > 0 {
+		w.events = make(map[EventType]bool, len(cfg.Events))
+		for _, e := range cfg.Events {
+			w.events[EventType(e)] = true
+		}
+	}
+	return w, nil
+}
+
+// Fire delivers the event unless it is filtered out
+func (w *Webhook) Fire(ctx context.Context, event Event) error {
+	if w.events != nil && !w.events[event.Type] {
+		return nil
+	}
+
+	var payload interface{} = event
+	if w.config.Format == FormatSlack {
+		payload = map[string]string{"text": event.Summary()}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt >= w.config.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("post webhook: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// protocol/checksum.go
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// RowChecksum is a rolling FNV-1a 64 checksum over a stream's rows in the
+// order they were sent. Each row is hashed as the values a client decodes it
+// to in the connection's encoding, so the server hashing driver values and
+// the client hashing decoded values arrive at the same sum.
+type RowChecksum struct {
+	h     hash.Hash64
+	codec Codec
+	size  int64
+}
+
+// NewRowChecksum starts an empty checksum for a JSON connection
+func NewRowChecksum() *RowChecksum {
+	return NewRowChecksumCodec(JSON)
+}
+
+// NewRowChecksumCodec starts an empty checksum for a connection using codec
+func NewRowChecksumCodec(codec Codec) *RowChecksum {
+	return &RowChecksum{h: fnv.New64a(), codec: codec}
+}
+
+// Add folds a row into the checksum
+func (c *RowChecksum) Add(row []interface{}) error {
+	// Round-trip through the codec to see the row as the client does
+	data, err := c.codec.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("checksum row: %w", err)
+	}
+	c.size += int64(len(data))
+	var decoded []interface{}
+	if err := c.codec.Unmarshal(data, &decoded); err != nil {
+		return fmt.Errorf("checksum row: %w", err)
+	}
+
+	normalized := make([]interface{}, len(decoded))
+	for i, v := range decoded {
+		n, err := normalizeValue(v)
+		if err != nil {
+			return err
+		}
+		normalized[i] = n
+	}
+
+	data, err = json.Marshal(normalized)
+	if err != nil {
+		return fmt.Errorf("checksum row: %w", err)
+	}
+	c.h.Write(data)
+	c.h.Write([]byte{'\n'})
+	return nil
+}
+
+// Size returns the encoded size of the rows added so far
+func (c *RowChecksum) Size() int64 {
+	return c.size
+}
+
+// Sum returns the checksum as a hex string
+func (c *RowChecksum) Sum() string {
+	return fmt.Sprintf("%016x", c.h.Sum64())
+}
+
+// normalizeValue converts a decoded value to a canonical form independent of
+// the encoding and the decoder's time zone: numbers become float64, strings
+// valid UTF-8 and times UTC
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch n := v.(type) {
+	case nil, bool, float64:
+		return n, nil
+	case string:
+		return strings.ToValidUTF8(n, "\uFFFD"), nil
+	case time.Time:
+		return n.UTC().Format(time.RFC3339Nano), nil
+	case int:
+		return float64(n), nil
+	case int8:
+		return float64(n), nil
+	case int16:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint8:
+		return float64(n), nil
+	case uint16:
+		return float64(n), nil
+	case uint32:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case float32:
+		return float64(n), nil
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, item := range n {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = normalized
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(n))
+		for k, item := range n {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[strings.ToValidUTF8(k, "\uFFFD")] = normalized
+		}
+		return out, nil
+	default:
+		// Anything else, such as raw bytes, is hashed as its JSON form
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("checksum value %T: %w", v, err)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil, err
+		}
+		return decoded, nil
+	}
+}
@@ -0,0 +1,123 @@
+// protocol/decimal.go
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DecimalExtType is the MessagePack extension type decimals are sent as,
+// holding their text
+const DecimalExtType int8 = 1
+
+// cborDecimalTag is the CBOR tag for decimal fractions (RFC 8949 section
+// 3.4.4), an array of the exponent and the mantissa
+const cborDecimalTag = 4
+
+func init() {
+	msgpack.RegisterExtEncoder(DecimalExtType, Decimal{}, func(_ *msgpack.Encoder, v reflect.Value) ([]byte, error) {
+		return []byte(v.Interface().(Decimal).String()), nil
+	})
+	msgpack.RegisterExtDecoder(DecimalExtType, Decimal{}, func(dec *msgpack.Decoder, v reflect.Value, extLen int) error {
+		data := make([]byte, extLen)
+		if err := dec.ReadFull(data); err != nil {
+			return err
+		}
+		parsed, err := ParseDecimal(string(data))
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(parsed))
+		return nil
+	})
+}
+
+// Decimal is an exact decimal number, Mantissa × 10^Exponent, as rows carry
+// arbitrary-precision numbers in the NumericsDecimal format. JSON sends it
+// as its text, MessagePack as extension DecimalExtType and CBOR as a
+// decimal fraction; the binary encodings decode back to a Decimal.
+type Decimal struct {
+	_        struct{} `cbor:",toarray"`
+	Exponent int64
+	Mantissa *big.Int
+}
+
+// NewDecimal returns r rounded to the given number of decimal places, with
+// halves rounded away from zero
+func NewDecimal(r *big.Rat, places int) Decimal {
+	d, _ := ParseDecimal(r.FloatString(places))
+	return d
+}
+
+// ParseDecimal parses decimal text such as "-12.50", keeping its places
+func ParseDecimal(text string) (Decimal, error) {
+	digits, places := text, 0
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		digits, places = text[:i]+text[i+1:], len(text)-i-1
+	}
+	mantissa, ok := new(big.Int).SetString(digits, 10)
+	if !ok || strings.ContainsAny(digits, "_xXoObB") {
+		return Decimal{}, fmt.Errorf("invalid decimal %q", text)
+	}
+	return Decimal{Exponent: -int64(places), Mantissa: mantissa}, nil
+}
+
+// Scale is the number of decimal places the value is written with
+func (d Decimal) Scale() int {
+	if d.Exponent > 0 {
+		return 0
+	}
+	return int(-d.Exponent)
+}
+
+// Rat returns the value as a fraction
+func (d Decimal) Rat() *big.Rat {
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(abs64(d.Exponent)), nil)
+	if d.Exponent >= 0 {
+		return new(big.Rat).SetInt(new(big.Int).Mul(d.mantissa(), pow))
+	}
+	return new(big.Rat).SetFrac(d.mantissa(), pow)
+}
+
+func (d Decimal) String() string {
+	if d.Exponent >= 0 {
+		return d.Rat().FloatString(0)
+	}
+	return d.Rat().FloatString(d.Scale())
+}
+
+func (d Decimal) mantissa() *big.Int {
+	if d.Mantissa == nil {
+		return new(big.Int)
+	}
+	return d.Mantissa
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,192 @@
+// protocol/encoding.go
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Message encodings a client can negotiate per connection
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+	EncodingCBOR    = "cbor"
+)
+
+// subprotocolPrefix namespaces the WebSocket subprotocols naming encodings
+const subprotocolPrefix = "supalytics."
+
+// Subprotocols lists the subprotocols the server accepts, in order of
+// preference. A client that offers none of them is spoken to in JSON.
+var Subprotocols = []string{
+	Subprotocol(EncodingMsgpack),
+	Subprotocol(EncodingCBOR),
+	Subprotocol(EncodingJSON),
+}
+
+// Subprotocol returns the WebSocket subprotocol that negotiates an encoding
+func Subprotocol(encoding string) string {
+	return subprotocolPrefix + encoding
+}
+
+// Codec encodes and decodes protocol messages in one encoding
+type Codec interface {
+	// Name is the encoding's name, e.g. EncodingMsgpack
+	Name() string
+	// Binary reports whether messages travel as binary frames
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// EncodeRow converts a row's driver values to ones the encoding
+	// represents natively
+	EncodeRow(row []interface{}) []interface{}
+}
+
+// JSON is the default codec
+var JSON Codec = jsonCodec{}
+
+// CodecFor returns the codec for an encoding name
+func CodecFor(encoding string) (Codec, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		return JSON, nil
+	case EncodingMsgpack:
+		return msgpackCodec{}, nil
+	case EncodingCBOR:
+		return cborCodec, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// CodecForSubprotocol returns the codec a negotiated subprotocol selects,
+// falling back to JSON when none was negotiated
+func CodecForSubprotocol(subprotocol string) Codec {
+	if !strings.HasPrefix(subprotocol, subprotocolPrefix) {
+		return JSON
+	}
+	codec, err := CodecFor(strings.TrimPrefix(subprotocol, subprotocolPrefix))
+	if err != nil {
+		return JSON
+	}
+	return codec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return EncodingJSON }
+func (jsonCodec) Binary() bool                               { return false }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) EncodeRow(row []interface{}) []interface{}  { return row }
+
+// msgpackCodec encodes messages as MessagePack. Struct fields are named by
+// their json tags so both encodings share one message schema.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return EncodingMsgpack }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (msgpackCodec) EncodeRow(row []interface{}) []interface{} {
+	return encodeBinaryRow(row)
+}
+
+// cborCodec encodes messages as CBOR, with times and decimals tagged so
+// they decode back to time.Time and Decimal
+var cborCodec = func() Codec {
+	tags := cbor.NewTagSet()
+	if err := tags.Add(cbor.TagOptions{EncTag: cbor.EncTagRequired, DecTag: cbor.DecTagRequired}, reflect.TypeOf(Decimal{}), cborDecimalTag); err != nil {
+		panic(err)
+	}
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano, TimeTag: cbor.EncTagRequired}.EncModeWithTags(tags)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecModeWithTags(tags)
+	if err != nil {
+		panic(err)
+	}
+	return cborCodecImpl{enc: enc, dec: dec}
+}()
+
+type cborCodecImpl struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func (cborCodecImpl) Name() string                                 { return EncodingCBOR }
+func (cborCodecImpl) Binary() bool                                 { return true }
+func (c cborCodecImpl) Marshal(v interface{}) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodecImpl) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
+func (cborCodecImpl) EncodeRow(row []interface{}) []interface{}    { return encodeBinaryRow(row) }
+
+func encodeBinaryRow(row []interface{}) []interface{} {
+	out := make([]interface{}, len(row))
+	for i, v := range row {
+		out[i] = binaryValue(v)
+	}
+	return out
+}
+
+// binaryValue keeps the values binary encodings carry natively, including
+// times, raw bytes and decimals. Arbitrary-precision numbers travel as their exact
+// decimal text rather than being rounded to a float, and any other driver
+// type as the JSON it would have been sent as.
+func binaryValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case nil, bool, string, []byte, time.Time, Decimal,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return n
+	case *big.Int:
+		return n.String()
+	case *big.Float:
+		return n.Text('g', -1)
+	case *big.Rat:
+		return n.RatString()
+	case []interface{}:
+		return encodeBinaryRow(n)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(n))
+		for k, item := range n {
+			out[k] = binaryValue(item)
+		}
+		return out
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return fmt.Sprint(v)
+		}
+		return decoded
+	}
+}
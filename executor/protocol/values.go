@@ -0,0 +1,253 @@
+// protocol/values.go
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/civil"
+)
+
+// How times are sent, for ValueFormat.Times
+const (
+	// TimesISO8601 sends times as RFC 3339 text, even in binary encodings
+	TimesISO8601 = "iso8601"
+	// TimesUnixMillis sends times as milliseconds since the Unix epoch.
+	// Dates and datetimes without a zone count as UTC, and times of day as
+	// milliseconds since midnight.
+	TimesUnixMillis = "unix_ms"
+)
+
+// How arbitrary-precision numbers are sent, for ValueFormat.Numerics
+const (
+	// NumericsString sends them as their exact decimal text
+	NumericsString = "string"
+	// NumericsNumber sends them as numbers, which JSON carries exactly but
+	// most decoders read as floats
+	NumericsNumber = "number"
+	// NumericsDecimal sends them as Decimal values: exact text in JSON, and
+	// a decimal type MessagePack and CBOR clients decode without rounding
+	NumericsDecimal = "decimal"
+)
+
+// Query parameters a client negotiates its connection's ValueFormat with,
+// overriding the server's default for the fields it sets
+const (
+	ValueTimesParam     = "times"
+	ValueNumericsParam  = "numerics"
+	ValuePrecisionParam = "precision"
+)
+
+// ValueFormat is how rows represent values their encoding has no type for,
+// so each driver's times and numbers reach clients alike. The zero value
+// sends times as each encoding does (RFC 3339 text in JSON, native
+// timestamps in MessagePack and CBOR) and arbitrary-precision numbers as
+// exact decimal text. Numbers of a column the engine declares a scale for
+// are written with that many decimal places. Floats that are not finite
+// are always sent as "NaN", "Infinity" or "-Infinity", which JSON has no
+// numbers for.
+type ValueFormat struct {
+	Times    string `json:"times,omitempty" toml:"times"`
+	Numerics string `json:"numerics,omitempty" toml:"numerics"`
+	// Precision rounds fractional numbers to this many decimal places; 0
+	// leaves them as the engine returned them, at the column's scale
+	Precision int `json:"precision,omitempty" toml:"precision"`
+}
+
+// Validate reports a format naming an unknown mode
+func (f ValueFormat) Validate() error {
+	switch f.Times {
+	case "", TimesISO8601, TimesUnixMillis:
+	default:
+		return fmt.Errorf("unsupported times format %q", f.Times)
+	}
+	switch f.Numerics {
+	case "", NumericsString, NumericsNumber, NumericsDecimal:
+	default:
+		return fmt.Errorf("unsupported numerics format %q", f.Numerics)
+	}
+	if f.Precision < 0 {
+		return fmt.Errorf("precision must not be negative")
+	}
+	return nil
+}
+
+// Merge returns f with the fields o sets replacing its own
+func (f ValueFormat) Merge(o ValueFormat) ValueFormat {
+	if o.Times != "" {
+		f.Times = o.Times
+	}
+	if o.Numerics != "" {
+		f.Numerics = o.Numerics
+	}
+	if o.Precision != 0 {
+		f.Precision = o.Precision
+	}
+	return f
+}
+
+// FormatRow returns a copy of row with its values converted to the format.
+// scales holds the scale each column declares, nil where it has none.
+// Codec.EncodeRow is applied after it.
+func (f ValueFormat) FormatRow(row []interface{}, scales []*int) []interface{} {
+	out := make([]interface{}, len(row))
+	for i, v := range row {
+		var scale *int
+		if i < len(scales) {
+			scale = scales[i]
+		}
+		out[i] = f.formatValue(v, scale)
+	}
+	return out
+}
+
+// places returns the decimal places a number of a column with the given
+// scale is written with, or -1 to write it as it is
+func (f ValueFormat) places(scale *int) int {
+	switch {
+	case f.Precision > 0:
+		return f.Precision
+	case scale != nil:
+		return *scale
+	}
+	return -1
+}
+
+func (f ValueFormat) formatValue(v interface{}, scale *int) interface{} {
+	switch n := v.(type) {
+	case float64:
+		return f.formatFloat(n, 64)
+	case float32:
+		return f.formatFloat(float64(n), 32)
+	case *big.Int:
+		if n.IsInt64() {
+			return n.Int64()
+		}
+		return f.numeric(n.String())
+	case *big.Float:
+		if n.IsInf() {
+			return f.formatFloat(math.Inf(n.Sign()), 64)
+		}
+		return f.numeric(n.Text('f', f.places(scale)))
+	case *big.Rat:
+		places := f.places(scale)
+		if places < 0 {
+			return f.numeric(FormatDecimal(n))
+		}
+		return f.numeric(n.FloatString(places))
+	case time.Time:
+		switch f.Times {
+		case TimesISO8601:
+			return n.Format(time.RFC3339Nano)
+		case TimesUnixMillis:
+			return n.UnixMilli()
+		}
+		return n
+	case civil.Date:
+		if f.Times == TimesUnixMillis {
+			return n.In(time.UTC).UnixMilli()
+		}
+		return n.String()
+	case civil.DateTime:
+		if f.Times == TimesUnixMillis {
+			return n.In(time.UTC).UnixMilli()
+		}
+		return n.String()
+	case civil.Time:
+		if f.Times == TimesUnixMillis {
+			return int64(n.Hour)*3600000 + int64(n.Minute)*60000 + int64(n.Second)*1000 + int64(n.Nanosecond)/1e6
+		}
+		return n.String()
+	case []interface{}:
+		return f.FormatRow(n, nil)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(n))
+		for k, item := range n {
+			out[k] = f.formatValue(item, nil)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// formatFloat rounds a float to the format's precision, spelling out those
+// JSON cannot represent
+func (f ValueFormat) formatFloat(v float64, bitSize int) interface{} {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	if f.Precision <= 0 {
+		if bitSize == 32 {
+			return float32(v)
+		}
+		return v
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', f.Precision, bitSize), bitSize)
+	if err != nil {
+		return v
+	}
+	return rounded
+}
+
+// numeric sends an arbitrary-precision number's decimal text per the format.
+// A json.Number is written into JSON as it is, and sent as a float by the
+// binary encodings.
+func (f ValueFormat) numeric(text string) interface{} {
+	switch f.Numerics {
+	case NumericsNumber:
+		return json.Number(text)
+	case NumericsDecimal:
+		if d, err := ParseDecimal(text); err == nil {
+			return d
+		}
+	}
+	return text
+}
+
+// maxRatDigits bounds the decimal places of a fraction that has no exact
+// decimal form, matching BigQuery's BIGNUMERIC scale
+const maxRatDigits = 38
+
+// FormatDecimal returns a fraction as decimal text, exactly when its
+// denominator allows it, without trailing zeros
+func FormatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	// A fraction has a finite decimal form when its reduced denominator's
+	// only prime factors are 2 and 5, with as many places as the larger
+	// power of the two
+	d := new(big.Int).Set(r.Denom())
+	var twos, fives int
+	two, five, rem := big.NewInt(2), big.NewInt(5), new(big.Int)
+	for q := new(big.Int); ; twos++ {
+		if q.QuoRem(d, two, rem); rem.Sign() != 0 {
+			break
+		}
+		d.Set(q)
+	}
+	for q := new(big.Int); ; fives++ {
+		if q.QuoRem(d, five, rem); rem.Sign() != 0 {
+			break
+		}
+		d.Set(q)
+	}
+	if d.Cmp(big.NewInt(1)) == 0 {
+		return r.FloatString(max(twos, fives))
+	}
+	text := r.FloatString(maxRatDigits)
+	for text[len(text)-1] == '0' {
+		text = text[:len(text)-1]
+	}
+	return text
+}
@@ -0,0 +1,201 @@
+// runner/aggregate.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"supalytics-executor/driver"
+)
+
+// Aggregate functions computed over a result as it streams
+const (
+	AggregateCount = "count"
+	AggregateSum   = "sum"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateAvg   = "avg"
+)
+
+// Aggregate is one value an aggregate-only execution returns instead of the
+// rows: Fn over Column, in a column named As. Count without a column counts
+// rows; every other function skips nulls, as in SQL.
+type Aggregate struct {
+	Fn     string `json:"fn"`
+	Column string `json:"column,omitempty"`
+	As     string `json:"as,omitempty"`
+}
+
+// name is the column an aggregate's value is returned in: As, or the
+// function and column joined, e.g. sum_revenue
+func (a Aggregate) name() string {
+	switch {
+	case a.As != "":
+		return a.As
+	case a.Column == "":
+		return a.Fn
+	}
+	return a.Fn + "_" + a.Column
+}
+
+// ValidateAggregates checks aggregates can be computed, without knowing the
+// columns they will see
+func ValidateAggregates(aggregates []Aggregate) error {
+	names := make(map[string]bool, len(aggregates))
+	for i, a := range aggregates {
+		switch a.Fn {
+		case AggregateCount:
+		case AggregateSum, AggregateMin, AggregateMax, AggregateAvg:
+			if a.Column == "" {
+				return fmt.Errorf("aggregate %d (%s): column is required", i+1, a.Fn)
+			}
+		default:
+			return fmt.Errorf("aggregate %d: unknown function %q", i+1, a.Fn)
+		}
+		if names[a.name()] {
+			return fmt.Errorf("aggregate %d: duplicate column %q", i+1, a.name())
+		}
+		names[a.name()] = true
+	}
+	return nil
+}
+
+// aggregateState accumulates one aggregate
+type aggregateState struct {
+	Aggregate
+	at int // column index, or -1 to count rows
+
+	count   int64
+	sum     float64
+	integer bool // every summed value was an integer
+	best    interface{}
+}
+
+func (s *aggregateState) add(row []interface{}) error {
+	if s.at < 0 {
+		s.count++
+		return nil
+	}
+	v := row[s.at]
+	if v == nil {
+		return nil
+	}
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	s.count++
+
+	switch s.Fn {
+	case AggregateSum, AggregateAvg:
+		n, integer, ok := exprNumber(v)
+		if !ok || math.IsNaN(n) {
+			return fmt.Errorf("%s(%s): %v is not a number", s.Fn, s.Column, v)
+		}
+		s.sum += n
+		s.integer = s.integer && integer
+	case AggregateMin, AggregateMax:
+		if s.best == nil {
+			s.best = v
+			return nil
+		}
+		c := compareValues(v, s.best)
+		if (s.Fn == AggregateMin && c < 0) || (s.Fn == AggregateMax && c > 0) {
+			s.best = v
+		}
+	}
+	return nil
+}
+
+func (s *aggregateState) value() interface{} {
+	switch s.Fn {
+	case AggregateCount:
+		return s.count
+	case AggregateMin, AggregateMax:
+		return s.best
+	}
+	if s.count == 0 {
+		return nil
+	}
+	if s.Fn == AggregateAvg {
+		return s.sum / float64(s.count)
+	}
+	if s.integer {
+		return int64(s.sum)
+	}
+	return s.sum
+}
+
+// aggregateRows reduces a result to a single row holding the aggregates,
+// computed as the rows stream by so none of them are sent
+func aggregateRows(result *driver.QueryResult, aggregates []Aggregate) *driver.QueryResult {
+	stream := result.Stream
+	if stream == nil || len(aggregates) == 0 {
+		return result
+	}
+
+	columns := make([]string, len(aggregates))
+	for i, a := range aggregates {
+		columns[i] = a.name()
+	}
+
+	return &driver.QueryResult{
+		Columns: columns,
+		Error:   result.Error,
+		Stream: func(yield func(columns []string, row []interface{}) error) error {
+			var states []*aggregateState
+			err := stream(func(header []string, row []interface{}) error {
+				if row == nil {
+					if states != nil {
+						return nil
+					}
+					states = make([]*aggregateState, len(aggregates))
+					for i, a := range aggregates {
+						states[i] = &aggregateState{Aggregate: a, at: -1, integer: true}
+						if a.Column == "" {
+							continue
+						}
+						at, err := columnIndex(header, a.Column)
+						if err != nil {
+							return fmt.Errorf("aggregate %s: %w", a.name(), err)
+						}
+						states[i].at = at
+					}
+					return nil
+				}
+				if states == nil {
+					return errors.New("aggregate: row streamed before the column header")
+				}
+				for _, s := range states {
+					if err := s.add(row); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := yield(columns, nil); err != nil {
+				return err
+			}
+			if states == nil {
+				// No header means no rows: counts are zero, the rest null
+				states = make([]*aggregateState, len(aggregates))
+				for i, a := range aggregates {
+					states[i] = &aggregateState{Aggregate: a}
+				}
+			}
+			row := make([]interface{}, len(states))
+			for i, s := range states {
+				row[i] = s.value()
+			}
+			if err := yield(nil, row); err != nil && err != io.EOF {
+				return err
+			}
+			return nil
+		},
+	}
+}
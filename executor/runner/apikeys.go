@@ -0,0 +1,115 @@
+// runner/apikeys.go
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key so keys can be told apart from JWTs
+// and recognized by secret scanners
+const APIKeyPrefix = "sqk_"
+
+// ErrAPIKeyNotFound is returned for keys that do not exist
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey lets a machine client such as a CI job run its organization's
+// queries without a user token. Only the key's hash is stored.
+type APIKey struct {
+	ID             string `json:"id"`
+	OrganizationID string `json:"organization_id"`
+	Name           string `json:"name"`
+	KeyHash        string `json:"key_hash"`
+	// QueryIDs limits the key to these queries; empty allows every query
+	// of the organization
+	QueryIDs   []string   `json:"query_ids,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Active reports whether the key may be used at now
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// APIKeyStore resolves API keys by hash. Metadata stores that implement it
+// can authenticate machine clients.
+type APIKeyStore interface {
+	FetchAPIKey(ctx context.Context, keyHash string) (*APIKey, error)
+}
+
+// NewAPIKey generates a key, returning it and the hash to store. The key
+// itself is shown to its owner once and never stored.
+func NewAPIKey() (key string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generate API key: %w", err)
+	}
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hex SHA-256 of a key as stored in key_hash. Keys
+// are random, so a fast unsalted hash is enough.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+	return hex.EncodeToString(sum[:])
+}
+
+// FetchAPIKey retrieves an API key by hash from Supabase
+func (s *SupabaseStore) FetchAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	var keys []APIKey
+	resp, _, err := s.client.From("api_keys").Select("*", "exact", false).Eq("key_hash", keyHash).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &keys); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return &keys[0], nil
+}
+
+// PutAPIKey adds or replaces an API key
+func (s *MemoryStore) PutAPIKey(k APIKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[k.KeyHash] = k
+}
+
+// FetchAPIKey retrieves an API key by hash
+func (s *MemoryStore) FetchAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.apiKeys[keyHash]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &k, nil
+}
+
+// FetchAPIKey retrieves an API key from the underlying store. Keys are not
+// cached, so a revoked key stops working at once and no key is accepted
+// while the store is unavailable.
+func (s *CachingStore) FetchAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	keys, ok := s.store.(APIKeyStore)
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	return keys.FetchAPIKey(ctx, keyHash)
+}
@@ -0,0 +1,148 @@
+// runner/attach.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errAsyncUntracked is returned by metadata stores that do not keep async
+// executions
+var errAsyncUntracked = errors.New("the metadata store does not keep async executions")
+
+// AsyncExecution records who started an engine execution with
+// ExecuteOptions.Async, so only they can attach to it
+type AsyncExecution struct {
+	ExecutionID    string    `json:"execution_id"`
+	QueryID        string    `json:"query_id"`
+	OrganizationID string    `json:"organization_id,omitempty"`
+	UserID         string    `json:"user_id,omitempty"`
+	APIKeyID       string    `json:"api_key_id,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+}
+
+// AsyncExecutionStore keeps the executions started asynchronously.
+// Attaching to an execution requires a metadata store that implements it.
+type AsyncExecutionStore interface {
+	SaveAsyncExecution(ctx context.Context, e AsyncExecution) error
+	// FetchAsyncExecution returns ErrExecutionNotFound for executions it
+	// did not save
+	FetchAsyncExecution(ctx context.Context, executionID string) (*AsyncExecution, error)
+}
+
+// recordAsyncExecutions wraps the OnExecutionID callback to save each
+// execution the query starts with the caller that started it. An execution
+// that fails to save still streams, but cannot be attached to.
+func recordAsyncExecutions(ctx context.Context, store MetadataStore, query *Query, opts ExecuteOptions) func(string) {
+	notify := opts.OnExecutionID
+	return func(executionID string) {
+		e := AsyncExecution{ExecutionID: executionID, QueryID: query.ID, StartedAt: time.Now()}
+		if c := opts.Caller; c != nil {
+			e.OrganizationID, e.UserID, e.APIKeyID = c.OrganizationID, c.UserID, c.APIKeyID
+		}
+		err := errAsyncUntracked
+		if executions, ok := store.(AsyncExecutionStore); ok {
+			err = runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+				return executions.SaveAsyncExecution(ctx, e)
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to record async execution %s of query %s: %v", executionID, query.ID, err)
+		}
+		if notify != nil {
+			notify(executionID)
+		}
+	}
+}
+
+// fetchAsyncExecution returns the record of an execution the caller started
+// on query. Executions of other queries, users or API keys, and those never
+// recorded, are reported as not found.
+func fetchAsyncExecution(ctx context.Context, store MetadataStore, query *Query, executionID string, opts ExecuteOptions) (*AsyncExecution, error) {
+	executions, ok := store.(AsyncExecutionStore)
+	if !ok {
+		return nil, fmt.Errorf("attach execution %s: %w", executionID, ErrExecutionNotFound)
+	}
+	var e *AsyncExecution
+	err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+		var err error
+		e, err = executions.FetchAsyncExecution(ctx, executionID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("attach execution %s: %w", executionID, err)
+	}
+	c := opts.Caller
+	if e.QueryID != query.ID || (c != nil && (!c.owns(e.OrganizationID) || e.UserID != c.UserID || e.APIKeyID != c.APIKeyID)) {
+		return nil, fmt.Errorf("attach execution %s: %w", executionID, ErrExecutionNotFound)
+	}
+	return e, nil
+}
+
+// SaveAsyncExecution records an execution in Supabase
+func (s *SupabaseStore) SaveAsyncExecution(ctx context.Context, e AsyncExecution) error {
+	_, _, err := s.client.From("async_executions").Insert(e, true, "execution_id", "minimal", "").Execute()
+	return err
+}
+
+// FetchAsyncExecution retrieves an execution's record from Supabase
+func (s *SupabaseStore) FetchAsyncExecution(ctx context.Context, executionID string) (*AsyncExecution, error) {
+	var executions []AsyncExecution
+	resp, _, err := s.client.From("async_executions").Select("*", "exact", false).Eq("execution_id", executionID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &executions); err != nil {
+		return nil, err
+	}
+
+	if len(executions) == 0 {
+		return nil, ErrExecutionNotFound
+	}
+
+	return &executions[0], nil
+}
+
+// SaveAsyncExecution records an execution
+func (s *MemoryStore) SaveAsyncExecution(ctx context.Context, e AsyncExecution) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.async[e.ExecutionID] = e
+	return nil
+}
+
+// FetchAsyncExecution returns an execution's record
+func (s *MemoryStore) FetchAsyncExecution(ctx context.Context, executionID string) (*AsyncExecution, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.async[executionID]
+	if !ok {
+		return nil, ErrExecutionNotFound
+	}
+	return &e, nil
+}
+
+// SaveAsyncExecution records an execution in the underlying store
+func (s *CachingStore) SaveAsyncExecution(ctx context.Context, e AsyncExecution) error {
+	executions, ok := s.store.(AsyncExecutionStore)
+	if !ok {
+		return errAsyncUntracked
+	}
+	return executions.SaveAsyncExecution(ctx, e)
+}
+
+// FetchAsyncExecution reads an execution's record from the underlying
+// store. Records are not cached; executions cannot be attached to while the
+// store is unavailable.
+func (s *CachingStore) FetchAsyncExecution(ctx context.Context, executionID string) (*AsyncExecution, error) {
+	executions, ok := s.store.(AsyncExecutionStore)
+	if !ok {
+		return nil, ErrExecutionNotFound
+	}
+	return executions.FetchAsyncExecution(ctx, executionID)
+}
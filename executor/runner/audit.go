@@ -0,0 +1,73 @@
+// runner/audit.go
+package runner
+
+import (
+	"context"
+	"time"
+)
+
+// AuditEntry records a single execution
+type AuditEntry struct {
+	ExecutionID  string    `json:"execution_id,omitempty"`
+	QueryID      string    `json:"query_id"`
+	ConnectorID  string    `json:"connector_id,omitempty"`
+	StreamID     string    `json:"stream_id"`
+	ConnectionID string    `json:"connection_id"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	ParameterSet string    `json:"parameter_set,omitempty"` // name of the preset used, if any
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	RowsSent     int64     `json:"rows_sent"`
+	QueuedAt     time.Time `json:"queued_at"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+
+	// BytesScanned and BytesBilled are the engine's statistics, for
+	// warehouses that report them such as BigQuery and Athena
+	BytesScanned int64 `json:"bytes_scanned,omitempty"`
+	BytesBilled  int64 `json:"bytes_billed,omitempty"`
+
+	// Who ran the query, when the server authenticates callers
+	OrganizationID string `json:"organization_id,omitempty"`
+	UserID         string `json:"user_id,omitempty"`
+	APIKeyID       string `json:"api_key_id,omitempty"`
+
+	// RenderedSQL and TemplateData are what the execution ran, so it can
+	// be replayed exactly; ReplayOf is the execution a replay re-ran
+	RenderedSQL  string      `json:"rendered_sql,omitempty"`
+	TemplateData interface{} `json:"template_data,omitempty"`
+	ReplayOf     string      `json:"replay_of,omitempty"`
+	// QueryVersion is the version of the query that rendered the SQL
+	QueryVersion int `json:"query_version,omitempty"`
+
+	// Slow is set when the execution ran past its connector's slow-query
+	// threshold
+	Slow bool `json:"slow,omitempty"`
+}
+
+// AuditLog persists execution records. Metadata stores that implement it
+// are used as the server's audit log.
+type AuditLog interface {
+	RecordExecution(ctx context.Context, entry AuditEntry) error
+}
+
+// RecordExecution inserts an audit entry into the query_audit_log table
+func (s *SupabaseStore) RecordExecution(ctx context.Context, entry AuditEntry) error {
+	_, _, err := s.client.From("query_audit_log").Insert(entry, false, "", "minimal", "").Execute()
+	return err
+}
+
+// RecordExecution appends an audit entry
+func (s *MemoryStore) RecordExecution(ctx context.Context, entry AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+// AuditEntries returns the recorded audit entries, oldest first
+func (s *MemoryStore) AuditEntries() []AuditEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]AuditEntry(nil), s.audit...)
+}
@@ -0,0 +1,362 @@
+// runner/cache.go
+package runner
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Maximum number of audit entries held while the audit log is unavailable
+const maxPendingAudit = 10000
+
+// Interval between attempts to flush pending audit entries
+const auditRetryInterval = 30 * time.Second
+
+// StoreHealth describes the availability of a metadata store
+type StoreHealth struct {
+	Degraded           bool      `json:"degraded"`
+	DegradedSince      time.Time `json:"degradedSince,omitempty"`
+	LastError          string    `json:"lastError,omitempty"`
+	PendingAuditWrites int       `json:"pendingAuditWrites"`
+	DroppedAuditWrites int64     `json:"droppedAuditWrites"`
+	// Realtime is set while a change feed keeps cached metadata current
+	Realtime bool `json:"realtime,omitempty"`
+}
+
+// HealthReporter is implemented by stores that track their own availability
+type HealthReporter interface {
+	Health() StoreHealth
+}
+
+// CachingStore keeps the last known good copy of every query, connector,
+// parameter set and organization it has fetched. When the underlying store
+// fails or does not answer before the context is done, cached copies are
+// served with Stale set so hot dashboards keep working through a metadata
+// outage. Audit entries that cannot be written are queued and retried.
+type CachingStore struct {
+	store MetadataStore
+
+	mu         sync.RWMutex
+	queries    map[string]Query
+	connectors map[string]Connector
+	paramSets  map[string]ParameterSet
+	orgs       map[string]Organization
+	versions   map[string]QueryVersion
+	health     StoreHealth
+
+	// live is set while a change feed is subscribed. The rows in fresh have
+	// not changed since they were fetched; epoch counts changes so a fetch
+	// that raced one is not marked fresh.
+	live  bool
+	epoch uint64
+	fresh map[string]bool
+
+	auditMu  sync.Mutex
+	pending  []*AuditEntry
+	flushing bool
+	wake     chan struct{}
+}
+
+// NewCachingStore wraps store with a last-known-good metadata cache
+func NewCachingStore(store MetadataStore) *CachingStore {
+	return &CachingStore{
+		store:      store,
+		queries:    make(map[string]Query),
+		connectors: make(map[string]Connector),
+		paramSets:  make(map[string]ParameterSet),
+		orgs:       make(map[string]Organization),
+		versions:   make(map[string]QueryVersion),
+		fresh:      make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// FetchQuery retrieves a query, falling back to the cache when the store is
+// unavailable. Queries a change feed keeps current are served from the cache.
+func (s *CachingStore) FetchQuery(ctx context.Context, queryID string) (*Query, error) {
+	key := freshKey(tableQueries, queryID)
+	s.mu.RLock()
+	cached, ok := s.queries[queryID]
+	fresh, epoch := ok && s.fresh[key], s.epoch
+	s.mu.RUnlock()
+	if fresh {
+		return &cached, nil
+	}
+
+	q, err := fetch(ctx, func() (*Query, error) { return s.store.FetchQuery(ctx, queryID) })
+	if err == nil {
+		s.mu.Lock()
+		s.queries[queryID] = *q
+		s.keepFresh(key, epoch)
+		s.mu.Unlock()
+		s.markAvailable()
+		return q, nil
+	}
+	if errors.Is(err, ErrQueryNotFound) {
+		s.markAvailable()
+		return nil, err
+	}
+
+	s.markUnavailable(err)
+	s.mu.RLock()
+	cached, ok = s.queries[queryID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, err
+	}
+	cached.Stale = true
+	return &cached, nil
+}
+
+// FetchConnector retrieves a connector, falling back to the cache when the
+// store is unavailable. Connectors a change feed keeps current are served
+// from the cache.
+func (s *CachingStore) FetchConnector(ctx context.Context, connectorID string) (*Connector, error) {
+	key := freshKey(tableConnectors, connectorID)
+	s.mu.RLock()
+	cached, ok := s.connectors[connectorID]
+	fresh, epoch := ok && s.fresh[key], s.epoch
+	s.mu.RUnlock()
+	if fresh {
+		return &cached, nil
+	}
+
+	c, err := fetch(ctx, func() (*Connector, error) { return s.store.FetchConnector(ctx, connectorID) })
+	if err == nil {
+		s.mu.Lock()
+		s.connectors[connectorID] = *c
+		s.keepFresh(key, epoch)
+		s.mu.Unlock()
+		s.markAvailable()
+		return c, nil
+	}
+	if errors.Is(err, ErrConnectorNotFound) {
+		s.markAvailable()
+		return nil, err
+	}
+
+	s.markUnavailable(err)
+	s.mu.RLock()
+	cached, ok = s.connectors[connectorID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, err
+	}
+	cached.Stale = true
+	return &cached, nil
+}
+
+// FetchParameterSet retrieves a parameter set, falling back to the cache when the store is unavailable
+func (s *CachingStore) FetchParameterSet(ctx context.Context, queryID string, name string) (*ParameterSet, error) {
+	key := queryID + "/" + name
+	p, err := fetch(ctx, func() (*ParameterSet, error) { return s.store.FetchParameterSet(ctx, queryID, name) })
+	if err == nil {
+		s.mu.Lock()
+		s.paramSets[key] = *p
+		s.mu.Unlock()
+		s.markAvailable()
+		return p, nil
+	}
+	if errors.Is(err, ErrParameterSetNotFound) {
+		s.markAvailable()
+		return nil, err
+	}
+
+	s.markUnavailable(err)
+	s.mu.RLock()
+	cached, ok := s.paramSets[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, err
+	}
+	return &cached, nil
+}
+
+// fetch runs a store lookup, giving up when ctx is done. Lookups that ignore
+// their context finish in the background.
+func fetch[T any](ctx context.Context, lookup func() (*T, error)) (*T, error) {
+	type result struct {
+		v   *T
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		v, err := lookup()
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *CachingStore) markAvailable() {
+	s.mu.Lock()
+	recovered := s.health.Degraded
+	s.health.Degraded = false
+	s.health.DegradedSince = time.Time{}
+	s.mu.Unlock()
+
+	if recovered {
+		log.Printf("Metadata store available again")
+		s.flushAudit()
+	}
+}
+
+func (s *CachingStore) markUnavailable(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.health.Degraded {
+		log.Printf("Metadata store unavailable, serving cached metadata: %v", err)
+		s.health.Degraded = true
+		s.health.DegradedSince = time.Now()
+	}
+	s.health.LastError = err.Error()
+}
+
+// Health reports whether the store is currently serving from its cache
+func (s *CachingStore) Health() StoreHealth {
+	s.mu.RLock()
+	health := s.health
+	s.mu.RUnlock()
+
+	s.auditMu.Lock()
+	health.PendingAuditWrites = len(s.pending)
+	s.auditMu.Unlock()
+	return health
+}
+
+// CachedMetadata counts the last known good copies a CachingStore holds
+type CachedMetadata struct {
+	Queries       int `json:"queries"`
+	Connectors    int `json:"connectors"`
+	ParameterSets int `json:"parameterSets"`
+	Organizations int `json:"organizations"`
+	Versions      int `json:"versions"`
+	PendingAudit  int `json:"pendingAudit"`
+}
+
+// Cached counts the copies held for outages and the audit entries waiting
+// to be written
+func (s *CachingStore) Cached() CachedMetadata {
+	s.mu.RLock()
+	cached := CachedMetadata{
+		Queries:       len(s.queries),
+		Connectors:    len(s.connectors),
+		ParameterSets: len(s.paramSets),
+		Organizations: len(s.orgs),
+		Versions:      len(s.versions),
+	}
+	s.mu.RUnlock()
+
+	s.auditMu.Lock()
+	cached.PendingAudit = len(s.pending)
+	s.auditMu.Unlock()
+	return cached
+}
+
+// Ping checks the underlying store is reachable; stores that cannot say
+// are assumed to be
+func (s *CachingStore) Ping(ctx context.Context) error {
+	if p, ok := s.store.(StorePinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// RecordExecution writes an audit entry, queueing it for a later retry when
+// the underlying store cannot take it
+func (s *CachingStore) RecordExecution(ctx context.Context, entry AuditEntry) error {
+	audit, ok := s.store.(AuditLog)
+	if !ok {
+		return nil
+	}
+
+	if err := audit.RecordExecution(ctx, entry); err != nil {
+		s.queueAudit(entry)
+		s.markUnavailable(err)
+		return nil
+	}
+	s.flushAudit()
+	return nil
+}
+
+func (s *CachingStore) queueAudit(entry AuditEntry) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	if len(s.pending) >= maxPendingAudit {
+		// Drop the oldest entry to keep memory bounded
+		s.pending = s.pending[1:]
+		s.mu.Lock()
+		s.health.DroppedAuditWrites++
+		s.mu.Unlock()
+	}
+	s.pending = append(s.pending, &entry)
+
+	if !s.flushing {
+		s.flushing = true
+		go s.retryAudit()
+	}
+}
+
+// flushAudit starts writing queued entries if any are waiting
+func (s *CachingStore) flushAudit() {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	if len(s.pending) == 0 {
+		return
+	}
+	if !s.flushing {
+		s.flushing = true
+		go s.retryAudit()
+		return
+	}
+
+	// Cut short the backoff of a retry loop that is already running
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryAudit drains the pending queue, backing off while the store is down
+func (s *CachingStore) retryAudit() {
+	audit := s.store.(AuditLog)
+	for {
+		s.auditMu.Lock()
+		if len(s.pending) == 0 {
+			s.flushing = false
+			s.auditMu.Unlock()
+			return
+		}
+		entry := s.pending[0]
+		s.auditMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), auditRetryInterval)
+		err := audit.RecordExecution(ctx, *entry)
+		cancel()
+		if err != nil {
+			select {
+			case <-time.After(auditRetryInterval):
+			case <-s.wake:
+			}
+			continue
+		}
+
+		s.auditMu.Lock()
+		if len(s.pending) > 0 && s.pending[0] == entry {
+			s.pending = s.pending[1:]
+		}
+		s.auditMu.Unlock()
+	}
+}
@@ -0,0 +1,174 @@
+// runner/composite.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"supalytics-executor/driver"
+)
+
+// QueryTypeComposite marks a query whose content runs on an embedded DuckDB
+// database holding the results of its Sources, so one widget can blend
+// data from several connectors, e.g. Postgres accounts joined to BigQuery
+// events. Its connector_id is ignored.
+const QueryTypeComposite = "composite"
+
+// CompositeSource is a saved query a composite query reads. Its result is
+// loaded into the table Name before the composite's own content runs.
+type CompositeSource struct {
+	Name    string `json:"name"`
+	QueryID string `json:"query_id"`
+}
+
+// ErrCompositeUnsupported is returned for composite queries asked to run in
+// a way only a single connector supports
+var ErrCompositeUnsupported = errors.New("composite queries cannot run asynchronously")
+
+var sourceNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// isComposite reports whether a query joins the results of other queries
+func (q *Query) isComposite() bool {
+	return q.Type == QueryTypeComposite
+}
+
+// validateSources checks a composite query's sources can be loaded
+func validateSources(query *Query, opts ExecuteOptions) error {
+	if opts.inComposite {
+		return fmt.Errorf("composite query %s cannot be the source of another", query.ID)
+	}
+	if opts.Async {
+		return ErrCompositeUnsupported
+	}
+	if len(query.Sources) == 0 {
+		return fmt.Errorf("composite query %s has no sources", query.ID)
+	}
+	names := make(map[string]bool, len(query.Sources))
+	for _, src := range query.Sources {
+		if !sourceNamePattern.MatchString(src.Name) {
+			return fmt.Errorf("composite source name %q must be a plain identifier", src.Name)
+		}
+		if names[src.Name] {
+			return fmt.Errorf("composite source %q is declared twice", src.Name)
+		}
+		names[src.Name] = true
+		if src.QueryID == "" {
+			return fmt.Errorf("composite source %q has no query_id", src.Name)
+		}
+	}
+	return nil
+}
+
+// compositeConnector is the in-memory engine a composite query runs on
+func compositeConnector(query *Query) *Connector {
+	return &Connector{
+		ID:             QueryTypeComposite,
+		OrganizationID: query.OrganizationID,
+		Name:           "Composite",
+		Type:           string(driver.DuckDBType),
+		Config:         json.RawMessage(`{}`),
+	}
+}
+
+// sourceResult is the buffered result of a composite source
+type sourceResult struct {
+	columns []string
+	rows    *rowBuffer
+}
+
+// loadSources runs every source of a composite query concurrently with
+// the composite's template data and loads each result into a table of drv.
+// Sources run with the caller, secrets, caches and job settings of the
+// composite, but without its paging, transforms or callbacks. Their
+// buffered results share the composite's memory account, spilling to disk
+// when it allows.
+func loadSources(ctx context.Context, drv driver.Driver, query *Query, templateData interface{}, store MetadataStore, mem *memoryAccount, opts ExecuteOptions) error {
+	loader, ok := drv.(driver.TableLoader)
+	if !ok {
+		return fmt.Errorf("%w: %s cannot load tables", ErrUnsupportedType, driver.DuckDBType)
+	}
+
+	sourceOpts := ExecuteOptions{
+		Timeouts:       opts.Timeouts,
+		Constants:      opts.Constants,
+		TemplateMode:   opts.TemplateMode,
+		ValidateSQL:    opts.ValidateSQL,
+		Keyring:        opts.Keyring,
+		Secrets:        opts.Secrets,
+		ResultCache:    opts.ResultCache,
+		CacheControl:   opts.CacheControl,
+		MetadataCache:  opts.MetadataCache,
+		CacheBust:      opts.CacheBust,
+		Memory:         opts.Memory,
+		Caller:         opts.Caller,
+		JobLabels:      opts.JobLabels,
+		JobPriority:    opts.JobPriority,
+		MaxBytesBilled: opts.MaxBytesBilled,
+		inComposite:    true,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]sourceResult, len(query.Sources))
+	for i, src := range query.Sources {
+		results[i].rows = newRowBuffer(mem, fmt.Sprintf("composite source %q", src.Name))
+		defer results[i].rows.close()
+	}
+	errs := make([]error, len(query.Sources))
+	var wg sync.WaitGroup
+	for i, src := range query.Sources {
+		wg.Add(1)
+		go func(i int, src CompositeSource) {
+			defer wg.Done()
+			defer func() {
+				if errs[i] != nil {
+					cancel()
+				}
+			}()
+			defer CatchPanic(&errs[i], fmt.Sprintf("composite source %q", src.Name))
+			errs[i] = fetchSource(ctx, src, templateData, store, &results[i], sourceOpts)
+		}(i, src)
+	}
+	wg.Wait()
+
+	// The first source to fail cancels the others, so report its error
+	// rather than their cancellations
+	var failed error
+	for i, err := range errs {
+		if err != nil && (failed == nil || errors.Is(failed, context.Canceled)) {
+			failed = fmt.Errorf("composite source %q: %w", query.Sources[i].Name, err)
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	for i, src := range query.Sources {
+		if err := loader.LoadTable(ctx, src.Name, results[i].columns, results[i].rows.each); err != nil {
+			return fmt.Errorf("composite source %q: %w", src.Name, err)
+		}
+	}
+	return nil
+}
+
+// fetchSource runs a source query and buffers its result in result
+func fetchSource(ctx context.Context, src CompositeSource, templateData interface{}, store MetadataStore, result *sourceResult, opts ExecuteOptions) error {
+	sr, err := ExecuteQuery(ctx, src.QueryID, templateData, store, opts)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+
+	return sr.Stream(func(columns []string, row []interface{}) error {
+		if row == nil {
+			result.columns = columns
+			return nil
+		}
+		return result.rows.add(row)
+	})
+}
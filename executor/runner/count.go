@@ -0,0 +1,133 @@
+// runner/count.go
+package runner
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"supalytics-executor/driver"
+)
+
+// CountColumn names the single column of a count-only result
+const CountColumn = "count"
+
+// wrapCount rewrites stmt to return only the number of rows it produces. It
+// reports false when the statement cannot be wrapped as a derived table,
+// either because the engine does not speak SQL or because the statement is
+// not a query.
+func wrapCount(stmt string, typ driver.DriverType) (string, bool) {
+	if typ == driver.MockType {
+		return "", false
+	}
+
+	switch strings.ToUpper(leadingKeyword(stmt, dialectFor(typ))) {
+	case "SELECT", "WITH", "VALUES", "TABLE", "(":
+	default:
+		return "", false
+	}
+
+	// The statement sits on its own lines so a trailing line comment cannot
+	// swallow the closing parenthesis
+	alias := " AS counted"
+	if typ == driver.OracleType {
+		// Oracle rejects AS before a table alias
+		alias = " counted"
+	}
+	return fmt.Sprintf("SELECT COUNT(*) AS %s FROM (\n%s\n)%s", CountColumn, stmt, alias), true
+}
+
+// leadingKeyword returns the first word of stmt after any comments, or "("
+// when the statement opens with a parenthesised query
+func leadingKeyword(stmt string, d dialect) string {
+	for i := 0; i < len(stmt); {
+		switch {
+		case stmt[i] == ' ' || stmt[i] == '\t' || stmt[i] == '\n' || stmt[i] == '\r':
+			i++
+		case strings.HasPrefix(stmt[i:], "--"), stmt[i] == '#' && d.hashComments:
+			i = skipLine(stmt, i)
+		case strings.HasPrefix(stmt[i:], "/*"):
+			end := strings.Index(stmt[i+2:], "*/")
+			if end < 0 {
+				return ""
+			}
+			i += end + 4
+		case stmt[i] == '(':
+			return "("
+		default:
+			j := i
+			for j < len(stmt) && isIdentChar(stmt[j]) {
+				j++
+			}
+			return stmt[i:j]
+		}
+	}
+	return ""
+}
+
+// countRows reduces a result to a single count column. Results already
+// counted by the engine are passed through with the count normalised to an
+// integer; otherwise the rows are counted as they stream by.
+func countRows(result *driver.QueryResult, counted bool) *driver.QueryResult {
+	stream := result.Stream
+	columns := []string{CountColumn}
+
+	return &driver.QueryResult{
+		Columns: columns,
+		Stream: func(yield func(columns []string, row []interface{}) error) error {
+			var count int64
+			if stream == nil {
+				stream = func(func([]string, []interface{}) error) error { return nil }
+			}
+			err := stream(func(_ []string, row []interface{}) error {
+				if row == nil {
+					return nil
+				}
+				if !counted {
+					count++
+					return nil
+				}
+				if len(row) == 0 {
+					return fmt.Errorf("count query returned no columns")
+				}
+				n, err := toCount(row[0])
+				if err != nil {
+					return err
+				}
+				count = n
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := yield(columns, nil); err != nil {
+				return err
+			}
+			if err := yield(nil, []interface{}{count}); err != nil && err != io.EOF {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// toCount converts an engine's COUNT(*) value to an integer. Some engines,
+// such as Athena, return every value as a string.
+func toCount(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected count value %v (%T)", v, v)
+	}
+}
@@ -0,0 +1,265 @@
+// runner/daterange.go
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// Column types accepted by the dateRange "type" option
+const (
+	rangeColumnTimestamp = "timestamp"
+	rangeColumnDate      = "date"
+)
+
+// lastNDays matches the rolling "last_<n>_days" range names
+var lastNDays = regexp.MustCompile(`^last_(\d+)_days$`)
+
+// rangeColumn matches the column names dateRange accepts: bare identifiers,
+// optionally qualified with dots. They are written into the query as given,
+// so anything else, which could carry SQL, is rejected.
+var rangeColumn = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// dateRangeOptions are the key=value options of the dateRange helper
+type dateRangeOptions struct {
+	location   *time.Location
+	columnType string
+	start      string
+	end        string
+
+	// partition names a column the warehouse prunes partitions on. A
+	// predicate over the dates the range covers is added for it.
+	partition       string
+	partitionType   string
+	partitionFormat string
+}
+
+// dateRange renders a half-open [start, end) predicate on column for a named
+// range, in the SQL dialect of the connector. Supported names are today,
+// yesterday, last_<n>_days, this_week, last_week, this_month, last_month,
+// this_year, last_year and custom. column and the partition option must be
+// plain, optionally dot-qualified identifiers. Options are key=value strings:
+//
+//	tz=<IANA zone>         zone the range's calendar days are taken in (UTC)
+//	type=timestamp|date    type of column (timestamp)
+//	start=, end=           bounds of a custom range, as dates or RFC 3339
+//	                       times; a date end includes that whole day
+//	partition=<column>     also constrain a partition column to the range's
+//	                       dates so BigQuery and Athena can prune partitions
+//	partition_type=        date or string (date on BigQuery, string elsewhere)
+//	partition_format=      Go layout of a string partition (2006-01-02)
+func dateRange(typ driver.DriverType, now time.Time, column string, name string, options ...string) (string, error) {
+	if !rangeColumn.MatchString(column) {
+		return "", fmt.Errorf("dateRange: invalid column %q", column)
+	}
+	opts, err := parseDateRangeOptions(typ, options)
+	if err != nil {
+		return "", fmt.Errorf("dateRange: %w", err)
+	}
+
+	start, end, err := resolveDateRange(name, now.In(opts.location), opts)
+	if err != nil {
+		return "", fmt.Errorf("dateRange: %w", err)
+	}
+
+	var predicate string
+	if opts.columnType == rangeColumnDate {
+		predicate = fmt.Sprintf("%s >= %s AND %s < %s",
+			column, dateLiteral(typ, start), column, dateLiteral(typ, end))
+	} else {
+		predicate = fmt.Sprintf("%s >= %s AND %s < %s",
+			column, timestampLiteral(typ, start), column, timestampLiteral(typ, end))
+	}
+
+	// Parenthesized so the predicate composes with OR in the caller's query
+	if opts.partition == "" {
+		return "(" + predicate + ")", nil
+	}
+	return fmt.Sprintf("(%s AND %s)", partitionPredicate(typ, start, end, opts), predicate), nil
+}
+
+func parseDateRangeOptions(typ driver.DriverType, options []string) (dateRangeOptions, error) {
+	opts := dateRangeOptions{
+		location:        time.UTC,
+		columnType:      rangeColumnTimestamp,
+		partitionType:   "string",
+		partitionFormat: "2006-01-02",
+	}
+	if typ == driver.BigQueryType {
+		opts.partitionType = rangeColumnDate
+	}
+
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return opts, fmt.Errorf("option %q is not key=value", option)
+		}
+		switch key {
+		case "tz":
+			loc, err := time.LoadLocation(value)
+			if err != nil {
+				return opts, fmt.Errorf("unknown time zone %q", value)
+			}
+			opts.location = loc
+		case "type":
+			if value != rangeColumnTimestamp && value != rangeColumnDate {
+				return opts, fmt.Errorf("type must be %s or %s, got %q", rangeColumnTimestamp, rangeColumnDate, value)
+			}
+			opts.columnType = value
+		case "start":
+			opts.start = value
+		case "end":
+			opts.end = value
+		case "partition":
+			if !rangeColumn.MatchString(value) {
+				return opts, fmt.Errorf("invalid partition column %q", value)
+			}
+			opts.partition = value
+		case "partition_type":
+			if value != rangeColumnDate && value != "string" {
+				return opts, fmt.Errorf("partition_type must be date or string, got %q", value)
+			}
+			opts.partitionType = value
+		case "partition_format":
+			opts.partitionFormat = value
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return opts, nil
+}
+
+// resolveDateRange returns the bounds of a named range relative to now, whose
+// location is the range's time zone
+func resolveDateRange(name string, now time.Time, opts dateRangeOptions) (time.Time, time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Weeks start on Monday
+	week := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	year := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+
+	switch name {
+	case "today":
+		return today, today.AddDate(0, 0, 1), nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, nil
+	case "this_week":
+		return week, week.AddDate(0, 0, 7), nil
+	case "last_week":
+		return week.AddDate(0, 0, -7), week, nil
+	case "this_month":
+		return month, month.AddDate(0, 1, 0), nil
+	case "last_month":
+		return month.AddDate(0, -1, 0), month, nil
+	case "this_year":
+		return year, year.AddDate(1, 0, 0), nil
+	case "last_year":
+		return year.AddDate(-1, 0, 0), year, nil
+	case "custom":
+		return customDateRange(now.Location(), opts)
+	}
+
+	// last_<n>_days ends with today, so last_7_days is today and the six
+	// days before it
+	if m := lastNDays.FindStringSubmatch(name); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", name)
+		}
+		return today.AddDate(0, 0, 1-n), today.AddDate(0, 0, 1), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown range %q", name)
+}
+
+func customDateRange(loc *time.Location, opts dateRangeOptions) (time.Time, time.Time, error) {
+	if opts.start == "" || opts.end == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("custom range requires start and end")
+	}
+	start, _, err := parseRangeBound(opts.start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, dateOnly, err := parseRangeBound(opts.end, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if dateOnly {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range end %s is not after start %s", opts.end, opts.start)
+	}
+	return start, end, nil
+}
+
+// parseRangeBound parses a date or RFC 3339 time, reporting whether it was a
+// bare date
+func parseRangeBound(value string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid range bound %q: want YYYY-MM-DD or RFC 3339", value)
+	}
+	return t.In(loc), false, nil
+}
+
+// timestampLiteral renders an instant as a constant timestamp in UTC, which
+// every engine can compare against a column without a per-row conversion
+func timestampLiteral(typ driver.DriverType, t time.Time) string {
+	utc := t.UTC().Format("2006-01-02 15:04:05")
+	switch typ {
+	case driver.PostgresType:
+		return fmt.Sprintf("TIMESTAMPTZ '%s+00'", utc)
+	case driver.BigQueryType:
+		return fmt.Sprintf("TIMESTAMP '%s+00'", utc)
+	case driver.AthenaType:
+		return fmt.Sprintf("TIMESTAMP '%s UTC'", utc)
+	case driver.SQLServerType:
+		return fmt.Sprintf("CAST('%s' AS DATETIME2)", utc)
+	case driver.MySQLType, driver.SQLiteType:
+		return fmt.Sprintf("'%s'", utc)
+	default:
+		return fmt.Sprintf("TIMESTAMP '%s'", utc)
+	}
+}
+
+// dateLiteral renders the calendar date of t in its own time zone
+func dateLiteral(typ driver.DriverType, t time.Time) string {
+	date := t.Format("2006-01-02")
+	switch typ {
+	case driver.SQLServerType:
+		return fmt.Sprintf("CAST('%s' AS DATE)", date)
+	case driver.MySQLType, driver.SQLiteType:
+		return fmt.Sprintf("'%s'", date)
+	default:
+		return fmt.Sprintf("DATE '%s'", date)
+	}
+}
+
+// partitionPredicate constrains a partition column to the UTC dates the
+// range touches. Partitions are keyed by UTC date on both BigQuery and
+// Hive-style Athena tables, and pruning needs constants on the partition
+// column itself.
+func partitionPredicate(typ driver.DriverType, start time.Time, end time.Time, opts dateRangeOptions) string {
+	first := start.UTC()
+	last := end.UTC().Add(-time.Nanosecond)
+	if opts.columnType == rangeColumnDate {
+		// Date columns carry no time zone; their days are the partitions
+		first = start
+		last = end.AddDate(0, 0, -1)
+	}
+
+	if opts.partitionType == rangeColumnDate {
+		return fmt.Sprintf("%s BETWEEN %s AND %s",
+			opts.partition, dateLiteral(typ, first), dateLiteral(typ, last))
+	}
+	return fmt.Sprintf("%s BETWEEN '%s' AND '%s'",
+		opts.partition, first.Format(opts.partitionFormat), last.Format(opts.partitionFormat))
+}
@@ -0,0 +1,52 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+func TestDateRangeColumns(t *testing.T) {
+	now := time.Date(2024, time.March, 14, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		template string
+		data     map[string]interface{}
+		// want is the rendered SQL, or empty when rendering must fail
+		want string
+	}{
+		{"plain column", `{{ dateRange "created_at" "today" }}`, nil,
+			`(created_at >= TIMESTAMPTZ '2024-03-14 00:00:00+00' AND created_at < TIMESTAMPTZ '2024-03-15 00:00:00+00')`},
+		{"qualified column from data", `{{ dateRange .col "today" "type=date" }}`, map[string]interface{}{"col": "e.day"},
+			`(e.day >= DATE '2024-03-14' AND e.day < DATE '2024-03-15')`},
+		{"partition column", `{{ dateRange "day" "today" "type=date" "partition=dt" }}`, nil,
+			`(dt BETWEEN '2024-03-14' AND '2024-03-14' AND day >= DATE '2024-03-14' AND day < DATE '2024-03-15')`},
+		{"hostile column", `{{ dateRange .col "today" }}`, map[string]interface{}{"col": "(1=1 OR true; DROP TABLE users; --"}, ""},
+		{"quoted column", `{{ dateRange .col "today" }}`, map[string]interface{}{"col": `"created_at"`}, ""},
+		{"hostile partition", `{{ dateRange "day" "today" .partition }}`, map[string]interface{}{"partition": "partition=dt OR 1=1"}, ""},
+		{"empty qualifier", `{{ dateRange "events..day" "today" }}`, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			funcs := templateFuncs(driver.PostgresType, now, TemplateModeSQLStrict)
+			got, err := renderTemplate(tt.template, tt.data, funcs, false)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("rendered %q, want an error", got)
+				}
+				if !strings.Contains(err.Error(), "dateRange") {
+					t.Fatalf("error %v, want a dateRange error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
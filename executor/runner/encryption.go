@@ -0,0 +1,335 @@
+// runner/encryption.go
+package runner
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	kmsapi "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// Key providers that can protect connector data keys
+const (
+	KeyProviderLocal  = "local"
+	KeyProviderAWSKMS = "aws-kms"
+	KeyProviderGCPKMS = "gcp-kms"
+)
+
+// ErrNoKeyring is returned for an encrypted connector config when no
+// encryption keys are configured
+var ErrNoKeyring = errors.New("connector config is encrypted but no encryption keys are configured")
+
+// EncryptionConfig configures the keys used to decrypt connector configs.
+// Every configured provider can decrypt; Provider selects the one used to
+// encrypt new configs.
+type EncryptionConfig struct {
+	Provider string `toml:"provider"`
+
+	// LocalKey is a base64-encoded 256-bit AES key
+	LocalKey string `toml:"local_key"`
+
+	// AWSKMSKeyID is a key ID, ARN or alias of an AWS KMS key
+	AWSKMSKeyID string `toml:"aws_kms_key_id"`
+	AWSRegion   string `toml:"aws_region"`
+
+	// GCPKMSKey is a Cloud KMS crypto key resource name
+	// (projects/.../locations/.../keyRings/.../cryptoKeys/...)
+	GCPKMSKey string `toml:"gcp_kms_key"`
+}
+
+// Enabled reports whether any key is configured
+func (c EncryptionConfig) Enabled() bool {
+	return c.LocalKey != "" || c.AWSKMSKeyID != "" || c.GCPKMSKey != ""
+}
+
+// KeyWrapper encrypts and decrypts data keys with a master key
+type KeyWrapper interface {
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// envelope is the stored form of an encrypted connector config. The config
+// is sealed with a random data key, which is in turn wrapped by the
+// provider's master key.
+type envelope struct {
+	Version    int    `json:"version"`
+	Provider   string `json:"provider"`
+	Key        string `json:"key"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// sealedConfig is how an envelope appears in the connectors table
+type sealedConfig struct {
+	Envelope *envelope `json:"envelope"`
+}
+
+// Keyring decrypts connector configs using the configured key providers
+type Keyring struct {
+	provider string
+	wrappers map[string]KeyWrapper
+}
+
+// NewKeyring creates a keyring from cfg. It returns nil when no keys are
+// configured.
+func NewKeyring(ctx context.Context, cfg EncryptionConfig) (*Keyring, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	k := &Keyring{provider: cfg.Provider, wrappers: make(map[string]KeyWrapper)}
+	if cfg.LocalKey != "" {
+		wrapper, err := newLocalKeyWrapper(cfg.LocalKey)
+		if err != nil {
+			return nil, err
+		}
+		k.wrappers[KeyProviderLocal] = wrapper
+	}
+	if cfg.AWSKMSKeyID != "" {
+		wrapper, err := newAWSKMSWrapper(ctx, cfg.AWSKMSKeyID, cfg.AWSRegion)
+		if err != nil {
+			return nil, err
+		}
+		k.wrappers[KeyProviderAWSKMS] = wrapper
+	}
+	if cfg.GCPKMSKey != "" {
+		wrapper, err := newGCPKMSWrapper(ctx, cfg.GCPKMSKey)
+		if err != nil {
+			return nil, err
+		}
+		k.wrappers[KeyProviderGCPKMS] = wrapper
+	}
+
+	if k.provider == "" && len(k.wrappers) == 1 {
+		for name := range k.wrappers {
+			k.provider = name
+		}
+	}
+	if _, ok := k.wrappers[k.provider]; k.provider != "" && !ok {
+		return nil, fmt.Errorf("encryption provider %q has no key configured", k.provider)
+	}
+	return k, nil
+}
+
+// Encrypt seals a connector config. The connector ID is bound to the
+// ciphertext so an envelope cannot be copied to another connector.
+func (k *Keyring) Encrypt(ctx context.Context, connectorID string, config json.RawMessage) (json.RawMessage, error) {
+	wrapper, ok := k.wrappers[k.provider]
+	if !ok {
+		return nil, fmt.Errorf("no encryption provider selected")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	nonce, ciphertext, err := seal(key, config, []byte(connectorID))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapper.WrapKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key with %s: %w", k.provider, err)
+	}
+
+	return json.Marshal(sealedConfig{Envelope: &envelope{
+		Version:    1,
+		Provider:   k.provider,
+		Key:        base64.StdEncoding.EncodeToString(wrapped),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}})
+}
+
+// Decrypt returns the plaintext of an encrypted connector config. Configs
+// that are not encrypted are returned unchanged, and a nil keyring only
+// accepts those.
+func (k *Keyring) Decrypt(ctx context.Context, connectorID string, config json.RawMessage) (json.RawMessage, error) {
+	var sealed sealedConfig
+	if err := json.Unmarshal(config, &sealed); err != nil || sealed.Envelope == nil {
+		return config, nil
+	}
+	if k == nil {
+		return nil, ErrNoKeyring
+	}
+
+	env := sealed.Envelope
+	if env.Version != 1 {
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	wrapper, ok := k.wrappers[env.Provider]
+	if !ok {
+		return nil, fmt.Errorf("no key configured for encryption provider %q", env.Provider)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(env.Key)
+	if err != nil {
+		return nil, fmt.Errorf("decode data key: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("decode nonce: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decode ciphertext: %w", err)
+	}
+
+	key, err := wrapper.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key with %s: %w", env.Provider, err)
+	}
+	plaintext, err := open(key, nonce, ciphertext, []byte(connectorID))
+	if err != nil {
+		return nil, fmt.Errorf("open envelope: %w", err)
+	}
+	return plaintext, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM under key
+func seal(key []byte, plaintext []byte, additional []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, additional), nil
+}
+
+// open decrypts a ciphertext produced by seal
+func open(key []byte, nonce []byte, ciphertext []byte, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	return gcm.Open(nil, nonce, ciphertext, additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// localKeyWrapper wraps data keys with a master key held in the config file
+type localKeyWrapper struct {
+	key []byte
+}
+
+func newLocalKeyWrapper(encoded string) (*localKeyWrapper, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode local key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("local key must be 32 bytes, got %d", len(key))
+	}
+	return &localKeyWrapper{key: key}, nil
+}
+
+func (w *localKeyWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	nonce, ciphertext, err := seal(w.key, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ciphertext...), nil
+}
+
+func (w *localKeyWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	gcm, err := newGCM(w.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	return gcm.Open(nil, wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():], nil)
+}
+
+// awsKMSWrapper wraps data keys with an AWS KMS key
+type awsKMSWrapper struct {
+	client *kms.Client
+	keyID  string
+}
+
+func newAWSKMSWrapper(ctx context.Context, keyID string, region string) (*awsKMSWrapper, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	if region != "" {
+		cfg.Region = region
+	}
+	return &awsKMSWrapper{client: kms.NewFromConfig(cfg), keyID: keyID}, nil
+}
+
+func (w *awsKMSWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	out, err := w.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(w.keyID),
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (w *awsKMSWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := w.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(w.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// gcpKMSWrapper wraps data keys with a Cloud KMS crypto key
+type gcpKMSWrapper struct {
+	client *kmsapi.KeyManagementClient
+	name   string
+}
+
+func newGCPKMSWrapper(ctx context.Context, name string) (*gcpKMSWrapper, error) {
+	client, err := kmsapi.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create Cloud KMS client: %w", err)
+	}
+	return &gcpKMSWrapper{client: client, name: name}, nil
+}
+
+func (w *gcpKMSWrapper) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := w.client.Encrypt(ctx, &kmspb.EncryptRequest{Name: w.name, Plaintext: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (w *gcpKMSWrapper) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := w.client.Decrypt(ctx, &kmspb.DecryptRequest{Name: w.name, Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
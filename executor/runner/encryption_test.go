@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// testKey is a local master key for the keyring tests
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     EncryptionConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{"no keys", EncryptionConfig{}, true, false},
+		{"local key", EncryptionConfig{LocalKey: testKey}, false, false},
+		{"local key selected", EncryptionConfig{Provider: KeyProviderLocal, LocalKey: testKey}, false, false},
+		{"key not base64", EncryptionConfig{LocalKey: "not base64!"}, false, true},
+		{"short key", EncryptionConfig{LocalKey: base64.StdEncoding.EncodeToString([]byte("short"))}, false, true},
+		{"provider without a key", EncryptionConfig{Provider: KeyProviderAWSKMS, LocalKey: testKey}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKeyring(context.Background(), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKeyring = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (k == nil) != tt.wantNil {
+				t.Errorf("NewKeyring = %v, want nil %v", k, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	k, err := NewKeyring(ctx, EncryptionConfig{LocalKey: testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := json.RawMessage(`{"host":"db","password":"hunter2"}`)
+	sealed, err := k.Encrypt(ctx, "connector-1", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("hunter2")) {
+		t.Fatalf("sealed config %s holds the plaintext", sealed)
+	}
+
+	other, err := NewKeyring(ctx, EncryptionConfig{LocalKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		keyring     *Keyring
+		connectorID string
+		config      json.RawMessage
+		// want is the decrypted config; nil when decrypting fails
+		want json.RawMessage
+	}{
+		{"same connector", k, "connector-1", sealed, config},
+		{"plain config passes through", k, "connector-1", config, config},
+		{"plain config without a keyring", nil, "connector-1", config, config},
+		{"sealed config without a keyring", nil, "connector-1", sealed, nil},
+		{"copied to another connector", k, "connector-2", sealed, nil},
+		{"another master key", other, "connector-1", sealed, nil},
+		{"unknown version", k, "connector-1", json.RawMessage(`{"envelope":{"version":2,"provider":"local"}}`), nil},
+		{"unknown provider", k, "connector-1", json.RawMessage(`{"envelope":{"version":1,"provider":"vault"}}`), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.keyring.Decrypt(ctx, tt.connectorID, tt.config)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("Decrypt = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("Decrypt = %s, %v; want %s", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := (*Keyring)(nil).Decrypt(ctx, "connector-1", sealed); !errors.Is(err, ErrNoKeyring) {
+		t.Errorf("Decrypt without a keyring = %v, want %v", err, ErrNoKeyring)
+	}
+}
@@ -0,0 +1,96 @@
+// runner/errors.go
+package runner
+
+import (
+	"context"
+	"errors"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+)
+
+// TemplateError is a query template that could not be rendered
+type TemplateError struct {
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return "render template: " + e.Err.Error()
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the protocol error code an execution error falls under,
+// or "" for one the runner cannot place
+func ErrorCode(err error) string {
+	var timeout *TimeoutError
+	if errors.As(err, &timeout) {
+		return timeout.Code()
+	}
+	var classified *driver.Error
+	var template *TemplateError
+	var panicked *PanicError
+	switch {
+	case errors.As(err, &panicked):
+		return protocol.ErrorCodeInternal
+	case errors.As(err, &classified):
+		return classified.Code
+	case errors.Is(err, context.Canceled):
+		return protocol.ErrorCodeCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return protocol.ErrorCodeTimeout
+	case errors.As(err, &template):
+		return protocol.ErrorCodeTemplate
+	case errors.Is(err, ErrQueryNotFound), errors.Is(err, ErrQueryVersionNotFound), errors.Is(err, ErrExecutionNotFound):
+		return protocol.ErrorCodeQueryNotFound
+	case errors.Is(err, ErrConnectorNotFound):
+		return protocol.ErrorCodeConnectorNotFound
+	case errors.Is(err, ErrParameterSetNotFound), errors.Is(err, ErrAsyncUnsupported):
+		return protocol.ErrorCodeInvalidRequest
+	}
+	return ""
+}
+
+// classifyError describes an error the driver returned with the driver's
+// ErrorClassifier, or as fallback when the driver does not recognize it.
+// Cancellations and timeouts are left as they are.
+func classifyError(drv driver.Driver, err error, fallback string) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var classified *driver.Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	if ec, ok := drv.(driver.ErrorClassifier); ok {
+		if classified := ec.ClassifyError(err); classified != nil {
+			return classified
+		}
+	}
+	return &driver.Error{Code: fallback, Err: err}
+}
+
+// classifyStream classifies the errors a result's stream ends with, other
+// than those returned by its consumer
+func classifyStream(result *driver.QueryResult, drv driver.Driver) *driver.QueryResult {
+	stream := result.Stream
+	if stream == nil {
+		return result
+	}
+
+	classified := *result
+	classified.Stream = func(yield func(columns []string, row []interface{}) error) error {
+		var yieldErr error
+		err := stream(func(columns []string, row []interface{}) error {
+			yieldErr = yield(columns, row)
+			return yieldErr
+		})
+		if err == nil || (yieldErr != nil && errors.Is(err, yieldErr)) {
+			return err
+		}
+		return classifyError(drv, err, protocol.ErrorCodeEngine)
+	}
+	return &classified
+}
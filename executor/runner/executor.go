@@ -7,15 +7,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"sync"
 	"text/template"
 	"time"
 
 	"supalytics-executor/driver"
 	"supalytics-executor/drivers/athena"
 	"supalytics-executor/drivers/bigquery"
+	"supalytics-executor/drivers/duckdb"
+	"supalytics-executor/drivers/mock"
 	"supalytics-executor/drivers/postgres"
-
-	"github.com/supabase-community/supabase-go"
+	"supalytics-executor/protocol"
 )
 
 // Common errors
@@ -23,6 +26,10 @@ var (
 	ErrQueryNotFound     = errors.New("query not found")
 	ErrConnectorNotFound = errors.New("connector not found")
 	ErrUnsupportedType   = errors.New("unsupported connector type")
+	ErrAsyncUnsupported  = errors.New("connector does not support async execution")
+
+	ErrParameterSetNotFound = errors.New("parameter set not found")
+	ErrOrganizationNotFound = errors.New("organization not found")
 )
 
 // init registers all available driver factories
@@ -30,6 +37,8 @@ func init() {
 	driver.Register(driver.PostgresType, postgres.New)
 	driver.Register(driver.BigQueryType, bigquery.New)
 	driver.Register(driver.AthenaType, athena.New)
+	driver.Register(driver.MockType, mock.New)
+	driver.Register(driver.DuckDBType, duckdb.New)
 }
 
 // Connector represents a database connection configuration
@@ -43,6 +52,21 @@ type Connector struct {
 	LastConnectionCheck time.Time       `json:"last_connection_check"`
 	CreatedAt           time.Time       `json:"created_at"`
 	UpdatedAt           time.Time       `json:"updated_at"`
+
+	// TemplateDefaults are template variables for every query run on the
+	// connector, e.g. a schema prefix that differs between environments
+	TemplateDefaults map[string]interface{} `json:"template_defaults,omitempty"`
+
+	// ReadOnly rejects queries that modify data or schema before they run,
+	// and makes the sessions of engines that support it read-only
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// Pinned keeps connected drivers ready for the connector, see WarmPool
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Stale is set when the connector was served from a cache because the
+	// metadata store was unavailable
+	Stale bool `json:"-"`
 }
 
 // Query represents a database query configuration
@@ -54,22 +78,223 @@ type Query struct {
 	Content        string    `json:"content"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
+
+	// ResultCacheTTL is how many seconds the query's results are cached
+	// for. Zero uses the server's TTL and a negative value disables
+	// caching for the query.
+	ResultCacheTTL int `json:"result_cache_ttl,omitempty"`
+
+	// SnapshotFormat stores every result of the query in object storage as
+	// csv or parquet, unless the request asks for another format
+	SnapshotFormat string `json:"snapshot_format,omitempty"`
+
+	// Parameters is the schema template data is validated against before
+	// the query renders; unset accepts any template data
+	Parameters []ParameterSpec `json:"parameters,omitempty"`
+
+	// TemplateEngine is the syntax the query is written in: go (default)
+	// or jinja
+	TemplateEngine string `json:"template_engine,omitempty"`
+
+	// TemplateMode decides how template data is written into the query:
+	// text, sql or sql_strict. Empty uses the server's default.
+	TemplateMode string `json:"template_mode,omitempty"`
+
+	// Transforms post-process every result of the query before any the
+	// request adds
+	Transforms []Transform `json:"transforms,omitempty"`
+
+	// Type is empty for queries run on their connector, or composite for
+	// queries that join the results of Sources on an embedded engine
+	Type    string            `json:"type,omitempty"`
+	Sources []CompositeSource `json:"sources,omitempty"`
+
+	// Timezone is the IANA time zone, e.g. "Europe/Paris", the query's
+	// timestamps are rendered in unless the request names another
+	Timezone string `json:"timezone,omitempty"`
+
+	// Version is the number of the query's current version, or of the
+	// version an execution was pinned to; zero for unversioned queries
+	Version int `json:"version,omitempty"`
+
+	// Stale is set when the query was served from a cache because the
+	// metadata store was unavailable
+	Stale bool `json:"-"`
+}
+
+// Caller identifies who an execution runs for
+type Caller struct {
+	UserID         string
+	OrganizationID string
+	// QueryIDs limits the caller to these queries, as for a scoped API
+	// key; empty allows every query of the organization
+	QueryIDs []string
+
+	// Email, Role, APIKeyID and Claims describe the caller to templates
+	// through the reserved User variable
+	Email    string
+	Role     string
+	APIKeyID string
+	Claims   map[string]interface{}
+}
+
+// ParameterSet is a named template data preset saved for a query
+type ParameterSet struct {
+	ID        string                 `json:"id"`
+	QueryID   string                 `json:"query_id"`
+	Name      string                 `json:"name"`
+	Values    map[string]interface{} `json:"values"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
 }
 
 // StreamResult wraps a query result and its associated driver
 type StreamResult struct {
 	driver.Result
-	drv driver.Driver
+	drv      driver.Driver
+	watchdog *watchdog
+	pager    *pager
+	sampler  *sampler
+	closed   sync.Once
+
+	// recorder collects the rows for the result cache
+	recorder *resultRecorder
+	// cached is the cache entry a result is replayed from
+	cached *CachedResult
+	// snapshot writes the result to object storage
+	snapshot *snapshotWriter
 }
 
-// Close closes the underlying driver connection
-func (sr *StreamResult) Close() error {
-	if sr.drv != nil {
-		return sr.drv.Close()
+// Snapshot returns the result's snapshot in object storage once it has
+// streamed in full, or nil when none was asked for
+func (sr *StreamResult) Snapshot() *Snapshot {
+	return sr.snapshot.Snapshot()
+}
+
+// FromCache reports whether the result is replayed from the result cache
+// rather than read from the engine, and when it was cached
+func (sr *StreamResult) FromCache() (bool, time.Time) {
+	if sr.cached == nil {
+		return false, time.Time{}
+	}
+	return true, sr.cached.CachedAt
+}
+
+// Truncated reports whether the result continued past the requested page.
+// It is known once the result has been streamed.
+func (sr *StreamResult) Truncated() bool {
+	return sr.pager != nil && sr.pager.truncated.Load()
+}
+
+// Sample reports the sample the result was reduced to, or nil when none was
+// asked for. It is known once the result has been streamed.
+func (sr *StreamResult) Sample() *SampleInfo {
+	return sr.sampler.Info()
+}
+
+// ColumnInfo describes each of the columns as the engine declared it, with
+// a zero ColumnInfo for a column it says nothing about, such as one a
+// transform added; nil altogether when it declares nothing. It is known
+// once the result has yielded its columns.
+func (sr *StreamResult) ColumnInfo(columns []string) []driver.ColumnInfo {
+	declared := sr.columnInfo()
+	if len(declared) == 0 {
+		return nil
+	}
+	out := make([]driver.ColumnInfo, len(columns))
+	for i, col := range columns {
+		out[i] = declared[col]
+	}
+	return out
+}
+
+// columnInfo returns what the engine declared about the columns, by name
+func (sr *StreamResult) columnInfo() map[string]driver.ColumnInfo {
+	if sr.cached != nil {
+		return sr.cached.ColumnInfo
+	}
+	if cr, ok := sr.drv.(driver.ColumnReporter); ok {
+		return cr.ColumnInfo()
 	}
 	return nil
 }
 
+// Stream iterates over the result set, enforcing the streaming timeouts. A
+// result streamed in full is written to the result cache when it is being
+// recorded, and uploaded when a snapshot was asked for.
+func (sr *StreamResult) Stream(callback func(columns []string, row []interface{}) error) error {
+	if sr.recorder == nil && sr.snapshot == nil {
+		return sr.stream(callback)
+	}
+
+	err := sr.stream(func(columns []string, row []interface{}) error {
+		if err := callback(columns, row); err != nil {
+			return err
+		}
+		if sr.recorder != nil {
+			sr.recorder.record(columns, row)
+		}
+		if sr.snapshot != nil {
+			if err := sr.snapshot.write(columns, row); err != nil {
+				return fmt.Errorf("write snapshot: %w", err)
+			}
+		}
+		return nil
+	})
+	if sr.recorder != nil {
+		if err == nil {
+			sr.recorder.store(sr.Truncated(), sr.Sample(), sr.columnInfo())
+		} else {
+			sr.recorder.release()
+		}
+	}
+	if sr.snapshot != nil {
+		if err == nil {
+			if err = sr.snapshot.finish(sr.columnInfo()); err != nil {
+				err = fmt.Errorf("store snapshot: %w", err)
+			}
+		} else {
+			sr.snapshot.discard()
+		}
+	}
+	return err
+}
+
+func (sr *StreamResult) stream(callback func(columns []string, row []interface{}) error) error {
+	if sr.watchdog == nil {
+		return sr.Result.Stream(callback)
+	}
+	defer sr.watchdog.stop()
+
+	err := sr.Result.Stream(func(columns []string, row []interface{}) error {
+		if row == nil {
+			return callback(columns, row)
+		}
+		sr.watchdog.rowReceived()
+		defer sr.watchdog.rowHandled()
+		return callback(columns, row)
+	})
+	return timeoutCause(sr.watchdog.ctx, err)
+}
+
+// Close closes the underlying driver connection. It is safe to call more
+// than once, including while the result is still streaming.
+func (sr *StreamResult) Close() error {
+	var err error
+	sr.closed.Do(func() {
+		// A result closed before it finished streaming caches nothing
+		sr.recorder.release()
+		sr.snapshot.discard()
+		if sr.watchdog != nil {
+			sr.watchdog.stop()
+		}
+		if sr.drv != nil {
+			err = sr.drv.Close()
+		}
+	})
+	return err
+}
+
 // queryResultWrapper adapts driver.QueryResult to driver.Result
 type queryResultWrapper struct {
 	qr *driver.QueryResult
@@ -82,90 +307,789 @@ func (q *queryResultWrapper) Stream(callback func(columns []string, row []interf
 	return q.qr.Stream(callback)
 }
 
+// StatementEvent reports progress through a multi-statement query
+type StatementEvent struct {
+	Index    int           `json:"index"` // 1-based position of the statement
+	Total    int           `json:"total"`
+	State    string        `json:"state"` // "running" or "completed"
+	Duration time.Duration `json:"-"`
+}
+
+// ExecuteOptions carries optional hooks and settings for a single execution
+type ExecuteOptions struct {
+	// OnResolved is invoked once the query and its connector have been fetched
+	OnResolved func(query *Query, connector *Connector)
+
+	// OnConnected is invoked once the driver has connected
+	OnConnected func()
+
+	// OnProgressReporter receives the connected driver when it reports the
+	// progress of its queries
+	OnProgressReporter func(driver.ProgressReporter)
+
+	// OnCanceller receives the connected driver when its engine has to be
+	// told to stop a query the execution gives up on
+	OnCanceller func(driver.Canceller)
+
+	// OnRendered is invoked with the SQL the query rendered to and the
+	// template data it was rendered with, less the reserved User variable
+	// describing the caller
+	OnRendered func(sql string, templateData interface{})
+
+	// OnStatement is invoked as each statement of a multi-statement query
+	// starts and finishes. It is not called for single-statement queries.
+	OnStatement func(StatementEvent)
+
+	// Async submits the final statement without waiting for it and reports
+	// the engine's execution ID through OnExecutionID before streaming. The
+	// execution is recorded in an AsyncExecutionStore with its caller, who
+	// can resume it later with AttachExecution.
+	Async         bool
+	OnExecutionID func(executionID string)
+
+	// Timeouts bounds each phase of the execution
+	Timeouts Timeouts
+
+	// ParameterSet names a saved preset whose values are used as template
+	// data. Keys in the request's template data override the preset.
+	ParameterSet string
+
+	// Constants are server-side template variables. They take precedence
+	// over every other source so requests cannot override them.
+	Constants map[string]interface{}
+
+	// TemplateMode is the template mode of queries that do not set their
+	// own; empty means TemplateModeText
+	TemplateMode string
+
+	// ValidateSQL checks the rendered query with ValidateSQL before it
+	// runs. Queries on read-only connectors are always checked.
+	ValidateSQL bool
+
+	// CountOnly wraps the final statement in SELECT COUNT(*) so the result
+	// is a single CountColumn row instead of the full result set
+	CountOnly bool
+
+	// Limit and Offset return one page of the result set. The final
+	// statement is wrapped so the engine skips and limits rows where the
+	// dialect allows it; otherwise rows outside the page are dropped as
+	// they stream. A Limit of 0 means no limit.
+	Limit  int64
+	Offset int64
+
+	// Transforms post-process the result set after the query's own
+	// transforms and after paging. They do not apply to CountOnly.
+	Transforms []Transform
+
+	// Aggregates reduce the result to a single row of aggregates computed
+	// as it streams, after the transforms
+	Aggregates []Aggregate
+
+	// Sample thins the result to every Nth row or a random sample of K
+	// rows, after the transforms
+	Sample *Sample
+
+	// PreviewRows fetches at most this many rows for a preview by adding a
+	// row limit to the final statement. It takes the place of Limit and
+	// Offset.
+	PreviewRows int64
+
+	// Keyring decrypts connector configs stored as encryption envelopes
+	Keyring *Keyring
+
+	// Secrets resolves "vault:<path>#<key>" references in connector configs
+	Secrets SecretResolver
+
+	// ResultCache serves repeated read-only queries from earlier results.
+	// CacheControl is CacheUse (the default), CacheBypass or CacheRefresh.
+	ResultCache  *ResultCache
+	CacheControl string
+
+	// WarmPool hands out drivers connected ahead of time to pinned
+	// connectors
+	WarmPool *WarmPool
+
+	// MetadataCache reuses recently fetched queries and connectors;
+	// CacheBust fetches them from the store again
+	MetadataCache *MetadataCache
+	CacheBust     bool
+
+	// Snapshots stores the full result set in object storage once it has
+	// streamed, in SnapshotFormat (csv or parquet). Without a format the
+	// query's own SnapshotFormat applies.
+	Snapshots      *Snapshots
+	SnapshotFormat string
+
+	// Replay re-runs an earlier execution of the query, by its ID in the
+	// audit log, with the SQL and template data it ran with instead of
+	// rendering the query's current template
+	Replay string
+
+	// QueryVersion renders this saved version of the query's template
+	// instead of the current one; zero runs the current version
+	QueryVersion int
+
+	// Timezone is the IANA time zone timestamps are rendered in, and the
+	// session time zone on engines that have one, in place of the query's
+	Timezone string
+
+	// ResultReuse lets engines that keep recent results serve the query
+	// from an identical one run within this age, in place of the
+	// connector's setting; negative turns reuse off and zero keeps the
+	// connector's setting
+	ResultReuse time.Duration
+
+	// JobLabels, JobPriority and MaxBytesBilled set up the jobs of engines
+	// that run queries as jobs, such as BigQuery: labels added to the
+	// connector's and the runner's organization and query labels, an
+	// interactive or batch priority in place of the connector's, and a
+	// maximum of bytes billed that can only lower the connector's
+	JobLabels      map[string]string
+	JobPriority    string
+	MaxBytesBilled int64
+
+	// Memory bounds the rows the execution buffers rather than streams,
+	// spilling them to disk or failing with ErrMemoryBudgetExceeded
+	Memory MemoryConfig
+
+	// Caller restricts the execution to queries and connectors of the
+	// caller's organization. Those of other organizations are reported as
+	// not found so their IDs cannot be probed. Without a caller every query
+	// runs, as for trusted internal callers.
+	Caller *Caller
+
+	// inComposite is set for the sources of a composite query, which may
+	// not be composite themselves
+	inComposite bool
+}
+
 // ExecuteQuery processes and runs a query, returning a streaming result
-func ExecuteQuery(ctx context.Context, queryID string, templateData interface{}, supaClient *supabase.Client) (*StreamResult, error) {
-	query, err := fetchQuery(ctx, queryID, supaClient)
+func ExecuteQuery(ctx context.Context, queryID string, templateData interface{}, store MetadataStore, opts ExecuteOptions) (*StreamResult, error) {
+	query, err := fetchQuery(ctx, store, queryID, opts)
 	if err != nil {
-		return nil, fmt.Errorf("fetch query: %w", err)
+		return nil, err
+	}
+	if opts.QueryVersion > 0 && opts.Replay == "" {
+		if err := pinVersion(ctx, store, query, opts); err != nil {
+			return nil, err
+		}
 	}
 
-	finalQuery, err := renderTemplate(query.Content, templateData)
+	connector, err := fetchConnector(ctx, store, query, opts)
 	if err != nil {
-		return nil, fmt.Errorf("render template: %w", err)
+		return nil, err
 	}
-
-	connector, err := fetchConnector(ctx, query.ConnectorID, supaClient)
+	if query.isComposite() {
+		if err := validateSources(query, opts); err != nil {
+			return nil, err
+		}
+	}
+	transforms, err := compileTransforms(queryTransforms(query, opts))
 	if err != nil {
-		return nil, fmt.Errorf("fetch connector: %w", err)
+		return nil, err
+	}
+	loc, err := timezoneFor(query, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	drv, err := createDriver(connector)
+	var finalQuery string
+	if opts.Replay != "" {
+		entry, err := fetchReplay(ctx, store, query, opts)
+		if err != nil {
+			return nil, err
+		}
+		finalQuery, templateData = entry.RenderedSQL, entry.TemplateData
+	} else {
+		templateData, err = resolveTemplateData(ctx, store, query, connector, templateData, opts)
+		if err != nil {
+			return nil, err
+		}
+		templateData, err = validateParameters(query.Parameters, templateData)
+		if err != nil {
+			return nil, err
+		}
+
+		mode, err := templateMode(query, opts)
+		if err != nil {
+			return nil, &TemplateError{Err: err}
+		}
+		engine, err := templateEngine(query, mode)
+		if err != nil {
+			return nil, &TemplateError{Err: err}
+		}
+
+		// Missing keys are an error once a preset defines what the query needs
+		strict := opts.ParameterSet != ""
+		err = runPhase(ctx, PhaseRender, opts.Timeouts.Render, func(ctx context.Context) error {
+			var err error
+			funcs := templateFuncs(driver.DriverType(connector.Type), time.Now(), mode)
+			finalQuery, err = renderTemplateContext(ctx, engine, query.Content, templateData, funcs, strict)
+			return err
+		})
+		if err != nil {
+			return nil, &TemplateError{Err: err}
+		}
+	}
+	if opts.OnRendered != nil {
+		opts.OnRendered(finalQuery, withoutUser(templateData))
+	}
+	if opts.ValidateSQL || connector.ReadOnly {
+		if err := ValidateSQL(finalQuery, driver.DriverType(connector.Type), connector.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot, err := newSnapshotWriter(ctx, query, opts)
 	if err != nil {
-		return nil, fmt.Errorf("create driver: %w", err)
+		return nil, err
 	}
 
-	// Connect and execute query
-	if err := drv.Connect(ctx); err != nil {
+	mem := newMemoryAccount(opts.Memory)
+	var recorder *resultRecorder
+	// The sources of a composite query are cached on their own, as its SQL
+	// does not identify the data they return
+	if cache := opts.ResultCache; cache != nil && opts.CacheControl != CacheBypass && !opts.Async && !query.isComposite() {
+		ttl := cache.ttlFor(query)
+		if ttl > 0 && cacheable(finalQuery, driver.DriverType(connector.Type)) {
+			key := resultCacheKey(query, connector, finalQuery, opts)
+			var claimed bool
+			if opts.CacheControl != CacheRefresh {
+				cached, hit, c := cache.lookup(ctx, key)
+				if hit {
+					sr := cachedStream(cached)
+					sr.snapshot = snapshot
+					return sr, nil
+				}
+				claimed = c
+			}
+			recorder = &resultRecorder{cache: cache, key: key, ttl: ttl, claimed: claimed, mem: mem}
+		}
+	}
+
+	drv, err := connect(ctx, connector, opts)
+	if err != nil {
+		recorder.release()
+		return nil, err
+	}
+	if query.isComposite() {
+		if err := loadSources(ctx, drv, query, templateData, store, mem, opts); err != nil {
+			drv.Close()
+			return nil, err
+		}
+	}
+	if err := setSessionTimezone(ctx, drv, loc); err != nil {
+		recorder.release()
 		drv.Close()
-		return nil, fmt.Errorf("connect: %w", err)
+		return nil, err
+	}
+	if r, ok := drv.(driver.ResultReuser); ok && opts.ResultReuse != 0 {
+		r.ReuseResults(opts.ResultReuse)
+	}
+	if err := configureJobs(drv, query, opts); err != nil {
+		recorder.release()
+		drv.Close()
+		return nil, err
+	}
+	if opts.OnConnected != nil {
+		opts.OnConnected()
+	}
+	if pr, ok := drv.(driver.ProgressReporter); ok && opts.OnProgressReporter != nil {
+		opts.OnProgressReporter(pr)
+	}
+	if c, ok := drv.(driver.Canceller); ok && opts.OnCanceller != nil {
+		opts.OnCanceller(c)
 	}
 
-	result, err := drv.Query(ctx, finalQuery)
+	if opts.Async {
+		opts.OnExecutionID = recordAsyncExecutions(ctx, store, query, opts)
+	}
+	w := newWatchdog(ctx, opts.Timeouts)
+	pg := newPager(opts)
+	smp := newSampler(opts, mem)
+	result, err := runStatements(w.ctx, drv, driver.DriverType(connector.Type), finalQuery, pg, opts)
 	if err != nil {
+		recorder.release()
+		w.stop()
 		drv.Close()
-		return nil, fmt.Errorf("execute query: %w", err)
+		return nil, timeoutCause(w.ctx, err)
 	}
+	result = convertTimezone(classifyStream(result, drv), loc)
 
 	return &StreamResult{
-		Result: &queryResultWrapper{qr: result},
-		drv:    drv,
+		Result:   &queryResultWrapper{qr: aggregateRows(smp.apply(applyTransforms(result, transforms, mem)), opts.Aggregates)},
+		drv:      drv,
+		watchdog: w,
+		pager:    pg,
+		sampler:  smp,
+		recorder: recorder,
+		snapshot: snapshot,
 	}, nil
 }
 
-// fetchQuery retrieves a query by ID from Supabase
-func fetchQuery(ctx context.Context, queryID string, client *supabase.Client) (*Query, error) {
-	var queries []Query
-	resp, _, err := client.From("queries").Select("*", "exact", false).Eq("id", queryID).Execute()
+// cachedStream replays a cached result
+func cachedStream(cached *CachedResult) *StreamResult {
+	pg := &pager{}
+	pg.truncated.Store(cached.Truncated)
+	var smp *sampler
+	if cached.Sample != nil {
+		smp = &sampler{}
+		smp.info.Store(cached.Sample)
+	}
+	return &StreamResult{
+		Result:  &cachedRows{result: cached},
+		pager:   pg,
+		sampler: smp,
+		cached:  cached,
+	}
+}
+
+// fetchQuery loads a query from the metadata cache, or from the store
+// within the metadata timeout
+func fetchQuery(ctx context.Context, store MetadataStore, queryID string, opts ExecuteOptions) (*Query, error) {
+	query, cached := opts.MetadataCache.query(queryID)
+	if !cached || opts.CacheBust {
+		err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+			var err error
+			query, err = store.FetchQuery(ctx, queryID)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetch query: %w", err)
+		}
+		opts.MetadataCache.putQuery(query)
+	}
+	if !opts.Caller.owns(query.OrganizationID) || !opts.Caller.allows(query.ID) {
+		return nil, fmt.Errorf("fetch query: %w", ErrQueryNotFound)
+	}
+	return query, nil
+}
+
+// LoadQuery retrieves a query the caller may run, within the metadata
+// timeout
+func LoadQuery(ctx context.Context, store MetadataStore, queryID string, opts ExecuteOptions) (*Query, error) {
+	return fetchQuery(ctx, store, queryID, opts)
+}
+
+// owns reports whether a caller may use a resource of the organization.
+// Resources without an organization belong to nobody.
+func (c *Caller) owns(organizationID string) bool {
+	return c == nil || (organizationID != "" && organizationID == c.OrganizationID)
+}
+
+// allows reports whether a caller's query scope includes the query
+func (c *Caller) allows(queryID string) bool {
+	if c == nil || len(c.QueryIDs) == 0 {
+		return true
+	}
+	return slices.Contains(c.QueryIDs, queryID)
+}
+
+// resolveTemplateData layers the template variables for a run, each source
+// overriding the ones before it: organization defaults, connector defaults,
+// the named parameter set, the request's template data and the server's
+// constants. Finally the reserved User variable is set from the caller, or
+// removed for runs without one, so no other source can spoof it. Request
+// data is passed through unchanged when no other source applies.
+func resolveTemplateData(ctx context.Context, store MetadataStore, query *Query, connector *Connector, templateData interface{}, opts ExecuteOptions) (interface{}, error) {
+	orgDefaults, err := organizationDefaults(ctx, store, query, connector, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := json.Unmarshal(resp, &queries); err != nil {
+	var preset map[string]interface{}
+	if opts.ParameterSet != "" {
+		var set *ParameterSet
+		err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+			var err error
+			set, err = store.FetchParameterSet(ctx, query.ID, opts.ParameterSet)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetch parameter set %q: %w", opts.ParameterSet, err)
+		}
+		preset = set.Values
+	}
+
+	overrides, ok := templateData.(map[string]interface{})
+	_, spoofed := overrides[TemplateUserKey]
+	if opts.ParameterSet == "" && len(orgDefaults) == 0 && len(connector.TemplateDefaults) == 0 && len(opts.Constants) == 0 &&
+		opts.Caller == nil && !spoofed {
+		return templateData, nil
+	}
+
+	if templateData != nil && !ok {
+		if opts.ParameterSet != "" {
+			return nil, fmt.Errorf("template data must be an object when using parameter set %q", opts.ParameterSet)
+		}
+		return nil, errors.New("template data must be an object when defaults, constants or the caller apply")
+	}
+
+	merged := make(map[string]interface{})
+	for _, layer := range []map[string]interface{}{orgDefaults, connector.TemplateDefaults, preset, overrides, opts.Constants} {
+		for k, v := range layer {
+			merged[k] = v
+		}
+	}
+	delete(merged, TemplateUserKey)
+	if opts.Caller != nil {
+		merged[TemplateUserKey] = opts.Caller.templateUser()
+	}
+	return merged, nil
+}
+
+// TemplateUserKey is the reserved template variable describing the caller,
+// e.g. {{ .User.ID }} or {{ .User.OrgID }}, for row-level security filters
+const TemplateUserKey = "User"
+
+// templateUser describes the caller to templates. Claims holds the access
+// token's verified claims, such as app_metadata and custom claims.
+func (c *Caller) templateUser() map[string]interface{} {
+	claims := c.Claims
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"ID":       c.UserID,
+		"OrgID":    c.OrganizationID,
+		"Email":    c.Email,
+		"Role":     c.Role,
+		"APIKeyID": c.APIKeyID,
+		"Claims":   claims,
+	}
+}
+
+// withoutUser returns template data without the reserved User variable, so
+// the caller's email, role and claims are not recorded with the execution
+func withoutUser(templateData interface{}) interface{} {
+	data, ok := templateData.(map[string]interface{})
+	if _, found := data[TemplateUserKey]; !ok || !found {
+		return templateData
+	}
+	stripped := make(map[string]interface{}, len(data)-1)
+	for k, v := range data {
+		if k != TemplateUserKey {
+			stripped[k] = v
+		}
+	}
+	return stripped
+}
+
+// organizationDefaults fetches the template defaults of the query's
+// organization. Stores without organizations contribute none.
+func organizationDefaults(ctx context.Context, store MetadataStore, query *Query, connector *Connector, opts ExecuteOptions) (map[string]interface{}, error) {
+	orgs, ok := store.(OrganizationStore)
+	orgID := query.OrganizationID
+	if orgID == "" {
+		orgID = connector.OrganizationID
+	}
+	if !ok || orgID == "" {
+		return nil, nil
+	}
+
+	var org *Organization
+	err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+		var err error
+		org, err = orgs.FetchOrganization(ctx, orgID)
+		return err
+	})
+	if errors.Is(err, ErrOrganizationNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch organization: %w", err)
+	}
+	return org.TemplateDefaults, nil
+}
+
+// fetchConnector loads the query's connector from the metadata cache, or
+// from the store within the metadata timeout, and reports both through
+// OnResolved. Composite queries run on an in-memory engine instead.
+func fetchConnector(ctx context.Context, store MetadataStore, query *Query, opts ExecuteOptions) (*Connector, error) {
+	if query.isComposite() {
+		connector := compositeConnector(query)
+		if opts.OnResolved != nil {
+			opts.OnResolved(query, connector)
+		}
+		return connector, nil
+	}
+
+	connector, cached := opts.MetadataCache.connector(query.ConnectorID)
+	if !cached || opts.CacheBust {
+		err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+			var err error
+			connector, err = store.FetchConnector(ctx, query.ConnectorID)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("fetch connector: %w", err)
+		}
+		opts.MetadataCache.putConnector(connector)
+	}
+	if !opts.Caller.owns(connector.OrganizationID) {
+		return nil, fmt.Errorf("fetch connector: %w", ErrConnectorNotFound)
+	}
+
+	if opts.OnResolved != nil {
+		opts.OnResolved(query, connector)
+	}
+	return connector, nil
+}
+
+// connect creates the connector's driver and connects it within the connect timeout
+func connect(ctx context.Context, connector *Connector, opts ExecuteOptions) (driver.Driver, error) {
+	if drv := opts.WarmPool.take(connector); drv != nil {
+		return drv, nil
+	}
+
+	// Decryption and secret lookups may call out to a KMS or Vault, so they
+	// count towards connecting
+	var config json.RawMessage
+	err := runPhase(ctx, PhaseConnect, opts.Timeouts.Connect, func(ctx context.Context) error {
+		var err error
+		if config, err = opts.Keyring.Decrypt(ctx, connector.ID, connector.Config); err != nil {
+			return fmt.Errorf("decrypt connector config: %w", err)
+		}
+		if config, err = resolveSecretRefs(ctx, config, opts.Secrets); err != nil {
+			return fmt.Errorf("resolve connector secrets: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if len(queries) == 0 {
-		return nil, ErrQueryNotFound
+	decrypted := *connector
+	decrypted.Config = config
+	drv, err := createDriver(&decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("create driver: %w", err)
+	}
+
+	if err := runPhase(ctx, PhaseConnect, opts.Timeouts.Connect, drv.Connect); err != nil {
+		err = classifyError(drv, err, protocol.ErrorCodeConnectorUnreachable)
+		drv.Close()
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	if ro, ok := drv.(driver.ReadOnlySession); ok && connector.ReadOnly {
+		if err := runPhase(ctx, PhaseConnect, opts.Timeouts.Connect, ro.SetReadOnly); err != nil {
+			drv.Close()
+			return nil, fmt.Errorf("connect: %w", err)
+		}
+	}
+	return drv, nil
+}
+
+// runStatements executes every statement of the query in order on the same
+// driver session and returns the result of the final statement, limited to
+// the page pg selects when it is not nil. Engines that run scripts natively
+// receive the whole query unchanged.
+func runStatements(ctx context.Context, drv driver.Driver, typ driver.DriverType, query string, pg *pager, opts ExecuteOptions) (*driver.QueryResult, error) {
+	statements := []string{query}
+	split := SplitStatements(query, typ)
+	if sr, ok := drv.(driver.ScriptRunner); !ok || !sr.RunsScripts() {
+		if len(split) > 0 {
+			statements = split
+		}
+	}
+	total := len(statements)
+
+	// A script run natively cannot be wrapped, so its final rows are
+	// counted as they stream instead
+	final, counted := statements[total-1], false
+	if opts.CountOnly && len(split) == total {
+		if wrapped, ok := wrapCount(split[total-1], typ); ok {
+			final, counted = wrapped, true
+		}
+	}
+	if pg != nil && !opts.CountOnly && len(split) == total {
+		if wrapped, ok := pg.wrap(split[total-1], typ); ok {
+			final = wrapped
+		}
+	}
+
+	notify := func(index int, state string, duration time.Duration) {
+		if opts.OnStatement != nil && total > 1 {
+			opts.OnStatement(StatementEvent{Index: index, Total: total, State: state, Duration: duration})
+		}
+	}
+	// Statements that only read may run on a read replica
+	statementCtx := func(stmt string) context.Context {
+		if readsOnly(stmt, typ) {
+			return driver.WithReadOnlyStatement(ctx)
+		}
+		return ctx
 	}
 
-	return &queries[0], nil
+	// Setup statements run to completion; only the final result is streamed
+	for i, stmt := range statements[:total-1] {
+		notify(i+1, "running", 0)
+		start := time.Now()
+		if err := execStatement(statementCtx(stmt), drv, stmt); err != nil {
+			err = classifyError(drv, err, protocol.ErrorCodeEngine)
+			return nil, fmt.Errorf("execute statement %d of %d: %w", i+1, total, err)
+		}
+		notify(i+1, "completed", time.Since(start))
+	}
+
+	notify(total, "running", 0)
+	result, err := queryFinal(statementCtx(final), drv, final, opts)
+	if err != nil {
+		if !errors.Is(err, ErrAsyncUnsupported) {
+			err = classifyError(drv, err, protocol.ErrorCodeEngine)
+		}
+		if total > 1 {
+			return nil, fmt.Errorf("execute statement %d of %d: %w", total, total, err)
+		}
+		return nil, fmt.Errorf("execute query: %w", err)
+	}
+	if opts.CountOnly {
+		return countRows(result, counted), nil
+	}
+	if pg != nil {
+		return pg.apply(result), nil
+	}
+	return result, nil
 }
 
-// fetchConnector retrieves a connector by ID from Supabase
-func fetchConnector(ctx context.Context, connectorID string, client *supabase.Client) (*Connector, error) {
-	var connectors []Connector
-	resp, _, err := client.From("connectors").Select("*", "exact", false).Eq("id", connectorID).Execute()
+// queryFinal runs the statement whose result set is streamed to the client
+func queryFinal(ctx context.Context, drv driver.Driver, stmt string, opts ExecuteOptions) (*driver.QueryResult, error) {
+	if !opts.Async {
+		return drv.Query(ctx, stmt)
+	}
+
+	aq, ok := drv.(driver.AsyncQuerier)
+	if !ok {
+		return nil, ErrAsyncUnsupported
+	}
+
+	executionID, err := aq.StartQuery(ctx, stmt)
 	if err != nil {
 		return nil, err
 	}
+	if opts.OnExecutionID != nil {
+		opts.OnExecutionID(executionID)
+	}
+	return aq.AttachQuery(ctx, executionID)
+}
 
-	if err := json.Unmarshal(resp, &connectors); err != nil {
+// AttachExecution resumes streaming the results of an execution previously
+// started with ExecuteOptions.Async. The query ID selects the connector the
+// execution ran on. Only the caller that started the execution, on that
+// query, may attach to it.
+func AttachExecution(ctx context.Context, queryID string, executionID string, store MetadataStore, opts ExecuteOptions) (*StreamResult, error) {
+	query, err := fetchQuery(ctx, store, queryID, opts)
+	if err != nil {
 		return nil, err
 	}
+	if _, err := fetchAsyncExecution(ctx, store, query, executionID, opts); err != nil {
+		return nil, err
+	}
+
+	connector, err := fetchConnector(ctx, store, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	transforms, err := compileTransforms(queryTransforms(query, opts))
+	if err != nil {
+		return nil, err
+	}
+	loc, err := timezoneFor(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := newSnapshotWriter(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	drv, err := connect(ctx, connector, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.OnConnected != nil {
+		opts.OnConnected()
+	}
+	if pr, ok := drv.(driver.ProgressReporter); ok && opts.OnProgressReporter != nil {
+		opts.OnProgressReporter(pr)
+	}
+	if c, ok := drv.(driver.Canceller); ok && opts.OnCanceller != nil {
+		opts.OnCanceller(c)
+	}
 
-	if len(connectors) == 0 {
-		return nil, ErrConnectorNotFound
+	aq, ok := drv.(driver.AsyncQuerier)
+	if !ok {
+		drv.Close()
+		return nil, ErrAsyncUnsupported
 	}
 
-	return &connectors[0], nil
+	w := newWatchdog(ctx, opts.Timeouts)
+	result, err := aq.AttachQuery(w.ctx, executionID)
+	if err != nil {
+		err = classifyError(drv, err, protocol.ErrorCodeEngine)
+		w.stop()
+		drv.Close()
+		return nil, fmt.Errorf("attach execution: %w", timeoutCause(w.ctx, err))
+	}
+
+	// The execution's session has ended, so its timestamps are only
+	// converted as they stream
+	result = convertTimezone(classifyStream(result, drv), loc)
+
+	// The execution was submitted without knowing the page, so it is
+	// applied to the stream
+	pg := newPager(opts)
+	if pg != nil {
+		result = pg.apply(result)
+	}
+	mem := newMemoryAccount(opts.Memory)
+	smp := newSampler(opts, mem)
+
+	return &StreamResult{
+		Result:   &queryResultWrapper{qr: aggregateRows(smp.apply(applyTransforms(result, transforms, mem)), opts.Aggregates)},
+		drv:      drv,
+		watchdog: w,
+		pager:    pg,
+		sampler:  smp,
+		snapshot: snapshot,
+	}, nil
 }
 
-// renderTemplate processes the query template with provided data
-func renderTemplate(queryContent string, data interface{}) (string, error) {
-	tmpl, err := template.New("queryTemplate").Parse(queryContent)
+// execStatement runs a statement whose result set is not needed
+func execStatement(ctx context.Context, drv driver.Driver, stmt string) error {
+	if exec, ok := drv.(driver.StatementExecutor); ok {
+		return exec.Execute(ctx, stmt)
+	}
+
+	result, err := drv.Query(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	if result.Stream == nil {
+		return nil
+	}
+	return result.Stream(func(columns []string, row []interface{}) error {
+		return nil
+	})
+}
+
+// renderTemplate processes the query template with provided data and helper
+// functions. In strict mode every key the template references must be
+// present in data. Helpers of an escaping template mode escape the output of
+// every action.
+func renderTemplate(queryContent string, data interface{}, funcs template.FuncMap, strict bool) (string, error) {
+	tmpl := template.New("queryTemplate").Funcs(funcs)
+	if strict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+	tmpl, err := tmpl.Parse(queryContent)
 	if err != nil {
 		return "", err
 	}
+	if _, ok := funcs[sqlEscapeFunc]; ok {
+		escapeActions(tmpl)
+	}
 
 	var buf bytes.Buffer
 	if err := tmpl.Execute(&buf, data); err != nil {
@@ -175,6 +1099,35 @@ func renderTemplate(queryContent string, data interface{}) (string, error) {
 	return buf.String(), nil
 }
 
+// renderTemplateContext renders the template with the engine, giving up
+// when ctx is done. Template execution cannot be interrupted, so an
+// abandoned render finishes in the background.
+func renderTemplateContext(ctx context.Context, engine string, queryContent string, data interface{}, funcs template.FuncMap, strict bool) (string, error) {
+	type rendered struct {
+		query string
+		err   error
+	}
+
+	done := make(chan rendered, 1)
+	go func() {
+		var r rendered
+		defer func() { done <- r }()
+		defer CatchPanic(&r.err, "template render")
+		if engine == TemplateEngineJinja {
+			r.query, r.err = renderJinja(queryContent, data, funcs)
+		} else {
+			r.query, r.err = renderTemplate(queryContent, data, funcs, strict)
+		}
+	}()
+
+	select {
+	case r := <-done:
+		return r.query, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
 // createDriver instantiates the appropriate database driver based on connector type
 func createDriver(connector *Connector) (driver.Driver, error) {
 	switch driver.DriverType(connector.Type) {
@@ -184,6 +1137,10 @@ func createDriver(connector *Connector) (driver.Driver, error) {
 		return createBigQueryDriver(connector.Config)
 	case driver.AthenaType:
 		return createAthenaDriver(connector.Config)
+	case driver.MockType:
+		return createMockDriver(connector.Config)
+	case driver.DuckDBType:
+		return createDuckDBDriver(connector.Config)
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, connector.Type)
 	}
@@ -230,3 +1187,31 @@ func createAthenaDriver(config json.RawMessage) (driver.Driver, error) {
 
 	return driver.New(driver.AthenaType, configJSON)
 }
+
+func createMockDriver(config json.RawMessage) (driver.Driver, error) {
+	mockConfig, err := mock.FromJSON(config)
+	if err != nil {
+		return nil, err
+	}
+
+	configJSON, err := mockConfig.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.New(driver.MockType, configJSON)
+}
+
+func createDuckDBDriver(config json.RawMessage) (driver.Driver, error) {
+	duckdbConfig, err := duckdb.FromJSON(config)
+	if err != nil {
+		return nil, err
+	}
+
+	configJSON, err := duckdbConfig.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return driver.New(driver.DuckDBType, configJSON)
+}
@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"supalytics-executor/driver"
+)
+
+// routingDriver records whether each statement it ran was marked read-only
+type routingDriver struct {
+	readOnly []bool
+}
+
+func (d *routingDriver) Connect(ctx context.Context) error { return nil }
+func (d *routingDriver) Close() error                      { return nil }
+
+func (d *routingDriver) Query(ctx context.Context, query string, args ...interface{}) (*driver.QueryResult, error) {
+	d.readOnly = append(d.readOnly, driver.IsReadOnlyStatement(ctx))
+	return &driver.QueryResult{}, nil
+}
+
+func TestRunStatementsMarksReadOnlyStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []bool
+	}{
+		{"read", "select * from events", []bool{true}},
+		{"write", "insert into events values (1)", []bool{false}},
+		{"setup then read", "create temp table t as select 1; select * from t", []bool{false, true}},
+		{"session setting", "set search_path = app; select 1", []bool{false, true}},
+		{"row lock", "select * from events for update", []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drv := &routingDriver{}
+			if _, err := runStatements(context.Background(), drv, driver.PostgresType, tt.sql, nil, ExecuteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(drv.readOnly, tt.want) {
+				t.Fatalf("statements marked read-only %v, want %v", drv.readOnly, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+// runner/expr.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions of computed columns are a small SQL-like language over the
+// columns of a row:
+//
+//	revenue - cost                 arithmetic with + - * / % and parentheses
+//	"unit price" * 1.2             double quotes name any column
+//	first_name || ' ' || last_name concatenation of 'single-quoted' strings
+//	round(ratio * 100, 1)          abs, round, coalesce, lower and upper
+//
+// A null operand makes the result null, as does division by zero.
+
+// exprNode is a parsed expression
+type exprNode interface {
+	// bind resolves the columns the expression reads against a header
+	bind(index map[string]int) (exprFunc, error)
+}
+
+// exprFunc evaluates a bound expression for a row
+type exprFunc func(row []interface{}) (interface{}, error)
+
+type exprLiteral struct{ value interface{} }
+
+type exprColumn struct{ name string }
+
+type exprUnary struct{ operand exprNode }
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+// exprFuncs lists the functions expressions call, by their argument counts
+var exprFuncs = map[string][2]int{
+	"abs": {1, 1}, "round": {1, 2}, "coalesce": {1, -1}, "lower": {1, 1}, "upper": {1, 1},
+}
+
+// parseExpr parses a computed column's expression
+func parseExpr(src string) (exprNode, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+// exprToken kinds
+const (
+	exprIdent = iota
+	exprQuoted
+	exprString
+	exprNumberToken
+	exprOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end, ok := closeQuoted(src, i, string(c), false)
+			if !ok {
+				return nil, errors.New("unterminated quote in expression")
+			}
+			q := string(c)
+			text := strings.ReplaceAll(src[i+1:end-1], q+q, q)
+			kind := exprString
+			if c == '"' {
+				kind = exprQuoted
+			}
+			tokens = append(tokens, exprToken{kind, text})
+			i = end
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprNumberToken, src[start:i]})
+		case isIdentChar(c):
+			start := i
+			for i < len(src) && isIdentChar(src[i]) {
+				i++
+			}
+			tokens = append(tokens, exprToken{exprIdent, src[start:i]})
+		case c == '|' && strings.HasPrefix(src[i:], "||"):
+			tokens = append(tokens, exprToken{exprOp, "||"})
+			i += 2
+		case strings.IndexByte("+-*/%(),", c) >= 0:
+			tokens = append(tokens, exprToken{exprOp, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression", rune(c))
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser parses by precedence, loosest first: ||, then + and -, then
+// * / and %, then unary minus
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != exprOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) binary(next func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.peekOp(ops...)
+		if !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) concat() (exprNode, error) { return p.binary(p.additive, "||") }
+
+func (p *exprParser) additive() (exprNode, error) { return p.binary(p.term, "+", "-") }
+
+func (p *exprParser) term() (exprNode, error) { return p.binary(p.unary, "*", "/", "%") }
+
+func (p *exprParser) unary() (exprNode, error) {
+	if _, ok := p.peekOp("-"); ok {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case exprString:
+		return &exprLiteral{tok.text}, nil
+	case exprQuoted:
+		return &exprColumn{tok.text}, nil
+	case exprNumberToken:
+		if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return &exprLiteral{n}, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in expression", tok.text)
+		}
+		return &exprLiteral{f}, nil
+	case exprIdent:
+		switch strings.ToLower(tok.text) {
+		case "null":
+			return &exprLiteral{nil}, nil
+		case "true":
+			return &exprLiteral{true}, nil
+		case "false":
+			return &exprLiteral{false}, nil
+		}
+		if _, ok := p.peekOp("("); ok {
+			return p.call(strings.ToLower(tok.text))
+		}
+		return &exprColumn{tok.text}, nil
+	}
+
+	if tok.text == "(" {
+		node, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, errors.New("missing ) in expression")
+		}
+		p.pos++
+		return node, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", tok.text)
+}
+
+func (p *exprParser) call(name string) (exprNode, error) {
+	arity, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.pos++ // (
+	call := &exprCall{name: name}
+	if _, ok := p.peekOp(")"); !ok {
+		for {
+			arg, err := p.concat()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.peekOp(","); !ok {
+				break
+			}
+			p.pos++
+		}
+	}
+	if _, ok := p.peekOp(")"); !ok {
+		return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+	}
+	p.pos++
+	if len(call.args) < arity[0] || (arity[1] >= 0 && len(call.args) > arity[1]) {
+		return nil, fmt.Errorf("wrong number of arguments to %s", name)
+	}
+	return call, nil
+}
+
+func (n *exprLiteral) bind(map[string]int) (exprFunc, error) {
+	return func([]interface{}) (interface{}, error) { return n.value, nil }, nil
+}
+
+func (n *exprColumn) bind(index map[string]int) (exprFunc, error) {
+	i, ok := index[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown column %q", n.name)
+	}
+	return func(row []interface{}) (interface{}, error) {
+		if b, ok := row[i].([]byte); ok {
+			return string(b), nil
+		}
+		return row[i], nil
+	}, nil
+}
+
+func (n *exprUnary) bind(index map[string]int) (exprFunc, error) {
+	operand, err := n.operand.bind(index)
+	if err != nil {
+		return nil, err
+	}
+	return func(row []interface{}) (interface{}, error) {
+		v, err := operand(row)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		x, integer, ok := exprNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate %v", v)
+		}
+		if integer {
+			return -int64(x), nil
+		}
+		return -x, nil
+	}, nil
+}
+
+func (n *exprBinary) bind(index map[string]int) (exprFunc, error) {
+	left, err := n.left.bind(index)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.bind(index)
+	if err != nil {
+		return nil, err
+	}
+	return func(row []interface{}) (interface{}, error) {
+		a, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(row)
+		if err != nil || a == nil || b == nil {
+			return nil, err
+		}
+		if n.op == "||" {
+			return pivotColumnName(a) + pivotColumnName(b), nil
+		}
+		return arithmetic(n.op, a, b)
+	}, nil
+}
+
+// arithmetic applies an arithmetic operator. Integers stay integers except
+// through division.
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	x, xInt, ok := exprNumber(a)
+	if !ok {
+		return nil, fmt.Errorf("%s needs numbers, got %v", op, a)
+	}
+	y, yInt, ok := exprNumber(b)
+	if !ok {
+		return nil, fmt.Errorf("%s needs numbers, got %v", op, b)
+	}
+	integer := xInt && yInt
+	var r float64
+	switch op {
+	case "+":
+		r = x + y
+	case "-":
+		r = x - y
+	case "*":
+		r = x * y
+	case "/":
+		if y == 0 {
+			return nil, nil
+		}
+		return x / y, nil
+	case "%":
+		if y == 0 {
+			return nil, nil
+		}
+		r = math.Mod(x, y)
+	}
+	if integer {
+		return int64(r), nil
+	}
+	return r, nil
+}
+
+func (n *exprCall) bind(index map[string]int) (exprFunc, error) {
+	args := make([]exprFunc, len(n.args))
+	for i, arg := range n.args {
+		var err error
+		if args[i], err = arg.bind(index); err != nil {
+			return nil, err
+		}
+	}
+	return func(row []interface{}) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg(row)
+			if err != nil {
+				return nil, err
+			}
+			if n.name == "coalesce" && v != nil {
+				return v, nil
+			}
+			values[i] = v
+		}
+		if n.name == "coalesce" || values[0] == nil {
+			return nil, nil
+		}
+
+		switch n.name {
+		case "lower":
+			return strings.ToLower(pivotColumnName(values[0])), nil
+		case "upper":
+			return strings.ToUpper(pivotColumnName(values[0])), nil
+		}
+		x, integer, ok := exprNumber(values[0])
+		if !ok {
+			return nil, fmt.Errorf("%s needs a number, got %v", n.name, values[0])
+		}
+		if n.name == "abs" {
+			if integer {
+				return int64(math.Abs(x)), nil
+			}
+			return math.Abs(x), nil
+		}
+
+		digits := 0.0
+		if len(values) > 1 {
+			d, _, ok := exprNumber(values[1])
+			if !ok {
+				return nil, fmt.Errorf("round needs a number of digits, got %v", values[1])
+			}
+			digits = math.Trunc(d)
+		}
+		scale := math.Pow(10, digits)
+		r := math.Round(x*scale) / scale
+		if digits <= 0 {
+			return int64(r), nil
+		}
+		return r, nil
+	}, nil
+}
+
+// exprNumber reads a value as a number, reporting whether it is an
+// integer. Numeric strings count as numbers, as some engines return every
+// value as text.
+func exprNumber(v interface{}) (float64, bool, bool) {
+	switch v := v.(type) {
+	case string:
+		s := strings.TrimFunc(v, unicode.IsSpace)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return float64(n), true, true
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, false, err == nil
+	case []byte:
+		return exprNumber(string(v))
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true, true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), false, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,121 @@
+// runner/healthcheck.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Connector statuses recorded by health checks
+const (
+	ConnectorStatusConnected = "connected"
+	ConnectorStatusError     = "error"
+)
+
+// ConnectorStatusStore lists connectors and records the outcome of their
+// health checks. Metadata stores that implement it have their connectors
+// checked in the background.
+type ConnectorStatusStore interface {
+	ListConnectors(ctx context.Context) ([]Connector, error)
+	UpdateConnectorStatus(ctx context.Context, connectorID string, status string, checkedAt time.Time) error
+}
+
+// LoadConnector retrieves a connector the caller may use, within the
+// metadata timeout
+func LoadConnector(ctx context.Context, store MetadataStore, connectorID string, opts ExecuteOptions) (*Connector, error) {
+	var connector *Connector
+	err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+		var err error
+		connector, err = store.FetchConnector(ctx, connectorID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch connector: %w", err)
+	}
+	if !opts.Caller.owns(connector.OrganizationID) {
+		return nil, fmt.Errorf("fetch connector: %w", ErrConnectorNotFound)
+	}
+	return connector, nil
+}
+
+// CheckConnector connects to a connector and pings it, or runs SELECT 1 on
+// engines without a ping
+func CheckConnector(ctx context.Context, connector *Connector, opts ExecuteOptions) (err error) {
+	defer CatchPanic(&err, "check of connector "+connector.ID)
+
+	drv, err := connect(ctx, connector, opts)
+	if err != nil {
+		return err
+	}
+	defer drv.Close()
+	return ping(ctx, drv)
+}
+
+// ListConnectors retrieves every connector from Supabase
+func (s *SupabaseStore) ListConnectors(ctx context.Context) ([]Connector, error) {
+	var connectors []Connector
+	resp, _, err := s.client.From("connectors").Select("*", "exact", false).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &connectors); err != nil {
+		return nil, err
+	}
+
+	return connectors, nil
+}
+
+// UpdateConnectorStatus sets a connector's status and last_connection_check
+func (s *SupabaseStore) UpdateConnectorStatus(ctx context.Context, connectorID string, status string, checkedAt time.Time) error {
+	_, _, err := s.client.From("connectors").Update(map[string]interface{}{
+		"status":                status,
+		"last_connection_check": checkedAt.UTC(),
+	}, "minimal", "").Eq("id", connectorID).Execute()
+	return err
+}
+
+// ListConnectors returns every connector
+func (s *MemoryStore) ListConnectors(ctx context.Context) ([]Connector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	connectors := make([]Connector, 0, len(s.connectors))
+	for _, c := range s.connectors {
+		connectors = append(connectors, c)
+	}
+	return connectors, nil
+}
+
+// UpdateConnectorStatus sets a connector's status and last check time
+func (s *MemoryStore) UpdateConnectorStatus(ctx context.Context, connectorID string, status string, checkedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.connectors[connectorID]
+	if !ok {
+		return ErrConnectorNotFound
+	}
+	c.Status, c.LastConnectionCheck = status, checkedAt
+	s.connectors[connectorID] = c
+	return nil
+}
+
+// ListConnectors lists the underlying store's connectors. The list is not
+// cached; health checks pause while the store is unavailable.
+func (s *CachingStore) ListConnectors(ctx context.Context) ([]Connector, error) {
+	statuses, ok := s.store.(ConnectorStatusStore)
+	if !ok {
+		return nil, nil
+	}
+	return statuses.ListConnectors(ctx)
+}
+
+// UpdateConnectorStatus records a status in the underlying store
+func (s *CachingStore) UpdateConnectorStatus(ctx context.Context, connectorID string, status string, checkedAt time.Time) error {
+	statuses, ok := s.store.(ConnectorStatusStore)
+	if !ok {
+		return nil
+	}
+	return statuses.UpdateConnectorStatus(ctx, connectorID, status, checkedAt)
+}
@@ -0,0 +1,143 @@
+// runner/history.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/supabase-community/postgrest-go"
+)
+
+// ErrExecutionNotFound is returned for executions missing from the audit log
+var ErrExecutionNotFound = errors.New("execution not found")
+
+// ExecutionHistory reads back the audit log. Metadata stores that implement
+// it can list past executions and replay them.
+type ExecutionHistory interface {
+	// ListExecutions returns up to limit executions of a query, newest first
+	ListExecutions(ctx context.Context, queryID string, limit int) ([]AuditEntry, error)
+	// FetchExecution returns the execution with the given ID
+	FetchExecution(ctx context.Context, executionID string) (*AuditEntry, error)
+}
+
+// ListExecutions retrieves a query's most recent executions from Supabase
+func (s *SupabaseStore) ListExecutions(ctx context.Context, queryID string, limit int) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	resp, _, err := s.client.From("query_audit_log").Select("*", "exact", false).
+		Eq("query_id", queryID).
+		Order("finished_at", &postgrest.OrderOpts{Ascending: false}).
+		Limit(limit, "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// FetchExecution retrieves an execution from Supabase
+func (s *SupabaseStore) FetchExecution(ctx context.Context, executionID string) (*AuditEntry, error) {
+	var entries []AuditEntry
+	resp, _, err := s.client.From("query_audit_log").Select("*", "exact", false).Eq("execution_id", executionID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &entries); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, ErrExecutionNotFound
+	}
+
+	return &entries[0], nil
+}
+
+// ListExecutions returns a query's most recent executions
+func (s *MemoryStore) ListExecutions(ctx context.Context, queryID string, limit int) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for _, e := range s.audit {
+		if e.QueryID == queryID {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].FinishedAt.After(entries[j].FinishedAt) })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// FetchExecution returns an execution from the audit log
+func (s *MemoryStore) FetchExecution(ctx context.Context, executionID string) (*AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, e := range s.audit {
+		if e.ExecutionID == executionID {
+			return &e, nil
+		}
+	}
+	return nil, ErrExecutionNotFound
+}
+
+// ListExecutions reads the underlying store's history. History is not
+// cached; it is unavailable while the store is.
+func (s *CachingStore) ListExecutions(ctx context.Context, queryID string, limit int) ([]AuditEntry, error) {
+	history, ok := s.store.(ExecutionHistory)
+	if !ok {
+		return nil, nil
+	}
+	return history.ListExecutions(ctx, queryID, limit)
+}
+
+// FetchExecution reads an execution from the underlying store
+func (s *CachingStore) FetchExecution(ctx context.Context, executionID string) (*AuditEntry, error) {
+	history, ok := s.store.(ExecutionHistory)
+	if !ok {
+		return nil, ErrExecutionNotFound
+	}
+	return history.FetchExecution(ctx, executionID)
+}
+
+// fetchReplay returns the execution a replay re-runs, which must be of
+// query and have recorded the SQL it ran. A caller may only replay its own
+// executions: the recorded SQL carries the User variable of whoever ran
+// it, so replaying someone else's would bypass row-level security filters.
+func fetchReplay(ctx context.Context, store MetadataStore, query *Query, opts ExecuteOptions) (*AuditEntry, error) {
+	history, ok := store.(ExecutionHistory)
+	if !ok {
+		return nil, fmt.Errorf("replay %s: %w", opts.Replay, ErrExecutionNotFound)
+	}
+	var entry *AuditEntry
+	err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+		var err error
+		entry, err = history.FetchExecution(ctx, opts.Replay)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("replay %s: %w", opts.Replay, err)
+	}
+	if entry.QueryID != query.ID || !opts.Caller.ran(entry) {
+		return nil, fmt.Errorf("replay %s: %w", opts.Replay, ErrExecutionNotFound)
+	}
+	if entry.RenderedSQL == "" {
+		return nil, fmt.Errorf("replay %s: the execution did not record its SQL", opts.Replay)
+	}
+	return entry, nil
+}
+
+// ran reports whether the caller is the user or API key that ran the
+// execution
+func (c *Caller) ran(entry *AuditEntry) bool {
+	return c == nil || (c.owns(entry.OrganizationID) && entry.UserID == c.UserID && entry.APIKeyID == c.APIKeyID)
+}
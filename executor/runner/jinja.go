@@ -0,0 +1,111 @@
+// runner/jinja.go
+package runner
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"text/template"
+
+	"github.com/flosch/pongo2/v6"
+)
+
+// Template engines a query can be written for
+const (
+	// TemplateEngineGo renders Go text/template syntax (default)
+	TemplateEngineGo = "go"
+	// TemplateEngineJinja renders Jinja syntax, {{ param | filter }} and
+	// {% if %} blocks, so queries imported from Jinja-based tools run
+	// unmodified. Template helpers are called as functions, e.g.
+	// {{ quoteIdent(table) }}.
+	TemplateEngineJinja = "jinja"
+)
+
+// Query output is SQL, which pongo2's default HTML escaping would corrupt
+func init() {
+	pongo2.SetAutoescape(false)
+}
+
+// templateEngine returns the engine a query renders with, checking it
+// supports the template mode
+func templateEngine(query *Query, mode string) (string, error) {
+	switch query.TemplateEngine {
+	case "", TemplateEngineGo:
+		return TemplateEngineGo, nil
+	case TemplateEngineJinja:
+		if mode == TemplateModeSQL || mode == TemplateModeSQLStrict {
+			return "", fmt.Errorf("template mode %s is not supported by the jinja engine", mode)
+		}
+		return TemplateEngineJinja, nil
+	}
+	return "", fmt.Errorf("unknown template engine %q", query.TemplateEngine)
+}
+
+// renderJinja renders a Jinja template. Helpers are passed as variables,
+// which template data of the same name replaces.
+func renderJinja(queryContent string, data interface{}, funcs template.FuncMap) (string, error) {
+	vars := pongo2.Context{}
+	for name, fn := range funcs {
+		vars[name] = fn
+	}
+	switch d := data.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, v := range d {
+			vars[k] = jinjaValue(v)
+		}
+	default:
+		return "", fmt.Errorf("jinja template data must be an object, got %T", data)
+	}
+
+	tmpl, err := pongo2.FromString(jinjaFilterArgs(queryContent))
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Execute(vars)
+}
+
+// Jinja tags and expressions, and the filter calls inside them
+var (
+	jinjaTag    = regexp.MustCompile(`(?s)\{\{.*?\}\}|\{%.*?%\}`)
+	jinjaFilter = regexp.MustCompile(`\|\s*(\w+)\s*\(\s*([^(),]*?)\s*\)`)
+)
+
+// jinjaFilterArgs rewrites Jinja's filter(arg) calls to pongo2's filter:arg.
+// Filters with several arguments have no pongo2 equivalent and are left
+// for pongo2 to reject.
+func jinjaFilterArgs(content string) string {
+	return jinjaTag.ReplaceAllStringFunc(content, func(tag string) string {
+		return jinjaFilter.ReplaceAllStringFunc(tag, func(call string) string {
+			m := jinjaFilter.FindStringSubmatch(call)
+			if m[2] == "" {
+				return "|" + m[1]
+			}
+			return "|" + m[1] + ":" + m[2]
+		})
+	})
+}
+
+// jinjaValue converts whole JSON numbers to integers, which pongo2 prints
+// without the decimals it gives every float, as Jinja does
+func jinjaValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = jinjaValue(item)
+		}
+		return items
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = jinjaValue(item)
+		}
+		return m
+	}
+	return v
+}
@@ -0,0 +1,44 @@
+// runner/jobs.go
+package runner
+
+import (
+	"fmt"
+
+	"supalytics-executor/driver"
+)
+
+// Labels the runner adds to the jobs of every execution, so the
+// warehouse's billing breaks down by organization and query. Requests
+// cannot override them.
+const (
+	JobLabelOrganization = "supalytics_org"
+	JobLabelQuery        = "supalytics_query"
+)
+
+// configureJobs sets up the jobs of engines that run queries as jobs with
+// the execution's labels, priority and maximum bytes billed
+func configureJobs(drv driver.Driver, query *Query, opts ExecuteOptions) error {
+	jc, ok := drv.(driver.JobConfigurer)
+	if !ok {
+		return nil
+	}
+
+	labels := make(map[string]string, len(opts.JobLabels)+2)
+	for key, value := range opts.JobLabels {
+		labels[key] = value
+	}
+	if query.OrganizationID != "" {
+		labels[JobLabelOrganization] = driver.LabelValue(query.OrganizationID)
+	}
+	labels[JobLabelQuery] = driver.LabelValue(query.ID)
+
+	err := jc.ConfigureJobs(driver.JobOptions{
+		Labels:         labels,
+		Priority:       opts.JobPriority,
+		MaxBytesBilled: opts.MaxBytesBilled,
+	})
+	if err != nil {
+		return fmt.Errorf("configure jobs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+// runner/lint.go
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"supalytics-executor/driver"
+)
+
+// Codes of the problems in a SQLValidationError
+const (
+	// SQLProblemSyntax is SQL the engine would reject: an unterminated
+	// literal or comment, unbalanced parentheses or an unknown statement
+	SQLProblemSyntax = "syntax"
+	// SQLProblemDisallowed is a statement that modifies data or schema on
+	// a read-only connector
+	SQLProblemDisallowed = "disallowed"
+)
+
+// SQLProblem is one problem found in a rendered query. Statement counts
+// from 1; Line and Column (in characters) also count from 1 and locate the
+// problem in the whole rendered query.
+type SQLProblem struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Statement int    `json:"statement"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+
+	offset int
+}
+
+// SQLValidationError lists the problems that kept a rendered query from
+// running
+type SQLValidationError struct {
+	Problems []SQLProblem
+}
+
+func (e *SQLValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = fmt.Sprintf("line %d, column %d: %s", p.Line, p.Column, p.Message)
+	}
+	return "invalid SQL: " + strings.Join(problems, "; ")
+}
+
+// Statement kinds by leading keyword
+type statementKind int
+
+const (
+	statementRead statementKind = iota
+	statementWrite
+	statementSchema
+	// statementOther covers session, transaction and scripting statements
+	statementOther
+	// statementProcedure runs code whose effects cannot be seen
+	statementProcedure
+)
+
+var statementKinds = map[string]statementKind{
+	"SELECT": statementRead, "WITH": statementRead, "VALUES": statementRead, "TABLE": statementRead,
+	"SHOW": statementRead, "EXPLAIN": statementRead, "DESCRIBE": statementRead, "DESC": statementRead,
+
+	"INSERT": statementWrite, "UPDATE": statementWrite, "DELETE": statementWrite, "MERGE": statementWrite,
+	"UPSERT": statementWrite, "REPLACE": statementWrite, "COPY": statementWrite, "UNLOAD": statementWrite,
+	"EXPORT": statementWrite, "LOAD": statementWrite,
+
+	"CREATE": statementSchema, "ALTER": statementSchema, "DROP": statementSchema, "TRUNCATE": statementSchema,
+	"RENAME": statementSchema, "GRANT": statementSchema, "REVOKE": statementSchema, "COMMENT": statementSchema,
+	"MSCK": statementSchema, "VACUUM": statementSchema, "REINDEX": statementSchema, "CLUSTER": statementSchema,
+	"REFRESH": statementSchema,
+
+	"CALL": statementProcedure, "DO": statementProcedure, "EXECUTE": statementProcedure, "EXEC": statementProcedure,
+
+	"SET": statementOther, "RESET": statementOther, "DECLARE": statementOther, "BEGIN": statementOther,
+	"START": statementOther, "COMMIT": statementOther, "ROLLBACK": statementOther, "END": statementOther,
+	"USE": statementOther, "PREPARE": statementOther, "DEALLOCATE": statementOther, "LOCK": statementOther,
+	"ANALYZE": statementOther, "IF": statementOther, "LOOP": statementOther, "WHILE": statementOther,
+	"REPEAT": statementOther, "FOR": statementOther, "BREAK": statementOther, "LEAVE": statementOther,
+	"CONTINUE": statementOther, "RETURN": statementOther, "RAISE": statementOther, "ASSERT": statementOther,
+}
+
+// Keywords after which a nested statement may start, such as a
+// data-modifying CTE or the body of a script's IF
+var nestedStatementStarts = map[string]bool{
+	"(": true, "THEN": true, "ELSE": true, "BEGIN": true, "LOOP": true, "DO": true,
+	"ANALYZE": true, "VERBOSE": true, "EXPLAIN": true,
+}
+
+// sqlToken is a word or punctuation character of a rendered query
+type sqlToken struct {
+	text   string
+	offset int
+}
+
+// ValidateSQL checks a rendered query before it runs. It finds what the
+// engine would reject without a round trip, and on read-only connectors it
+// rejects statements that modify data or schema. The check is lexical and
+// conservative: queries it passes may still fail to parse, and it cannot see
+// writes made by functions a query calls. On read-only connectors it is
+// advisory only; engines that support it also run the session read-only
+// (see driver.ReadOnlySession), and only a database role without write
+// grants keeps every write out.
+func ValidateSQL(sql string, typ driver.DriverType, readOnly bool) error {
+	v := &sqlValidator{}
+	tokens, problem := lexSQL(sql, dialectFor(typ))
+	if problem != nil {
+		v.problems = append(v.problems, *problem)
+		return v.err(sql)
+	}
+
+	var statement []sqlToken
+	for _, tok := range tokens {
+		if tok.text == ";" {
+			v.statement(statement, readOnly)
+			statement = nil
+			continue
+		}
+		statement = append(statement, tok)
+	}
+	v.statement(statement, readOnly)
+
+	if v.statements == 0 {
+		v.add(SQLProblemSyntax, 0, "query is empty")
+	}
+	return v.err(sql)
+}
+
+type sqlValidator struct {
+	statements int
+	problems   []SQLProblem
+}
+
+func (v *sqlValidator) add(code string, offset int, format string, args ...interface{}) {
+	v.problems = append(v.problems, SQLProblem{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		Statement: v.statements,
+		offset:    offset,
+	})
+}
+
+// err returns the problems found in sql, located by line and column
+func (v *sqlValidator) err(sql string) error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	for i := range v.problems {
+		v.problems[i].Line, v.problems[i].Column = lineColumn(sql, v.problems[i].offset)
+	}
+	return &SQLValidationError{Problems: v.problems}
+}
+
+// statement checks one statement's tokens
+func (v *sqlValidator) statement(tokens []sqlToken, readOnly bool) {
+	if len(tokens) == 0 {
+		return
+	}
+	v.statements++
+
+	var open []int
+	for _, tok := range tokens {
+		switch tok.text {
+		case "(":
+			open = append(open, tok.offset)
+		case ")":
+			if len(open) == 0 {
+				v.add(SQLProblemSyntax, tok.offset, "unexpected )")
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, offset := range open {
+		v.add(SQLProblemSyntax, offset, "unclosed (")
+	}
+
+	first := tokens[0]
+	for _, tok := range tokens {
+		if tok.text != "(" {
+			first = tok
+			break
+		}
+	}
+	keyword := strings.ToUpper(first.text)
+	kind, known := statementKinds[keyword]
+	if !known {
+		v.add(SQLProblemSyntax, first.offset, "unexpected %q at the start of a statement", first.text)
+		return
+	}
+	if !readOnly {
+		return
+	}
+
+	if disallowed(kind) {
+		v.add(SQLProblemDisallowed, first.offset, "%s statements are not allowed on a read-only connector", keyword)
+		return
+	}
+	depth := 0
+	for i, tok := range tokens {
+		// The engine's read-only session must not be turned off, whether
+		// by SET default_transaction_read_only or BEGIN READ WRITE
+		if kind == statementOther && (strings.HasSuffix(strings.ToLower(tok.text), "transaction_read_only") ||
+			strings.EqualFold(tok.text, "READ") && i+1 < len(tokens) && strings.EqualFold(tokens[i+1].text, "WRITE")) {
+			v.add(SQLProblemDisallowed, tok.offset, "changing the transaction access mode is not allowed on a read-only connector")
+			return
+		}
+		switch tok.text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		word := strings.ToUpper(tok.text)
+		// A keyword followed by ( is a function such as REPLACE(s, a, b)
+		call := i+1 < len(tokens) && tokens[i+1].text == "("
+		if i > 0 && !call && nestedStatementStarts[strings.ToUpper(tokens[i-1].text)] {
+			if k, ok := statementKinds[word]; ok && disallowed(k) {
+				v.add(SQLProblemDisallowed, tok.offset, "%s statements are not allowed on a read-only connector", word)
+				return
+			}
+		}
+		// SELECT ... INTO creates a table on Postgres and SQL Server
+		if word == "INTO" && depth == 0 && kind == statementRead {
+			v.add(SQLProblemDisallowed, tok.offset, "SELECT INTO is not allowed on a read-only connector")
+			return
+		}
+	}
+}
+
+// readsOnly reports whether every statement of sql only reads data, by the
+// rules ValidateSQL applies on read-only connectors. Session statements
+// such as SET, row locks and SQL that does not lex do not count as reads.
+func readsOnly(sql string, typ driver.DriverType) bool {
+	if ValidateSQL(sql, typ, true) != nil {
+		return false
+	}
+	tokens, _ := lexSQL(sql, dialectFor(typ))
+	first := true
+	for i, tok := range tokens {
+		word := strings.ToUpper(tok.text)
+		switch {
+		case word == ";":
+			first = true
+		case word == "(":
+		case first:
+			if statementKinds[word] != statementRead {
+				return false
+			}
+			first = false
+		// SELECT ... FOR UPDATE and FOR SHARE lock rows
+		case word == "FOR" && i+1 < len(tokens):
+			switch strings.ToUpper(tokens[i+1].text) {
+			case "UPDATE", "SHARE", "NO", "KEY":
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func disallowed(kind statementKind) bool {
+	return kind == statementWrite || kind == statementSchema || kind == statementProcedure
+}
+
+// lexSQL splits a query into words and the punctuation ( ) and ;, skipping
+// literals, quoted identifiers and comments by the dialect's rules. Lexing
+// stops at the first unterminated literal or comment, which is returned as
+// a problem.
+func lexSQL(sql string, d dialect) ([]sqlToken, *SQLProblem) {
+	var tokens []sqlToken
+	unterminated := func(i int, what string) ([]sqlToken, *SQLProblem) {
+		return tokens, &SQLProblem{Code: SQLProblemSyntax, Message: "unterminated " + what, Statement: countStatements(tokens) + 1, offset: i}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"),
+			c == '#' && d.hashComments:
+			i = skipLine(sql, i)
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return unterminated(i, "comment")
+			}
+			i += end + 4
+
+		case (c == '\'' || c == '"') && d.tripleQuotes && strings.HasPrefix(sql[i:], strings.Repeat(string(c), 3)):
+			end, ok := closeQuoted(sql, i, strings.Repeat(string(c), 3), true)
+			if !ok {
+				return unterminated(i, "string literal")
+			}
+			i = end
+
+		case c == '\'':
+			end, ok := closeQuoted(sql, i, "'", d.backslashEscapes || isEscapeString(sql, i))
+			if !ok {
+				return unterminated(i, "string literal")
+			}
+			i = end
+
+		case c == '"' || (c == '`' && d.backticks):
+			end, ok := closeQuoted(sql, i, string(c), d.backslashEscapes)
+			if !ok {
+				return unterminated(i, "quoted identifier")
+			}
+			i = end
+
+		case c == '$' && d.dollarQuotes:
+			tag, ok := dollarTag(sql, i)
+			if !ok {
+				i++
+				continue
+			}
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				return unterminated(i, "dollar-quoted string")
+			}
+			i += len(tag) + end + len(tag)
+
+		case c == '(' || c == ')' || c == ';':
+			tokens = append(tokens, sqlToken{text: string(c), offset: i})
+			i++
+
+		case isIdentChar(c) || c >= utf8.RuneSelf:
+			start := i
+			for i < len(sql) && (isIdentChar(sql[i]) || sql[i] >= utf8.RuneSelf) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{text: sql[start:i], offset: start})
+
+		default:
+			tokens = append(tokens, sqlToken{text: string(c), offset: i})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// closeQuoted returns the index just past the literal opened at i by quote,
+// and whether it was closed. A doubled quote is an escaped quote.
+func closeQuoted(sql string, i int, quote string, backslash bool) (int, bool) {
+	for j := i + len(quote); j < len(sql); j++ {
+		switch {
+		case sql[j] == '\\' && backslash:
+			j++
+		case strings.HasPrefix(sql[j:], quote):
+			if len(quote) == 1 && j+1 < len(sql) && sql[j+1] == quote[0] {
+				j++
+				continue
+			}
+			return j + len(quote), true
+		}
+	}
+	return len(sql), false
+}
+
+// dollarTag returns the $tag$ opening a Postgres dollar-quoted string at i.
+// A '$' that does not open one, such as a $1 placeholder, is not a tag.
+func dollarTag(sql string, i int) (string, bool) {
+	if i > 0 && isIdentChar(sql[i-1]) {
+		return "", false
+	}
+	for j := i + 1; j < len(sql); j++ {
+		switch {
+		case sql[j] == '$':
+			return sql[i : j+1], true
+		case !isIdentChar(sql[j]) || (j == i+1 && sql[j] >= '0' && sql[j] <= '9'):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// countStatements counts the non-empty statements ended by a semicolon
+func countStatements(tokens []sqlToken) int {
+	n := 0
+	pending := false
+	for _, tok := range tokens {
+		if tok.text != ";" {
+			pending = true
+			continue
+		}
+		if pending {
+			n++
+		}
+		pending = false
+	}
+	return n
+}
+
+// lineColumn converts a byte offset to a line and a column in characters
+func lineColumn(sql string, offset int) (int, int) {
+	before := sql[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return line, column
+}
@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"errors"
+	"testing"
+
+	"supalytics-executor/driver"
+)
+
+func TestValidateSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		typ      driver.DriverType
+		readOnly bool
+		// want lists the codes of the problems found, in order
+		want []string
+	}{
+		{"select", "select * from events", driver.PostgresType, false, nil},
+		{"cte", "with t as (select 1) select * from t", driver.PostgresType, true, nil},
+		{"several statements", "set search_path = app; select 1", driver.PostgresType, true, nil},
+		{"empty", "  -- nothing\n", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"unterminated string", "select 'abc", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"unterminated comment", "select 1 /* abc", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"unclosed parenthesis", "select (1 + 2", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"unexpected parenthesis", "select 1)", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"unknown statement", "selec 1", driver.PostgresType, false, []string{SQLProblemSyntax}},
+		{"write on a writable connector", "insert into t values (1)", driver.PostgresType, false, nil},
+		{"write on a read-only connector", "insert into t values (1)", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"schema change on a read-only connector", "select 1; drop table t", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"data-modifying cte", "with d as (delete from t returning *) select * from d", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"select into", "select * into copy from t", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"read-only session turned off", "set default_transaction_read_only = off", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"read-write transaction", "begin read write", driver.PostgresType, true, []string{SQLProblemDisallowed}},
+		{"read-only transaction", "start transaction read only; select 1", driver.PostgresType, true, nil},
+		{"keyword in a string", "select 'drop table t'", driver.PostgresType, true, nil},
+		{"bigquery backticks", "select * from `project.dataset.delete`", driver.BigQueryType, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSQL(tt.sql, tt.typ, tt.readOnly)
+			var invalid *SQLValidationError
+			if err != nil && !errors.As(err, &invalid) {
+				t.Fatalf("ValidateSQL(%q) = %v, want a *SQLValidationError", tt.sql, err)
+			}
+			var got []string
+			if invalid != nil {
+				for _, p := range invalid.Problems {
+					got = append(got, p.Code)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ValidateSQL(%q) = %v, want problems %v", tt.sql, err, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ValidateSQL(%q) problem %d = %q, want %q", tt.sql, i+1, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSQLLocatesProblems(t *testing.T) {
+	err := ValidateSQL("select 1;\nselect 'abc", driver.PostgresType, false)
+	var invalid *SQLValidationError
+	if !errors.As(err, &invalid) || len(invalid.Problems) != 1 {
+		t.Fatalf("ValidateSQL = %v, want one problem", err)
+	}
+	p := invalid.Problems[0]
+	if p.Statement != 2 || p.Line != 2 || p.Column != 8 {
+		t.Errorf("problem at statement %d, line %d, column %d; want statement 2, line 2, column 8", p.Statement, p.Line, p.Column)
+	}
+}
+
+func TestReadsOnly(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"select * from events", true},
+		{"(select 1) union (select 2)", true},
+		{"with t as (select 1) select * from t", true},
+		{"select 1; select 2", true},
+		{"select 'insert into t'", true},
+		{"insert into t values (1)", false},
+		{"with d as (delete from t returning *) select * from d", false},
+		{"select * into copy from t", false},
+		{"select * from t for update", false},
+		{"select * from t for no key update", false},
+		{"set search_path = app; select 1", false},
+		{"select 'abc", false},
+	}
+	for _, tt := range tests {
+		if got := readsOnly(tt.sql, driver.PostgresType); got != tt.want {
+			t.Errorf("readsOnly(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
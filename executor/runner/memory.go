@@ -0,0 +1,220 @@
+// runner/memory.go
+package runner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ErrMemoryBudgetExceeded fails an execution whose buffered rows outgrow
+// its memory budget and cannot spill to disk
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// MemoryConfig bounds the rows one execution holds in memory: the result
+// being recorded for the cache, the rows pivot, top and reservoir sample
+// keep until the stream ends, and the source results of composite queries
+type MemoryConfig struct {
+	// Budget is the bytes of buffered rows an execution may hold; zero
+	// leaves it unbounded
+	Budget int64 `toml:"budget"`
+	// Spill moves composite source results over budget to temporary files
+	// instead of failing the execution. Results recorded for the cache are
+	// never spilled: they are not cached. Other buffers always fail.
+	Spill bool `toml:"spill"`
+	// SpillDir holds spilled rows (default the system temp directory)
+	SpillDir string `toml:"spill_dir"`
+}
+
+// memoryAccount tracks the bytes an execution's buffers hold. A nil
+// account has no budget.
+type memoryAccount struct {
+	MemoryConfig
+	used atomic.Int64
+}
+
+func newMemoryAccount(cfg MemoryConfig) *memoryAccount {
+	if cfg.Budget <= 0 {
+		return nil
+	}
+	return &memoryAccount{MemoryConfig: cfg}
+}
+
+// grow charges n bytes held by what, failing when they take the execution
+// over its budget. A failed charge holds nothing.
+func (m *memoryAccount) grow(n int64, what string) error {
+	if m == nil {
+		return nil
+	}
+	if m.used.Add(n) > m.Budget {
+		m.used.Add(-n)
+		return fmt.Errorf("%w: %s needs more than the %d bytes an execution may buffer", ErrMemoryBudgetExceeded, what, m.Budget)
+	}
+	return nil
+}
+
+// shrink returns n bytes to the budget
+func (m *memoryAccount) shrink(n int64) {
+	if m != nil {
+		m.used.Add(-n)
+	}
+}
+
+// rowSize estimates the memory a buffered row holds
+func rowSize(row []interface{}) int64 {
+	// Slice header and an interface per value
+	size := int64(24 + 16*len(row))
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			size += int64(len(v))
+		case []byte:
+			size += int64(len(v)) + 24
+		case time.Time:
+			size += 24
+		case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		default:
+			// Driver types such as decimals and maps; a rough guess
+			size += 64
+		}
+	}
+	return size
+}
+
+// rowBuffer holds rows in memory while the account allows, then spills
+// them to a temporary file when it may, so large results are read back
+// from disk instead of exhausting memory
+type rowBuffer struct {
+	mem  *memoryAccount
+	what string
+
+	rows [][]interface{}
+	held int64
+
+	spill *os.File
+	out   *bufio.Writer
+	enc   *msgpack.Encoder
+}
+
+func newRowBuffer(mem *memoryAccount, what string) *rowBuffer {
+	return &rowBuffer{mem: mem, what: what}
+}
+
+// add buffers a copy of row
+func (b *rowBuffer) add(row []interface{}) error {
+	if b.spill != nil {
+		return b.write(row)
+	}
+
+	size := rowSize(row)
+	err := b.mem.grow(size, b.what)
+	if err == nil {
+		b.held += size
+		b.rows = append(b.rows, append([]interface{}(nil), row...))
+		return nil
+	}
+	if !b.mem.Spill {
+		return err
+	}
+	if err := b.spillRows(); err != nil {
+		return err
+	}
+	return b.write(row)
+}
+
+// spillRows moves the rows held in memory to a new spill file
+func (b *rowBuffer) spillRows() error {
+	f, err := os.CreateTemp(b.mem.SpillDir, "spill-*")
+	if err != nil {
+		return fmt.Errorf("spill %s: %w", b.what, err)
+	}
+	b.spill = f
+	b.out = bufio.NewWriter(f)
+	b.enc = msgpack.NewEncoder(b.out)
+	for _, row := range b.rows {
+		if err := b.write(row); err != nil {
+			return err
+		}
+	}
+	b.rows = nil
+	b.mem.shrink(b.held)
+	b.held = 0
+	return nil
+}
+
+func (b *rowBuffer) write(row []interface{}) error {
+	values := make([]cachedValue, len(row))
+	for i, v := range row {
+		cv, err := encodeCachedValue(v)
+		if err != nil {
+			return fmt.Errorf("spill %s: %w", b.what, err)
+		}
+		values[i] = cv
+	}
+	if err := b.enc.Encode(values); err != nil {
+		return fmt.Errorf("spill %s: %w", b.what, err)
+	}
+	return nil
+}
+
+// each calls fn for every buffered row in the order they were added. It
+// can be called any number of times once the rows have all been added.
+func (b *rowBuffer) each(fn func(row []interface{}) error) error {
+	if b.spill == nil {
+		for _, row := range b.rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := b.out.Flush(); err != nil {
+		return fmt.Errorf("spill %s: %w", b.what, err)
+	}
+	if _, err := b.spill.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("read spilled %s: %w", b.what, err)
+	}
+	// Writes resume at the end of the file should more rows be added
+	defer b.spill.Seek(0, io.SeekEnd)
+
+	dec := msgpack.NewDecoder(bufio.NewReader(b.spill))
+	dec.UseLooseInterfaceDecoding(true)
+	for {
+		var values []cachedValue
+		if err := dec.Decode(&values); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read spilled %s: %w", b.what, err)
+		}
+		row := make([]interface{}, len(values))
+		for i, cv := range values {
+			v, err := decodeCachedValue(cv)
+			if err != nil {
+				return fmt.Errorf("read spilled %s: %w", b.what, err)
+			}
+			row[i] = v
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// close frees the buffered rows and removes any spill file
+func (b *rowBuffer) close() {
+	b.mem.shrink(b.held)
+	b.rows, b.held = nil, 0
+	if b.spill != nil {
+		b.spill.Close()
+		os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+}
@@ -0,0 +1,141 @@
+// runner/metadatacache.go
+package runner
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Default number of queries and connectors the metadata cache holds
+const defaultMetadataCacheMaxEntries = 10000
+
+// MetadataCacheConfig configures the metadata cache
+type MetadataCacheConfig struct {
+	// TTL is how long fetched queries and connectors are reused; zero
+	// disables the cache
+	TTL time.Duration `toml:"ttl"`
+	// MaxEntries bounds the queries and connectors held (default 10000)
+	MaxEntries int `toml:"max_entries"`
+}
+
+// MetadataCache is an LRU cache of fetched queries and connectors, so
+// repeated executions of a query skip the metadata store until the entries
+// expire. Requests that set CacheBust fetch both again.
+type MetadataCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type metadataCacheEntry struct {
+	key     string
+	value   interface{} // Query or Connector
+	expires time.Time
+}
+
+// NewMetadataCache creates a metadata cache, or returns nil when the TTL
+// disables it
+func NewMetadataCache(cfg MetadataCacheConfig) *MetadataCache {
+	if cfg.TTL <= 0 {
+		return nil
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMetadataCacheMaxEntries
+	}
+	return &MetadataCache{
+		ttl:        cfg.TTL,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// query returns an unexpired copy of a cached query
+func (c *MetadataCache) query(queryID string) (*Query, bool) {
+	v, ok := c.get(freshKey(tableQueries, queryID))
+	if !ok {
+		return nil, false
+	}
+	q := v.(Query)
+	return &q, true
+}
+
+// connector returns an unexpired copy of a cached connector
+func (c *MetadataCache) connector(connectorID string) (*Connector, bool) {
+	v, ok := c.get(freshKey(tableConnectors, connectorID))
+	if !ok {
+		return nil, false
+	}
+	conn := v.(Connector)
+	return &conn, true
+}
+
+// putQuery caches a query; copies served from a stale cache are not kept
+func (c *MetadataCache) putQuery(q *Query) {
+	if c != nil && !q.Stale {
+		c.put(freshKey(tableQueries, q.ID), *q)
+	}
+}
+
+// putConnector caches a connector; copies served from a stale cache are
+// not kept
+func (c *MetadataCache) putConnector(conn *Connector) {
+	if c != nil && !conn.Stale {
+		c.put(freshKey(tableConnectors, conn.ID), *conn)
+	}
+}
+
+// Len returns the queries and connectors held, expired ones included
+func (c *MetadataCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *MetadataCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*metadataCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *MetadataCache) put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &metadataCacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*metadataCacheEntry).key)
+	}
+}
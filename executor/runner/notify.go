@@ -0,0 +1,62 @@
+// runner/notify.go
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"supalytics-executor/driver"
+)
+
+// ErrNotifyUnsupported is returned when listening for notifications on a
+// connector whose engine cannot send them
+var ErrNotifyUnsupported = errors.New("connector does not support notifications")
+
+// Listener is a connection to a query's connector that waits for the
+// notifications sent on a channel
+type Listener struct {
+	drv      driver.Driver
+	notifier driver.Notifier
+}
+
+// Listen connects to the connector of the query and listens on the channel.
+// The caller closes the listener.
+func Listen(ctx context.Context, store MetadataStore, queryID string, channel string, opts ExecuteOptions) (*Listener, error) {
+	query, err := fetchQuery(ctx, store, queryID, opts)
+	if err != nil {
+		return nil, err
+	}
+	if query.isComposite() {
+		return nil, fmt.Errorf("%w: composite query %s has no connector of its own", ErrNotifyUnsupported, query.ID)
+	}
+	connector, err := fetchConnector(ctx, store, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	drv, err := connect(ctx, connector, opts)
+	if err != nil {
+		return nil, err
+	}
+	notifier, ok := drv.(driver.Notifier)
+	if !ok {
+		drv.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotifyUnsupported, connector.Type)
+	}
+	if err := notifier.Listen(ctx, channel); err != nil {
+		drv.Close()
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	return &Listener{drv: drv, notifier: notifier}, nil
+}
+
+// Wait blocks until a notification arrives and returns its payload
+func (l *Listener) Wait(ctx context.Context) (string, error) {
+	return l.notifier.WaitForNotification(ctx)
+}
+
+// Close disconnects from the connector
+func (l *Listener) Close() error {
+	return l.drv.Close()
+}
@@ -0,0 +1,93 @@
+// runner/organizations.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Organization holds settings shared by every connector of an organization
+type Organization struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// TemplateDefaults are template variables available to every query of
+	// the organization, beneath connector defaults and request data
+	TemplateDefaults map[string]interface{} `json:"template_defaults"`
+	CreatedAt        time.Time              `json:"created_at"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+}
+
+// OrganizationStore resolves organizations. Metadata stores that implement
+// it supply organization-wide template defaults.
+type OrganizationStore interface {
+	FetchOrganization(ctx context.Context, organizationID string) (*Organization, error)
+}
+
+// FetchOrganization retrieves an organization by ID from Supabase
+func (s *SupabaseStore) FetchOrganization(ctx context.Context, organizationID string) (*Organization, error) {
+	var orgs []Organization
+	resp, _, err := s.client.From("organizations").Select("*", "exact", false).Eq("id", organizationID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &orgs); err != nil {
+		return nil, err
+	}
+
+	if len(orgs) == 0 {
+		return nil, ErrOrganizationNotFound
+	}
+
+	return &orgs[0], nil
+}
+
+// PutOrganization adds or replaces an organization
+func (s *MemoryStore) PutOrganization(o Organization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orgs[o.ID] = o
+}
+
+// FetchOrganization retrieves an organization by ID
+func (s *MemoryStore) FetchOrganization(ctx context.Context, organizationID string) (*Organization, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.orgs[organizationID]
+	if !ok {
+		return nil, ErrOrganizationNotFound
+	}
+	return &o, nil
+}
+
+// FetchOrganization retrieves an organization, falling back to the cache when the store is unavailable
+func (s *CachingStore) FetchOrganization(ctx context.Context, organizationID string) (*Organization, error) {
+	orgs, ok := s.store.(OrganizationStore)
+	if !ok {
+		return nil, ErrOrganizationNotFound
+	}
+
+	o, err := fetch(ctx, func() (*Organization, error) { return orgs.FetchOrganization(ctx, organizationID) })
+	if err == nil {
+		s.mu.Lock()
+		s.orgs[organizationID] = *o
+		s.mu.Unlock()
+		s.markAvailable()
+		return o, nil
+	}
+	if errors.Is(err, ErrOrganizationNotFound) {
+		s.markAvailable()
+		return nil, err
+	}
+
+	s.markUnavailable(err)
+	s.mu.RLock()
+	cached, ok := s.orgs[organizationID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, err
+	}
+	return &cached, nil
+}
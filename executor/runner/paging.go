@@ -0,0 +1,123 @@
+// runner/paging.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"supalytics-executor/driver"
+)
+
+// pager returns one page of a result set. The engine is asked for the page
+// where the final statement can be wrapped; otherwise rows outside the page
+// are dropped as they stream by.
+type pager struct {
+	limit  int64 // 0 for no limit
+	offset int64
+
+	// preview adds the limit to the statement itself rather than wrapping
+	// it, falling back to wrapping when that is not possible
+	preview bool
+
+	// wrapped is set once the engine applies the offset and returns at
+	// most one row past the page
+	wrapped   bool
+	truncated atomic.Bool
+}
+
+func newPager(opts ExecuteOptions) *pager {
+	if opts.PreviewRows > 0 {
+		return &pager{limit: opts.PreviewRows, preview: true}
+	}
+	if opts.Limit <= 0 && opts.Offset <= 0 {
+		return nil
+	}
+	return &pager{limit: opts.Limit, offset: opts.Offset}
+}
+
+// wrap rewrites stmt to return the page plus one row, which tells whether
+// the result continues past it. It reports false when the statement cannot
+// be wrapped.
+func (p *pager) wrap(stmt string, typ driver.DriverType) (string, bool) {
+	if p.limit <= 0 || typ == driver.MockType {
+		return "", false
+	}
+	if p.preview {
+		if limited, ok := injectLimit(stmt, typ, p.limit+1); ok {
+			p.wrapped = true
+			return limited, true
+		}
+	}
+
+	switch strings.ToUpper(leadingKeyword(stmt, dialectFor(typ))) {
+	case "SELECT", "WITH", "VALUES", "TABLE", "(":
+	default:
+		return "", false
+	}
+
+	fetch := p.limit + 1
+	var clause string
+	switch typ {
+	case driver.SQLServerType:
+		// OFFSET requires an ORDER BY; sorting by a constant keeps the
+		// statement's own order
+		clause = fmt.Sprintf("ORDER BY (SELECT NULL) OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", p.offset, fetch)
+	case driver.OracleType:
+		clause = fmt.Sprintf("OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", p.offset, fetch)
+	case driver.AthenaType:
+		// Trino takes OFFSET before LIMIT
+		clause = fmt.Sprintf("OFFSET %d LIMIT %d", p.offset, fetch)
+		if p.offset == 0 {
+			clause = fmt.Sprintf("LIMIT %d", fetch)
+		}
+	default:
+		clause = fmt.Sprintf("LIMIT %d OFFSET %d", fetch, p.offset)
+	}
+
+	alias := " AS paged"
+	if typ == driver.OracleType {
+		alias = " paged"
+	}
+	p.wrapped = true
+	return fmt.Sprintf("SELECT * FROM (\n%s\n)%s %s", stmt, alias, clause), true
+}
+
+// apply limits a result to the page, recording whether rows past it were
+// left unread
+func (p *pager) apply(result *driver.QueryResult) *driver.QueryResult {
+	stream := result.Stream
+	if stream == nil {
+		return result
+	}
+
+	paged := *result
+	paged.Stream = func(yield func(columns []string, row []interface{}) error) error {
+		var seen, sent int64
+		stopped := false
+		err := stream(func(columns []string, row []interface{}) error {
+			if row == nil {
+				return yield(columns, row)
+			}
+			if !p.wrapped && seen < p.offset {
+				seen++
+				return nil
+			}
+			if p.limit > 0 && sent == p.limit {
+				p.truncated.Store(true)
+				stopped = true
+				return io.EOF
+			}
+			sent++
+			return yield(columns, row)
+		})
+		// Drivers either return the io.EOF that stopped them or end cleanly
+		if stopped && errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+	return &paged
+}
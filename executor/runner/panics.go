@@ -0,0 +1,41 @@
+// runner/panics.go
+package runner
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// PanicError is a panic recovered from an execution, such as a driver bug
+// or a conversion helper meeting a value it did not expect. It fails that
+// execution alone; its stack is logged rather than sent to clients.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("internal error: %v", e.Value)
+}
+
+// Recovered turns the value recover returned into a *PanicError and logs
+// it with the stack of the goroutine that panicked, or returns nil when
+// nothing panicked. Call it from a deferred function as
+// Recovered(recover(), what) where what names the work that panicked.
+func Recovered(v interface{}, what string) error {
+	if v == nil {
+		return nil
+	}
+	stack := debug.Stack()
+	log.Printf("Recovered from panic in %s: %v\n%s", what, v, stack)
+	return &PanicError{Value: v, Stack: stack}
+}
+
+// CatchPanic recovers a panic in the function deferring it, returning it
+// as a *PanicError through err
+func CatchPanic(err *error, what string) {
+	if p := Recovered(recover(), what); p != nil {
+		*err = p
+	}
+}
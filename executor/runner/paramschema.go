@@ -0,0 +1,202 @@
+// runner/paramschema.go
+package runner
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Parameter types a query's schema can declare
+const (
+	ParamString    = "string"
+	ParamNumber    = "number"
+	ParamInteger   = "integer"
+	ParamBoolean   = "boolean"
+	ParamDate      = "date"      // YYYY-MM-DD
+	ParamTimestamp = "timestamp" // RFC 3339
+	ParamList      = "list"      // elements of Items, any type when unset
+)
+
+// Codes of the parameter errors in a ValidationError
+const (
+	ParamErrorRequired = "required"
+	ParamErrorType     = "type"
+	ParamErrorAllowed  = "allowed"
+)
+
+// ParameterSpec declares a template parameter a query accepts
+type ParameterSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Items    string `json:"items,omitempty"`
+	Required bool   `json:"required,omitempty"`
+	// AllowedValues restricts the parameter, or each element of a list, to
+	// these values
+	AllowedValues []interface{} `json:"allowed_values,omitempty"`
+	// Default is used when the parameter is missing
+	Default interface{} `json:"default,omitempty"`
+}
+
+// ParameterError describes one parameter that failed validation
+type ParameterError struct {
+	Parameter string `json:"parameter"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// ValidationError lists every parameter of a run that does not match the
+// query's parameter schema
+type ValidationError struct {
+	Errors []ParameterError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, p := range e.Errors {
+		problems[i] = p.Parameter + ": " + p.Message
+	}
+	return "invalid template parameters: " + strings.Join(problems, "; ")
+}
+
+// validateParameters checks template data against a parameter schema,
+// returning the data with defaults filled in for missing parameters
+func validateParameters(specs []ParameterSpec, templateData interface{}) (interface{}, error) {
+	if len(specs) == 0 {
+		return templateData, nil
+	}
+	data := make(map[string]interface{})
+	switch d := templateData.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k, v := range d {
+			data[k] = v
+		}
+	default:
+		return nil, fmt.Errorf("template data must be an object to validate parameters, got %T", templateData)
+	}
+
+	var invalid []ParameterError
+	for _, spec := range specs {
+		value, ok := data[spec.Name]
+		if !ok || value == nil {
+			if spec.Default != nil {
+				data[spec.Name] = spec.Default
+			} else if spec.Required {
+				invalid = append(invalid, ParameterError{Parameter: spec.Name, Code: ParamErrorRequired, Message: "is required"})
+			}
+			continue
+		}
+		if problem := spec.check(value); problem != nil {
+			invalid = append(invalid, *problem)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, &ValidationError{Errors: invalid}
+	}
+	return data, nil
+}
+
+// check validates a parameter's value against its spec
+func (spec ParameterSpec) check(value interface{}) *ParameterError {
+	if spec.Type != ParamList {
+		if !hasParamType(spec.Type, value) {
+			return &ParameterError{Parameter: spec.Name, Code: ParamErrorType, Message: fmt.Sprintf("must be a %s, got %v", spec.Type, value)}
+		}
+		if !spec.allows(value) {
+			return &ParameterError{Parameter: spec.Name, Code: ParamErrorAllowed, Message: fmt.Sprintf("must be one of %v, got %v", spec.AllowedValues, value)}
+		}
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &ParameterError{Parameter: spec.Name, Code: ParamErrorType, Message: fmt.Sprintf("must be a list, got %v", value)}
+	}
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i).Interface()
+		if !hasParamType(spec.Items, item) {
+			return &ParameterError{Parameter: spec.Name, Code: ParamErrorType, Message: fmt.Sprintf("element %d must be a %s, got %v", i, spec.Items, item)}
+		}
+		if !spec.allows(item) {
+			return &ParameterError{Parameter: spec.Name, Code: ParamErrorAllowed, Message: fmt.Sprintf("element %d must be one of %v, got %v", i, spec.AllowedValues, item)}
+		}
+	}
+	return nil
+}
+
+// allows reports whether a value is among the spec's allowed values.
+// Numbers compare by value whatever their Go type.
+func (spec ParameterSpec) allows(value interface{}) bool {
+	if len(spec.AllowedValues) == 0 {
+		return true
+	}
+	n, numeric := paramNumber(value)
+	for _, allowed := range spec.AllowedValues {
+		if m, ok := paramNumber(allowed); ok && numeric {
+			if m == n {
+				return true
+			}
+			continue
+		}
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hasParamType reports whether a value is of a parameter type; an empty type
+// accepts anything
+func hasParamType(typ string, value interface{}) bool {
+	switch typ {
+	case "":
+		return true
+	case ParamString:
+		_, ok := value.(string)
+		return ok
+	case ParamNumber:
+		_, ok := paramNumber(value)
+		return ok
+	case ParamInteger:
+		n, ok := paramNumber(value)
+		return ok && n == math.Trunc(n)
+	case ParamBoolean:
+		_, ok := value.(bool)
+		return ok
+	case ParamDate:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case ParamTimestamp:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case ParamList:
+		v := reflect.ValueOf(value)
+		return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+	}
+	return false
+}
+
+// paramNumber converts a numeric value of any Go type to float64
+func paramNumber(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
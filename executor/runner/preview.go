@@ -0,0 +1,125 @@
+// runner/preview.go
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	"supalytics-executor/driver"
+)
+
+// injectLimit rewrites a query to return at most n rows by adding the
+// dialect's row limit to the statement itself: TOP on SQL Server, FETCH FIRST
+// on Oracle and LIMIT elsewhere, where the planner is sure to see it and can
+// stop reading once it has enough rows. It reports false when the statement already limits its rows or its shape
+// would change meaning, in which case the caller wraps it instead.
+func injectLimit(stmt string, typ driver.DriverType, n int64) (string, bool) {
+	if typ == driver.MockType {
+		return "", false
+	}
+
+	stmt = strings.TrimRight(strings.TrimSpace(stmt), ";")
+	d := dialectFor(typ)
+	switch strings.ToUpper(leadingKeyword(stmt, d)) {
+	case "SELECT", "WITH", "VALUES", "TABLE":
+	default:
+		return "", false
+	}
+
+	words := topLevelWords(stmt, d)
+	firstSelect := -1
+	for i, w := range words {
+		switch strings.ToUpper(w.text) {
+		case "LIMIT", "FETCH", "TOP", "OFFSET", "FOR", "INTO":
+			return "", false
+		case "UNION", "INTERSECT", "EXCEPT", "MINUS":
+			// TOP would bind to the first branch only
+			if typ == driver.SQLServerType {
+				return "", false
+			}
+		case "SELECT":
+			if firstSelect < 0 {
+				firstSelect = i
+			}
+		}
+	}
+
+	switch typ {
+	case driver.SQLServerType:
+		if firstSelect < 0 {
+			return "", false
+		}
+		// TOP follows SELECT and its DISTINCT or ALL quantifier
+		at := words[firstSelect].end
+		if next := firstSelect + 1; next < len(words) {
+			if q := strings.ToUpper(words[next].text); q == "DISTINCT" || q == "ALL" {
+				at = words[next].end
+			}
+		}
+		return fmt.Sprintf("%s TOP (%d)%s", stmt[:at], n, stmt[at:]), true
+	case driver.OracleType:
+		return fmt.Sprintf("%s\nFETCH FIRST %d ROWS ONLY", stmt, n), true
+	default:
+		// The clause goes on its own line so a trailing line comment
+		// cannot swallow it
+		return fmt.Sprintf("%s\nLIMIT %d", stmt, n), true
+	}
+}
+
+// word is a keyword or identifier outside any parentheses, literal or comment
+type word struct {
+	text string
+	end  int // index just past the word
+}
+
+// topLevelWords returns the words of stmt that are not nested in
+// parentheses, skipping literals, quoted identifiers and comments
+func topLevelWords(stmt string, d dialect) []word {
+	var words []word
+	depth := 0
+	for i := 0; i < len(stmt); {
+		c := stmt[i]
+		switch {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == '-' && strings.HasPrefix(stmt[i:], "--"),
+			c == '#' && d.hashComments:
+			i = skipLine(stmt, i)
+		case c == '/' && strings.HasPrefix(stmt[i:], "/*"):
+			if end := strings.Index(stmt[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(stmt)
+			}
+		case (c == '\'' || c == '"') && d.tripleQuotes && strings.HasPrefix(stmt[i:], strings.Repeat(string(c), 3)):
+			i = skipTripleQuoted(stmt, i, c)
+		case c == '\'':
+			i = skipQuoted(stmt, i, '\'', d.backslashEscapes || isEscapeString(stmt, i))
+		case c == '"':
+			i = skipQuoted(stmt, i, '"', d.backslashEscapes)
+		case c == '`' && d.backticks:
+			i = skipQuoted(stmt, i, '`', false)
+		case c == '[' && !d.backticks:
+			// SQL Server [quoted identifiers]
+			i = skipQuoted(stmt, i, ']', false)
+		case c == '$' && d.dollarQuotes:
+			i = skipDollarQuoted(stmt, i)
+		case isIdentChar(c):
+			j := i
+			for j < len(stmt) && isIdentChar(stmt[j]) {
+				j++
+			}
+			if depth == 0 {
+				words = append(words, word{text: stmt[i:j], end: j})
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return words
+}
@@ -0,0 +1,167 @@
+// runner/prewarm.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrPrewarmNotFound is returned for pre-warmed queries that do not exist
+var ErrPrewarmNotFound = errors.New("pre-warmed query not found")
+
+// Prewarm declares a query whose result is executed ahead of time and kept
+// in the result cache, so dashboards running it with the same template
+// data are served from the cache on first paint
+type Prewarm struct {
+	ID             string `json:"id"`
+	OrganizationID string `json:"organization_id,omitempty"`
+	QueryID        string `json:"query_id"`
+
+	// ParameterSet, TemplateData and Timezone are those the dashboard runs
+	// the query with; a result is only served to executions that render the
+	// same SQL
+	ParameterSet string                 `json:"parameter_set,omitempty"`
+	TemplateData map[string]interface{} `json:"template_data,omitempty"`
+	Timezone     string                 `json:"timezone,omitempty"`
+
+	// IntervalSeconds re-executes the query on this schedule, which should
+	// be shorter than the result cache's TTL; zero executes it only when it
+	// is declared and, with OnStartup, when the executor starts. Scheduled
+	// queries are also executed at startup.
+	IntervalSeconds int64 `json:"interval_seconds,omitempty"`
+	OnStartup       bool  `json:"on_startup,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Interval is the time between scheduled executions, or zero for none
+func (p *Prewarm) Interval() time.Duration {
+	return time.Duration(p.IntervalSeconds) * time.Second
+}
+
+// PrewarmStore keeps the queries declared for pre-warming. Metadata stores
+// that implement it have those queries executed into the result cache.
+type PrewarmStore interface {
+	ListPrewarms(ctx context.Context) ([]Prewarm, error)
+	SavePrewarm(ctx context.Context, p Prewarm) error
+	DeletePrewarm(ctx context.Context, id string) error
+}
+
+// WarmResult executes a pre-warmed query, replacing any cached result, and
+// reads it to the end so the result cache stores it. It returns the number
+// of rows. opts supplies the server's settings; the cache control,
+// template data and caller come from the declaration, whose organization
+// the query must belong to.
+func WarmResult(ctx context.Context, store MetadataStore, p *Prewarm, opts ExecuteOptions) (rows int64, err error) {
+	defer CatchPanic(&err, "pre-warm "+p.ID)
+
+	opts.CacheControl = CacheRefresh
+	opts.ParameterSet = p.ParameterSet
+	opts.Timezone = p.Timezone
+	opts.Caller = nil
+	if p.OrganizationID != "" {
+		opts.Caller = &Caller{OrganizationID: p.OrganizationID}
+	}
+
+	result, err := ExecuteQuery(ctx, p.QueryID, p.TemplateData, store, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer result.Close()
+	err = result.Stream(func(columns []string, row []interface{}) error {
+		if row != nil {
+			rows++
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// ListPrewarms retrieves every pre-warmed query from Supabase
+func (s *SupabaseStore) ListPrewarms(ctx context.Context) ([]Prewarm, error) {
+	var prewarms []Prewarm
+	resp, _, err := s.client.From("prewarmed_queries").Select("*", "exact", false).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &prewarms); err != nil {
+		return nil, err
+	}
+
+	return prewarms, nil
+}
+
+// SavePrewarm adds or replaces a pre-warmed query in Supabase
+func (s *SupabaseStore) SavePrewarm(ctx context.Context, p Prewarm) error {
+	_, _, err := s.client.From("prewarmed_queries").Insert(p, true, "id", "minimal", "").Execute()
+	return err
+}
+
+// DeletePrewarm removes a pre-warmed query from Supabase
+func (s *SupabaseStore) DeletePrewarm(ctx context.Context, id string) error {
+	_, _, err := s.client.From("prewarmed_queries").Delete("minimal", "").Eq("id", id).Execute()
+	return err
+}
+
+// ListPrewarms returns the pre-warmed queries, oldest first
+func (s *MemoryStore) ListPrewarms(ctx context.Context) ([]Prewarm, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prewarms := make([]Prewarm, 0, len(s.prewarms))
+	for _, p := range s.prewarms {
+		prewarms = append(prewarms, p)
+	}
+	sort.Slice(prewarms, func(i, j int) bool { return prewarms[i].CreatedAt.Before(prewarms[j].CreatedAt) })
+	return prewarms, nil
+}
+
+// SavePrewarm adds or replaces a pre-warmed query
+func (s *MemoryStore) SavePrewarm(ctx context.Context, p Prewarm) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prewarms[p.ID] = p
+	return nil
+}
+
+// DeletePrewarm removes a pre-warmed query
+func (s *MemoryStore) DeletePrewarm(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.prewarms[id]; !ok {
+		return ErrPrewarmNotFound
+	}
+	delete(s.prewarms, id)
+	return nil
+}
+
+// ListPrewarms reads the underlying store's pre-warmed queries. They are
+// not cached; none are listed while the store is unavailable.
+func (s *CachingStore) ListPrewarms(ctx context.Context) ([]Prewarm, error) {
+	prewarms, ok := s.store.(PrewarmStore)
+	if !ok {
+		return nil, nil
+	}
+	return prewarms.ListPrewarms(ctx)
+}
+
+// SavePrewarm saves a pre-warmed query in the underlying store
+func (s *CachingStore) SavePrewarm(ctx context.Context, p Prewarm) error {
+	prewarms, ok := s.store.(PrewarmStore)
+	if !ok {
+		return errors.New("the metadata store does not keep pre-warmed queries")
+	}
+	return prewarms.SavePrewarm(ctx, p)
+}
+
+// DeletePrewarm removes a pre-warmed query from the underlying store
+func (s *CachingStore) DeletePrewarm(ctx context.Context, id string) error {
+	prewarms, ok := s.store.(PrewarmStore)
+	if !ok {
+		return ErrPrewarmNotFound
+	}
+	return prewarms.DeletePrewarm(ctx, id)
+}
@@ -0,0 +1,146 @@
+// runner/quotas.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrQuotaNotFound is returned for organizations without a quota row
+var ErrQuotaNotFound = errors.New("quota not found")
+
+// Quota limits how much an organization may run. Zero leaves a limit off.
+type Quota struct {
+	OrganizationID       string `json:"organization_id"`
+	MaxConcurrentQueries int    `json:"max_concurrent_queries" toml:"max_concurrent_queries"`
+	MaxQueriesPerMinute  int    `json:"max_queries_per_minute" toml:"max_queries_per_minute"`
+	// MaxRowsPerQuery truncates larger results, which report truncated
+	MaxRowsPerQuery int64 `json:"max_rows_per_query" toml:"max_rows_per_query"`
+	// MaxStreamRows and MaxStreamBytes stop a stream once it has sent this
+	// many rows or encoded row bytes, whatever the query produces
+	MaxStreamRows  int64 `json:"max_stream_rows" toml:"max_stream_rows"`
+	MaxStreamBytes int64 `json:"max_stream_bytes" toml:"max_stream_bytes"`
+	// MaxBytesScannedPerMonth blocks further queries once the organization's
+	// queries have scanned (or, where the engine says, been billed for) this
+	// much data in the calendar month (UTC)
+	MaxBytesScannedPerMonth int64 `json:"max_bytes_scanned_per_month" toml:"max_bytes_scanned_per_month"`
+}
+
+// QuotaStore resolves organization quotas. Metadata stores that implement
+// it override the server's default quota per organization.
+type QuotaStore interface {
+	FetchQuota(ctx context.Context, organizationID string) (*Quota, error)
+}
+
+// ScanUsageStore totals the data an organization's executions scanned, so
+// scan budgets hold across restarts and replicas. Metadata stores that
+// implement it read the totals from their audit log.
+type ScanUsageStore interface {
+	ScannedBytes(ctx context.Context, organizationID string, since time.Time) (int64, error)
+}
+
+// ChargedBytes is what an execution counts against a scan budget: the bytes
+// billed where the engine reports them, otherwise the bytes scanned
+func (e *AuditEntry) ChargedBytes() int64 {
+	if e.BytesBilled > 0 {
+		return e.BytesBilled
+	}
+	return e.BytesScanned
+}
+
+// FetchQuota retrieves an organization's quota from Supabase
+func (s *SupabaseStore) FetchQuota(ctx context.Context, organizationID string) (*Quota, error) {
+	var quotas []Quota
+	resp, _, err := s.client.From("organization_quotas").Select("*", "exact", false).Eq("organization_id", organizationID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &quotas); err != nil {
+		return nil, err
+	}
+
+	if len(quotas) == 0 {
+		return nil, ErrQuotaNotFound
+	}
+
+	return &quotas[0], nil
+}
+
+// ScannedBytes totals the data scanned by an organization's executions
+// since a time, from the query_audit_log table
+func (s *SupabaseStore) ScannedBytes(ctx context.Context, organizationID string, since time.Time) (int64, error) {
+	var entries []AuditEntry
+	resp, _, err := s.client.From("query_audit_log").Select("bytes_scanned,bytes_billed", "exact", false).
+		Eq("organization_id", organizationID).
+		Gte("finished_at", since.UTC().Format(time.RFC3339)).
+		Gt("bytes_scanned", "0").
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(resp, &entries); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.ChargedBytes()
+	}
+	return total, nil
+}
+
+// PutQuota adds or replaces an organization's quota
+func (s *MemoryStore) PutQuota(q Quota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas[q.OrganizationID] = q
+}
+
+// FetchQuota retrieves an organization's quota
+func (s *MemoryStore) FetchQuota(ctx context.Context, organizationID string) (*Quota, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q, ok := s.quotas[organizationID]
+	if !ok {
+		return nil, ErrQuotaNotFound
+	}
+	return &q, nil
+}
+
+// ScannedBytes totals the data scanned by an organization's executions
+// since a time
+func (s *MemoryStore) ScannedBytes(ctx context.Context, organizationID string, since time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total int64
+	for _, e := range s.audit {
+		if e.OrganizationID == organizationID && !e.FinishedAt.Before(since) {
+			total += e.ChargedBytes()
+		}
+	}
+	return total, nil
+}
+
+// ScannedBytes reads the totals of the underlying store; without them
+// usage is counted from zero
+func (s *CachingStore) ScannedBytes(ctx context.Context, organizationID string, since time.Time) (int64, error) {
+	usage, ok := s.store.(ScanUsageStore)
+	if !ok {
+		return 0, nil
+	}
+	return usage.ScannedBytes(ctx, organizationID, since)
+}
+
+// FetchQuota retrieves a quota from the underlying store. Callers cache
+// quotas themselves.
+func (s *CachingStore) FetchQuota(ctx context.Context, organizationID string) (*Quota, error) {
+	quotas, ok := s.store.(QuotaStore)
+	if !ok {
+		return nil, ErrQuotaNotFound
+	}
+	return quotas.FetchQuota(ctx, organizationID)
+}
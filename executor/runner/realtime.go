@@ -0,0 +1,282 @@
+// runner/realtime.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Metadata tables whose rows the cache follows
+const (
+	tableQueries    = "queries"
+	tableConnectors = "connectors"
+)
+
+const (
+	// Interval between Phoenix heartbeats on the Realtime socket
+	realtimeHeartbeat = 25 * time.Second
+
+	// Time allowed to connect and join the change channel
+	realtimeJoinTimeout = 10 * time.Second
+
+	// Bounds of the delay between reconnection attempts
+	realtimeMinBackoff = time.Second
+	realtimeMaxBackoff = 30 * time.Second
+)
+
+// ChangeHandlers receive the events of a change feed
+type ChangeHandlers struct {
+	// OnSynced is called each time the feed (re)subscribes; every change
+	// after it is delivered until OnLost
+	OnSynced func()
+	// OnChange is called with the table and ID of each inserted, updated
+	// or deleted row
+	OnChange func(table, id string)
+	// OnLost is called when changes may be missed, until the next OnSynced
+	OnLost func(err error)
+}
+
+// ChangeFeed streams changes to metadata rows
+type ChangeFeed interface {
+	// Follow delivers changes to the tables' rows until ctx is done,
+	// resubscribing whenever the feed is interrupted
+	Follow(ctx context.Context, tables []string, h ChangeHandlers)
+}
+
+// Follow keeps cached queries and connectors current from a change feed.
+// While the feed is subscribed, rows that have not changed since they were
+// fetched are served from the cache without asking the store; every cached
+// row is fetched again after the feed is interrupted.
+func (s *CachingStore) Follow(ctx context.Context, feed ChangeFeed) {
+	go feed.Follow(ctx, []string{tableQueries, tableConnectors}, ChangeHandlers{
+		OnSynced: func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.live = true
+			s.resetFresh()
+			s.health.Realtime = true
+		},
+		OnChange: func(table, id string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.epoch++
+			delete(s.fresh, freshKey(table, id))
+		},
+		OnLost: func(err error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.live = false
+			s.resetFresh()
+			s.health.Realtime = false
+		},
+	})
+}
+
+// freshKey names a cached row in the fresh set
+func freshKey(table, id string) string {
+	return table + "/" + id
+}
+
+// resetFresh forgets which rows are current; the caller holds the lock
+func (s *CachingStore) resetFresh() {
+	s.epoch++
+	s.fresh = make(map[string]bool)
+}
+
+// keepFresh marks a row fetched at epoch as current, unless a change may
+// have arrived while it was being fetched; the caller holds the lock
+func (s *CachingStore) keepFresh(key string, epoch uint64) {
+	if s.live && s.epoch == epoch {
+		s.fresh[key] = true
+	}
+}
+
+// SupabaseRealtime follows Postgres changes through Supabase Realtime
+type SupabaseRealtime struct {
+	url    string
+	key    string
+	dialer *websocket.Dialer
+}
+
+// NewSupabaseRealtime creates a change feed for the Supabase project at
+// projectURL, authenticating with key
+func NewSupabaseRealtime(projectURL, key string) (*SupabaseRealtime, error) {
+	u, err := url.Parse(projectURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse Supabase URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("unsupported Supabase URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/realtime/v1/websocket"
+	u.RawQuery = url.Values{"apikey": {key}, "vsn": {"1.0.0"}}.Encode()
+	return &SupabaseRealtime{url: u.String(), key: key, dialer: websocket.DefaultDialer}, nil
+}
+
+// phoenixMessage is a frame of the Phoenix channel protocol Realtime speaks
+type phoenixMessage struct {
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	Ref     *string         `json:"ref"`
+}
+
+// Follow subscribes to changes of the tables in the public schema,
+// reconnecting with backoff until ctx is done
+func (r *SupabaseRealtime) Follow(ctx context.Context, tables []string, h ChangeHandlers) {
+	backoff := realtimeMinBackoff
+	for {
+		err := r.follow(ctx, tables, h, func() { backoff = realtimeMinBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Realtime subscription interrupted, retrying in %s: %v", backoff, err)
+		h.OnLost(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, realtimeMaxBackoff)
+	}
+}
+
+// follow runs one subscription until it fails
+func (r *SupabaseRealtime) follow(ctx context.Context, tables []string, h ChangeHandlers, joined func()) error {
+	dialCtx, cancel := context.WithTimeout(ctx, realtimeJoinTimeout)
+	conn, _, err := r.dialer.DialContext(dialCtx, r.url, nil)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+
+	// Closing the socket ends the read loop once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	var writeMu sync.Mutex
+	var ref int
+	send := func(topic, event string, payload interface{}) (string, error) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		ref++
+		id := strconv.Itoa(ref)
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return "", err
+		}
+		return id, conn.WriteJSON(phoenixMessage{Topic: topic, Event: event, Payload: data, Ref: &id})
+	}
+
+	changes := make([]map[string]string, len(tables))
+	for i, table := range tables {
+		changes[i] = map[string]string{"event": "*", "schema": "public", "table": table}
+	}
+	topic := "realtime:supalytics-metadata"
+	joinRef, err := send(topic, "phx_join", map[string]interface{}{
+		"config":       map[string]interface{}{"postgres_changes": changes},
+		"access_token": r.key,
+	})
+	if err != nil {
+		return fmt.Errorf("join: %w", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(realtimeHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := send("phoenix", "heartbeat", struct{}{}); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	// Until the join is acknowledged the socket must answer promptly;
+	// afterwards heartbeat replies arrive at least every interval
+	deadline := realtimeJoinTimeout
+	for {
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		var msg phoenixMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if msg.Topic != topic {
+			continue
+		}
+
+		switch msg.Event {
+		case "phx_reply":
+			if msg.Ref == nil || *msg.Ref != joinRef {
+				continue
+			}
+			var reply struct {
+				Status   string          `json:"status"`
+				Response json.RawMessage `json:"response"`
+			}
+			if err := json.Unmarshal(msg.Payload, &reply); err != nil {
+				return fmt.Errorf("join: %w", err)
+			}
+			if reply.Status != "ok" {
+				return fmt.Errorf("join: %s %s", reply.Status, reply.Response)
+			}
+			deadline = 2 * realtimeHeartbeat
+			joined()
+			h.OnSynced()
+		case "postgres_changes":
+			var change struct {
+				Data struct {
+					Table     string                 `json:"table"`
+					Record    map[string]interface{} `json:"record"`
+					OldRecord map[string]interface{} `json:"old_record"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(msg.Payload, &change); err != nil {
+				return fmt.Errorf("decode change: %w", err)
+			}
+			for _, record := range []map[string]interface{}{change.Data.Record, change.Data.OldRecord} {
+				if id, ok := record["id"].(string); ok {
+					h.OnChange(change.Data.Table, id)
+				}
+			}
+		case "system":
+			var status struct {
+				Status  string `json:"status"`
+				Message string `json:"message"`
+			}
+			if json.Unmarshal(msg.Payload, &status) == nil && status.Status == "error" {
+				return fmt.Errorf("subscription: %s", status.Message)
+			}
+		case "phx_error", "phx_close":
+			return fmt.Errorf("channel %s", strings.TrimPrefix(msg.Event, "phx_"))
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// runner/rediscache.go
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"supalytics-executor/driver"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	defaultRedisKeyPrefix  = "supalytics:"
+	defaultInFlightTimeout = 5 * time.Minute
+
+	// Interval at which a waiting replica checks that the execution it
+	// waits for still holds its claim
+	inFlightPollInterval = time.Second
+)
+
+// ExecutionCoordinator lets replicas that share a result cache run each
+// uncached query once. The replica that claims a key executes the query;
+// the others wait for it to release the claim and read the cached result.
+type ExecutionCoordinator interface {
+	// Claim reports whether the caller now owns the execution of key
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release ends a claim and wakes the replicas waiting on it
+	Release(ctx context.Context, key string) error
+	// Wait blocks until nobody holds a claim on key
+	Wait(ctx context.Context, key string) error
+}
+
+// RedisResultCache stores cached results in Redis so every replica behind a
+// load balancer shares them, and coordinates in-flight executions through
+// claim keys and a pub/sub channel per key
+type RedisResultCache struct {
+	client *redis.Client
+	prefix string
+	owner  string // identifies this replica's claims
+}
+
+// NewRedisResultCache connects to the Redis server at url, e.g.
+// redis://cache:6379/0. Keys are namespaced by prefix.
+func NewRedisResultCache(url string, prefix string) (*RedisResultCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &RedisResultCache{
+		client: redis.NewClient(opts),
+		prefix: prefix,
+		owner:  uuid.NewString(),
+	}, nil
+}
+
+func (c *RedisResultCache) resultKey(key string) string      { return c.prefix + "result:" + key }
+func (c *RedisResultCache) claimKey(key string) string       { return c.prefix + "inflight:" + key }
+func (c *RedisResultCache) releaseChannel(key string) string { return c.prefix + "released:" + key }
+
+// Get reads a cached result
+func (c *RedisResultCache) Get(ctx context.Context, key string) (*CachedResult, bool, error) {
+	data, err := c.client.Get(ctx, c.resultKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	result, err := decodeCachedResult(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("decode cached result: %w", err)
+	}
+	return result, true, nil
+}
+
+// Set writes a result that expires after ttl
+func (c *RedisResultCache) Set(ctx context.Context, key string, result *CachedResult, ttl time.Duration) error {
+	data, err := encodeCachedResult(result)
+	if err != nil {
+		return fmt.Errorf("encode cached result: %w", err)
+	}
+	return c.client.Set(ctx, c.resultKey(key), data, ttl).Err()
+}
+
+// Claim takes the execution of key unless another replica holds it. The
+// claim lapses after ttl so a replica that dies mid-query does not block
+// the others.
+func (c *RedisResultCache) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return c.client.SetNX(ctx, c.claimKey(key), c.owner, ttl).Result()
+}
+
+// releaseClaim deletes a claim only while the caller still owns it, so a
+// lapsed claim taken over by another replica is left alone
+var releaseClaim = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Release drops this replica's claim and notifies the waiting replicas
+func (c *RedisResultCache) Release(ctx context.Context, key string) error {
+	if err := releaseClaim.Run(ctx, c.client, []string{c.claimKey(key)}, c.owner).Err(); err != nil {
+		return err
+	}
+	return c.client.Publish(ctx, c.releaseChannel(key), c.owner).Err()
+}
+
+// Wait blocks until the claim on key is released or lapses
+func (c *RedisResultCache) Wait(ctx context.Context, key string) error {
+	sub := c.client.Subscribe(ctx, c.releaseChannel(key))
+	defer sub.Close()
+	// The subscription must be live before the claim is checked, or a
+	// release in between would be missed
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	released := sub.Channel()
+
+	ticker := time.NewTicker(inFlightPollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := c.client.Exists(ctx, c.claimKey(key)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close disconnects from Redis
+func (c *RedisResultCache) Close() error {
+	return c.client.Close()
+}
+
+// Cached values are tagged so times keep their zone, decimals stay exact
+// and driver types Redis cannot represent come back as the JSON they would
+// have been sent as
+const (
+	cachedNative byte = iota
+	cachedTime
+	cachedJSON
+	cachedDecimal
+)
+
+type cachedValue struct {
+	Tag   byte        `msgpack:"t"`
+	Value interface{} `msgpack:"v"`
+}
+
+type encodedResult struct {
+	Columns    []string                     `msgpack:"columns"`
+	Rows       [][]cachedValue              `msgpack:"rows"`
+	Truncated  bool                         `msgpack:"truncated"`
+	Sample     *SampleInfo                  `msgpack:"sample,omitempty"`
+	CachedAt   time.Time                    `msgpack:"cachedAt"`
+	ColumnInfo map[string]driver.ColumnInfo `msgpack:"columnInfo,omitempty"`
+}
+
+// EncodeResult encodes a result set as the Redis cache stores it, keeping
+// the type of every value, so replicas can hand rows to one another
+func EncodeResult(result *CachedResult) ([]byte, error) {
+	return encodeCachedResult(result)
+}
+
+// DecodeResult decodes a result set encoded by EncodeResult
+func DecodeResult(data []byte) (*CachedResult, error) {
+	return decodeCachedResult(data)
+}
+
+func encodeCachedResult(result *CachedResult) ([]byte, error) {
+	enc := encodedResult{
+		Columns:    result.Columns,
+		Rows:       make([][]cachedValue, len(result.Rows)),
+		Truncated:  result.Truncated,
+		Sample:     result.Sample,
+		CachedAt:   result.CachedAt,
+		ColumnInfo: result.ColumnInfo,
+	}
+	for i, row := range result.Rows {
+		values := make([]cachedValue, len(row))
+		for j, v := range row {
+			cv, err := encodeCachedValue(v)
+			if err != nil {
+				return nil, err
+			}
+			values[j] = cv
+		}
+		enc.Rows[i] = values
+	}
+	return msgpack.Marshal(&enc)
+}
+
+func encodeCachedValue(v interface{}) (cachedValue, error) {
+	switch n := v.(type) {
+	case nil, bool, string, []byte,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return cachedValue{Tag: cachedNative, Value: n}, nil
+	case time.Time:
+		data, err := n.MarshalBinary()
+		if err != nil {
+			return cachedValue{}, err
+		}
+		return cachedValue{Tag: cachedTime, Value: data}, nil
+	case *big.Rat:
+		return cachedValue{Tag: cachedDecimal, Value: n.RatString()}, nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return cachedValue{}, err
+		}
+		return cachedValue{Tag: cachedJSON, Value: data}, nil
+	}
+}
+
+func decodeCachedResult(data []byte) (*CachedResult, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	// Integers decode as int64 and uint64 rather than the smallest type
+	// that holds them
+	dec.UseLooseInterfaceDecoding(true)
+
+	var enc encodedResult
+	if err := dec.Decode(&enc); err != nil {
+		return nil, err
+	}
+
+	result := &CachedResult{
+		Columns:    enc.Columns,
+		Rows:       make([][]interface{}, len(enc.Rows)),
+		Truncated:  enc.Truncated,
+		Sample:     enc.Sample,
+		CachedAt:   enc.CachedAt,
+		ColumnInfo: enc.ColumnInfo,
+	}
+	for i, values := range enc.Rows {
+		row := make([]interface{}, len(values))
+		for j, cv := range values {
+			v, err := decodeCachedValue(cv)
+			if err != nil {
+				return nil, err
+			}
+			row[j] = v
+		}
+		result.Rows[i] = row
+	}
+	return result, nil
+}
+
+func decodeCachedValue(cv cachedValue) (interface{}, error) {
+	switch cv.Tag {
+	case cachedTime:
+		data, _ := cv.Value.([]byte)
+		var t time.Time
+		if err := t.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case cachedJSON:
+		data, _ := cv.Value.([]byte)
+		return json.RawMessage(data), nil
+	case cachedDecimal:
+		text, _ := cv.Value.(string)
+		r, ok := new(big.Rat).SetString(text)
+		if !ok {
+			return nil, fmt.Errorf("invalid cached decimal %q", text)
+		}
+		return r, nil
+	default:
+		return cv.Value, nil
+	}
+}
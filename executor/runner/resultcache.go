@@ -0,0 +1,399 @@
+// runner/resultcache.go
+package runner
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// Cache control modes a request may set
+const (
+	// CacheUse serves a cached result when there is one (default)
+	CacheUse = "use"
+	// CacheBypass runs the query without reading or writing the cache
+	CacheBypass = "bypass"
+	// CacheRefresh runs the query and replaces the cached result
+	CacheRefresh = "refresh"
+)
+
+const (
+	defaultResultCacheTTL        = 5 * time.Minute
+	defaultResultCacheMaxEntries = 1000
+	defaultResultCacheMaxRows    = 10000
+)
+
+// ResultCacheConfig configures the result cache
+type ResultCacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// TTL is how long results stay cached unless the query sets its own
+	// (default 5m)
+	TTL time.Duration `toml:"ttl"`
+	// MaxEntries bounds the results held in memory (default 1000)
+	MaxEntries int `toml:"max_entries"`
+	// MaxRows is the largest result that is cached (default 10000)
+	MaxRows int `toml:"max_rows"`
+
+	// RedisURL stores results in Redis instead of memory so replicas share
+	// them, e.g. redis://cache:6379/0. Replicas then also run each uncached
+	// query once: identical requests wait for the replica running it.
+	RedisURL       string `toml:"redis_url"`
+	RedisKeyPrefix string `toml:"redis_key_prefix"` // default "supalytics:"
+	// InFlightTimeout bounds how long a replica waits for another to finish
+	// the same query before running it itself (default 5m)
+	InFlightTimeout time.Duration `toml:"in_flight_timeout"`
+}
+
+// CachedResult is a complete result set held by the result cache
+type CachedResult struct {
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated,omitempty"`
+	// Sample describes the sample the rows were reduced to, if any
+	Sample   *SampleInfo `json:"sample,omitempty"`
+	CachedAt time.Time   `json:"cachedAt"`
+	// ColumnInfo is what the engine declared about the columns
+	ColumnInfo map[string]driver.ColumnInfo `json:"columnInfo,omitempty"`
+}
+
+// ResultCacheBackend stores cached results
+type ResultCacheBackend interface {
+	Get(ctx context.Context, key string) (*CachedResult, bool, error)
+	Set(ctx context.Context, key string, result *CachedResult, ttl time.Duration) error
+}
+
+// ResultCache serves repeated executions of a query from the results of an
+// earlier one. Results are keyed by query, connector and the rendered SQL, so
+// different template data caches separately.
+type ResultCache struct {
+	backend         ResultCacheBackend
+	ttl             time.Duration
+	maxRows         int
+	inFlightTimeout time.Duration
+}
+
+// NewResultCache creates the result cache described by cfg, or returns nil
+// when caching is disabled
+func NewResultCache(cfg ResultCacheConfig) (*ResultCache, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.RedisURL != "" {
+		backend, err := NewRedisResultCache(cfg.RedisURL, cfg.RedisKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return newResultCache(backend, cfg), nil
+	}
+
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultResultCacheMaxEntries
+	}
+	return newResultCache(NewMemoryResultCache(maxEntries), cfg), nil
+}
+
+func newResultCache(backend ResultCacheBackend, cfg ResultCacheConfig) *ResultCache {
+	c := &ResultCache{backend: backend, ttl: cfg.TTL, maxRows: cfg.MaxRows, inFlightTimeout: cfg.InFlightTimeout}
+	if c.ttl <= 0 {
+		c.ttl = defaultResultCacheTTL
+	}
+	if c.maxRows <= 0 {
+		c.maxRows = defaultResultCacheMaxRows
+	}
+	if c.inFlightTimeout <= 0 {
+		c.inFlightTimeout = defaultInFlightTimeout
+	}
+	return c
+}
+
+// Len returns the results held in process, and false when they are held
+// by a backend shared between replicas
+func (c *ResultCache) Len() (int, bool) {
+	if m, ok := c.backend.(*MemoryResultCache); ok {
+		return m.Len(), true
+	}
+	return 0, false
+}
+
+// lookup returns the cached result for key. On a miss, a backend shared
+// between replicas is asked for the execution: lookup either claims it,
+// reporting claimed, or waits for the replica that holds the claim and
+// returns the result it cached.
+func (c *ResultCache) lookup(ctx context.Context, key string) (result *CachedResult, hit bool, claimed bool) {
+	if result, ok := c.get(ctx, key); ok {
+		return result, true, false
+	}
+	coord, ok := c.backend.(ExecutionCoordinator)
+	if !ok {
+		return nil, false, false
+	}
+
+	claimed, err := coord.Claim(ctx, key, c.inFlightTimeout)
+	if err != nil {
+		log.Printf("Result cache claim failed: %v", err)
+		return nil, false, false
+	}
+	if claimed {
+		return nil, false, true
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, c.inFlightTimeout)
+	defer cancel()
+	if err := coord.Wait(waitCtx, key); err != nil && ctx.Err() == nil {
+		log.Printf("Waiting for in-flight execution failed: %v", err)
+	}
+	// A result too large to cache, or a failed execution, leaves nothing
+	// behind and the query runs here
+	if result, ok := c.get(ctx, key); ok {
+		return result, true, false
+	}
+	return nil, false, false
+}
+
+// get returns the cached result for key. A backend failure is logged and
+// treated as a miss so the query still runs.
+func (c *ResultCache) get(ctx context.Context, key string) (*CachedResult, bool) {
+	result, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		log.Printf("Result cache read failed: %v", err)
+		return nil, false
+	}
+	return result, ok
+}
+
+func (c *ResultCache) set(ctx context.Context, key string, result *CachedResult, ttl time.Duration) {
+	if err := c.backend.Set(ctx, key, result, ttl); err != nil {
+		log.Printf("Result cache write failed: %v", err)
+	}
+}
+
+// ttlFor returns how long the query's results are cached, or 0 when the
+// query opts out
+func (c *ResultCache) ttlFor(query *Query) time.Duration {
+	switch {
+	case query.ResultCacheTTL < 0:
+		return 0
+	case query.ResultCacheTTL > 0:
+		return time.Duration(query.ResultCacheTTL) * time.Second
+	default:
+		return c.ttl
+	}
+}
+
+// resultCacheKey identifies a result by everything that shapes it
+func resultCacheKey(query *Query, connector *Connector, sql string, opts ExecuteOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", query.ID, connector.ID, sql)
+	fmt.Fprintf(h, "count=%t limit=%d offset=%d preview=%d", opts.CountOnly, opts.Limit, opts.Offset, opts.PreviewRows)
+	if transforms := queryTransforms(query, opts); len(transforms) > 0 {
+		encoded, _ := json.Marshal(transforms)
+		fmt.Fprintf(h, " transforms=%s", encoded)
+	}
+	// The time zone changes how the engine evaluates the query, not just
+	// how its timestamps are written
+	if tz := queryTimezone(query, opts); tz != "" {
+		fmt.Fprintf(h, " timezone=%s", tz)
+	}
+	if opts.Sample != nil {
+		fmt.Fprintf(h, " sample=%d/%d/%d", opts.Sample.Every, opts.Sample.Size, opts.Sample.Seed)
+	}
+	if len(opts.Aggregates) > 0 {
+		encoded, _ := json.Marshal(opts.Aggregates)
+		fmt.Fprintf(h, " aggregates=%s", encoded)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cacheable reports whether a rendered query only reads, so serving it from
+// the cache skips no side effects
+func cacheable(sql string, typ driver.DriverType) bool {
+	statements := SplitStatements(sql, typ)
+	if len(statements) != 1 {
+		return false
+	}
+	switch strings.ToUpper(leadingKeyword(statements[0], dialectFor(typ))) {
+	case "SELECT", "WITH", "VALUES", "TABLE", "(":
+		return true
+	}
+	return false
+}
+
+// resultRecorder collects a streaming result for the cache. Results larger
+// than the cache's row limit or the execution's memory budget are
+// abandoned.
+type resultRecorder struct {
+	cache    *ResultCache
+	key      string
+	ttl      time.Duration
+	result   CachedResult
+	overflow bool
+
+	// mem is charged for the rows recorded so far, held bytes of it
+	mem  *memoryAccount
+	held int64
+
+	// claimed is set when this replica holds the key's execution claim
+	claimed  bool
+	released sync.Once
+}
+
+// release gives up the execution claim, if held, so waiting replicas read
+// the cache or run the query themselves. It is safe on a nil recorder.
+func (r *resultRecorder) release() {
+	if r == nil || !r.claimed {
+		return
+	}
+	r.released.Do(func() {
+		coord := r.cache.backend.(ExecutionCoordinator)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := coord.Release(ctx, r.key); err != nil {
+			log.Printf("Result cache release failed: %v", err)
+		}
+	})
+}
+
+func (r *resultRecorder) record(columns []string, row []interface{}) {
+	if r.overflow {
+		return
+	}
+	if row == nil {
+		r.result.Columns = columns
+		return
+	}
+	size := rowSize(row)
+	if len(r.result.Rows) == r.cache.maxRows || r.mem.grow(size, "cached result") != nil {
+		// Waiting replicas would find nothing cached, so they are let go
+		// to run the query now
+		r.overflow = true
+		r.free()
+		r.release()
+		return
+	}
+	r.held += size
+	r.result.Rows = append(r.result.Rows, append([]interface{}(nil), row...))
+}
+
+// free drops the recorded rows from the execution's memory account
+func (r *resultRecorder) free() {
+	r.mem.shrink(r.held)
+	r.held = 0
+	r.result.Rows = nil
+}
+
+// store caches the recorded result once it has streamed in full
+func (r *resultRecorder) store(truncated bool, sample *SampleInfo, columns map[string]driver.ColumnInfo) {
+	defer r.release()
+	if r.overflow {
+		return
+	}
+	r.result.Truncated = truncated
+	r.result.Sample = sample
+	r.result.ColumnInfo = columns
+	r.result.CachedAt = time.Now()
+	// The stream's context may already be done; the write is short
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r.cache.set(ctx, r.key, &r.result, r.ttl)
+	// The cache holds the rows now, outside any one execution's budget
+	r.mem.shrink(r.held)
+	r.held = 0
+}
+
+// cachedRows replays a cached result as a driver result
+type cachedRows struct {
+	result *CachedResult
+}
+
+func (c *cachedRows) Stream(callback func(columns []string, row []interface{}) error) error {
+	if err := callback(c.result.Columns, nil); err != nil {
+		return err
+	}
+	for _, row := range c.result.Rows {
+		if err := callback(nil, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryResultCache is an in-process LRU result cache backend
+type MemoryResultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // most recently used first
+	entries    map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key     string
+	result  *CachedResult
+	expires time.Time
+}
+
+// NewMemoryResultCache creates an LRU cache holding up to maxEntries results
+func NewMemoryResultCache(maxEntries int) *MemoryResultCache {
+	return &MemoryResultCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns an unexpired result and marks it recently used
+// Len returns the results held, expired ones included
+func (c *MemoryResultCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *MemoryResultCache) Get(ctx context.Context, key string) (*CachedResult, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(el)
+	return entry.result, true, nil
+}
+
+// Set stores a result, evicting the least recently used when full
+func (c *MemoryResultCache) Set(ctx context.Context, key string, result *CachedResult, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &memoryCacheEntry{key: key, result: result, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// runner/sample.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// Sampling methods
+const (
+	// SampleEvery keeps the first row and every Every-th after it
+	SampleEvery = "every"
+	// SampleReservoir keeps a uniform random sample of Size rows, in the
+	// order they streamed. It buffers the sample until the stream ends.
+	SampleReservoir = "reservoir"
+)
+
+// Sample thins a result to fewer rows as it streams, for charts that
+// cannot draw every point. Exactly one of Every and Size is set. Seed makes
+// a reservoir sample repeatable; zero draws a different one each run.
+type Sample struct {
+	Every int64 `json:"every,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+	Seed  int64 `json:"seed,omitempty"`
+}
+
+// SampleInfo describes the sample a result was reduced to
+type SampleInfo struct {
+	Method      string `json:"method"`
+	RowsSeen    int64  `json:"rowsSeen"`
+	RowsSampled int64  `json:"rowsSampled"`
+}
+
+// Validate checks exactly one sampling method is asked for
+func (s *Sample) Validate() error {
+	switch {
+	case s.Every < 0 || s.Size < 0:
+		return fmt.Errorf("sample every and size must not be negative, got %d and %d", s.Every, s.Size)
+	case (s.Every > 0) == (s.Size > 0):
+		return errors.New("sample needs exactly one of every or size")
+	}
+	return nil
+}
+
+// sampler reduces a result to a sample and records what it did once the
+// stream ends
+type sampler struct {
+	Sample
+	info atomic.Pointer[SampleInfo]
+
+	// mem is charged for the rows a reservoir holds
+	mem *memoryAccount
+}
+
+func newSampler(opts ExecuteOptions, mem *memoryAccount) *sampler {
+	if opts.Sample == nil {
+		return nil
+	}
+	return &sampler{Sample: *opts.Sample, mem: mem}
+}
+
+// Info returns the sample taken, or nil until the stream has ended
+func (s *sampler) Info() *SampleInfo {
+	if s == nil {
+		return nil
+	}
+	return s.info.Load()
+}
+
+func (s *sampler) method() string {
+	if s.Every > 0 {
+		return SampleEvery
+	}
+	return SampleReservoir
+}
+
+// apply samples a result as it streams
+func (s *sampler) apply(result *driver.QueryResult) *driver.QueryResult {
+	stream := result.Stream
+	if s == nil || stream == nil {
+		return result
+	}
+
+	return &driver.QueryResult{
+		Columns: result.Columns,
+		Error:   result.Error,
+		Stream: func(yield func(columns []string, row []interface{}) error) error {
+			var seen, sampled int64
+			// The reservoir holds the sampled rows with their positions,
+			// so they can be sent in streamed order
+			type kept struct {
+				at  int64
+				row []interface{}
+			}
+			var reservoir []kept
+			var rng *rand.Rand
+			if s.Size > 0 {
+				seed := s.Seed
+				if seed == 0 {
+					seed = time.Now().UnixNano()
+				}
+				rng = rand.New(rand.NewSource(seed))
+			}
+
+			err := stream(func(columns []string, row []interface{}) error {
+				if row == nil {
+					return yield(columns, nil)
+				}
+				seen++
+				if s.Every > 0 {
+					if (seen-1)%s.Every != 0 {
+						return nil
+					}
+					sampled++
+					return yield(nil, row)
+				}
+
+				// Algorithm R: the n-th row replaces a random member of a
+				// full reservoir with probability size/n
+				if int64(len(reservoir)) < s.Size {
+					if err := s.mem.grow(rowSize(row), "reservoir sample"); err != nil {
+						return err
+					}
+					reservoir = append(reservoir, kept{seen, row})
+				} else if j := rng.Int63n(seen); j < s.Size {
+					if err := s.mem.grow(rowSize(row), "reservoir sample"); err != nil {
+						return err
+					}
+					s.mem.shrink(rowSize(reservoir[j].row))
+					reservoir[j] = kept{seen, row}
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+
+			if s.Size > 0 {
+				sort.Slice(reservoir, func(i, j int) bool { return reservoir[i].at < reservoir[j].at })
+				for _, k := range reservoir {
+					sampled++
+					if err := yield(nil, k.row); err != nil {
+						if errors.Is(err, io.EOF) {
+							break
+						}
+						return err
+					}
+				}
+			}
+			s.info.Store(&SampleInfo{Method: s.method(), RowsSeen: seen, RowsSampled: sampled})
+			return nil
+		},
+	}
+}
@@ -0,0 +1,540 @@
+// runner/snapshot.go
+package runner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/export"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/decimal128"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/compress"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Snapshot formats a query or request may ask for
+const (
+	SnapshotCSV     = "csv"
+	SnapshotParquet = "parquet"
+)
+
+const (
+	defaultSnapshotURLExpiry = time.Hour
+	defaultSnapshotPrefix    = "snapshots/"
+
+	// Rows per Arrow record batch written to a Parquet snapshot
+	snapshotBatchSize = 4096
+)
+
+// ValidSnapshotFormat reports whether format names a snapshot format
+func ValidSnapshotFormat(format string) bool {
+	return format == SnapshotCSV || format == SnapshotParquet
+}
+
+// SnapshotConfig configures where result snapshots are stored
+type SnapshotConfig struct {
+	// Provider is s3, gcs or supabase; snapshots are disabled when empty
+	Provider string `toml:"provider"`
+	Bucket   string `toml:"bucket"`
+	// Prefix is prepended to every object key (default "snapshots/")
+	Prefix string `toml:"prefix"`
+	// URLExpiry is how long the signed download URL is valid (default 1h)
+	URLExpiry time.Duration `toml:"url_expiry"`
+
+	// S3 settings. Endpoint and PathStyle address S3-compatible stores such
+	// as MinIO; credentials default to the AWS credential chain.
+	Region          string `toml:"region"`
+	Endpoint        string `toml:"endpoint"`
+	PathStyle       bool   `toml:"path_style"`
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+
+	// Supabase Storage settings; both default to the server's Supabase
+	// project
+	SupabaseURL string `toml:"supabase_url"`
+	SupabaseKey string `toml:"supabase_key"`
+
+	// SpoolDir holds results while they stream, before they are uploaded
+	// (default the system temp directory)
+	SpoolDir string `toml:"spool_dir"`
+}
+
+// Enabled reports whether a storage provider is configured
+func (c SnapshotConfig) Enabled() bool {
+	return c.Provider != ""
+}
+
+// SnapshotStore is object storage that holds snapshots
+type SnapshotStore interface {
+	// Put uploads size bytes from body as the object key
+	Put(ctx context.Context, key string, contentType string, body io.ReadSeeker, size int64) error
+	// SignedURL returns a URL that downloads key until expiry has passed
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Snapshots persists complete result sets to object storage so clients can
+// download large exports instead of streaming them
+type Snapshots struct {
+	store    SnapshotStore
+	prefix   string
+	expiry   time.Duration
+	spoolDir string
+}
+
+// NewSnapshots creates the snapshot storage described by cfg, or returns nil
+// when snapshots are disabled
+func NewSnapshots(ctx context.Context, cfg SnapshotConfig) (*Snapshots, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("snapshot bucket is required")
+	}
+
+	var store SnapshotStore
+	var err error
+	switch cfg.Provider {
+	case "s3":
+		store, err = newS3SnapshotStore(ctx, cfg)
+	case "gcs":
+		store, err = newGCSSnapshotStore(ctx, cfg)
+	case "supabase":
+		store, err = newSupabaseSnapshotStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown snapshot provider %q", cfg.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSnapshotsWithStore(store, cfg), nil
+}
+
+// NewSnapshotsWithStore creates snapshot storage backed by store
+func NewSnapshotsWithStore(store SnapshotStore, cfg SnapshotConfig) *Snapshots {
+	s := &Snapshots{store: store, prefix: cfg.Prefix, expiry: cfg.URLExpiry, spoolDir: cfg.SpoolDir}
+	if s.prefix == "" {
+		s.prefix = defaultSnapshotPrefix
+	}
+	if s.expiry <= 0 {
+		s.expiry = defaultSnapshotURLExpiry
+	}
+	return s
+}
+
+// Snapshot describes a result set stored in object storage
+type Snapshot struct {
+	URL       string    `json:"url"`
+	Format    string    `json:"format"`
+	Key       string    `json:"key"`
+	Rows      int64     `json:"rows"`
+	Bytes     int64     `json:"bytes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// snapshotFormat returns the format a query's result is snapshotted in, or
+// "" when it is not. The request's choice overrides the query's.
+func snapshotFormat(query *Query, opts ExecuteOptions) string {
+	if opts.SnapshotFormat != "" {
+		return opts.SnapshotFormat
+	}
+	return query.SnapshotFormat
+}
+
+// newSnapshotWriter returns the writer for an execution's snapshot, or nil
+// when none was asked for
+func newSnapshotWriter(ctx context.Context, query *Query, opts ExecuteOptions) (*snapshotWriter, error) {
+	format := snapshotFormat(query, opts)
+	if format == "" {
+		return nil, nil
+	}
+	if !ValidSnapshotFormat(format) {
+		return nil, fmt.Errorf("unknown snapshot format %q", format)
+	}
+	if opts.Snapshots == nil {
+		return nil, errors.New("result snapshots are not enabled on this server")
+	}
+	return &snapshotWriter{snapshots: opts.Snapshots, ctx: ctx, queryID: query.ID, format: format}, nil
+}
+
+// snapshotWriter spools a streaming result to a local file and uploads it
+// once the result has streamed in full. CSV is written as rows arrive;
+// Parquet needs every column's type, so rows are spooled and converted at
+// the end.
+type snapshotWriter struct {
+	snapshots *Snapshots
+	ctx       context.Context
+	queryID   string
+	format    string
+
+	spool   *os.File
+	buf     *bufio.Writer
+	csv     export.Writer
+	enc     *msgpack.Encoder
+	columns []string
+	kinds   []columnKind
+	// intDigits is the most integer digits of a decimal in each column,
+	// which with the column's scale gives the precision Parquet needs
+	intDigits []int
+	rows      int64
+
+	snapshot *Snapshot
+}
+
+// Snapshot returns the stored snapshot once the result has streamed
+func (w *snapshotWriter) Snapshot() *Snapshot {
+	if w == nil {
+		return nil
+	}
+	return w.snapshot
+}
+
+func (w *snapshotWriter) write(columns []string, row []interface{}) error {
+	if row == nil {
+		if w.spool != nil {
+			return nil
+		}
+		return w.open(columns)
+	}
+	if w.spool == nil {
+		return errors.New("row before column header")
+	}
+
+	w.rows++
+	if w.format == SnapshotCSV {
+		return w.csv.WriteRow(row)
+	}
+
+	values := make([]cachedValue, len(row))
+	for i, v := range row {
+		if i < len(w.kinds) {
+			w.kinds[i] = w.kinds[i].merge(kindOf(v))
+			if r, ok := v.(*big.Rat); ok {
+				w.intDigits[i] = max(w.intDigits[i], intDigits(r))
+			}
+		}
+		cv, err := encodeCachedValue(v)
+		if err != nil {
+			return err
+		}
+		values[i] = cv
+	}
+	return w.enc.Encode(values)
+}
+
+func (w *snapshotWriter) open(columns []string) error {
+	spool, err := os.CreateTemp(w.snapshots.spoolDir, "snapshot-*")
+	if err != nil {
+		return err
+	}
+	w.spool = spool
+	w.buf = bufio.NewWriter(spool)
+	w.columns = columns
+
+	if w.format == SnapshotCSV {
+		w.csv, _ = export.NewWriter(export.FormatCSV, w.buf)
+		return w.csv.WriteHeader(columns)
+	}
+	w.enc = msgpack.NewEncoder(w.buf)
+	w.kinds = make([]columnKind, len(columns))
+	w.intDigits = make([]int, len(columns))
+	return nil
+}
+
+// finish uploads the spooled result and signs a URL for it. columns is what
+// the engine declared about the columns, which gives decimals their scale.
+func (w *snapshotWriter) finish(columns map[string]driver.ColumnInfo) error {
+	defer w.discard()
+	// A result with no column header still gets a file
+	if w.spool == nil {
+		if err := w.open(nil); err != nil {
+			return err
+		}
+	}
+	if w.csv != nil {
+		if err := w.csv.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+
+	file, contentType := w.spool, "text/csv"
+	if w.format == SnapshotParquet {
+		converted, err := w.convertParquet(columns)
+		if err != nil {
+			return fmt.Errorf("write parquet: %w", err)
+		}
+		defer os.Remove(converted.Name())
+		defer converted.Close()
+		file, contentType = converted, "application/vnd.apache.parquet"
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%s/%s.%s", w.snapshots.prefix, w.queryID, uuid.NewString(), w.format)
+	if err := w.snapshots.store.Put(w.ctx, key, contentType, file, size); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	url, err := w.snapshots.store.SignedURL(w.ctx, key, w.snapshots.expiry)
+	if err != nil {
+		return fmt.Errorf("sign url: %w", err)
+	}
+
+	w.snapshot = &Snapshot{
+		URL:       url,
+		Format:    w.format,
+		Key:       key,
+		Rows:      w.rows,
+		Bytes:     size,
+		ExpiresAt: time.Now().Add(w.snapshots.expiry),
+	}
+	return nil
+}
+
+// discard removes the spool file. It is safe on a nil writer and after
+// finish.
+func (w *snapshotWriter) discard() {
+	if w == nil || w.spool == nil {
+		return
+	}
+	w.spool.Close()
+	os.Remove(w.spool.Name())
+	w.spool = nil
+}
+
+// convertParquet rewrites the spooled rows as a Parquet file
+func (w *snapshotWriter) convertParquet(info map[string]driver.ColumnInfo) (*os.File, error) {
+	fields := make([]arrow.Field, len(w.columns))
+	for i, name := range w.columns {
+		typ := w.kinds[i].arrowType()
+		if w.kinds[i] == kindDecimal {
+			// Decimals are written as Parquet decimals when the column has
+			// a scale that fits them, and as their text otherwise
+			if scale := info[name].Scale; scale != nil && *scale >= 0 && w.intDigits[i]+*scale <= maxDecimalPrecision {
+				typ = &arrow.Decimal128Type{Precision: maxDecimalPrecision, Scale: int32(*scale)}
+			} else {
+				w.kinds[i] = kindString
+			}
+		}
+		fields[i] = arrow.Field{Name: name, Type: typ, Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	out, err := os.CreateTemp(w.snapshots.spoolDir, "snapshot-*.parquet")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, err
+	}
+
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	fw, err := pqarrow.NewFileWriter(schema, out, props, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return fail(err)
+	}
+
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	dec := msgpack.NewDecoder(bufio.NewReader(w.spool))
+	dec.UseLooseInterfaceDecoding(true)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	flush := func() error {
+		rec := builder.NewRecord()
+		defer rec.Release()
+		return fw.Write(rec)
+	}
+
+	var batched int
+	for i := int64(0); i < w.rows; i++ {
+		var values []cachedValue
+		if err := dec.Decode(&values); err != nil {
+			return fail(err)
+		}
+		for j := range w.columns {
+			var v interface{}
+			if j < len(values) {
+				if v, err = decodeCachedValue(values[j]); err != nil {
+					return fail(err)
+				}
+			}
+			appendArrowValue(builder.Field(j), w.kinds[j], v)
+		}
+		if batched++; batched == snapshotBatchSize {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+			batched = 0
+		}
+	}
+	if batched > 0 || w.rows == 0 {
+		if err := flush(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := fw.Close(); err != nil {
+		os.Remove(out.Name())
+		return nil, err
+	}
+
+	// The writer closes the file, so it is reopened for the upload
+	return os.Open(out.Name())
+}
+
+// columnKind is the Parquet type inferred for a column from its values
+type columnKind int
+
+const (
+	kindUnknown columnKind = iota // only NULLs seen so far
+	kindBool
+	kindInt
+	kindFloat
+	kindTime
+	kindDecimal
+	kindString
+)
+
+// maxDecimalPrecision is the most digits a Parquet decimal column holds
+const maxDecimalPrecision = 38
+
+func kindOf(v interface{}) columnKind {
+	switch v.(type) {
+	case nil:
+		return kindUnknown
+	case bool:
+		return kindBool
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return kindInt
+	case float32, float64:
+		return kindFloat
+	case time.Time:
+		return kindTime
+	case *big.Rat:
+		return kindDecimal
+	default:
+		return kindString
+	}
+}
+
+// merge widens a column's kind to hold a value of kind other: integers mix
+// with floats as floats and with decimals as decimals, and any other mix
+// falls back to strings
+func (k columnKind) merge(other columnKind) columnKind {
+	switch {
+	case other == kindUnknown || k == other:
+		return k
+	case k == kindUnknown:
+		return other
+	case (k == kindInt && other == kindFloat) || (k == kindFloat && other == kindInt):
+		return kindFloat
+	case (k == kindInt && other == kindDecimal) || (k == kindDecimal && other == kindInt):
+		return kindDecimal
+	default:
+		return kindString
+	}
+}
+
+func (k columnKind) arrowType() arrow.DataType {
+	switch k {
+	case kindBool:
+		return arrow.FixedWidthTypes.Boolean
+	case kindInt:
+		return arrow.PrimitiveTypes.Int64
+	case kindFloat:
+		return arrow.PrimitiveTypes.Float64
+	case kindTime:
+		return arrow.FixedWidthTypes.Timestamp_us
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+func appendArrowValue(b array.Builder, kind columnKind, v interface{}) {
+	if v == nil {
+		b.AppendNull()
+		return
+	}
+	switch kind {
+	case kindBool:
+		b.(*array.BooleanBuilder).Append(v.(bool))
+	case kindInt:
+		b.(*array.Int64Builder).Append(toInt64(v))
+	case kindFloat:
+		b.(*array.Float64Builder).Append(toFloat64(v))
+	case kindTime:
+		b.(*array.TimestampBuilder).Append(arrow.Timestamp(v.(time.Time).UnixMicro()))
+	case kindDecimal:
+		scale := b.Type().(*arrow.Decimal128Type).Scale
+		b.(*array.Decimal128Builder).Append(decimal128.FromBigInt(scaledDecimal(v, scale)))
+	default:
+		b.(*array.StringBuilder).Append(export.FormatValue(v))
+	}
+}
+
+// scaledDecimal returns an integer or decimal value times 10^scale, the
+// unscaled form a Parquet decimal stores
+func scaledDecimal(v interface{}, scale int32) *big.Int {
+	r, ok := v.(*big.Rat)
+	if !ok {
+		r = new(big.Rat).SetInt64(toInt64(v))
+	}
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow))
+	// Values carry no more places than the column's scale, so this only
+	// drops a remainder engines never produce
+	return new(big.Int).Quo(scaled.Num(), scaled.Denom())
+}
+
+// intDigits returns the number of digits before a decimal's point
+func intDigits(r *big.Rat) int {
+	q := new(big.Int).Quo(r.Num(), r.Denom())
+	return len(q.Abs(q).String())
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	}
+	i, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	return i
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case float32:
+		return float64(n)
+	}
+	f, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+	return f
+}
@@ -0,0 +1,133 @@
+// runner/snapshotstore.go
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	storage_go "github.com/supabase-community/storage-go"
+)
+
+// s3SnapshotStore stores snapshots in an S3 or S3-compatible bucket and
+// hands out presigned GET URLs
+type s3SnapshotStore struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+}
+
+func newS3SnapshotStore(ctx context.Context, cfg SnapshotConfig) (*s3SnapshotStore, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	if cfg.Region != "" {
+		awsCfg.Region = cfg.Region
+	}
+	if cfg.AccessKeyID != "" && cfg.SecretAccessKey != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.PathStyle
+	})
+	return &s3SnapshotStore{client: client, presign: s3.NewPresignClient(client), bucket: cfg.Bucket}, nil
+}
+
+func (s *s3SnapshotStore) Put(ctx context.Context, key string, contentType string, body io.ReadSeeker, size int64) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	})
+	return err
+}
+
+func (s *s3SnapshotStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// gcsSnapshotStore stores snapshots in a Cloud Storage bucket. URLs are
+// signed with the client's service account.
+type gcsSnapshotStore struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSSnapshotStore(ctx context.Context, cfg SnapshotConfig) (*gcsSnapshotStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create storage client: %w", err)
+	}
+	return &gcsSnapshotStore{bucket: client.Bucket(cfg.Bucket)}, nil
+}
+
+func (s *gcsSnapshotStore) Put(ctx context.Context, key string, contentType string, body io.ReadSeeker, size int64) error {
+	w := s.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := io.Copy(w, body); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *gcsSnapshotStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return s.bucket.SignedURL(key, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expiry),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+// supabaseSnapshotStore stores snapshots in a Supabase Storage bucket
+type supabaseSnapshotStore struct {
+	client     *storage_go.Client
+	storageURL string
+	bucket     string
+}
+
+func newSupabaseSnapshotStore(cfg SnapshotConfig) (*supabaseSnapshotStore, error) {
+	if cfg.SupabaseURL == "" || cfg.SupabaseKey == "" {
+		return nil, fmt.Errorf("supabase snapshots need supabase_url and supabase_key")
+	}
+	storageURL := strings.TrimSuffix(cfg.SupabaseURL, "/") + "/storage/v1"
+	return &supabaseSnapshotStore{
+		client:     storage_go.NewClient(storageURL, cfg.SupabaseKey, map[string]string{"apikey": cfg.SupabaseKey}),
+		storageURL: storageURL,
+		bucket:     cfg.Bucket,
+	}, nil
+}
+
+func (s *supabaseSnapshotStore) Put(ctx context.Context, key string, contentType string, body io.ReadSeeker, size int64) error {
+	_, err := s.client.UploadFile(s.bucket, key, body, storage_go.FileOptions{ContentType: &contentType})
+	return err
+}
+
+func (s *supabaseSnapshotStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	resp, err := s.client.CreateSignedUrl(s.bucket, key, int(expiry.Seconds()))
+	if err != nil {
+		return "", err
+	}
+	// The storage API returns a URL relative to itself
+	return s.storageURL + resp.SignedURL, nil
+}
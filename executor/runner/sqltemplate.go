@@ -0,0 +1,118 @@
+// runner/sqltemplate.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+
+	"supalytics-executor/driver"
+)
+
+// Template modes decide how values substituted into a query are written
+const (
+	// TemplateModeText substitutes values as they are (default)
+	TemplateModeText = "text"
+	// TemplateModeSQL renders every substituted value as a literal quoted
+	// for the connector's dialect, so template data cannot inject SQL.
+	// Output of the SQL helpers such as quoteIdent and inList is kept as
+	// is, and raw splices text unescaped.
+	TemplateModeSQL = "sql"
+	// TemplateModeSQLStrict escapes like TemplateModeSQL and rejects raw
+	TemplateModeSQLStrict = "sql_strict"
+)
+
+// ErrRawInterpolation is returned when a strict SQL template uses raw
+var ErrRawInterpolation = errors.New("raw interpolation is not allowed in sql_strict templates")
+
+// sqlEscapeFunc names the function appended to every action of an escaping
+// template
+const sqlEscapeFunc = "sqlEscape"
+
+// sqlFragment is SQL produced by a template helper, which escaping
+// templates write without quoting
+type sqlFragment string
+
+// ValidTemplateMode reports whether mode is a known template mode
+func ValidTemplateMode(mode string) bool {
+	switch mode {
+	case "", TemplateModeText, TemplateModeSQL, TemplateModeSQLStrict:
+		return true
+	}
+	return false
+}
+
+// templateMode returns the mode a query renders in: its own, or the
+// server's default
+func templateMode(query *Query, opts ExecuteOptions) (string, error) {
+	mode := query.TemplateMode
+	if mode == "" {
+		mode = opts.TemplateMode
+	}
+	if !ValidTemplateMode(mode) {
+		return "", fmt.Errorf("unknown template mode %q", mode)
+	}
+	return mode, nil
+}
+
+// addModeFuncs adds the helpers of a template mode to funcs
+func addModeFuncs(funcs template.FuncMap, typ driver.DriverType, mode string) {
+	switch mode {
+	case TemplateModeSQL:
+		funcs["raw"] = func(v interface{}) sqlFragment { return sqlFragment(fmt.Sprint(v)) }
+	case TemplateModeSQLStrict:
+		funcs["raw"] = func(v interface{}) (sqlFragment, error) { return "", ErrRawInterpolation }
+	default:
+		funcs["raw"] = func(v interface{}) interface{} { return v }
+		return
+	}
+	funcs[sqlEscapeFunc] = func(v interface{}) (sqlFragment, error) {
+		if f, ok := v.(sqlFragment); ok {
+			return f, nil
+		}
+		literal, err := sqlLiteral(typ, v)
+		if err != nil {
+			return "", fmt.Errorf("escape template value: %w", err)
+		}
+		return sqlFragment(literal), nil
+	}
+}
+
+// escapeActions appends sqlEscape to the pipeline of every action that
+// writes output, in the template and every template it defines
+func escapeActions(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			escapeNode(t.Tree, t.Tree.Root)
+		}
+	}
+}
+
+func escapeNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeNode(tree, child)
+		}
+	case *parse.ActionNode:
+		// Variable declarations write nothing
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		escape := parse.NewIdentifier(sqlEscapeFunc).SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{escape}})
+	case *parse.IfNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	}
+}
@@ -0,0 +1,190 @@
+// runner/statements.go
+package runner
+
+import (
+	"strings"
+
+	"supalytics-executor/driver"
+)
+
+// dialect describes the lexical rules the statement splitter must respect
+type dialect struct {
+	backslashEscapes bool // '\'' escapes inside string literals
+	dollarQuotes     bool // Postgres $tag$ ... $tag$ bodies
+	backticks        bool // `quoted identifiers`
+	hashComments     bool // # line comments
+	tripleQuotes     bool // '''...''' and """...""" literals
+}
+
+// dialectFor returns the lexical rules for a connector type
+func dialectFor(typ driver.DriverType) dialect {
+	switch typ {
+	case driver.PostgresType, driver.DuckDBType:
+		return dialect{dollarQuotes: true}
+	case driver.BigQueryType:
+		return dialect{backslashEscapes: true, backticks: true, hashComments: true, tripleQuotes: true}
+	case driver.MySQLType:
+		return dialect{backslashEscapes: true, backticks: true, hashComments: true}
+	default:
+		return dialect{}
+	}
+}
+
+// SplitStatements splits a rendered query into individual statements on
+// top-level semicolons. Semicolons inside string literals, quoted
+// identifiers, comments and dollar-quoted bodies are ignored. Statements that
+// contain only whitespace or comments are dropped.
+func SplitStatements(sql string, typ driver.DriverType) []string {
+	d := dialectFor(typ)
+
+	var statements []string
+	start := 0
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ';':
+			statements = appendStatement(statements, sql[start:i], d)
+			i++
+			start = i
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"),
+			c == '#' && d.hashComments:
+			i = skipLine(sql, i)
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(sql)
+			}
+
+		case (c == '\'' || c == '"') && d.tripleQuotes && strings.HasPrefix(sql[i:], strings.Repeat(string(c), 3)):
+			i = skipTripleQuoted(sql, i, c)
+
+		case c == '\'':
+			i = skipQuoted(sql, i, '\'', d.backslashEscapes || isEscapeString(sql, i))
+
+		case c == '"':
+			i = skipQuoted(sql, i, '"', d.backslashEscapes)
+
+		case c == '`' && d.backticks:
+			i = skipQuoted(sql, i, '`', false)
+
+		case c == '$' && d.dollarQuotes:
+			i = skipDollarQuoted(sql, i)
+
+		default:
+			i++
+		}
+	}
+
+	return appendStatement(statements, sql[start:], d)
+}
+
+// appendStatement adds stmt unless it carries no executable SQL
+func appendStatement(statements []string, stmt string, d dialect) []string {
+	stmt = strings.TrimSpace(stmt)
+	if stmt == "" || isCommentOnly(stmt, d) {
+		return statements
+	}
+	return append(statements, stmt)
+}
+
+// isCommentOnly reports whether stmt consists solely of comments
+func isCommentOnly(stmt string, d dialect) bool {
+	for i := 0; i < len(stmt); {
+		switch {
+		case stmt[i] == ' ' || stmt[i] == '\t' || stmt[i] == '\n' || stmt[i] == '\r':
+			i++
+		case strings.HasPrefix(stmt[i:], "--"), stmt[i] == '#' && d.hashComments:
+			i = skipLine(stmt, i)
+		case strings.HasPrefix(stmt[i:], "/*"):
+			end := strings.Index(stmt[i+2:], "*/")
+			if end < 0 {
+				return true
+			}
+			i += end + 4
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isEscapeString reports whether the quote at i opens a Postgres E'...' literal
+func isEscapeString(sql string, i int) bool {
+	if i == 0 || (sql[i-1] != 'E' && sql[i-1] != 'e') {
+		return false
+	}
+	return i == 1 || !isIdentChar(sql[i-2])
+}
+
+func skipLine(sql string, i int) int {
+	if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(sql)
+}
+
+// skipQuoted returns the index just past the literal opened at i. A doubled
+// quote character is an escaped quote in every dialect.
+func skipQuoted(sql string, i int, quote byte, backslash bool) int {
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if backslash {
+				j++
+			}
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(sql)
+}
+
+func skipTripleQuoted(sql string, i int, quote byte) int {
+	delim := strings.Repeat(string(quote), 3)
+	for j := i + 3; j < len(sql); j++ {
+		if sql[j] == '\\' {
+			j++
+			continue
+		}
+		if strings.HasPrefix(sql[j:], delim) {
+			return j + 3
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted skips a $tag$ ... $tag$ body. A '$' that does not open a
+// valid tag (such as a $1 placeholder) is consumed as a single character.
+func skipDollarQuoted(sql string, i int) int {
+	if i > 0 && isIdentChar(sql[i-1]) {
+		return i + 1
+	}
+
+	j := i + 1
+	for j < len(sql) && sql[j] != '$' {
+		if !isIdentChar(sql[j]) || (j == i+1 && sql[j] >= '0' && sql[j] <= '9') {
+			return i + 1
+		}
+		j++
+	}
+	if j >= len(sql) {
+		return i + 1
+	}
+
+	tag := sql[i : j+1]
+	if end := strings.Index(sql[j+1:], tag); end >= 0 {
+		return j + 1 + end + len(tag)
+	}
+	return len(sql)
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,45 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+
+	"supalytics-executor/driver"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		typ  driver.DriverType
+		want []string
+	}{
+		{"single", "select 1", driver.PostgresType, []string{"select 1"}},
+		{"trailing semicolon", "select 1;", driver.PostgresType, []string{"select 1"}},
+		{"several", "create temp table t as select 1; select * from t", driver.PostgresType,
+			[]string{"create temp table t as select 1", "select * from t"}},
+		{"semicolon in string", "select 'a;b'; select 2", driver.PostgresType, []string{"select 'a;b'", "select 2"}},
+		{"doubled quote in string", "select 'it''s;'; select 2", driver.PostgresType, []string{"select 'it''s;'", "select 2"}},
+		{"quoted identifier", `select 1 as "a;b"`, driver.PostgresType, []string{`select 1 as "a;b"`}},
+		{"line comment", "select 1 -- ; not here\n; select 2", driver.PostgresType, []string{"select 1 -- ; not here", "select 2"}},
+		{"block comment", "select /* ; */ 1; select 2", driver.PostgresType, []string{"select /* ; */ 1", "select 2"}},
+		{"dollar quoted body", "do $$ begin perform 1; end $$; select 2", driver.PostgresType,
+			[]string{"do $$ begin perform 1; end $$", "select 2"}},
+		{"tagged dollar quotes", "select $fn$ a; b $fn$", driver.DuckDBType, []string{"select $fn$ a; b $fn$"}},
+		{"comment-only statements dropped", "select 1; -- done\n;  ;", driver.PostgresType, []string{"select 1"}},
+		{"empty", "  ", driver.PostgresType, nil},
+		{"bigquery backticks", "select * from `p.d.t;x`; select 2", driver.BigQueryType, []string{"select * from `p.d.t;x`", "select 2"}},
+		{"bigquery hash comment", "select 1 # ;\n; select 2", driver.BigQueryType, []string{"select 1 # ;", "select 2"}},
+		{"bigquery backslash escape", `select 'a\';b'; select 2`, driver.BigQueryType, []string{`select 'a\';b'`, "select 2"}},
+		{"bigquery triple quotes", `select """a;'b"""; select 2`, driver.BigQueryType, []string{`select """a;'b"""`, "select 2"}},
+		{"hash is not a comment on postgres", "select 1 # 2; select 3", driver.PostgresType, []string{"select 1 # 2", "select 3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitStatements(tt.sql, tt.typ)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitStatements(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// runner/store.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/supabase-community/supabase-go"
+)
+
+// MetadataStore resolves the stored queries and connectors a run depends on
+type MetadataStore interface {
+	FetchQuery(ctx context.Context, queryID string) (*Query, error)
+	FetchConnector(ctx context.Context, connectorID string) (*Connector, error)
+	FetchParameterSet(ctx context.Context, queryID string, name string) (*ParameterSet, error)
+}
+
+// StorePinger is implemented by metadata stores that can check they are
+// reachable without fetching anything in particular
+type StorePinger interface {
+	Ping(ctx context.Context) error
+}
+
+// SupabaseStore reads query and connector rows from Supabase
+type SupabaseStore struct {
+	client *supabase.Client
+}
+
+// NewSupabaseStore creates a metadata store backed by the given Supabase client
+func NewSupabaseStore(client *supabase.Client) *SupabaseStore {
+	return &SupabaseStore{client: client}
+}
+
+// FetchQuery retrieves a query by ID from Supabase
+func (s *SupabaseStore) FetchQuery(ctx context.Context, queryID string) (*Query, error) {
+	var queries []Query
+	resp, _, err := s.client.From("queries").Select("*", "exact", false).Eq("id", queryID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &queries); err != nil {
+		return nil, err
+	}
+
+	if len(queries) == 0 {
+		return nil, ErrQueryNotFound
+	}
+
+	return &queries[0], nil
+}
+
+// Ping reads at most one query row to check Supabase answers
+func (s *SupabaseStore) Ping(ctx context.Context) error {
+	_, _, err := s.client.From("queries").Select("id", "", false).Limit(1, "").Execute()
+	return err
+}
+
+// FetchConnector retrieves a connector by ID from Supabase
+func (s *SupabaseStore) FetchConnector(ctx context.Context, connectorID string) (*Connector, error) {
+	var connectors []Connector
+	resp, _, err := s.client.From("connectors").Select("*", "exact", false).Eq("id", connectorID).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &connectors); err != nil {
+		return nil, err
+	}
+
+	if len(connectors) == 0 {
+		return nil, ErrConnectorNotFound
+	}
+
+	return &connectors[0], nil
+}
+
+// FetchParameterSet retrieves a query's named parameter set from Supabase
+func (s *SupabaseStore) FetchParameterSet(ctx context.Context, queryID string, name string) (*ParameterSet, error) {
+	var sets []ParameterSet
+	resp, _, err := s.client.From("query_parameter_sets").Select("*", "exact", false).Eq("query_id", queryID).Eq("name", name).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &sets); err != nil {
+		return nil, err
+	}
+
+	if len(sets) == 0 {
+		return nil, ErrParameterSetNotFound
+	}
+
+	return &sets[0], nil
+}
+
+// MemoryStore is an in-process metadata store used by tests and local development
+type MemoryStore struct {
+	mu         sync.RWMutex
+	queries    map[string]Query
+	connectors map[string]Connector
+	paramSets  map[string]ParameterSet // keyed by query ID and name
+	versions   map[string]QueryVersion // keyed by query ID and version
+	orgs       map[string]Organization
+	apiKeys    map[string]APIKey // keyed by hash
+	quotas     map[string]Quota  // keyed by organization ID
+	prewarms   map[string]Prewarm
+	async      map[string]AsyncExecution
+	audit      []AuditEntry
+}
+
+// NewMemoryStore creates an empty in-memory metadata store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		queries:    make(map[string]Query),
+		connectors: make(map[string]Connector),
+		paramSets:  make(map[string]ParameterSet),
+		versions:   make(map[string]QueryVersion),
+		orgs:       make(map[string]Organization),
+		apiKeys:    make(map[string]APIKey),
+		quotas:     make(map[string]Quota),
+		prewarms:   make(map[string]Prewarm),
+		async:      make(map[string]AsyncExecution),
+	}
+}
+
+// PutQuery adds or replaces a query
+func (s *MemoryStore) PutQuery(q Query) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries[q.ID] = q
+}
+
+// PutConnector adds or replaces a connector
+func (s *MemoryStore) PutConnector(c Connector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectors[c.ID] = c
+}
+
+// PutParameterSet adds or replaces a query's named parameter set
+func (s *MemoryStore) PutParameterSet(p ParameterSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paramSets[p.QueryID+"/"+p.Name] = p
+}
+
+// FetchQuery retrieves a query by ID
+func (s *MemoryStore) FetchQuery(ctx context.Context, queryID string) (*Query, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	q, ok := s.queries[queryID]
+	if !ok {
+		return nil, ErrQueryNotFound
+	}
+	return &q, nil
+}
+
+// FetchConnector retrieves a connector by ID
+func (s *MemoryStore) FetchConnector(ctx context.Context, connectorID string) (*Connector, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.connectors[connectorID]
+	if !ok {
+		return nil, ErrConnectorNotFound
+	}
+	return &c, nil
+}
+
+// FetchParameterSet retrieves a query's named parameter set
+func (s *MemoryStore) FetchParameterSet(ctx context.Context, queryID string, name string) (*ParameterSet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.paramSets[queryID+"/"+name]
+	if !ok {
+		return nil, ErrParameterSetNotFound
+	}
+	return &p, nil
+}
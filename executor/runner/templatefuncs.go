@@ -0,0 +1,225 @@
+// runner/templatefuncs.go
+package runner
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// templateFuncs returns the helpers available to query templates for a
+// connector of the given type. Helpers that produce SQL render it in the
+// connector's dialect:
+//
+//	dateRange COLUMN NAME OPTIONS...  predicate for a named date range
+//	now                               time the execution started, in UTC
+//	dateAdd UNIT N TIME               TIME moved by N seconds, minutes,
+//	                                  hours, days, weeks, months or years
+//	truncToDay TIME                   midnight of TIME's day in its zone
+//	inTimezone ZONE TIME              TIME in an IANA zone
+//	sqlTimestamp TIME                 timestamp literal in UTC: TIMESTAMPTZ
+//	                                  on Postgres, TIMESTAMP '... UTC' on
+//	                                  Athena, DATETIME2 on SQL Server
+//	sqlDate TIME                      date literal of TIME's calendar day
+//	quoteIdent NAME                   identifier quoted per dot-separated
+//	                                  part: "a"."b" on Postgres and Athena,
+//	                                  `a`.`b` on BigQuery and MySQL, [a].[b]
+//	                                  on SQL Server
+//	inList VALUES                     parenthesized list of literals for IN,
+//	                                  (NULL) when empty so it matches nothing
+//	default FALLBACK VALUE            VALUE, or FALLBACK when VALUE is
+//	                                  missing, nil or empty
+//	raw VALUE                         VALUE unescaped in the sql template
+//	                                  mode; an error in sql_strict
+//
+// Times compose in pipelines, e.g.
+// {{ now | inTimezone "Europe/Berlin" | truncToDay | dateAdd "day" -7 | sqlTimestamp }}
+func templateFuncs(typ driver.DriverType, now time.Time, mode string) template.FuncMap {
+	funcs := template.FuncMap{
+		"dateRange": func(column string, name string, options ...string) (sqlFragment, error) {
+			predicate, err := dateRange(typ, now, column, name, options...)
+			return sqlFragment(predicate), err
+		},
+		"now":        func() time.Time { return now.UTC() },
+		"dateAdd":    dateAdd,
+		"truncToDay": truncToDay,
+		"inTimezone": inTimezone,
+		"sqlTimestamp": func(t time.Time) sqlFragment {
+			return sqlFragment(timestampLiteral(typ, t))
+		},
+		"sqlDate": func(t time.Time) sqlFragment {
+			return sqlFragment(dateLiteral(typ, t))
+		},
+		"quoteIdent": func(name string) (sqlFragment, error) {
+			quoted, err := quoteIdent(typ, name)
+			return sqlFragment(quoted), err
+		},
+		"inList": func(values interface{}) (sqlFragment, error) {
+			list, err := inList(typ, values)
+			return sqlFragment(list), err
+		},
+		"default": defaultValue,
+	}
+	addModeFuncs(funcs, typ, mode)
+	return funcs
+}
+
+// dateAdd moves t by n units. Months and years keep the day of the month
+// where it exists, normalizing like time.AddDate otherwise.
+func dateAdd(unit string, n int, t time.Time) (time.Time, error) {
+	switch strings.TrimSuffix(unit, "s") {
+	case "second":
+		return t.Add(time.Duration(n) * time.Second), nil
+	case "minute":
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case "hour":
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case "day":
+		return t.AddDate(0, 0, n), nil
+	case "week":
+		return t.AddDate(0, 0, 7*n), nil
+	case "month":
+		return t.AddDate(0, n, 0), nil
+	case "year":
+		return t.AddDate(n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("dateAdd: unknown unit %q", unit)
+}
+
+// truncToDay returns midnight of t's calendar day in t's time zone
+func truncToDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// inTimezone converts t to an IANA time zone
+func inTimezone(zone string, t time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("inTimezone: unknown time zone %q", zone)
+	}
+	return t.In(loc), nil
+}
+
+// quoteIdent quotes each dot-separated part of an identifier in the
+// dialect's quoting style, doubling any quote characters inside it
+func quoteIdent(typ driver.DriverType, name string) (string, error) {
+	open, close := `"`, `"`
+	switch typ {
+	case driver.BigQueryType, driver.MySQLType:
+		open, close = "`", "`"
+	case driver.SQLServerType:
+		open, close = "[", "]"
+	}
+
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("quoteIdent: invalid identifier %q", name)
+		}
+		// BigQuery escapes backticks with a backslash rather than doubling
+		if typ == driver.BigQueryType {
+			part = strings.NewReplacer(`\`, `\\`, "`", "\\`").Replace(part)
+		} else {
+			part = strings.ReplaceAll(part, close, close+close)
+		}
+		parts[i] = open + part + close
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// inList renders a slice as a parenthesized list of SQL literals
+func inList(typ driver.DriverType, values interface{}) (string, error) {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("inList: want a list, got %T", values)
+	}
+	if v.Len() == 0 {
+		return "(NULL)", nil
+	}
+
+	literals := make([]string, v.Len())
+	for i := range literals {
+		literal, err := sqlLiteral(typ, v.Index(i).Interface())
+		if err != nil {
+			return "", fmt.Errorf("inList: %w", err)
+		}
+		literals[i] = literal
+	}
+	return "(" + strings.Join(literals, ", ") + ")", nil
+}
+
+// sqlLiteral renders a template value as a SQL constant in the dialect
+func sqlLiteral(typ driver.DriverType, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return stringLiteral(typ, v), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case time.Time:
+		return timestampLiteral(typ, v), nil
+	case float32:
+		return floatLiteral(float64(v))
+	case float64:
+		return floatLiteral(v)
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported value %v of type %T", value, value)
+}
+
+func floatLiteral(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("unsupported number %v", f)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
+
+// stringLiteral quotes a string, doubling single quotes. BigQuery and MySQL
+// treat backslashes as escapes, so those are escaped too; BigQuery has no
+// doubled-quote escape.
+func stringLiteral(typ driver.DriverType, s string) string {
+	switch typ {
+	case driver.BigQueryType:
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	case driver.MySQLType:
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// defaultValue returns value unless it is missing, nil or empty, in which
+// case fallback is returned
+func defaultValue(fallback interface{}, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return fallback
+		}
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fallback
+		}
+	}
+	return value
+}
@@ -0,0 +1,168 @@
+// runner/timeouts.go
+package runner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TimeoutPhase identifies the part of an execution a timeout applies to
+type TimeoutPhase string
+
+const (
+	PhaseMetadata TimeoutPhase = "metadata"
+	PhaseRender   TimeoutPhase = "render"
+	PhaseConnect  TimeoutPhase = "connect"
+	PhaseFirstRow TimeoutPhase = "first_row"
+	PhaseStream   TimeoutPhase = "stream"
+	PhaseIdle     TimeoutPhase = "idle"
+)
+
+var phaseDescriptions = map[TimeoutPhase]string{
+	PhaseMetadata: "metadata fetch",
+	PhaseRender:   "template render",
+	PhaseConnect:  "driver connect",
+	PhaseFirstRow: "waiting for first row",
+	PhaseStream:   "stream",
+	PhaseIdle:     "waiting for next row",
+}
+
+// Timeouts bounds each phase of an execution. A zero duration disables the
+// limit for that phase.
+type Timeouts struct {
+	Metadata time.Duration `toml:"metadata"`  // each query and connector lookup
+	Render   time.Duration `toml:"render"`    // template rendering
+	Connect  time.Duration `toml:"connect"`   // driver connect
+	FirstRow time.Duration `toml:"first_row"` // from execution start to the first row
+	Stream   time.Duration `toml:"stream"`    // from execution start to the last row
+	Idle     time.Duration `toml:"idle"`      // between consecutive rows
+}
+
+// TimeoutError reports which phase of an execution exceeded its limit
+type TimeoutError struct {
+	Phase TimeoutPhase
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", phaseDescriptions[e.Phase], e.Limit)
+}
+
+// Code returns the protocol error code for the timeout, e.g. "connect_timeout"
+func (e *TimeoutError) Code() string {
+	return string(e.Phase) + "_timeout"
+}
+
+// Unwrap lets callers treat every phase timeout as a deadline
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// runPhase calls fn with a context that is cancelled if fn has not returned
+// within limit. The context stays valid after fn returns so drivers may keep
+// it for the lifetime of a client.
+func runPhase(ctx context.Context, phase TimeoutPhase, limit time.Duration, fn func(ctx context.Context) error) error {
+	if limit <= 0 {
+		return fn(ctx)
+	}
+
+	timeout := &TimeoutError{Phase: phase, Limit: limit}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(limit, func() { cancel(timeout) })
+
+	err := fn(ctx)
+	timer.Stop()
+	if err != nil && context.Cause(ctx) == timeout {
+		return timeout
+	}
+	return err
+}
+
+// timeoutCause returns the phase timeout that cancelled ctx, or err unchanged
+func timeoutCause(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if timeout, ok := context.Cause(ctx).(*TimeoutError); ok {
+		return timeout
+	}
+	return err
+}
+
+// watchdog enforces the first-row, idle and total stream limits by
+// cancelling the execution context with a *TimeoutError cause
+type watchdog struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	limits Timeouts
+
+	mu       sync.Mutex
+	firstRow *time.Timer
+	idle     *time.Timer
+	total    *time.Timer
+	gotRow   bool
+	stopped  bool
+}
+
+func newWatchdog(parent context.Context, limits Timeouts) *watchdog {
+	ctx, cancel := context.WithCancelCause(parent)
+	w := &watchdog{ctx: ctx, cancel: cancel, limits: limits}
+	w.firstRow = w.after(PhaseFirstRow, limits.FirstRow)
+	w.total = w.after(PhaseStream, limits.Stream)
+	return w
+}
+
+func (w *watchdog) after(phase TimeoutPhase, limit time.Duration) *time.Timer {
+	if limit <= 0 {
+		return nil
+	}
+	return time.AfterFunc(limit, func() {
+		w.cancel(&TimeoutError{Phase: phase, Limit: limit})
+	})
+}
+
+// rowReceived pauses the idle clock while the row is being handled
+func (w *watchdog) rowReceived() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.gotRow {
+		w.gotRow = true
+		stopTimer(w.firstRow)
+	}
+	stopTimer(w.idle)
+}
+
+// rowHandled restarts the idle clock once the consumer is ready for more
+func (w *watchdog) rowHandled() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped || w.limits.Idle <= 0 {
+		return
+	}
+	if w.idle == nil {
+		w.idle = w.after(PhaseIdle, w.limits.Idle)
+		return
+	}
+	w.idle.Reset(w.limits.Idle)
+}
+
+// stop disarms every timer; the execution context is left to its parent
+func (w *watchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	stopTimer(w.firstRow)
+	stopTimer(w.idle)
+	stopTimer(w.total)
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,85 @@
+// runner/timezone.go
+package runner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// queryTimezone returns the time zone an execution renders timestamps in:
+// the request's, else the query's default; empty leaves them as the engine
+// returned them
+func queryTimezone(query *Query, opts ExecuteOptions) string {
+	if opts.Timezone != "" {
+		return opts.Timezone
+	}
+	return query.Timezone
+}
+
+// timezoneFor loads the execution's time zone, nil when it has none
+func timezoneFor(query *Query, opts ExecuteOptions) (*time.Location, error) {
+	name := queryTimezone(query, opts)
+	if name == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// setSessionTimezone evaluates the session's queries in the time zone on
+// engines that support one, so casts of timestamps to dates and date
+// truncation follow it too
+func setSessionTimezone(ctx context.Context, drv driver.Driver, loc *time.Location) error {
+	tz, ok := drv.(driver.SessionTimezoner)
+	if !ok || loc == nil {
+		return nil
+	}
+	if err := tz.SetTimezone(ctx, loc.String()); err != nil {
+		return fmt.Errorf("set session timezone: %w", err)
+	}
+	return nil
+}
+
+// convertTimezone converts the result's timestamps to the time zone,
+// including those inside arrays and objects. Timestamps without a zone,
+// which engines return as UTC, are converted from UTC; dates and times of
+// day are left alone.
+func convertTimezone(result *driver.QueryResult, loc *time.Location) *driver.QueryResult {
+	stream := result.Stream
+	if stream == nil || loc == nil {
+		return result
+	}
+
+	converted := *result
+	converted.Stream = func(yield func(columns []string, row []interface{}) error) error {
+		return stream(func(columns []string, row []interface{}) error {
+			for i, v := range row {
+				row[i] = timeIn(v, loc)
+			}
+			return yield(columns, row)
+		})
+	}
+	return &converted
+}
+
+func timeIn(v interface{}, loc *time.Location) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return t.In(loc)
+	case []interface{}:
+		for i, item := range t {
+			t[i] = timeIn(item, loc)
+		}
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = timeIn(item, loc)
+		}
+	}
+	return v
+}
@@ -0,0 +1,664 @@
+// runner/transforms.go
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// Transform operations applied to a result set as it streams
+const (
+	// TransformRename renames columns, old name to new in Names
+	TransformRename = "rename"
+	// TransformCast converts the values of columns to the type in Types:
+	// string, number, integer (truncating fractions) or boolean
+	TransformCast = "cast"
+	// TransformCompute adds the column Name holding Expr, an expression
+	// over the row's columns such as "revenue - cost" or
+	// "round(hits * 100 / total, 1)"
+	TransformCompute = "compute"
+	// TransformPivot turns the distinct values of Column into columns
+	// holding Value, with a row per distinct combination of the Index
+	// columns. It buffers the whole result.
+	TransformPivot = "pivot"
+	// TransformUnpivot turns Columns into rows of two columns, Name
+	// (default "name") holding the column name and Value (default "value")
+	// its value, keeping the other columns
+	TransformUnpivot = "unpivot"
+	// TransformTop keeps the first N rows, or the N largest by the column
+	// By, smallest when Descending is false
+	TransformTop = "top"
+)
+
+// Transform is one step of the post-processing applied to a query's result
+// set before it is sent, so thin clients receive dashboard-ready rows. Each
+// operation reads the fields its documentation names.
+type Transform struct {
+	Op         string            `json:"op"`
+	Names      map[string]string `json:"names,omitempty"`
+	Types      map[string]string `json:"types,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Expr       string            `json:"expr,omitempty"`
+	Index      []string          `json:"index,omitempty"`
+	Column     string            `json:"column,omitempty"`
+	Value      string            `json:"value,omitempty"`
+	Columns    []string          `json:"columns,omitempty"`
+	N          int64             `json:"n,omitempty"`
+	By         string            `json:"by,omitempty"`
+	Descending bool              `json:"desc,omitempty"`
+}
+
+// ValidateTransforms checks transforms can be applied, without knowing the
+// columns they will see
+func ValidateTransforms(transforms []Transform) error {
+	_, err := compileTransforms(transforms)
+	return err
+}
+
+// queryTransforms returns the transforms an execution applies: the query's
+// followed by the request's, or none for a count
+func queryTransforms(query *Query, opts ExecuteOptions) []Transform {
+	if opts.CountOnly {
+		return nil
+	}
+	return append(append([]Transform(nil), query.Transforms...), opts.Transforms...)
+}
+
+// transformStage is a compiled transform. header receives the result's
+// column header before any row and returns the stage's own, or nil when the
+// stage holds it back until flush. A stage that needs no more input returns
+// io.EOF from row; one that holds rows back emits them from flush once the
+// stream ends, preceded by its header when it held that back too.
+type transformStage interface {
+	header(columns []string) ([]string, error)
+	row(row []interface{}, emit func([]interface{}) error) error
+	flush(emit emitFunc) error
+}
+
+// bufferingStage is a stage that holds rows until flush. The rows it holds
+// are charged to the execution's memory account.
+type bufferingStage interface {
+	account(mem *memoryAccount)
+}
+
+// emitFunc passes on a column header (with a nil row) or a row
+type emitFunc func(columns []string, row []interface{}) error
+
+// compileTransforms checks each transform and builds its stage
+func compileTransforms(transforms []Transform) ([]transformStage, error) {
+	stages := make([]transformStage, 0, len(transforms))
+	for i, t := range transforms {
+		stage, err := t.compile()
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i+1, t.Op, err)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+func (t Transform) compile() (transformStage, error) {
+	switch t.Op {
+	case TransformRename:
+		if len(t.Names) == 0 {
+			return nil, errors.New("names is required")
+		}
+		return &renameStage{names: t.Names}, nil
+
+	case TransformCast:
+		if len(t.Types) == 0 {
+			return nil, errors.New("types is required")
+		}
+		for column, typ := range t.Types {
+			switch typ {
+			case ParamString, ParamNumber, ParamInteger, ParamBoolean:
+			default:
+				return nil, fmt.Errorf("column %q: unsupported type %q", column, typ)
+			}
+		}
+		return &castStage{types: t.Types}, nil
+
+	case TransformCompute:
+		if t.Name == "" || t.Expr == "" {
+			return nil, errors.New("name and expr are required")
+		}
+		expr, err := parseExpr(t.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &computeStage{name: t.Name, expr: expr}, nil
+
+	case TransformPivot:
+		if t.Column == "" || t.Value == "" {
+			return nil, errors.New("column and value are required")
+		}
+		return &pivotStage{index: t.Index, key: t.Column, value: t.Value, groups: map[string]int{}, keys: map[string]int{}}, nil
+
+	case TransformUnpivot:
+		if len(t.Columns) == 0 {
+			return nil, errors.New("columns is required")
+		}
+		name, value := t.Name, t.Value
+		if name == "" {
+			name = "name"
+		}
+		if value == "" {
+			value = "value"
+		}
+		return &unpivotStage{unpivot: t.Columns, name: name, value: value}, nil
+
+	case TransformTop:
+		if t.N <= 0 {
+			return nil, fmt.Errorf("n must be positive, got %d", t.N)
+		}
+		return &topStage{n: t.N, by: t.By, descending: t.Descending}, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", t.Op)
+}
+
+// applyTransforms runs a result through compiled transforms, charging the
+// rows they hold back to mem
+func applyTransforms(result *driver.QueryResult, stages []transformStage, mem *memoryAccount) *driver.QueryResult {
+	stream := result.Stream
+	if stream == nil || len(stages) == 0 {
+		return result
+	}
+	for _, stage := range stages {
+		if b, ok := stage.(bufferingStage); ok {
+			b.account(mem)
+		}
+	}
+
+	transformed := &driver.QueryResult{Error: result.Error}
+	transformed.Stream = func(yield func(columns []string, row []interface{}) error) error {
+		// emitFrom passes a header or row to the stages from i on, then
+		// to yield
+		var emitFrom func(i int) emitFunc
+		emitFrom = func(i int) emitFunc {
+			if i == len(stages) {
+				return yield
+			}
+			next := emitFrom(i + 1)
+			return func(columns []string, row []interface{}) error {
+				if row != nil {
+					return stages[i].row(row, func(out []interface{}) error {
+						return next(nil, out)
+					})
+				}
+				out, err := stages[i].header(columns)
+				if err != nil {
+					return fmt.Errorf("transform %d: %w", i+1, err)
+				}
+				if out == nil {
+					return nil
+				}
+				return next(out, nil)
+			}
+		}
+		emit := emitFrom(0)
+
+		header, stopped := false, false
+		err := stream(func(columns []string, row []interface{}) error {
+			if row == nil {
+				if header {
+					return nil
+				}
+				header = true
+				return emit(columns, nil)
+			}
+			if !header {
+				return errors.New("transform: row streamed before the column header")
+			}
+			err := emit(nil, row)
+			if errors.Is(err, io.EOF) {
+				stopped = true
+			}
+			return err
+		})
+		// Drivers either return the io.EOF that stopped them or end cleanly
+		if err != nil && !(stopped && errors.Is(err, io.EOF)) {
+			return err
+		}
+		if !header {
+			return nil
+		}
+		for i, stage := range stages {
+			if err := stage.flush(emitFrom(i + 1)); err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+		}
+		return nil
+	}
+	return transformed
+}
+
+// columnIndex finds a column of a header
+func columnIndex(columns []string, name string) (int, error) {
+	for i, c := range columns {
+		if c == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown column %q", name)
+}
+
+type renameStage struct {
+	names map[string]string
+}
+
+func (s *renameStage) header(in []string) ([]string, error) {
+	out := make([]string, len(in))
+	copy(out, in)
+	for old, name := range s.names {
+		i, err := columnIndex(in, old)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = name
+	}
+	return out, nil
+}
+
+func (s *renameStage) row(row []interface{}, emit func([]interface{}) error) error {
+	return emit(row)
+}
+
+func (s *renameStage) flush(emitFunc) error { return nil }
+
+type castStage struct {
+	types map[string]string
+	index map[int]string
+	names []string
+}
+
+func (s *castStage) header(in []string) ([]string, error) {
+	s.index = make(map[int]string, len(s.types))
+	for column, typ := range s.types {
+		i, err := columnIndex(in, column)
+		if err != nil {
+			return nil, err
+		}
+		s.index[i] = typ
+	}
+	s.names = in
+	return in, nil
+}
+
+func (s *castStage) row(row []interface{}, emit func([]interface{}) error) error {
+	for i, typ := range s.index {
+		v, err := castValue(row[i], typ)
+		if err != nil {
+			return fmt.Errorf("cast column %q: %w", s.names[i], err)
+		}
+		row[i] = v
+	}
+	return emit(row)
+}
+
+func (s *castStage) flush(emitFunc) error { return nil }
+
+// castValue converts a value to a cast type; nil stays nil
+func castValue(v interface{}, typ string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	switch typ {
+	case ParamString:
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case time.Time:
+			return v.Format(time.RFC3339Nano), nil
+		}
+		return fmt.Sprint(v), nil
+
+	case ParamNumber, ParamInteger:
+		n, _, ok := exprNumber(v)
+		if !ok {
+			if b, isBool := v.(bool); isBool {
+				n, ok = 0, true
+				if b {
+					n = 1
+				}
+			}
+		}
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("cannot convert %v to %s", v, typ)
+		}
+		if typ == ParamInteger {
+			return int64(math.Trunc(n)), nil
+		}
+		return n, nil
+
+	case ParamBoolean:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q to boolean", v)
+			}
+			return b, nil
+		}
+		if n, _, ok := exprNumber(v); ok {
+			return n != 0, nil
+		}
+		return nil, fmt.Errorf("cannot convert %v to boolean", v)
+	}
+	return nil, fmt.Errorf("unsupported type %q", typ)
+}
+
+type computeStage struct {
+	name string
+	expr exprNode
+	eval exprFunc
+}
+
+func (s *computeStage) header(in []string) ([]string, error) {
+	index := make(map[string]int, len(in))
+	for i, c := range in {
+		index[c] = i
+	}
+	eval, err := s.expr.bind(index)
+	if err != nil {
+		return nil, fmt.Errorf("compute %q: %w", s.name, err)
+	}
+	s.eval = eval
+	return append(append([]string(nil), in...), s.name), nil
+}
+
+func (s *computeStage) row(row []interface{}, emit func([]interface{}) error) error {
+	v, err := s.eval(row)
+	if err != nil {
+		return fmt.Errorf("compute %q: %w", s.name, err)
+	}
+	return emit(append(row, v))
+}
+
+func (s *computeStage) flush(emitFunc) error { return nil }
+
+// pivotStage buffers a row per group of index values, in the order the
+// groups first appear, and a column per key, likewise. A key seen twice in
+// a group keeps its last value.
+type pivotStage struct {
+	index      []string
+	key, value string
+
+	seen           bool
+	indexAt        []int
+	keyAt, valueAt int
+	groups         map[string]int
+	groupValues    [][]interface{}
+	keys           map[string]int
+	keyNames       []string
+	cells          []map[int]interface{}
+
+	mem *memoryAccount
+}
+
+func (s *pivotStage) account(mem *memoryAccount) { s.mem = mem }
+
+func (s *pivotStage) header(in []string) ([]string, error) {
+	var err error
+	if s.keyAt, err = columnIndex(in, s.key); err != nil {
+		return nil, err
+	}
+	if s.valueAt, err = columnIndex(in, s.value); err != nil {
+		return nil, err
+	}
+	s.indexAt = make([]int, len(s.index))
+	for i, name := range s.index {
+		if s.indexAt[i], err = columnIndex(in, name); err != nil {
+			return nil, err
+		}
+	}
+	// The pivoted columns are only known once every row has been read
+	s.seen = true
+	return nil, nil
+}
+
+func (s *pivotStage) row(row []interface{}, emit func([]interface{}) error) error {
+	values := make([]interface{}, len(s.indexAt))
+	for i, at := range s.indexAt {
+		values[i] = row[at]
+	}
+	group := fmt.Sprintf("%#v", values)
+	g, ok := s.groups[group]
+	if !ok {
+		if err := s.mem.grow(rowSize(values)+int64(len(group)), "pivot"); err != nil {
+			return err
+		}
+		g = len(s.groupValues)
+		s.groups[group] = g
+		s.groupValues = append(s.groupValues, values)
+		s.cells = append(s.cells, map[int]interface{}{})
+	}
+
+	name := pivotColumnName(row[s.keyAt])
+	k, ok := s.keys[name]
+	if !ok {
+		k = len(s.keyNames)
+		s.keys[name] = k
+		s.keyNames = append(s.keyNames, name)
+	}
+	if _, ok := s.cells[g][k]; !ok {
+		if err := s.mem.grow(rowSize(row[s.valueAt:s.valueAt+1]), "pivot"); err != nil {
+			return err
+		}
+	}
+	s.cells[g][k] = row[s.valueAt]
+	return nil
+}
+
+func (s *pivotStage) flush(emit emitFunc) error {
+	if !s.seen {
+		return nil
+	}
+	columns := append(append([]string{}, s.index...), s.keyNames...)
+	if err := emit(columns, nil); err != nil {
+		return err
+	}
+	for g, values := range s.groupValues {
+		out := make([]interface{}, len(values)+len(s.keyNames))
+		copy(out, values)
+		for k, v := range s.cells[g] {
+			out[len(values)+k] = v
+		}
+		if err := emit(nil, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pivotColumnName names the column a pivot key becomes
+func pivotColumnName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+type unpivotStage struct {
+	unpivot     []string
+	name, value string
+
+	unpivotAt []int
+	keepAt    []int
+}
+
+func (s *unpivotStage) header(in []string) ([]string, error) {
+	s.unpivotAt = make([]int, len(s.unpivot))
+	unpivoted := make(map[int]bool, len(s.unpivot))
+	for i, name := range s.unpivot {
+		at, err := columnIndex(in, name)
+		if err != nil {
+			return nil, err
+		}
+		s.unpivotAt[i] = at
+		unpivoted[at] = true
+	}
+	var out []string
+	for i, c := range in {
+		if !unpivoted[i] {
+			s.keepAt = append(s.keepAt, i)
+			out = append(out, c)
+		}
+	}
+	return append(out, s.name, s.value), nil
+}
+
+func (s *unpivotStage) row(row []interface{}, emit func([]interface{}) error) error {
+	for i, at := range s.unpivotAt {
+		out := make([]interface{}, 0, len(s.keepAt)+2)
+		for _, keep := range s.keepAt {
+			out = append(out, row[keep])
+		}
+		out = append(out, s.unpivot[i], row[at])
+		if err := emit(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *unpivotStage) flush(emitFunc) error { return nil }
+
+// topStage passes the first n rows through and stops the stream, or keeps
+// the n rows ranking highest by a column and emits them in order at the end
+type topStage struct {
+	n          int64
+	by         string
+	descending bool
+
+	byAt int
+	sent int64
+	rows [][]interface{}
+
+	mem *memoryAccount
+}
+
+func (s *topStage) account(mem *memoryAccount) { s.mem = mem }
+
+func (s *topStage) header(in []string) ([]string, error) {
+	if s.by != "" {
+		at, err := columnIndex(in, s.by)
+		if err != nil {
+			return nil, err
+		}
+		s.byAt = at
+	}
+	return in, nil
+}
+
+func (s *topStage) row(row []interface{}, emit func([]interface{}) error) error {
+	if s.by == "" {
+		s.sent++
+		if err := emit(row); err != nil {
+			return err
+		}
+		if s.sent == s.n {
+			return io.EOF
+		}
+		return nil
+	}
+
+	// rows stays sorted, so a row ranking below a full set is dropped
+	// and any other is inserted in place
+	i := sort.Search(len(s.rows), func(i int) bool {
+		return s.before(row, s.rows[i])
+	})
+	if int64(i) == s.n {
+		return nil
+	}
+	if err := s.mem.grow(rowSize(row), "top"); err != nil {
+		return err
+	}
+	s.rows = append(s.rows, nil)
+	copy(s.rows[i+1:], s.rows[i:])
+	s.rows[i] = row
+	if int64(len(s.rows)) > s.n {
+		s.mem.shrink(rowSize(s.rows[s.n]))
+		s.rows = s.rows[:s.n]
+	}
+	return nil
+}
+
+// before reports whether row a ranks ahead of b. Nulls rank last in either
+// direction, and ties keep their streamed order.
+func (s *topStage) before(a, b []interface{}) bool {
+	x, y := a[s.byAt], b[s.byAt]
+	switch {
+	case x == nil:
+		return false
+	case y == nil:
+		return true
+	}
+	c := compareValues(x, y)
+	if s.descending {
+		return c > 0
+	}
+	return c < 0
+}
+
+func (s *topStage) flush(emit emitFunc) error {
+	for _, row := range s.rows {
+		if err := emit(nil, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareValues orders two non-nil values: numbers numerically, times
+// chronologically and anything else by its text
+func compareValues(x, y interface{}) int {
+	if a, ok := x.(time.Time); ok {
+		if b, ok := y.(time.Time); ok {
+			return a.Compare(b)
+		}
+	}
+	if isNumeric(x) && isNumeric(y) {
+		a, _, _ := exprNumber(x)
+		b, _, _ := exprNumber(y)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(pivotColumnName(x), pivotColumnName(y))
+}
+
+// isNumeric reports whether a value is of a Go numeric type
+func isNumeric(v interface{}) bool {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
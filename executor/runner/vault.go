@@ -0,0 +1,402 @@
+// runner/vault.go
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix marking a connector config value as a Vault reference, e.g.
+// "vault:secret/data/pg#password"
+const vaultRefPrefix = "vault:"
+
+// Default time a secret without a lease is served from cache
+const defaultVaultCacheTTL = 5 * time.Minute
+
+// ErrNoSecretResolver is returned for a connector config that references
+// secrets when no secret backend is configured
+var ErrNoSecretResolver = errors.New("connector config references Vault secrets but Vault is not configured")
+
+// SecretResolver resolves a secret reference to its value
+type SecretResolver interface {
+	// ResolveSecret returns the value of key in the secret at path
+	ResolveSecret(ctx context.Context, path string, key string) (interface{}, error)
+}
+
+// VaultConfig configures HashiCorp Vault access. Either Token or the
+// AppRole credentials must be set.
+type VaultConfig struct {
+	Address   string `toml:"address"`
+	Namespace string `toml:"namespace"`
+
+	Token string `toml:"token"`
+
+	RoleID    string `toml:"role_id"`
+	SecretID  string `toml:"secret_id"`
+	AuthMount string `toml:"auth_mount"` // AppRole mount path (default "approle")
+
+	// CacheTTL bounds how long secrets without a lease are cached (default 5m)
+	CacheTTL time.Duration `toml:"cache_ttl"`
+}
+
+// Enabled reports whether Vault is configured
+func (c VaultConfig) Enabled() bool {
+	return c.Address != ""
+}
+
+// VaultResolver reads secrets from Vault's HTTP API. Secrets are cached
+// until their lease is two-thirds spent; renewable leases are renewed rather
+// than re-read so dynamic credentials stay stable. An AppRole token is
+// renewed in the background and replaced by a fresh login when renewal fails.
+type VaultResolver struct {
+	config VaultConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time // zero for tokens that do not expire
+	secrets     map[string]*vaultSecret
+}
+
+// vaultSecret is a cached secret read
+type vaultSecret struct {
+	data      map[string]interface{}
+	leaseID   string
+	renewable bool
+	refreshAt time.Time
+	expiresAt time.Time
+}
+
+// vaultResponse is the envelope of every Vault API response
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultResolver creates a resolver for the configured Vault server
+func NewVaultResolver(cfg VaultConfig) (*VaultResolver, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("vault address is required")
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, errors.New("vault token or approle role_id and secret_id are required")
+	}
+	if cfg.AuthMount == "" {
+		cfg.AuthMount = "approle"
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultVaultCacheTTL
+	}
+	cfg.Address = strings.TrimRight(cfg.Address, "/")
+
+	return &VaultResolver{
+		config:  cfg,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		token:   cfg.Token,
+		secrets: make(map[string]*vaultSecret),
+	}, nil
+}
+
+// ResolveSecret returns the value of key in the secret at path
+func (v *VaultResolver) ResolveSecret(ctx context.Context, path string, key string) (interface{}, error) {
+	secret, err := v.secret(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// KV version 2 nests the secret's fields under data.data
+	data := secret.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no key %q", path, key)
+	}
+	return value, nil
+}
+
+// secret returns the secret at path, from cache while its lease is fresh
+func (v *VaultResolver) secret(ctx context.Context, path string) (*vaultSecret, error) {
+	v.mu.Lock()
+	cached, ok := v.secrets[path]
+	v.mu.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(cached.refreshAt) {
+		return cached, nil
+	}
+	if ok && cached.renewable && now.Before(cached.expiresAt) {
+		renewed, err := v.renewLease(ctx, cached)
+		if err == nil {
+			return renewed, nil
+		}
+		log.Printf("Renewing Vault lease for %s failed, reading it again: %v", path, err)
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, "/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("read vault secret %s: %w", path, err)
+	}
+
+	secret := &vaultSecret{data: resp.Data, leaseID: resp.LeaseID, renewable: resp.Renewable}
+	v.setLease(secret, resp.LeaseDuration)
+
+	v.mu.Lock()
+	v.secrets[path] = secret
+	v.mu.Unlock()
+	return secret, nil
+}
+
+// renewLease extends a cached secret's lease
+func (v *VaultResolver) renewLease(ctx context.Context, cached *vaultSecret) (*vaultSecret, error) {
+	resp, err := v.do(ctx, http.MethodPut, "/v1/sys/leases/renew", map[string]interface{}{"lease_id": cached.leaseID})
+	if err != nil {
+		return nil, err
+	}
+
+	renewed := &vaultSecret{data: cached.data, leaseID: cached.leaseID, renewable: resp.Renewable}
+	v.setLease(renewed, resp.LeaseDuration)
+
+	v.mu.Lock()
+	for path, s := range v.secrets {
+		if s == cached {
+			v.secrets[path] = renewed
+		}
+	}
+	v.mu.Unlock()
+	return renewed, nil
+}
+
+// setLease schedules when a secret is refreshed and when it stops being usable
+func (v *VaultResolver) setLease(secret *vaultSecret, leaseSeconds int) {
+	now := time.Now()
+	if leaseSeconds <= 0 {
+		secret.refreshAt = now.Add(v.config.CacheTTL)
+		secret.expiresAt = secret.refreshAt
+		return
+	}
+
+	lease := time.Duration(leaseSeconds) * time.Second
+	refresh := lease * 2 / 3
+	if refresh > v.config.CacheTTL && secret.leaseID == "" {
+		refresh = v.config.CacheTTL
+	}
+	secret.refreshAt = now.Add(refresh)
+	secret.expiresAt = now.Add(lease)
+}
+
+// authToken returns a valid client token, logging in with AppRole when there
+// is none yet or the current one is about to expire
+func (v *VaultResolver) authToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	token, expiry := v.token, v.tokenExpiry
+	v.mu.Unlock()
+
+	if token != "" && (expiry.IsZero() || time.Until(expiry) > 10*time.Second) {
+		return token, nil
+	}
+	if v.config.RoleID == "" {
+		return token, nil
+	}
+	return v.login(ctx)
+}
+
+// login exchanges the AppRole credentials for a client token and schedules
+// its renewal
+func (v *VaultResolver) login(ctx context.Context) (string, error) {
+	resp, err := v.request(ctx, "", http.MethodPost, "/v1/auth/"+v.config.AuthMount+"/login", map[string]interface{}{
+		"role_id":   v.config.RoleID,
+		"secret_id": v.config.SecretID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("vault approle login: %w", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", errors.New("vault approle login returned no token")
+	}
+
+	v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	return resp.Auth.ClientToken, nil
+}
+
+// setToken stores a client token and, for renewable tokens, renews it in
+// the background once two-thirds of its lease has passed
+func (v *VaultResolver) setToken(token string, leaseSeconds int, renewable bool) {
+	lease := time.Duration(leaseSeconds) * time.Second
+
+	v.mu.Lock()
+	v.token = token
+	v.tokenExpiry = time.Time{}
+	if lease > 0 {
+		v.tokenExpiry = time.Now().Add(lease)
+	}
+	v.mu.Unlock()
+
+	if !renewable || lease <= 0 {
+		return
+	}
+	time.AfterFunc(lease*2/3, func() {
+		v.mu.Lock()
+		current := v.token
+		v.mu.Unlock()
+		if current != token {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		resp, err := v.request(ctx, token, http.MethodPost, "/v1/auth/token/renew-self", nil)
+		if err != nil || resp.Auth == nil {
+			// The next lookup logs in again once the token is near expiry
+			log.Printf("Renewing Vault token failed: %v", err)
+			return
+		}
+		v.setToken(token, resp.Auth.LeaseDuration, resp.Auth.Renewable)
+	})
+}
+
+// do sends an authenticated request
+func (v *VaultResolver) do(ctx context.Context, method string, path string, body interface{}) (*vaultResponse, error) {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return v.request(ctx, token, method, path, body)
+}
+
+func (v *VaultResolver) request(ctx context.Context, token string, method string, path string, body interface{}) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.config.Address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp vaultResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decode vault response: %w", err)
+	}
+	if httpResp.StatusCode >= 300 {
+		if len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %s: %s", httpResp.Status, strings.Join(resp.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault returned %s", httpResp.Status)
+	}
+	return &resp, nil
+}
+
+// resolveSecretRefs replaces every "vault:<path>#<key>" string in a connector
+// config with the referenced secret value
+func resolveSecretRefs(ctx context.Context, config json.RawMessage, resolver SecretResolver) (json.RawMessage, error) {
+	if !bytes.Contains(config, []byte(`"`+vaultRefPrefix)) {
+		return config, nil
+	}
+
+	// Keep numbers exact; they are written back unchanged
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.UseNumber()
+	if err := decoder.Decode(&tree); err != nil {
+		return config, nil
+	}
+
+	resolved, changed, err := resolveRefs(ctx, tree, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return config, nil
+	}
+	return json.Marshal(resolved)
+}
+
+func resolveRefs(ctx context.Context, node interface{}, resolver SecretResolver) (interface{}, bool, error) {
+	switch v := node.(type) {
+	case string:
+		if !strings.HasPrefix(v, vaultRefPrefix) {
+			return v, false, nil
+		}
+		path, key, ok := strings.Cut(strings.TrimPrefix(v, vaultRefPrefix), "#")
+		if !ok || path == "" || key == "" {
+			return nil, false, fmt.Errorf("invalid vault reference %q: want vault:<path>#<key>", v)
+		}
+		if resolver == nil {
+			return nil, false, ErrNoSecretResolver
+		}
+		value, err := resolver.ResolveSecret(ctx, path, key)
+		if err != nil {
+			return nil, false, err
+		}
+		return value, true, nil
+
+	case map[string]interface{}:
+		changed := false
+		for k, child := range v {
+			resolved, c, err := resolveRefs(ctx, child, resolver)
+			if err != nil {
+				return nil, false, err
+			}
+			v[k] = resolved
+			changed = changed || c
+		}
+		return v, changed, nil
+
+	case []interface{}:
+		changed := false
+		for i, child := range v {
+			resolved, c, err := resolveRefs(ctx, child, resolver)
+			if err != nil {
+				return nil, false, err
+			}
+			v[i] = resolved
+			changed = changed || c
+		}
+		return v, changed, nil
+
+	default:
+		return v, false, nil
+	}
+}
@@ -0,0 +1,119 @@
+// runner/versions.go
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrQueryVersionNotFound is returned for versions missing from the store
+var ErrQueryVersionNotFound = errors.New("query version not found")
+
+// QueryVersion is a saved revision of a query's template. Versions are
+// numbered from 1 and never change once saved.
+type QueryVersion struct {
+	ID        string    `json:"id"`
+	QueryID   string    `json:"query_id"`
+	Version   int       `json:"version"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// QueryVersionStore reads saved query versions. Metadata stores that
+// implement it can run a query pinned to an earlier version.
+type QueryVersionStore interface {
+	FetchQueryVersion(ctx context.Context, queryID string, version int) (*QueryVersion, error)
+}
+
+// FetchQueryVersion retrieves a version of a query from Supabase
+func (s *SupabaseStore) FetchQueryVersion(ctx context.Context, queryID string, version int) (*QueryVersion, error) {
+	var versions []QueryVersion
+	resp, _, err := s.client.From("query_versions").Select("*", "exact", false).
+		Eq("query_id", queryID).
+		Eq("version", strconv.Itoa(version)).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &versions); err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrQueryVersionNotFound
+	}
+
+	return &versions[0], nil
+}
+
+// PutQueryVersion adds or replaces a version of a query
+func (s *MemoryStore) PutQueryVersion(v QueryVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[queryVersionKey(v.QueryID, v.Version)] = v
+}
+
+// FetchQueryVersion retrieves a version of a query
+func (s *MemoryStore) FetchQueryVersion(ctx context.Context, queryID string, version int) (*QueryVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.versions[queryVersionKey(queryID, version)]
+	if !ok {
+		return nil, ErrQueryVersionNotFound
+	}
+	return &v, nil
+}
+
+// FetchQueryVersion retrieves a version of a query. Versions never change,
+// so cached ones are served without asking the underlying store.
+func (s *CachingStore) FetchQueryVersion(ctx context.Context, queryID string, version int) (*QueryVersion, error) {
+	key := queryVersionKey(queryID, version)
+	s.mu.RLock()
+	cached, ok := s.versions[key]
+	s.mu.RUnlock()
+	if ok {
+		return &cached, nil
+	}
+
+	versions, ok := s.store.(QueryVersionStore)
+	if !ok {
+		return nil, ErrQueryVersionNotFound
+	}
+	v, err := versions.FetchQueryVersion(ctx, queryID, version)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.versions[key] = *v
+	s.mu.Unlock()
+	return v, nil
+}
+
+func queryVersionKey(queryID string, version int) string {
+	return queryID + "@" + strconv.Itoa(version)
+}
+
+// pinVersion replaces the query's template with the version the execution
+// is pinned to
+func pinVersion(ctx context.Context, store MetadataStore, query *Query, opts ExecuteOptions) error {
+	versions, ok := store.(QueryVersionStore)
+	if !ok {
+		return fmt.Errorf("query version %d: %w", opts.QueryVersion, ErrQueryVersionNotFound)
+	}
+	var v *QueryVersion
+	err := runPhase(ctx, PhaseMetadata, opts.Timeouts.Metadata, func(ctx context.Context) error {
+		var err error
+		v, err = versions.FetchQueryVersion(ctx, query.ID, opts.QueryVersion)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("query version %d: %w", opts.QueryVersion, err)
+	}
+	query.Content, query.Version = v.Content, v.Version
+	return nil
+}
@@ -0,0 +1,252 @@
+// runner/warmpool.go
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// Defaults of the warm pool
+const (
+	defaultWarmPoolSize     = 2
+	defaultWarmPoolInterval = time.Minute
+	defaultWarmPoolMaxIdle  = 15 * time.Minute
+
+	// Time allowed for a round of the warm pool
+	warmPoolRoundTimeout = time.Minute
+)
+
+// WarmPoolConfig sizes the connections kept ready for pinned connectors
+type WarmPoolConfig struct {
+	// Size is the number of connected drivers kept idle per pinned
+	// connector (default 2); negative disables the pool
+	Size int `toml:"size"`
+	// Interval is the time between rounds that ping the idle drivers,
+	// replace those that fail and refill the pool (default 1m)
+	Interval time.Duration `toml:"interval"`
+	// MaxIdle retires drivers that have waited longer, before the engine
+	// or a proxy drops their connections (default 15m)
+	MaxIdle time.Duration `toml:"max_idle"`
+}
+
+// WarmPool keeps drivers connected to pinned connectors ready, so that an
+// execution on one, such as the first dashboard load of the day, does not
+// wait for a cold connection. Each driver serves a single execution, which
+// closes it as usual, and the pool connects its replacement on the next
+// round; a driver therefore never carries one execution's session state
+// into another.
+type WarmPool struct {
+	size     int
+	interval time.Duration
+	maxIdle  time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*warmDriver // by connector ID, oldest first
+	closed bool
+}
+
+type warmDriver struct {
+	drv       driver.Driver
+	connector Connector // as the driver was connected
+	since     time.Time
+}
+
+// NewWarmPool creates a warm pool, or returns nil when its size disables it
+func NewWarmPool(cfg WarmPoolConfig) *WarmPool {
+	if cfg.Size < 0 {
+		return nil
+	}
+	p := &WarmPool{
+		size:     cfg.Size,
+		interval: cfg.Interval,
+		maxIdle:  cfg.MaxIdle,
+		idle:     make(map[string][]*warmDriver),
+	}
+	if p.size == 0 {
+		p.size = defaultWarmPoolSize
+	}
+	if p.interval <= 0 {
+		p.interval = defaultWarmPoolInterval
+	}
+	if p.maxIdle <= 0 {
+		p.maxIdle = defaultWarmPoolMaxIdle
+	}
+	return p
+}
+
+// Interval is the time between the pool's rounds
+func (p *WarmPool) Interval() time.Duration {
+	return p.interval
+}
+
+// take hands out an idle driver connected to the connector as it is now,
+// or returns nil when there is none. Drivers connected to an earlier
+// version of the connector are closed.
+func (p *WarmPool) take(connector *Connector) driver.Driver {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	idle := p.idle[connector.ID]
+	var drv driver.Driver
+	var stale []*warmDriver
+	for len(idle) > 0 && drv == nil {
+		// The newest driver is the least likely to have been dropped
+		w := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+		if w.connector.sameVersion(connector) {
+			drv = w.drv
+		} else {
+			stale = append(stale, w)
+		}
+	}
+	p.idle[connector.ID] = idle
+	p.mu.Unlock()
+
+	for _, w := range stale {
+		w.drv.Close()
+	}
+	return drv
+}
+
+// sameVersion reports whether two copies of a connector have the same
+// config, so a driver connected with one serves the other
+func (c *Connector) sameVersion(other *Connector) bool {
+	return c.Type == other.Type && c.UpdatedAt.Equal(other.UpdatedAt) && bytes.Equal(c.Config, other.Config)
+}
+
+// Maintain runs one round over the pinned connectors: idle drivers past
+// the maximum idle time, or whose ping fails, are closed, and each
+// connector is topped up to the pool size. Drivers of connectors no longer
+// pinned are closed. opts supplies the connect timeout, keyring and secret
+// resolver.
+func (p *WarmPool) Maintain(ctx context.Context, pinned []Connector, opts ExecuteOptions) {
+	if p == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, warmPoolRoundTimeout)
+	defer cancel()
+
+	keep := make(map[string]bool, len(pinned))
+	for _, c := range pinned {
+		keep[c.ID] = true
+	}
+	p.mu.Lock()
+	var dropped []*warmDriver
+	for id, idle := range p.idle {
+		if !keep[id] {
+			dropped = append(dropped, idle...)
+			delete(p.idle, id)
+		}
+	}
+	p.mu.Unlock()
+	for _, w := range dropped {
+		w.drv.Close()
+	}
+
+	var wg sync.WaitGroup
+	for i := range pinned {
+		wg.Add(1)
+		go func(connector *Connector) {
+			defer wg.Done()
+			defer func() { Recovered(recover(), "warm-up of connector "+connector.ID) }()
+			p.maintain(ctx, connector, opts)
+		}(&pinned[i])
+	}
+	wg.Wait()
+}
+
+// maintain checks a connector's idle drivers and tops them up
+func (p *WarmPool) maintain(ctx context.Context, connector *Connector, opts ExecuteOptions) {
+	p.mu.Lock()
+	idle := p.idle[connector.ID]
+	delete(p.idle, connector.ID)
+	p.mu.Unlock()
+
+	var healthy []*warmDriver
+	for _, w := range idle {
+		if !w.connector.sameVersion(connector) || time.Since(w.since) > p.maxIdle || ping(ctx, w.drv) != nil {
+			w.drv.Close()
+			continue
+		}
+		healthy = append(healthy, w)
+	}
+
+	for len(healthy) < p.size {
+		drv, err := connect(ctx, connector, opts)
+		if err != nil {
+			log.Printf("Failed to warm up connector %s: %v", connector.ID, err)
+			break
+		}
+		healthy = append(healthy, &warmDriver{drv: drv, connector: *connector, since: time.Now()})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		for _, w := range healthy {
+			w.drv.Close()
+		}
+		return
+	}
+	p.idle[connector.ID] = healthy
+}
+
+// ping checks a driver's connection is alive with its ping, or SELECT 1 on
+// engines without one
+func ping(ctx context.Context, drv driver.Driver) error {
+	if p, ok := drv.(driver.Pinger); ok {
+		if err := p.Ping(ctx); err != nil {
+			return fmt.Errorf("ping: %w", err)
+		}
+		return nil
+	}
+	result, err := drv.Query(ctx, "SELECT 1")
+	if err != nil {
+		return fmt.Errorf("execute query: %w", err)
+	}
+	if result.Stream != nil {
+		if err := result.Stream(func(columns []string, row []interface{}) error { return nil }); err != nil {
+			return fmt.Errorf("read result: %w", err)
+		}
+	}
+	return nil
+}
+
+// Idle returns the number of idle drivers of each pinned connector
+func (p *WarmPool) Idle() map[string]int {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := make(map[string]int, len(p.idle))
+	for id, idle := range p.idle {
+		counts[id] = len(idle)
+	}
+	return counts
+}
+
+// Close closes every idle driver; drivers connected by a round still
+// running are closed as it ends
+func (p *WarmPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = make(map[string][]*warmDriver)
+	p.mu.Unlock()
+	for _, ws := range idle {
+		for _, w := range ws {
+			w.drv.Close()
+		}
+	}
+}
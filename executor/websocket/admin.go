@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// Reason given to clients whose stream an operator killed
+const adminCancelReason = "cancelled by an operator"
+
+// ExecutionSnapshot is a queued or running stream and the connection and
+// caller it belongs to
+type ExecutionSnapshot struct {
+	ConnectionID   string `json:"connectionId"`
+	RemoteAddr     string `json:"remoteAddr"`
+	UserID         string `json:"userId,omitempty"`
+	APIKeyID       string `json:"apiKeyId,omitempty"`
+	OrganizationID string `json:"organizationId,omitempty"`
+	StreamSnapshot
+}
+
+// handleAdminConnections lists live connections and their streams for
+// GET /admin/connections
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Snapshot().Connections)
+}
+
+// handleAdminExecutions lists every queued and running stream, longest
+// running first, for GET /admin/executions
+func (s *Server) handleAdminExecutions(w http.ResponseWriter, r *http.Request) {
+	executions := []ExecutionSnapshot{}
+	for _, cs := range s.Snapshot().Connections {
+		for _, ss := range cs.Streams {
+			executions = append(executions, ExecutionSnapshot{
+				ConnectionID:   cs.ID,
+				RemoteAddr:     cs.RemoteAddr,
+				UserID:         cs.UserID,
+				APIKeyID:       cs.APIKeyID,
+				OrganizationID: cs.OrganizationID,
+				StreamSnapshot: ss,
+			})
+		}
+	}
+	sort.SliceStable(executions, func(i, j int) bool { return executions[i].RuntimeMS > executions[j].RuntimeMS })
+	writeJSON(w, http.StatusOK, executions)
+}
+
+// handleAdminKill cancels a queued or running stream for
+// DELETE /admin/executions/{id}, along with the duplicate requests queued
+// behind it. The client is told an operator cancelled them; a running
+// execution gets the cancel timeout to stop like any other.
+func (s *Server) handleAdminKill(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	killed := false
+	s.activeConns.Range(func(key, value interface{}) bool {
+		connState, ok := value.(*ConnectionState)
+		if !ok {
+			return true
+		}
+		connState.TasksMutex.Lock()
+		defer connState.TasksMutex.Unlock()
+		for _, task := range connState.ActiveTasks {
+			if task.ID == id {
+				task.cancelReason = adminCancelReason
+				s.cancelStream(connState, task)
+				killed = true
+				return false
+			}
+		}
+		return true
+	})
+	if !killed {
+		writeJSONError(w, http.StatusNotFound, errors.New("execution not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelledDetails describes why a task was cancelled, if anyone said; the
+// caller holds the task lock
+func cancelledDetails(task *QueryTask) map[string]interface{} {
+	if task.cancelReason == "" {
+		return nil
+	}
+	return map[string]interface{}{"reason": task.cancelReason}
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"supalytics-executor/hooks"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+// Time allowed to persist an audit entry
+const auditWriteTimeout = 10 * time.Second
+
+// recordAudit writes the outcome of an execution to the audit log, if the
+// metadata store provides one. The write happens in the background so a
+// slow audit table never holds up the worker.
+func (s *Server) recordAudit(connState *ConnectionState, task *QueryTask, err error) {
+	if s.audit == nil {
+		return
+	}
+
+	connState.TasksMutex.RLock()
+	entry := runner.AuditEntry{
+		ExecutionID:  task.ID,
+		QueryID:      task.Request.QueryID,
+		ConnectorID:  task.ConnectorID,
+		StreamID:     task.Request.StreamID,
+		ConnectionID: connState.ID,
+		RemoteAddr:   connState.RemoteAddr,
+		ParameterSet: task.Request.ParameterSet,
+		Status:       task.Status,
+		RowsSent:     task.RowsSent.Load(),
+		QueuedAt:     task.QueuedAt,
+		StartedAt:    task.ExecutedAt,
+		FinishedAt:   time.Now(),
+		BytesScanned: task.BytesScanned,
+		BytesBilled:  task.BytesBilled,
+		RenderedSQL:  task.RenderedSQL,
+		TemplateData: task.TemplateData,
+		ReplayOf:     task.Request.Replay,
+		QueryVersion: task.QueryVersion,
+		Slow:         task.slowThreshold > 0,
+	}
+	connState.TasksMutex.RUnlock()
+	if p := connState.Principal(); p != nil {
+		entry.OrganizationID, entry.UserID, entry.APIKeyID = p.OrganizationID, p.UserID, p.APIKeyID
+	}
+
+	if err != nil {
+		entry.Error = redact.Secrets(err.Error())
+		if errors.Is(err, context.Canceled) {
+			entry.Status = "cancelled"
+		}
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		defer cancel()
+		if err := s.audit.RecordExecution(ctx, entry); err != nil {
+			log.Printf("Failed to record audit entry for stream %s: %v", entry.StreamID, err)
+		}
+	}()
+}
+
+// fireEvent notifies lifecycle hooks about a task
+func (s *Server) fireEvent(connState *ConnectionState, task *QueryTask, typ hooks.EventType, err error) {
+	now := time.Now()
+
+	connState.TasksMutex.RLock()
+	event := hooks.Event{
+		Type:         typ,
+		Time:         now,
+		StreamID:     task.Request.StreamID,
+		QueryID:      task.Request.QueryID,
+		ConnectorID:  task.ConnectorID,
+		ConnectionID: connState.ID,
+		ParameterSet: task.Request.ParameterSet,
+		RowsSent:     task.RowsSent.Load(),
+		QueuedAt:     task.QueuedAt,
+		StartedAt:    task.ExecutedAt,
+	}
+	if typ == hooks.EventSlow {
+		event.DurationMS, event.ThresholdMS = task.runTime.Milliseconds(), task.slowThreshold.Milliseconds()
+	}
+	connState.TasksMutex.RUnlock()
+
+	switch typ {
+	case hooks.EventCompleted, hooks.EventFailed, hooks.EventCancelled:
+		event.DurationMS = now.Sub(event.QueuedAt).Milliseconds()
+	}
+	if err != nil {
+		event.Error = redact.Secrets(err.Error())
+	}
+	s.hooks.Fire(event)
+}
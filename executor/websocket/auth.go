@@ -0,0 +1,528 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Audience Supabase issues user access tokens for, unless configured
+	// with audience
+	defaultAuthAudience = "authenticated"
+
+	// Claim holding the caller's organization, unless configured with
+	// organization_claim
+	defaultOrganizationClaim = "organization_id"
+
+	// Time a connection opened without a token has to send an auth message,
+	// unless configured with timeout
+	defaultAuthTimeout = 10 * time.Second
+
+	// Minimum time between JWKS fetches, so tokens with unknown key IDs
+	// cannot make the server hammer the key endpoint
+	jwksRefreshInterval = time.Minute
+)
+
+// errUnauthenticated is reported when a request carries no token
+var errUnauthenticated = errors.New("authentication required")
+
+// AuthConfig configures Supabase JWT authentication. Tokens are verified
+// with the project's JWT secret (HS256), its JWKS endpoint (asymmetric
+// signing keys) or both. Machine clients may use API keys instead.
+type AuthConfig struct {
+	// JWTSecret is the project's JWT secret for HS256 tokens
+	JWTSecret string `toml:"jwt_secret"`
+	// JWKSURL serves the project's public signing keys, e.g.
+	// https://<ref>.supabase.co/auth/v1/.well-known/jwks.json
+	JWKSURL string `toml:"jwks_url"`
+	// Audience tokens must be issued for (default "authenticated")
+	Audience string `toml:"audience"`
+	// Issuer tokens must be issued by; any issuer when empty
+	Issuer string `toml:"issuer"`
+	// OrganizationClaim names the claim holding the caller's organization,
+	// looked up at the top level and then in app_metadata (default
+	// "organization_id")
+	OrganizationClaim string `toml:"organization_claim"`
+	// Timeout is how long a connection opened without a token has to send
+	// an auth message (default 10s)
+	Timeout time.Duration `toml:"timeout"`
+	// APIKeys accepts API keys from the metadata store's api_keys table
+	APIKeys bool `toml:"api_keys"`
+}
+
+// Enabled reports whether callers can be authenticated
+func (c AuthConfig) Enabled() bool {
+	return c.JWTSecret != "" || c.JWKSURL != "" || c.APIKeys
+}
+
+// Principal is the caller an access token or API key identifies
+type Principal struct {
+	UserID         string `json:"userId,omitempty"`
+	Email          string `json:"email,omitempty"`
+	Role           string `json:"role,omitempty"`
+	OrganizationID string `json:"organizationId,omitempty"`
+	// APIKeyID is set for callers using an API key, which may be limited
+	// to QueryIDs
+	APIKeyID string   `json:"apiKeyId,omitempty"`
+	QueryIDs []string `json:"queryIds,omitempty"`
+	// ExpiresAt is zero for API keys without an expiry
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Claims are the access token's verified claims, except user_metadata
+	// which users can edit themselves
+	Claims map[string]interface{} `json:"-"`
+}
+
+// identity names the user or API key behind the principal
+func (p *Principal) identity() string {
+	if p.APIKeyID != "" {
+		return "apikey:" + p.APIKeyID
+	}
+	return p.UserID
+}
+
+// caller is the runner caller for the principal; executions without a
+// principal are not restricted to an organization
+func (p *Principal) caller() *runner.Caller {
+	if p == nil {
+		return nil
+	}
+	return &runner.Caller{
+		UserID:         p.UserID,
+		OrganizationID: p.OrganizationID,
+		QueryIDs:       p.QueryIDs,
+		Email:          p.Email,
+		Role:           p.Role,
+		APIKeyID:       p.APIKeyID,
+		Claims:         p.Claims,
+	}
+}
+
+// organizationOf returns the principal's organization, if any
+func organizationOf(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.OrganizationID
+}
+
+// scopeOf identifies the principal's query scope: the API key limiting it
+// to some queries, if any
+func scopeOf(p *Principal) string {
+	if p == nil || len(p.QueryIDs) == 0 {
+		return ""
+	}
+	return p.APIKeyID
+}
+
+// Principal returns the connection's authenticated caller, or nil when
+// authentication is disabled
+func (c *ConnectionState) Principal() *Principal {
+	return c.principal.Load()
+}
+
+// authenticator verifies access tokens
+type authenticator struct {
+	cfg    AuthConfig
+	secret []byte
+	jwks   *jwksCache
+	parser *jwt.Parser
+	// keys resolves API keys; nil when they are not accepted
+	keys runner.APIKeyStore
+}
+
+func newAuthenticator(cfg AuthConfig, store runner.MetadataStore) *authenticator {
+	if cfg.Audience == "" {
+		cfg.Audience = defaultAuthAudience
+	}
+	if cfg.OrganizationClaim == "" {
+		cfg.OrganizationClaim = defaultOrganizationClaim
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultAuthTimeout
+	}
+
+	a := &authenticator{cfg: cfg}
+	if keys, ok := store.(runner.APIKeyStore); ok && cfg.APIKeys {
+		a.keys = keys
+	}
+	var methods []string
+	if cfg.JWTSecret != "" {
+		a.secret = []byte(cfg.JWTSecret)
+		methods = append(methods, "HS256")
+	}
+	if cfg.JWKSURL != "" {
+		a.jwks = &jwksCache{url: cfg.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+		methods = append(methods, "RS256", "ES256", "ES384")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithAudience(cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(5 * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	a.parser = jwt.NewParser(opts...)
+	return a
+}
+
+// verify checks an access token's signature and claims, or looks up an API
+// key, and returns its caller
+func (a *authenticator) verify(ctx context.Context, token string) (*Principal, error) {
+	if strings.HasPrefix(token, runner.APIKeyPrefix) {
+		return a.verifyAPIKey(ctx, token)
+	}
+	if a.secret == nil && a.jwks == nil {
+		return nil, errors.New("invalid token: only API keys are accepted")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return a.secret, nil
+		}
+		if a.jwks == nil {
+			return nil, fmt.Errorf("no key for %s tokens", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.jwks.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+
+	p := &Principal{}
+	p.UserID, _ = claims.GetSubject()
+	if p.UserID == "" {
+		return nil, errors.New("invalid token: no subject")
+	}
+	p.Email, _ = claims["email"].(string)
+	p.Role, _ = claims["role"].(string)
+	p.OrganizationID = organizationClaim(claims, a.cfg.OrganizationClaim)
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		p.ExpiresAt = exp.Time
+	}
+	p.Claims = make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		if k != "user_metadata" {
+			p.Claims[k] = v
+		}
+	}
+	return p, nil
+}
+
+// verifyAPIKey looks up an API key and returns its caller
+func (a *authenticator) verifyAPIKey(ctx context.Context, key string) (*Principal, error) {
+	if a.keys == nil {
+		return nil, errors.New("invalid token: API keys are not accepted")
+	}
+	k, err := a.keys.FetchAPIKey(ctx, runner.HashAPIKey(key))
+	if errors.Is(err, runner.ErrAPIKeyNotFound) {
+		return nil, errors.New("invalid API key")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("look up API key: %w", err)
+	}
+	if !k.Active(time.Now()) {
+		return nil, errors.New("API key expired or revoked")
+	}
+
+	p := &Principal{
+		OrganizationID: k.OrganizationID,
+		APIKeyID:       k.ID,
+		QueryIDs:       k.QueryIDs,
+	}
+	if k.ExpiresAt != nil {
+		p.ExpiresAt = *k.ExpiresAt
+	}
+	return p, nil
+}
+
+// organizationClaim reads the organization from a top-level claim, falling
+// back to app_metadata where Supabase keeps claims users cannot edit
+func organizationClaim(claims jwt.MapClaims, name string) string {
+	if org, ok := claims[name].(string); ok {
+		return org
+	}
+	if meta, ok := claims["app_metadata"].(map[string]interface{}); ok {
+		org, _ := meta[name].(string)
+		return org
+	}
+	return ""
+}
+
+// requestToken returns the access token or API key of an HTTP request,
+// from its Authorization bearer token or X-API-Key header or, for clients
+// that cannot set headers such as browsers opening a WebSocket, the
+// access_token or api_key query parameter
+func requestToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	params := r.URL.Query()
+	if token := params.Get("access_token"); token != "" {
+		return token
+	}
+	return params.Get("api_key")
+}
+
+// authenticateConn authenticates a new connection with the token in its
+// handshake or, failing that, the auth message it must send first. It
+// reports whether the token came in a message, which is acknowledged.
+func (s *Server) authenticateConn(r *http.Request, connState *ConnectionState) (*Principal, bool, error) {
+	if token := requestToken(r); token != "" {
+		p, err := s.auth.verify(r.Context(), token)
+		return p, false, err
+	}
+
+	conn := connState.Conn
+	conn.SetReadDeadline(time.Now().Add(s.auth.cfg.Timeout))
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, true, errUnauthenticated
+	}
+	var msg protocol.ClientMessage
+	if err := decodeClientMessage(connState, frameType, data, &msg); err != nil || msg.Type != MessageTypeAuth || msg.Token == "" {
+		return nil, true, errUnauthenticated
+	}
+	p, err := s.auth.verify(r.Context(), msg.Token)
+	return p, true, err
+}
+
+// reauthenticate replaces a connection's token. The new token must belong
+// to the same user or API key so a connection cannot change hands.
+func (s *Server) reauthenticate(connState *ConnectionState, token string) (*Principal, error) {
+	p, err := s.auth.verify(context.Background(), token)
+	if err != nil {
+		return nil, err
+	}
+	if current := connState.Principal(); current != nil && current.identity() != p.identity() {
+		return nil, errors.New("token belongs to a different caller")
+	}
+	connState.principal.Store(p)
+	return p, nil
+}
+
+// sendAuth acknowledges a token received in an auth message
+func (s *Server) sendAuth(connState *ConnectionState, p *Principal) {
+	payload := map[string]interface{}{
+		"userId":         p.UserID,
+		"organizationId": p.OrganizationID,
+	}
+	if p.APIKeyID != "" {
+		payload["apiKeyId"] = p.APIKeyID
+	}
+	if !p.ExpiresAt.IsZero() {
+		payload["expiresAt"] = p.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	s.sendMessage(connState.Conn, WSMessage{Type: MessageTypeAuth, Payload: payload}, connState)
+}
+
+// tokenExpiry closes a connection when its credentials expire
+type tokenExpiry struct {
+	conn  *websocket.Conn
+	timer *time.Timer
+}
+
+// schedule closes the connection at expiresAt, replacing any earlier
+// deadline; credentials that never expire clear it
+func (e *tokenExpiry) schedule(expiresAt time.Time) {
+	e.stop()
+	if expiresAt.IsZero() {
+		return
+	}
+	e.timer = time.AfterFunc(time.Until(expiresAt), func() {
+		closeUnauthorized(e.conn, "token expired")
+	})
+}
+
+func (e *tokenExpiry) stop() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
+
+// closeUnauthorized ends a connection with the unauthorized close code.
+// WriteControl may be called alongside the connection's writer.
+func closeUnauthorized(conn *websocket.Conn, reason string) {
+	// Control frames carry at most 123 bytes of reason
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(protocol.CloseUnauthorized, reason),
+		time.Now().Add(writeWait))
+	conn.Close()
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller of an authenticated HTTP request
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// requireAuth rejects HTTP requests without a valid access token when
+// authentication is enabled, passing the caller on in the request context
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			next(w, r)
+			return
+		}
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errUnauthenticated)
+			return
+		}
+		p, err := s.auth.verify(r.Context(), token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// jwksCache holds the public keys served by a JWKS endpoint, fetching them
+// again when a token names a key it does not know
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.fetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refresh fetches the key set; the caller holds c.mu
+func (c *jwksCache) refresh(ctx context.Context) error {
+	c.fetched = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		// Keys of unsupported types are skipped rather than failing the set
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	c.keys = keys
+	return nil
+}
+
+// jsonWebKey is an RSA or elliptic curve public key in JWK form
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode key: %w", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"supalytics-executor/runner"
+)
+
+// errCancelTimedOut reports a cancelled execution whose driver did not stop
+// within the cancel deadline and had to be closed
+var errCancelTimedOut = fmt.Errorf("cancel timed out: %w", context.Canceled)
+
+// runTask executes a task, bounding how long a cancelled execution may keep
+// the worker. Once the task is cancelled, or reaches its deadline, the
+// driver has the cancel timeout to stop; after that its connection is
+// closed and the worker moves on while the abandoned execution unwinds in
+// the background.
+func (s *Server) runTask(connState *ConnectionState, task *QueryTask) error {
+	ctx, cancel := s.withDeadline(task)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer runner.CatchPanic(&err, "stream "+task.Request.StreamID)
+		err = s.executeQuery(ctx, task.Request.StreamID, connState, task)
+	}()
+
+	select {
+	case err := <-done:
+		return taskError(ctx, task, err)
+	case <-ctx.Done():
+	}
+	if expired(ctx, task) != nil {
+		s.cancelOnEngine(connState, task)
+	}
+
+	timer := time.NewTimer(s.cancelTimeout())
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return taskError(ctx, task, err)
+	case <-timer.C:
+	}
+
+	log.Printf("Stream %s did not stop within %s of being cancelled, closing its driver", task.Request.StreamID, s.cancelTimeout())
+	connState.TasksMutex.Lock()
+	closer := task.closer
+	connState.TasksMutex.Unlock()
+	if closer != nil {
+		go closer.Close()
+	}
+	if timeout := expired(ctx, task); timeout != nil {
+		return timeout
+	}
+	return errCancelTimedOut
+}
+
+// taskError reports an execution that failed once it reached its deadline
+// as a timeout, whatever error the driver surfaced, and one that ended
+// because its task was cancelled as a cancellation
+func taskError(ctx context.Context, task *QueryTask, err error) error {
+	if timeout := expired(ctx, task); timeout != nil && err != nil {
+		return timeout
+	}
+	return cancelledError(task, err)
+}
+
+// cancelledError reports an execution that ended because its task was
+// cancelled as a cancellation, whatever error the driver surfaced
+func cancelledError(task *QueryTask, err error) error {
+	if err != nil && task.Context.Err() != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %v", context.Canceled, err)
+	}
+	return err
+}
+
+// setTaskCloser records how to release a task's driver if its cancellation
+// has to be forced
+func (s *Server) setTaskCloser(connState *ConnectionState, task *QueryTask, closer io.Closer) {
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	task.closer = closer
+}
+
+func (s *Server) cancelTimeout() time.Duration {
+	if s.config.CancelTimeout > 0 {
+		return s.config.CancelTimeout
+	}
+	return defaultCancelTimeout
+}
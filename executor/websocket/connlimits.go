@@ -0,0 +1,161 @@
+package websocket
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionLimits bound the WebSocket connections the server holds, so a
+// storm of connections cannot exhaust it; zero leaves a limit off
+type ConnectionLimits struct {
+	// MaxConnections bounds the connections across all clients; further
+	// upgrades are refused with 503
+	MaxConnections int `toml:"max_connections"`
+	// PerIP bounds the connections from one client address; further
+	// upgrades are refused with 429
+	PerIP int `toml:"per_ip"`
+	// PerOrganization bounds an authenticated organization's connections.
+	// The organization is only known once the connection authenticates, so
+	// further connections are closed with code 4429 rather than refused.
+	PerOrganization int `toml:"per_organization"`
+	// TrustProxy takes the client address from the first X-Forwarded-For
+	// entry, for servers behind a load balancer
+	TrustProxy bool `toml:"trust_proxy"`
+}
+
+// ConnectionRejections counts the connections refused by each limit since
+// the server started
+type ConnectionRejections struct {
+	Server       int64 `json:"server"`
+	IP           int64 `json:"ip"`
+	Organization int64 `json:"organization"`
+}
+
+// Total is the number of connections refused by any limit
+func (r ConnectionRejections) Total() int64 {
+	return r.Server + r.IP + r.Organization
+}
+
+// connectionLimiter counts open connections against the limits
+type connectionLimiter struct {
+	mu       sync.Mutex
+	limits   ConnectionLimits
+	total    int
+	byIP     map[string]int
+	byOrg    map[string]int
+	rejected ConnectionRejections
+}
+
+func newConnectionLimiter(limits ConnectionLimits) *connectionLimiter {
+	return &connectionLimiter{limits: limits, byIP: make(map[string]int), byOrg: make(map[string]int)}
+}
+
+// configure replaces the limits. Connections over a lower limit stay open.
+func (l *connectionLimiter) configure(limits ConnectionLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// clientIP returns the address a request comes from
+func (l *connectionLimiter) clientIP(r *http.Request) string {
+	l.mu.Lock()
+	trustProxy := l.limits.TrustProxy
+	l.mu.Unlock()
+	if trustProxy {
+		if first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ","); strings.TrimSpace(first) != "" {
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit counts a connection from ip, returning its release, or the status
+// and reason to refuse it with
+func (l *connectionLimiter) admit(ip string) (func(), int, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		l.rejected.Server++
+		return nil, http.StatusServiceUnavailable, fmt.Sprintf("server allows %d connections", l.limits.MaxConnections)
+	}
+	if l.limits.PerIP > 0 && l.byIP[ip] >= l.limits.PerIP {
+		l.rejected.IP++
+		return nil, http.StatusTooManyRequests, fmt.Sprintf("%d connections allowed per client address", l.limits.PerIP)
+	}
+	l.total++
+	l.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.byIP[ip]--; l.byIP[ip] <= 0 {
+				delete(l.byIP, ip)
+			}
+		})
+	}, 0, ""
+}
+
+// admitOrganization counts an authenticated connection of org, returning
+// its release, or the reason to close it
+func (l *connectionLimiter) admitOrganization(org string) (func(), string) {
+	if org == "" {
+		return func() {}, ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.PerOrganization > 0 && l.byOrg[org] >= l.limits.PerOrganization {
+		l.rejected.Organization++
+		return nil, fmt.Sprintf("organization allows %d connections", l.limits.PerOrganization)
+	}
+	l.byOrg[org]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.byOrg[org]--; l.byOrg[org] <= 0 {
+				delete(l.byOrg, org)
+			}
+		})
+	}, ""
+}
+
+func (l *connectionLimiter) rejections() ConnectionRejections {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected
+}
+
+// rejectConnection refuses a WebSocket upgrade over a connection limit
+func rejectConnection(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	log.Printf("Refusing connection from %s: %s", r.RemoteAddr, reason)
+	w.Header().Set("Retry-After", "1")
+	writeJSONError(w, status, fmt.Errorf("too many connections: %s", reason))
+}
+
+// closeTooManyConnections ends an authenticated connection over its
+// organization's limit
+func closeTooManyConnections(conn *websocket.Conn, reason string) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(protocol.CloseTooManyConnections, reason),
+		time.Now().Add(writeWait))
+	conn.Close()
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// creditGate meters the rows a flow-controlled stream may send. The client
+// grants credits, one per row, and the stream pauses its driver once they
+// run out.
+type creditGate struct {
+	mu        sync.Mutex
+	available int64
+	granted   chan struct{} // closed and replaced on every grant
+}
+
+func newCreditGate(initial int64) *creditGate {
+	return &creditGate{available: initial, granted: make(chan struct{})}
+}
+
+// acquire takes one credit, waiting for a grant while none are available
+func (g *creditGate) acquire(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		if g.available > 0 {
+			g.available--
+			g.mu.Unlock()
+			return nil
+		}
+		granted := g.granted
+		g.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-granted:
+		}
+	}
+}
+
+// grant adds credits and wakes a paused stream
+func (g *creditGate) grant(n int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.available += n
+	close(g.granted)
+	g.granted = make(chan struct{})
+}
+
+// remaining returns the credits not yet used
+func (g *creditGate) remaining() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.available
+}
+
+// handleCreditRequest grants a flow-controlled stream more rows
+func (s *Server) handleCreditRequest(connState *ConnectionState, streamID string, credits int64) error {
+	if streamID == "" {
+		return errors.New("streamId is required")
+	}
+	if credits <= 0 {
+		return fmt.Errorf("credits must be positive, got %d", credits)
+	}
+
+	// Credit racing the end of its stream is expected and ignored
+	connState.TasksMutex.RLock()
+	task, ok := connState.ActiveTasks[streamID]
+	connState.TasksMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	if task.credits == nil {
+		return fmt.Errorf("stream %s was not started with flow control", streamID)
+	}
+
+	task.credits.grant(credits)
+	return nil
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"supalytics-executor/driver"
+)
+
+// executionTimeoutError ends an execution still running at its deadline
+type executionTimeoutError struct {
+	limit time.Duration
+}
+
+func (e *executionTimeoutError) Error() string {
+	return fmt.Sprintf("execution exceeded its %s deadline", e.limit)
+}
+
+func (e *executionTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// executionTimeout returns the deadline of a request's execution, its own
+// timeoutMs or the server's execution timeout, or zero for none
+func (s *Server) executionTimeout(req *QueryRequest) time.Duration {
+	if req.TimeoutMS > 0 {
+		return time.Duration(req.TimeoutMS) * time.Millisecond
+	}
+	return s.config.ExecutionTimeout
+}
+
+// checkExecutionTimeout rejects a timeoutMs over the server's maximum
+func (s *Server) checkExecutionTimeout(req *QueryRequest) error {
+	limit := s.config.MaxExecutionTimeout
+	if limit <= 0 {
+		limit = s.config.ExecutionTimeout
+	}
+	if limit > 0 && time.Duration(req.TimeoutMS)*time.Millisecond > limit {
+		return fmt.Errorf("timeoutMs %d exceeds the maximum of %d", req.TimeoutMS, limit.Milliseconds())
+	}
+	return nil
+}
+
+// withDeadline derives the context a task executes under, ended with an
+// *executionTimeoutError cause at the task's deadline
+func (s *Server) withDeadline(task *QueryTask) (context.Context, context.CancelFunc) {
+	limit := s.executionTimeout(task.Request)
+	if limit <= 0 {
+		return context.WithCancel(task.Context)
+	}
+	return context.WithTimeoutCause(task.Context, limit, &executionTimeoutError{limit: limit})
+}
+
+// expired returns why a task's execution context ended when it reached its
+// deadline, or nil when it has not or the task was cancelled first
+func expired(ctx context.Context, task *QueryTask) *executionTimeoutError {
+	var timeout *executionTimeoutError
+	if task.Context.Err() == nil && errors.As(context.Cause(ctx), &timeout) {
+		return timeout
+	}
+	return nil
+}
+
+// setTaskCanceller records how to stop a task's query on its engine
+func (s *Server) setTaskCanceller(connState *ConnectionState, task *QueryTask, canceller driver.Canceller) {
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	task.canceller = canceller
+}
+
+// cancelOnEngine asks the engine of a task that ran past its deadline to
+// stop its query, which engines that execute server-side would otherwise
+// run to the end after the worker has given up on it
+func (s *Server) cancelOnEngine(connState *ConnectionState, task *QueryTask) {
+	connState.TasksMutex.RLock()
+	canceller := task.canceller
+	connState.TasksMutex.RUnlock()
+	if canceller == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cancelTimeout())
+		defer cancel()
+		if err := canceller.Cancel(ctx); err != nil {
+			log.Printf("Failed to cancel stream %s on its engine: %v", task.Request.StreamID, err)
+		}
+	}()
+}
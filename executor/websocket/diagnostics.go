@@ -0,0 +1,222 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"supalytics-executor/runner"
+)
+
+// Profile label carrying the ID of the connection a goroutine serves
+const connectionLabel = "connection"
+
+// Diagnostics is the runtime state operators need to chase memory and
+// goroutine leaks in the worker and stream pipeline
+type Diagnostics struct {
+	GeneratedAt time.Time               `json:"generatedAt"`
+	Runtime     RuntimeStats            `json:"runtime"`
+	Connections []ConnectionDiagnostics `json:"connections"`
+	// OtherGoroutines were not started for a connection: listeners, HTTP
+	// requests and background work
+	OtherGoroutines int           `json:"otherGoroutines"`
+	Pipeline        PipelineStats `json:"pipeline"`
+	Caches          CacheStats    `json:"caches"`
+}
+
+// RuntimeStats are process-wide Go runtime figures
+type RuntimeStats struct {
+	GoVersion    string    `json:"goVersion"`
+	GOMAXPROCS   int       `json:"gomaxprocs"`
+	NumCPU       int       `json:"numCpu"`
+	Goroutines   int       `json:"goroutines"`
+	HeapAlloc    uint64    `json:"heapAlloc"`
+	HeapInuse    uint64    `json:"heapInuse"`
+	HeapObjects  uint64    `json:"heapObjects"`
+	StackInuse   uint64    `json:"stackInuse"`
+	Sys          uint64    `json:"sys"`
+	NumGC        uint32    `json:"numGc"`
+	LastGC       time.Time `json:"lastGc,omitempty"`
+	GCPauseTotal string    `json:"gcPauseTotal"`
+}
+
+// ConnectionDiagnostics are the goroutines and buffers held by a connection
+type ConnectionDiagnostics struct {
+	ID             string    `json:"id"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	OrganizationID string    `json:"organizationId,omitempty"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	Goroutines     int       `json:"goroutines"`
+	Workers        int       `json:"workers"`
+	ActiveTasks    int       `json:"activeTasks"`
+	QueueDepth     int       `json:"queueDepth"`
+	QueueCapacity  int       `json:"queueCapacity"`
+	SendQueued     int       `json:"sendQueued"`
+	SendCapacity   int       `json:"sendCapacity"`
+	// OpenSequences are streams still numbering messages; one outliving
+	// its stream is a leak
+	OpenSequences int `json:"openSequences"`
+}
+
+// PipelineStats count the work in flight outside any one connection
+type PipelineStats struct {
+	QueuedStreams  int   `json:"queuedStreams"`
+	RunningStreams int   `json:"runningStreams"`
+	SharedFlights  int   `json:"sharedFlights"`
+	RESTRunning    int   `json:"restRunning"`
+	RESTRetained   int   `json:"restRetained"`
+	JobsRunning    int64 `json:"jobsRunning"`
+}
+
+// CacheStats are the entries held by each cache
+type CacheStats struct {
+	// ResultCache is unset when the cache is off or held in Redis
+	ResultCache   *int `json:"resultCache,omitempty"`
+	MetadataCache int  `json:"metadataCache"`
+	// Store counts the copies kept to ride out a metadata outage
+	Store *runner.CachedMetadata `json:"store,omitempty"`
+}
+
+// labelConnection tags the calling goroutine, and the goroutines it starts,
+// with the connection they serve, returning a context carrying the label
+// for goroutines started elsewhere
+func labelConnection(ctx context.Context, connID string) context.Context {
+	ctx = pprof.WithLabels(ctx, pprof.Labels(connectionLabel, connID))
+	pprof.SetGoroutineLabels(ctx)
+	return ctx
+}
+
+// goroutinesByConnection counts the live goroutines labelled with each
+// connection
+func goroutinesByConnection() (map[string]int, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil, err
+	}
+
+	// Each record opens with "<count> @ <pcs>", followed by its labels
+	counts := make(map[string]int)
+	n := 0
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if count, _, ok := strings.Cut(line, " @ "); ok {
+			n, _ = strconv.Atoi(count)
+			continue
+		}
+		if labels, ok := strings.CutPrefix(line, "# labels: "); ok {
+			var set map[string]string
+			if json.Unmarshal([]byte(labels), &set) == nil && set[connectionLabel] != "" {
+				counts[set[connectionLabel]] += n
+			}
+		}
+	}
+	return counts, scanner.Err()
+}
+
+// Diagnostics captures runtime, per-connection, pipeline and cache figures
+func (s *Server) Diagnostics() Diagnostics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	diag := Diagnostics{
+		GeneratedAt: time.Now(),
+		Runtime: RuntimeStats{
+			GoVersion:    runtime.Version(),
+			GOMAXPROCS:   runtime.GOMAXPROCS(0),
+			NumCPU:       runtime.NumCPU(),
+			Goroutines:   runtime.NumGoroutine(),
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapObjects:  mem.HeapObjects,
+			StackInuse:   mem.StackInuse,
+			Sys:          mem.Sys,
+			NumGC:        mem.NumGC,
+			GCPauseTotal: time.Duration(mem.PauseTotalNs).String(),
+		},
+		Connections: []ConnectionDiagnostics{},
+	}
+	if mem.LastGC > 0 {
+		diag.Runtime.LastGC = time.Unix(0, int64(mem.LastGC))
+	}
+
+	goroutines, err := goroutinesByConnection()
+	if err != nil {
+		log.Printf("Count goroutines by connection: %v", err)
+	}
+	attributed := 0
+	s.eachConnection(func(connState *ConnectionState) {
+		cd := ConnectionDiagnostics{
+			ID:            connState.ID,
+			RemoteAddr:    connState.RemoteAddr,
+			ConnectedAt:   connState.ConnectedAt,
+			Goroutines:    goroutines[connState.ID],
+			QueueDepth:    connState.QueryQueue.len(),
+			QueueCapacity: connState.QueryQueue.limit(),
+			SendQueued:    len(connState.send),
+			SendCapacity:  cap(connState.send),
+		}
+		if p := connState.Principal(); p != nil {
+			cd.OrganizationID = p.OrganizationID
+		}
+		attributed += cd.Goroutines
+
+		connState.TasksMutex.RLock()
+		cd.Workers = connState.QueueWorkers
+		cd.ActiveTasks = len(connState.ActiveTasks)
+		for _, task := range connState.ActiveTasks {
+			if task.Status == "running" {
+				diag.Pipeline.RunningStreams++
+			} else {
+				diag.Pipeline.QueuedStreams++
+			}
+		}
+		connState.TasksMutex.RUnlock()
+
+		connState.seqMu.Lock()
+		cd.OpenSequences = len(connState.seqs)
+		connState.seqMu.Unlock()
+
+		diag.Connections = append(diag.Connections, cd)
+	})
+	sort.Slice(diag.Connections, func(i, j int) bool {
+		return diag.Connections[i].ConnectedAt.Before(diag.Connections[j].ConnectedAt)
+	})
+	diag.OtherGoroutines = diag.Runtime.Goroutines - attributed
+
+	s.flightsMu.Lock()
+	diag.Pipeline.SharedFlights = len(s.flights)
+	s.flightsMu.Unlock()
+	diag.Pipeline.RESTRunning = len(s.rest.slots)
+	diag.Pipeline.RESTRetained = s.rest.len()
+	if s.jobs != nil {
+		diag.Pipeline.JobsRunning = s.jobs.running.Load()
+	}
+
+	if s.resultCache != nil {
+		if n, ok := s.resultCache.Len(); ok {
+			diag.Caches.ResultCache = &n
+		}
+	}
+	diag.Caches.MetadataCache = s.metadataCache.Len()
+	if store, ok := s.store.(*runner.CachingStore); ok {
+		cached := store.Cached()
+		diag.Caches.Store = &cached
+	}
+	return diag
+}
+
+// handleAdminDiagnostics serves GET /admin/diagnostics
+func (s *Server) handleAdminDiagnostics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, s.Diagnostics())
+}
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// errServerShuttingDown rejects work that arrives while the server drains
+var errServerShuttingDown = errors.New("server is shutting down")
+
+// Reason given to clients whose streams outlived the drain timeout
+const shutdownCancelReason = "server shutting down"
+
+// drainPollInterval is how often a draining server checks whether its
+// executions have finished
+const drainPollInterval = 50 * time.Millisecond
+
+// Draining reports whether the server has stopped accepting new work
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// Drain stops the server accepting connections and queries, tells every
+// connected client with a server_shutdown status so it can reconnect to
+// another replica, and waits for the executions in flight to finish. Those
+// still running when ctx ends are cancelled. Every connection is then
+// closed as going away.
+func (s *Server) Drain(ctx context.Context) error {
+	s.draining.Store(true)
+
+	details := map[string]interface{}{}
+	if deadline, ok := ctx.Deadline(); ok {
+		details["drainTimeoutMs"] = time.Until(deadline).Milliseconds()
+	}
+	s.eachConnection(func(connState *ConnectionState) {
+		s.sendStatusDetails(connState.Conn, "", protocol.StatusServerShutdown, details, connState)
+	})
+
+	err := s.awaitIdle(ctx)
+	if err != nil {
+		log.Printf("Drain timed out with %d executions in flight, cancelling them", s.inFlight())
+		s.eachConnection(func(connState *ConnectionState) {
+			connState.TasksMutex.Lock()
+			defer connState.TasksMutex.Unlock()
+			for _, task := range connState.ActiveTasks {
+				task.cancelReason = shutdownCancelReason
+				s.cancelStream(connState, task)
+			}
+		})
+		// Cancelled executions get the cancel timeout to report back
+		cancelCtx, cancel := context.WithTimeout(context.Background(), s.cancelTimeout())
+		s.awaitIdle(cancelCtx)
+		cancel()
+	}
+
+	s.eachConnection(func(connState *ConnectionState) {
+		// Queued frames are written before the close frame
+		connState.flushSend(writeWait)
+		connState.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownCancelReason),
+			time.Now().Add(writeWait))
+		connState.Conn.Close()
+	})
+	s.warmPool.Close()
+	return err
+}
+
+// awaitIdle waits until no execution is in flight or ctx ends
+func (s *Server) awaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.inFlight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// inFlight counts the queued and running WebSocket streams, the running
+// REST executions and the queued queries this replica's workers run
+func (s *Server) inFlight() int {
+	n := len(s.rest.slots)
+	if s.jobs != nil {
+		n += int(s.jobs.running.Load())
+	}
+	s.eachConnection(func(connState *ConnectionState) {
+		connState.TasksMutex.RLock()
+		n += len(connState.ActiveTasks)
+		connState.TasksMutex.RUnlock()
+	})
+	return n
+}
+
+// eachConnection calls fn for every open connection
+func (s *Server) eachConnection(fn func(connState *ConnectionState)) {
+	s.activeConns.Range(func(key, value interface{}) bool {
+		if connState, ok := value.(*ConnectionState); ok {
+			fn(connState)
+		}
+		return true
+	})
+}
+
+// rejectDraining answers an HTTP request with 503 while the server drains,
+// reporting whether it did
+func (s *Server) rejectDraining(w http.ResponseWriter) bool {
+	if !s.Draining() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	writeJSONError(w, http.StatusServiceUnavailable, errServerShuttingDown)
+	return true
+}
+
+func (s *Server) drainTimeout() time.Duration {
+	if s.config.DrainTimeout > 0 {
+		return s.config.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
+
+// flushSend waits up to timeout for the writer to take every queued frame
+func (c *ConnectionState) flushSend(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for len(c.send) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.writerDone:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
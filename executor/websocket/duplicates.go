@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+
+	"supalytics-executor/protocol"
+)
+
+// Reason given for an execution cancelled by a request replacing it
+const replacedCancelReason = "replaced"
+
+// errDuplicateStream rejects a request for a stream ID that is in use
+var errDuplicateStream = errors.New("duplicate stream")
+
+// duplicatePolicy returns the request's duplicate policy, falling back to
+// the server's
+func (s *Server) duplicatePolicy(req *QueryRequest) string {
+	if req.OnDuplicate != "" {
+		return req.OnDuplicate
+	}
+	if s.config.DuplicateStreamPolicy != "" {
+		return s.config.DuplicateStreamPolicy
+	}
+	return protocol.DuplicateReject
+}
+
+// followTask places a request for a stream ID that is still queued or
+// running behind the task holding it, as its duplicate policy says. The
+// request is answered with a waiting status and takes the stream ID over
+// once every task ahead of it has ended, so the client sees one execution
+// end before the next starts. The caller holds the task lock.
+func (s *Server) followTask(connState *ConnectionState, current, task *QueryTask) error {
+	streamID := task.Request.StreamID
+	policy := s.duplicatePolicy(task.Request)
+	if policy != protocol.DuplicateReplace && policy != protocol.DuplicateQueue {
+		return fmt.Errorf("%w: %s already exists", errDuplicateStream, streamID)
+	}
+
+	// Requests replaced while they waited stay in line until the task
+	// ahead ends, so the line is bounded like the queue
+	waiting := 0
+	last := current
+	for next := current.successor; next != nil; next = next.successor {
+		waiting++
+		last = next
+	}
+	if limit := max(int(s.queueCapacity.Load()), 1); waiting >= limit {
+		return fmt.Errorf("%w: %s already has %d requests waiting", errDuplicateStream, streamID, waiting)
+	}
+
+	last.successor = task
+	s.sendUnnumbered(connState, WSMessage{
+		Type:     MessageTypeStatus,
+		StreamID: streamID,
+		Payload: map[string]interface{}{
+			"status":      protocol.StatusWaiting,
+			"onDuplicate": policy,
+			"ahead":       waiting + 1,
+		},
+	})
+
+	if policy == protocol.DuplicateReplace {
+		for next := current.successor; next != task; next = next.successor {
+			if next.transition(protocol.StatusQueued, protocol.StatusCancelled) {
+				next.cancelReason = replacedCancelReason
+				next.CancelFunc()
+			}
+		}
+		if current.Status == protocol.StatusQueued || current.Status == protocol.StatusRunning {
+			current.cancelReason = replacedCancelReason
+			s.cancelTask(connState, current)
+		}
+	}
+	return nil
+}
+
+// cancelStream cancels the task holding a stream ID and the requests
+// waiting behind it, which take the task's cancel reason; the caller holds
+// the task lock
+func (s *Server) cancelStream(connState *ConnectionState, task *QueryTask) {
+	for next := task.successor; next != nil; next = next.successor {
+		if next.transition(protocol.StatusQueued, protocol.StatusCancelled) {
+			next.cancelReason = task.cancelReason
+			next.CancelFunc()
+		}
+	}
+	s.cancelTask(connState, task)
+}
@@ -0,0 +1,243 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/export"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+// handleExport runs a query and streams its result as a file download:
+//
+//	GET /export?queryId=...&format=csv|json|xlsx&templateData={...}
+//
+// parameterSet, limit and offset work as they do for WebSocket requests.
+// Failures before the first byte is written are reported with an HTTP
+// status; a failure mid-stream aborts the response so the download is
+// visibly incomplete rather than silently short.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectDraining(w) {
+		return
+	}
+
+	req, format, err := parseExportRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	caller := principalFrom(r.Context())
+	quota, releaseQuota, err := s.quotas.acquire(r.Context(), caller)
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		writeRateLimited(w, limited)
+		return
+	}
+	defer releaseQuota()
+	s.capRows(req, quota.MaxRowsPerQuery)
+
+	obs := &httpObserver{s: s, caller: caller}
+	stream, err := runner.ExecuteQuery(r.Context(), req.QueryID, req.TemplateData, s.store, s.executeOptions(req, caller, obs))
+	if err != nil {
+		s.recordHTTPOutcome("export", req, obs, err)
+		http.Error(w, redact.Message(err.Error()), executionStatus(err))
+		return
+	}
+	defer stream.Close()
+
+	filename := exportFilename(req.QueryID, obs.query, format)
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// The format was validated, so the writer always exists
+	out, _ := export.NewWriter(format, w)
+	err = stream.Stream(func(cols []string, row []interface{}) error {
+		if row == nil {
+			return out.WriteHeader(cols)
+		}
+		return out.WriteRow(row)
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	s.recordHTTPOutcome("export", req, obs, err)
+	if err != nil {
+		log.Printf("Export of query %s failed: %v", req.QueryID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// parseExportRequest reads an export's query parameters into a request
+func parseExportRequest(r *http.Request) (*QueryRequest, string, error) {
+	params := r.URL.Query()
+	req := &QueryRequest{
+		QueryID:      params.Get("queryId"),
+		StreamID:     "export",
+		ParameterSet: params.Get("parameterSet"),
+		CacheControl: params.Get("cacheControl"),
+		CacheBust:    params.Get("cacheBust") == "true",
+		Replay:       params.Get("replay"),
+		Timezone:     params.Get("timezone"),
+	}
+	if req.QueryID == "" {
+		return nil, "", errors.New("queryId is required")
+	}
+
+	format := params.Get("format")
+	if format == "" {
+		format = export.FormatCSV
+	}
+	switch format {
+	case export.FormatCSV, export.FormatJSON, export.FormatXLSX:
+	default:
+		return nil, "", fmt.Errorf("invalid format %q: want csv, json or xlsx", format)
+	}
+
+	if data := params.Get("templateData"); data != "" {
+		if err := json.Unmarshal([]byte(data), &req.TemplateData); err != nil {
+			return nil, "", fmt.Errorf("templateData must be a JSON object: %w", err)
+		}
+	}
+	if transforms := params.Get("transforms"); transforms != "" {
+		if err := json.Unmarshal([]byte(transforms), &req.Transforms); err != nil {
+			return nil, "", fmt.Errorf("transforms must be a JSON array: %w", err)
+		}
+	}
+	if sample := params.Get("sample"); sample != "" {
+		if err := json.Unmarshal([]byte(sample), &req.Sample); err != nil {
+			return nil, "", fmt.Errorf("sample must be a JSON object: %w", err)
+		}
+	}
+	if aggregates := params.Get("aggregates"); aggregates != "" {
+		if err := json.Unmarshal([]byte(aggregates), &req.Aggregates); err != nil {
+			return nil, "", fmt.Errorf("aggregates must be a JSON array: %w", err)
+		}
+	}
+	for name, dst := range map[string]*int64{"limit": &req.Limit, "offset": &req.Offset} {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, "", fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+			}
+			*dst = n
+		}
+	}
+	if v := params.Get("queryVersion"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("queryVersion must be a non-negative integer, got %q", v)
+		}
+		req.QueryVersion = n
+	}
+	if err := validateQueryRequest(req); err != nil {
+		return nil, "", err
+	}
+	return req, format, nil
+}
+
+// executionStatus maps an execution failure to an HTTP status
+func executionStatus(err error) int {
+	var timeout *runner.TimeoutError
+	var invalid *runner.ValidationError
+	var rejected *runner.SQLValidationError
+	switch {
+	case errors.Is(err, runner.ErrQueryNotFound), errors.Is(err, runner.ErrConnectorNotFound),
+		errors.Is(err, runner.ErrParameterSetNotFound), errors.Is(err, runner.ErrExecutionNotFound),
+		errors.Is(err, runner.ErrQueryVersionNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &invalid), errors.As(err, &rejected):
+		return http.StatusBadRequest
+	case errors.As(err, &timeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		// The client went away; nobody reads the status
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// exportFilename names the download after the query, falling back to its ID
+func exportFilename(queryID string, query *runner.Query, format string) string {
+	name := queryID
+	if query != nil && query.Name != "" {
+		name = query.Name
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r == ' ':
+			return '_'
+		default:
+			return -1
+		}
+	}, name)
+	if name == "" {
+		name = "export"
+	}
+	return name + "." + format
+}
+
+// recordHTTPOutcome updates connector health and the error log after an
+// execution requested over HTTP; source stands in for the connection ID
+func (s *Server) recordHTTPOutcome(source string, req *QueryRequest, obs *httpObserver, err error) {
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+	if obs.connector != nil {
+		s.health.record(obs.connector.ID, err)
+	}
+	if err == nil && obs.engine != nil {
+		obs.scan = obs.engine.Progress()
+		s.quotas.charge(obs.caller, obs.scan)
+	}
+	if err != nil {
+		s.recentErrors.add(ErrorRecord{
+			Time:         time.Now(),
+			ConnectionID: source,
+			StreamID:     req.StreamID,
+			QueryID:      req.QueryID,
+			Error:        redact.Secrets(err.Error()),
+		})
+	}
+}
+
+// httpObserver notes the query and connector an HTTP execution runs, and
+// the data it scanned; HTTP executions report no progress
+type httpObserver struct {
+	s         *Server
+	caller    *Principal
+	query     *runner.Query
+	connector *runner.Connector
+	engine    driver.ProgressReporter
+	// scan is the engine's final statistics, once the execution succeeded
+	scan driver.Progress
+}
+
+func (o *httpObserver) resolved(query *runner.Query, connector *runner.Connector) {
+	o.query, o.connector = query, connector
+	o.s.health.register(connector)
+}
+
+func (o *httpObserver) rendered(sql string, templateData interface{}) {}
+func (o *httpObserver) connected()                                    {}
+func (o *httpObserver) progressSource(engine driver.ProgressReporter) { o.engine = engine }
+func (o *httpObserver) statement(ev runner.StatementEvent)            {}
+func (o *httpObserver) submitted(executionID string)                  {}
@@ -0,0 +1,355 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// flight is an execution shared by every stream that asked for the same
+// query with the same data before its first row. The query runs once and
+// each row is fanned out to every member's stream.
+type flight struct {
+	key    string
+	caller *Principal
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	members map[*flightMember]struct{}
+	// started is set once rows flow; later requests start a new flight
+	started bool
+
+	// Events already reported, replayed to members that join late
+	query           *runner.Query
+	connector       *runner.Connector
+	sql             string
+	templateData    interface{}
+	driverConnected bool
+	engine          driver.ProgressReporter
+	stream          *runner.StreamResult
+}
+
+// flightMember is one stream subscribed to a flight
+type flightMember struct {
+	sink *streamSink
+	ctx  context.Context
+
+	// mu serializes the flight's calls into the sink and the member
+	// leaving, so nothing is sent for a stream once it has left
+	mu   sync.Mutex
+	left bool
+
+	done chan flightResult
+}
+
+// flightResult is how a flight ended for a member
+type flightResult struct {
+	err       error
+	truncated bool
+	sample    *runner.SampleInfo
+	snapshot  *runner.Snapshot
+}
+
+// flightKey identifies the requests that can share an execution. Requests
+// that are async, attach to an execution or use flow control always run on
+// their own, and only callers of the same organization and query scope
+// share an execution.
+func (s *Server) flightKey(req *QueryRequest, caller *Principal) (string, bool) {
+	if !s.config.DedupeInFlight || req.Async || req.ExecutionID != "" || req.Credits > 0 {
+		return "", false
+	}
+
+	// Map keys marshal sorted, so equal template data gives equal keys
+	key, err := json.Marshal(struct {
+		QueryID      string                 `json:"q"`
+		TemplateData map[string]interface{} `json:"d"`
+		ParameterSet string                 `json:"p"`
+		CountOnly    bool                   `json:"c"`
+		Limit        int64                  `json:"l"`
+		Offset       int64                  `json:"o"`
+		PreviewRows  int64                  `json:"v"`
+		CacheControl string                 `json:"cc"`
+		Snapshot     string                 `json:"s"`
+		Organization string                 `json:"org,omitempty"`
+		Scope        string                 `json:"k,omitempty"`
+		Replay       string                 `json:"r,omitempty"`
+		QueryVersion int                    `json:"qv,omitempty"`
+		Timezone     string                 `json:"tz,omitempty"`
+		ResultReuse  int64                  `json:"rr,omitempty"`
+		JobLabels    map[string]string      `json:"jl,omitempty"`
+		JobPriority  string                 `json:"jp,omitempty"`
+		MaxBilled    int64                  `json:"mb,omitempty"`
+		Transforms   []protocol.Transform   `json:"t,omitempty"`
+		Aggregates   []protocol.Aggregate   `json:"ag,omitempty"`
+		Sample       *protocol.Sample       `json:"sa,omitempty"`
+		// Templates see the caller as User, so callers only share their
+		// own executions
+		User string `json:"u,omitempty"`
+	}{req.QueryID, req.TemplateData, req.ParameterSet, req.CountOnly, req.Limit, req.Offset, s.previewRows(req), req.CacheControl, req.Snapshot,
+		organizationOf(caller), scopeOf(caller), req.Replay, req.QueryVersion, req.Timezone, req.ResultReuseMinutes, req.JobLabels, req.JobPriority, req.MaxBytesBilled,
+		req.Transforms, req.Aggregates, req.Sample, identityOf(caller)})
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// identityOf names the user or API key behind a principal, if any
+func identityOf(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.identity()
+}
+
+// joinFlight streams the shared execution for key into sink, starting the
+// execution when no flight for key is waiting for its first row
+func (s *Server) joinFlight(ctx context.Context, key string, caller *Principal, sink *streamSink) error {
+	m := &flightMember{sink: sink, ctx: ctx, done: make(chan flightResult, 1)}
+
+	s.flightsMu.Lock()
+	f := s.flights[key]
+	var replay func()
+	if f != nil {
+		replay = f.add(m)
+	}
+	joined := replay != nil
+	sink.shared = joined
+	if !joined {
+		f = newFlight(key, caller)
+		replay = f.add(m)
+		s.flights[key] = f
+	}
+	s.flightsMu.Unlock()
+	replay()
+
+	if joined {
+		s.trace(sink.connState, sink.task.Request, "joined_execution", map[string]interface{}{
+			"members": f.size(),
+		})
+	} else {
+		go s.runFlight(f, sink.task.Request)
+	}
+
+	select {
+	case r := <-m.done:
+		// Send any remaining rows in the final batch
+		if ctx.Err() == nil {
+			if err := sink.flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(r.err, errLimitExceeded) {
+			return sink.complete(true, nil, nil)
+		}
+		if r.err != nil {
+			return r.err
+		}
+		return sink.complete(r.truncated, r.sample, r.snapshot)
+	case <-ctx.Done():
+		f.leave(m)
+		return ctx.Err()
+	}
+}
+
+func newFlight(key string, caller *Principal) *flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &flight{key: key, caller: caller, ctx: ctx, cancel: cancel, members: make(map[*flightMember]struct{})}
+}
+
+// add subscribes m unless rows are already flowing, returning nil if they
+// are. The caller must run the returned replay, which reports the events m
+// missed; nothing else reaches m until it has.
+func (f *flight) add(m *flightMember) (replay func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started {
+		return nil
+	}
+	f.members[m] = struct{}{}
+	query, connector, connected, engine, stream := f.query, f.connector, f.driverConnected, f.engine, f.stream
+	sql, templateData := f.sql, f.templateData
+	m.mu.Lock()
+
+	return func() {
+		defer m.mu.Unlock()
+		if query != nil {
+			m.sink.resolved(query, connector)
+		}
+		if sql != "" {
+			m.sink.rendered(sql, templateData)
+		}
+		if connected {
+			m.sink.connected()
+		}
+		if engine != nil {
+			m.sink.progressSource(engine)
+		}
+		if stream != nil {
+			m.sink.source = stream
+			m.sink.opened(stream.FromCache())
+		}
+	}
+}
+
+func (f *flight) size() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.members)
+}
+
+// leave unsubscribes m, stopping the execution when nobody is left
+func (f *flight) leave(m *flightMember) {
+	f.mu.Lock()
+	delete(f.members, m)
+	empty := len(f.members) == 0
+	f.mu.Unlock()
+
+	// Wait out a row being sent to m
+	m.mu.Lock()
+	m.left = true
+	m.mu.Unlock()
+
+	if empty {
+		f.cancel()
+	}
+}
+
+// each calls fn for every current member that has not left
+func (f *flight) each(fn func(m *flightMember)) {
+	f.record(func() {}, fn)
+}
+
+// record updates the replayed state and reports an event to the members,
+// both under the lock that admits members so each member learns of the
+// event exactly once: from fn or from its replay
+func (f *flight) record(update func(), fn func(m *flightMember)) {
+	f.mu.Lock()
+	update()
+	members := make([]*flightMember, 0, len(f.members))
+	for m := range f.members {
+		members = append(members, m)
+	}
+	f.mu.Unlock()
+
+	for _, m := range members {
+		m.mu.Lock()
+		if !m.left {
+			fn(m)
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (f *flight) resolved(query *runner.Query, connector *runner.Connector) {
+	f.record(func() { f.query, f.connector = query, connector }, func(m *flightMember) {
+		m.sink.resolved(query, connector)
+	})
+}
+
+func (f *flight) rendered(sql string, templateData interface{}) {
+	f.record(func() { f.sql, f.templateData = sql, templateData }, func(m *flightMember) {
+		m.sink.rendered(sql, templateData)
+	})
+}
+
+func (f *flight) connected() {
+	f.record(func() { f.driverConnected = true }, func(m *flightMember) { m.sink.connected() })
+}
+
+func (f *flight) progressSource(engine driver.ProgressReporter) {
+	f.record(func() { f.engine = engine }, func(m *flightMember) { m.sink.progressSource(engine) })
+}
+
+func (f *flight) statement(ev runner.StatementEvent) {
+	f.each(func(m *flightMember) { m.sink.statement(ev) })
+}
+
+// submitted is never called: async requests do not share executions
+func (f *flight) submitted(executionID string) {}
+
+// runFlight executes the flight's query and fans its rows out
+func (s *Server) runFlight(f *flight, req *QueryRequest) {
+	defer func() {
+		if err := runner.Recovered(recover(), "shared execution of query "+req.QueryID); err != nil {
+			s.finishFlight(f, flightResult{err: err})
+		}
+	}()
+
+	stream, err := runner.ExecuteQuery(f.ctx, req.QueryID, req.TemplateData, s.store, s.executeOptions(req, f.caller, f))
+	if err != nil {
+		s.finishFlight(f, flightResult{err: fmt.Errorf("execute query: %w", err)})
+		return
+	}
+	defer stream.Close()
+
+	f.record(func() { f.stream = stream }, func(m *flightMember) {
+		m.sink.source = stream
+		m.sink.opened(stream.FromCache())
+	})
+	err = stream.Stream(func(cols []string, row []interface{}) error {
+		return s.publish(f, cols, row)
+	})
+	s.finishFlight(f, flightResult{err: err, truncated: stream.Truncated(), sample: stream.Sample(), snapshot: stream.Snapshot()})
+}
+
+// publish hands a column header or row to every member. A member whose
+// stream fails is dropped without disturbing the others.
+func (s *Server) publish(f *flight, cols []string, row []interface{}) error {
+	f.mu.Lock()
+	first := !f.started
+	f.started = true
+	f.mu.Unlock()
+	if first {
+		s.forgetFlight(f)
+	}
+
+	var failed []*flightMember
+	var errs []error
+	f.each(func(m *flightMember) {
+		if err := m.sink.handle(m.ctx, cols, row); err != nil {
+			failed = append(failed, m)
+			errs = append(errs, err)
+		}
+	})
+	for i, m := range failed {
+		f.leave(m)
+		m.done <- flightResult{err: errs[i]}
+	}
+
+	if f.ctx.Err() != nil {
+		return f.ctx.Err()
+	}
+	return nil
+}
+
+// finishFlight reports the end of the execution to its remaining members
+func (s *Server) finishFlight(f *flight, result flightResult) {
+	f.mu.Lock()
+	f.started = true
+	members := f.members
+	f.members = make(map[*flightMember]struct{})
+	f.mu.Unlock()
+	s.forgetFlight(f)
+
+	for m := range members {
+		m.done <- result
+	}
+	f.cancel()
+}
+
+// forgetFlight stops new requests from joining f
+func (s *Server) forgetFlight(f *flight) {
+	s.flightsMu.Lock()
+	defer s.flightsMu.Unlock()
+	if s.flights[f.key] == f {
+		delete(s.flights, f.key)
+	}
+}
@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"supalytics-executor/protocol"
+)
+
+// Most queries a batch may carry
+const maxBatchQueries = 100
+
+// queryGroup counts the streams of a batch as they end. It is guarded by
+// the connection's groupsMu.
+type queryGroup struct {
+	id        string
+	startedAt time.Time
+	total     int
+	completed int
+	failed    int
+	cancelled int
+	// cancelRequested is set once the client cancelled the group
+	cancelRequested bool
+}
+
+func (g *queryGroup) pending() int {
+	return g.total - g.completed - g.failed - g.cancelled
+}
+
+// outcome is the group's status once its last stream has ended
+func (g *queryGroup) outcome() string {
+	switch {
+	case g.cancelRequested:
+		return protocol.StatusCancelled
+	case g.failed > 0:
+		return protocol.StatusFailed
+	case g.completed == 0:
+		return protocol.StatusCancelled
+	}
+	return protocol.StatusCompleted
+}
+
+func (g *queryGroup) payload() map[string]interface{} {
+	status := protocol.StatusRunning
+	if g.pending() == 0 {
+		status = g.outcome()
+	}
+	return map[string]interface{}{
+		"groupId":   g.id,
+		"status":    status,
+		"total":     g.total,
+		"completed": g.completed,
+		"failed":    g.failed,
+		"cancelled": g.cancelled,
+		"pending":   g.pending(),
+	}
+}
+
+// queueBatch queues each query of a batch message as a stream of its group.
+// A query that is rejected counts as a failed stream of the group.
+func (s *Server) queueBatch(ctx context.Context, connState *ConnectionState, msg *protocol.ClientMessage, receivedAt time.Time) {
+	group := &queryGroup{id: msg.GroupID, startedAt: receivedAt, total: len(msg.Queries)}
+	if err := s.openGroup(connState, group); err != nil {
+		payload := map[string]interface{}{
+			"groupId":  msg.GroupID,
+			"status":   protocol.StatusFailed,
+			"error":    err.Error(),
+			"rejected": true,
+		}
+		s.sendMessage(connState.Conn, WSMessage{Type: MessageTypeGroup, Payload: payload}, connState)
+		return
+	}
+
+	for i := range msg.Queries {
+		req := msg.Queries[i]
+		req.GroupID = group.id
+		req.ExecutionID = ""
+		if err := s.queueQuery(ctx, connState, &req, receivedAt); err != nil {
+			s.recordError(connState, &req, err)
+			s.sendRejection(connState.Conn, req.StreamID, err, connState)
+			s.endGroupStream(connState, group.id, req.StreamID, protocol.StatusFailed)
+		}
+	}
+}
+
+// openGroup checks a batch and starts following its group
+func (s *Server) openGroup(connState *ConnectionState, group *queryGroup) error {
+	switch {
+	case group.id == "":
+		return errors.New("groupId is required")
+	case group.total == 0:
+		return fmt.Errorf("batch %s has no queries", group.id)
+	case group.total > maxBatchQueries:
+		return fmt.Errorf("batch %s has %d queries, the limit is %d", group.id, group.total, maxBatchQueries)
+	}
+
+	connState.groupsMu.Lock()
+	defer connState.groupsMu.Unlock()
+	if _, exists := connState.groups[group.id]; exists {
+		return fmt.Errorf("group %s already exists", group.id)
+	}
+	connState.groups[group.id] = group
+	return nil
+}
+
+// endGroupStream counts an ended stream against its group and reports the
+// group's progress, or its outcome once the last stream has ended
+func (s *Server) endGroupStream(connState *ConnectionState, groupID, streamID, status string) {
+	if groupID == "" {
+		return
+	}
+	connState.groupsMu.Lock()
+	defer connState.groupsMu.Unlock()
+	group, ok := connState.groups[groupID]
+	if !ok {
+		return
+	}
+
+	switch status {
+	case protocol.StatusCompleted:
+		group.completed++
+	case protocol.StatusCancelled:
+		group.cancelled++
+	default:
+		group.failed++
+	}
+	payload := group.payload()
+	payload["streamId"] = streamID
+	payload["streamStatus"] = status
+	if group.pending() == 0 {
+		delete(connState.groups, groupID)
+		payload["elapsedMs"] = time.Since(group.startedAt).Milliseconds()
+	}
+	// Sent under the lock so the group's messages arrive in order
+	s.sendMessage(connState.Conn, WSMessage{Type: MessageTypeGroup, Payload: payload}, connState)
+}
+
+// cancelGroup cancels every queued, running or waiting stream of a group
+func (s *Server) cancelGroup(connState *ConnectionState, groupID string) error {
+	connState.groupsMu.Lock()
+	group, ok := connState.groups[groupID]
+	if ok {
+		group.cancelRequested = true
+	}
+	connState.groupsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("group %s not found", groupID)
+	}
+
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	for _, task := range connState.ActiveTasks {
+		for next := task.successor; next != nil; next = next.successor {
+			if next.Request.GroupID == groupID && next.transition(protocol.StatusQueued, protocol.StatusCancelled) {
+				next.CancelFunc()
+			}
+		}
+		if task.Request.GroupID == groupID {
+			s.cancelTask(connState, task)
+		}
+	}
+	return nil
+}
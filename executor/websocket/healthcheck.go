@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"supalytics-executor/hooks"
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+const (
+	// Time allowed for one connector's health check when none is configured
+	defaultHealthCheckTimeout = 10 * time.Second
+
+	// Connectors the background health checker checks at once
+	healthCheckConcurrency = 4
+
+	// Time allowed to list connectors or record a status
+	connectorStatusTimeout = 10 * time.Second
+)
+
+// HealthCheckConfig schedules background connector health checks
+type HealthCheckConfig struct {
+	// Interval is the time between rounds of checks; zero disables them
+	Interval time.Duration `toml:"interval"`
+	// Timeout bounds a single connector's check (default 10s)
+	Timeout time.Duration `toml:"timeout"`
+}
+
+// runHealthChecks checks every connector of the store each interval, for
+// as long as the process runs
+func (s *Server) runHealthChecks(statuses runner.ConnectorStatusStore) {
+	ticker := time.NewTicker(s.config.HealthChecks.Interval)
+	defer ticker.Stop()
+	for {
+		s.checkConnectors(statuses)
+		<-ticker.C
+	}
+}
+
+// checkConnectors runs one round of health checks
+func (s *Server) checkConnectors(statuses runner.ConnectorStatusStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectorStatusTimeout)
+	connectors, err := statuses.ListConnectors(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Skipping connector health checks: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, healthCheckConcurrency)
+	for i := range connectors {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(connector *runner.Connector) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.checkConnector(context.Background(), connector)
+		}(&connectors[i])
+	}
+	wg.Wait()
+}
+
+// checkConnector checks a connector can be reached, records the result in
+// the metadata store and fires a connector status event when it changed
+func (s *Server) checkConnector(ctx context.Context, connector *runner.Connector) protocol.ConnectionTest {
+	timeout := s.config.HealthChecks.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := runner.CheckConnector(ctx, connector, runner.ExecuteOptions{
+		Timeouts: s.config.Timeouts,
+		Keyring:  s.keyring,
+		Secrets:  s.secretResolver(),
+	})
+	result := protocol.ConnectionTest{
+		ConnectorID: connector.ID,
+		Status:      runner.ConnectorStatusConnected,
+		LatencyMS:   time.Since(start).Milliseconds(),
+		CheckedAt:   time.Now(),
+	}
+	if err != nil {
+		result.Status, result.Error = runner.ConnectorStatusError, redact.Secrets(err.Error())
+	}
+
+	s.health.register(connector)
+	previous := s.health.checked(result)
+	if previous == "" {
+		previous = connector.Status
+	}
+
+	if statuses, ok := s.store.(runner.ConnectorStatusStore); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), connectorStatusTimeout)
+		defer cancel()
+		if err := statuses.UpdateConnectorStatus(ctx, connector.ID, result.Status, result.CheckedAt); err != nil {
+			log.Printf("Failed to record status of connector %s: %v", connector.ID, err)
+		}
+	}
+
+	// A connector's first check only reports failures
+	if result.Status != previous && (previous != "" || result.Status == runner.ConnectorStatusError) {
+		log.Printf("Connector %s is now %s (was %q): %s", connector.ID, result.Status, previous, result.Error)
+		s.hooks.Fire(hooks.Event{
+			Type:           hooks.EventConnectorStatus,
+			Time:           result.CheckedAt,
+			ConnectorID:    connector.ID,
+			Status:         result.Status,
+			PreviousStatus: previous,
+			Error:          result.Error,
+		})
+	}
+	return result
+}
+
+// testConnection checks a connector caller may use on demand
+func (s *Server) testConnection(ctx context.Context, connectorID string, caller *Principal) (protocol.ConnectionTest, error) {
+	connector, err := runner.LoadConnector(ctx, s.store, connectorID, runner.ExecuteOptions{
+		Timeouts: s.config.Timeouts,
+		Caller:   caller.caller(),
+	})
+	if err != nil {
+		return protocol.ConnectionTest{}, err
+	}
+	return s.checkConnector(ctx, connector), nil
+}
+
+// sendConnectionTest answers a test_connection message on its stream
+func (s *Server) sendConnectionTest(ctx context.Context, connState *ConnectionState, req QueryRequest) {
+	if req.StreamID == "" || req.ConnectorID == "" {
+		s.sendError(connState.Conn, req.StreamID, "streamId and connectorId are required", connState)
+		return
+	}
+	result, err := s.testConnection(ctx, req.ConnectorID, connState.Principal())
+	if err != nil {
+		s.sendFailure(connState.Conn, req.StreamID, err, connState)
+		return
+	}
+	payload := map[string]interface{}{
+		"connectorId": result.ConnectorID,
+		"status":      result.Status,
+		"latencyMs":   result.LatencyMS,
+		"checkedAt":   result.CheckedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if result.Error != "" {
+		payload["error"] = redact.Message(result.Error)
+	}
+	s.sendMessage(connState.Conn, WSMessage{
+		Type:     MessageTypeTestConnection,
+		StreamID: req.StreamID,
+		Payload:  payload,
+	}, connState)
+}
+
+// handleRESTTestConnection checks a connector for
+// POST /api/v1/connectors/{id}/test. A connector that cannot be reached is
+// still a successful test: the result reports status "error".
+func (s *Server) handleRESTTestConnection(w http.ResponseWriter, r *http.Request) {
+	result, err := s.testConnection(r.Context(), r.PathValue("id"), principalFrom(r.Context()))
+	if errors.Is(err, runner.ErrConnectorNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	result.Error = redact.Message(result.Error)
+	writeJSON(w, http.StatusOK, result)
+}
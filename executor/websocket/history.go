@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+const (
+	// Executions a history request lists when it does not set a limit
+	defaultHistoryLimit = 20
+
+	// Most executions a history request lists
+	maxHistoryLimit = 100
+)
+
+// errHistoryUnavailable is reported when the metadata store keeps no
+// execution history
+var errHistoryUnavailable = errors.New("execution history is not available")
+
+// history lists a query's recent executions that caller may see, newest
+// first. Executions are visible to their own organization only, and API
+// keys limited to some queries see only those. The SQL and template data
+// of an execution are only listed for the user or API key that ran it, or
+// for admins, as they carry its row-level security filters.
+func (s *Server) history(ctx context.Context, queryID string, limit int64, caller *Principal, admin bool) ([]protocol.ExecutionRecord, error) {
+	store, ok := s.store.(runner.ExecutionHistory)
+	if !ok {
+		return nil, errHistoryUnavailable
+	}
+	if caller != nil && len(caller.QueryIDs) > 0 && !slices.Contains(caller.QueryIDs, queryID) {
+		return []protocol.ExecutionRecord{}, nil
+	}
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	entries, err := store.ListExecutions(ctx, queryID, int(min(limit, maxHistoryLimit)))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []protocol.ExecutionRecord{}
+	for _, e := range entries {
+		if e.ExecutionID == "" || e.OrganizationID != organizationOf(caller) {
+			continue
+		}
+		record := protocol.ExecutionRecord{
+			ExecutionID:  e.ExecutionID,
+			QueryID:      e.QueryID,
+			ConnectorID:  e.ConnectorID,
+			StreamID:     e.StreamID,
+			UserID:       e.UserID,
+			Status:       e.Status,
+			Error:        redact.Message(e.Error),
+			RowsSent:     e.RowsSent,
+			BytesScanned: e.BytesScanned,
+			QueuedAt:     e.QueuedAt,
+			StartedAt:    e.StartedAt,
+			FinishedAt:   e.FinishedAt,
+			ReplayOf:     e.ReplayOf,
+			QueryVersion: e.QueryVersion,
+			Slow:         e.Slow,
+		}
+		if admin || ranBy(e, caller) {
+			record.RenderedSQL, record.TemplateData = e.RenderedSQL, e.TemplateData
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ranBy reports whether the user or API key of caller ran the execution
+func ranBy(e runner.AuditEntry, caller *Principal) bool {
+	return caller == nil || (e.UserID == caller.UserID && e.APIKeyID == caller.APIKeyID)
+}
+
+// sendHistory answers a history message on its stream
+func (s *Server) sendHistory(ctx context.Context, connState *ConnectionState, req QueryRequest) {
+	if req.StreamID == "" || req.QueryID == "" {
+		s.sendError(connState.Conn, req.StreamID, "streamId and queryId are required", connState)
+		return
+	}
+	records, err := s.history(ctx, req.QueryID, req.Limit, connState.Principal(), connState.admin)
+	if err != nil {
+		s.sendFailure(connState.Conn, req.StreamID, err, connState)
+		return
+	}
+	s.sendMessage(connState.Conn, WSMessage{
+		Type:     MessageTypeHistory,
+		StreamID: req.StreamID,
+		Payload: map[string]interface{}{
+			"queryId":    req.QueryID,
+			"executions": records,
+		},
+	}, connState)
+}
+
+// handleRESTHistory lists a query's recent executions for
+// GET /api/v1/queries/{id}/history?limit=N. An execution is replayed by
+// passing its executionId as "replay" to the execute endpoint.
+func (s *Server) handleRESTHistory(w http.ResponseWriter, r *http.Request) {
+	var limit int64
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("limit must be a non-negative integer"))
+			return
+		}
+		limit = n
+	}
+	records, err := s.history(r.Context(), r.PathValue("id"), limit, principalFrom(r.Context()), s.presentsAdminToken(r))
+	if errors.Is(err, errHistoryUnavailable) {
+		writeJSONError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"executions": records})
+}
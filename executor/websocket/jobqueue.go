@@ -0,0 +1,675 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/runner"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Prefix of the queue's Redis keys, unless configured with key_prefix
+	defaultJobKeyPrefix = "supalytics:"
+
+	// Time a published query waits to be claimed, unless configured with
+	// claim_timeout
+	defaultClaimTimeout = 30 * time.Second
+
+	// Time a claimed query's worker may stay silent, unless configured
+	// with worker_timeout
+	defaultWorkerTimeout = 30 * time.Second
+
+	// Interval at which a worker reports that it is alive and checks
+	// whether its query was cancelled
+	jobHeartbeat = time.Second
+
+	// Longest a worker holds rows before sending them on
+	jobFlushInterval = 100 * time.Millisecond
+
+	// Longest a read of a query's events blocks, so the stream notices its
+	// cancellation promptly
+	jobReadBlock = 200 * time.Millisecond
+
+	// Time a query's events stay in Redis, in case nobody cleans them up
+	jobEventTTL = 10 * time.Minute
+
+	// Queued queries kept in the stream; older ones are trimmed
+	jobQueueLength = 10000
+
+	// Consumer group every worker replica claims queries through
+	jobGroup = "executors"
+)
+
+// Events a worker reports to the replica that published its query
+const (
+	jobClaimed   = "claimed"
+	jobResolved  = "resolved"
+	jobRendered  = "rendered"
+	jobConnected = "connected"
+	jobProgress  = "progress"
+	jobStatement = "statement"
+	jobSubmitted = "submitted"
+	jobOpened    = "opened"
+	jobRows      = "rows"
+	jobAlive     = "alive"
+	jobDone      = "done"
+)
+
+// JobQueueConfig shares query execution between replicas through a Redis
+// stream. Replicas that publish hand their streams' queries to the queue;
+// replicas with workers claim queries published by any replica and send
+// the results back to the one holding the client's connection. WebSocket
+// termination and the worker fleet can then be scaled independently.
+type JobQueueConfig struct {
+	// RedisURL enables the queue, e.g. redis://queue:6379/0
+	RedisURL  string `toml:"redis_url"`
+	KeyPrefix string `toml:"key_prefix"` // default "supalytics:"
+
+	// Publish runs this replica's streams on the queue. Streams using flow
+	// control, and requests sharing an in-flight execution, still run
+	// locally.
+	Publish bool `toml:"publish"`
+	// Workers is how many queued queries this replica runs at once; zero
+	// runs none
+	Workers int `toml:"workers"`
+
+	// ClaimTimeout fails a published query no worker claims in time
+	// (default 30s)
+	ClaimTimeout time.Duration `toml:"claim_timeout"`
+	// WorkerTimeout fails a claimed query whose worker has been silent this
+	// long, as when its replica died (default 30s)
+	WorkerTimeout time.Duration `toml:"worker_timeout"`
+}
+
+// Enabled reports whether a queue is configured
+func (c JobQueueConfig) Enabled() bool {
+	return c.RedisURL != ""
+}
+
+// job is a query published to the queue
+type job struct {
+	ID          string        `json:"id"`
+	Request     *QueryRequest `json:"request"`
+	Caller      *Principal    `json:"caller,omitempty"`
+	PublishedAt time.Time     `json:"publishedAt"`
+	// Claims are sent on their own as principals do not serialize them
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// principal is the caller the job runs for
+func (j *job) principal() *Principal {
+	if j.Caller != nil {
+		j.Caller.Claims = j.Claims
+	}
+	return j.Caller
+}
+
+// jobEvent is one event a worker reported for a job
+type jobEvent struct {
+	id   string
+	Type string
+	Data []byte
+}
+
+// resolvedEvent reports a job's query and connector. The connector's config
+// stays with the worker.
+type resolvedEvent struct {
+	Query          *runner.Query     `json:"query"`
+	Connector      *runner.Connector `json:"connector"`
+	QueryStale     bool              `json:"queryStale,omitempty"`
+	ConnectorStale bool              `json:"connectorStale,omitempty"`
+}
+
+type renderedEvent struct {
+	SQL          string      `json:"sql"`
+	TemplateData interface{} `json:"templateData"`
+}
+
+type statementEvent struct {
+	runner.StatementEvent
+	DurationMs int64 `json:"durationMs"`
+}
+
+type openedEvent struct {
+	FromCache bool      `json:"fromCache,omitempty"`
+	CachedAt  time.Time `json:"cachedAt"`
+}
+
+// doneEvent ends a job: completed, or failed with the payload the client is
+// sent
+type doneEvent struct {
+	Truncated bool                   `json:"truncated,omitempty"`
+	Sample    *runner.SampleInfo     `json:"sample,omitempty"`
+	Snapshot  *runner.Snapshot       `json:"snapshot,omitempty"`
+	Failure   map[string]interface{} `json:"failure,omitempty"`
+}
+
+// remoteError is a failure reported by the replica that ran a query,
+// carrying the payload to send the client
+type remoteError struct {
+	payload map[string]interface{}
+}
+
+func (e *remoteError) Error() string {
+	msg, _ := e.payload["error"].(string)
+	return msg
+}
+
+// jobQueue publishes, claims and reports jobs on Redis
+type jobQueue struct {
+	cfg    JobQueueConfig
+	client *redis.Client
+	// consumer names this replica in the consumer group
+	consumer string
+	// running counts the jobs this replica's workers are running
+	running atomic.Int64
+}
+
+func newJobQueue(cfg JobQueueConfig) (*jobQueue, error) {
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = defaultJobKeyPrefix
+	}
+	if cfg.ClaimTimeout <= 0 {
+		cfg.ClaimTimeout = defaultClaimTimeout
+	}
+	if cfg.WorkerTimeout <= 0 {
+		cfg.WorkerTimeout = defaultWorkerTimeout
+	}
+	host, _ := os.Hostname()
+	return &jobQueue{
+		cfg:      cfg,
+		client:   redis.NewClient(opts),
+		consumer: host + "-" + uuid.NewString()[:8],
+	}, nil
+}
+
+func (q *jobQueue) jobsKey() string            { return q.cfg.KeyPrefix + "jobs" }
+func (q *jobQueue) eventsKey(id string) string { return q.cfg.KeyPrefix + "job:" + id }
+func (q *jobQueue) cancelKey(id string) string { return q.cfg.KeyPrefix + "job:" + id + ":cancel" }
+
+// publish queues a job
+func (q *jobQueue) publish(ctx context.Context, j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.jobsKey(),
+		MaxLen: jobQueueLength,
+		Approx: true,
+		Values: map[string]interface{}{"job": data},
+	}).Err()
+}
+
+// read returns the events reported for job id after lastID, waiting at most
+// jobReadBlock for the first
+func (q *jobQueue) read(ctx context.Context, id string, lastID string) ([]jobEvent, error) {
+	streams, err := q.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{q.eventsKey(id), lastID},
+		Count:   100,
+		Block:   jobReadBlock,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var events []jobEvent
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			typ, _ := msg.Values["type"].(string)
+			data, _ := msg.Values["data"].(string)
+			events = append(events, jobEvent{id: msg.ID, Type: typ, Data: []byte(data)})
+		}
+	}
+	return events, nil
+}
+
+// report adds an event to job id
+func (q *jobQueue) report(id string, typ string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	pipe := q.client.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.eventsKey(id),
+		Values: map[string]interface{}{"type": typ, "data": data},
+	})
+	pipe.Expire(ctx, q.eventsKey(id), jobEventTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// cancel tells the worker running job id to stop
+func (q *jobQueue) cancel(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if err := q.client.Set(ctx, q.cancelKey(id), 1, jobEventTTL).Err(); err != nil {
+		log.Printf("Cancel queued query %s failed: %v", id, err)
+	}
+}
+
+// cancelled reports whether job id was cancelled
+func (q *jobQueue) cancelled(ctx context.Context, id string) bool {
+	n, err := q.client.Exists(ctx, q.cancelKey(id)).Result()
+	return err == nil && n > 0
+}
+
+// forget removes the events of job id once its stream has ended
+func (q *jobQueue) forget(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	q.client.Del(ctx, q.eventsKey(id))
+}
+
+// claim takes the next job for this replica, waiting up to a heartbeat for
+// one. It returns nil when none was queued.
+func (q *jobQueue) claim(ctx context.Context) (*job, error) {
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    jobGroup,
+		Consumer: q.consumer,
+		Streams:  []string{q.jobsKey(), ">"},
+		Count:    1,
+		Block:    jobHeartbeat,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		// Reading from the start takes jobs published before any worker
+		// replica ran
+		err = q.client.XGroupCreateMkStream(ctx, q.jobsKey(), jobGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			// A job runs at most once: a worker that dies with it is
+			// detected by the publisher's worker timeout
+			q.client.XAck(ctx, q.jobsKey(), jobGroup, msg.ID)
+			data, _ := msg.Values["job"].(string)
+			var j job
+			if err := json.Unmarshal([]byte(data), &j); err != nil || j.Request == nil {
+				log.Printf("Dropping malformed queued query %s: %v", msg.ID, err)
+				return nil, nil
+			}
+			// Its publisher has given up on a job that waited this long
+			if time.Since(j.PublishedAt) > q.cfg.ClaimTimeout {
+				return nil, nil
+			}
+			return &j, nil
+		}
+	}
+	return nil, nil
+}
+
+// publishes reports whether a stream's query runs on the queue
+func (s *Server) publishes(req *QueryRequest) bool {
+	// Credits hold rows back on this replica, which the queue cannot do
+	return s.jobs != nil && s.jobs.cfg.Publish && req.Credits == 0
+}
+
+// runRemote publishes a stream's query to the queue and relays the events
+// of the replica that runs it into sink
+func (s *Server) runRemote(ctx context.Context, caller *Principal, sink *streamSink) error {
+	req := sink.task.Request
+	j := &job{ID: uuid.NewString(), Request: req, Caller: caller, PublishedAt: time.Now()}
+	if caller != nil {
+		j.Claims = caller.Claims
+	}
+	if err := s.jobs.publish(ctx, j); err != nil {
+		return fmt.Errorf("publish query: %w", err)
+	}
+	s.trace(sink.connState, req, "published", map[string]interface{}{"job": j.ID})
+
+	finished := false
+	defer func() {
+		// The worker is stopped however the stream ended early
+		if !finished {
+			s.jobs.cancel(j.ID)
+		}
+		s.jobs.forget(j.ID)
+	}()
+
+	var (
+		progress = &driver.ProgressTracker{}
+		header   bool
+		claimed  bool
+		lastID   = "0"
+		heard    = time.Now()
+	)
+	for {
+		events, err := s.jobs.read(ctx, j.ID, lastID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("read queued query: %w", err)
+		}
+		if len(events) == 0 {
+			switch {
+			case !claimed && time.Since(heard) > s.jobs.cfg.ClaimTimeout:
+				return fmt.Errorf("no replica claimed the query within %s", s.jobs.cfg.ClaimTimeout)
+			case claimed && time.Since(heard) > s.jobs.cfg.WorkerTimeout:
+				return fmt.Errorf("the replica running the query was silent for %s", s.jobs.cfg.WorkerTimeout)
+			}
+			continue
+		}
+		heard = time.Now()
+
+		for _, ev := range events {
+			lastID = ev.id
+			switch ev.Type {
+			case jobClaimed:
+				claimed = true
+				var worker struct {
+					Worker string `json:"worker"`
+				}
+				json.Unmarshal(ev.Data, &worker)
+				s.trace(sink.connState, req, "claimed", map[string]interface{}{"worker": worker.Worker})
+			case jobResolved:
+				var r resolvedEvent
+				if err := json.Unmarshal(ev.Data, &r); err != nil {
+					return fmt.Errorf("queued query: %w", err)
+				}
+				r.Query.Stale, r.Connector.Stale = r.QueryStale, r.ConnectorStale
+				sink.resolved(r.Query, r.Connector)
+			case jobRendered:
+				var r renderedEvent
+				json.Unmarshal(ev.Data, &r)
+				sink.rendered(r.SQL, r.TemplateData)
+			case jobConnected:
+				sink.connected()
+			case jobProgress:
+				var p driver.Progress
+				json.Unmarshal(ev.Data, &p)
+				progress.SetProgress(p)
+				sink.progressSource(progress)
+			case jobStatement:
+				var st statementEvent
+				json.Unmarshal(ev.Data, &st)
+				st.Duration = time.Duration(st.DurationMs) * time.Millisecond
+				sink.statement(st.StatementEvent)
+			case jobSubmitted:
+				sink.submitted(string(ev.Data))
+			case jobOpened:
+				var o openedEvent
+				json.Unmarshal(ev.Data, &o)
+				sink.opened(o.FromCache, o.CachedAt)
+			case jobRows:
+				batch, err := runner.DecodeResult(ev.Data)
+				if err != nil {
+					return fmt.Errorf("queued query rows: %w", err)
+				}
+				if !header && batch.Columns != nil {
+					header = true
+					err = sink.handle(ctx, batch.Columns, nil)
+				}
+				for _, row := range batch.Rows {
+					if err != nil {
+						break
+					}
+					err = sink.handle(ctx, nil, row)
+				}
+				if errors.Is(err, errLimitExceeded) {
+					if err := sink.flush(); err != nil {
+						return err
+					}
+					return sink.complete(true, nil, nil)
+				}
+				if err != nil {
+					return err
+				}
+			case jobDone:
+				finished = true
+				var done doneEvent
+				if err := json.Unmarshal(ev.Data, &done); err != nil {
+					return fmt.Errorf("queued query: %w", err)
+				}
+				if done.Failure != nil {
+					return &remoteError{payload: done.Failure}
+				}
+				if err := sink.flush(); err != nil {
+					return err
+				}
+				return sink.complete(done.Truncated, done.Sample, done.Snapshot)
+			}
+		}
+	}
+}
+
+// claimJobs runs queued queries on this replica's workers until the server
+// drains
+func (s *Server) claimJobs() {
+	slots := make(chan struct{}, s.jobs.cfg.Workers)
+	for !s.Draining() {
+		slots <- struct{}{}
+		j, err := s.jobs.claim(context.Background())
+		if err != nil {
+			<-slots
+			log.Printf("Claiming queued queries failed: %v", err)
+			time.Sleep(jobHeartbeat)
+			continue
+		}
+		if j == nil {
+			<-slots
+			continue
+		}
+		s.jobs.running.Add(1)
+		go func() {
+			defer func() { <-slots }()
+			defer s.jobs.running.Add(-1)
+			s.runJob(j)
+		}()
+	}
+}
+
+// runJob runs a claimed query, reporting its events to the publisher
+func (s *Server) runJob(j *job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &jobWriter{q: s.jobs, id: j.ID}
+	defer func() {
+		if err := runner.Recovered(recover(), "queued query "+j.ID); err != nil {
+			w.send(jobDone, doneEvent{Failure: failurePayload(err)})
+		}
+	}()
+	w.send(jobClaimed, map[string]interface{}{"worker": s.jobs.consumer})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(jobHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if s.jobs.cancelled(ctx, j.ID) {
+				cancel()
+				return
+			}
+			w.heartbeat()
+		}
+	}()
+
+	req := j.Request
+	opts := s.executeOptions(req, j.principal(), w)
+	var stream *runner.StreamResult
+	var err error
+	if req.ExecutionID != "" {
+		stream, err = runner.AttachExecution(ctx, req.QueryID, req.ExecutionID, s.store, opts)
+	} else {
+		stream, err = runner.ExecuteQuery(ctx, req.QueryID, req.TemplateData, s.store, opts)
+	}
+	if err != nil {
+		err = fmt.Errorf("execute query: %w", err)
+	} else {
+		defer stream.Close()
+		fromCache, cachedAt := stream.FromCache()
+		w.send(jobOpened, openedEvent{FromCache: fromCache, CachedAt: cachedAt})
+		err = stream.Stream(w.row)
+		if err == nil {
+			err = w.flush()
+		}
+	}
+	if ctx.Err() != nil {
+		// The publisher has stopped listening
+		return
+	}
+
+	done := doneEvent{}
+	if err != nil {
+		done.Failure = failurePayload(err)
+	} else {
+		done.Truncated, done.Sample, done.Snapshot = stream.Truncated(), stream.Sample(), stream.Snapshot()
+	}
+	w.send(jobDone, done)
+}
+
+// jobWriter reports a running job's events, batching its rows
+type jobWriter struct {
+	q  *jobQueue
+	id string
+
+	mu      sync.Mutex
+	engine  driver.ProgressReporter
+	columns []string
+	rows    [][]interface{}
+	since   time.Time
+}
+
+func (w *jobWriter) send(typ string, v interface{}) {
+	var data []byte
+	switch v := v.(type) {
+	case nil:
+	case string:
+		data = []byte(v)
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			log.Printf("Encode %s event of queued query %s: %v", typ, w.id, err)
+			return
+		}
+	}
+	if err := w.q.report(w.id, typ, data); err != nil {
+		log.Printf("Report %s event of queued query %s: %v", typ, w.id, err)
+	}
+}
+
+func (w *jobWriter) resolved(query *runner.Query, connector *runner.Connector) {
+	c := *connector
+	c.Config = nil
+	w.send(jobResolved, resolvedEvent{Query: query, Connector: &c, QueryStale: query.Stale, ConnectorStale: connector.Stale})
+}
+
+func (w *jobWriter) rendered(sql string, templateData interface{}) {
+	w.send(jobRendered, renderedEvent{SQL: sql, TemplateData: templateData})
+}
+
+func (w *jobWriter) connected() {
+	w.send(jobConnected, nil)
+}
+
+func (w *jobWriter) progressSource(engine driver.ProgressReporter) {
+	w.mu.Lock()
+	w.engine = engine
+	w.mu.Unlock()
+	w.send(jobProgress, engine.Progress())
+}
+
+func (w *jobWriter) statement(ev runner.StatementEvent) {
+	w.send(jobStatement, statementEvent{StatementEvent: ev, DurationMs: ev.Duration.Milliseconds()})
+}
+
+func (w *jobWriter) submitted(executionID string) {
+	w.send(jobSubmitted, executionID)
+}
+
+// heartbeat sends rows held too long and tells the publisher the worker is
+// alive, with the engine's progress when it reports it
+func (w *jobWriter) heartbeat() {
+	w.flush()
+	w.mu.Lock()
+	engine := w.engine
+	w.mu.Unlock()
+	if engine != nil {
+		w.send(jobProgress, engine.Progress())
+	} else {
+		w.send(jobAlive, nil)
+	}
+}
+
+// row buffers a header or row, sending the batch once it is full or has
+// waited long enough. The header is sent at once so the client learns the
+// columns before the first batch.
+func (w *jobWriter) row(columns []string, row []interface{}) error {
+	w.mu.Lock()
+	if row == nil {
+		if w.columns != nil {
+			w.mu.Unlock()
+			return nil
+		}
+		w.columns = columns
+		w.mu.Unlock()
+		return w.sendRows(&runner.CachedResult{Columns: columns})
+	}
+	if len(w.rows) == 0 {
+		w.since = time.Now()
+	}
+	w.rows = append(w.rows, append([]interface{}(nil), row...))
+	full := len(w.rows) >= batchSize || time.Since(w.since) >= jobFlushInterval
+	w.mu.Unlock()
+	if full {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush sends the rows buffered so far
+func (w *jobWriter) flush() error {
+	w.mu.Lock()
+	rows := w.rows
+	w.rows = nil
+	w.mu.Unlock()
+	if len(rows) == 0 {
+		return nil
+	}
+	return w.sendRows(&runner.CachedResult{Rows: rows})
+}
+
+func (w *jobWriter) sendRows(batch *runner.CachedResult) error {
+	data, err := runner.EncodeResult(batch)
+	if err != nil {
+		return fmt.Errorf("encode rows: %w", err)
+	}
+	if err := w.q.report(w.id, jobRows, data); err != nil {
+		return fmt.Errorf("report rows: %w", err)
+	}
+	return nil
+}
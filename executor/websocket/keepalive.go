@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to read the next frame, pongs included, from the peer,
+	// unless configured with keepalive.pong_wait
+	defaultPongWait = 60 * time.Second
+
+	// Bounds on how often an idle timeout is checked
+	minIdleCheck = 10 * time.Millisecond
+	maxIdleCheck = 10 * time.Second
+)
+
+// KeepaliveConfig sets how connections are kept alive, and how long they
+// may sit idle
+type KeepaliveConfig struct {
+	// PongWait drops a connection that sends nothing, not even a pong, for
+	// this long (default 60s)
+	PongWait time.Duration `toml:"pong_wait"`
+	// PingPeriod is the time between pings; it must be shorter than
+	// PongWait (default 9/10 of it)
+	PingPeriod time.Duration `toml:"ping_period"`
+	// IdleTimeout closes a connection that has had no queued or running
+	// streams, and sent no messages, for this long; zero keeps it open
+	IdleTimeout time.Duration `toml:"idle_timeout"`
+	// HeartbeatInterval is the time between heartbeat messages; zero sends
+	// none
+	HeartbeatInterval time.Duration `toml:"heartbeat_interval"`
+}
+
+func (s *Server) pongWait() time.Duration {
+	if s.config.Keepalive.PongWait > 0 {
+		return s.config.Keepalive.PongWait
+	}
+	return defaultPongWait
+}
+
+func (s *Server) pingPeriod() time.Duration {
+	pongWait := s.pongWait()
+	if period := s.config.Keepalive.PingPeriod; period > 0 && period < pongWait {
+		return period
+	}
+	return pongWait * 9 / 10
+}
+
+// keepalive sends a connection's heartbeats and closes it once it has been
+// idle for the idle timeout
+func (s *Server) keepalive(ctx context.Context, connState *ConnectionState) {
+	cfg := s.config.Keepalive
+	var heartbeat, idleCheck <-chan time.Time
+	if cfg.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(cfg.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	if cfg.IdleTimeout > 0 {
+		ticker := time.NewTicker(min(max(cfg.IdleTimeout/10, minIdleCheck), maxIdleCheck))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	if heartbeat == nil && idleCheck == nil {
+		return
+	}
+
+	busyAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat:
+			s.sendHeartbeat(connState)
+		case now := <-idleCheck:
+			if connState.activeStreams() > 0 {
+				busyAt = now
+				continue
+			}
+			if last := time.Unix(0, connState.lastMessageAt.Load()); last.After(busyAt) {
+				busyAt = last
+			}
+			if now.Sub(busyAt) >= cfg.IdleTimeout {
+				s.closeIdle(connState, cfg.IdleTimeout)
+				return
+			}
+		}
+	}
+}
+
+// activeStreams counts the connection's queued and running streams and its
+// subscriptions
+func (c *ConnectionState) activeStreams() int {
+	c.TasksMutex.RLock()
+	defer c.TasksMutex.RUnlock()
+	return len(c.ActiveTasks) + len(c.subscriptions)
+}
+
+// sendHeartbeat tells the client the connection is alive, so it can tell a
+// quiet connection from a half-open one
+func (s *Server) sendHeartbeat(connState *ConnectionState) {
+	s.sendMessage(connState.Conn, WSMessage{Type: MessageTypeHeartbeat, Payload: map[string]interface{}{
+		"serverTime":    time.Now().UTC().Format(time.RFC3339Nano),
+		"activeStreams": connState.activeStreams(),
+		"intervalMs":    s.config.Keepalive.HeartbeatInterval.Milliseconds(),
+	}}, connState)
+}
+
+// closeIdle ends a connection that has been idle for timeout
+func (s *Server) closeIdle(connState *ConnectionState, timeout time.Duration) {
+	log.Printf("Closing connection %s: idle for %s", connState.RemoteAddr, timeout)
+	// Queued frames are written before the close frame
+	connState.flushSend(writeWait)
+	connState.Conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(protocol.CloseIdleTimeout, fmt.Sprintf("idle for %s", timeout)),
+		time.Now().Add(writeWait))
+	connState.Conn.Close()
+}
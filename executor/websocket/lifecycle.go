@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"time"
+
+	"supalytics-executor/protocol"
+)
+
+// Reason given for the tasks of a connection that closed
+const disconnectCancelReason = "client disconnected"
+
+// taskTransitions lists the states each task state may move to. A task
+// has a single owner at a time: the queue while it is queued, where a
+// cancellation, the queue timeout or a worker's claim may end it, then the
+// worker that claimed it, which alone decides how it ends. Completed,
+// failed, cancelled and timeout are final.
+var taskTransitions = map[string][]string{
+	protocol.StatusQueued:  {protocol.StatusRunning, protocol.StatusFailed, protocol.StatusCancelled},
+	protocol.StatusRunning: {protocol.StatusCompleted, protocol.StatusFailed, protocol.StatusCancelled, protocol.StatusTimeout},
+}
+
+// transition moves the task from one state to another, reporting false
+// when it is no longer in the first or the move is not allowed. Whichever
+// goroutine makes a transition first wins, so racing cancellations,
+// timeouts and workers end a task once. The caller holds the connection's
+// task lock.
+func (task *QueryTask) transition(from, to string) bool {
+	if task.Status != from {
+		return false
+	}
+	for _, next := range taskTransitions[from] {
+		if next == to {
+			task.Status = to
+			if to == protocol.StatusRunning {
+				task.ExecutedAt = time.Now()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// claimTask hands a task taken from the queue to its worker, reporting
+// false when the task ended while it was queued
+func (s *Server) claimTask(connState *ConnectionState, task *QueryTask) bool {
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	return task.transition(protocol.StatusQueued, protocol.StatusRunning)
+}
+
+// endTask moves a task from a state to a final one, reporting false when
+// another goroutine ended it first
+func (s *Server) endTask(connState *ConnectionState, task *QueryTask, from, to string) bool {
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	return task.transition(from, to)
+}
+
+// releaseTask frees an ended task's stream ID for reuse, or hands it to the
+// request waiting behind the task, records its final owner status, ends its
+// context and counts it against its group; the caller holds the task lock
+func (s *Server) releaseTask(connState *ConnectionState, task *QueryTask) {
+	// A later task may have taken the stream ID already
+	if connState.ActiveTasks[task.Request.StreamID] == task {
+		delete(connState.ActiveTasks, task.Request.StreamID)
+		if next := task.successor; next != nil {
+			task.successor = nil
+			connState.ActiveTasks[next.Request.StreamID] = next
+			go s.enqueueTask(connState, next, true)
+		}
+	}
+	s.routing.record(connState, task, task.Status, "")
+	task.CancelFunc()
+	s.endGroupStream(connState, task.Request.GroupID, task.Request.StreamID, task.Status)
+}
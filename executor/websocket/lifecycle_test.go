@@ -0,0 +1,295 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// testQuery streams a few rows slowly enough for cancellations to race the
+// workers running it
+const testQuery = "query-slow"
+
+// testConnection is a connection without a socket whose frames are kept
+// for the test to read
+type testConnection struct {
+	*ConnectionState
+
+	mu       sync.Mutex
+	messages []WSMessage
+}
+
+// newTestConnection serves a connection from a server with workers
+// workers, reading a memory store that holds testQuery
+func newTestConnection(t *testing.T, workers int) (*Server, *testConnection) {
+	t.Helper()
+	store := runner.NewMemoryStore()
+	config, err := json.Marshal(map[string]interface{}{
+		"columns":      []string{"n"},
+		"rows":         [][]interface{}{{1}, {2}, {3}, {4}, {5}},
+		"row_delay_ms": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.PutConnector(runner.Connector{ID: "connector-slow", Name: "slow", Type: string(driver.MockType), Config: config})
+	store.PutQuery(runner.Query{ID: testQuery, ConnectorID: "connector-slow", Content: "select n"})
+
+	s := NewServerWithStore(Config{MaxWorkers: workers, QueueCapacity: 1000}, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &testConnection{ConnectionState: &ConnectionState{
+		ID:            fmt.Sprintf("test-%p", t),
+		ConnectedAt:   time.Now(),
+		Codec:         protocol.CodecForSubprotocol(""),
+		QueryQueue:    newTaskQueue(1000),
+		ActiveTasks:   make(map[string]*QueryTask),
+		send:          make(chan outbound, 64),
+		writerDone:    make(chan struct{}),
+		seqs:          make(map[string]*streamSeq),
+		groups:        make(map[string]*queryGroup),
+		subscriptions: make(map[string]*subscription),
+		closed:        make(chan struct{}),
+		ctx:           ctx,
+	}}
+
+	go func() {
+		for {
+			select {
+			case frame := <-conn.send:
+				var msg WSMessage
+				if err := json.Unmarshal(frame.data, &msg); err != nil {
+					t.Errorf("decode frame: %v", err)
+					continue
+				}
+				conn.mu.Lock()
+				conn.messages = append(conn.messages, msg)
+				conn.mu.Unlock()
+			case <-ctx.Done():
+				close(conn.writerDone)
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		conn.QueryQueue.close()
+		cancel()
+	})
+
+	s.scaleWorkers(conn.ConnectionState)
+	return s, conn
+}
+
+// queue queues testQuery on a stream, returning the task that holds it
+func (c *testConnection) queue(t *testing.T, s *Server, streamID, onDuplicate string) (*QueryTask, error) {
+	t.Helper()
+	req := &QueryRequest{StreamID: streamID, QueryID: testQuery, OnDuplicate: onDuplicate}
+	if err := s.queueQuery(context.Background(), c.ConnectionState, req, time.Now()); err != nil {
+		return nil, err
+	}
+	c.TasksMutex.RLock()
+	defer c.TasksMutex.RUnlock()
+	return c.ActiveTasks[streamID], nil
+}
+
+// waitIdle waits for every task of the connection to be released and for
+// the terminal statuses of want executions to be sent
+func (c *testConnection) waitIdle(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		c.TasksMutex.RLock()
+		active := len(c.ActiveTasks)
+		c.TasksMutex.RUnlock()
+		ended := 0
+		for _, n := range c.terminalStatuses() {
+			ended += n
+		}
+		if active == 0 && ended >= want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks still active and %d of %d executions ended", active, ended, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// terminalStatuses counts the terminal statuses sent on each stream
+func (c *testConnection) terminalStatuses() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int)
+	for _, msg := range c.messages {
+		if msg.Type != MessageTypeStatus {
+			continue
+		}
+		if status, _ := msg.Payload["status"].(string); protocol.IsTerminalStatus(status) {
+			counts[msg.StreamID]++
+		}
+	}
+	return counts
+}
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{protocol.StatusQueued, protocol.StatusRunning, true},
+		{protocol.StatusQueued, protocol.StatusCancelled, true},
+		{protocol.StatusQueued, protocol.StatusFailed, true},
+		{protocol.StatusQueued, protocol.StatusCompleted, false},
+		{protocol.StatusRunning, protocol.StatusCompleted, true},
+		{protocol.StatusRunning, protocol.StatusTimeout, true},
+		{protocol.StatusRunning, protocol.StatusQueued, false},
+		{protocol.StatusCancelled, protocol.StatusRunning, false},
+		{protocol.StatusCompleted, protocol.StatusFailed, false},
+	}
+	for _, tt := range tests {
+		task := &QueryTask{Status: tt.from}
+		if got := task.transition(tt.from, tt.to); got != tt.want {
+			t.Errorf("transition %s to %s = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+		if !tt.want && task.Status != tt.from {
+			t.Errorf("refused transition %s to %s left the task %s", tt.from, tt.to, task.Status)
+		}
+	}
+}
+
+func TestRacingTransitionsEndATaskOnce(t *testing.T) {
+	connState := &ConnectionState{}
+	s := &Server{}
+	for i := 0; i < 200; i++ {
+		task := &QueryTask{Status: protocol.StatusQueued}
+
+		// A worker's claim, a cancellation and the queue timeout race
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		won := 0
+		for _, to := range []string{protocol.StatusRunning, protocol.StatusCancelled, protocol.StatusFailed} {
+			wg.Add(1)
+			go func(to string) {
+				defer wg.Done()
+				if s.endTask(connState, task, protocol.StatusQueued, to) {
+					mu.Lock()
+					won++
+					mu.Unlock()
+				}
+			}(to)
+		}
+		wg.Wait()
+		if won != 1 {
+			t.Fatalf("%d goroutines moved the task out of the queue, want 1", won)
+		}
+	}
+}
+
+func TestCancelRacesWorkers(t *testing.T) {
+	s, conn := newTestConnection(t, 4)
+
+	const streams = 60
+	var wg sync.WaitGroup
+	var tasks []*QueryTask
+	for i := 0; i < streams; i++ {
+		streamID := fmt.Sprintf("stream-%d", i)
+		task, err := conn.queue(t, s, streamID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+
+		// Cancel while the task is queued, claimed or running
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i%7) * time.Millisecond)
+			s.handleCancelRequest(conn.ConnectionState, &CancelRequest{StreamID: streamID})
+		}(i)
+	}
+	wg.Wait()
+	conn.waitIdle(t, streams)
+
+	for streamID, n := range conn.terminalStatuses() {
+		if n != 1 {
+			t.Errorf("stream %s ended %d times", streamID, n)
+		}
+	}
+	for _, task := range tasks {
+		if task.Context.Err() == nil {
+			t.Errorf("stream %s released with its context live", task.Request.StreamID)
+		}
+	}
+}
+
+func TestCleanupConnectionEndsEveryTask(t *testing.T) {
+	s, conn := newTestConnection(t, 2)
+
+	const streams = 20
+	var tasks []*QueryTask
+	for i := 0; i < streams; i++ {
+		task, err := conn.queue(t, s, fmt.Sprintf("stream-%d", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	// Some tasks are running, the rest queued, when the connection closes
+	time.Sleep(5 * time.Millisecond)
+	s.cleanupConnection(conn.ConnectionState, false)
+	conn.waitIdle(t, streams)
+
+	counts := conn.terminalStatuses()
+	for _, task := range tasks {
+		if n := counts[task.Request.StreamID]; n != 1 {
+			t.Errorf("stream %s ended %d times", task.Request.StreamID, n)
+		}
+		if task.Context.Err() == nil {
+			t.Errorf("stream %s released with its context live", task.Request.StreamID)
+		}
+	}
+}
+
+func TestReplacingRequestsRaceWorkers(t *testing.T) {
+	s, conn := newTestConnection(t, 3)
+
+	// Several clients replace the same streams at once; each accepted
+	// request ends exactly once, whether it ran or was replaced
+	const streams, requests = 3, 30
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := make(map[string]int)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			streamID := fmt.Sprintf("stream-%d", i%streams)
+			if _, err := conn.queue(t, s, streamID, protocol.DuplicateReplace); err != nil {
+				return
+			}
+			mu.Lock()
+			accepted[streamID]++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range accepted {
+		total += n
+	}
+	conn.waitIdle(t, total)
+
+	counts := conn.terminalStatuses()
+	for streamID, n := range accepted {
+		if counts[streamID] != n {
+			t.Errorf("stream %s ended %d times for %d accepted requests", streamID, counts[streamID], n)
+		}
+	}
+}
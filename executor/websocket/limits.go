@@ -0,0 +1,50 @@
+package websocket
+
+import (
+	"errors"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// errLimitExceeded stops a stream at a safety cap. It ends the stream with
+// a complete message rather than an error.
+var errLimitExceeded = errors.New("stream limit exceeded")
+
+// capStream sets a request's row and byte caps to the tightest of the
+// server's, the organization's and its own
+func (s *Server) capStream(req *QueryRequest, quota runner.Quota) {
+	req.MaxRows = tightestCap(req.MaxRows, s.config.MaxStreamRows, quota.MaxStreamRows)
+	req.MaxBytes = tightestCap(req.MaxBytes, s.config.MaxStreamBytes, quota.MaxStreamBytes)
+}
+
+// tightestCap returns the smallest positive cap, or 0 when none is set
+func tightestCap(caps ...int64) int64 {
+	var tightest int64
+	for _, c := range caps {
+		if c > 0 && (tightest == 0 || c < tightest) {
+			tightest = c
+		}
+	}
+	return tightest
+}
+
+// checkLimits stops the stream before a row that would go past its caps.
+// Bytes are checked against the rows already sent, so the last row may
+// overshoot the byte cap.
+func (k *streamSink) checkLimits() error {
+	req := k.task.Request
+	switch {
+	case req.MaxRows > 0 && k.totalRows >= req.MaxRows:
+		k.exceeded = &protocol.LimitExceeded{Limit: protocol.LimitRows, Max: req.MaxRows}
+	case req.MaxBytes > 0 && k.checksum.Size() >= req.MaxBytes:
+		k.exceeded = &protocol.LimitExceeded{Limit: protocol.LimitBytes, Max: req.MaxBytes}
+	default:
+		return nil
+	}
+	k.s.trace(k.connState, req, "limit_exceeded", map[string]interface{}{
+		"limit":    k.exceeded.Limit,
+		"rowsSent": k.totalRows,
+	})
+	return errLimitExceeded
+}
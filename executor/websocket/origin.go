@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// originPolicy decides which browser origins may open WebSockets and call
+// the HTTP endpoints
+type originPolicy struct {
+	// patterns are scheme://host[:port] origins, where the host may start
+	// with "*." to match any subdomain; "*" matches every origin. A reload
+	// replaces them.
+	mu       sync.RWMutex
+	patterns []string
+}
+
+func newOriginPolicy(allowed []string) *originPolicy {
+	p := &originPolicy{}
+	p.set(allowed)
+	return p
+}
+
+// set replaces the allowed origins
+func (p *originPolicy) set(allowed []string) {
+	var patterns []string
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "/"))
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	p.mu.Lock()
+	p.patterns = patterns
+	p.mu.Unlock()
+}
+
+func (p *originPolicy) allowed() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.patterns
+}
+
+// restricted reports whether an allow-list is configured. Without one every
+// origin may open a WebSocket but no CORS headers are sent.
+func (p *originPolicy) restricted() bool {
+	return len(p.allowed()) > 0
+}
+
+// allows reports whether origin may connect
+func (p *originPolicy) allows(origin string) bool {
+	patterns := p.allowed()
+	if len(patterns) == 0 {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		scheme, host, ok := strings.Cut(pattern, "://")
+		if !ok || scheme != u.Scheme {
+			continue
+		}
+		if sub, ok := strings.CutPrefix(host, "*."); ok {
+			// The wildcard needs at least one label: *.example.com does
+			// not match example.com itself
+			if strings.HasSuffix(u.Host, "."+sub) {
+				return true
+			}
+			continue
+		}
+		if host == u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the upgrader's origin check. Requests without an Origin
+// header come from non-browser clients, which origins do not apply to.
+func (p *originPolicy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || p.allows(origin)
+}
+
+// cors adds CORS headers for allowed origins, refuses the rest and answers
+// preflight requests before they reach the endpoints
+func (p *originPolicy) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !p.restricted() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		// Requests from other origins are refused rather than only hidden
+		// from the page, so simple requests cannot start executions
+		if !p.allows(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Location")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,423 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+const (
+	// Time between rounds of pre-warming when none is configured
+	defaultPrewarmInterval = time.Minute
+
+	// Queries the pre-warmer executes at once
+	prewarmConcurrency = 2
+
+	// Shortest schedule a pre-warmed query may be declared with
+	minPrewarmIntervalSeconds = 60
+
+	// Pre-warmed queries an organization may declare when no limit is
+	// configured
+	defaultMaxPrewarmsPerOrganization = 50
+)
+
+// errPrewarmUnavailable is reported when the metadata store keeps no
+// pre-warmed queries or the result cache is disabled
+var errPrewarmUnavailable = errors.New("query pre-warming is not available")
+
+// PrewarmConfig schedules the queries declared for pre-warming, which are
+// read from the metadata store and executed into the result cache
+type PrewarmConfig struct {
+	// Interval is the time between rounds that read the declared queries
+	// and execute those due (default 1m); negative disables pre-warming
+	Interval time.Duration `toml:"interval"`
+	// MaxPerOrganization caps the queries each organization may declare
+	// (default 50)
+	MaxPerOrganization int `toml:"max_per_organization"`
+}
+
+// prewarmer tracks this executor's runs of the pre-warmed queries
+type prewarmer struct {
+	store runner.PrewarmStore
+	// wake starts a round early, so a query is warmed as it is declared
+	wake chan struct{}
+
+	mu   sync.Mutex
+	runs map[string]*prewarmRun // by pre-warm ID
+}
+
+// prewarmRun is the latest run of a pre-warmed query
+type prewarmRun struct {
+	at   time.Time // zero when the query has been seen but not run
+	rows int64
+	err  string
+}
+
+// newPrewarmer creates the pre-warmer, or returns nil when the store keeps
+// no pre-warmed queries, there is no result cache to warm or the config
+// disables it
+func newPrewarmer(cfg PrewarmConfig, store runner.MetadataStore, cache *runner.ResultCache) *prewarmer {
+	prewarms, ok := store.(runner.PrewarmStore)
+	if !ok || cache == nil || cfg.Interval < 0 {
+		return nil
+	}
+	return &prewarmer{
+		store: prewarms,
+		wake:  make(chan struct{}, 1),
+		runs:  make(map[string]*prewarmRun),
+	}
+}
+
+// runPrewarms executes the pre-warmed queries as they come due, starting
+// as the server does, for as long as the process runs
+func (s *Server) runPrewarms() {
+	interval := s.config.Prewarm.Interval
+	if interval <= 0 {
+		interval = defaultPrewarmInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for startup := true; ; startup = false {
+		if !s.Draining() {
+			s.prewarmDue(startup)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.prewarms.wake:
+		}
+	}
+}
+
+// prewarmDue runs one round, executing the pre-warmed queries that are due
+func (s *Server) prewarmDue(startup bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectorStatusTimeout)
+	prewarms, err := s.prewarms.store.ListPrewarms(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Skipping query pre-warming: %v", err)
+		return
+	}
+
+	due := s.prewarms.due(prewarms, startup, time.Now())
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, prewarmConcurrency)
+	for _, p := range due {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(p *runner.Prewarm) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.prewarm(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// due returns the pre-warmed queries to execute in a round. At startup
+// those marked OnStartup or scheduled are due; afterwards those declared
+// since the last round, and scheduled ones whose interval has passed.
+// Queries no longer declared are forgotten.
+func (w *prewarmer) due(prewarms []runner.Prewarm, startup bool, now time.Time) []*runner.Prewarm {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	declared := make(map[string]bool, len(prewarms))
+	var due []*runner.Prewarm
+	for i := range prewarms {
+		p := &prewarms[i]
+		declared[p.ID] = true
+		run, seen := w.runs[p.ID]
+		switch {
+		case !seen:
+			w.runs[p.ID] = &prewarmRun{}
+			if !startup || p.OnStartup || p.IntervalSeconds > 0 {
+				due = append(due, p)
+			}
+		case p.IntervalSeconds > 0 && now.Sub(run.at) >= p.Interval():
+			due = append(due, p)
+		}
+	}
+	for id := range w.runs {
+		if !declared[id] {
+			delete(w.runs, id)
+		}
+	}
+	return due
+}
+
+// prewarm executes a pre-warmed query into the result cache and records
+// the run. Runs count against the declaring organization's quota like its
+// own queries, and are skipped while it is rate limited or out of scan
+// budget.
+func (s *Server) prewarm(p *runner.Prewarm) {
+	ctx := context.Background()
+	if limit := s.config.ExecutionTimeout; limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	var org *Principal
+	if p.OrganizationID != "" {
+		org = &Principal{OrganizationID: p.OrganizationID}
+	}
+	var rows int64
+	_, releaseQuota, err := s.quotas.acquire(ctx, org)
+	if err == nil {
+		var engine driver.ProgressReporter
+		rows, err = runner.WarmResult(ctx, s.store, p, runner.ExecuteOptions{
+			Timeouts:           s.config.Timeouts,
+			Constants:          s.config.TemplateConstants,
+			TemplateMode:       s.config.TemplateMode,
+			ValidateSQL:        s.config.ValidateSQL,
+			Keyring:            s.keyring,
+			Secrets:            s.secretResolver(),
+			ResultCache:        s.resultCache,
+			WarmPool:           s.warmPool,
+			MetadataCache:      s.metadataCache,
+			Memory:             s.config.Memory,
+			OnProgressReporter: func(r driver.ProgressReporter) { engine = r },
+		})
+		releaseQuota()
+		if engine != nil {
+			s.quotas.charge(org, engine.Progress())
+		}
+	}
+	run := &prewarmRun{at: time.Now(), rows: rows}
+	if err != nil {
+		run.err = redact.Message(err.Error())
+		log.Printf("Failed to pre-warm query %s (%s): %s", p.QueryID, p.ID, run.err)
+	}
+
+	s.prewarms.mu.Lock()
+	defer s.prewarms.mu.Unlock()
+	if _, ok := s.prewarms.runs[p.ID]; ok {
+		s.prewarms.runs[p.ID] = run
+	}
+}
+
+// wakeUp starts a round without waiting for the interval
+func (w *prewarmer) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// record describes a pre-warmed query with its latest run on this executor
+func (w *prewarmer) record(p *runner.Prewarm) protocol.PrewarmedQuery {
+	record := protocol.PrewarmedQuery{
+		ID:              p.ID,
+		QueryID:         p.QueryID,
+		ParameterSet:    p.ParameterSet,
+		TemplateData:    p.TemplateData,
+		Timezone:        p.Timezone,
+		IntervalSeconds: p.IntervalSeconds,
+		OnStartup:       p.OnStartup,
+		CreatedAt:       p.CreatedAt,
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if run := w.runs[p.ID]; run != nil && !run.at.IsZero() {
+		at := run.at
+		record.LastRunAt, record.LastError, record.LastRows = &at, run.err, run.rows
+	}
+	return record
+}
+
+// visiblePrewarms lists the pre-warmed queries caller may see: those of
+// its organization, and for API keys limited to some queries only theirs
+func (s *Server) visiblePrewarms(ctx context.Context, caller *Principal) ([]runner.Prewarm, error) {
+	if s.prewarms == nil {
+		return nil, errPrewarmUnavailable
+	}
+	prewarms, err := s.prewarms.store.ListPrewarms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var visible []runner.Prewarm
+	for _, p := range prewarms {
+		if p.OrganizationID != organizationOf(caller) {
+			continue
+		}
+		if caller != nil && len(caller.QueryIDs) > 0 && !slices.Contains(caller.QueryIDs, p.QueryID) {
+			continue
+		}
+		visible = append(visible, p)
+	}
+	return visible, nil
+}
+
+// restPrewarmRequest is the body of POST /api/v1/prewarms
+type restPrewarmRequest struct {
+	QueryID         string                 `json:"queryId"`
+	ParameterSet    string                 `json:"parameterSet,omitempty"`
+	TemplateData    map[string]interface{} `json:"templateData,omitempty"`
+	Timezone        string                 `json:"timezone,omitempty"`
+	IntervalSeconds int64                  `json:"intervalSeconds,omitempty"`
+	OnStartup       bool                   `json:"onStartup,omitempty"`
+}
+
+// handleRESTPrewarms lists the caller's pre-warmed queries for
+// GET /api/v1/prewarms
+func (s *Server) handleRESTPrewarms(w http.ResponseWriter, r *http.Request) {
+	prewarms, err := s.visiblePrewarms(r.Context(), principalFrom(r.Context()))
+	if errors.Is(err, errPrewarmUnavailable) {
+		writeJSONError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	records := []protocol.PrewarmedQuery{}
+	for i := range prewarms {
+		records = append(records, s.prewarms.record(&prewarms[i]))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"prewarms": records})
+}
+
+// handleRESTDeclarePrewarm declares a query to pre-warm for
+// POST /api/v1/prewarms. The query is executed right away, then on its
+// schedule.
+func (s *Server) handleRESTDeclarePrewarm(w http.ResponseWriter, r *http.Request) {
+	if s.prewarms == nil {
+		writeJSONError(w, http.StatusNotImplemented, errPrewarmUnavailable)
+		return
+	}
+	var body restPrewarmRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRESTBodySize)).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if err := validatePrewarm(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	caller := principalFrom(r.Context())
+	_, err := runner.LoadQuery(r.Context(), s.store, body.QueryID, runner.ExecuteOptions{
+		Timeouts:      s.config.Timeouts,
+		MetadataCache: s.metadataCache,
+		Caller:        caller.caller(),
+	})
+	if err != nil {
+		writeJSONError(w, executionStatus(err), err)
+		return
+	}
+
+	if err := s.checkPrewarmLimit(r.Context(), organizationOf(caller)); err != nil {
+		var limited *prewarmLimitError
+		if errors.As(err, &limited) {
+			writeJSONError(w, http.StatusConflict, err)
+		} else {
+			writeJSONError(w, http.StatusBadGateway, err)
+		}
+		return
+	}
+
+	p := runner.Prewarm{
+		ID:              uuid.NewString(),
+		OrganizationID:  organizationOf(caller),
+		QueryID:         body.QueryID,
+		ParameterSet:    body.ParameterSet,
+		TemplateData:    body.TemplateData,
+		Timezone:        body.Timezone,
+		IntervalSeconds: body.IntervalSeconds,
+		OnStartup:       body.OnStartup,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if err := s.prewarms.store.SavePrewarm(r.Context(), p); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	s.prewarms.wakeUp()
+	writeJSON(w, http.StatusCreated, s.prewarms.record(&p))
+}
+
+// prewarmLimitError rejects a declaration over the organization's limit
+type prewarmLimitError struct {
+	max int
+}
+
+func (e *prewarmLimitError) Error() string {
+	return fmt.Sprintf("organization already has the most pre-warmed queries allowed, %d", e.max)
+}
+
+// checkPrewarmLimit checks an organization may declare another pre-warmed
+// query
+func (s *Server) checkPrewarmLimit(ctx context.Context, orgID string) error {
+	max := s.config.Prewarm.MaxPerOrganization
+	if max <= 0 {
+		max = defaultMaxPrewarmsPerOrganization
+	}
+	prewarms, err := s.prewarms.store.ListPrewarms(ctx)
+	if err != nil {
+		return err
+	}
+	declared := 0
+	for _, p := range prewarms {
+		if p.OrganizationID == orgID {
+			declared++
+		}
+	}
+	if declared >= max {
+		return &prewarmLimitError{max: max}
+	}
+	return nil
+}
+
+// validatePrewarm checks a pre-warm declaration before its query is looked
+// up
+func validatePrewarm(body *restPrewarmRequest) error {
+	if body.QueryID == "" {
+		return errors.New("queryId is required")
+	}
+	if body.IntervalSeconds != 0 && body.IntervalSeconds < minPrewarmIntervalSeconds {
+		return fmt.Errorf("intervalSeconds must be zero or at least %d, got %d", minPrewarmIntervalSeconds, body.IntervalSeconds)
+	}
+	if body.Timezone != "" {
+		if _, err := time.LoadLocation(body.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", body.Timezone)
+		}
+	}
+	return nil
+}
+
+// handleRESTDeletePrewarm stops pre-warming a query for
+// DELETE /api/v1/prewarms/{id}. Its cached result is left to expire.
+func (s *Server) handleRESTDeletePrewarm(w http.ResponseWriter, r *http.Request) {
+	prewarms, err := s.visiblePrewarms(r.Context(), principalFrom(r.Context()))
+	if errors.Is(err, errPrewarmUnavailable) {
+		writeJSONError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	id := r.PathValue("id")
+	if !slices.ContainsFunc(prewarms, func(p runner.Prewarm) bool { return p.ID == id }) {
+		writeJSONError(w, http.StatusNotFound, runner.ErrPrewarmNotFound)
+		return
+	}
+	if err := s.prewarms.store.DeletePrewarm(r.Context(), id); err != nil && !errors.Is(err, runner.ErrPrewarmNotFound) {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/runner"
+)
+
+// progressReporter periodically sends a stream's progress: rows streamed,
+// elapsed time and, for engines that report them, bytes scanned and an
+// estimate of the time remaining
+type progressReporter struct {
+	mu     sync.Mutex
+	engine driver.ProgressReporter
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+// startProgress begins reporting progress for a task until stop is called
+func (s *Server) startProgress(connState *ConnectionState, task *QueryTask) *progressReporter {
+	p := &progressReporter{stopCh: make(chan struct{}), done: make(chan struct{})}
+	started := time.Now()
+
+	go func() {
+		defer close(p.done)
+		// A driver that panics reporting progress stops the reports only
+		defer func() { runner.Recovered(recover(), "progress of stream "+task.Request.StreamID) }()
+		ticker := time.NewTicker(s.progressInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-task.Context.Done():
+				return
+			case <-ticker.C:
+			}
+
+			elapsed := time.Since(started)
+			payload := map[string]interface{}{
+				"rowsStreamed": task.RowsSent.Load(),
+				"elapsedMs":    elapsed.Milliseconds(),
+			}
+			if engine := p.source(); engine != nil {
+				progress := engine.Progress()
+				if progress.BytesScanned > 0 {
+					payload["bytesScanned"] = progress.BytesScanned
+				}
+				if progress.Fraction > 0 {
+					fraction := min(progress.Fraction, 1)
+					payload["fraction"] = fraction
+					remaining := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+					payload["estimatedRemainingMs"] = remaining.Milliseconds()
+				}
+			}
+
+			s.sendMessage(connState.Conn, WSMessage{
+				Type:     MessageTypeProgress,
+				StreamID: task.Request.StreamID,
+				Payload:  payload,
+			}, connState)
+		}
+	}()
+	return p
+}
+
+// setSource records the driver reporting the engine's progress
+func (p *progressReporter) setSource(engine driver.ProgressReporter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.engine = engine
+}
+
+func (p *progressReporter) source() driver.ProgressReporter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.engine
+}
+
+// stop ends reporting; once it returns no further progress is sent
+func (p *progressReporter) stop() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+	<-p.done
+}
+
+func (s *Server) progressInterval() time.Duration {
+	if s.config.ProgressInterval > 0 {
+		return s.config.ProgressInterval
+	}
+	return defaultProgressInterval
+}
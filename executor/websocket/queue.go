@@ -0,0 +1,289 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"supalytics-executor/hooks"
+	"supalytics-executor/protocol"
+)
+
+// errQueueTimeout fails a task that waited in the queue longer than
+// queue_timeout
+var errQueueTimeout = errors.New("timed out waiting in the queue")
+
+// Weight of the latest run in a queue's average run time
+const runTimeWeight = 0.2
+
+// priorityLevels orders the query priorities, highest first. Exports rank
+// above background work because a user is waiting for the download.
+var priorityLevels = []string{protocol.PriorityInteractive, protocol.PriorityExport, protocol.PriorityBackground}
+
+// priorityLevel returns the queue level of a priority; requests without
+// one are interactive
+func priorityLevel(priority string) (int, bool) {
+	if priority == "" {
+		return 0, true
+	}
+	for i, p := range priorityLevels {
+		if p == priority {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// taskQueue holds a connection's queued tasks. Workers take the oldest task
+// of the highest priority waiting, so interactive queries overtake queued
+// background refreshes and exports.
+type taskQueue struct {
+	mu       sync.Mutex
+	capacity int
+	levels   [][]*QueryTask
+	size     int
+	// avgRun is a moving average of how long dequeued tasks ran, zero
+	// until one has finished
+	avgRun time.Duration
+
+	// ready holds a token while tasks may be waiting; each worker that
+	// takes a task passes the token on if any are left
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTaskQueue(capacity int) *taskQueue {
+	return &taskQueue{
+		capacity: capacity,
+		levels:   make([][]*QueryTask, len(priorityLevels)),
+		ready:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// push queues a task, reporting false when the queue is full or closed.
+// A task accepted earlier, which waited behind another on its stream, is
+// queued past the capacity.
+func (q *taskQueue) push(task *QueryTask, accepted bool) bool {
+	level, _ := priorityLevel(task.Request.Priority)
+
+	q.mu.Lock()
+	select {
+	case <-q.closed:
+		q.mu.Unlock()
+		return false
+	default:
+	}
+	if q.size >= q.capacity && !accepted {
+		q.mu.Unlock()
+		return false
+	}
+	q.levels[level] = append(q.levels[level], task)
+	q.size++
+	q.mu.Unlock()
+
+	q.signal()
+	return true
+}
+
+// pop waits for the next task, returning false once ctx ends or the queue
+// is closed
+func (q *taskQueue) pop(ctx context.Context) (*QueryTask, bool) {
+	for {
+		// A worker stopped by a reload or a closed connection takes no
+		// further task
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		select {
+		case <-q.closed:
+			return nil, false
+		default:
+		}
+		q.mu.Lock()
+		for level, tasks := range q.levels {
+			if len(tasks) == 0 {
+				continue
+			}
+			task := tasks[0]
+			tasks[0] = nil
+			q.levels[level] = tasks[1:]
+			q.size--
+			more := q.size > 0
+			q.mu.Unlock()
+			if more {
+				q.signal()
+			}
+			return task, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-q.closed:
+			return nil, false
+		case <-q.ready:
+		}
+	}
+}
+
+func (q *taskQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// setCapacity changes how many tasks the queue holds. Tasks already queued
+// beyond a lower capacity stay queued.
+func (q *taskQueue) setCapacity(capacity int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.capacity = capacity
+}
+
+// limit returns how many tasks the queue holds
+func (q *taskQueue) limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.capacity
+}
+
+// len returns the number of queued tasks
+func (q *taskQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// position returns the 1-based place of a task in the order workers will
+// take them, or 0 when it is no longer queued
+func (q *taskQueue) position(task *QueryTask) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ahead := 0
+	for _, tasks := range q.levels {
+		for _, t := range tasks {
+			ahead++
+			if t == task {
+				return ahead
+			}
+		}
+	}
+	return 0
+}
+
+// remove takes a task out of the queue, reporting false when a worker
+// already took it
+func (q *taskQueue) remove(task *QueryTask) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for level, tasks := range q.levels {
+		for i, t := range tasks {
+			if t == task {
+				q.levels[level] = append(tasks[:i:i], tasks[i+1:]...)
+				q.size--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// observe records how long a dequeued task ran
+func (q *taskQueue) observe(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.avgRun == 0 {
+		q.avgRun = d
+		return
+	}
+	q.avgRun = time.Duration(runTimeWeight*float64(d) + (1-runTimeWeight)*float64(q.avgRun))
+}
+
+// estimateWait guesses how long the task at position will wait with
+// workers busy, assuming queued tasks run as long as recent ones did. It
+// returns false until a task has finished.
+func (q *taskQueue) estimateWait(position int, workers int) (time.Duration, bool) {
+	q.mu.Lock()
+	avg := q.avgRun
+	q.mu.Unlock()
+	if avg == 0 || position <= 0 {
+		return 0, false
+	}
+	workers = max(workers, 1)
+	// With every worker busy, the first workers tasks start after about one
+	// run, the next workers after two, and so on
+	rounds := (position + workers - 1) / workers
+	return time.Duration(rounds) * avg, true
+}
+
+// close stops the queue; waiting workers return
+func (q *taskQueue) close() {
+	q.once.Do(func() { close(q.closed) })
+}
+
+// watchQueued reports a queued task's position and estimated wait every
+// progress interval until a worker takes it, failing it once it has waited
+// longer than queue_timeout
+func (s *Server) watchQueued(connState *ConnectionState, task *QueryTask) {
+	queue := connState.QueryQueue
+	ticker := time.NewTicker(s.progressInterval())
+	defer ticker.Stop()
+
+	var timeout <-chan time.Time
+	if s.config.QueueTimeout > 0 {
+		timer := time.NewTimer(s.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-task.Context.Done():
+			return
+		case <-timeout:
+			if s.endTask(connState, task, protocol.StatusQueued, protocol.StatusFailed) {
+				queue.remove(task)
+				s.failQueued(connState, task, fmt.Errorf("%w after %s", errQueueTimeout, s.config.QueueTimeout))
+			}
+			return
+		case <-ticker.C:
+		}
+
+		position := queue.position(task)
+		if position == 0 {
+			return
+		}
+		connState.TasksMutex.RLock()
+		workers := connState.QueueWorkers
+		connState.TasksMutex.RUnlock()
+
+		details := map[string]interface{}{
+			"position":  position,
+			"queueSize": queue.len(),
+			"waitedMs":  time.Since(task.QueuedAt).Milliseconds(),
+		}
+		if wait, ok := queue.estimateWait(position, workers); ok {
+			details["estimatedWaitMs"] = wait.Milliseconds()
+		}
+		s.sendStatusDetails(connState.Conn, task.Request.StreamID, protocol.StatusQueued, details, connState)
+	}
+}
+
+// failQueued reports a task that failed without leaving the queue
+func (s *Server) failQueued(connState *ConnectionState, task *QueryTask, err error) {
+	s.sendFailure(connState.Conn, task.Request.StreamID, err, connState)
+	s.sendStatus(connState.Conn, task.Request.StreamID, protocol.StatusFailed, connState)
+
+	connState.TasksMutex.Lock()
+	s.releaseTask(connState, task)
+	connState.TasksMutex.Unlock()
+
+	s.recordAudit(connState, task, err)
+	s.fireEvent(connState, task, hooks.EventFailed, err)
+}
@@ -0,0 +1,174 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"supalytics-executor/protocol"
+)
+
+func queuedTask(streamID, priority string) *QueryTask {
+	return &QueryTask{
+		Request: &QueryRequest{StreamID: streamID, Priority: priority},
+		Status:  protocol.StatusQueued,
+	}
+}
+
+func TestTaskQueueTakesTheHighestPriorityFirst(t *testing.T) {
+	q := newTaskQueue(10)
+	background := queuedTask("background", protocol.PriorityBackground)
+	export := queuedTask("export", protocol.PriorityExport)
+	first := queuedTask("first", "")
+	second := queuedTask("second", protocol.PriorityInteractive)
+	for _, task := range []*QueryTask{background, export, first, second} {
+		if !q.push(task, false) {
+			t.Fatalf("push %s refused", task.Request.StreamID)
+		}
+	}
+
+	if got := q.position(background); got != 4 {
+		t.Fatalf("background task at position %d, want 4", got)
+	}
+	for _, want := range []*QueryTask{first, second, export, background} {
+		got, ok := q.pop(context.Background())
+		if !ok {
+			t.Fatal("pop returned no task")
+		}
+		if got != want {
+			t.Fatalf("popped %s, want %s", got.Request.StreamID, want.Request.StreamID)
+		}
+	}
+}
+
+func TestTaskQueueRefusesTasksPastItsCapacity(t *testing.T) {
+	q := newTaskQueue(1)
+	if !q.push(queuedTask("a", ""), false) {
+		t.Fatal("push into an empty queue refused")
+	}
+	if q.push(queuedTask("b", ""), false) {
+		t.Fatal("push into a full queue accepted")
+	}
+	// A task accepted earlier is queued past the capacity
+	if !q.push(queuedTask("c", ""), true) {
+		t.Fatal("push of an accepted task refused")
+	}
+	q.close()
+	if q.push(queuedTask("d", ""), true) {
+		t.Fatal("push into a closed queue accepted")
+	}
+}
+
+func TestTaskQueueHandsOutEachTaskOnce(t *testing.T) {
+	const (
+		pushers    = 4
+		workers    = 4
+		perPusher  = 250
+		totalTasks = pushers * perPusher
+	)
+	q := newTaskQueue(totalTasks)
+	priorities := []string{protocol.PriorityInteractive, protocol.PriorityExport, protocol.PriorityBackground}
+
+	var mu sync.Mutex
+	taken := make(map[*QueryTask]int)
+	take := func(task *QueryTask) {
+		mu.Lock()
+		taken[task]++
+		mu.Unlock()
+	}
+
+	// Workers pop while pushers push and a canceller removes, as a
+	// connection's workers, requests and cancellations do
+	var workersDone sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			for {
+				task, ok := q.pop(context.Background())
+				if !ok {
+					return
+				}
+				take(task)
+			}
+		}()
+	}
+
+	pushed := make(chan *QueryTask, totalTasks)
+	var pushersDone sync.WaitGroup
+	for p := 0; p < pushers; p++ {
+		pushersDone.Add(1)
+		go func(p int) {
+			defer pushersDone.Done()
+			for i := 0; i < perPusher; i++ {
+				task := queuedTask(fmt.Sprintf("stream-%d-%d", p, i), priorities[i%len(priorities)])
+				if !q.push(task, false) {
+					t.Errorf("push %s refused", task.Request.StreamID)
+					return
+				}
+				pushed <- task
+			}
+		}(p)
+	}
+
+	removerDone := make(chan struct{})
+	go func() {
+		defer close(removerDone)
+		n := 0
+		for task := range pushed {
+			n++
+			if n%3 == 0 && q.remove(task) {
+				take(task)
+			}
+			q.position(task)
+		}
+	}()
+
+	pushersDone.Wait()
+	close(pushed)
+	<-removerDone
+
+	deadline := time.Now().Add(10 * time.Second)
+	for q.len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tasks left in the queue", q.len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.close()
+	workersDone.Wait()
+
+	if len(taken) != totalTasks {
+		t.Fatalf("%d tasks taken, want %d", len(taken), totalTasks)
+	}
+	for task, n := range taken {
+		if n != 1 {
+			t.Fatalf("task %s taken %d times", task.Request.StreamID, n)
+		}
+	}
+}
+
+func TestTaskQueueCloseReleasesWaitingWorkers(t *testing.T) {
+	q := newTaskQueue(10)
+	done := make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, ok := q.pop(context.Background())
+			done <- ok
+		}()
+	}
+
+	q.close()
+	for i := 0; i < 3; i++ {
+		select {
+		case ok := <-done:
+			if ok {
+				t.Fatal("pop from a closed queue returned a task")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker still waiting after the queue closed")
+		}
+	}
+}
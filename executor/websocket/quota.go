@@ -0,0 +1,263 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// Time an organization's quota is cached, unless configured with
+// quotas.cache_ttl
+const defaultQuotaCacheTTL = time.Minute
+
+// QuotaConfig sets the quota of organizations without a row in the
+// organization_quotas table; zero leaves a limit off
+type QuotaConfig struct {
+	runner.Quota
+	// CacheTTL is how long quotas read from the metadata store are reused
+	// (default 1m)
+	CacheTTL time.Duration `toml:"cache_ttl"`
+}
+
+// rateLimitError rejects a request that would exceed its organization's
+// quota
+type rateLimitError struct {
+	reason string
+	// retryAfter is when a per-minute limit or scan budget frees up; zero
+	// for limits that free up as queries finish
+	retryAfter time.Duration
+	// code is the error code reported; rate_limited when empty
+	code string
+}
+
+func (e *rateLimitError) Error() string {
+	return "rate limited: " + e.reason
+}
+
+// errorCode returns the error code clients receive for the rejection
+func (e *rateLimitError) errorCode() string {
+	if e.code != "" {
+		return e.code
+	}
+	return protocol.ErrorCodeRateLimited
+}
+
+// quotaTracker counts each organization's running and recent queries
+// against its quota. Only authenticated callers belong to an organization;
+// the rest are not limited.
+type quotaTracker struct {
+	store runner.QuotaStore
+
+	mu       sync.Mutex
+	defaults runner.Quota
+	ttl      time.Duration
+	orgs     map[string]*orgUsage
+}
+
+// orgUsage is an organization's quota and what it is using
+type orgUsage struct {
+	quota    runner.Quota
+	loadedAt time.Time
+	running  int
+	starts   []time.Time // within the last minute, oldest first
+	// scanned is the data charged to the organization since month began
+	month   time.Time
+	scanned int64
+}
+
+func newQuotaTracker(cfg QuotaConfig, store runner.MetadataStore) *quotaTracker {
+	quotas, _ := store.(runner.QuotaStore)
+	t := &quotaTracker{store: quotas, orgs: make(map[string]*orgUsage)}
+	t.configure(cfg)
+	return t
+}
+
+// configure sets the default quota and cache TTL. Cached quotas are loaded
+// again on each organization's next query; usage carries over.
+func (t *quotaTracker) configure(cfg QuotaConfig) {
+	ttl := cfg.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultQuotaCacheTTL
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.defaults, t.ttl = cfg.Quota, ttl
+	for _, u := range t.orgs {
+		u.loadedAt = time.Time{}
+	}
+}
+
+// acquire admits a query for caller, returning its organization's quota and
+// the release to call once the query has finished
+func (t *quotaTracker) acquire(ctx context.Context, caller *Principal) (runner.Quota, func(), error) {
+	orgID := organizationOf(caller)
+	if orgID == "" {
+		return runner.Quota{}, func() {}, nil
+	}
+
+	t.mu.Lock()
+	u := t.orgs[orgID]
+	stale := u == nil || time.Since(u.loadedAt) > t.ttl
+	t.mu.Unlock()
+	// The store is read without the lock so other organizations do not
+	// wait on it
+	if stale {
+		quota := t.load(ctx, orgID)
+		// Usage is reread with the quota so scans recorded by other
+		// replicas count too
+		month := monthStart(time.Now())
+		var scanned *int64
+		if quota != nil && quota.MaxBytesScannedPerMonth > 0 {
+			scanned = t.loadScanned(ctx, orgID, month)
+		}
+		t.mu.Lock()
+		if u = t.orgs[orgID]; u == nil {
+			u = &orgUsage{}
+			t.orgs[orgID] = u
+		}
+		if quota != nil {
+			u.quota = *quota
+		}
+		if scanned != nil {
+			u.month, u.scanned = month, *scanned
+		}
+		u.loadedAt = time.Now()
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for len(u.starts) > 0 && now.Sub(u.starts[0]) >= time.Minute {
+		u.starts = u.starts[1:]
+	}
+	q := u.quota
+	u.rollover(now)
+	if q.MaxBytesScannedPerMonth > 0 && u.scanned >= q.MaxBytesScannedPerMonth {
+		return q, nil, &rateLimitError{
+			reason:     fmt.Sprintf("organization has used its monthly scan budget of %d bytes", q.MaxBytesScannedPerMonth),
+			retryAfter: u.month.AddDate(0, 1, 0).Sub(now),
+			code:       protocol.ErrorCodeScanBudgetExceeded,
+		}
+	}
+	if q.MaxQueriesPerMinute > 0 && len(u.starts) >= q.MaxQueriesPerMinute {
+		return q, nil, &rateLimitError{
+			reason:     fmt.Sprintf("organization allows %d queries per minute", q.MaxQueriesPerMinute),
+			retryAfter: u.starts[0].Add(time.Minute).Sub(now),
+		}
+	}
+	if q.MaxConcurrentQueries > 0 && u.running >= q.MaxConcurrentQueries {
+		return q, nil, &rateLimitError{reason: fmt.Sprintf("organization allows %d concurrent queries", q.MaxConcurrentQueries)}
+	}
+	u.starts = append(u.starts, now)
+	u.running++
+
+	var once sync.Once
+	return q, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			u.running--
+			t.mu.Unlock()
+		})
+	}, nil
+}
+
+// charge counts the data an execution for caller scanned against its
+// organization's monthly scan budget: the bytes billed where the engine
+// reports them, otherwise the bytes scanned
+func (t *quotaTracker) charge(caller *Principal, scan driver.Progress) {
+	bytes := scan.BytesScanned
+	if scan.BytesBilled > 0 {
+		bytes = scan.BytesBilled
+	}
+	orgID := organizationOf(caller)
+	if orgID == "" || bytes <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if u := t.orgs[orgID]; u != nil {
+		u.rollover(time.Now())
+		u.scanned += bytes
+	}
+}
+
+// rollover starts counting scans afresh when a new month begins; the
+// caller holds the tracker's lock
+func (u *orgUsage) rollover(now time.Time) {
+	if month := monthStart(now); !u.month.Equal(month) {
+		u.month, u.scanned = month, 0
+	}
+}
+
+// monthStart returns the start of t's calendar month in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// loadScanned reads how much an organization has scanned since month
+// began, or nil when the store cannot say
+func (t *quotaTracker) loadScanned(ctx context.Context, orgID string, month time.Time) *int64 {
+	usage, ok := t.store.(runner.ScanUsageStore)
+	if !ok {
+		return nil
+	}
+	scanned, err := usage.ScannedBytes(ctx, orgID, month)
+	if err != nil {
+		log.Printf("Failed to load scan usage for organization %s: %v", orgID, err)
+		return nil
+	}
+	return &scanned
+}
+
+// load reads an organization's quota, falling back to the defaults for
+// organizations without one. It returns nil when the store fails, keeping
+// whatever quota was loaded before.
+func (t *quotaTracker) load(ctx context.Context, orgID string) *runner.Quota {
+	t.mu.Lock()
+	defaults := t.defaults
+	t.mu.Unlock()
+	if t.store == nil {
+		return &defaults
+	}
+	q, err := t.store.FetchQuota(ctx, orgID)
+	if errors.Is(err, runner.ErrQuotaNotFound) {
+		return &defaults
+	}
+	if err != nil {
+		log.Printf("Failed to load quota for organization %s: %v", orgID, err)
+		return nil
+	}
+	return q
+}
+
+// capRows limits a request to max rows. Pages are capped and previews
+// shortened; counts and aggregates return a single row and are left alone.
+func (s *Server) capRows(req *QueryRequest, max int64) {
+	switch {
+	case max <= 0, req.CountOnly, len(req.Aggregates) > 0:
+	case req.Preview:
+		req.PreviewRows = min(s.previewRows(req), max)
+	case req.Limit == 0 || req.Limit > max:
+		req.Limit = max
+	}
+}
+
+// writeRateLimited reports a rate limited HTTP request
+func writeRateLimited(w http.ResponseWriter, err *rateLimitError) {
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	}
+	writeJSONError(w, http.StatusTooManyRequests, err)
+}
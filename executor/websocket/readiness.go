@@ -0,0 +1,236 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+// Time allowed for each readiness check, unless configured with
+// readiness.timeout
+const defaultReadinessTimeout = 2 * time.Second
+
+// Readiness statuses. Degraded servers are still ready: they keep serving
+// cached metadata.
+const (
+	ReadinessReady    = "ready"
+	ReadinessDegraded = "degraded"
+	ReadinessNotReady = "not_ready"
+	ReadinessDraining = "draining"
+)
+
+// Check statuses
+const (
+	checkOK       = "ok"
+	checkDegraded = "degraded"
+	checkFailed   = "failed"
+)
+
+// ReadinessConfig sets what /readyz verifies beyond the metadata store
+type ReadinessConfig struct {
+	// MaxQueuedStreams reports the server not ready once this many streams
+	// wait for a worker across its connections; zero leaves it off
+	MaxQueuedStreams int `toml:"max_queued_streams"`
+	// CanaryConnector is pinged on every check, and the server reported not
+	// ready while it cannot be reached
+	CanaryConnector string `toml:"canary_connector"`
+	// Timeout bounds each check (default 2s)
+	Timeout time.Duration `toml:"timeout"`
+	// CacheTTL reuses a result for this long so frequent probes do not
+	// load the metadata store or the canary; zero checks every time
+	CacheTTL time.Duration `toml:"cache_ttl"`
+}
+
+// ReadinessCheck is the outcome of one readiness check
+type ReadinessCheck struct {
+	Status    string                 `json:"status"` // "ok", "degraded" or "failed"
+	Error     string                 `json:"error,omitempty"`
+	LatencyMS int64                  `json:"latencyMs"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Readiness reports whether the server should be sent traffic, with the
+// checks that decided it
+type Readiness struct {
+	Status     string                    `json:"status"`
+	InstanceID string                    `json:"instanceId"`
+	CheckedAt  time.Time                 `json:"checkedAt"`
+	Checks     map[string]ReadinessCheck `json:"checks,omitempty"`
+	// MetadataStore is the store's own account of its availability
+	MetadataStore *runner.StoreHealth `json:"metadataStore,omitempty"`
+}
+
+// readinessCache holds the last readiness result
+type readinessCache struct {
+	mu     sync.Mutex
+	result *Readiness
+}
+
+// handleLive reports liveness for GET /healthz: the process is up and
+// serving requests. It checks no dependencies, so orchestrators restart
+// the server only when it has stopped responding.
+func (s *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "alive",
+		"instanceId": s.routing.instanceID,
+		"startedAt":  s.startedAt,
+		"uptime":     time.Since(s.startedAt).Round(time.Second).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"draining":   s.Draining(),
+	})
+}
+
+// handleReady reports readiness for GET /readyz: 200 when ready or
+// degraded, 503 when not ready or draining
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := s.Readiness(r.Context())
+	status := http.StatusOK
+	if ready.Status == ReadinessNotReady || ready.Status == ReadinessDraining {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
+
+// Readiness checks the metadata store can be reached, the queues have
+// room and, when configured, the canary connector answers
+func (s *Server) Readiness(ctx context.Context) Readiness {
+	if s.Draining() {
+		// Load balancers stop routing here while in-flight work finishes
+		return Readiness{Status: ReadinessDraining, InstanceID: s.routing.instanceID, CheckedAt: time.Now()}
+	}
+
+	cfg := s.config.Readiness
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+	if cached := s.readiness.result; cached != nil && time.Since(cached.CheckedAt) < cfg.CacheTTL {
+		return *cached
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	checks := map[string]func(ctx context.Context) ReadinessCheck{
+		"metadata": s.checkMetadata,
+		"queue":    s.checkQueue,
+	}
+	if cfg.CanaryConnector != "" {
+		checks["canary"] = s.checkCanary
+	}
+
+	result := Readiness{
+		Status:     ReadinessReady,
+		InstanceID: s.routing.instanceID,
+		Checks:     make(map[string]ReadinessCheck, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) ReadinessCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			outcome := check(ctx)
+			outcome.LatencyMS = time.Since(start).Milliseconds()
+			mu.Lock()
+			result.Checks[name] = outcome
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	for _, check := range result.Checks {
+		switch {
+		case check.Status == checkFailed:
+			result.Status = ReadinessNotReady
+		case check.Status == checkDegraded && result.Status == ReadinessReady:
+			result.Status = ReadinessDegraded
+		}
+	}
+	if reporter, ok := s.store.(runner.HealthReporter); ok {
+		health := reporter.Health()
+		result.MetadataStore = &health
+	}
+	result.CheckedAt = time.Now()
+	s.readiness.result = &result
+	return result
+}
+
+// checkMetadata pings the metadata store. A store serving cached metadata
+// through an outage is degraded rather than failed.
+func (s *Server) checkMetadata(ctx context.Context) ReadinessCheck {
+	reporter, caching := s.store.(runner.HealthReporter)
+	if pinger, ok := s.store.(runner.StorePinger); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			if caching {
+				return ReadinessCheck{Status: checkDegraded, Error: fmt.Sprintf("serving cached metadata: %v", err)}
+			}
+			return ReadinessCheck{Status: checkFailed, Error: err.Error()}
+		}
+	}
+	if caching {
+		if health := reporter.Health(); health.Degraded {
+			return ReadinessCheck{Status: checkDegraded, Error: health.LastError}
+		}
+	}
+	return ReadinessCheck{Status: checkOK}
+}
+
+// checkQueue counts the streams waiting for a worker against the limit,
+// and the REST executions running against their slots
+func (s *Server) checkQueue(ctx context.Context) ReadinessCheck {
+	queued, running, connections := 0, 0, 0
+	s.eachConnection(func(connState *ConnectionState) {
+		connections++
+		connState.TasksMutex.RLock()
+		for _, task := range connState.ActiveTasks {
+			if task.Status == "running" {
+				running++
+			} else {
+				queued++
+			}
+		}
+		connState.TasksMutex.RUnlock()
+	})
+
+	check := ReadinessCheck{Status: checkOK, Details: map[string]interface{}{
+		"connections":    connections,
+		"queuedStreams":  queued,
+		"runningStreams": running,
+		"workersPerConn": s.maxWorkers.Load(),
+		"queueCapacity":  s.queueCapacity.Load(),
+		"restInFlight":   len(s.rest.slots),
+		"restCapacity":   cap(s.rest.slots),
+	}}
+	if limit := s.config.Readiness.MaxQueuedStreams; limit > 0 {
+		check.Details["maxQueuedStreams"] = limit
+		check.Details["headroom"] = max(limit-queued, 0)
+		if queued >= limit {
+			check.Status = checkFailed
+			check.Error = fmt.Sprintf("%d streams are queued, the limit is %d", queued, limit)
+		}
+	}
+	return check
+}
+
+// checkCanary pings the canary connector
+func (s *Server) checkCanary(ctx context.Context) ReadinessCheck {
+	id := s.config.Readiness.CanaryConnector
+	opts := runner.ExecuteOptions{Timeouts: s.config.Timeouts, Keyring: s.keyring, Secrets: s.secretResolver()}
+	connector, err := runner.LoadConnector(ctx, s.store, id, opts)
+	if err == nil {
+		err = runner.CheckConnector(ctx, connector, opts)
+	}
+	if err != nil {
+		return ReadinessCheck{Status: checkFailed, Error: redact.Message(err.Error()), Details: map[string]interface{}{"connectorId": id}}
+	}
+	return ReadinessCheck{Status: checkOK, Details: map[string]interface{}{"connectorId": id}}
+}
@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Defaults for settings left out of the config file
+const (
+	defaultMaxWorkers    = 3
+	defaultQueueCapacity = 100
+)
+
+// Settings a reload applies to the running server; the rest need a restart
+var reloadableSettings = map[string]bool{
+	"max_workers":       true,
+	"queue_capacity":    true,
+	"quotas":            true,
+	"allowed_origins":   true,
+	"connection_limits": true,
+}
+
+// ReloadResult lists the settings a reload changed, by their config file
+// names
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	// RestartRequired changed in the file but only take effect once the
+	// server restarts
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// LoadConfig reads a config file, filling in defaults for settings it
+// leaves out
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return Config{}, err
+	}
+	if cfg.MaxWorkers <= 0 {
+		cfg.MaxWorkers = defaultMaxWorkers
+	}
+	if cfg.QueueCapacity <= 0 {
+		cfg.QueueCapacity = defaultQueueCapacity
+	}
+	return cfg, nil
+}
+
+// SetConfigFile names the file the server was configured from, enabling
+// reloads on SIGHUP and through POST /admin/reload
+func (s *Server) SetConfigFile(path string) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.configFile = path
+}
+
+// ReloadConfigFile rereads the config file and applies it with Reload
+func (s *Server) ReloadConfigFile() (ReloadResult, error) {
+	s.reloadMu.Lock()
+	path := s.configFile
+	s.reloadMu.Unlock()
+	if path == "" {
+		return ReloadResult{}, errors.New("server was not configured from a file")
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("load %s: %w", path, err)
+	}
+	return s.Reload(cfg), nil
+}
+
+// Reload applies a new configuration without dropping connections. Worker
+// counts and queue capacity change on open connections as well as new
+// ones: workers over a lower count stop once their current query finishes,
+// and queries already queued beyond a lower capacity stay queued. Quotas
+// apply to each organization's next query, and allowed origins and
+// connection limits to the next request. Other settings are reported as
+// needing a restart.
+func (s *Server) Reload(cfg Config) ReloadResult {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	result := ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	for _, name := range changedSettings(s.loaded, cfg) {
+		if reloadableSettings[name] {
+			result.Applied = append(result.Applied, name)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+
+	if cfg.MaxWorkers > 0 {
+		s.maxWorkers.Store(int64(cfg.MaxWorkers))
+	}
+	if cfg.QueueCapacity > 0 {
+		s.queueCapacity.Store(int64(cfg.QueueCapacity))
+	}
+	s.quotas.configure(cfg.Quotas)
+	s.origins.set(cfg.AllowedOrigins)
+	s.connLimits.configure(cfg.ConnectionLimits)
+	s.eachConnection(func(connState *ConnectionState) {
+		connState.QueryQueue.setCapacity(int(s.queueCapacity.Load()))
+		s.scaleWorkers(connState)
+	})
+
+	// Settings that need a restart keep their running values, so a later
+	// reload reports them again until then
+	for _, name := range result.Applied {
+		setSetting(&s.loaded, name, cfg)
+	}
+
+	log.Printf("Reloaded config: applied %v", result.Applied)
+	if len(result.RestartRequired) > 0 {
+		log.Printf("Config changes to %v take effect after a restart", result.RestartRequired)
+	}
+	return result
+}
+
+// changedSettings lists the top-level settings that differ between two
+// configurations, by their config file names
+func changedSettings(from, to Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(from), reflect.ValueOf(to)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, settingName(a.Type().Field(i)))
+		}
+	}
+	return changed
+}
+
+// setSetting copies the named setting from src into dst
+func setSetting(dst *Config, name string, src Config) {
+	v, from := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	for i := 0; i < v.NumField(); i++ {
+		if settingName(v.Type().Field(i)) == name {
+			v.Field(i).Set(from.Field(i))
+		}
+	}
+}
+
+func settingName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// scaleWorkers starts or stops the connection's queue workers to match the
+// configured count. A stopped worker finishes the query it is running.
+func (s *Server) scaleWorkers(connState *ConnectionState) {
+	want := int(s.maxWorkers.Load())
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	for len(connState.workers) < want {
+		ctx, cancel := context.WithCancel(connState.ctx)
+		connState.workers = append(connState.workers, cancel)
+		go s.startQueueWorker(ctx, connState, len(connState.workers))
+	}
+	for len(connState.workers) > want {
+		last := len(connState.workers) - 1
+		connState.workers[last]()
+		connState.workers = connState.workers[:last]
+	}
+}
+
+// handleAdminReload rereads the config file for POST /admin/reload
+func (s *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	result, err := s.ReloadConfigFile()
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
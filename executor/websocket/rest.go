@@ -0,0 +1,426 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Rows a REST execution returns at most, unless configured with
+	// rest_max_rows
+	defaultRESTMaxRows = 10000
+
+	// Time the result of an async REST execution stays available after it
+	// finishes, unless configured with rest_result_ttl
+	defaultRESTResultTTL = 10 * time.Minute
+
+	// Largest request body accepted by the REST API
+	maxRESTBodySize = 1 << 20
+)
+
+// Execution states reported by the REST API
+const (
+	executionRunning   = "running"
+	executionCompleted = "completed"
+	executionFailed    = "failed"
+	executionCancelled = "cancelled"
+)
+
+// restExecuteRequest is the body of POST /api/v1/queries/{id}/execute
+type restExecuteRequest struct {
+	TemplateData map[string]interface{} `json:"templateData"`
+	ParameterSet string                 `json:"parameterSet,omitempty"`
+	CountOnly    bool                   `json:"countOnly,omitempty"`
+	Limit        int64                  `json:"limit,omitempty"`
+	Offset       int64                  `json:"offset,omitempty"`
+	Preview      bool                   `json:"preview,omitempty"`
+	PreviewRows  int64                  `json:"previewRows,omitempty"`
+	CacheControl string                 `json:"cacheControl,omitempty"`
+	CacheBust    bool                   `json:"cacheBust,omitempty"`
+	// Replay re-runs an execution from the query's history
+	Replay string `json:"replay,omitempty"`
+	// QueryVersion runs a saved version of the query
+	QueryVersion int `json:"queryVersion,omitempty"`
+	// Timezone renders timestamps in an IANA time zone
+	Timezone string `json:"timezone,omitempty"`
+	// ResultReuseMinutes lets the engine reuse a recent identical result
+	ResultReuseMinutes int64 `json:"resultReuseMinutes,omitempty"`
+	// JobLabels, JobPriority and MaxBytesBilled set up BigQuery jobs
+	JobLabels      map[string]string `json:"jobLabels,omitempty"`
+	JobPriority    string            `json:"jobPriority,omitempty"`
+	MaxBytesBilled int64             `json:"maxBytesBilled,omitempty"`
+	// Transforms post-process the rows as for WebSocket requests
+	Transforms []protocol.Transform `json:"transforms,omitempty"`
+	// Aggregates return a single row of aggregates instead of the rows
+	Aggregates []protocol.Aggregate `json:"aggregates,omitempty"`
+	// Sample thins the rows to every Nth or a random sample of K
+	Sample *protocol.Sample `json:"sample,omitempty"`
+	// Async returns an execution ID at once instead of waiting for the
+	// result, which is then polled at /api/v1/executions/{id}
+	Async bool `json:"async,omitempty"`
+}
+
+// restResult is a result set returned as JSON
+type restResult struct {
+	Columns   []string        `json:"columns"`
+	Nullable  []*bool         `json:"nullable,omitempty"`
+	Scales    []*int          `json:"scales,omitempty"`
+	Rows      [][]interface{} `json:"rows"`
+	RowCount  int             `json:"rowCount"`
+	Truncated bool            `json:"truncated,omitempty"`
+	FromCache bool            `json:"fromCache,omitempty"`
+	// Sample describes the sample the rows were reduced to
+	Sample *runner.SampleInfo `json:"sample,omitempty"`
+	// BytesScanned is the data the engine read, when it reports it
+	BytesScanned int64 `json:"bytesScanned,omitempty"`
+}
+
+// restExecution is an async execution started through the REST API
+type restExecution struct {
+	ID      string `json:"executionId"`
+	QueryID string `json:"queryId"`
+
+	cancel context.CancelFunc
+	// organization the execution was started for; it is hidden from
+	// callers of other organizations
+	organization string
+
+	mu         sync.Mutex
+	Status     string      `json:"status"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     *restResult `json:"result,omitempty"`
+}
+
+// restExecutions holds async REST executions until their results expire
+type restExecutions struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	byID  map[string]*restExecution
+	slots chan struct{} // bounds the REST executions running at once
+}
+
+func newRESTExecutions(ttl time.Duration, workers int) *restExecutions {
+	if ttl <= 0 {
+		ttl = defaultRESTResultTTL
+	}
+	if workers <= 0 {
+		workers = 1
+	}
+	return &restExecutions{ttl: ttl, byID: make(map[string]*restExecution), slots: make(chan struct{}, workers)}
+}
+
+func (e *restExecutions) add(exec *restExecution) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	e.byID[exec.ID] = exec
+}
+
+// len counts the executions held, running or awaiting collection
+func (e *restExecutions) len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	return len(e.byID)
+}
+
+// get returns an execution started by caller's organization
+func (e *restExecutions) get(id string, caller *Principal) (*restExecution, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire()
+	exec, ok := e.byID[id]
+	if !ok || exec.organization != organizationOf(caller) {
+		return nil, false
+	}
+	return exec, true
+}
+
+// expire drops executions whose results have outlived the TTL. The caller
+// holds e.mu.
+func (e *restExecutions) expire() {
+	now := time.Now()
+	for id, exec := range e.byID {
+		exec.mu.Lock()
+		finished := exec.FinishedAt
+		exec.mu.Unlock()
+		if finished != nil && now.Sub(*finished) > e.ttl {
+			delete(e.byID, id)
+		}
+	}
+}
+
+// acquire waits for a free execution slot
+func (e *restExecutions) acquire(ctx context.Context) error {
+	select {
+	case e.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *restExecutions) release() {
+	<-e.slots
+}
+
+// finish records how an execution ended
+func (exec *restExecution) finish(result *restResult, err error) {
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+	now := time.Now()
+	exec.FinishedAt = &now
+	switch {
+	case err == nil:
+		exec.Status = executionCompleted
+		exec.Result = result
+	case errors.Is(err, context.Canceled):
+		exec.Status = executionCancelled
+	default:
+		exec.Status = executionFailed
+		exec.Error = redact.Message(err.Error())
+	}
+}
+
+// handleRESTExecute runs a query for POST /api/v1/queries/{id}/execute,
+// answering with the result or, for async requests, the execution to poll
+func (s *Server) handleRESTExecute(w http.ResponseWriter, r *http.Request) {
+	if s.rejectDraining(w) {
+		return
+	}
+	var body restExecuteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRESTBodySize)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	req := &QueryRequest{
+		QueryID:            r.PathValue("id"),
+		StreamID:           "rest",
+		TemplateData:       body.TemplateData,
+		ParameterSet:       body.ParameterSet,
+		CountOnly:          body.CountOnly,
+		Limit:              body.Limit,
+		Offset:             body.Offset,
+		Preview:            body.Preview,
+		PreviewRows:        body.PreviewRows,
+		CacheControl:       body.CacheControl,
+		CacheBust:          body.CacheBust,
+		Replay:             body.Replay,
+		QueryVersion:       body.QueryVersion,
+		Timezone:           body.Timezone,
+		ResultReuseMinutes: body.ResultReuseMinutes,
+		JobLabels:          body.JobLabels,
+		JobPriority:        body.JobPriority,
+		MaxBytesBilled:     body.MaxBytesBilled,
+		Transforms:         body.Transforms,
+		Aggregates:         body.Aggregates,
+		Sample:             body.Sample,
+	}
+	if err := validateQueryRequest(req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	caller := principalFrom(r.Context())
+	quota, releaseQuota, err := s.quotas.acquire(r.Context(), caller)
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		writeRateLimited(w, limited)
+		return
+	}
+	s.capRows(req, quota.MaxRowsPerQuery)
+
+	if !body.Async {
+		defer releaseQuota()
+		if err := s.rest.acquire(r.Context()); err != nil {
+			return
+		}
+		defer s.rest.release()
+
+		result, err := s.collectREST(r.Context(), req, caller)
+		if err != nil {
+			writeJSONError(w, executionStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	// Async executions outlive the request that started them
+	ctx, cancel := context.WithCancel(context.Background())
+	exec := &restExecution{
+		ID:           uuid.NewString(),
+		QueryID:      req.QueryID,
+		cancel:       cancel,
+		organization: organizationOf(caller),
+		Status:       executionRunning,
+		StartedAt:    time.Now(),
+	}
+	s.rest.add(exec)
+	go func() {
+		defer cancel()
+		defer releaseQuota()
+		if err := s.rest.acquire(ctx); err != nil {
+			exec.finish(nil, err)
+			return
+		}
+		defer s.rest.release()
+		exec.finish(s.collectREST(ctx, req, caller))
+	}()
+
+	location := "/api/v1/executions/" + exec.ID
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"executionId": exec.ID,
+		"status":      executionRunning,
+		"location":    location,
+	})
+}
+
+// collectREST runs a query for caller and collects its result, capped at
+// the REST row limit
+func (s *Server) collectREST(ctx context.Context, req *QueryRequest, caller *Principal) (*restResult, error) {
+	maxRows := s.config.RESTMaxRows
+	if maxRows <= 0 {
+		maxRows = defaultRESTMaxRows
+	}
+	return s.collect(ctx, "rest", req, caller, maxRows, s.config.Values)
+}
+
+// collect runs a query for caller outside any stream and collects its
+// result in the given value format, capped at maxRows; source stands in for
+// the connection in the errors it records
+func (s *Server) collect(ctx context.Context, source string, req *QueryRequest, caller *Principal, maxRows int, values protocol.ValueFormat) (result *restResult, err error) {
+	defer runner.CatchPanic(&err, source+" execution of query "+req.QueryID)
+
+	// The page is capped at the row limit so the engine stops reading
+	// there and the result reports what was left out
+	capped := *req
+	s.capRows(&capped, int64(maxRows))
+
+	obs := &httpObserver{s: s, caller: caller}
+	stream, err := runner.ExecuteQuery(ctx, capped.QueryID, capped.TemplateData, s.store, s.executeOptions(&capped, caller, obs))
+	if err != nil {
+		s.recordHTTPOutcome(source, req, obs, err)
+		return nil, err
+	}
+	defer stream.Close()
+
+	result = &restResult{Rows: [][]interface{}{}}
+	err = stream.Stream(func(cols []string, row []interface{}) error {
+		if row == nil {
+			result.Columns = cols
+			result.Scales = columnScales(stream.ColumnInfo(cols))
+			return nil
+		}
+		result.Rows = append(result.Rows, values.FormatRow(row, result.Scales))
+		return nil
+	})
+	s.recordHTTPOutcome(source, req, obs, err)
+	if err != nil {
+		return nil, err
+	}
+	result.Nullable = nullability(stream.ColumnInfo(result.Columns))
+	result.RowCount = len(result.Rows)
+	result.Truncated = stream.Truncated()
+	result.Sample = stream.Sample()
+	result.FromCache, _ = stream.FromCache()
+	result.BytesScanned = obs.scan.BytesScanned
+	return result, nil
+}
+
+// handleRESTExecution reports an async execution for
+// GET /api/v1/executions/{id}
+func (s *Server) handleRESTExecution(w http.ResponseWriter, r *http.Request) {
+	exec, ok := s.rest.get(r.PathValue("id"), principalFrom(r.Context()))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errors.New("execution not found"))
+		return
+	}
+	exec.mu.Lock()
+	defer exec.mu.Unlock()
+	writeJSON(w, http.StatusOK, exec)
+}
+
+// handleRESTCancel cancels an async execution for
+// DELETE /api/v1/executions/{id}
+func (s *Server) handleRESTCancel(w http.ResponseWriter, r *http.Request) {
+	exec, ok := s.rest.get(r.PathValue("id"), principalFrom(r.Context()))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errors.New("execution not found"))
+		return
+	}
+	exec.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	// Encoded up front so a value that cannot be encoded is reported
+	// rather than cut short
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": fmt.Sprintf("encode response: %v", err)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// writeJSONError reports err, with its error code when it has one
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	payload := map[string]interface{}{"error": redact.Message(err.Error())}
+	var timeout *runner.TimeoutError
+	if errors.As(err, &timeout) {
+		payload["code"] = timeout.Code()
+	}
+	if errors.Is(err, runner.ErrMemoryBudgetExceeded) {
+		payload["code"] = protocol.ErrorCodeMemoryBudgetExceeded
+	}
+	if errors.Is(err, errServerShuttingDown) {
+		payload["code"] = protocol.ErrorCodeServerShutdown
+	}
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		payload["code"] = limited.errorCode()
+		if limited.retryAfter > 0 {
+			payload["retryAfterMs"] = limited.retryAfter.Milliseconds()
+		}
+	}
+	var invalid *runner.ValidationError
+	if errors.As(err, &invalid) {
+		payload["code"] = protocol.ErrorCodeInvalidParameters
+		payload["parameterErrors"] = invalid.Errors
+	}
+	var rejected *runner.SQLValidationError
+	if errors.As(err, &rejected) {
+		payload["code"] = protocol.ErrorCodeValidation
+		payload["validationErrors"] = rejected.Problems
+	}
+	var request *requestError
+	if errors.As(err, &request) {
+		payload["code"] = protocol.ErrorCodeInvalidRequest
+	}
+	if _, ok := payload["code"]; !ok {
+		if code := runner.ErrorCode(err); code != "" {
+			payload["code"] = code
+		}
+	}
+	addEngineError(payload, err)
+	writeJSON(w, status, payload)
+}
@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// InstanceHeader names the replica that accepted a WebSocket upgrade, so a
+// load balancer can pin the client's later connections to it
+const InstanceHeader = "X-Supalytics-Instance"
+
+const (
+	// Time a stream's owner can be looked up after it was last updated,
+	// unless configured with owner_ttl
+	defaultOwnerTTL = time.Hour
+
+	// Owner updates waiting to be written to Redis; more are dropped
+	ownerQueueSize = 1024
+)
+
+// RoutingConfig identifies this replica to clients and load balancers, and
+// records which replica owns each stream so a client that reconnects
+// through a load balancer can be routed back to it
+type RoutingConfig struct {
+	// InstanceID names this replica in hello messages and owner lookups
+	// (default the hostname with a random suffix)
+	InstanceID string `toml:"instance_id"`
+	// URL is the WebSocket URL that reaches this replica directly, bypassing
+	// the load balancer
+	URL string `toml:"url"`
+
+	// RedisURL shares stream owners between replicas, so any replica can
+	// answer a lookup; without it each replica only knows its own streams
+	RedisURL  string `toml:"redis_url"`
+	KeyPrefix string `toml:"key_prefix"` // default "supalytics:"
+
+	// OwnerTTL is how long a stream's owner can be looked up after its
+	// last update, including once the stream has ended (default 1h)
+	OwnerTTL time.Duration `toml:"owner_ttl"`
+}
+
+// StreamOwner is the replica and connection a stream belongs to
+type StreamOwner struct {
+	StreamID       string `json:"streamId"`
+	InstanceID     string `json:"instanceId"`
+	URL            string `json:"url,omitempty"`
+	ConnectionID   string `json:"connectionId"`
+	OrganizationID string `json:"organizationId,omitempty"`
+	// Status is the stream's last known status: queued, running,
+	// submitted, or how it ended
+	Status string `json:"status"`
+	// ExecutionID is set once an async stream has been submitted
+	ExecutionID string    `json:"executionId,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// streamRegistry records the owners of this replica's streams, sharing them
+// through Redis when configured
+type streamRegistry struct {
+	instanceID string
+	url        string
+	ttl        time.Duration
+
+	mu     sync.Mutex
+	owners map[string]*StreamOwner
+	pruned time.Time
+
+	client  *redis.Client
+	prefix  string
+	pending chan StreamOwner
+}
+
+func newStreamRegistry(cfg RoutingConfig) (*streamRegistry, error) {
+	r := &streamRegistry{
+		instanceID: cfg.InstanceID,
+		url:        cfg.URL,
+		ttl:        cfg.OwnerTTL,
+		owners:     make(map[string]*StreamOwner),
+		pruned:     time.Now(),
+		prefix:     cfg.KeyPrefix,
+	}
+	if r.instanceID == "" {
+		host, _ := os.Hostname()
+		r.instanceID = host + "-" + uuid.NewString()[:8]
+	}
+	if r.ttl <= 0 {
+		r.ttl = defaultOwnerTTL
+	}
+	if r.prefix == "" {
+		r.prefix = defaultJobKeyPrefix
+	}
+	if cfg.RedisURL == "" {
+		return r, nil
+	}
+
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		return r, fmt.Errorf("parse redis url: %w", err)
+	}
+	r.client = redis.NewClient(opts)
+	r.pending = make(chan StreamOwner, ownerQueueSize)
+	go r.share()
+	return r, nil
+}
+
+// ownerKey scopes stream IDs, which clients choose, to their organization
+func ownerKey(organizationID string, streamID string) string {
+	return organizationID + ":" + streamID
+}
+
+// record notes that a stream on connState is now in status. It never
+// blocks on Redis, so it can be called with the task lock held.
+func (r *streamRegistry) record(connState *ConnectionState, task *QueryTask, status string, executionID string) {
+	org := organizationOf(connState.Principal())
+	key := ownerKey(org, task.Request.StreamID)
+
+	r.mu.Lock()
+	now := time.Now()
+	prev := r.owners[key]
+	owner := &StreamOwner{
+		StreamID:       task.Request.StreamID,
+		InstanceID:     r.instanceID,
+		URL:            r.url,
+		ConnectionID:   connState.ID,
+		OrganizationID: org,
+		Status:         status,
+		ExecutionID:    executionID,
+		UpdatedAt:      now,
+	}
+	// A later update of the same stream keeps its execution ID
+	if owner.ExecutionID == "" && prev != nil && prev.ConnectionID == owner.ConnectionID {
+		owner.ExecutionID = prev.ExecutionID
+	}
+	r.owners[key] = owner
+	if now.Sub(r.pruned) > r.ttl {
+		r.prune(now)
+	}
+	r.mu.Unlock()
+
+	if r.pending != nil {
+		select {
+		case r.pending <- *owner:
+		default:
+			log.Printf("Dropping owner update for stream %s: too many pending", owner.StreamID)
+		}
+	}
+}
+
+// prune forgets owners past their TTL; the caller holds the lock
+func (r *streamRegistry) prune(now time.Time) {
+	for key, owner := range r.owners {
+		if now.Sub(owner.UpdatedAt) > r.ttl {
+			delete(r.owners, key)
+		}
+	}
+	r.pruned = now
+}
+
+// share writes owner updates to Redis in the order they were recorded
+func (r *streamRegistry) share() {
+	for owner := range r.pending {
+		data, err := json.Marshal(owner)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+		err = r.client.Set(ctx, r.prefix+"stream:"+ownerKey(owner.OrganizationID, owner.StreamID), data, r.ttl).Err()
+		cancel()
+		if err != nil {
+			log.Printf("Sharing owner of stream %s failed: %v", owner.StreamID, err)
+		}
+	}
+}
+
+// lookup returns the owner of an organization's stream, or nil when no
+// replica has recorded it within the TTL. With Redis the most recent of
+// the shared and local owners wins, as the stream may have moved.
+func (r *streamRegistry) lookup(ctx context.Context, organizationID string, streamID string) (*StreamOwner, error) {
+	key := ownerKey(organizationID, streamID)
+	var owner *StreamOwner
+	r.mu.Lock()
+	if local := r.owners[key]; local != nil && time.Since(local.UpdatedAt) <= r.ttl {
+		copied := *local
+		owner = &copied
+	}
+	r.mu.Unlock()
+	if r.client == nil {
+		return owner, nil
+	}
+
+	data, err := r.client.Get(ctx, r.prefix+"stream:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return owner, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shared StreamOwner
+	if err := json.Unmarshal(data, &shared); err != nil {
+		return nil, err
+	}
+	if owner == nil || shared.UpdatedAt.After(owner.UpdatedAt) {
+		owner = &shared
+	}
+	return owner, nil
+}
+
+// sendHello announces the replica and connection to a new client, with
+// the token that resumes its session and what a resumed session kept
+func (s *Server) sendHello(connState *ConnectionState, resumed bool, streams []string) {
+	payload := map[string]interface{}{
+		"instanceId":   s.routing.instanceID,
+		"connectionId": connState.ID,
+	}
+	if s.routing.url != "" {
+		payload["url"] = s.routing.url
+	}
+	if interval := s.config.Keepalive.HeartbeatInterval; interval > 0 {
+		payload["heartbeatIntervalMs"] = interval.Milliseconds()
+	}
+	if connState.Values != (protocol.ValueFormat{}) {
+		payload["values"] = connState.Values
+	}
+	if connState.sessionID != "" {
+		payload["sessionToken"] = s.sessions.token(connState.sessionID, connState.Principal())
+	}
+	if resumed {
+		payload["resumed"] = true
+		payload["resumedStreams"] = streams
+	}
+	s.sendMessage(connState.Conn, WSMessage{Type: MessageTypeHello, Payload: payload}, connState)
+}
+
+// handleStreamOwner reports which replica owns a stream of the caller's
+// organization for GET /api/v1/streams/{id}/owner, so a client can
+// reconnect to it to resume the stream
+func (s *Server) handleStreamOwner(w http.ResponseWriter, r *http.Request) {
+	owner, err := s.routing.lookup(r.Context(), organizationOf(principalFrom(r.Context())), r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Errorf("look up stream owner: %w", err))
+		return
+	}
+	if owner == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("stream not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, owner)
+}
@@ -2,17 +2,27 @@ package websocket
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	httppprof "net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 
+	"supalytics-executor/driver"
+	"supalytics-executor/drivers/athena"
+	"supalytics-executor/hooks"
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
 	"supalytics-executor/runner"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/supabase-community/supabase-go"
 )
@@ -24,32 +34,194 @@ func NewServer(cfg Config) (*Server, error) {
 		return nil, fmt.Errorf("initialize Supabase client: %w", err)
 	}
 
-	return &Server{
+	// Cached metadata keeps hot queries running through a Supabase outage
+	store := runner.NewCachingStore(runner.NewSupabaseStore(client))
+	if cfg.Realtime {
+		feed, err := runner.NewSupabaseRealtime(cfg.SupabaseURL, cfg.SupabaseKey)
+		if err != nil {
+			return nil, fmt.Errorf("initialize Supabase Realtime: %w", err)
+		}
+		store.Follow(context.Background(), feed)
+	}
+	return NewServerWithStore(cfg, store), nil
+}
+
+// NewServerWithStore creates a WebSocket server that resolves queries and
+// connectors from the given metadata store
+func NewServerWithStore(cfg Config, store runner.MetadataStore) *Server {
+	audit, _ := store.(runner.AuditLog)
+
+	dispatcher := hooks.NewDispatcher()
+	for _, wc := range cfg.Webhooks {
+		webhook, err := hooks.NewWebhook(wc)
+		if err != nil {
+			log.Printf("Skipping webhook %q: %v", wc.URL, err)
+			continue
+		}
+		dispatcher.Add(webhook)
+	}
+
+	// Without a keyring, encrypted connector configs fail to decrypt
+	keyring, err := runner.NewKeyring(context.Background(), cfg.Encryption)
+	if err != nil {
+		log.Printf("Connector config encryption unavailable: %v", err)
+	}
+
+	var secrets runner.SecretResolver
+	if cfg.Vault.Enabled() {
+		vault, err := runner.NewVaultResolver(cfg.Vault)
+		if err != nil {
+			log.Printf("Vault secret references unavailable: %v", err)
+		} else {
+			secrets = vault
+		}
+	}
+
+	resultCache, err := runner.NewResultCache(cfg.ResultCache)
+	if err != nil {
+		log.Printf("Result cache unavailable: %v", err)
+	}
+
+	// Supabase Storage snapshots default to the metadata project
+	if cfg.Snapshots.SupabaseURL == "" {
+		cfg.Snapshots.SupabaseURL = cfg.SupabaseURL
+	}
+	if cfg.Snapshots.SupabaseKey == "" {
+		cfg.Snapshots.SupabaseKey = cfg.SupabaseKey
+	}
+	snapshots, err := runner.NewSnapshots(context.Background(), cfg.Snapshots)
+	if err != nil {
+		log.Printf("Result snapshots unavailable: %v", err)
+	}
+
+	if err := cfg.Values.Validate(); err != nil {
+		log.Printf("Ignoring values: %v", err)
+		cfg.Values = protocol.ValueFormat{}
+	}
+
+	origins := newOriginPolicy(cfg.AllowedOrigins)
+
+	routing, err := newStreamRegistry(cfg.Routing)
+	if err != nil {
+		log.Printf("Shared stream owners unavailable: %v", err)
+	}
+
+	var jobs *jobQueue
+	if cfg.JobQueue.Enabled() {
+		jobs, err = newJobQueue(cfg.JobQueue)
+		if err != nil {
+			log.Printf("Job queue unavailable: %v", err)
+		}
+	}
+
+	var auth *authenticator
+	if cfg.Auth.Enabled() {
+		auth = newAuthenticator(cfg.Auth, store)
+	}
+
+	s := &Server{
 		config:        cfg,
-		supaClient:    client,
-		maxWorkers:    cfg.MaxWorkers,
-		queueCapacity: cfg.QueueCapacity,
+		store:         store,
+		loaded:        cfg,
+		startedAt:     time.Now(),
+		health:        newConnectorHealthTracker(),
+		recentErrors:  newErrorLog(recentErrorCapacity),
+		audit:         audit,
+		hooks:         dispatcher,
+		keyring:       keyring,
+		secrets:       secrets,
+		resultCache:   resultCache,
+		metadataCache: runner.NewMetadataCache(cfg.MetadataCache),
+		warmPool:      runner.NewWarmPool(cfg.WarmPool),
+		prewarms:      newPrewarmer(cfg.Prewarm, store, resultCache),
+		snapshots:     snapshots,
+		rest:          newRESTExecutions(cfg.RESTResultTTL, cfg.MaxWorkers),
+		auth:          auth,
+		origins:       origins,
+		quotas:        newQuotaTracker(cfg.Quotas, store),
+		jobs:          jobs,
+		routing:       routing,
+		connLimits:    newConnectionLimiter(cfg.ConnectionLimits),
+		sessions:      newSessionRegistry(),
+		flights:       make(map[string]*flight),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Configure appropriately for production
-			},
+			Subprotocols:    protocol.Subprotocols,
+			// Only clients that offer permessage-deflate get compression
+			EnableCompression: cfg.Compression,
+			CheckOrigin:       origins.checkOrigin,
 		},
-	}, nil
+	}
+
+	s.maxWorkers.Store(int64(cfg.MaxWorkers))
+	s.queueCapacity.Store(int64(cfg.QueueCapacity))
+
+	return s
+}
+
+// AddHook registers a hook that receives execution lifecycle events
+func (s *Server) AddHook(h hooks.Hook) {
+	s.hooks.Add(h)
+}
+
+// SetSecretResolver replaces the backend that resolves secret references in
+// connector configs
+func (s *Server) SetSecretResolver(r runner.SecretResolver) {
+	s.secretsMu.Lock()
+	defer s.secretsMu.Unlock()
+	s.secrets = r
+}
+
+// secretResolver returns the backend set by SetSecretResolver, or the
+// configured Vault
+func (s *Server) secretResolver() runner.SecretResolver {
+	s.secretsMu.RLock()
+	defer s.secretsMu.RUnlock()
+	return s.secrets
+}
+
+// startBackground starts the health checks, warm pool, prewarms and job
+// claims once, when the server is first served, so they see the hooks and
+// secret resolver set up after NewServerWithStore
+func (s *Server) startBackground() {
+	s.background.Do(func() {
+		if statuses, ok := s.store.(runner.ConnectorStatusStore); ok && s.config.HealthChecks.Interval > 0 {
+			go s.runHealthChecks(statuses)
+		}
+		if connectors, ok := s.store.(runner.ConnectorStatusStore); ok && s.warmPool != nil {
+			go s.runWarmPool(connectors)
+		}
+		if s.prewarms != nil {
+			go s.runPrewarms()
+		}
+		if s.jobs != nil && s.config.JobQueue.Workers > 0 {
+			go s.claimJobs()
+		}
+	})
 }
 
 // NewConnectionState creates a new connection state
-func NewConnectionState(conn *websocket.Conn, queueCapacity int) *ConnectionState {
+func NewConnectionState(conn *websocket.Conn, queueCapacity int, sendQueueSize int) *ConnectionState {
 	return &ConnectionState{
-		Conn:         conn,
-		QueryQueue:   make(chan *QueryTask, queueCapacity),
-		ActiveTasks:  make(map[string]*QueryTask),
-		QueueWorkers: 0,
+		ID:            fmt.Sprintf("%p", conn),
+		ConnectedAt:   time.Now(),
+		Conn:          conn,
+		Codec:         protocol.CodecForSubprotocol(conn.Subprotocol()),
+		QueryQueue:    newTaskQueue(queueCapacity),
+		ActiveTasks:   make(map[string]*QueryTask),
+		QueueWorkers:  0,
+		send:          make(chan outbound, sendQueueSize),
+		writerDone:    make(chan struct{}),
+		seqs:          make(map[string]*streamSeq),
+		groups:        make(map[string]*queryGroup),
+		subscriptions: make(map[string]*subscription),
+		closed:        make(chan struct{}),
 	}
 }
 
-// handleHealth handles health check requests
+// handleHealth handles health check requests; /healthz reports liveness in
+// more detail
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("healthy"))
@@ -57,78 +229,203 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // handleWebSocket handles WebSocket connections
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if s.rejectDraining(w) {
+		return
+	}
+	release, status, reason := s.connLimits.admit(s.connLimits.clientIP(r))
+	if release == nil {
+		rejectConnection(w, r, status, reason)
+		return
+	}
+	defer release()
+	values, err := s.valueFormat(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, http.Header{InstanceHeader: {s.routing.instanceID}})
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	connState := NewConnectionState(conn, s.queueCapacity)
-	connID := fmt.Sprintf("%p", conn)
+	sendQueueSize := s.config.SendQueueSize
+	if sendQueueSize <= 0 {
+		sendQueueSize = defaultSendQueueSize
+	}
+	connState := NewConnectionState(conn, int(s.queueCapacity.Load()), sendQueueSize)
+	connID := connState.ID
+	connState.RemoteAddr = r.RemoteAddr
+	connState.Compressed = s.config.Compression && offersCompression(r.Header)
+	connState.Values = values
+	connState.admin = s.presentsAdminToken(r)
+	if connState.Compressed && s.config.CompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(s.config.CompressionLevel); err != nil {
+			log.Printf("Ignoring compression_level %d: %v", s.config.CompressionLevel, err)
+		}
+	}
+
+	conn.SetReadLimit(maxMessageSize)
+
+	// Unauthenticated connections are closed before they can queue work
+	var authAck bool
+	expiry := &tokenExpiry{conn: conn}
+	defer expiry.stop()
+	if s.auth != nil {
+		principal, viaMessage, err := s.authenticateConn(r, connState)
+		if err != nil {
+			closeUnauthorized(conn, err.Error())
+			return
+		}
+		releaseOrg, reason := s.connLimits.admitOrganization(principal.OrganizationID)
+		if releaseOrg == nil {
+			closeTooManyConnections(conn, reason)
+			return
+		}
+		defer releaseOrg()
+		connState.principal.Store(principal)
+		authAck = viaMessage
+		expiry.schedule(principal.ExpiresAt)
+	}
+
+	restored, resumed := s.openSession(r, connState)
 	s.activeConns.Store(connID, connState)
 
+	// A connection that dropped rather than closing may be resumed
+	var dropped bool
 	defer func() {
-		s.cleanupConnection(connState)
+		s.cleanupConnection(connState, dropped)
+		s.sessions.detach(connState)
 		s.activeConns.Delete(connID)
 		conn.Close()
+		close(connState.closed)
 	}()
 
-	conn.SetReadLimit(maxMessageSize)
+	pongWait := s.pongWait()
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// Goroutines serving the connection carry its ID in profiles
+	ctx, cancel := context.WithCancel(labelConnection(context.Background(), connID))
 	defer cancel()
 
-	for i := 0; i < s.maxWorkers; i++ {
-		go s.startQueueWorker(ctx, connState)
-	}
+	connState.ctx = ctx
+	s.scaleWorkers(connState)
 
-	go s.writePingMessages(conn, connState)
+	go s.writeLoop(ctx, connState)
+	go s.keepalive(ctx, connState)
 
-	for {
-		var msg struct {
-			Type         MessageType            `json:"type"`
-			StreamID     string                 `json:"streamId"`
-			QueryID      string                 `json:"queryId,omitempty"`
-			TemplateData map[string]interface{} `json:"templateData,omitempty"`
-		}
+	if authAck {
+		s.sendAuth(connState, connState.Principal())
+	}
+	s.sendHello(connState, resumed, resumedStreams(restored))
+	s.restoreSession(ctx, connState, restored)
 
-		err := conn.ReadJSON(&msg)
+	for {
+		frameType, data, err := conn.ReadMessage()
+		receivedAt := time.Now()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway,
 				websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket read error: %v", err)
 			}
+			var closeErr *websocket.CloseError
+			dropped = !errors.As(err, &closeErr) || closeErr.Code == websocket.CloseAbnormalClosure
 			return
 		}
+		connState.lastMessageAt.Store(receivedAt.UnixNano())
 
-		if msg.Type == MessageTypeCancel {
-			if err := s.handleCancelRequest(connState, &CancelRequest{StreamID: msg.StreamID}); err != nil {
-				s.sendError(conn, msg.StreamID, err.Error(), connState)
-			}
+		// A malformed message is reported back to the client rather than
+		// tearing down the connection and every stream on it
+		var msg protocol.ClientMessage
+		if err := decodeClientMessage(connState, frameType, data, &msg); err != nil {
+			s.sendError(conn, "", fmt.Sprintf("malformed message: %v", err), connState)
 			continue
 		}
 
-		// Handle regular query request
-		req := &QueryRequest{
-			QueryID:      msg.QueryID,
-			StreamID:     msg.StreamID,
-			TemplateData: msg.TemplateData,
+		switch msg.Type {
+		case MessageTypeAuth:
+			if s.auth == nil {
+				s.sendError(conn, "", "authentication is not enabled", connState)
+				continue
+			}
+			principal, err := s.reauthenticate(connState, msg.Token)
+			if err != nil {
+				closeUnauthorized(conn, err.Error())
+				return
+			}
+			expiry.schedule(principal.ExpiresAt)
+			s.sendAuth(connState, principal)
+		case MessageTypeCancel:
+			if err := s.handleCancelRequest(connState, &CancelRequest{StreamID: msg.StreamID, GroupID: msg.GroupID}); err != nil {
+				s.sendError(conn, msg.StreamID, err.Error(), connState)
+			}
+		case MessageTypeCredit:
+			if err := s.handleCreditRequest(connState, msg.StreamID, msg.Credits); err != nil {
+				s.sendError(conn, msg.StreamID, err.Error(), connState)
+			}
+		case MessageTypeQuery, "":
+			req := msg.QueryRequest
+			req.ExecutionID = ""
+			req.GroupID = ""
+			if err := s.queueQuery(ctx, connState, &req, receivedAt); err != nil {
+				s.recordError(connState, &req, err)
+				s.sendRejection(conn, req.StreamID, err, connState)
+			}
+		case MessageTypeAttach:
+			req := msg.QueryRequest
+			if req.ExecutionID == "" {
+				s.sendError(conn, req.StreamID, "executionId is required", connState)
+				continue
+			}
+			req.GroupID = ""
+			if err := s.queueQuery(ctx, connState, &req, receivedAt); err != nil {
+				s.recordError(connState, &req, err)
+				s.sendRejection(conn, req.StreamID, err, connState)
+			}
+		case MessageTypeBatch:
+			s.queueBatch(ctx, connState, &msg, receivedAt)
+		case MessageTypeSubscribe:
+			req := msg.QueryRequest
+			req.ExecutionID = ""
+			req.GroupID = ""
+			if err := s.subscribe(ctx, connState, &req); err != nil {
+				s.recordError(connState, &req, err)
+				s.sendRejection(conn, req.StreamID, err, connState)
+			}
+		case MessageTypeHistory:
+			go s.sendHistory(ctx, connState, msg.QueryRequest)
+		case MessageTypeTestConnection:
+			go s.sendConnectionTest(ctx, connState, msg.QueryRequest)
+		default:
+			s.sendError(conn, msg.StreamID, fmt.Sprintf("unknown message type: %s", msg.Type), connState)
 		}
+	}
+}
 
-		if err := s.queueQuery(ctx, connState, req); err != nil {
-			s.sendError(conn, req.StreamID, err.Error(), connState)
+// offersCompression reports whether a handshake offers permessage-deflate
+func offersCompression(header http.Header) bool {
+	for _, ext := range header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(ext, ",") {
+			name, _, _ := strings.Cut(offer, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
 		}
 	}
+	return false
 }
 
-// handleCancelRequest handles the cancellation of a running or queued query
+// handleCancelRequest handles the cancellation of a running or queued
+// query, or of every query of a group
 func (s *Server) handleCancelRequest(connState *ConnectionState, req *CancelRequest) error {
+	if req.StreamID == "" && req.GroupID != "" {
+		return s.cancelGroup(connState, req.GroupID)
+	}
 	if req.StreamID == "" {
 		return errors.New("streamId is required")
 	}
@@ -136,60 +433,300 @@ func (s *Server) handleCancelRequest(connState *ConnectionState, req *CancelRequ
 	connState.TasksMutex.Lock()
 	defer connState.TasksMutex.Unlock()
 
+	if sub, ok := connState.subscriptions[req.StreamID]; ok {
+		s.endSubscription(connState, sub, protocol.StatusCancelled, nil)
+		return nil
+	}
 	task, exists := connState.ActiveTasks[req.StreamID]
 	if !exists {
 		return fmt.Errorf("stream %s not found", req.StreamID)
 	}
+	s.cancelStream(connState, task)
+	return nil
+}
 
-	// Cancel the task and update its status
+// cancelTask cancels a queued or running task; the caller holds the task
+// lock. A queued task ends here; a running one is reported cancelled by its
+// worker once the driver stops, or once the cancel deadline forces it to.
+func (s *Server) cancelTask(connState *ConnectionState, task *QueryTask) {
 	task.CancelFunc()
-	task.Status = "cancelled"
-	delete(connState.ActiveTasks, req.StreamID)
-
-	// Send cancellation status
-	s.sendStatus(connState.Conn, req.StreamID, "cancelled", connState)
-
-	return nil
+	if !task.transition(protocol.StatusQueued, protocol.StatusCancelled) {
+		return
+	}
+	connState.QueryQueue.remove(task)
+	s.sendStatusDetails(connState.Conn, task.Request.StreamID, protocol.StatusCancelled, cancelledDetails(task), connState)
+	s.releaseTask(connState, task)
 }
 
-// queueQuery adds a new query to the execution queue
-func (s *Server) queueQuery(ctx context.Context, connState *ConnectionState, req *QueryRequest) error {
+// queueQuery adds a new query to the execution queue, or places it behind
+// the execution holding its stream ID. An error rejects the request.
+func (s *Server) queueQuery(ctx context.Context, connState *ConnectionState, req *QueryRequest, receivedAt time.Time) error {
 	if req.StreamID == "" || req.QueryID == "" {
-		return errors.New("streamId and queryId are required")
+		return &requestError{err: errors.New("streamId and queryId are required")}
+	}
+	if err := validateQueryRequest(req); err != nil {
+		return err
+	}
+	if req.Debug && !connState.admin {
+		return &requestError{err: errors.New("debug requires a connection opened with the admin token")}
+	}
+	if err := s.checkExecutionTimeout(req); err != nil {
+		return &requestError{err: err}
+	}
+	if s.Draining() {
+		return errServerShuttingDown
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	quota, releaseQuota, err := s.quotas.acquire(ctx, connState.Principal())
+	if err != nil {
+		return err
+	}
+	s.capRows(req, quota.MaxRowsPerQuery)
+	s.capStream(req, quota)
+
+	// The task's context is its own rather than the connection's: it ends
+	// once the task is released, which a closing connection brings about by
+	// cancelling the task like any other
+	taskCtx, cancel := context.WithCancel(context.Background())
+	context.AfterFunc(taskCtx, releaseQuota)
 	task := &QueryTask{
+		ID:         uuid.NewString(),
 		Request:    req,
+		Context:    taskCtx,
 		CancelFunc: cancel,
-		Status:     "queued",
+		QueuedAt:   time.Now(),
+		Status:     protocol.StatusQueued,
+		receivedAt: receivedAt,
+	}
+	if req.Credits > 0 {
+		task.credits = newCreditGate(req.Credits)
 	}
 
 	connState.TasksMutex.Lock()
-	if _, exists := connState.ActiveTasks[req.StreamID]; exists {
+	if _, subscribed := connState.subscriptions[req.StreamID]; subscribed {
+		connState.TasksMutex.Unlock()
+		cancel()
+		return fmt.Errorf("%w: %s is subscribed", errDuplicateStream, req.StreamID)
+	}
+	if current, exists := connState.ActiveTasks[req.StreamID]; exists {
+		err := s.followTask(connState, current, task)
 		connState.TasksMutex.Unlock()
-		return fmt.Errorf("stream %s already exists", req.StreamID)
+		if err != nil {
+			cancel()
+		}
+		return err
 	}
 	connState.ActiveTasks[req.StreamID] = task
 	connState.TasksMutex.Unlock()
 
-	// Send status update
-	s.sendStatus(connState.Conn, req.StreamID, "queued", connState)
+	s.enqueueTask(connState, task, false)
+	return nil
+}
 
-	select {
-	case connState.QueryQueue <- task:
-		return nil
-	default:
-		connState.TasksMutex.Lock()
-		delete(connState.ActiveTasks, req.StreamID)
+// enqueueTask announces a task that holds its stream ID and queues it for
+// a worker. A task that waited behind another was accepted then, so it is
+// queued even past the queue's capacity, or reported cancelled if it was
+// replaced or cancelled while it waited.
+func (s *Server) enqueueTask(connState *ConnectionState, task *QueryTask, waited bool) {
+	req := task.Request
+	var details map[string]interface{}
+	if waited {
+		details = map[string]interface{}{"waitedMs": time.Since(task.QueuedAt).Milliseconds()}
+	}
+
+	connState.TasksMutex.Lock()
+	if connState.ActiveTasks[req.StreamID] != task {
+		// Cancelled and released already
 		connState.TasksMutex.Unlock()
-		cancel()
-		return errors.New("query queue is full")
+		return
+	}
+	if task.Status != protocol.StatusQueued {
+		// Replaced or cancelled while it waited
+		s.sendStatusDetails(connState.Conn, req.StreamID, task.Status, cancelledDetails(task), connState)
+		s.releaseTask(connState, task)
+		connState.TasksMutex.Unlock()
+		return
+	}
+	s.traceAt(connState, req, task.receivedAt, "received", nil)
+	s.trace(connState, req, "validated", nil)
+	s.sendStatusDetails(connState.Conn, req.StreamID, protocol.StatusQueued, details, connState)
+	connState.TasksMutex.Unlock()
+	s.routing.record(connState, task, protocol.StatusQueued, "")
+
+	if !connState.QueryQueue.push(task, waited) {
+		// Unless it was cancelled before it could be queued, in which case
+		// the client has been told
+		if s.endTask(connState, task, protocol.StatusQueued, protocol.StatusFailed) {
+			err := errors.New("query queue is full")
+			s.recordError(connState, req, err)
+			s.sendFailure(connState.Conn, req.StreamID, err, connState)
+			s.sendStatus(connState.Conn, req.StreamID, protocol.StatusFailed, connState)
+
+			connState.TasksMutex.Lock()
+			s.releaseTask(connState, task)
+			connState.TasksMutex.Unlock()
+		}
+		return
+	}
+	s.trace(connState, req, "queued", map[string]interface{}{
+		"position": connState.QueryQueue.position(task),
+		"priority": priorityOf(req),
+	})
+	s.fireEvent(connState, task, hooks.EventQueued, nil)
+	go s.watchQueued(connState, task)
+}
+
+// priorityOf returns a request's priority, defaulting to interactive
+func priorityOf(req *QueryRequest) string {
+	if req.Priority == "" {
+		return protocol.PriorityInteractive
+	}
+	return req.Priority
+}
+
+// requestError rejects a request whose fields are missing or invalid
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// validateQueryRequest checks the options of a query request, however it
+// arrived
+func validateQueryRequest(req *QueryRequest) error {
+	if err := checkQueryOptions(req); err != nil {
+		return &requestError{err: err}
+	}
+	return nil
+}
+
+func checkQueryOptions(req *QueryRequest) error {
+	switch req.SlowClientPolicy {
+	case "", protocol.SlowClientWait, protocol.SlowClientDrop, protocol.SlowClientClose:
+	default:
+		return fmt.Errorf("invalid slowClientPolicy %q", req.SlowClientPolicy)
+	}
+	switch req.OnDuplicate {
+	case "", protocol.DuplicateReject, protocol.DuplicateReplace, protocol.DuplicateQueue:
+	default:
+		return fmt.Errorf("invalid onDuplicate %q: want reject, replace or queue", req.OnDuplicate)
 	}
+	if _, ok := priorityLevel(req.Priority); !ok {
+		return fmt.Errorf("invalid priority %q: want interactive, export or background", req.Priority)
+	}
+	if req.TimeoutMS < 0 {
+		return fmt.Errorf("timeoutMs must not be negative, got %d", req.TimeoutMS)
+	}
+	if req.Credits < 0 {
+		return fmt.Errorf("credits must not be negative, got %d", req.Credits)
+	}
+	if req.Limit < 0 || req.Offset < 0 {
+		return fmt.Errorf("limit and offset must not be negative, got %d and %d", req.Limit, req.Offset)
+	}
+	if req.CountOnly && (req.Limit > 0 || req.Offset > 0) {
+		return errors.New("countOnly cannot be combined with limit or offset")
+	}
+	if req.MaxRows < 0 || req.MaxBytes < 0 {
+		return fmt.Errorf("maxRows and maxBytes must not be negative, got %d and %d", req.MaxRows, req.MaxBytes)
+	}
+	if req.QueryVersion < 0 {
+		return fmt.Errorf("queryVersion must not be negative, got %d", req.QueryVersion)
+	}
+	if req.ResultReuseMinutes < -1 || req.ResultReuseMinutes > athena.MaxResultReuseMinutes {
+		return fmt.Errorf("resultReuseMinutes must be -1 (off) to %d, got %d", athena.MaxResultReuseMinutes, req.ResultReuseMinutes)
+	}
+	if err := checkJobOptions(req); err != nil {
+		return err
+	}
+	if req.QueryVersion > 0 && req.Replay != "" {
+		return errors.New("queryVersion cannot be combined with replay")
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", req.Timezone)
+		}
+	}
+	if req.PreviewRows < 0 {
+		return fmt.Errorf("previewRows must not be negative, got %d", req.PreviewRows)
+	}
+	if req.Preview && (req.CountOnly || req.Limit > 0 || req.Offset > 0) {
+		return errors.New("preview cannot be combined with countOnly, limit or offset")
+	}
+	switch req.CacheControl {
+	case "", runner.CacheUse, runner.CacheBypass, runner.CacheRefresh:
+	default:
+		return fmt.Errorf("invalid cacheControl %q", req.CacheControl)
+	}
+	if req.Snapshot != "" && !runner.ValidSnapshotFormat(req.Snapshot) {
+		return fmt.Errorf("invalid snapshot format %q", req.Snapshot)
+	}
+	if req.SnapshotOnly && req.Snapshot == "" {
+		return errors.New("snapshotOnly requires a snapshot format")
+	}
+	if req.SnapshotOnly && req.Credits > 0 {
+		return errors.New("snapshotOnly cannot be combined with credits")
+	}
+	if req.ResumeAfterRows < 0 {
+		return fmt.Errorf("resumeAfterRows must not be negative, got %d", req.ResumeAfterRows)
+	}
+	if req.ResumeAfterRows > 0 && (req.ResumeChecksum == "" || req.SnapshotOnly) {
+		return errors.New("resumeAfterRows needs resumeChecksum and rows sent over the socket")
+	}
+	if err := runner.ValidateTransforms(requestTransforms(req)); err != nil {
+		return err
+	}
+	if len(req.Aggregates) > 0 && (req.CountOnly || req.Limit > 0 || req.Offset > 0 || req.Preview) {
+		return errors.New("aggregates cannot be combined with countOnly, limit, offset or preview")
+	}
+	if err := runner.ValidateAggregates(requestAggregates(req)); err != nil {
+		return err
+	}
+	if req.Sample != nil {
+		if req.CountOnly || len(req.Aggregates) > 0 {
+			return errors.New("sample cannot be combined with countOnly or aggregates")
+		}
+		if err := requestSample(req).Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkJobOptions checks the job settings of a request, which drivers of
+// engines without jobs ignore
+func checkJobOptions(req *QueryRequest) error {
+	switch req.JobPriority {
+	case "", driver.JobPriorityInteractive, driver.JobPriorityBatch:
+	default:
+		return fmt.Errorf("invalid jobPriority %q: want interactive or batch", req.JobPriority)
+	}
+	if req.MaxBytesBilled < 0 {
+		return fmt.Errorf("maxBytesBilled must not be negative, got %d", req.MaxBytesBilled)
+	}
+	if len(req.JobLabels) > maxJobLabels {
+		return fmt.Errorf("at most %d jobLabels, got %d", maxJobLabels, len(req.JobLabels))
+	}
+	for key, value := range req.JobLabels {
+		if key == runner.JobLabelOrganization || key == runner.JobLabelQuery {
+			return fmt.Errorf("job label %q is set by the server", key)
+		}
+		if err := driver.ValidateLabel(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // startQueueWorker processes queries from the queue
-func (s *Server) startQueueWorker(ctx context.Context, connState *ConnectionState) {
+func (s *Server) startQueueWorker(ctx context.Context, connState *ConnectionState, workerID int) {
+	// Workers started by a reload do not inherit the connection's label
+	pprof.SetGoroutineLabels(ctx)
 	connState.TasksMutex.Lock()
 	connState.QueueWorkers++
 	connState.TasksMutex.Unlock()
@@ -201,194 +738,470 @@ func (s *Server) startQueueWorker(ctx context.Context, connState *ConnectionStat
 	}()
 
 	for {
-		select {
-		case <-ctx.Done():
+		task, ok := connState.QueryQueue.pop(ctx)
+		if !ok {
 			return
-		case task := <-connState.QueryQueue:
-			if task == nil {
-				continue
-			}
-
-			task.Status = "running"
-			task.ExecutedAt = time.Now()
-			s.sendStatus(connState.Conn, task.Request.StreamID, "running", connState)
+		}
+		if !s.claimTask(connState, task) {
+			// Ended while queued; the client has been told already
+			continue
+		}
 
-			err := s.executeQuery(ctx, task.Request.StreamID, connState, task)
+		s.trace(connState, task.Request, "dequeued", map[string]interface{}{
+			"worker":     workerID,
+			"waitedMs":   time.Since(task.QueuedAt).Milliseconds(),
+			"queueDepth": connState.QueryQueue.len(),
+		})
+		s.routing.record(connState, task, protocol.StatusRunning, "")
+		s.sendStatus(connState.Conn, task.Request.StreamID, protocol.StatusRunning, connState)
+		s.fireEvent(connState, task, hooks.EventStarted, nil)
+
+		err := s.runTask(connState, task)
+		s.recordOutcome(connState, task, err)
+		connState.QueryQueue.observe(time.Since(task.ExecutedAt))
+		slow := s.markSlow(connState, task, err)
+
+		// The worker owns a running task, so only it ends one
+		var timeout *executionTimeoutError
+		switch {
+		case errors.As(err, &timeout):
+			s.endTask(connState, task, protocol.StatusRunning, protocol.StatusTimeout)
+			s.sendStatusDetails(connState.Conn, task.Request.StreamID, protocol.StatusTimeout, map[string]interface{}{
+				"reason":  err.Error(),
+				"code":    protocol.ErrorCodeExecutionTimeout,
+				"limitMs": timeout.limit.Milliseconds(),
+			}, connState)
+		case errors.Is(err, errCancelTimedOut):
+			s.endTask(connState, task, protocol.StatusRunning, protocol.StatusCancelled)
+			s.sendStatusDetails(connState.Conn, task.Request.StreamID, protocol.StatusCancelled, map[string]interface{}{
+				"reason": err.Error(),
+				"code":   protocol.ErrorCodeCancelTimeout,
+			}, connState)
+		case errors.Is(err, context.Canceled):
+			s.endTask(connState, task, protocol.StatusRunning, protocol.StatusCancelled)
+			connState.TasksMutex.RLock()
+			details := cancelledDetails(task)
+			connState.TasksMutex.RUnlock()
+			s.sendStatusDetails(connState.Conn, task.Request.StreamID, protocol.StatusCancelled, details, connState)
+		case err != nil:
+			s.endTask(connState, task, protocol.StatusRunning, protocol.StatusFailed)
+			s.sendTaskFailure(connState, task, err)
+			s.sendStatus(connState.Conn, task.Request.StreamID, protocol.StatusFailed, connState)
+		default:
+			s.endTask(connState, task, protocol.StatusRunning, protocol.StatusCompleted)
+			s.sendStatus(connState.Conn, task.Request.StreamID, protocol.StatusCompleted, connState)
+		}
 
-			if err != nil {
-				task.Status = "failed"
-				s.sendError(connState.Conn, task.Request.StreamID, err.Error(), connState)
-				s.sendStatus(connState.Conn, task.Request.StreamID, "failed", connState)
-			} else {
-				task.Status = "completed"
-				s.sendStatus(connState.Conn, task.Request.StreamID, "completed", connState)
-			}
+		// The stream ID is free again once the client has been told how it
+		// ended, before the audit log and hooks are written
+		connState.TasksMutex.Lock()
+		s.releaseTask(connState, task)
+		connState.TasksMutex.Unlock()
 
-			connState.TasksMutex.Lock()
-			delete(connState.ActiveTasks, task.Request.StreamID)
-			connState.TasksMutex.Unlock()
-			task.CancelFunc()
+		s.recordAudit(connState, task, err)
+		switch {
+		case errors.Is(err, context.Canceled):
+			s.fireEvent(connState, task, hooks.EventCancelled, nil)
+		case err != nil:
+			s.fireEvent(connState, task, hooks.EventFailed, err)
+		default:
+			s.fireEvent(connState, task, hooks.EventCompleted, nil)
+		}
+		if slow {
+			s.fireEvent(connState, task, hooks.EventSlow, err)
 		}
 	}
 }
 
 // executeQuery processes a single query
 func (s *Server) executeQuery(ctx context.Context, streamID string, connState *ConnectionState, task *QueryTask) error {
-	stream, err := runner.ExecuteQuery(ctx, task.Request.QueryID, task.Request.TemplateData, s.supaClient)
-	fmt.Println("Executing: ", streamID)
+	progress := s.startProgress(connState, task)
+	defer progress.stop()
+	sink := s.newStreamSink(connState, task, progress)
+
+	caller := connState.Principal()
+	if key, ok := s.flightKey(task.Request, caller); ok {
+		return s.joinFlight(ctx, key, caller, sink)
+	}
+	if s.publishes(task.Request) {
+		return s.runRemote(ctx, caller, sink)
+	}
+
+	opts := s.executeOptions(task.Request, caller, sink)
+	opts.OnCanceller = func(c driver.Canceller) { s.setTaskCanceller(connState, task, c) }
+	var stream *runner.StreamResult
+	var err error
+	if task.Request.ExecutionID != "" {
+		stream, err = runner.AttachExecution(ctx, task.Request.QueryID, task.Request.ExecutionID, s.store, opts)
+	} else {
+		stream, err = runner.ExecuteQuery(ctx, task.Request.QueryID, task.Request.TemplateData, s.store, opts)
+	}
 	if err != nil {
 		return fmt.Errorf("execute query: %w", err)
 	}
 	defer stream.Close()
+	s.setTaskCloser(connState, task, stream)
 
-	var totalRows int64
-	var currentBatch [][]interface{}
-
+	sink.source = stream
+	sink.opened(stream.FromCache())
 	err = stream.Stream(func(cols []string, row []interface{}) error {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-
-		if cols != nil {
-			metadata := QueryMetadata{
-				Columns:   cols,
-				TotalRows: 0,
-			}
-			msg := WSMessage{
-				Type:     MessageTypeMetadata,
-				StreamID: streamID,
-				Payload: map[string]interface{}{
-					"metadata": metadata,
-				},
-			}
-			return s.sendMessage(connState.Conn, msg, connState)
-		}
-
-		if row != nil {
-			currentBatch = append(currentBatch, row)
-			totalRows++
-
-			// Send batch when it reaches batchSize
-			if len(currentBatch) >= batchSize {
-				msg := WSMessage{
-					Type:     MessageTypeRow,
-					StreamID: streamID,
-					Payload: map[string]interface{}{
-						"data": currentBatch,
-					},
-				}
-				if err := s.sendMessage(connState.Conn, msg, connState); err != nil {
-					return err
-				}
-				currentBatch = make([][]interface{}, 0, batchSize)
-			}
-		}
-		return nil
+		return sink.handle(ctx, cols, row)
 	})
 
 	// Send any remaining rows in the final batch
-	if len(currentBatch) > 0 {
-		msg := WSMessage{
-			Type:     MessageTypeRow,
-			StreamID: streamID,
-			Payload: map[string]interface{}{
-				"data": currentBatch,
-			},
-		}
-		if err := s.sendMessage(connState.Conn, msg, connState); err != nil {
+	if ctx.Err() == nil {
+		if err := sink.flush(); err != nil {
 			return err
 		}
 	}
-
+	if errors.Is(err, errLimitExceeded) {
+		return sink.complete(true, nil, nil)
+	}
 	if err != nil {
 		return err
 	}
+	return sink.complete(stream.Truncated(), stream.Sample(), stream.Snapshot())
+}
 
-	completeMsg := WSMessage{
-		Type:     MessageTypeComplete,
-		StreamID: streamID,
-		Payload: map[string]interface{}{
-			"totalRows": totalRows,
-		},
+// executionObserver receives the events of an execution
+type executionObserver interface {
+	resolved(query *runner.Query, connector *runner.Connector)
+	rendered(sql string, templateData interface{})
+	connected()
+	progressSource(engine driver.ProgressReporter)
+	statement(ev runner.StatementEvent)
+	submitted(executionID string)
+}
+
+// executeOptions builds the runner options for a request made by caller,
+// reporting the execution's events to obs
+func (s *Server) executeOptions(req *QueryRequest, caller *Principal, obs executionObserver) runner.ExecuteOptions {
+	return runner.ExecuteOptions{
+		OnResolved:         obs.resolved,
+		OnRendered:         obs.rendered,
+		OnConnected:        obs.connected,
+		OnProgressReporter: obs.progressSource,
+		OnStatement:        obs.statement,
+		Timeouts:           s.config.Timeouts,
+		ParameterSet:       req.ParameterSet,
+		Constants:          s.config.TemplateConstants,
+		TemplateMode:       s.config.TemplateMode,
+		ValidateSQL:        s.config.ValidateSQL,
+		Async:              req.Async,
+		CountOnly:          req.CountOnly,
+		Limit:              req.Limit,
+		Offset:             req.Offset,
+		PreviewRows:        s.previewRows(req),
+		Keyring:            s.keyring,
+		Secrets:            s.secretResolver(),
+		ResultCache:        s.resultCache,
+		WarmPool:           s.warmPool,
+		MetadataCache:      s.metadataCache,
+		CacheBust:          req.CacheBust,
+		CacheControl:       req.CacheControl,
+		Snapshots:          s.snapshots,
+		SnapshotFormat:     req.Snapshot,
+		OnExecutionID:      obs.submitted,
+		Caller:             caller.caller(),
+		Replay:             req.Replay,
+		QueryVersion:       req.QueryVersion,
+		Timezone:           req.Timezone,
+		ResultReuse:        resultReuse(req),
+		JobLabels:          req.JobLabels,
+		JobPriority:        req.JobPriority,
+		MaxBytesBilled:     req.MaxBytesBilled,
+		Transforms:         requestTransforms(req),
+		Aggregates:         requestAggregates(req),
+		Sample:             requestSample(req),
+		Memory:             s.config.Memory,
 	}
-	return s.sendMessage(connState.Conn, completeMsg, connState)
 }
 
-// cleanupConnection handles connection cleanup
-func (s *Server) cleanupConnection(connState *ConnectionState) {
-	connState.TasksMutex.Lock()
-	defer connState.TasksMutex.Unlock()
+// resultReuse returns the age of the results a request lets the engine
+// reuse; any negative value turns reuse off, and is kept from wrapping
+// around when converted
+func resultReuse(req *QueryRequest) time.Duration {
+	if req.ResultReuseMinutes < 0 {
+		return -time.Minute
+	}
+	return time.Duration(min(req.ResultReuseMinutes, athena.MaxResultReuseMinutes)) * time.Minute
+}
 
-	for _, task := range connState.ActiveTasks {
-		task.CancelFunc()
+// requestTransforms converts a request's transforms for the runner
+func requestTransforms(req *QueryRequest) []runner.Transform {
+	var transforms []runner.Transform
+	for _, t := range req.Transforms {
+		transforms = append(transforms, runner.Transform(t))
 	}
+	return transforms
+}
 
-	close(connState.QueryQueue)
+// requestSample converts a request's sample for the runner
+func requestSample(req *QueryRequest) *runner.Sample {
+	if req.Sample == nil {
+		return nil
+	}
+	sample := runner.Sample(*req.Sample)
+	return &sample
 }
 
-// writePingMessages sends periodic ping messages
-func (s *Server) writePingMessages(conn *websocket.Conn, connState *ConnectionState) {
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
+// requestAggregates converts a request's aggregates for the runner
+func requestAggregates(req *QueryRequest) []runner.Aggregate {
+	var aggregates []runner.Aggregate
+	for _, a := range req.Aggregates {
+		aggregates = append(aggregates, runner.Aggregate(a))
+	}
+	return aggregates
+}
 
-	for range ticker.C {
-		connState.WriteMutex.Lock()
-		conn.SetWriteDeadline(time.Now().Add(writeWait))
-		if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-			connState.WriteMutex.Unlock()
-			return
+// previewRows returns the rows a preview request fetches, or 0 when the
+// request is not a preview
+func (s *Server) previewRows(req *QueryRequest) int64 {
+	switch {
+	case !req.Preview:
+		return 0
+	case req.PreviewRows > 0:
+		return req.PreviewRows
+	case s.config.PreviewRows > 0:
+		return s.config.PreviewRows
+	default:
+		return defaultPreviewRows
+	}
+}
+
+// cleanupConnection ends a closed connection's tasks. Closing the queue
+// first stops its workers taking more; queued tasks are then cancelled here
+// and running ones by their workers once the driver stops. When the
+// connection dropped, its queued requests are first parked for the client
+// to resume on a new connection.
+func (s *Server) cleanupConnection(connState *ConnectionState, dropped bool) {
+	connState.QueryQueue.close()
+
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	if dropped && connState.sessionID != "" && !s.Draining() {
+		s.parkQueued(connState)
+	}
+	for _, task := range connState.ActiveTasks {
+		if task.cancelReason == "" {
+			task.cancelReason = disconnectCancelReason
 		}
-		connState.WriteMutex.Unlock()
+		s.cancelStream(connState, task)
 	}
 }
 
-// sendMessage sends a message to the WebSocket connection
+// sendMessage queues a message for the connection's writer
 func (s *Server) sendMessage(conn *websocket.Conn, msg WSMessage, connState *ConnectionState) error {
-	connState.WriteMutex.Lock()
-	defer connState.WriteMutex.Unlock()
+	return s.deliver(connState, msg, s.enqueue)
+}
 
-	conn.SetWriteDeadline(time.Now().Add(writeWait))
-	return conn.WriteJSON(msg)
+// decodeClientMessage decodes a client frame. Text frames are always JSON so
+// hand-written messages work on any connection; binary frames use the
+// negotiated encoding.
+func decodeClientMessage(connState *ConnectionState, frameType int, data []byte, msg *protocol.ClientMessage) error {
+	if frameType == websocket.BinaryMessage && connState.Codec.Binary() {
+		return connState.Codec.Unmarshal(data, msg)
+	}
+	return json.Unmarshal(data, msg)
 }
 
-// sendError sends an error message to the client
+// sendError rejects a malformed or invalid client message
 func (s *Server) sendError(conn *websocket.Conn, streamID string, message string, connState *ConnectionState) {
 	msg := WSMessage{
 		Type:     MessageTypeError,
 		StreamID: streamID,
 		Payload: map[string]interface{}{
 			"error": message,
+			"code":  protocol.ErrorCodeInvalidRequest,
 		},
 	}
 	s.sendMessage(conn, msg, connState)
 }
 
+// sendFailure reports a failed execution, adding an error code when the
+// failure has one
+func (s *Server) sendFailure(conn *websocket.Conn, streamID string, err error, connState *ConnectionState) {
+	s.sendMessage(conn, WSMessage{
+		Type:     MessageTypeError,
+		StreamID: streamID,
+		Payload:  failurePayload(err),
+	}, connState)
+}
+
+// sendTaskFailure reports a failed execution. A debug request also gets
+// the rendered SQL and the error with only its secrets redacted.
+func (s *Server) sendTaskFailure(connState *ConnectionState, task *QueryTask, err error) {
+	payload := failurePayload(err)
+	if task.Request.Debug && connState.admin {
+		payload["error"] = redact.Secrets(err.Error())
+		connState.TasksMutex.RLock()
+		if task.RenderedSQL != "" {
+			payload["sql"] = task.RenderedSQL
+		}
+		connState.TasksMutex.RUnlock()
+	}
+	s.sendMessage(connState.Conn, WSMessage{
+		Type:     MessageTypeError,
+		StreamID: task.Request.StreamID,
+		Payload:  payload,
+	}, connState)
+}
+
+// sendRejection answers a query request the server did not accept. The
+// error carries "rejected": true and no sequence number, since the stream ID
+// may belong to an execution that is still running.
+func (s *Server) sendRejection(conn *websocket.Conn, streamID string, err error, connState *ConnectionState) {
+	payload := failurePayload(err)
+	payload["rejected"] = true
+	s.sendUnnumbered(connState, WSMessage{
+		Type:     MessageTypeError,
+		StreamID: streamID,
+		Payload:  payload,
+	})
+}
+
+// failurePayload describes a failed execution to the client, with an error
+// code and details when the failure has them
+func failurePayload(err error) map[string]interface{} {
+	var remote *remoteError
+	if errors.As(err, &remote) {
+		return remote.payload
+	}
+	payload := map[string]interface{}{
+		"error": redact.Message(err.Error()),
+	}
+
+	var timeout *runner.TimeoutError
+	if errors.As(err, &timeout) {
+		payload["code"] = timeout.Code()
+	}
+	if errors.Is(err, errSlowClient) {
+		payload["code"] = protocol.ErrorCodeSlowClient
+	}
+	if errors.Is(err, errQueueTimeout) {
+		payload["code"] = protocol.ErrorCodeQueueTimeout
+	}
+	if errors.Is(err, runner.ErrMemoryBudgetExceeded) {
+		payload["code"] = protocol.ErrorCodeMemoryBudgetExceeded
+	}
+	if errors.Is(err, errServerShuttingDown) {
+		payload["code"] = protocol.ErrorCodeServerShutdown
+	}
+	if errors.Is(err, errDuplicateStream) {
+		payload["code"] = protocol.ErrorCodeDuplicateStream
+	}
+	if errors.Is(err, errResumeMismatch) {
+		payload["code"] = protocol.ErrorCodeIntegrity
+	}
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		payload["code"] = limited.errorCode()
+		if limited.retryAfter > 0 {
+			payload["retryAfterMs"] = limited.retryAfter.Milliseconds()
+		}
+	}
+	var invalid *runner.ValidationError
+	if errors.As(err, &invalid) {
+		payload["code"] = protocol.ErrorCodeInvalidParameters
+		payload["parameterErrors"] = invalid.Errors
+	}
+	var rejected *runner.SQLValidationError
+	if errors.As(err, &rejected) {
+		payload["code"] = protocol.ErrorCodeValidation
+		payload["validationErrors"] = rejected.Problems
+	}
+	var request *requestError
+	if errors.As(err, &request) {
+		payload["code"] = protocol.ErrorCodeInvalidRequest
+	}
+	if _, ok := payload["code"]; !ok {
+		payload["code"] = protocol.ErrorCodeInternal
+		if code := runner.ErrorCode(err); code != "" {
+			payload["code"] = code
+		}
+	}
+	addEngineError(payload, err)
+	return payload
+}
+
+// addEngineError adds what the engine reported about an error it raised
+func addEngineError(payload map[string]interface{}, err error) {
+	var classified *driver.Error
+	if errors.As(err, &classified) && classified.Engine != (protocol.EngineError{}) {
+		payload["engine"] = classified.Engine
+	}
+}
+
 // sendStatus sends a status update message to the client
 func (s *Server) sendStatus(conn *websocket.Conn, streamID string, status string, connState *ConnectionState) {
+	s.sendStatusDetails(conn, streamID, status, nil, connState)
+}
+
+// sendStatusDetails sends a status update carrying additional payload fields
+func (s *Server) sendStatusDetails(conn *websocket.Conn, streamID string, status string, details map[string]interface{}, connState *ConnectionState) {
+	payload := map[string]interface{}{
+		"status": status,
+	}
+	for k, v := range details {
+		payload[k] = v
+	}
+
 	msg := WSMessage{
 		Type:     MessageTypeStatus,
 		StreamID: streamID,
-		Payload: map[string]interface{}{
-			"status": status,
-		},
+		Payload:  payload,
 	}
 	s.sendMessage(conn, msg, connState)
 }
 
+// Handler returns the HTTP handler serving the WebSocket, REST, export and
+// health endpoints
+func (s *Server) Handler() http.Handler {
+	s.startBackground()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/healthz", s.handleLive)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/export", s.requireAuth(s.handleExport))
+	mux.HandleFunc("POST /api/v1/queries/{id}/execute", s.requireAuth(s.handleRESTExecute))
+	mux.HandleFunc("GET /api/v1/queries/{id}/history", s.requireAuth(s.handleRESTHistory))
+	mux.HandleFunc("POST /api/v1/connectors/{id}/test", s.requireAuth(s.handleRESTTestConnection))
+	mux.HandleFunc("GET /api/v1/executions/{id}", s.requireAuth(s.handleRESTExecution))
+	mux.HandleFunc("DELETE /api/v1/executions/{id}", s.requireAuth(s.handleRESTCancel))
+	mux.HandleFunc("GET /api/v1/prewarms", s.requireAuth(s.handleRESTPrewarms))
+	mux.HandleFunc("POST /api/v1/prewarms", s.requireAuth(s.handleRESTDeclarePrewarm))
+	mux.HandleFunc("DELETE /api/v1/prewarms/{id}", s.requireAuth(s.handleRESTDeletePrewarm))
+	mux.HandleFunc("GET /api/v1/streams/{id}/owner", s.requireAuth(s.handleStreamOwner))
+	mux.HandleFunc("GET /admin/connections", s.requireAdmin(s.handleAdminConnections))
+	mux.HandleFunc("GET /admin/executions", s.requireAdmin(s.handleAdminExecutions))
+	mux.HandleFunc("DELETE /admin/executions/{id}", s.requireAdmin(s.handleAdminKill))
+	mux.HandleFunc("POST /admin/reload", s.requireAdmin(s.handleAdminReload))
+	if s.config.StatusPage {
+		mux.HandleFunc("/admin/status", s.requireAdmin(s.handleStatusPage))
+		mux.HandleFunc("/admin/status.json", s.requireAdmin(s.handleStatusJSON))
+	}
+	if s.config.Diagnostics {
+		// go tool pprof reads the profiles given the token as a query
+		// parameter
+		mux.HandleFunc("GET /admin/diagnostics", s.requireAdmin(s.handleAdminDiagnostics))
+		mux.HandleFunc("/debug/pprof/", s.requireAdmin(httppprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.requireAdmin(httppprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.requireAdmin(httppprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.requireAdmin(httppprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.requireAdmin(httppprof.Trace))
+	}
+	return s.origins.cors(mux)
+}
+
 // Start initializes and starts the server
 func (s *Server) Start() error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", s.handleWebSocket)
-	mux.HandleFunc("/health", s.handleHealth)
-
 	server := &http.Server{
 		Addr:    ":" + s.config.Port,
-		Handler: mux,
+		Handler: s.Handler(),
 	}
 
 	serverClosed := make(chan struct{})
@@ -404,6 +1217,18 @@ func (s *Server) Start() error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	// SIGHUP reloads the config file in place
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if _, err := s.ReloadConfigFile(); err != nil {
+				log.Printf("Config reload failed: %v", err)
+			}
+		}
+	}()
+
 	select {
 	case <-stop:
 		log.Println("Received shutdown signal")
@@ -411,15 +1236,15 @@ func (s *Server) Start() error {
 		log.Println("Context cancelled")
 	}
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer shutdownCancel()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), s.drainTimeout())
+	defer drainCancel()
+	if err := s.Drain(drainCtx); err != nil {
+		log.Printf("Drain ended early: %v", err)
+	}
 
-	s.activeConns.Range(func(key, value interface{}) bool {
-		if connState, ok := value.(*ConnectionState); ok {
-			s.cleanupConnection(connState)
-		}
-		return true
-	})
+	// Remaining HTTP requests, such as exports, get the cancel timeout
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), s.cancelTimeout())
+	defer shutdownCancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		return fmt.Errorf("server shutdown: %w", err)
@@ -0,0 +1,222 @@
+package websocket
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/google/uuid"
+)
+
+// How long a reconnecting client waits for the connection it is taking
+// over to be cleaned up
+const sessionTakeoverWait = 5 * time.Second
+
+// SessionConfig sets whether a client that lost its connection can resume
+// its session on a new one
+type SessionConfig struct {
+	// ResumeWindow is how long the queued streams of a connection that
+	// dropped are kept for the client to reconnect and resume them; zero
+	// ends them with the connection
+	ResumeWindow time.Duration `toml:"resume_window"`
+}
+
+// parkedRequest is a stream that was still queued when its connection
+// dropped, kept to be queued again on the connection resuming the session
+type parkedRequest struct {
+	req        QueryRequest
+	receivedAt time.Time
+}
+
+// parkedSession holds what a dropped connection left for the client to
+// resume until its resume window passes
+type parkedSession struct {
+	requests []parkedRequest
+	expiry   *time.Timer
+}
+
+// sessionRegistry tracks the session of each connection and the sessions
+// waiting to be resumed. Sessions live on the replica that accepted them;
+// tokens are signed with a key of the replica's own, so another replica
+// starts a new session instead.
+type sessionRegistry struct {
+	key []byte
+
+	mu     sync.Mutex
+	live   map[string]*ConnectionState
+	parked map[string]*parkedSession
+}
+
+func newSessionRegistry() *sessionRegistry {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &sessionRegistry{
+		key:    key,
+		live:   make(map[string]*ConnectionState),
+		parked: make(map[string]*parkedSession),
+	}
+}
+
+// token signs a session ID for the caller, so only the caller who opened a
+// session can resume it
+func (r *sessionRegistry) token(id string, caller *Principal) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(id))
+	if caller != nil {
+		for _, field := range []string{caller.OrganizationID, caller.UserID, caller.APIKeyID} {
+			mac.Write([]byte{0})
+			mac.Write([]byte(field))
+		}
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session ID of a token the caller was issued
+func (r *sessionRegistry) verify(token string, caller *Principal) (string, bool) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	return id, hmac.Equal([]byte(token), []byte(r.token(id, caller)))
+}
+
+// attach makes a connection the session's, returning the connection that
+// had it
+func (r *sessionRegistry) attach(id string, connState *ConnectionState) *ConnectionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.live[id]
+	r.live[id] = connState
+	return prev
+}
+
+// detach forgets a closed connection, unless another took its session over
+func (r *sessionRegistry) detach(connState *ConnectionState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.live[connState.sessionID] == connState {
+		delete(r.live, connState.sessionID)
+	}
+}
+
+// park keeps a dropped connection's queued requests for the window
+func (r *sessionRegistry) park(id string, requests []parkedRequest, window time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parked := &parkedSession{requests: requests}
+	parked.expiry = time.AfterFunc(window, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.parked[id] == parked {
+			delete(r.parked, id)
+		}
+	})
+	r.parked[id] = parked
+}
+
+// resume takes the requests parked for a session
+func (r *sessionRegistry) resume(id string) []parkedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parked, ok := r.parked[id]
+	if !ok {
+		return nil
+	}
+	parked.expiry.Stop()
+	delete(r.parked, id)
+	return parked.requests
+}
+
+// openSession gives a new connection its session: the one named by the
+// token it presented, if valid for its caller, or a new one. A connection
+// still holding the session is closed first, as a client only reconnects
+// once it has given up on it, and the requests it parks are resumed.
+func (s *Server) openSession(r *http.Request, connState *ConnectionState) (requests []parkedRequest, resumed bool) {
+	if s.config.Sessions.ResumeWindow <= 0 {
+		return nil, false
+	}
+
+	token := r.Header.Get(protocol.SessionHeader)
+	if token == "" {
+		token = r.URL.Query().Get("session")
+	}
+	id, ok := s.sessions.verify(token, connState.Principal())
+	if !ok {
+		connState.sessionID = uuid.NewString()
+		s.sessions.attach(connState.sessionID, connState)
+		return nil, false
+	}
+
+	connState.sessionID = id
+	if prev := s.sessions.attach(id, connState); prev != nil {
+		prev.Conn.Close()
+		select {
+		case <-prev.closed:
+		case <-time.After(sessionTakeoverWait):
+		}
+	}
+	return s.sessions.resume(id), true
+}
+
+// parkQueued keeps the queued streams of a connection that dropped, in
+// queue order, for the client to resume. Streams with requests waiting
+// behind them are not kept, since the client does not resume those. The
+// caller holds the task lock and cancels the tasks afterwards.
+func (s *Server) parkQueued(connState *ConnectionState) {
+	var queued []*QueryTask
+	for _, task := range connState.ActiveTasks {
+		if task.Status == protocol.StatusQueued && task.successor == nil {
+			queued = append(queued, task)
+		}
+	}
+	if len(queued) == 0 {
+		return
+	}
+
+	positions := make(map[*QueryTask]int, len(queued))
+	for _, task := range queued {
+		positions[task] = connState.QueryQueue.position(task)
+	}
+	sort.Slice(queued, func(i, j int) bool { return positions[queued[i]] < positions[queued[j]] })
+
+	requests := make([]parkedRequest, 0, len(queued))
+	for _, task := range queued {
+		// Groups end with their connection, so the stream resumes alone
+		req := *task.Request
+		req.GroupID = ""
+		requests = append(requests, parkedRequest{req: req, receivedAt: task.receivedAt})
+	}
+	s.sessions.park(connState.sessionID, requests, s.config.Sessions.ResumeWindow)
+}
+
+// restoreSession queues the requests a resumed session kept, ahead of
+// anything the client sends on the new connection. A request that can no
+// longer be queued fails on its stream, which the client kept waiting.
+func (s *Server) restoreSession(ctx context.Context, connState *ConnectionState, requests []parkedRequest) {
+	for _, parked := range requests {
+		req := parked.req
+		if err := s.queueQuery(ctx, connState, &req, parked.receivedAt); err != nil {
+			s.recordError(connState, &req, err)
+			s.sendFailure(connState.Conn, req.StreamID, err, connState)
+			s.sendStatus(connState.Conn, req.StreamID, protocol.StatusFailed, connState)
+		}
+	}
+}
+
+// resumedStreams lists the stream IDs of a resumed session's requests
+func resumedStreams(requests []parkedRequest) []string {
+	ids := make([]string, 0, len(requests))
+	for _, parked := range requests {
+		ids = append(ids, parked.req.StreamID)
+	}
+	return ids
+}
@@ -0,0 +1,363 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"supalytics-executor/driver"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+// errResumeMismatch fails a resumed stream whose rows are not the ones the
+// client received before
+var errResumeMismatch = errors.New("resumed result differs from the rows already received")
+
+// streamSink turns the rows of an execution into one stream's messages:
+// it batches rows in the connection's encoding, meters them against the
+// stream's credits and checksums them for the complete message
+type streamSink struct {
+	s         *Server
+	connState *ConnectionState
+	task      *QueryTask
+	progress  *progressReporter
+
+	totalRows int64
+	batch     [][]interface{}
+	checksum  *protocol.RowChecksum
+	// exceeded is the safety cap that stopped the stream
+	exceeded *protocol.LimitExceeded
+
+	// source is the result being streamed, which declares the nullability
+	// and scale of its columns; nil for results relayed from another replica
+	source *runner.StreamResult
+	// scales holds the declared scale of each column, for formatting rows
+	scales []*int
+
+	fromCache bool
+	cachedAt  time.Time
+	// shared is set for streams that joined another stream's execution,
+	// whose scan is charged to that stream
+	shared bool
+}
+
+func (s *Server) newStreamSink(connState *ConnectionState, task *QueryTask, progress *progressReporter) *streamSink {
+	return &streamSink{
+		s:         s,
+		connState: connState,
+		task:      task,
+		progress:  progress,
+		checksum:  protocol.NewRowChecksumCodec(connState.Codec),
+	}
+}
+
+func (k *streamSink) streamID() string {
+	return k.task.Request.StreamID
+}
+
+// resolved reports the query and connector an execution runs
+func (k *streamSink) resolved(query *runner.Query, connector *runner.Connector) {
+	k.connState.TasksMutex.Lock()
+	k.task.ConnectorID, k.task.QueryVersion = connector.ID, query.Version
+	k.connState.TasksMutex.Unlock()
+	k.s.health.register(connector)
+	if query.Stale || connector.Stale {
+		k.s.sendStatusDetails(k.connState.Conn, k.streamID(), protocol.StatusWarning, map[string]interface{}{
+			"warning": "stale metadata: the metadata store is unavailable, using cached query and connector",
+		}, k.connState)
+	}
+	k.s.trace(k.connState, k.task.Request, "resolved", map[string]interface{}{
+		"connectorId":   connector.ID,
+		"connectorType": connector.Type,
+	})
+}
+
+func (k *streamSink) rendered(sql string, templateData interface{}) {
+	k.connState.TasksMutex.Lock()
+	k.task.RenderedSQL, k.task.TemplateData = sql, templateData
+	k.connState.TasksMutex.Unlock()
+}
+
+func (k *streamSink) connected() {
+	k.s.trace(k.connState, k.task.Request, "driver_connected", nil)
+}
+
+func (k *streamSink) progressSource(engine driver.ProgressReporter) {
+	k.progress.setSource(engine)
+}
+
+func (k *streamSink) statement(ev runner.StatementEvent) {
+	k.s.sendStatusDetails(k.connState.Conn, k.streamID(), protocol.StatusStatement, map[string]interface{}{
+		"statement": map[string]interface{}{
+			"index":      ev.Index,
+			"total":      ev.Total,
+			"state":      ev.State,
+			"durationMs": ev.Duration.Milliseconds(),
+		},
+	}, k.connState)
+}
+
+func (k *streamSink) submitted(executionID string) {
+	k.s.routing.record(k.connState, k.task, protocol.StatusSubmitted, executionID)
+	k.s.sendStatusDetails(k.connState.Conn, k.streamID(), protocol.StatusSubmitted, map[string]interface{}{
+		"executionId": executionID,
+	}, k.connState)
+}
+
+// opened is called once the result is ready to stream, with whether it is
+// replayed from the result cache and when it was cached
+func (k *streamSink) opened(fromCache bool, cachedAt time.Time) {
+	k.fromCache, k.cachedAt = fromCache, cachedAt
+	if k.fromCache {
+		k.s.trace(k.connState, k.task.Request, "cache_hit", map[string]interface{}{
+			"cachedAt": k.cachedAt.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	k.s.trace(k.connState, k.task.Request, "executing", nil)
+}
+
+// scan returns the data the engine reports the execution scanned, records it
+// for the audit log and charges it to the caller's scan budget
+func (k *streamSink) scan() driver.Progress {
+	engine := k.progress.source()
+	if engine == nil {
+		return driver.Progress{}
+	}
+	scan := engine.Progress()
+	if k.shared || scan.BytesScanned <= 0 {
+		return scan
+	}
+
+	k.connState.TasksMutex.Lock()
+	k.task.BytesScanned, k.task.BytesBilled = scan.BytesScanned, scan.BytesBilled
+	k.connState.TasksMutex.Unlock()
+	k.s.quotas.charge(k.connState.Principal(), scan)
+	return scan
+}
+
+// markCached marks every message of a replayed result so clients can tell
+// it apart from a fresh one
+func (k *streamSink) markCached(payload map[string]interface{}) map[string]interface{} {
+	if k.fromCache {
+		payload["fromCache"] = true
+	}
+	return payload
+}
+
+// nullability lists whether each column allows nulls, nil where the
+// engine does not say; nil altogether when it says nothing of any
+func nullability(columns []driver.ColumnInfo) []*bool {
+	var out []*bool
+	for i, col := range columns {
+		if col.Nullable == nil {
+			continue
+		}
+		if out == nil {
+			out = make([]*bool, len(columns))
+		}
+		out[i] = col.Nullable
+	}
+	return out
+}
+
+// columnScales lists the scale of each fixed-point numeric column, nil for
+// other columns; nil altogether when there are none
+func columnScales(columns []driver.ColumnInfo) []*int {
+	var out []*int
+	for i, col := range columns {
+		if col.Scale == nil {
+			continue
+		}
+		if out == nil {
+			out = make([]*int, len(columns))
+		}
+		out[i] = col.Scale
+	}
+	return out
+}
+
+// handle processes one callback of the result stream: a column header or a
+// row
+func (k *streamSink) handle(ctx context.Context, cols []string, row []interface{}) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	if cols != nil {
+		metadata := QueryMetadata{
+			Columns:   cols,
+			TotalRows: 0,
+		}
+		if k.source != nil {
+			info := k.source.ColumnInfo(cols)
+			metadata.Nullable = nullability(info)
+			k.scales = columnScales(info)
+			metadata.Scales = k.scales
+		}
+		payload := map[string]interface{}{
+			"metadata": metadata,
+		}
+		k.connState.TasksMutex.RLock()
+		if k.task.QueryVersion > 0 {
+			payload["queryVersion"] = k.task.QueryVersion
+		}
+		k.connState.TasksMutex.RUnlock()
+		msg := WSMessage{
+			Type:     MessageTypeMetadata,
+			StreamID: k.streamID(),
+			Payload:  k.markCached(payload),
+		}
+		return k.s.sendMessage(k.connState.Conn, msg, k.connState)
+	}
+
+	if row == nil {
+		return nil
+	}
+	if k.totalRows < k.task.Request.ResumeAfterRows {
+		return k.skip(row)
+	}
+
+	// A flow-controlled stream holds the driver here until the client
+	// grants credit for the row
+	task := k.task
+	if task.credits != nil && task.credits.remaining() == 0 {
+		k.s.trace(k.connState, task.Request, "paused", map[string]interface{}{"rowsSent": k.totalRows})
+	}
+	if task.credits != nil {
+		if err := task.credits.acquire(ctx); err != nil {
+			return err
+		}
+	}
+
+	row = k.connState.Codec.EncodeRow(k.connState.Values.FormatRow(row, k.scales))
+	if k.totalRows == 0 {
+		k.s.trace(k.connState, task.Request, "first_row", nil)
+	}
+	// A snapshot-only stream counts its rows but leaves them to the
+	// snapshot
+	if task.Request.SnapshotOnly {
+		k.totalRows++
+		return nil
+	}
+	if err := k.checkLimits(); err != nil {
+		return err
+	}
+	if err := k.checksum.Add(row); err != nil {
+		return err
+	}
+	k.totalRows++
+	k.batch = append(k.batch, row)
+	task.RowsSent.Add(1)
+
+	// Send batch when it reaches batchSize, or early once credits run out
+	// so the client receives every row it granted
+	if len(k.batch) >= batchSize || (task.credits != nil && task.credits.remaining() == 0) {
+		return k.flush()
+	}
+	return nil
+}
+
+// skip checksums a row the client of a resumed stream already has without
+// sending it, checking the skipped rows against the client's checksum once
+// the last one is reached
+func (k *streamSink) skip(row []interface{}) error {
+	if err := k.checkLimits(); err != nil {
+		return err
+	}
+	if err := k.checksum.Add(k.connState.Codec.EncodeRow(k.connState.Values.FormatRow(row, k.scales))); err != nil {
+		return err
+	}
+	k.totalRows++
+
+	req := k.task.Request
+	if k.totalRows < req.ResumeAfterRows {
+		return nil
+	}
+	if sum := k.checksum.Sum(); sum != req.ResumeChecksum {
+		return fmt.Errorf("%w: checksum %s after %d rows, %s was received", errResumeMismatch, sum, k.totalRows, req.ResumeChecksum)
+	}
+	k.s.trace(k.connState, req, "resumed", map[string]interface{}{"rowsSkipped": k.totalRows})
+	return nil
+}
+
+// flush sends the rows batched so far
+func (k *streamSink) flush() error {
+	if len(k.batch) == 0 {
+		return nil
+	}
+	payload := map[string]interface{}{
+		"data": k.batch,
+	}
+	if k.task.Request.BatchChecksums {
+		payload["checksum"] = k.checksum.Sum()
+	}
+	msg := WSMessage{
+		Type:     MessageTypeRow,
+		StreamID: k.streamID(),
+		Payload:  k.markCached(payload),
+	}
+	k.batch = make([][]interface{}, 0, batchSize)
+
+	// Writes slowed by a client that is not keeping up are reported
+	start := time.Now()
+	err := k.s.deliver(k.connState, msg, func(connState *ConnectionState, frame outbound) error {
+		return k.s.enqueueRows(connState, k.task, frame)
+	})
+	if paused := time.Since(start); paused >= backpressureThreshold {
+		k.s.trace(k.connState, k.task.Request, "backpressure", map[string]interface{}{
+			"pausedMs": paused.Milliseconds(),
+			"rowsSent": k.totalRows,
+		})
+	}
+	return err
+}
+
+// complete sends the message that ends a successful stream, with the
+// sample the rows were reduced to and the snapshot of the result when one
+// was stored
+func (k *streamSink) complete(truncated bool, sample *runner.SampleInfo, snapshot *runner.Snapshot) error {
+	// A result shorter than what a resumed stream's client received is not
+	// the same result
+	if k.totalRows < k.task.Request.ResumeAfterRows {
+		return fmt.Errorf("%w: the result has %d rows, %d were received", errResumeMismatch, k.totalRows, k.task.Request.ResumeAfterRows)
+	}
+	// No progress may follow the complete message
+	k.progress.stop()
+	completeMsg := WSMessage{
+		Type:     MessageTypeComplete,
+		StreamID: k.streamID(),
+		Payload: k.markCached(map[string]interface{}{
+			"totalRows": k.totalRows,
+		}),
+	}
+	// The checksum covers the rows sent, so it is left out when none were
+	if !k.task.Request.SnapshotOnly {
+		completeMsg.Payload["checksum"] = k.checksum.Sum()
+	}
+	if truncated {
+		completeMsg.Payload["truncated"] = true
+	}
+	if k.exceeded != nil {
+		completeMsg.Payload["limitExceeded"] = k.exceeded
+	}
+	if sample != nil {
+		completeMsg.Payload["sample"] = sample
+	}
+	if k.fromCache {
+		completeMsg.Payload["cachedAt"] = k.cachedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if snapshot != nil {
+		completeMsg.Payload["snapshot"] = snapshot
+	}
+	if scan := k.scan(); scan.BytesScanned > 0 {
+		completeMsg.Payload["bytesScanned"] = scan.BytesScanned
+		if scan.BytesBilled > 0 {
+			completeMsg.Payload["bytesBilled"] = scan.BytesBilled
+		}
+	}
+	return k.s.sendMessage(k.connState.Conn, completeMsg, k.connState)
+}
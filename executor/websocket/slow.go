@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// SlowQueryConfig sets how long an execution may run before it is reported
+// as slow
+type SlowQueryConfig struct {
+	// Threshold applies to connectors without their own; zero reports no
+	// slow queries on them
+	Threshold time.Duration `toml:"threshold"`
+	// Connectors overrides the threshold by connector ID
+	Connectors map[string]time.Duration `toml:"connectors"`
+}
+
+// thresholdFor returns the slow-query threshold of a connector, zero if it
+// has none
+func (c SlowQueryConfig) thresholdFor(connectorID string) time.Duration {
+	if t, ok := c.Connectors[connectorID]; ok {
+		return t
+	}
+	return c.Threshold
+}
+
+// markSlow tags a finished task whose run, not counting time in the queue,
+// exceeded its connector's threshold, and reports whether it did. Cancelled
+// executions are not reported.
+func (s *Server) markSlow(connState *ConnectionState, task *QueryTask, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	connState.TasksMutex.Lock()
+	defer connState.TasksMutex.Unlock()
+	threshold := s.config.SlowQueries.thresholdFor(task.ConnectorID)
+	ran := time.Since(task.ExecutedAt)
+	if threshold <= 0 || ran <= threshold {
+		return false
+	}
+	task.slowThreshold, task.runTime = threshold, ran
+	log.Printf("Slow query %s on connector %s: ran %s, over its %s threshold (connection %s, stream %s)",
+		task.Request.QueryID, task.ConnectorID, ran.Round(time.Millisecond), threshold, connState.ID, task.Request.StreamID)
+	return true
+}
@@ -0,0 +1,352 @@
+package websocket
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/redact"
+	"supalytics-executor/runner"
+)
+
+// Number of recent errors retained for operators
+const recentErrorCapacity = 50
+
+// StatusSnapshot is a point-in-time view of the server used by operator endpoints
+type StatusSnapshot struct {
+	GeneratedAt time.Time            `json:"generatedAt"`
+	StartedAt   time.Time            `json:"startedAt"`
+	Uptime      string               `json:"uptime"`
+	Connections []ConnectionSnapshot `json:"connections"`
+	Connectors  []ConnectorHealth    `json:"connectors"`
+	// WarmDrivers counts the drivers kept connected for each pinned
+	// connector
+	WarmDrivers   map[string]int `json:"warmDrivers,omitempty"`
+	RecentErrors  []ErrorRecord  `json:"recentErrors"`
+	ActiveStreams int            `json:"activeStreams"`
+	QueuedStreams int            `json:"queuedStreams"`
+	// RejectedConnections counts connections refused by each connection
+	// limit since the server started
+	RejectedConnections ConnectionRejections `json:"rejectedConnections"`
+}
+
+// ConnectionSnapshot describes a live WebSocket connection
+type ConnectionSnapshot struct {
+	ID             string           `json:"id"`
+	RemoteAddr     string           `json:"remoteAddr"`
+	UserID         string           `json:"userId,omitempty"`
+	APIKeyID       string           `json:"apiKeyId,omitempty"`
+	OrganizationID string           `json:"organizationId,omitempty"`
+	ConnectedAt    time.Time        `json:"connectedAt"`
+	Encoding       string           `json:"encoding"`
+	Compressed     bool             `json:"compressed"`
+	QueueDepth     int              `json:"queueDepth"`
+	QueueCapacity  int              `json:"queueCapacity"`
+	SendQueued     int              `json:"sendQueued"`
+	Workers        int              `json:"workers"`
+	Streams        []StreamSnapshot `json:"streams"`
+}
+
+// StreamSnapshot describes a queued or running stream
+type StreamSnapshot struct {
+	ID          string    `json:"id"`
+	StreamID    string    `json:"streamId"`
+	QueryID     string    `json:"queryId"`
+	ConnectorID string    `json:"connectorId,omitempty"`
+	Status      string    `json:"status"`
+	Priority    string    `json:"priority"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	StartedAt   time.Time `json:"startedAt,omitempty"`
+	RuntimeMS   int64     `json:"runtimeMs"`
+	RowsSent    int64     `json:"rowsSent"`
+}
+
+// ConnectorHealth summarizes the recent execution outcomes of a connector
+type ConnectorHealth struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastFailure time.Time `json:"lastFailure,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	// Status is the result of the latest health check, if any has run
+	Status     string    `json:"status,omitempty"`
+	LastCheck  time.Time `json:"lastCheck,omitempty"`
+	CheckError string    `json:"checkError,omitempty"`
+}
+
+// Healthy reports whether the most recent execution on the connector succeeded
+func (h ConnectorHealth) Healthy() bool {
+	return !h.LastSuccess.Before(h.LastFailure)
+}
+
+// ErrorRecord is a failed or rejected execution
+type ErrorRecord struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connectionId"`
+	StreamID     string    `json:"streamId"`
+	QueryID      string    `json:"queryId"`
+	Error        string    `json:"error"`
+}
+
+// connectorHealthTracker aggregates execution outcomes per connector
+type connectorHealthTracker struct {
+	mu         sync.Mutex
+	connectors map[string]*ConnectorHealth
+}
+
+func newConnectorHealthTracker() *connectorHealthTracker {
+	return &connectorHealthTracker{connectors: make(map[string]*ConnectorHealth)}
+}
+
+// register records a connector the first time it is used
+func (t *connectorHealthTracker) register(c *runner.Connector) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.connectors[c.ID]
+	if !ok {
+		h = &ConnectorHealth{ID: c.ID}
+		t.connectors[c.ID] = h
+	}
+	h.Name = c.Name
+	h.Type = c.Type
+}
+
+func (t *connectorHealthTracker) record(connectorID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.connectors[connectorID]
+	if !ok {
+		h = &ConnectorHealth{ID: connectorID}
+		t.connectors[connectorID] = h
+	}
+
+	if err != nil {
+		h.Failures++
+		h.LastFailure = time.Now()
+		h.LastError = redact.Secrets(err.Error())
+		return
+	}
+	h.Successes++
+	h.LastSuccess = time.Now()
+}
+
+// checked records a health check and returns the connector's status before
+// it, empty when it had not been checked yet
+func (t *connectorHealthTracker) checked(result protocol.ConnectionTest) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.connectors[result.ConnectorID]
+	if !ok {
+		h = &ConnectorHealth{ID: result.ConnectorID}
+		t.connectors[result.ConnectorID] = h
+	}
+	previous := h.Status
+	h.Status, h.LastCheck, h.CheckError = result.Status, result.CheckedAt, result.Error
+	return previous
+}
+
+func (t *connectorHealthTracker) snapshot() []ConnectorHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]ConnectorHealth, 0, len(t.connectors))
+	for _, h := range t.connectors {
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// errorLog is a fixed-size ring of the most recent errors
+type errorLog struct {
+	mu      sync.Mutex
+	records []ErrorRecord
+	next    int
+	full    bool
+}
+
+func newErrorLog(capacity int) *errorLog {
+	return &errorLog{records: make([]ErrorRecord, capacity)}
+}
+
+func (l *errorLog) add(rec ErrorRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records[l.next] = rec
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// snapshot returns the retained errors, newest first
+func (l *errorLog) snapshot() []ErrorRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.records)
+	}
+	out := make([]ErrorRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (l.next - i + len(l.records)) % len(l.records)
+		out = append(out, l.records[idx])
+	}
+	return out
+}
+
+// recordOutcome updates connector health and the error log after an execution
+func (s *Server) recordOutcome(connState *ConnectionState, task *QueryTask, err error) {
+	connState.TasksMutex.RLock()
+	connectorID := task.ConnectorID
+	connState.TasksMutex.RUnlock()
+
+	// Cancellations say nothing about the connector's health
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if connectorID != "" {
+		s.health.record(connectorID, err)
+	}
+	if err != nil {
+		s.recordError(connState, task.Request, err)
+	}
+}
+
+// recordError adds an error to the operator error log
+func (s *Server) recordError(connState *ConnectionState, req *QueryRequest, err error) {
+	s.recentErrors.add(ErrorRecord{
+		Time:         time.Now(),
+		ConnectionID: connState.ID,
+		StreamID:     req.StreamID,
+		QueryID:      req.QueryID,
+		Error:        redact.Secrets(err.Error()),
+	})
+}
+
+// Snapshot captures the current state of connections, streams and connectors
+func (s *Server) Snapshot() StatusSnapshot {
+	now := time.Now()
+	snap := StatusSnapshot{
+		GeneratedAt:  now,
+		StartedAt:    s.startedAt,
+		Uptime:       now.Sub(s.startedAt).Round(time.Second).String(),
+		Connections:  []ConnectionSnapshot{},
+		Connectors:   s.health.snapshot(),
+		WarmDrivers:  s.warmPool.Idle(),
+		RecentErrors: s.recentErrors.snapshot(),
+
+		RejectedConnections: s.connLimits.rejections(),
+	}
+
+	s.activeConns.Range(func(key, value interface{}) bool {
+		connState, ok := value.(*ConnectionState)
+		if !ok {
+			return true
+		}
+
+		cs := ConnectionSnapshot{
+			ID:            connState.ID,
+			RemoteAddr:    connState.RemoteAddr,
+			ConnectedAt:   connState.ConnectedAt,
+			Encoding:      connState.Codec.Name(),
+			Compressed:    connState.Compressed,
+			QueueDepth:    connState.QueryQueue.len(),
+			QueueCapacity: connState.QueryQueue.limit(),
+			SendQueued:    len(connState.send),
+		}
+		if p := connState.Principal(); p != nil {
+			cs.UserID, cs.APIKeyID, cs.OrganizationID = p.UserID, p.APIKeyID, p.OrganizationID
+		}
+
+		connState.TasksMutex.RLock()
+		cs.Workers = connState.QueueWorkers
+		for _, task := range connState.ActiveTasks {
+			ss := StreamSnapshot{
+				ID:          task.ID,
+				StreamID:    task.Request.StreamID,
+				QueryID:     task.Request.QueryID,
+				ConnectorID: task.ConnectorID,
+				Status:      task.Status,
+				Priority:    priorityOf(task.Request),
+				QueuedAt:    task.QueuedAt,
+				StartedAt:   task.ExecutedAt,
+				RowsSent:    task.RowsSent.Load(),
+			}
+			if !task.ExecutedAt.IsZero() {
+				ss.RuntimeMS = now.Sub(task.ExecutedAt).Milliseconds()
+			}
+			if task.Status == "running" {
+				snap.ActiveStreams++
+			} else {
+				snap.QueuedStreams++
+			}
+			cs.Streams = append(cs.Streams, ss)
+		}
+		connState.TasksMutex.RUnlock()
+
+		sort.Slice(cs.Streams, func(i, j int) bool { return cs.Streams[i].QueuedAt.Before(cs.Streams[j].QueuedAt) })
+		snap.Connections = append(snap.Connections, cs)
+		return true
+	})
+
+	sort.Slice(snap.Connections, func(i, j int) bool {
+		return snap.Connections[i].ConnectedAt.Before(snap.Connections[j].ConnectedAt)
+	})
+	return snap
+}
+
+// adminToken returns the admin token an HTTP request presents, in a
+// "token" query parameter or, failing that, as its bearer token. The query
+// parameter comes first: WebSocket connections and the REST API keep the
+// Authorization header for the caller's access token.
+func adminToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// presentsAdminToken reports whether r carries the configured admin token
+func (s *Server) presentsAdminToken(r *http.Request) bool {
+	if s.config.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(adminToken(r)), []byte(s.config.AdminToken)) == 1
+}
+
+// requireAdmin guards operator endpoints with the configured admin token
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled", http.StatusNotFound)
+			return
+		}
+
+		if !s.presentsAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="executor-admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+//go:embed templates/status.html
+var templateFS embed.FS
+
+var statusTemplate = template.Must(template.New("status.html").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return time.Since(t).Round(time.Second).String()
+	},
+	"millis": func(ms int64) string {
+		return (time.Duration(ms) * time.Millisecond).Round(time.Millisecond).String()
+	},
+	"clock": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("15:04:05")
+	},
+}).ParseFS(templateFS, "templates/status.html"))
+
+// handleStatusPage renders the operator status page. The admin token the
+// page was opened with never appears in it: the page's own script sends it
+// as a bearer token to fetch the JSON view, and the opened URL is kept out
+// of Referer headers.
+func (s *Server) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := statusTemplate.Execute(w, s.Snapshot()); err != nil {
+		log.Printf("Render status page: %v", err)
+	}
+}
+
+// handleStatusJSON serves the data behind the status page as JSON
+func (s *Server) handleStatusJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(s.Snapshot()); err != nil {
+		log.Printf("Encode status snapshot: %v", err)
+	}
+}
@@ -0,0 +1,502 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+)
+
+const (
+	// Shortest refresh interval a subscription may ask for, unless
+	// configured with subscriptions.min_interval
+	defaultMinRefreshInterval = time.Second
+
+	// Rows a subscription's result holds at most, unless configured with
+	// subscriptions.max_rows
+	defaultSubscriptionMaxRows = 10000
+
+	// Subscriptions a connection may hold at once, unless configured with
+	// subscriptions.max_per_connection
+	defaultMaxSubscriptions = 20
+
+	// Longest notification channel name, the longest identifier Postgres
+	// accepts
+	maxNotifyChannelLength = 63
+)
+
+// SubscriptionConfig bounds the live queries clients subscribe to
+type SubscriptionConfig struct {
+	// MinInterval is the shortest refresh interval accepted, and the
+	// shortest time between refreshes notifications trigger (default 1s)
+	MinInterval time.Duration `toml:"min_interval"`
+	// MaxRows caps the rows of a subscription's result, which is held in
+	// memory to tell what changed (default 10000)
+	MaxRows int `toml:"max_rows"`
+	// MaxPerConnection bounds the subscriptions a connection holds at once
+	// (default 20)
+	MaxPerConnection int `toml:"max_per_connection"`
+}
+
+func (s *Server) minRefreshInterval() time.Duration {
+	if s.config.Subscriptions.MinInterval > 0 {
+		return s.config.Subscriptions.MinInterval
+	}
+	return defaultMinRefreshInterval
+}
+
+func (s *Server) subscriptionMaxRows() int {
+	if s.config.Subscriptions.MaxRows > 0 {
+		return s.config.Subscriptions.MaxRows
+	}
+	return defaultSubscriptionMaxRows
+}
+
+func (s *Server) maxSubscriptions() int {
+	if s.config.Subscriptions.MaxPerConnection > 0 {
+		return s.config.Subscriptions.MaxPerConnection
+	}
+	return defaultMaxSubscriptions
+}
+
+// subscription is a live query run on its connection every interval until
+// it is cancelled or the connection closes. It holds its stream ID like a
+// task, in the connection's subscriptions under TasksMutex.
+type subscription struct {
+	req      *QueryRequest
+	interval time.Duration
+	mode     string
+	cancel   context.CancelFunc
+}
+
+// subscribe starts a live query for a subscribe request. An error rejects
+// the request.
+func (s *Server) subscribe(ctx context.Context, connState *ConnectionState, req *QueryRequest) error {
+	if req.StreamID == "" || req.QueryID == "" {
+		return &requestError{err: errors.New("streamId and queryId are required")}
+	}
+	if err := validateQueryRequest(req); err != nil {
+		return err
+	}
+	mode := req.RefreshMode
+	switch mode {
+	case "":
+		mode = protocol.RefreshFull
+	case protocol.RefreshFull, protocol.RefreshDiff, protocol.RefreshKeyed:
+	default:
+		return fmt.Errorf("invalid refreshMode %q: want full, diff or keyed", req.RefreshMode)
+	}
+	switch {
+	case mode == protocol.RefreshKeyed && len(req.KeyColumns) == 0:
+		return errors.New("keyed refreshes need keyColumns")
+	case mode != protocol.RefreshKeyed && len(req.KeyColumns) > 0:
+		return errors.New("keyColumns apply to keyed refreshes only")
+	}
+	interval := time.Duration(req.RefreshIntervalMS) * time.Millisecond
+	switch minimum := s.minRefreshInterval(); {
+	case interval == 0 && req.NotifyChannel != "":
+		// Refreshed on notifications only
+	case interval < minimum:
+		return fmt.Errorf("refreshIntervalMs must be at least %d", minimum.Milliseconds())
+	}
+	if len(req.NotifyChannel) > maxNotifyChannelLength {
+		return fmt.Errorf("notifyChannel must be at most %d bytes", maxNotifyChannelLength)
+	}
+	if req.Async || req.Credits > 0 || req.Snapshot != "" {
+		return errors.New("subscriptions cannot be async, flow controlled or snapshotted")
+	}
+	if s.Draining() {
+		return errServerShuttingDown
+	}
+
+	// A subscription ends with its connection
+	subCtx, cancel := context.WithCancel(ctx)
+	sub := &subscription{req: req, interval: interval, mode: mode, cancel: cancel}
+
+	connState.TasksMutex.Lock()
+	_, running := connState.ActiveTasks[req.StreamID]
+	_, subscribed := connState.subscriptions[req.StreamID]
+	switch {
+	case running || subscribed:
+		connState.TasksMutex.Unlock()
+		cancel()
+		return fmt.Errorf("%w: %s already exists", errDuplicateStream, req.StreamID)
+	case len(connState.subscriptions) >= s.maxSubscriptions():
+		connState.TasksMutex.Unlock()
+		cancel()
+		return fmt.Errorf("connection already has %d subscriptions", len(connState.subscriptions))
+	}
+	connState.subscriptions[req.StreamID] = sub
+	details := map[string]interface{}{
+		"refreshIntervalMs": interval.Milliseconds(),
+		"refreshMode":       mode,
+	}
+	if req.NotifyChannel != "" {
+		details["notifyChannel"] = req.NotifyChannel
+	}
+	if len(req.KeyColumns) > 0 {
+		details["keyColumns"] = req.KeyColumns
+	}
+	s.sendStatusDetails(connState.Conn, req.StreamID, protocol.StatusSubscribed, details, connState)
+	connState.TasksMutex.Unlock()
+
+	go s.refresh(subCtx, connState, sub)
+	return nil
+}
+
+// refresh runs a subscription's query every interval, and on each
+// notification when it listens on a channel, sending an update whenever the
+// result changed. A failed first run ends the subscription; later failures
+// are reported as warnings and the previous result stands.
+func (s *Server) refresh(ctx context.Context, connState *ConnectionState, sub *subscription) {
+	req := sub.req
+	var prev *restResult
+	var revision int64
+	var lastRun time.Time
+
+	// The listener wakes the loop through notified and reports why it
+	// stopped on listenDone; relisten starts it again
+	var notified chan struct{}
+	var listenDone chan error
+	var relisten <-chan time.Time
+	if req.NotifyChannel != "" {
+		notified = make(chan struct{}, 1)
+		listenDone = make(chan error, 1)
+		go func() { listenDone <- s.listen(ctx, connState, req, notified, false) }()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-notified:
+			// Notifications closer together than the minimum interval are
+			// coalesced into one refresh
+			resetTimer(timer, time.Until(lastRun.Add(s.minRefreshInterval())))
+			continue
+		case err := <-listenDone:
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, runner.ErrNotifyUnsupported) {
+				s.failSubscription(connState, sub, err)
+				return
+			}
+			s.recordError(connState, req, err)
+			s.warnSubscription(connState, sub, fmt.Sprintf("listening on %s failed: %v", req.NotifyChannel, err))
+			relisten = time.After(s.minRefreshInterval())
+			continue
+		case <-relisten:
+			relisten = nil
+			go func() { listenDone <- s.listen(ctx, connState, req, notified, true) }()
+			continue
+		}
+		if s.Draining() {
+			connState.TasksMutex.Lock()
+			s.endSubscription(connState, sub, protocol.StatusCancelled, map[string]interface{}{"reason": errServerShuttingDown.Error()})
+			connState.TasksMutex.Unlock()
+			return
+		}
+
+		startedAt := time.Now()
+		result, err := s.collectSubscription(ctx, connState, req)
+		if ctx.Err() != nil {
+			// Cancelled by the client or with the connection
+			return
+		}
+		var payload map[string]interface{}
+		if err == nil {
+			payload, err = sub.changes(prev, result)
+		}
+		switch {
+		case err != nil && prev == nil:
+			s.failSubscription(connState, sub, err)
+			return
+		case err != nil:
+			s.recordError(connState, req, err)
+			s.warnSubscription(connState, sub, fmt.Sprintf("refresh failed: %v", err))
+		default:
+			if payload != nil {
+				revision++
+				payload["revision"] = revision
+				payload["rowCount"] = result.RowCount
+				payload["refreshedAt"] = time.Now().UTC().Format(time.RFC3339Nano)
+				payload["elapsedMs"] = time.Since(startedAt).Milliseconds()
+				if result.Truncated {
+					payload["truncated"] = true
+				}
+				s.sendSubscribed(connState, sub, WSMessage{Type: MessageTypeUpdate, StreamID: req.StreamID, Payload: payload})
+			}
+			prev = result
+		}
+		lastRun = time.Now()
+		if sub.interval > 0 {
+			timer.Reset(sub.interval)
+		}
+	}
+}
+
+// listen waits for notifications on a subscription's channel, waking its
+// refresh loop for each, until the connection to the connector fails or
+// the subscription ends. A listener started again wakes the loop at once,
+// for the changes made while nothing was listening.
+func (s *Server) listen(ctx context.Context, connState *ConnectionState, req *QueryRequest, notified chan<- struct{}, catchUp bool) (err error) {
+	defer runner.CatchPanic(&err, "listener of stream "+req.StreamID)
+
+	caller := connState.Principal()
+	listener, err := runner.Listen(ctx, s.store, req.QueryID, req.NotifyChannel, s.executeOptions(req, caller, &httpObserver{s: s, caller: caller}))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	wake := func() {
+		select {
+		case notified <- struct{}{}:
+		default:
+			// A refresh is pending already
+		}
+	}
+	if catchUp {
+		wake()
+	}
+	for {
+		if _, err := listener.Wait(ctx); err != nil {
+			return err
+		}
+		wake()
+	}
+}
+
+// resetTimer changes when a timer fires, discarding a firing not yet received
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// collectSubscription runs one refresh of a subscription for the
+// connection's caller. Each run reads the engine afresh, refreshing the
+// result cache for other readers unless the request bypasses it.
+func (s *Server) collectSubscription(ctx context.Context, connState *ConnectionState, req *QueryRequest) (*restResult, error) {
+	caller := connState.Principal()
+	quota, releaseQuota, err := s.quotas.acquire(ctx, caller)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseQuota()
+
+	run := *req
+	s.capRows(&run, quota.MaxRowsPerQuery)
+	if run.CacheControl != runner.CacheBypass {
+		run.CacheControl = runner.CacheRefresh
+	}
+	result, err := s.collect(ctx, "subscription", &run, caller, s.subscriptionMaxRows(), connState.Values)
+	if err != nil {
+		return nil, err
+	}
+	// Rows are compared and sent as the connection's encoding carries them
+	for i, row := range result.Rows {
+		result.Rows[i] = connState.Codec.EncodeRow(row)
+	}
+	return result, nil
+}
+
+// failSubscription ends a subscription that cannot go on, sending the error
+// before its failed status
+func (s *Server) failSubscription(connState *ConnectionState, sub *subscription, err error) {
+	s.recordError(connState, sub.req, err)
+	s.sendFailure(connState.Conn, sub.req.StreamID, err, connState)
+	connState.TasksMutex.Lock()
+	s.endSubscription(connState, sub, protocol.StatusFailed, nil)
+	connState.TasksMutex.Unlock()
+}
+
+// warnSubscription reports a problem the subscription carries on despite
+func (s *Server) warnSubscription(connState *ConnectionState, sub *subscription, warning string) {
+	s.sendSubscribed(connState, sub, WSMessage{
+		Type:     MessageTypeStatus,
+		StreamID: sub.req.StreamID,
+		Payload: map[string]interface{}{
+			"status":  protocol.StatusWarning,
+			"warning": warning,
+		},
+	})
+}
+
+// sendSubscribed sends a message for a subscription unless it has ended,
+// so nothing follows its final status
+func (s *Server) sendSubscribed(connState *ConnectionState, sub *subscription, msg WSMessage) {
+	connState.TasksMutex.RLock()
+	defer connState.TasksMutex.RUnlock()
+	if connState.subscriptions[sub.req.StreamID] == sub {
+		s.sendMessage(connState.Conn, msg, connState)
+	}
+}
+
+// endSubscription stops a subscription and sends its final status, unless
+// it has ended already; the caller holds the task lock
+func (s *Server) endSubscription(connState *ConnectionState, sub *subscription, status string, details map[string]interface{}) {
+	if connState.subscriptions[sub.req.StreamID] != sub {
+		return
+	}
+	delete(connState.subscriptions, sub.req.StreamID)
+	sub.cancel()
+	s.sendStatusDetails(connState.Conn, sub.req.StreamID, status, details, connState)
+}
+
+// changes returns the update taking a subscriber from the previous result
+// to the next, or nil when nothing changed. The whole result is sent first,
+// whenever the columns change and on every change in full mode. In keyed
+// mode a result whose keys are not unique is an error.
+func (sub *subscription) changes(prev, next *restResult) (map[string]interface{}, error) {
+	var nextKeys *keyIndex
+	if sub.mode == protocol.RefreshKeyed {
+		var err error
+		if nextKeys, err = indexKeys(next, sub.req.KeyColumns); err != nil {
+			return nil, err
+		}
+	}
+	whole := map[string]interface{}{"columns": next.Columns, "rows": next.Rows}
+	if prev == nil || !slices.Equal(prev.Columns, next.Columns) {
+		return whole, nil
+	}
+
+	switch sub.mode {
+	case protocol.RefreshDiff:
+		added, removed := diffRows(prev.Rows, next.Rows)
+		if len(added) == 0 && len(removed) == 0 {
+			return nil, nil
+		}
+		return map[string]interface{}{"added": added, "removed": removed}, nil
+	case protocol.RefreshKeyed:
+		// The previous result was indexed when it arrived
+		prevKeys, _ := indexKeys(prev, sub.req.KeyColumns)
+		inserted, updated, deleted := diffKeyed(prev, next, prevKeys, nextKeys)
+		if len(inserted) == 0 && len(updated) == 0 && len(deleted) == 0 {
+			return nil, nil
+		}
+		return map[string]interface{}{"inserted": inserted, "updated": updated, "deleted": deleted}, nil
+	default:
+		if slices.Equal(rowKeys(prev.Rows), rowKeys(next.Rows)) {
+			return nil, nil
+		}
+		return whole, nil
+	}
+}
+
+// diffRows returns the rows of next missing from prev and those of prev
+// missing from next, counting duplicates
+func diffRows(prev, next [][]interface{}) (added, removed [][]interface{}) {
+	added, removed = [][]interface{}{}, [][]interface{}{}
+	prevKeys, nextKeys := rowKeys(prev), rowKeys(next)
+	remaining := make(map[string]int, len(prev))
+	for _, key := range prevKeys {
+		remaining[key]++
+	}
+	for i, key := range nextKeys {
+		if remaining[key] > 0 {
+			remaining[key]--
+			continue
+		}
+		added = append(added, next[i])
+	}
+	for i, key := range prevKeys {
+		if remaining[key] > 0 {
+			remaining[key]--
+			removed = append(removed, prev[i])
+		}
+	}
+	return added, removed
+}
+
+// keyIndex locates a result's rows by the values of its key columns
+type keyIndex struct {
+	positions []int          // of the key columns in the result
+	keys      []string       // each row's encoded key, in order
+	rows      map[string]int // encoded key to row
+}
+
+// indexKeys indexes a result's rows by the key columns, which must be in
+// the result and identify one row each
+func indexKeys(result *restResult, keyColumns []string) (*keyIndex, error) {
+	idx := &keyIndex{
+		positions: make([]int, len(keyColumns)),
+		keys:      make([]string, len(result.Rows)),
+		rows:      make(map[string]int, len(result.Rows)),
+	}
+	for i, name := range keyColumns {
+		if idx.positions[i] = slices.Index(result.Columns, name); idx.positions[i] < 0 {
+			return nil, fmt.Errorf("key column %s is not in the result", name)
+		}
+	}
+	for i, row := range result.Rows {
+		key := rowKey(idx.values(row))
+		if _, ok := idx.rows[key]; ok {
+			return nil, fmt.Errorf("key %s is not unique", key)
+		}
+		idx.keys[i] = key
+		idx.rows[key] = i
+	}
+	return idx, nil
+}
+
+// values returns the key columns of a row
+func (idx *keyIndex) values(row []interface{}) []interface{} {
+	values := make([]interface{}, len(idx.positions))
+	for i, pos := range idx.positions {
+		values[i] = row[pos]
+	}
+	return values
+}
+
+// diffKeyed returns the rows of next whose key prev lacks, those whose key
+// prev has with other values, and the keys of the rows of prev next lacks
+func diffKeyed(prev, next *restResult, prevKeys, nextKeys *keyIndex) (inserted, updated, deleted [][]interface{}) {
+	inserted, updated, deleted = [][]interface{}{}, [][]interface{}{}, [][]interface{}{}
+	for i, row := range next.Rows {
+		j, ok := prevKeys.rows[nextKeys.keys[i]]
+		switch {
+		case !ok:
+			inserted = append(inserted, row)
+		case rowKey(prev.Rows[j]) != rowKey(row):
+			updated = append(updated, row)
+		}
+	}
+	for i, row := range prev.Rows {
+		if _, ok := nextKeys.rows[prevKeys.keys[i]]; !ok {
+			deleted = append(deleted, prevKeys.values(row))
+		}
+	}
+	return inserted, updated, deleted
+}
+
+// rowKeys encodes each row so rows can be compared by value
+func rowKeys(rows [][]interface{}) []string {
+	keys := make([]string, len(rows))
+	for i, row := range rows {
+		keys[i] = rowKey(row)
+	}
+	return keys
+}
+
+// rowKey encodes a row, or some of its values, for comparison by value
+func rowKey(row []interface{}) string {
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Sprint(row)
+	}
+	return string(encoded)
+}
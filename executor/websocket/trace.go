@@ -0,0 +1,28 @@
+package websocket
+
+import (
+	"time"
+
+	"supalytics-executor/protocol"
+)
+
+// trace reports an internal state transition to streams that asked for
+// verbose status
+func (s *Server) trace(connState *ConnectionState, req *QueryRequest, event string, details map[string]interface{}) {
+	s.traceAt(connState, req, time.Now(), event, details)
+}
+
+func (s *Server) traceAt(connState *ConnectionState, req *QueryRequest, at time.Time, event string, details map[string]interface{}) {
+	if !req.Verbose || req.StreamID == "" {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"event": event,
+		"at":    at.UTC().Format(time.RFC3339Nano),
+	}
+	for k, v := range details {
+		payload[k] = v
+	}
+	s.sendStatusDetails(connState.Conn, req.StreamID, protocol.StatusTrace, payload, connState)
+}
@@ -2,84 +2,193 @@ package websocket
 
 import (
 	"context"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"supalytics-executor/driver"
+	"supalytics-executor/hooks"
+	"supalytics-executor/protocol"
+	"supalytics-executor/runner"
+
 	"github.com/gorilla/websocket"
-	"github.com/supabase-community/supabase-go"
 )
 
 const (
 	// Time allowed to write a message to the peer
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period (must be less than pongWait)
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer
 	maxMessageSize = 64 * 1024 * 1024 // 64MB
 
 	// Number of rows to accumulate before sending a batch
 	batchSize = 250
+
+	// Row batch writes slower than this are traced as backpressure pauses
+	backpressureThreshold = 50 * time.Millisecond
+
+	// Time a cancelled execution has to stop before it is forcibly closed,
+	// unless configured with cancel_timeout
+	defaultCancelTimeout = 10 * time.Second
+
+	// Interval between progress messages, unless configured with
+	// progress_interval
+	defaultProgressInterval = 2 * time.Second
+
+	// Frames queued per connection for its writer, unless configured with
+	// send_queue_size
+	defaultSendQueueSize = 256
+
+	// Time a full send queue may block a stream before its slow client
+	// policy applies, unless configured with slow_client_timeout
+	defaultSlowClientTimeout = 30 * time.Second
+
+	// Rows fetched by a preview request that does not say how many, unless
+	// configured with preview_rows
+	defaultPreviewRows = 100
+
+	// Time a shutting down server lets executions in flight finish, unless
+	// configured with drain_timeout
+	defaultDrainTimeout = 30 * time.Second
+
+	// Most job labels a request may add, leaving room under BigQuery's 64
+	// for the connector's and the server's
+	maxJobLabels = 32
 )
 
-// MessageType represents different types of messages sent to the client
-type MessageType string
+// Protocol types are shared with the client SDK so both sides compile
+// against the same message definitions.
+type (
+	MessageType   = protocol.MessageType
+	QueryRequest  = protocol.QueryRequest
+	CancelRequest = protocol.CancelRequest
+	WSMessage     = protocol.WSMessage
+	QueryMetadata = protocol.QueryMetadata
+)
 
 const (
-	MessageTypeMetadata MessageType = "metadata"
-	MessageTypeColumns  MessageType = "columns"
-	MessageTypeRow      MessageType = "row"
-	MessageTypeError    MessageType = "error"
-	MessageTypeComplete MessageType = "complete"
-	MessageTypeStatus   MessageType = "status"
-	MessageTypeCancel   MessageType = "cancel"
+	MessageTypeMetadata = protocol.MessageTypeMetadata
+	MessageTypeColumns  = protocol.MessageTypeColumns
+	MessageTypeRow      = protocol.MessageTypeRow
+	MessageTypeError    = protocol.MessageTypeError
+	MessageTypeComplete = protocol.MessageTypeComplete
+	MessageTypeStatus   = protocol.MessageTypeStatus
+	MessageTypeCancel   = protocol.MessageTypeCancel
+	MessageTypeQuery    = protocol.MessageTypeQuery
+	MessageTypeAttach   = protocol.MessageTypeAttach
+	MessageTypeCredit   = protocol.MessageTypeCredit
+	MessageTypeProgress = protocol.MessageTypeProgress
+	MessageTypeAuth     = protocol.MessageTypeAuth
+	MessageTypeHistory  = protocol.MessageTypeHistory
+
+	MessageTypeTestConnection = protocol.MessageTypeTestConnection
+	MessageTypeHello          = protocol.MessageTypeHello
+	MessageTypeBatch          = protocol.MessageTypeBatch
+	MessageTypeGroup          = protocol.MessageTypeGroup
+	MessageTypeHeartbeat      = protocol.MessageTypeHeartbeat
+	MessageTypeSubscribe      = protocol.MessageTypeSubscribe
+	MessageTypeUpdate         = protocol.MessageTypeUpdate
 )
 
-// QueryRequest represents a single query execution request
-type QueryRequest struct {
-	QueryID      string                 `json:"queryId"`
-	StreamID     string                 `json:"streamId"`
-	TemplateData map[string]interface{} `json:"templateData"`
-}
+// QueryTask represents a query execution task in the queue
+type QueryTask struct {
+	ID          string // identifies the task to operators
+	Request     *QueryRequest
+	Context     context.Context // the task's own, ended once it is cancelled or released
+	CancelFunc  context.CancelFunc
+	QueuedAt    time.Time
+	ExecutedAt  time.Time
+	receivedAt  time.Time // when the request was read, for its trace
+	Status      string    // changed only through transition, under TasksMutex
+	ConnectorID string    // Resolved once the runner has fetched the query
+	// QueryVersion is the version of the query that runs, once resolved
+	QueryVersion int
+	// RenderedSQL and TemplateData are recorded once the query renders so
+	// the execution can be replayed
+	RenderedSQL  string
+	TemplateData interface{}
+	// BytesScanned and BytesBilled are the engine's statistics, recorded
+	// once the stream completes
+	BytesScanned int64
+	BytesBilled  int64
+	RowsSent     atomic.Int64
 
-// CancelRequest represents a request to cancel a running query
-type CancelRequest struct {
-	StreamID string `json:"streamId"`
-}
+	// closer releases the execution's driver when a cancellation has to be
+	// forced; set once the stream is open
+	closer io.Closer
+	// canceller stops the query on its engine when the execution runs past
+	// its deadline; set once the driver has connected, for drivers whose
+	// engine needs telling
+	canceller driver.Canceller
 
-// WSMessage represents the standardized message format
-type WSMessage struct {
-	Type     MessageType            `json:"type"`
-	StreamID string                 `json:"streamId"`
-	Payload  map[string]interface{} `json:"payload,omitempty"`
-}
+	// credits meters rows for streams started with flow control
+	credits *creditGate
 
-// QueryMetadata represents the metadata about a query execution
-type QueryMetadata struct {
-	TotalRows int64    `json:"totalRows"`
-	Columns   []string `json:"columns"`
-}
+	// cancelReason tells the client why the task was cancelled, when it
+	// was not by the client itself
+	cancelReason string
 
-// QueryTask represents a query execution task in the queue
-type QueryTask struct {
-	Request    *QueryRequest
-	CancelFunc context.CancelFunc
-	ExecutedAt time.Time
-	Status     string // "queued", "running", "completed", "failed", "cancelled"
+	// successor is the next request for the stream ID, waiting for this
+	// task to end under the replace or queue duplicate policy
+	successor *QueryTask
+
+	// slowThreshold is set, with the time the task ran, when it ran past
+	// its connector's slow-query threshold
+	slowThreshold time.Duration
+	runTime       time.Duration
 }
 
 // ConnectionState manages state for a single WebSocket connection
 type ConnectionState struct {
-	Conn         *websocket.Conn
-	QueryQueue   chan *QueryTask
-	ActiveTasks  map[string]*QueryTask
-	TasksMutex   sync.RWMutex
-	WriteMutex   sync.Mutex
-	QueueWorkers int
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Conn        *websocket.Conn
+	Codec       protocol.Codec       // negotiated message encoding
+	Compressed  bool                 // permessage-deflate negotiated
+	Values      protocol.ValueFormat // negotiated value format
+	QueryQueue  *taskQueue
+	ActiveTasks map[string]*QueryTask
+	TasksMutex  sync.RWMutex
+	// subscriptions holds the connection's live queries by stream ID,
+	// under TasksMutex
+	subscriptions map[string]*subscription
+	QueueWorkers  int
+
+	// ctx ends with the connection; workers holds a cancel for each queue
+	// worker started, under TasksMutex
+	ctx     context.Context
+	workers []context.CancelFunc
+
+	// send queues encoded frames for the connection's single writer, which
+	// closes writerDone when it stops
+	send       chan outbound
+	writerDone chan struct{}
+
+	// seqs numbers the messages of each stream that has not ended
+	seqMu sync.Mutex
+	seqs  map[string]*streamSeq
+
+	// groups follows each batch until its last stream ends
+	groupsMu sync.Mutex
+	groups   map[string]*queryGroup
+
+	// principal is the authenticated caller; nil when auth is disabled
+	principal atomic.Pointer[Principal]
+	// admin is set for connections opened with the admin token, whose
+	// requests may ask for debug detail
+	admin bool
+
+	// lastMessageAt is when the client last sent a message, in Unix
+	// nanoseconds
+	lastMessageAt atomic.Int64
+
+	// sessionID names the session the connection belongs to, when sessions
+	// can be resumed; closed is closed once the connection has been
+	// cleaned up and has parked what the session keeps
+	sessionID string
+	closed    chan struct{}
 }
 
 // Config represents the server configuration
@@ -89,14 +198,224 @@ type Config struct {
 	Port          string `toml:"port" default:"8080"`
 	MaxWorkers    int    `toml:"max_workers" default:"3"`
 	QueueCapacity int    `toml:"queue_capacity" default:"100"`
+
+	// Realtime follows changes to the queries and connectors tables through
+	// Supabase Realtime, so unchanged rows are served from memory instead
+	// of being fetched for every execution
+	Realtime bool `toml:"realtime"`
+
+	// Timeouts bounds each phase of an execution; durations such as "30s"
+	Timeouts runner.Timeouts `toml:"timeouts"`
+	// ExecutionTimeout is the deadline of an execution from when a worker
+	// picks it up; an execution still running at it is cancelled, on its
+	// engine as well, and ends with the timeout status. Zero lets
+	// executions run until they finish.
+	ExecutionTimeout time.Duration `toml:"execution_timeout"`
+	// MaxExecutionTimeout is the longest deadline a request's timeoutMs
+	// may ask for. Zero holds requests to the execution timeout, or leaves
+	// them free when there is none.
+	MaxExecutionTimeout time.Duration `toml:"max_execution_timeout"`
+	// CancelTimeout bounds how long a cancelled execution may take to stop
+	// before its driver is forcibly closed (default 10s)
+	CancelTimeout time.Duration `toml:"cancel_timeout"`
+	// DrainTimeout bounds how long a shutting down server lets executions
+	// in flight finish before cancelling them (default 30s)
+	DrainTimeout time.Duration `toml:"drain_timeout"`
+
+	// ProgressInterval is the time between progress messages for a running
+	// stream, and between position updates for a queued one (default 2s)
+	ProgressInterval time.Duration `toml:"progress_interval"`
+	// QueueTimeout fails queries that wait longer than this for a worker;
+	// zero lets them wait
+	QueueTimeout time.Duration `toml:"queue_timeout"`
+
+	// PreviewRows is the number of rows a preview fetches when the request
+	// does not set previewRows (default 100)
+	PreviewRows int64 `toml:"preview_rows"`
+
+	// SendQueueSize is the number of frames buffered per connection for its
+	// writer (default 256)
+	SendQueueSize int `toml:"send_queue_size"`
+	// SlowClientTimeout is how long a full send queue may block a stream
+	// before SlowClientPolicy applies (default 30s)
+	SlowClientTimeout time.Duration `toml:"slow_client_timeout"`
+	// SlowClientPolicy is wait (default), drop or close; requests may
+	// override it per stream
+	SlowClientPolicy string `toml:"slow_client_policy"`
+
+	// DuplicateStreamPolicy is reject (default), replace or queue: what a
+	// request for a stream ID still queued or running does. Requests may
+	// override it with onDuplicate.
+	DuplicateStreamPolicy string `toml:"duplicate_stream_policy"`
+
+	// Compression negotiates permessage-deflate with clients that offer it
+	Compression bool `toml:"compression"`
+	// CompressionLevel is a flate level from 1 (fastest) to 9 (smallest);
+	// 0 uses the default level
+	CompressionLevel int `toml:"compression_level"`
+
+	// Webhooks receive execution lifecycle events
+	Webhooks []hooks.WebhookConfig `toml:"webhooks"`
+	// HealthChecks periodically checks every connector can be reached and
+	// records the result as its status
+	HealthChecks HealthCheckConfig `toml:"health_checks"`
+	// WarmPool keeps drivers connected to the connectors marked pinned, so
+	// their executions skip connecting
+	WarmPool runner.WarmPoolConfig `toml:"warm_pool"`
+	// Prewarm executes the queries declared for pre-warming into the result
+	// cache, at startup and on their schedules
+	Prewarm PrewarmConfig `toml:"prewarm"`
+
+	// SlowQueries tags executions that run too long in the audit log and
+	// fires a slow event for them
+	SlowQueries SlowQueryConfig `toml:"slow_queries"`
+
+	// TemplateConstants are template variables set for every query; requests
+	// cannot override them
+	TemplateConstants map[string]interface{} `toml:"template_constants"`
+	// TemplateMode is the template mode of queries that do not set one:
+	// text (default), sql or sql_strict
+	TemplateMode string `toml:"template_mode"`
+
+	// ValidateSQL checks rendered queries for syntax errors before they
+	// run; queries on read-only connectors are always checked
+	ValidateSQL bool `toml:"validate_sql"`
+
+	// Encryption holds the keys that decrypt encrypted connector configs
+	Encryption runner.EncryptionConfig `toml:"encryption"`
+	// Vault resolves "vault:<path>#<key>" references in connector configs
+	Vault runner.VaultConfig `toml:"vault"`
+
+	// ResultCache replays repeated queries from earlier results
+	ResultCache runner.ResultCacheConfig `toml:"result_cache"`
+	// MetadataCache reuses fetched queries and connectors for a while so
+	// repeated executions skip the metadata store
+	MetadataCache runner.MetadataCacheConfig `toml:"metadata_cache"`
+	// DedupeInFlight runs identical requests that arrive before the first
+	// one's rows once, fanning the rows out to every stream
+	DedupeInFlight bool `toml:"dedupe_in_flight"`
+
+	// Snapshots stores result sets in object storage for requests and
+	// queries that ask for a snapshot
+	Snapshots runner.SnapshotConfig `toml:"snapshots"`
+
+	// Memory bounds the rows an execution buffers for the result cache,
+	// buffering transforms and composite sources
+	Memory runner.MemoryConfig `toml:"memory"`
+
+	// JobQueue shares query execution between replicas through Redis
+	JobQueue JobQueueConfig `toml:"job_queue"`
+
+	// ConnectionLimits bound the WebSocket connections overall, per client
+	// address and per organization
+	ConnectionLimits ConnectionLimits `toml:"connection_limits"`
+
+	// Routing names this replica and records which replica owns each
+	// stream, for clients reconnecting through a load balancer
+	Routing RoutingConfig `toml:"routing"`
+
+	// Readiness sets what /readyz checks beyond the metadata store
+	Readiness ReadinessConfig `toml:"readiness"`
+
+	// Keepalive sets the ping interval, heartbeats and idle timeout of
+	// WebSocket connections
+	Keepalive KeepaliveConfig `toml:"keepalive"`
+
+	// Subscriptions bounds live queries re-run on a refresh interval
+	Subscriptions SubscriptionConfig `toml:"subscriptions"`
+
+	// Sessions lets a client resume the queued streams of a connection it
+	// lost by reconnecting with the session token from its hello
+	Sessions SessionConfig `toml:"sessions"`
+
+	// Values is how rows send times and arbitrary-precision numbers unless
+	// a connection negotiates otherwise
+	Values protocol.ValueFormat `toml:"values"`
+
+	// MaxStreamRows and MaxStreamBytes are hard caps on the rows and encoded
+	// row bytes a stream sends; organization quotas and requests may lower
+	// them. Zero leaves a cap off.
+	MaxStreamRows  int64 `toml:"max_stream_rows"`
+	MaxStreamBytes int64 `toml:"max_stream_bytes"`
+
+	// RESTMaxRows caps the rows a REST execution returns; larger results
+	// are truncated (default 10000)
+	RESTMaxRows int `toml:"rest_max_rows"`
+	// RESTResultTTL is how long the result of an async REST execution can
+	// be fetched after it finishes (default 10m)
+	RESTResultTTL time.Duration `toml:"rest_result_ttl"`
+
+	// AllowedOrigins lists the browser origins that may open WebSockets
+	// and call the HTTP endpoints, e.g. "https://app.example.com" or
+	// "https://*.example.com"; every origin may connect when it is empty
+	AllowedOrigins []string `toml:"allowed_origins"`
+
+	// Auth requires clients to present a Supabase access token; connections
+	// and requests are unauthenticated when it is not configured
+	Auth AuthConfig `toml:"auth"`
+
+	// Quotas limit each authenticated organization's concurrent queries,
+	// queries per minute and rows per query; organization_quotas rows
+	// override them per organization
+	Quotas QuotaConfig `toml:"quotas"`
+
+	// AdminToken protects operator endpoints; they are disabled when empty
+	AdminToken string `toml:"admin_token"`
+	// StatusPage serves the operator status page at /admin/status
+	StatusPage bool `toml:"status_page"`
+	// Diagnostics serves runtime figures at /admin/diagnostics and the
+	// net/http/pprof profiles at /debug/pprof/
+	Diagnostics bool `toml:"diagnostics"`
 }
 
 // Server represents the WebSocket server
 type Server struct {
-	config        Config
-	supaClient    *supabase.Client
-	upgrader      websocket.Upgrader
-	activeConns   sync.Map
-	maxWorkers    int
-	queueCapacity int
+	config      Config
+	store       runner.MetadataStore
+	upgrader    websocket.Upgrader
+	activeConns sync.Map
+	// maxWorkers and queueCapacity apply to every connection; a reload
+	// changes them
+	maxWorkers    atomic.Int64
+	queueCapacity atomic.Int64
+	startedAt     time.Time
+	health        *connectorHealthTracker
+	recentErrors  *errorLog
+	audit         runner.AuditLog
+	hooks         *hooks.Dispatcher
+	keyring       *runner.Keyring
+	secretsMu     sync.RWMutex
+	secrets       runner.SecretResolver
+	resultCache   *runner.ResultCache
+	metadataCache *runner.MetadataCache
+	warmPool      *runner.WarmPool
+	prewarms      *prewarmer
+	snapshots     *runner.Snapshots
+	rest          *restExecutions
+	auth          *authenticator
+	origins       *originPolicy
+	quotas        *quotaTracker
+	jobs          *jobQueue
+	routing       *streamRegistry
+	connLimits    *connectionLimiter
+	sessions      *sessionRegistry
+
+	// flights are the shared executions still admitting streams, by key
+	flightsMu sync.Mutex
+	flights   map[string]*flight
+
+	// readiness is the last /readyz result, reused for readiness.cache_ttl
+	readiness readinessCache
+
+	// background starts the server's loops the first time it is served
+	background sync.Once
+
+	// draining is set once the server stops taking new work to shut down
+	draining atomic.Bool
+
+	// configFile is reread on SIGHUP and by /admin/reload; loaded is the
+	// configuration last applied
+	configFile string
+	reloadMu   sync.Mutex
+	loaded     Config
 }
@@ -0,0 +1,32 @@
+// websocket/values.go
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"supalytics-executor/protocol"
+)
+
+// valueFormat returns the format a connection's rows use: the server's
+// default with whatever the client asked for in the handshake's query
+// parameters in its place
+func (s *Server) valueFormat(r *http.Request) (protocol.ValueFormat, error) {
+	query := r.URL.Query()
+	requested := protocol.ValueFormat{
+		Times:    query.Get(protocol.ValueTimesParam),
+		Numerics: query.Get(protocol.ValueNumericsParam),
+	}
+	if v := query.Get(protocol.ValuePrecisionParam); v != "" {
+		precision, err := strconv.Atoi(v)
+		if err != nil {
+			return protocol.ValueFormat{}, fmt.Errorf("invalid precision %q", v)
+		}
+		requested.Precision = precision
+	}
+	if err := requested.Validate(); err != nil {
+		return protocol.ValueFormat{}, err
+	}
+	return s.config.Values.Merge(requested), nil
+}
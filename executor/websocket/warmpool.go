@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"supalytics-executor/runner"
+)
+
+// runWarmPool keeps drivers connected to the store's pinned connectors,
+// starting as the server does, for as long as the process runs
+func (s *Server) runWarmPool(connectors runner.ConnectorStatusStore) {
+	ticker := time.NewTicker(s.warmPool.Interval())
+	defer ticker.Stop()
+	for {
+		s.warmConnectors(connectors)
+		<-ticker.C
+	}
+}
+
+// warmConnectors runs one round of the warm pool over the connectors that
+// are pinned now, so connectors pinned or unpinned since the last round
+// are picked up
+func (s *Server) warmConnectors(connectors runner.ConnectorStatusStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectorStatusTimeout)
+	all, err := connectors.ListConnectors(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Skipping connector warm-up: %v", err)
+		return
+	}
+
+	var pinned []runner.Connector
+	for _, c := range all {
+		if c.Pinned {
+			pinned = append(pinned, c)
+		}
+	}
+	s.warmPool.Maintain(context.Background(), pinned, runner.ExecuteOptions{
+		Timeouts: s.config.Timeouts,
+		Keyring:  s.keyring,
+		Secrets:  s.secretResolver(),
+	})
+}
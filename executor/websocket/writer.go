@@ -0,0 +1,230 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"supalytics-executor/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// errConnectionClosed is returned for messages sent after the
+	// connection's writer has stopped
+	errConnectionClosed = errors.New("connection closed")
+
+	// errSlowClient fails a stream whose rows the client stopped reading
+	errSlowClient = errors.New("client is not reading results fast enough")
+)
+
+// outbound is an encoded frame waiting for the connection's writer
+type outbound struct {
+	frameType int
+	data      []byte
+}
+
+// writeLoop is the only goroutine that writes to a connection. Workers queue
+// encoded frames on the send channel so no write ever interleaves with
+// another, and pings share the same loop.
+func (s *Server) writeLoop(ctx context.Context, connState *ConnectionState) {
+	defer close(connState.writerDone)
+
+	ticker := time.NewTicker(s.pingPeriod())
+	defer ticker.Stop()
+
+	conn := connState.Conn
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case frame := <-connState.send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = conn.WriteMessage(frame.frameType, frame.data)
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			// Closing the connection ends the read loop, which cleans up
+			// every stream on it
+			log.Printf("Write to %s failed: %v", connState.RemoteAddr, err)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// enqueue hands a frame to the writer, waiting as long as the send queue
+// is full
+func (s *Server) enqueue(connState *ConnectionState, frame outbound) error {
+	select {
+	case connState.send <- frame:
+		return nil
+	case <-connState.writerDone:
+		return errConnectionClosed
+	}
+}
+
+// enqueueRows hands a row batch to the writer. A client that leaves the send
+// queue full for longer than the slow client timeout is dealt with according
+// to the stream's slow client policy: wait keeps waiting, drop fails the
+// stream and close disconnects the client.
+func (s *Server) enqueueRows(connState *ConnectionState, task *QueryTask, frame outbound) error {
+	select {
+	case connState.send <- frame:
+		return nil
+	case <-connState.writerDone:
+		return errConnectionClosed
+	default:
+	}
+
+	timer := time.NewTimer(s.slowClientTimeout())
+	defer timer.Stop()
+
+	select {
+	case connState.send <- frame:
+		return nil
+	case <-connState.writerDone:
+		return errConnectionClosed
+	case <-timer.C:
+	}
+
+	policy := s.slowClientPolicy(task.Request)
+	s.trace(connState, task.Request, "slow_client", map[string]interface{}{
+		"policy":   policy,
+		"rowsSent": task.RowsSent.Load(),
+	})
+
+	switch policy {
+	case protocol.SlowClientDrop:
+		return fmt.Errorf("%w: send queue full for %s", errSlowClient, s.slowClientTimeout())
+	case protocol.SlowClientClose:
+		log.Printf("Closing connection %s: send queue full for %s", connState.RemoteAddr, s.slowClientTimeout())
+		connState.Conn.Close()
+		return errConnectionClosed
+	default:
+		return s.enqueue(connState, frame)
+	}
+}
+
+// streamSeq is the last sequence number sent on a stream
+type streamSeq struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// deliver numbers a stream message and queues it with enqueue. The stream's
+// sequence is held until the frame is queued so frames reach the writer in
+// sequence order; a frame that is never queued gives its number back.
+func (s *Server) deliver(connState *ConnectionState, msg WSMessage, enqueue func(*ConnectionState, outbound) error) error {
+	if msg.StreamID == "" {
+		frame, err := encode(connState, msg)
+		if err != nil {
+			return err
+		}
+		return enqueue(connState, frame)
+	}
+
+	seq := connState.streamSeq(msg.StreamID)
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	msg.Seq = seq.last + 1
+	frame, err := encode(connState, msg)
+	if err != nil {
+		return err
+	}
+	if err := enqueue(connState, frame); err != nil {
+		return err
+	}
+	seq.last = msg.Seq
+
+	if streamEnded(connState, msg) {
+		connState.forgetStreamSeq(msg.StreamID)
+	}
+	return nil
+}
+
+// sendUnnumbered queues a stream message outside the stream's sequence,
+// for messages answering a request rather than belonging to an execution
+func (s *Server) sendUnnumbered(connState *ConnectionState, msg WSMessage) error {
+	frame, err := encode(connState, msg)
+	if err != nil {
+		return err
+	}
+	return s.enqueue(connState, frame)
+}
+
+// streamEnded reports whether msg is the last a stream will receive: its
+// terminal status, or an error for a stream that is neither running nor
+// subscribed
+func streamEnded(connState *ConnectionState, msg WSMessage) bool {
+	switch msg.Type {
+	case MessageTypeStatus:
+		status, _ := msg.Payload["status"].(string)
+		return protocol.IsTerminalStatus(status)
+	case MessageTypeHistory, MessageTypeTestConnection:
+		return true
+	case MessageTypeError:
+		connState.TasksMutex.RLock()
+		defer connState.TasksMutex.RUnlock()
+		_, running := connState.ActiveTasks[msg.StreamID]
+		_, subscribed := connState.subscriptions[msg.StreamID]
+		return !running && !subscribed
+	}
+	return false
+}
+
+func (c *ConnectionState) streamSeq(streamID string) *streamSeq {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	seq, ok := c.seqs[streamID]
+	if !ok {
+		seq = &streamSeq{}
+		c.seqs[streamID] = seq
+	}
+	return seq
+}
+
+func (c *ConnectionState) forgetStreamSeq(streamID string) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	delete(c.seqs, streamID)
+}
+
+// encode serializes a message in the connection's encoding
+func encode(connState *ConnectionState, msg WSMessage) (outbound, error) {
+	data, err := connState.Codec.Marshal(msg)
+	if err != nil {
+		return outbound{}, fmt.Errorf("encode message: %w", err)
+	}
+
+	frameType := websocket.TextMessage
+	if connState.Codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+	return outbound{frameType: frameType, data: data}, nil
+}
+
+func (s *Server) slowClientPolicy(req *QueryRequest) string {
+	if req.SlowClientPolicy != "" {
+		return req.SlowClientPolicy
+	}
+	if s.config.SlowClientPolicy != "" {
+		return s.config.SlowClientPolicy
+	}
+	return protocol.SlowClientWait
+}
+
+func (s *Server) slowClientTimeout() time.Duration {
+	if s.config.SlowClientTimeout > 0 {
+		return s.config.SlowClientTimeout
+	}
+	return defaultSlowClientTimeout
+}
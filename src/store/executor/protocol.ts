@@ -0,0 +1,887 @@
+// Code generated by executor/cmd/tsprotocol from executor/protocol; DO NOT EDIT.
+// Run "go generate ./protocol" in executor after changing the protocol.
+
+/**
+ * DecimalExtType is the MessagePack extension type decimals are sent as,
+ * holding their text
+ */
+export const DecimalExtType = 1;
+
+/** Message encodings a client can negotiate per connection */
+export const Encoding = {
+  JSON: "json",
+  Msgpack: "msgpack",
+  CBOR: "cbor",
+} as const;
+export type Encoding = (typeof Encoding)[keyof typeof Encoding];
+
+export const MessageType = {
+  Metadata: "metadata",
+  Columns: "columns",
+  Row: "row",
+  Error: "error",
+  Complete: "complete",
+  Status: "status",
+  Cancel: "cancel",
+  Query: "query",
+  Attach: "attach",
+  /**
+   * MessageTypeProgress periodically reports a running stream's progress:
+   * "rowsStreamed" and "elapsedMs", plus "bytesScanned", "fraction" (0-1)
+   * and "estimatedRemainingMs" when the engine reports them
+   */
+  Progress: "progress",
+  /** MessageTypeCredit grants a flow-controlled stream "credits" more rows */
+  Credit: "credit",
+  /**
+   * MessageTypeAuth carries a client's access token in its "token" field,
+   * either as the first message on a connection opened without one or to
+   * replace a token before it expires. The server answers with an auth
+   * message whose payload has "userId", "organizationId" and "expiresAt".
+   */
+  Auth: "auth",
+  /**
+   * MessageTypeHistory lists a query's recent executions: a client sends
+   * one with "queryId" and optionally "limit", and the server answers on
+   * the same stream with an "executions" payload of ExecutionRecords,
+   * newest first
+   */
+  History: "history",
+  /**
+   * MessageTypeTestConnection asks the server to check a connector can be
+   * reached; the server answers on the same stream with a message of this
+   * type carrying a ConnectionTest
+   */
+  TestConnection: "test_connection",
+  /**
+   * MessageTypeHello is the first message on a connection, after any auth
+   * acknowledgement. Its payload has the "instanceId" of the replica that
+   * accepted the connection, the "connectionId" and, when configured, the
+   * "url" that reaches the replica directly, "heartbeatIntervalMs" when
+   * the server sends heartbeats, and "values" with the ValueFormat rows
+   * use when it is not the zero value. Servers that resume sessions add a
+   * "sessionToken" to present on reconnect; a connection that resumed one
+   * also has "resumed": true and the "resumedStreams" the server kept
+   * queued, which the client should not submit again.
+   */
+  Hello: "hello",
+  /**
+   * MessageTypeBatch submits the "queries" in it as a group named by its
+   * "groupId". Each query streams as if sent on its own; the server also
+   * reports on the group as a whole with group messages.
+   */
+  Batch: "batch",
+  /**
+   * MessageTypeGroup reports on a batch, without a stream ID, each time
+   * one of its streams ends. The payload has "groupId", "total",
+   * "completed", "failed", "cancelled" and "pending", with the "streamId"
+   * and "streamStatus" of the stream that ended. Its "status" is running
+   * until the last stream ends, then completed, failed when any stream
+   * failed or was rejected, or cancelled when the group was, along with
+   * "elapsedMs". A rejected batch is reported failed with an "error" and
+   * "rejected": true, leaving any group already using its ID alone.
+   */
+  Group: "group",
+  /**
+   * MessageTypeHeartbeat is sent without a stream ID every heartbeat
+   * interval, when configured. The payload has "serverTime" (RFC 3339),
+   * "activeStreams" and "intervalMs"; a client that hears nothing for
+   * several intervals can treat the connection as half-open.
+   */
+  Heartbeat: "heartbeat",
+  /**
+   * MessageTypeSubscribe starts a live query: the server runs it every
+   * "refreshIntervalMs" while the connection is open, and whenever the
+   * connector sends a notification on "notifyChannel", answering with a
+   * subscribed status and then an update message each time the result
+   * changes. The subscription lasts until it is cancelled.
+   */
+  Subscribe: "subscribe",
+  /**
+   * MessageTypeUpdate carries a subscription's changed result. Its
+   * payload has "revision", counting from 1, "rowCount", "refreshedAt"
+   * (RFC 3339) and "elapsedMs", and either "columns" and "rows" holding
+   * the whole result, or, once the client has a result with the same
+   * columns, what changed: in diff mode the "added" and "removed" rows, in
+   * keyed mode the "inserted" and "updated" rows and the "deleted" keys,
+   * each the values of the key columns in order. "truncated" is set when
+   * the result was cut at the server's row limit.
+   */
+  Update: "update",
+} as const;
+export type MessageType = (typeof MessageType)[keyof typeof MessageType];
+
+/** Close codes the server sends when it ends a connection */
+export const Close = {
+  /**
+   * CloseUnauthorized ends a connection that did not authenticate, sent
+   * an invalid token or let its token expire. Clients should not
+   * reconnect without a new token.
+   */
+  Unauthorized: 4401,
+  /**
+   * CloseTooManyConnections ends a connection its organization has no
+   * room for; clients should back off before reconnecting
+   */
+  TooManyConnections: 4429,
+  /**
+   * CloseIdleTimeout ends a connection that had no streams and sent no
+   * messages for the server's idle timeout. Clients should reconnect when
+   * they next have a query to run rather than straight away.
+   */
+  IdleTimeout: 4408,
+} as const;
+export type Close = (typeof Close)[keyof typeof Close];
+
+/**
+ * SessionHeader carries the "sessionToken" of an earlier hello when a
+ * client reconnects, asking the server to resume that session. Browsers,
+ * which cannot set WebSocket headers, pass it as the "session" query
+ * parameter instead.
+ */
+export const SessionHeader = "X-Supalytics-Session";
+
+/**
+ * Stream statuses reported in status messages. Queued is repeated while a
+ * stream waits with its "position", "queueSize", "waitedMs" and, once the
+ * server has timed a run, "estimatedWaitMs".
+ */
+export const Status = {
+  Queued: "queued",
+  Running: "running",
+  Completed: "completed",
+  Failed: "failed",
+  Cancelled: "cancelled",
+  /**
+   * StatusTimeout ends a stream still running at its execution deadline,
+   * the server's execution timeout or the request's timeoutMs. Its query
+   * is cancelled on the engine; the payload carries "reason", "code"
+   * (execution_timeout) and "limitMs".
+   */
+  Timeout: "timeout",
+  /**
+   * StatusSubmitted reports the engine execution ID of an async query in
+   * the "executionId" payload field; it can be passed to an attach request
+   */
+  Submitted: "submitted",
+  /**
+   * StatusStatement reports progress through a multi-statement query; the
+   * payload carries a "statement" object with index, total and state
+   */
+  Statement: "statement",
+  /**
+   * StatusWarning reports a non-fatal condition in the "warning" payload
+   * field, e.g. metadata served from cache during a store outage
+   */
+  Warning: "warning",
+  /**
+   * StatusTrace carries an internal state transition for verbose streams;
+   * the payload has "event", "at" (RFC 3339) and optional event details
+   */
+  Trace: "trace",
+  /**
+   * StatusWaiting answers a request made under the replace or queue
+   * duplicate policy while another execution holds its stream ID. It is
+   * sent without a sequence number; the request's own messages, starting
+   * with queued, follow the current execution's terminal status.
+   */
+  Waiting: "waiting",
+  /**
+   * StatusSubscribed accepts a subscribe request, echoing its
+   * "refreshIntervalMs", "refreshMode", "notifyChannel" and
+   * "keyColumns". A refresh
+   * that fails, or a lost notification listener, is reported with a
+   * warning and the subscription goes on; only a first run that fails, or
+   * a connector that cannot send notifications, ends it.
+   */
+  Subscribed: "subscribed",
+  /**
+   * StatusServerShutdown is sent without a stream ID when the server
+   * starts draining: it takes no new queries, lets those in flight finish
+   * for up to "drainTimeoutMs", then closes the connection as going
+   * away. Clients should reconnect to another replica.
+   */
+  ServerShutdown: "server_shutdown",
+} as const;
+export type Status = (typeof Status)[keyof typeof Status];
+
+/**
+ * Error codes carried in the "code" field of error payloads. Errors the
+ * engine raised also carry an "engine" EngineError with what it reported.
+ */
+export const ErrorCode = {
+  /**
+   * ErrorCodeInvalidRequest rejects a message whose fields are missing or
+   * invalid, such as an unknown priority or time zone
+   */
+  InvalidRequest: "invalid_request",
+  /**
+   * ErrorCodeQueryNotFound fails a request for a query, query version or
+   * execution that does not exist or that the caller may not use
+   */
+  QueryNotFound: "query_not_found",
+  /**
+   * ErrorCodeConnectorNotFound fails a query whose connector does not
+   * exist or belongs to another organization
+   */
+  ConnectorNotFound: "connector_not_found",
+  /**
+   * ErrorCodeConnectorUnreachable fails an execution whose engine could
+   * not be connected to, as when it is down or its address is wrong
+   */
+  ConnectorUnreachable: "connector_unreachable",
+  /**
+   * ErrorCodeTemplate fails a query whose template could not be rendered
+   * with the request's template data
+   */
+  Template: "template_error",
+  /** ErrorCodeSyntax fails a query the engine could not parse */
+  Syntax: "syntax_error",
+  /**
+   * ErrorCodeObjectNotFound fails a query naming a table, column,
+   * function or schema the engine does not have
+   */
+  ObjectNotFound: "object_not_found",
+  /**
+   * ErrorCodePermissionDenied fails a query the connector's credentials
+   * are not allowed to run, or that the engine refused to authenticate
+   */
+  PermissionDenied: "permission_denied",
+  /**
+   * ErrorCodeTimeout fails a query the engine gave up on, such as one
+   * over a statement timeout; the executor's own limits have the
+   * specific codes below
+   */
+  Timeout: "timeout",
+  /**
+   * ErrorCodeCancelled fails a query cancelled other than by its client,
+   * such as by an administrator on the engine
+   */
+  Cancelled: "cancelled",
+  /** ErrorCodeEngine fails a query the engine raised any other error for */
+  Engine: "engine_error",
+  /**
+   * ErrorCodeInternal fails an execution for a reason of the executor's
+   * own, which the client cannot correct
+   */
+  Internal: "internal_error",
+  MetadataTimeout: "metadata_timeout",
+  RenderTimeout: "render_timeout",
+  ConnectTimeout: "connect_timeout",
+  FirstRowTimeout: "first_row_timeout",
+  StreamTimeout: "stream_timeout",
+  IdleTimeout: "idle_timeout",
+  /**
+   * ErrorCodeCancelTimeout is set on a cancelled status when the driver
+   * did not stop in time and was forcibly closed
+   */
+  CancelTimeout: "cancel_timeout",
+  /** ErrorCodeSlowClient fails a stream under the drop slow client policy */
+  SlowClient: "slow_client",
+  /**
+   * ErrorCodeExecutionTimeout is set on the timeout status of a stream
+   * that ran past its execution deadline
+   */
+  ExecutionTimeout: "execution_timeout",
+  /**
+   * ErrorCodeQueueTimeout fails a stream that waited longer than the
+   * server's queue timeout for a worker
+   */
+  QueueTimeout: "queue_timeout",
+  /**
+   * ErrorCodeRateLimited rejects a request over its organization's quota;
+   * the payload's "retryAfterMs" says when a per-minute limit frees up
+   */
+  RateLimited: "rate_limited",
+  /**
+   * ErrorCodeInvalidParameters rejects template data that does not match
+   * the query's parameter schema; "parameterErrors" lists each offending
+   * parameter with its "parameter", "code" and "message"
+   */
+  InvalidParameters: "invalid_parameters",
+  /**
+   * ErrorCodeValidation rejects a rendered query that failed validation
+   * before it ran; "validationErrors" lists each problem with its "code"
+   * (syntax or disallowed), "message", "statement", "line" and "column"
+   */
+  Validation: "validation_error",
+  /**
+   * ErrorCodeScanBudgetExceeded rejects a request once its organization
+   * has scanned its monthly budget; "retryAfterMs" runs to the next month
+   */
+  ScanBudgetExceeded: "scan_budget_exceeded",
+  /**
+   * ErrorCodeBillingLimitExceeded fails a query the engine refused to run
+   * because it would bill more than the connector's or request's maximum
+   * bytes billed
+   */
+  BillingLimitExceeded: "billing_limit_exceeded",
+  /**
+   * ErrorCodeMemoryBudgetExceeded fails an execution that buffered more
+   * rows than the server's memory budget allows and could not spill them
+   */
+  MemoryBudgetExceeded: "memory_budget_exceeded",
+  /**
+   * ErrorCodeServerShutdown rejects a request that arrived while the
+   * server was draining; it can be retried on another replica
+   */
+  ServerShutdown: "server_shutdown",
+  /**
+   * ErrorCodeDuplicateStream rejects a request for a stream ID that is
+   * already running under the reject duplicate policy, or one with too
+   * many requests already waiting behind it
+   */
+  DuplicateStream: "duplicate_stream",
+  /**
+   * ErrorCodeIntegrity fails a resumed stream whose skipped rows are not
+   * the ones the client received, as when the data changed between runs
+   */
+  Integrity: "integrity_mismatch",
+} as const;
+export type ErrorCode = (typeof ErrorCode)[keyof typeof ErrorCode];
+
+/**
+ * Duplicate policies decide what happens to a request for a stream ID that
+ * is still queued or running. Errors rejecting a request, rather than
+ * failing an execution, carry "rejected": true and no sequence number.
+ */
+export const Duplicate = {
+  /** DuplicateReject rejects the request (default) */
+  Reject: "reject",
+  /**
+   * DuplicateReplace cancels the current execution, which ends with a
+   * cancelled status whose "reason" is "replaced", then runs the request;
+   * it also replaces requests still waiting behind it
+   */
+  Replace: "replace",
+  /**
+   * DuplicateQueue runs the request once the current execution, and any
+   * request already waiting behind it, has ended
+   */
+  Queue: "queue",
+} as const;
+export type Duplicate = (typeof Duplicate)[keyof typeof Duplicate];
+
+/** Refresh modes decide how a subscription's changed results are sent */
+export const Refresh = {
+  /** RefreshFull sends the whole result whenever it changes (default) */
+  Full: "full",
+  /**
+   * RefreshDiff sends the rows added and removed since the previous
+   * result, compared as a multiset so reordered rows are no change
+   */
+  Diff: "diff",
+  /**
+   * RefreshKeyed identifies rows by the request's key columns and sends
+   * the rows inserted and updated and the keys deleted since the previous
+   * result. A result whose keys are not unique fails the refresh.
+   */
+  Keyed: "keyed",
+} as const;
+export type Refresh = (typeof Refresh)[keyof typeof Refresh];
+
+/**
+ * Slow client policies decide what happens to a stream whose rows the
+ * client is not reading fast enough
+ */
+export const SlowClient = {
+  /** SlowClientWait keeps the stream waiting for the client (default) */
+  Wait: "wait",
+  /** SlowClientDrop fails the stream, leaving the connection open */
+  Drop: "drop",
+  /** SlowClientClose disconnects the client */
+  Close: "close",
+} as const;
+export type SlowClient = (typeof SlowClient)[keyof typeof SlowClient];
+
+/** Query priorities decide which queued query a connection runs next */
+export const Priority = {
+  /**
+   * PriorityInteractive is for queries a user is waiting on, such as a
+   * dashboard loading (default)
+   */
+  Interactive: "interactive",
+  /** PriorityExport is for downloads, run once no interactive query waits */
+  Export: "export",
+  /**
+   * PriorityBackground is for work nobody is waiting on, such as
+   * scheduled refreshes
+   */
+  Background: "background",
+} as const;
+export type Priority = (typeof Priority)[keyof typeof Priority];
+
+/** Stream safety caps reported by LimitExceeded */
+export const Limit = {
+  Rows: "rows",
+  Bytes: "bytes",
+} as const;
+export type Limit = (typeof Limit)[keyof typeof Limit];
+
+/** How times are sent, for ValueFormat.Times */
+export const Times = {
+  /** TimesISO8601 sends times as RFC 3339 text, even in binary encodings */
+  ISO8601: "iso8601",
+  /**
+   * TimesUnixMillis sends times as milliseconds since the Unix epoch.
+   * Dates and datetimes without a zone count as UTC, and times of day as
+   * milliseconds since midnight.
+   */
+  UnixMillis: "unix_ms",
+} as const;
+export type Times = (typeof Times)[keyof typeof Times];
+
+/** How arbitrary-precision numbers are sent, for ValueFormat.Numerics */
+export const Numerics = {
+  /** NumericsString sends them as their exact decimal text */
+  String: "string",
+  /**
+   * NumericsNumber sends them as numbers, which JSON carries exactly but
+   * most decoders read as floats
+   */
+  Number: "number",
+  /**
+   * NumericsDecimal sends them as Decimal values: exact text in JSON, and
+   * a decimal type MessagePack and CBOR clients decode without rounding
+   */
+  Decimal: "decimal",
+} as const;
+export type Numerics = (typeof Numerics)[keyof typeof Numerics];
+
+/**
+ * Query parameters a client negotiates its connection's ValueFormat with,
+ * overriding the server's default for the fields it sets
+ */
+export const Value = {
+  TimesParam: "times",
+  NumericsParam: "numerics",
+  PrecisionParam: "precision",
+} as const;
+export type Value = (typeof Value)[keyof typeof Value];
+
+/**
+ * Decimal is an exact decimal number, Mantissa × 10^Exponent, as rows carry
+ * arbitrary-precision numbers in the NumericsDecimal format. JSON sends it
+ * as its text, MessagePack as extension DecimalExtType and CBOR as a
+ * decimal fraction; the binary encodings decode back to a Decimal.
+ */
+export type Decimal = string;
+
+/**
+ * EngineError is the "engine" of an error payload: what the engine said
+ * about an error it raised, as far as it says. Code is the engine's own
+ * name for the error, such as a BigQuery reason or an Athena error type.
+ * Position counts characters of the statement from 1; engines reporting a
+ * Line and Column instead point at the same place.
+ */
+export interface EngineError {
+  code?: string;
+  sqlState?: string;
+  position?: number;
+  line?: number;
+  column?: number;
+  detail?: string;
+  hint?: string;
+}
+
+/** QueryRequest represents a single query execution request */
+export interface QueryRequest {
+  queryId: string;
+  streamId: string;
+  templateData: Record<string, unknown> | null;
+  /**
+   * ParameterSet names a preset saved for the query; its values are used
+   * as template data, with TemplateData keys taking precedence
+   */
+  parameterSet?: string;
+  /**
+   * Verbose asks for trace status messages describing each internal
+   * state transition of the stream
+   */
+  verbose?: boolean;
+  /**
+   * Debug reports a failure with its rendered SQL and its unredacted
+   * error message. Only connections opened with the admin token may set
+   * it.
+   */
+  debug?: boolean;
+  /**
+   * TimeoutMS sets the query's execution deadline in place of the
+   * server's execution timeout, up to the server's maximum. It runs from
+   * when a worker picks the query up, not counting time in the queue.
+   */
+  timeoutMs?: number;
+  /**
+   * CountOnly returns just the number of rows the query produces as a
+   * single "count" column instead of streaming the result set
+   */
+  countOnly?: boolean;
+  /**
+   * Limit and Offset request one page of the result set. Limit 0 means
+   * no limit. The complete message carries "truncated": true when the
+   * result continued past the page.
+   */
+  limit?: number;
+  offset?: number;
+  /**
+   * Preview fetches only the first rows of the result, adding a row limit
+   * to the query so the engine does not read whole tables. PreviewRows
+   * sets how many, defaulting to the server's preview_rows.
+   */
+  preview?: boolean;
+  previewRows?: number;
+  /**
+   * CacheControl decides how the result cache is used: "use" (default)
+   * replays a cached result, "bypass" neither reads nor writes the cache
+   * and "refresh" runs the query and replaces the cached result. Replayed
+   * messages carry "fromCache": true.
+   */
+  cacheControl?: string;
+  /**
+   * CacheBust fetches the query and connector from the metadata store
+   * even when the server's metadata cache holds them, e.g. right after
+   * the query was edited
+   */
+  cacheBust?: boolean;
+  /**
+   * Snapshot stores the full result set in object storage as "csv" or
+   * "parquet" once it completes; the complete message then carries a
+   * "snapshot" object with a signed download URL. SnapshotOnly skips
+   * streaming the rows over the socket.
+   */
+  snapshot?: string;
+  snapshotOnly?: boolean;
+  /**
+   * Priority places the request in the connection's queue: interactive
+   * (default), export or background. Queued requests of a higher
+   * priority start first.
+   */
+  priority?: string;
+  /**
+   * SlowClientPolicy overrides the server's slow client policy for this
+   * stream: wait, drop or close
+   */
+  slowClientPolicy?: string;
+  /**
+   * OnDuplicate is the duplicate policy applied when the stream ID is
+   * still queued or running: reject, replace or queue. It overrides the
+   * server's duplicate_stream_policy.
+   */
+  onDuplicate?: string;
+  /**
+   * Credits enables flow control: the server sends at most this many
+   * rows until the client grants more with a credit message. A credit
+   * message carries the number of additional rows in the same field.
+   */
+  credits?: number;
+  /**
+   * Async asks the driver to return its execution ID as soon as the query
+   * is submitted so the results can be re-attached after a reconnect
+   */
+  async?: boolean;
+  /** ExecutionID identifies the execution an attach request resumes */
+  executionId?: string;
+  /**
+   * BatchChecksums adds to each row message the "checksum" of the
+   * stream's rows up to and including its own, so clients verify rows as
+   * they arrive instead of only at the complete message
+   */
+  batchChecksums?: boolean;
+  /**
+   * ResumeAfterRows resumes a stream whose first rows the client already
+   * received, e.g. before its connection dropped: the query runs again
+   * and those rows are skipped instead of sent. Unless they hash to
+   * ResumeChecksum, the stream fails with ErrorCodeIntegrity, so the rows
+   * received before and after are known to be one result. totalRows and
+   * checksums cover the skipped rows too.
+   */
+  resumeAfterRows?: number;
+  resumeChecksum?: string;
+  /**
+   * Replay re-runs an earlier execution of the query, named by its ID in
+   * the query's history, with the exact SQL and template data it ran
+   * with. TemplateData and ParameterSet are ignored.
+   */
+  replay?: string;
+  /**
+   * QueryVersion runs a saved version of the query instead of its current
+   * template, so dashboards can pin to a tested version while editors
+   * iterate. The metadata message carries the "queryVersion" that ran.
+   */
+  queryVersion?: number;
+  /**
+   * Timezone is the IANA time zone, e.g. "America/New_York", timestamps
+   * are rendered in, overriding the query's default. Engines with a
+   * session time zone (Postgres, BigQuery) also evaluate the query in it,
+   * so casts to dates and truncation follow the dashboard's day.
+   * Timestamps without a zone are taken as UTC.
+   */
+  timezone?: string;
+  /**
+   * ResultReuseMinutes lets engines that keep recent results (Athena)
+   * answer the query with the result of an identical one run at most
+   * this many minutes ago, up to a week, in place of the connector's
+   * result_reuse_minutes; -1 turns reuse off for the query
+   */
+  resultReuseMinutes?: number;
+  /**
+   * JobLabels, JobPriority and MaxBytesBilled set up the job of engines
+   * that run queries as jobs (BigQuery). JobLabels are added to the
+   * connector's, e.g. {"dashboard": "sales-overview"}, with keys and
+   * values of at most 63 lowercase letters, digits, _ and -; the server
+   * adds supalytics_org and supalytics_query itself. JobPriority is
+   * interactive or batch, in place of the connector's. MaxBytesBilled
+   * fails a query that would bill more bytes with
+   * ErrorCodeBillingLimitExceeded; it can lower the connector's limit but
+   * not raise it.
+   */
+  jobLabels?: Record<string, string>;
+  jobPriority?: string;
+  maxBytesBilled?: number;
+  /**
+   * Transforms post-process the rows before they are sent, after the
+   * query's own transforms and after paging: renaming, casting, computed
+   * columns, pivot, unpivot and top-N. They are ignored by countOnly.
+   */
+  transforms?: Transform[];
+  /**
+   * Aggregates return a single row of aggregates computed over the whole
+   * result as it streams, in place of its rows, for summary widgets that
+   * only show a number. Transforms apply first. They cannot be combined
+   * with countOnly, limit, offset or preview.
+   */
+  aggregates?: Aggregate[];
+  /**
+   * Sample thins the rows as they stream, after the transforms, for
+   * charts that cannot draw them all. The complete message carries
+   * "sample" describing the rows seen and sent.
+   */
+  sample?: Sample | null;
+  /**
+   * MaxRows and MaxBytes lower the server's caps on the rows and encoded
+   * row bytes sent for this stream; they cannot raise them. A stream
+   * reaching a cap ends with a complete message carrying
+   * "limitExceeded" instead of sending the rest.
+   */
+  maxRows?: number;
+  maxBytes?: number;
+  /** ConnectorID names the connector a test_connection message checks */
+  connectorId?: string;
+  /**
+   * GroupID names the group of a batch message, which its queries join.
+   * A cancel message with a groupId and no streamId cancels every stream
+   * of the group.
+   */
+  groupId?: string;
+  /**
+   * RefreshIntervalMS is the time between a subscription's runs, from
+   * the end of one to the start of the next; RefreshMode is full, diff
+   * or keyed, which needs KeyColumns
+   */
+  refreshIntervalMs?: number;
+  refreshMode?: string;
+  keyColumns?: string[];
+  /**
+   * NotifyChannel also refreshes a subscription whenever the connector
+   * sends a notification on the channel, such as a Postgres NOTIFY from
+   * a trigger. Notifications closer together than the server's minimum
+   * refresh interval are coalesced. RefreshIntervalMS may then be zero,
+   * to refresh on notifications only.
+   */
+  notifyChannel?: string;
+}
+
+/**
+ * Transform is one post-processing step of a query request. Op is rename
+ * (Names maps old column names to new), cast (Types maps columns to string,
+ * number, integer or boolean), compute (adds column Name holding Expr, e.g.
+ * "revenue - cost"), pivot (values of Column become columns holding Value,
+ * a row per distinct Index), unpivot (Columns become Name and Value rows)
+ * or top (the first N rows, or the N largest By a column when Descending).
+ */
+export interface Transform {
+  op: string;
+  names?: Record<string, string>;
+  types?: Record<string, string>;
+  name?: string;
+  expr?: string;
+  index?: string[];
+  column?: string;
+  value?: string;
+  columns?: string[];
+  n?: number;
+  by?: string;
+  desc?: boolean;
+}
+
+/**
+ * Aggregate is one value of an aggregate request: Fn (count, sum, min, max
+ * or avg) over Column, returned in the column As, by default Fn_Column or
+ * just "count" when counting rows. Nulls are skipped.
+ */
+export interface Aggregate {
+  fn: string;
+  column?: string;
+  as?: string;
+}
+
+/**
+ * Sample selects the rows of a sampled request: every Every-th row starting
+ * with the first, or a uniform random sample of Size rows kept in streamed
+ * order. A non-zero Seed makes the random sample repeatable.
+ */
+export interface Sample {
+  every?: number;
+  size?: number;
+  seed?: number;
+}
+
+/**
+ * SampleInfo is the "sample" of a complete message: the method used (every
+ * or reservoir), the rows the query produced and the rows sent
+ */
+export interface SampleInfo {
+  method: string;
+  rowsSeen: number;
+  rowsSampled: number;
+}
+
+/**
+ * LimitExceeded is the "limitExceeded" of a complete message for a stream
+ * stopped at a safety cap: Limit is rows or bytes and Max the cap. The rows
+ * sent before the cap are complete; bytes may overshoot Max by the last row.
+ */
+export interface LimitExceeded {
+  limit: string;
+  max: number;
+}
+
+/** ConnectionTest is the result of checking a connector can be reached */
+export interface ConnectionTest {
+  connectorId: string;
+  /** "connected" or "error" */
+  status: string;
+  error?: string;
+  latencyMs: number;
+  checkedAt: string;
+}
+
+/**
+ * ExecutionRecord is a past execution listed in a query's history.
+ * RenderedSQL and TemplateData are omitted from other users' executions.
+ */
+export interface ExecutionRecord {
+  executionId: string;
+  queryId: string;
+  connectorId?: string;
+  streamId: string;
+  userId?: string;
+  status: string;
+  error?: string;
+  rowsSent: number;
+  bytesScanned?: number;
+  queuedAt: string;
+  startedAt: string;
+  finishedAt: string;
+  renderedSql?: string;
+  templateData?: unknown;
+  replayOf?: string;
+  queryVersion?: number;
+  slow?: boolean;
+}
+
+/**
+ * PrewarmedQuery is a query executed ahead of time into the result cache,
+ * as declared with POST /api/v1/prewarms and listed with GET. Executions
+ * with the same parameter set, template data and time zone are served from
+ * the cache. IntervalSeconds re-executes it on a schedule; without one it
+ * is executed when declared and, with onStartup, when an executor starts.
+ * LastRunAt, LastError and LastRows report this executor's latest run.
+ */
+export interface PrewarmedQuery {
+  id: string;
+  queryId: string;
+  parameterSet?: string;
+  templateData?: Record<string, unknown>;
+  timezone?: string;
+  intervalSeconds?: number;
+  onStartup?: boolean;
+  createdAt: string;
+  lastRunAt?: string | null;
+  lastError?: string;
+  lastRows?: number;
+}
+
+/**
+ * CancelRequest represents a request to cancel a running query, or every
+ * query of a group
+ */
+export interface CancelRequest {
+  streamId: string;
+  groupId?: string;
+}
+
+/**
+ * ClientMessage is the envelope for every message sent by a client.
+ * An empty Type is treated as a query request for backwards compatibility.
+ */
+export interface ClientMessage extends QueryRequest {
+  type?: MessageType;
+  /** Token is the access token of an auth message */
+  token?: string;
+  /** Queries are the requests of a batch message */
+  queries?: QueryRequest[];
+}
+
+/** WSMessage represents the standardized message format sent by the server */
+export interface WSMessage {
+  type: MessageType;
+  streamId: string;
+  /**
+   * Seq numbers a stream's messages from 1 in the order they are sent, so
+   * clients can detect gaps and duplicates. Messages without a stream
+   * carry no sequence number.
+   */
+  seq?: number;
+  payload?: Record<string, unknown>;
+}
+
+/** QueryMetadata represents the metadata about a query execution */
+export interface QueryMetadata {
+  totalRows: number;
+  columns: string[] | null;
+  /**
+   * Nullable says, for each column, whether the engine allows it to hold
+   * nulls, so a null can be told from a zero or an empty string that was
+   * really returned. Entries are null for columns the engine does not
+   * declare, and the field is left out when it declares none.
+   */
+  nullable?: (boolean | null)[];
+  /**
+   * Scales gives, for each fixed-point numeric column, the number of
+   * decimal places its values are exact to, so a client can render them
+   * without floating point drift. Entries are null for other columns,
+   * and the field is left out when there are none.
+   */
+  scales?: (number | null)[];
+}
+
+/**
+ * ValueFormat is how rows represent values their encoding has no type for,
+ * so each driver's times and numbers reach clients alike. The zero value
+ * sends times as each encoding does (RFC 3339 text in JSON, native
+ * timestamps in MessagePack and CBOR) and arbitrary-precision numbers as
+ * exact decimal text. Numbers of a column the engine declares a scale for
+ * are written with that many decimal places. Floats that are not finite
+ * are always sent as "NaN", "Infinity" or "-Infinity", which JSON has no
+ * numbers for.
+ */
+export interface ValueFormat {
+  times?: string;
+  numerics?: string;
+  /**
+   * Precision rounds fractional numbers to this many decimal places; 0
+   * leaves them as the engine returned them, at the column's scale
+   */
+  precision?: number;
+}